@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type accessEntry struct {
+	Time       time.Time `json:"ts"`
+	RequestID  string    `json:"request_id"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Key        string    `json:"key,omitempty"`
+	Status     int       `json:"status"`
+	DurationUs int64     `json:"duration_us"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	Cache      string    `json:"cache,omitempty"`
+	RunID      string    `json:"run_id,omitempty"`
+}
+
+type accessLogStats struct {
+	Written int64 `json:"written"`
+	Dropped int64 `json:"dropped"`
+	Rotated int64 `json:"rotated"`
+}
+
+// accessLogger writes one JSON line per sampled request. Handlers only
+// enqueue; a single goroutine encodes and writes, and entries are dropped
+// (and counted) rather than blocking when the queue is full.
+type accessLogger struct {
+	path     string
+	sample   float64
+	hashKeys bool
+	maxBytes int64
+
+	entries chan accessEntry
+	done    chan struct{}
+
+	idPrefix string
+	nextID   int64
+
+	written int64
+	dropped int64
+	rotated int64
+}
+
+func newAccessLogger(path string, sample float64, hashKeys bool, maxBytes int64) (*accessLogger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	var prefix [4]byte
+	rand.Read(prefix[:])
+	l := &accessLogger{
+		path:     path,
+		sample:   sample,
+		hashKeys: hashKeys,
+		maxBytes: maxBytes,
+		entries:  make(chan accessEntry, 8192),
+		done:     make(chan struct{}),
+		idPrefix: hex.EncodeToString(prefix[:]),
+	}
+	go l.run(f)
+	return l, nil
+}
+
+func (l *accessLogger) run(f *os.File) {
+	defer close(l.done)
+	size := int64(0)
+	if fi, err := f.Stat(); err == nil {
+		size = fi.Size()
+	}
+	w := bufio.NewWriterSize(f, 64<<10)
+
+	for e := range l.entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		line = append(line, '\n')
+		if l.maxBytes > 0 && size > 0 && size+int64(len(line)) > l.maxBytes {
+			w.Flush()
+			if nf, err := l.rotate(f); err != nil {
+				log.Printf("Access log rotation failed: %v", err)
+			} else {
+				f, size = nf, 0
+				w.Reset(f)
+			}
+		}
+		n, _ := w.Write(line)
+		size += int64(n)
+		atomic.AddInt64(&l.written, 1)
+		if len(l.entries) == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+	f.Close()
+}
+
+// rotate keeps a single previous generation as path.1.
+func (l *accessLogger) rotate(f *os.File) (*os.File, error) {
+	f.Close()
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&l.rotated, 1)
+	return os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+// Close flushes queued entries; no request may be logged afterwards.
+func (l *accessLogger) Close() {
+	close(l.entries)
+	<-l.done
+}
+
+func (l *accessLogger) stats() *accessLogStats {
+	if l == nil {
+		return nil
+	}
+	return &accessLogStats{
+		Written: atomic.LoadInt64(&l.written),
+		Dropped: atomic.LoadInt64(&l.dropped),
+		Rotated: atomic.LoadInt64(&l.rotated),
+	}
+}
+
+// keyFor returns the key path names and the path to log; with hashKeys
+// both carry the hash, so the key itself never reaches the log.
+func (l *accessLogger) keyFor(path string) (key, logged string) {
+	for _, prefix := range []string{"/kv/", "/cache/"} {
+		if strings.HasPrefix(path, prefix) {
+			key = strings.TrimPrefix(path, prefix)
+			break
+		}
+	}
+	if key == "" || !l.hashKeys {
+		return key, path
+	}
+	hashed := hashKey(key)
+	return hashed, path[:len(path)-len(key)] + hashed
+}
+
+// hashKey is what -access-log-hash-keys logs in place of key.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *accessRecorder) WriteString(s string) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := io.WriteString(r.ResponseWriter, s)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection for flushes
+// and deadlines.
+func (r *accessRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (l *accessLogger) middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.sample < 1 && mrand.Float64() >= l.sample {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = l.idPrefix + "-" + strconv.FormatInt(atomic.AddInt64(&l.nextID, 1), 10)
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		rec := &accessRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		key, path := l.keyFor(r.URL.Path)
+		e := accessEntry{
+			Time:       start.UTC(),
+			RequestID:  id,
+			Method:     r.Method,
+			Path:       path,
+			Key:        key,
+			Status:     rec.status,
+			DurationUs: time.Since(start).Microseconds(),
+			BytesIn:    max(r.ContentLength, 0),
+			BytesOut:   rec.bytes,
+			Cache:      w.Header().Get("X-Cache"),
+			RunID:      r.Header.Get("X-Run-ID"),
+		}
+		select {
+		case l.entries <- e:
+		default:
+			atomic.AddInt64(&l.dropped, 1)
+		}
+	})
+}
+
+func validateAccessLogSample(sample float64) error {
+	if sample <= 0 || sample > 1 {
+		return fmt.Errorf("-access-log-sample must be in (0, 1], got %g", sample)
+	}
+	return nil
+}
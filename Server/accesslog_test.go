@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readAccessLog parses every line of the log at path.
+func readAccessLog(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []map[string]any
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("access log line %q: %v", sc.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestAccessLogFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLogger(path, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(NewMemStore())
+	s.accessLog = l
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	requests := []struct {
+		method, path, body string
+		status             int
+		key, cache         string
+	}{
+		{"PUT", "/kv/k", "value", http.StatusOK, "k", ""},
+		{"GET", "/kv/k", "", http.StatusOK, "k", "HIT"},
+		{"GET", "/kv/missing", "", http.StatusNotFound, "missing", "MISS"},
+		{"PATCH", "/kv/k", "", http.StatusMethodNotAllowed, "k", ""},
+		{"GET", "/kv/?limit=0", "", http.StatusBadRequest, "", ""},
+		{"DELETE", "/kv/k", "", http.StatusOK, "k", ""},
+		{"GET", "/stats", "", http.StatusOK, "", ""},
+	}
+	for _, req := range requests {
+		status, _, h := do(t, req.method, ts.URL+req.path, req.body, "X-Run-ID", "run-1")
+		if status != req.status {
+			t.Fatalf("%s %s: status %d, want %d", req.method, req.path, status, req.status)
+		}
+		if h.Get("X-Request-ID") == "" {
+			t.Errorf("%s %s: no X-Request-ID", req.method, req.path)
+		}
+	}
+	do(t, "GET", ts.URL+"/kv/k", "", "X-Request-ID", "from-client")
+	l.Close()
+
+	lines := readAccessLog(t, path)
+	if len(lines) != len(requests)+1 {
+		t.Fatalf("%d access log lines for %d requests", len(lines), len(requests)+1)
+	}
+	for i, req := range requests {
+		line := lines[i]
+		for _, field := range []string{"ts", "request_id", "method", "path", "status", "duration_us", "bytes_in", "bytes_out", "run_id"} {
+			if _, ok := line[field]; !ok {
+				t.Errorf("%s %s: no %s in %v", req.method, req.path, field, line)
+			}
+		}
+		if line["method"] != req.method || line["status"] != float64(req.status) {
+			t.Errorf("%s %s logged as %v %v", req.method, req.path, line["method"], line["status"])
+		}
+		if got, _ := line["key"].(string); got != req.key {
+			t.Errorf("%s %s: key %q, want %q", req.method, req.path, got, req.key)
+		}
+		if got, _ := line["cache"].(string); got != req.cache {
+			t.Errorf("%s %s: cache %q, want %q", req.method, req.path, got, req.cache)
+		}
+	}
+	if lines[0]["bytes_in"] != float64(len("value")) || lines[1]["bytes_out"] != float64(len("value")) {
+		t.Errorf("PUT bytes_in %v, GET bytes_out %v; want %d", lines[0]["bytes_in"], lines[1]["bytes_out"], len("value"))
+	}
+	if got := lines[len(lines)-1]["request_id"]; got != "from-client" {
+		t.Errorf("request_id = %v, want the client's X-Request-ID", got)
+	}
+	if st := l.stats(); st.Written != int64(len(lines)) || st.Dropped != 0 {
+		t.Errorf("stats %+v for %d lines", st, len(lines))
+	}
+}
+
+func TestAccessLogHashesKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLogger(path, 1, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(NewMemStore())
+	s.accessLog = l
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	do(t, "GET", ts.URL+"/kv/secret-key", "")
+	l.Close()
+
+	lines := readAccessLog(t, path)
+	if len(lines) != 1 || lines[0]["key"] != hashKey("secret-key") || lines[0]["path"] != "/kv/"+hashKey("secret-key") {
+		t.Fatalf("logged %v, want the key hashed", lines)
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "secret-key") {
+		t.Errorf("the key appears in the log unhashed: %s", data)
+	}
+}
+
+func TestAccessLogRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLogger(path, 1, false, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for range 50 {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/kv/k", nil))
+	}
+	l.Close()
+
+	st := l.stats()
+	if st.Rotated == 0 {
+		t.Fatalf("50 entries in a 1000 byte log never rotated")
+	}
+	for _, p := range []string{path, path + ".1"} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 1000 {
+			t.Errorf("%s is %d bytes, over the 1000 byte limit", p, fi.Size())
+		}
+	}
+}
+
+func TestAccessLogSampleAndDrop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLogger(path, 0.1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for range 2000 {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/kv/k", nil))
+	}
+	l.Close()
+	if n := len(readAccessLog(t, path)); n < 100 || n > 300 {
+		t.Errorf("sample 0.1 logged %d of 2000 requests", n)
+	}
+
+	// With the writer stalled, a full queue drops entries instead of
+	// holding up the request.
+	stalled := &accessLogger{sample: 1, entries: make(chan accessEntry, 1)}
+	h = stalled.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for range 3 {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/kv/k", nil))
+	}
+	if st := stalled.stats(); st.Dropped != 2 {
+		t.Errorf("%d entries dropped with a one entry queue, want 2", st.Dropped)
+	}
+}
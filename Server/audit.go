@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxAuditSample = 100_000
+	// auditHistory is how many audit summaries /stats keeps.
+	auditHistory = 20
+	// auditProgressEvery is how many keys an audit checks between
+	// progress lines.
+	auditProgressEvery = 100
+)
+
+// Mismatch types an audit reports, from most to least serious.
+const (
+	auditMissing = "missing"
+	auditValue   = "value"
+	auditVersion = "version_behind"
+	// auditSkipped is for keys whose entry changed during the check.
+	auditSkipped = "skipped"
+)
+
+type auditMismatch struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+}
+
+type auditProgress struct {
+	Sampled int `json:"sampled"`
+	Checked int `json:"checked"`
+	// Skipped counts keys written, deleted or evicted while they were
+	// being checked, whose cache entry could no longer be compared.
+	Skipped    int            `json:"skipped"`
+	Errors     int            `json:"errors"`
+	Mismatches map[string]int `json:"mismatches"`
+	Repaired   int            `json:"repaired,omitempty"`
+	Done       bool           `json:"done,omitempty"`
+	ElapsedMs  int64          `json:"elapsed_ms"`
+	Error      string         `json:"error,omitempty"`
+	// Examples are the first mismatched keys, on the last line only.
+	Examples []auditMismatch `json:"examples,omitempty"`
+}
+
+// auditSummary is what /stats keeps of a finished audit.
+type auditSummary struct {
+	Start        time.Time          `json:"start"`
+	DurationMs   int64              `json:"duration_ms"`
+	Repair       bool               `json:"repair"`
+	Checked      int                `json:"checked"`
+	Skipped      int                `json:"skipped"`
+	Errors       int                `json:"errors"`
+	Mismatches   map[string]int     `json:"mismatches"`
+	MismatchRate map[string]float64 `json:"mismatch_rate_pct"`
+	Repaired     int                `json:"repaired,omitempty"`
+	Interrupted  bool               `json:"interrupted,omitempty"`
+}
+
+// auditLog keeps the latest audit summaries and lets one audit run at a
+// time.
+type auditLog struct {
+	running atomic.Bool
+	mu      sync.Mutex
+	recent  []auditSummary
+}
+
+func (l *auditLog) add(s auditSummary) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.recent) == auditHistory {
+		l.recent = append(l.recent[:0], l.recent[1:]...)
+	}
+	l.recent = append(l.recent, s)
+}
+
+func (l *auditLog) stats() []auditSummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]auditSummary(nil), l.recent...)
+}
+
+// SampleKeys reservoir-samples up to n keys of live, non-tombstone
+// entries.
+func (c *Cache) SampleKeys(n int) []string {
+	now := c.now()
+	sample := make([]string, 0, n)
+	seen := 0
+	c.each(func(k string, e cacheEntry) {
+		if e.tombstone != "" || e.expired(now) {
+			return
+		}
+		seen++
+		if len(sample) < n {
+			sample = append(sample, k)
+		} else if i := rand.IntN(seen); i < n {
+			sample[i] = k
+		}
+	})
+	return sample
+}
+
+// auditHandler serves POST /admin/audit?sample=N&rate=R&repair=true. It
+// compares a random sample of the read-through cache's entries with the
+// store, reading at most R keys per second so it can run under load, and
+// streams progress as one JSON line per auditProgressEvery keys. With
+// repair, mismatched entries are evicted so the next read refills them.
+func (s *Server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	n, rate := 1000, 100.0
+	var repair bool
+	var err error
+	if v := q.Get("sample"); v != "" {
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 || n > maxAuditSample {
+			http.Error(w, "sample must be between 1 and "+strconv.Itoa(maxAuditSample), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("rate"); v != "" {
+		if rate, err = strconv.ParseFloat(v, 64); err != nil || rate <= 0 {
+			http.Error(w, "rate must be a positive number of keys per second", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("repair"); v != "" {
+		if repair, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "repair must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	if !s.audits.running.CompareAndSwap(false, true) {
+		http.Error(w, "An audit is already running", http.StatusConflict)
+		return
+	}
+	defer s.audits.running.Store(false)
+
+	// An audit outlasts -write-timeout; progress lines keep the
+	// connection busy instead.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	progress := s.audit(r.Context(), n, rate, repair, func(p auditProgress) {
+		enc.Encode(p)
+		rc.Flush()
+	})
+	enc.Encode(progress)
+}
+
+// audit checks a sample of n cache entries against the store at up to
+// rate keys per second (0 for no limit), records the summary for /stats
+// and returns the final progress. progress, if not nil, is called every
+// auditProgressEvery keys.
+func (s *Server) audit(ctx context.Context, n int, rate float64, repair bool, progress func(auditProgress)) auditProgress {
+	start := time.Now()
+	keys := s.cache.SampleKeys(n)
+	res := auditProgress{Sampled: len(keys), Mismatches: make(map[string]int)}
+	var examples []auditMismatch
+
+	var tick <-chan time.Time
+	if rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer t.Stop()
+		tick = t.C
+	}
+	for i, key := range keys {
+		if i > 0 && tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			res.Error = "cancelled"
+			break
+		}
+		kind, err := s.auditKey(ctx, key)
+		switch {
+		case err != nil:
+			res.Errors++
+		case kind == "":
+			res.Checked++
+		case kind == auditSkipped:
+			res.Skipped++
+		default:
+			res.Checked++
+			res.Mismatches[kind]++
+			if len(examples) < 10 {
+				examples = append(examples, auditMismatch{key, kind})
+			}
+			if repair {
+				s.cache.Delete(key)
+				res.Repaired++
+			}
+		}
+		if (i+1)%auditProgressEvery == 0 && progress != nil {
+			res.ElapsedMs = time.Since(start).Milliseconds()
+			progress(res)
+		}
+	}
+	res.Done = res.Error == ""
+	res.Examples = examples
+	res.ElapsedMs = time.Since(start).Milliseconds()
+
+	summary := auditSummary{
+		Start:        start.Round(0),
+		DurationMs:   res.ElapsedMs,
+		Repair:       repair,
+		Checked:      res.Checked,
+		Skipped:      res.Skipped,
+		Errors:       res.Errors,
+		Mismatches:   res.Mismatches,
+		MismatchRate: make(map[string]float64),
+		Repaired:     res.Repaired,
+		Interrupted:  !res.Done,
+	}
+	for _, kind := range []string{auditMissing, auditValue, auditVersion} {
+		if res.Checked > 0 {
+			summary.MismatchRate[kind] = float64(res.Mismatches[kind]) / float64(res.Checked) * 100
+		}
+	}
+	s.audits.add(summary)
+	log.Printf("Audited %d cached keys in %s: %d missing from the store, %d with another value, %d behind its version, %d repaired",
+		res.Checked, time.Since(start).Round(time.Millisecond),
+		res.Mismatches[auditMissing], res.Mismatches[auditValue], res.Mismatches[auditVersion], res.Repaired)
+	return res
+}
+
+// auditKey compares key's cache entry with the store and returns the
+// mismatch type, "" if they agree, or auditSkipped if the entry changed
+// while the store was read.
+func (s *Server) auditKey(ctx context.Context, key string) (string, error) {
+	token := s.cache.FillToken(key)
+	e, ok := s.cache.lookup(key)
+	if !ok || e.tombstone != "" {
+		return auditSkipped, nil
+	}
+	value, err := s.store.Get(ctx, key)
+	var modified time.Time
+	if err == nil && e.version != 0 {
+		modified, err = version(ctx, s.store, key)
+		if errors.Is(err, errNoVersions) {
+			err = nil
+		}
+	}
+	if s.cache.FillToken(key) != token {
+		return auditSkipped, nil
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return auditMissing, nil
+	case err != nil:
+		return "", err
+	case value != e.value:
+		return auditValue, nil
+	case !modified.IsZero() && modified.UnixMicro() > e.version:
+		return auditVersion, nil
+	}
+	return "", nil
+}
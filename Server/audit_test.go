@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runAudit posts an audit and returns its progress lines, the final
+// one last.
+func runAudit(t *testing.T, url string) []auditProgress {
+	t.Helper()
+	status, body, h := do(t, "POST", url, "")
+	if status != http.StatusOK || h.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("POST %s: status %d, Content-Type %q (%s)", url, status, h.Get("Content-Type"), body)
+	}
+	var lines []auditProgress
+	dec := json.NewDecoder(strings.NewReader(body))
+	for dec.More() {
+		var p auditProgress
+		if err := dec.Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, p)
+	}
+	return lines
+}
+
+func TestAuditFindsAndRepairsMismatches(t *testing.T) {
+	store := NewMemStore()
+	s := newTestServer(store)
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	ctx := context.Background()
+	const n = 250
+	for i := range n {
+		k := fmt.Sprint("k", i)
+		store.Put(ctx, k, "v")
+		// Read with a staleness bound so the entry carries its version.
+		do(t, "GET", ts.URL+"/kv/"+k, "", "X-Max-Staleness", "1h")
+	}
+	time.Sleep(time.Millisecond)
+	// Behind the cache's back: 5 keys deleted, 10 changed, 15 rewritten
+	// with the same value.
+	for i := range 5 {
+		store.Delete(ctx, fmt.Sprint("k", i))
+	}
+	for i := 5; i < 15; i++ {
+		store.Put(ctx, fmt.Sprint("k", i), "changed")
+	}
+	for i := 15; i < 30; i++ {
+		store.Put(ctx, fmt.Sprint("k", i), "v")
+	}
+
+	lines := runAudit(t, ts.URL+"/admin/audit?sample=1000&rate=100000")
+	if len(lines) != 3 {
+		t.Fatalf("%d progress lines for %d keys, want one per %d and a final one", len(lines), n, auditProgressEvery)
+	}
+	if lines[0].Checked != auditProgressEvery || lines[0].Done {
+		t.Errorf("first progress line %+v", lines[0])
+	}
+	final := lines[len(lines)-1]
+	want := map[string]int{auditMissing: 5, auditValue: 10, auditVersion: 15}
+	if !final.Done || final.Sampled != n || final.Checked != n || final.Repaired != 0 || fmt.Sprint(final.Mismatches) != fmt.Sprint(want) {
+		t.Fatalf("audit = %+v, want mismatches %v", final, want)
+	}
+	if len(final.Examples) != 10 {
+		t.Errorf("%d examples, want the first 10", len(final.Examples))
+	}
+	if _, ok := s.cache.Peek("k0"); !ok {
+		t.Error("audit without repair evicted a mismatched entry")
+	}
+
+	lines = runAudit(t, ts.URL+"/admin/audit?repair=true&rate=100000")
+	if final := lines[len(lines)-1]; final.Repaired != 30 {
+		t.Errorf("repairing audit = %+v, want 30 repaired", final)
+	}
+	for i := range 30 {
+		if _, ok := s.cache.Peek(fmt.Sprint("k", i)); ok {
+			t.Fatalf("k%d still cached after the repair", i)
+		}
+	}
+	lines = runAudit(t, ts.URL+"/admin/audit?rate=100000")
+	if final := lines[len(lines)-1]; len(final.Mismatches) != 0 || final.Checked != n-30 {
+		t.Errorf("audit after the repair = %+v, want %d clean keys", final, n-30)
+	}
+
+	history := s.audits.stats()
+	if len(history) != 3 || !history[1].Repair || history[0].MismatchRate[auditValue] != 4 || history[2].MismatchRate[auditValue] != 0 {
+		t.Errorf("audit history %+v", history)
+	}
+}
+
+func TestAuditThrottleAndLimits(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	for i := range 10 {
+		do(t, "PUT", ts.URL+fmt.Sprint("/kv/k", i), "v")
+	}
+
+	start := time.Now()
+	runAudit(t, ts.URL+"/admin/audit?rate=50")
+	// Ten keys at 50 a second take nine intervals of 20ms.
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("audit of 10 keys at 50/s took %s", elapsed)
+	}
+
+	for _, q := range []string{"sample=0", "sample=100001", "rate=0", "rate=x", "repair=maybe"} {
+		if status, _, _ := do(t, "POST", ts.URL+"/admin/audit?"+q, ""); status != http.StatusBadRequest {
+			t.Errorf("POST /admin/audit?%s: status %d, want 400", q, status)
+		}
+	}
+	s.audits.running.Store(true)
+	if status, _, _ := do(t, "POST", ts.URL+"/admin/audit", ""); status != http.StatusConflict {
+		t.Errorf("second concurrent audit: status %d, want 409", status)
+	}
+}
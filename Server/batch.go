@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const maxBatchEntries = 1000
+
+type batchPutRequest struct {
+	Entries []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"entries"`
+}
+
+type batchPutResponse struct {
+	Stored  int `json:"stored"`
+	Created int `json:"created"`
+	// Deduplicated counts the entries dropped by ?dedupe=last.
+	Deduplicated int `json:"deduplicated,omitempty"`
+}
+
+type batchDuplicatesResponse struct {
+	Error         string   `json:"error"`
+	DuplicateKeys []string `json:"duplicate_keys"`
+}
+
+// handleBatchPut stores up to maxBatchEntries values with one PutMany.
+// An empty batch succeeds, which lets clients probe for the endpoint.
+// A batch with the same key twice is rejected with 422 listing the keys,
+// unless ?dedupe=last asks for only the last entry of each key to be
+// stored.
+func (s *Server) handleBatchPut(w http.ResponseWriter, r *http.Request) {
+	dedupe := r.URL.Query().Get("dedupe")
+	if dedupe != "" && dedupe != "last" {
+		http.Error(w, "dedupe must be last", http.StatusBadRequest)
+		return
+	}
+	markStage(r.Context(), stageBody)
+	var req batchPutRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.maxValueBytes)).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Batch too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		}
+		return
+	}
+	if len(req.Entries) > maxBatchEntries {
+		http.Error(w, "Too many entries in batch", http.StatusBadRequest)
+		return
+	}
+
+	entries := make([]KeyValue, len(req.Entries))
+	for i, e := range req.Entries {
+		if e.Key == "" {
+			http.Error(w, "Key is missing", http.StatusBadRequest)
+			return
+		}
+		if s.keyTooLong(w, e.Key) {
+			return
+		}
+		entries[i] = KeyValue{Key: e.Key, Value: e.Value}
+	}
+	var resp batchPutResponse
+	if dups := duplicateKeys(entries); len(dups) > 0 {
+		if dedupe == "" {
+			writeJSON(w, http.StatusUnprocessableEntity, batchDuplicatesResponse{
+				Error:         "Batch has the same key more than once; send ?dedupe=last to keep the last entry of each",
+				DuplicateKeys: dups,
+			})
+			return
+		}
+		entries = lastWins(entries)
+		resp.Deduplicated = len(req.Entries) - len(entries)
+	}
+	old := make([]int64, len(entries))
+	for i, e := range entries {
+		old[i] = s.cachedSize(e.Key)
+	}
+	if s.overQuotaBatch(w, entries, old) {
+		return
+	}
+	if len(entries) > 0 {
+		if s.keys != nil {
+			for _, e := range entries {
+				defer s.keys.adding(e.Key)()
+			}
+		}
+		markStage(r.Context(), stageStore)
+		created, err := s.store.PutMany(r.Context(), entries)
+		if errors.Is(err, ErrDuplicateKeys) {
+			http.Error(w, "Batch has the same key more than once", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			s.dbError(w)
+			return
+		}
+		for i, c := range created {
+			if c {
+				resp.Created++
+			}
+			s.quota.written(entries[i].Key, int64(len(entries[i].Value)), old[i], c)
+		}
+	}
+
+	for _, e := range entries {
+		s.optimal.recordPut(e.Key)
+		if s.streamThreshold > 0 && int64(len(e.Value)) > s.streamThreshold {
+			s.cache.Delete(e.Key)
+		} else {
+			s.cache.Set(e.Key, e.Value)
+		}
+	}
+	resp.Stored = len(entries)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// duplicateKeys returns each key that appears more than once in entries,
+// in the order of their first appearance.
+func duplicateKeys(entries []KeyValue) []string {
+	seen := make(map[string]int, len(entries))
+	var dups []string
+	for _, e := range entries {
+		seen[e.Key]++
+		if seen[e.Key] == 2 {
+			dups = append(dups, e.Key)
+		}
+	}
+	return dups
+}
+
+// lastWins keeps only the last entry for each key, at its own position
+// relative to the others, as the group-commit batcher does.
+func lastWins(entries []KeyValue) []KeyValue {
+	last := make(map[string]int, len(entries))
+	for i, e := range entries {
+		last[e.Key] = i
+	}
+	kept := make([]KeyValue, 0, len(last))
+	for i, e := range entries {
+		if last[e.Key] == i {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
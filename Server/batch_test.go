@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestBatchDuplicateKeys(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	do(t, "PUT", ts.URL+"/kv/a", "old")
+	do(t, "GET", ts.URL+"/kv/a", "")
+	body := `{"entries":[{"key":"a","value":"1"},{"key":"b","value":"1"},{"key":"c","value":"1"},{"key":"b","value":"2"},{"key":"a","value":"2"},{"key":"a","value":"3"}]}`
+
+	status, resp, _ := do(t, "POST", ts.URL+"/kv/", body)
+	var dups batchDuplicatesResponse
+	json.Unmarshal([]byte(resp), &dups)
+	if status != http.StatusUnprocessableEntity || !slices.Equal(dups.DuplicateKeys, []string{"b", "a"}) {
+		t.Fatalf("batch with repeated keys: status %d, duplicates %v; want 422 listing b, a", status, dups.DuplicateKeys)
+	}
+	for k, want := range map[string]int{"a": http.StatusOK, "b": http.StatusNotFound, "c": http.StatusNotFound} {
+		if status, body, _ := do(t, "GET", ts.URL+"/kv/"+k, ""); status != want || (k == "a" && body != "old") {
+			t.Errorf("GET %s after a rejected batch: status %d (%q), want %d", k, status, body, want)
+		}
+	}
+
+	if status, _, _ := do(t, "POST", ts.URL+"/kv/?dedupe=first", body); status != http.StatusBadRequest {
+		t.Errorf("dedupe=first: status %d, want 400", status)
+	}
+
+	status, resp, _ = do(t, "POST", ts.URL+"/kv/?dedupe=last", body)
+	var stored batchPutResponse
+	json.Unmarshal([]byte(resp), &stored)
+	if status != http.StatusOK || stored != (batchPutResponse{Stored: 3, Created: 2, Deduplicated: 3}) {
+		t.Fatalf("dedupe=last: status %d, %+v; want 3 stored, 2 created, 3 deduplicated", status, stored)
+	}
+	for k, want := range map[string]string{"a": "3", "b": "2", "c": "1"} {
+		v, _ := s.store.Get(context.Background(), k)
+		cached, ok := s.cache.Peek(k)
+		if v != want || !ok || cached != want {
+			t.Errorf("%s: stored %q, cached %q (%v); want %q in both", k, v, cached, ok, want)
+		}
+	}
+}
+
+// dupSlipStore fails every PutMany as Postgres fails a batch with a
+// repeated key.
+type dupSlipStore struct{ Store }
+
+func (dupSlipStore) PutMany(ctx context.Context, entries []KeyValue) ([]bool, error) {
+	return nil, duplicateKeysError(&pgconn.PgError{Code: cardinalityViolation, Message: "ON CONFLICT DO UPDATE command cannot affect row a second time"})
+}
+
+func TestBatchDuplicateFromStore(t *testing.T) {
+	if _, err := NewMemStore().PutMany(context.Background(), []KeyValue{{"a", "1"}, {"a", "2"}}); !errors.Is(err, ErrDuplicateKeys) {
+		t.Errorf("MemStore.PutMany with a repeated key: %v, want ErrDuplicateKeys", err)
+	}
+	other := &pgconn.PgError{Code: "23505"}
+	if err := duplicateKeysError(other); err != other {
+		t.Errorf("duplicateKeysError changed an unrelated error to %v", err)
+	}
+
+	s := newTestServer(dupSlipStore{NewMemStore()})
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	status, body, _ := do(t, "POST", ts.URL+"/kv/", `{"entries":[{"key":"a","value":"1"}]}`)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("batch the store rejects for a repeated key: status %d (%s), want 422", status, body)
+	}
+	if _, ok := s.cache.Peek("a"); ok {
+		t.Error("a cached from a batch the store rejected")
+	}
+}
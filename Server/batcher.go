@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type flushReason int
+
+const (
+	flushSize flushReason = iota
+	flushWindow
+	numFlushReasons
+)
+
+type pendingPut struct {
+	key   string
+	value string
+	done  chan putResult
+}
+
+type putResult struct {
+	created bool
+	err     error
+}
+
+// putBatcher implements group commit: PUTs arriving within window of the
+// first one (or until maxRows) are written with a single PutMany and every
+// waiter gets the shared outcome. Batches are written one at a time, so a
+// later PUT to a key never lands before an earlier one. The batcher also
+// puts the values it wrote in the cache before waking the waiters: a batch
+// stores only the last of several PUTs to a key, and waiters filling the
+// cache themselves would race each other and the next batch.
+type putBatcher struct {
+	store   Store
+	cache   *Cache
+	window  time.Duration
+	maxRows int
+	pending chan pendingPut
+
+	batches      int64
+	rows         int64
+	maxBatchRows int64
+	failed       int64
+	flushes      [numFlushReasons]int64
+}
+
+type batcherStats struct {
+	Batches      int64   `json:"batches"`
+	Rows         int64   `json:"rows"`
+	AvgBatchRows float64 `json:"avg_batch_rows"`
+	MaxBatchRows int64   `json:"max_batch_rows"`
+	Failed       int64   `json:"failed_batches"`
+	FlushSize    int64   `json:"flush_size"`
+	FlushWindow  int64   `json:"flush_window"`
+}
+
+func newPutBatcher(store Store, cache *Cache, window time.Duration, maxRows int) *putBatcher {
+	b := &putBatcher{
+		store:   store,
+		cache:   cache,
+		window:  window,
+		maxRows: maxRows,
+		pending: make(chan pendingPut, maxRows),
+	}
+	go b.run()
+	return b
+}
+
+func (b *putBatcher) Put(ctx context.Context, key, value string) (bool, error) {
+	p := pendingPut{key: key, value: value, done: make(chan putResult, 1)}
+	select {
+	case b.pending <- p:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	select {
+	case res := <-p.done:
+		return res.created, res.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (b *putBatcher) run() {
+	batch := make([]pendingPut, 0, b.maxRows)
+	timer := time.NewTimer(b.window)
+	timer.Stop()
+	for first := range b.pending {
+		batch = append(batch[:0], first)
+		timer.Reset(b.window)
+		reason := flushWindow
+	collect:
+		for len(batch) < b.maxRows {
+			select {
+			case p := <-b.pending:
+				batch = append(batch, p)
+			case <-timer.C:
+				break collect
+			}
+		}
+		if len(batch) == b.maxRows {
+			reason = flushSize
+			timer.Stop()
+		}
+		b.flush(batch, reason)
+	}
+}
+
+func (b *putBatcher) flush(batch []pendingPut, reason flushReason) {
+	// Only the last write to each key survives, keeping its original
+	// position relative to the others.
+	last := make(map[string]int, len(batch))
+	for i, p := range batch {
+		last[p.key] = i
+	}
+	entries := make([]KeyValue, 0, len(last))
+	for i, p := range batch {
+		if last[p.key] == i {
+			entries = append(entries, KeyValue{Key: p.key, Value: p.value})
+		}
+	}
+
+	created, err := b.store.PutMany(context.Background(), entries)
+
+	atomic.AddInt64(&b.batches, 1)
+	atomic.AddInt64(&b.rows, int64(len(batch)))
+	atomic.AddInt64(&b.flushes[reason], 1)
+	if n := int64(len(batch)); n > atomic.LoadInt64(&b.maxBatchRows) {
+		atomic.StoreInt64(&b.maxBatchRows, n)
+	}
+	if err != nil {
+		atomic.AddInt64(&b.failed, 1)
+	} else {
+		for _, e := range entries {
+			b.cache.Set(e.Key, e.Value)
+		}
+	}
+	// A key created by the batch counts as created for its first PUT only.
+	createdFor := make(map[string]bool, len(entries))
+	for i, e := range entries {
+		if err == nil && created[i] {
+			createdFor[e.Key] = true
+		}
+	}
+	for _, p := range batch {
+		p.done <- putResult{created: createdFor[p.key], err: err}
+		delete(createdFor, p.key)
+	}
+}
+
+func (b *putBatcher) stats() *batcherStats {
+	if b == nil {
+		return nil
+	}
+	st := &batcherStats{
+		Batches:      atomic.LoadInt64(&b.batches),
+		Rows:         atomic.LoadInt64(&b.rows),
+		MaxBatchRows: atomic.LoadInt64(&b.maxBatchRows),
+		Failed:       atomic.LoadInt64(&b.failed),
+		FlushSize:    atomic.LoadInt64(&b.flushes[flushSize]),
+		FlushWindow:  atomic.LoadInt64(&b.flushes[flushWindow]),
+	}
+	if st.Batches > 0 {
+		st.AvgBatchRows = float64(st.Rows) / float64(st.Batches)
+	}
+	return st
+}
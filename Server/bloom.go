@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"hash/maphash"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bloomFilter is a fixed-size Bloom filter whose bits are set and read
+// atomically, so Add and MayContain need no lock.
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64
+	k      int
+	seed   maphash.Seed
+	added  int64
+	target int
+}
+
+func newBloomFilter(expected int, fpRate float64) *bloomFilter {
+	n := float64(max(expected, 1))
+	m := uint64(math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) &^ 63
+	k := max(int(math.Round(float64(m)/n*math.Ln2)), 1)
+	return &bloomFilter{bits: make([]uint64, m/64), m: m, k: k, seed: maphash.MakeSeed(), target: expected}
+}
+
+func (b *bloomFilter) hashes(key string) (uint64, uint64) {
+	h := maphash.String(b.seed, key)
+	return h, (h>>32 | h<<32) | 1
+}
+
+func (b *bloomFilter) add(key string) {
+	h1, h2 := b.hashes(key)
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		atomic.OrUint64(&b.bits[bit/64], 1<<(bit%64))
+	}
+	atomic.AddInt64(&b.added, 1)
+}
+
+func (b *bloomFilter) mayContain(key string) bool {
+	h1, h2 := b.hashes(key)
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		if atomic.LoadUint64(&b.bits[bit/64])&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// estimatedFPRate is the textbook (1 - e^(-kn/m))^k for the keys added so far.
+func (b *bloomFilter) estimatedFPRate() float64 {
+	n := float64(atomic.LoadInt64(&b.added))
+	return math.Pow(1-math.Exp(-float64(b.k)*n/float64(b.m)), float64(b.k))
+}
+
+// keyFilter answers "definitely absent" for keys never written. Deletes are
+// not removed from the filter; a periodic rebuild from a key scan drops
+// them. Writers bracket the store write with adding/done so a rebuild also
+// covers writes that were in flight while it scanned.
+type keyFilter struct {
+	store  Store
+	fpRate float64
+
+	cur atomic.Pointer[bloomFilter]
+
+	mu       sync.Mutex
+	next     *bloomFilter
+	inflight map[string]int
+
+	negatives      int64
+	falsePositives int64
+	rebuilds       int64
+	lastRebuild    atomic.Int64
+}
+
+type keyFilterStats struct {
+	Bits             uint64  `json:"bits"`
+	Bytes            int     `json:"bytes"`
+	Hashes           int     `json:"hashes"`
+	ExpectedKeys     int     `json:"expected_keys"`
+	KeysAdded        int64   `json:"keys_added"`
+	TargetFPRate     float64 `json:"target_fp_rate"`
+	EstimatedFPRate  float64 `json:"estimated_fp_rate"`
+	Negatives        int64   `json:"negatives"`
+	FalsePositives   int64   `json:"false_positives"`
+	Rebuilds         int64   `json:"rebuilds"`
+	LastRebuildUnixS int64   `json:"last_rebuild_unix"`
+}
+
+func newKeyFilter(store Store, expected int, fpRate float64) *keyFilter {
+	f := &keyFilter{store: store, fpRate: fpRate, inflight: make(map[string]int)}
+	f.cur.Store(newBloomFilter(expected, fpRate))
+	return f
+}
+
+func (f *keyFilter) mayContain(key string) bool {
+	if f.cur.Load().mayContain(key) {
+		return true
+	}
+	atomic.AddInt64(&f.negatives, 1)
+	return false
+}
+
+// adding must be called before key is written to the store and the returned
+// func once the write has finished, successfully or not.
+func (f *keyFilter) adding(key string) func() {
+	f.mu.Lock()
+	f.cur.Load().add(key)
+	if f.next != nil {
+		f.next.add(key)
+	}
+	f.inflight[key]++
+	f.mu.Unlock()
+	return func() {
+		f.mu.Lock()
+		if f.inflight[key]--; f.inflight[key] == 0 {
+			delete(f.inflight, key)
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *keyFilter) falsePositive() {
+	atomic.AddInt64(&f.falsePositives, 1)
+}
+
+// rebuild scans every live key into a fresh filter sized for the larger of
+// the configured and the last observed key count, then swaps it in.
+func (f *keyFilter) rebuild(ctx context.Context) error {
+	old := f.cur.Load()
+	expected := max(old.target, int(float64(atomic.LoadInt64(&old.added))*1.25))
+	next := newBloomFilter(expected, f.fpRate)
+
+	f.mu.Lock()
+	f.next = next
+	for key := range f.inflight {
+		next.add(key)
+	}
+	f.mu.Unlock()
+
+	var err error
+	after := ""
+	for {
+		var page []ListedKey
+		page, err = f.store.List(ctx, ListOptions{After: after, Limit: 1000})
+		if err != nil {
+			break
+		}
+		for _, k := range page {
+			next.add(k.Key)
+		}
+		if len(page) < 1000 {
+			break
+		}
+		after = page[len(page)-1].Key
+	}
+
+	f.mu.Lock()
+	if err == nil {
+		f.cur.Store(next)
+	}
+	f.next = nil
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&f.rebuilds, 1)
+	f.lastRebuild.Store(time.Now().Unix())
+	return nil
+}
+
+func (f *keyFilter) rebuildLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		start := time.Now()
+		if err := f.rebuild(context.Background()); err != nil {
+			log.Printf("Key filter rebuild failed: %v", err)
+			continue
+		}
+		b := f.cur.Load()
+		log.Printf("Key filter rebuilt with %d keys in %s", atomic.LoadInt64(&b.added), time.Since(start).Round(time.Millisecond))
+	}
+}
+
+func (f *keyFilter) stats() *keyFilterStats {
+	if f == nil {
+		return nil
+	}
+	b := f.cur.Load()
+	return &keyFilterStats{
+		Bits:             b.m,
+		Bytes:            len(b.bits) * 8,
+		Hashes:           b.k,
+		ExpectedKeys:     b.target,
+		KeysAdded:        atomic.LoadInt64(&b.added),
+		TargetFPRate:     f.fpRate,
+		EstimatedFPRate:  b.estimatedFPRate(),
+		Negatives:        atomic.LoadInt64(&f.negatives),
+		FalsePositives:   atomic.LoadInt64(&f.falsePositives),
+		Rebuilds:         atomic.LoadInt64(&f.rebuilds),
+		LastRebuildUnixS: f.lastRebuild.Load(),
+	}
+}
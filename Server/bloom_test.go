@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// countingStore counts the reads that reach the store.
+type countingStore struct {
+	Store
+	reads atomic.Int64
+}
+
+func (c *countingStore) Get(ctx context.Context, key string) (string, error) {
+	c.reads.Add(1)
+	return c.Store.Get(ctx, key)
+}
+
+func (c *countingStore) GetBounded(ctx context.Context, key string, limit int64) (string, bool, error) {
+	c.reads.Add(1)
+	return c.Store.GetBounded(ctx, key, limit)
+}
+
+func TestBloomFilterRates(t *testing.T) {
+	const n = 10_000
+	b := newBloomFilter(n, 0.01)
+	for i := range n {
+		b.add(fmt.Sprintf("key-%d", i))
+	}
+	for i := range n {
+		if !b.mayContain(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("key-%d added but reported absent", i)
+		}
+	}
+	fp := 0
+	for i := range 10 * n {
+		if b.mayContain(fmt.Sprintf("other-%d", i)) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / (10 * n); rate > 0.02 {
+		t.Errorf("false positive rate %.4f for a target of 0.01", rate)
+	}
+	if est := b.estimatedFPRate(); est < 0.005 || est > 0.02 {
+		t.Errorf("estimated false positive rate %.4f at the expected key count, want about 0.01", est)
+	}
+}
+
+func keyFilterTestServer(t *testing.T) (*Server, *countingStore, *httptest.Server) {
+	store := &countingStore{Store: NewMemStore()}
+	s := newTestServer(store)
+	s.keys = newKeyFilter(store, 1000, 0.01)
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+	return s, store, ts
+}
+
+func TestKeyFilterShortCircuitsMisses(t *testing.T) {
+	_, store, ts := keyFilterTestServer(t)
+	for i := range 100 {
+		if status, _, _ := do(t, "GET", fmt.Sprintf("%s/kv/missing-%d", ts.URL, i), ""); status != http.StatusNotFound {
+			t.Fatalf("GET missing-%d: status %d, want 404", i, status)
+		}
+	}
+	// At a 1% false positive rate a few misses may still reach the store.
+	if reads := store.reads.Load(); reads > 5 {
+		t.Errorf("%d of 100 misses on absent keys reached the store", reads)
+	}
+
+	_, body, _ := do(t, "GET", ts.URL+"/stats", "")
+	var st struct {
+		KeyFilter *keyFilterStats `json:"key_filter"`
+	}
+	json.Unmarshal([]byte(body), &st)
+	if st.KeyFilter == nil || st.KeyFilter.Bytes == 0 || st.KeyFilter.Negatives < 95 {
+		t.Errorf("/stats key_filter = %+v, want its size and the negatives", st.KeyFilter)
+	}
+}
+
+// TestKeyFilterPutAfterNegative checks that a key the filter turned away
+// is found as soon as it is written, by each write path.
+func TestKeyFilterPutAfterNegative(t *testing.T) {
+	s, _, ts := keyFilterTestServer(t)
+	for _, write := range []struct {
+		name string
+		put  func(key string)
+	}{
+		{"put", func(key string) { do(t, "PUT", ts.URL+"/kv/"+key, "v") }},
+		{"batch", func(key string) {
+			do(t, "POST", ts.URL+"/kv/", fmt.Sprintf(`{"entries": [{"key": %q, "value": "v"}]}`, key))
+		}},
+		{"stream", func(key string) {
+			req, _ := http.NewRequest("PUT", ts.URL+"/kv/"+key, &chunkedReader{data: []byte("v")})
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}},
+	} {
+		key := "new-" + write.name
+		if s.keys.mayContain(key) {
+			t.Fatalf("%s in the filter before it was written", key)
+		}
+		if status, _, h := do(t, "GET", ts.URL+"/kv/"+key, ""); status != http.StatusNotFound || h.Get("X-Cache") != "NEGATIVE" {
+			t.Fatalf("GET %s before writing: status %d, X-Cache %q", key, status, h.Get("X-Cache"))
+		}
+		write.put(key)
+		if status, body, _ := do(t, "GET", ts.URL+"/kv/"+key, ""); status != http.StatusOK || body != "v" {
+			t.Errorf("GET %s right after a %s write: status %d, %q", key, write.name, status, body)
+		}
+	}
+}
+
+// chunkedReader hides its length from http.NewRequest, so the request is
+// sent chunked and the server streams it.
+type chunkedReader struct {
+	data []byte
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func TestKeyFilterRebuild(t *testing.T) {
+	store := NewMemStore()
+	f := newKeyFilter(store, 1000, 0.01)
+	ctx := context.Background()
+	for i := range 200 {
+		k := fmt.Sprintf("key-%d", i)
+		f.adding(k)()
+		store.Put(ctx, k, "v")
+	}
+	for i := range 100 {
+		store.Delete(ctx, fmt.Sprintf("key-%d", i))
+	}
+	// A write still in flight when the rebuild scans is kept.
+	done := f.adding("in-flight")
+	if err := f.rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+	done()
+	if !f.mayContain("in-flight") {
+		t.Errorf("write in flight during the rebuild was dropped")
+	}
+	kept := 0
+	for i := range 200 {
+		in := f.mayContain(fmt.Sprintf("key-%d", i))
+		switch {
+		case i >= 100 && !in:
+			t.Fatalf("live key-%d dropped by the rebuild", i)
+		case i < 100 && in:
+			kept++
+		}
+	}
+	if kept > 5 {
+		t.Errorf("%d of 100 deleted keys still in the filter after a rebuild", kept)
+	}
+	if st := f.stats(); st.Rebuilds != 1 || st.KeysAdded != 101 {
+		t.Errorf("stats after rebuilding %+v, want 1 rebuild of 101 keys", st)
+	}
+}
@@ -0,0 +1,881 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EvictReason int
+
+const (
+	EvictCapacity EvictReason = iota
+	EvictTTL
+	EvictExplicit
+	EvictAdmissionReject
+	numEvictReasons
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictTTL:
+		return "ttl"
+	case EvictExplicit:
+		return "explicit"
+	case EvictAdmissionReject:
+		return "admission-reject"
+	}
+	return "unknown"
+}
+
+// EvictHook is called after an entry leaves the cache, outside the cache
+// lock, so it may block without stalling Set. It must be safe for
+// concurrent use.
+type EvictHook func(key string, size int, reason EvictReason)
+
+type eviction struct {
+	key    string
+	size   int
+	reason EvictReason
+}
+
+type cacheEntry struct {
+	value     string
+	expiresAt int64 // unix nanos, 0 = never
+	tombstone string
+	pinned    bool
+	version   int64 // unix micros the store last modified the key, 0 = unknown
+	cachedAt  int64 // unix nanos the entry was stored or last revalidated
+	// capped means expiresAt is the maxAge limit rather than the key's ttl.
+	capped bool
+}
+
+func (e cacheEntry) expired(now int64) bool {
+	return e.expiresAt != 0 && now >= e.expiresAt
+}
+
+// entrySize is what an entry costs in the byte accounting, key included.
+func entrySize(key string, e cacheEntry) int64 {
+	return int64(len(key) + len(e.value) + len(e.tombstone))
+}
+
+type Cache struct {
+	// shards split the entries by key hash, each under its own lock, so
+	// that writers to different keys rarely wait for one another. There
+	// is always a power of two of them.
+	shards []cacheShard
+	// maxSize is the configured entry limit, shared out evenly between
+	// the shards; it is read and written atomically.
+	maxSize int64
+	hits    int64
+	misses  int64
+
+	// maxKeyBytes > 0 keeps longer keys out of the cache whatever path
+	// they come by; oversizedKeys counts the refusals.
+	maxKeyBytes   int
+	oversizedKeys int64
+	// maxEntryBytes > 0 does the same for longer values, so one large
+	// value cannot evict many small ones; uncacheable counts those.
+	maxEntryBytes int64
+	uncacheable   int64
+
+	// rejectWhenFull makes Set refuse new keys instead of evicting a
+	// live entry, for callers that use the cache as their only store.
+	rejectWhenFull bool
+
+	// maxAge > 0 bounds how long any value stays cached, however it got
+	// there, so readers see the store's value within that long.
+	maxAge time.Duration
+	// maxStale keeps entries that long past maxAge for bounded-staleness
+	// reads; other reads treat them as missing.
+	maxStale time.Duration
+
+	onEvict   EvictHook
+	evictions [numEvictReasons]int64
+	// evictedBytes adds up the value sizes of the evictions.
+	evictedBytes [numEvictReasons]int64
+
+	// pinBudget limits pinned keys across all shards, counted by pinCount.
+	pinBudget int
+	pinCount  int64
+
+	// gens is bumped on every write to a key's stripe so a read-through
+	// Fill started before a concurrent PUT or DELETE can tell it is stale.
+	// epoch does the same for every key at once: Clear and Resize bump it.
+	gens  [cacheGenStripes]uint64
+	epoch uint64
+
+	// storage is how shards hold their entries: storageMap or
+	// storageSlab.
+	storage string
+
+	// clock replaces time.Now for entry ages and expiry, in tests.
+	clock func() time.Time
+}
+
+// now is the current time in unix nanos.
+func (c *Cache) now() int64 {
+	if c.clock != nil {
+		return c.clock().UnixNano()
+	}
+	return time.Now().UnixNano()
+}
+
+// fillToken is the generation a read-through fill started under.
+type fillToken struct {
+	epoch, gen uint64
+}
+
+type cacheShard struct {
+	mu      sync.RWMutex
+	items   entryTable
+	maxSize int
+	// bytes is the entrySize of every item, kept under mu.
+	bytes int64
+
+	// pins are keys whose entries are never chosen as victims. They are
+	// limited by the cache's pinBudget instead of maxSize; pinnedCached
+	// counts the ones currently in items.
+	pins         map[string]struct{}
+	pinnedCached int
+
+	hits, misses int64
+	// readAt holds when a key was last read, in unix nanos, for keys
+	// hashing to each slot. Reads store into it atomically under the read
+	// lock; keys sharing a slot all look as recent as the latest of them.
+	readAt [recencySlots]int64
+	// Every lockSampleRate-th acquisition of mu is timed.
+	acquisitions, waitSamples, waitNanos int64
+}
+
+const lockSampleRate = 64
+
+// recencySlots is the size of a shard's readAt table.
+const recencySlots = 4096
+
+// touch records a read of key.
+func (sh *cacheShard) touch(key string, now int64) {
+	atomic.StoreInt64(&sh.readAt[shardHash(key)>>32%recencySlots], now)
+}
+
+// lastUsed is when key was last read or stored, whichever is later.
+func (sh *cacheShard) lastUsed(key string, e cacheEntry) int64 {
+	return max(e.cachedAt, atomic.LoadInt64(&sh.readAt[shardHash(key)>>32%recencySlots]))
+}
+
+func (sh *cacheShard) lock() {
+	if atomic.AddInt64(&sh.acquisitions, 1)%lockSampleRate != 0 {
+		sh.mu.Lock()
+		return
+	}
+	start := time.Now()
+	sh.mu.Lock()
+	sh.sampleWait(start)
+}
+
+func (sh *cacheShard) rlock() {
+	if atomic.AddInt64(&sh.acquisitions, 1)%lockSampleRate != 0 {
+		sh.mu.RLock()
+		return
+	}
+	start := time.Now()
+	sh.mu.RLock()
+	sh.sampleWait(start)
+}
+
+func (sh *cacheShard) sampleWait(start time.Time) {
+	atomic.AddInt64(&sh.waitNanos, int64(time.Since(start)))
+	atomic.AddInt64(&sh.waitSamples, 1)
+}
+
+// shardHash is FNV-1a with a final mix, so that keys differing only in
+// their last bytes still spread over the low bits that pick a shard.
+func shardHash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h = (h ^ uint64(key[i])) * 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h
+}
+
+func (c *Cache) shard(key string) *cacheShard {
+	return &c.shards[shardHash(key)&uint64(len(c.shards)-1)]
+}
+
+// shardLimit shares maxSize out between n shards, rounding up so the
+// cache never holds fewer than maxSize entries for want of room.
+func shardLimit(maxSize, n int) int {
+	return (maxSize + n - 1) / n
+}
+
+const cacheGenStripes = 256
+
+func genStripe(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h = (h ^ uint32(key[i])) * 16777619
+	}
+	return int(h % cacheGenStripes)
+}
+
+func (c *Cache) bump(key string) {
+	atomic.AddUint64(&c.gens[genStripe(key)], 1)
+}
+
+// Get treats tombstones as misses; use Tombstoned to tell them apart.
+func (c *Cache) Get(key string) (string, bool) {
+	sh := c.shard(key)
+	sh.rlock()
+	e, ok := sh.items.get(key)
+	sh.mu.RUnlock()
+	now := c.now()
+	if ok && e.expired(now) {
+		c.expire(key)
+		ok = false
+	}
+	if !ok || e.tombstone != "" || !c.fresh(e, now) {
+		atomic.AddInt64(&c.misses, 1)
+		atomic.AddInt64(&sh.misses, 1)
+		return "", false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	atomic.AddInt64(&sh.hits, 1)
+	sh.touch(key, now)
+	return e.value, true
+}
+
+func (c *Cache) expire(key string) {
+	var evicted []eviction
+	sh := c.shard(key)
+	sh.lock()
+	if e, ok := sh.items.get(key); ok && e.expired(c.now()) {
+		sh.remove(key, e)
+		evicted = append(evicted, eviction{key, len(e.value), EvictTTL})
+	}
+	sh.mu.Unlock()
+	c.notify(evicted)
+}
+
+// each calls fn for every entry, expired ones included, holding one
+// shard's read lock at a time.
+func (c *Cache) each(fn func(key string, e cacheEntry)) {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.rlock()
+		sh.items.each(func(k string, e cacheEntry) bool {
+			fn(k, e)
+			return true
+		})
+		sh.mu.RUnlock()
+	}
+}
+
+// ScrubExpired removes expired entries that no Get has come across, and
+// returns how many it removed.
+func (c *Cache) ScrubExpired() int {
+	now := c.now()
+	var expired []string
+	c.each(func(k string, e cacheEntry) {
+		if e.expired(now) {
+			expired = append(expired, k)
+		}
+	})
+	for _, k := range expired {
+		c.expire(k)
+	}
+	return len(expired)
+}
+
+func scrubLoop(c *Cache, interval time.Duration) {
+	for range time.Tick(interval) {
+		c.ScrubExpired()
+	}
+}
+
+func (c *Cache) Set(key, value string) bool {
+	return c.SetTTL(key, value, 0)
+}
+
+// FillToken must be taken before reading a value from the store that will
+// be passed to Fill.
+func (c *Cache) FillToken(key string) fillToken {
+	return fillToken{atomic.LoadUint64(&c.epoch), atomic.LoadUint64(&c.gens[genStripe(key)])}
+}
+
+// Fill caches a value read from the store unless the key was written,
+// deleted or tombstoned, or the cache cleared or resized, since token was
+// taken.
+func (c *Cache) Fill(key, value string, token fillToken) bool {
+	return c.store(key, cacheEntry{value: value}, token, true)
+}
+
+// FillVersion is Fill for a value whose store modification time is known.
+func (c *Cache) FillVersion(key, value string, modified time.Time, token fillToken) bool {
+	return c.store(key, cacheEntry{value: value, version: modified.UnixMicro()}, token, true)
+}
+
+// staleEntry is what a bounded-staleness read needs to know of an entry.
+type staleEntry struct {
+	value   string
+	age     time.Duration
+	version int64
+}
+
+// GetStale looks key up for a read that accepts a value up to maxStale
+// old, even past maxAge. ok reports a live entry of any age; only one
+// within maxStale counts as a hit.
+func (c *Cache) GetStale(key string, maxStale time.Duration) (e staleEntry, fresh, ok bool) {
+	sh := c.shard(key)
+	sh.rlock()
+	entry, ok := sh.items.get(key)
+	sh.mu.RUnlock()
+	now := c.now()
+	ok = ok && entry.tombstone == "" && !entry.expired(now)
+	if ok {
+		e = staleEntry{value: entry.value, age: time.Duration(now - entry.cachedAt), version: entry.version}
+		fresh = e.age <= maxStale
+	}
+	if fresh {
+		atomic.AddInt64(&c.hits, 1)
+		atomic.AddInt64(&sh.hits, 1)
+		sh.touch(key, now)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+		atomic.AddInt64(&sh.misses, 1)
+	}
+	return e, fresh, ok
+}
+
+// Revalidate restarts the age of key's entry once the store confirmed
+// its version, unless the key was written since token was taken.
+func (c *Cache) Revalidate(key string, version int64, token fillToken) bool {
+	now := c.now()
+	sh := c.shard(key)
+	sh.lock()
+	defer sh.mu.Unlock()
+	e, ok := sh.items.get(key)
+	if !ok || e.tombstone != "" || e.version != version || c.FillToken(key) != token {
+		return false
+	}
+	e.cachedAt = now
+	if e.capped {
+		e.expiresAt = now + int64(c.maxAge+c.maxStale)
+	}
+	sh.items.set(key, e)
+	return true
+}
+
+// Tombstone replaces the key with a marker that makes Tombstoned report
+// true for ttl, blocking read-through fills until a Set replaces it.
+// reason says what removed the key and is reported by Tombstones.
+func (c *Cache) Tombstone(key, reason string, ttl time.Duration) {
+	c.store(key, cacheEntry{tombstone: reason, expiresAt: c.now() + int64(ttl)}, fillToken{}, false)
+}
+
+// fresh is false for entries past maxAge, which are only kept for
+// bounded-staleness reads.
+func (c *Cache) fresh(e cacheEntry, now int64) bool {
+	return !e.expired(now) && (c.maxAge == 0 || now-e.cachedAt < int64(c.maxAge))
+}
+
+func (c *Cache) lookup(key string) (cacheEntry, bool) {
+	sh := c.shard(key)
+	sh.rlock()
+	e, ok := sh.items.get(key)
+	sh.mu.RUnlock()
+	return e, ok
+}
+
+// Peek returns a live value without counting a hit or miss.
+func (c *Cache) Peek(key string) (string, bool) {
+	e, ok := c.lookup(key)
+	if !ok || e.tombstone != "" || !c.fresh(e, c.now()) {
+		return "", false
+	}
+	return e.value, true
+}
+
+func (c *Cache) Tombstoned(key string) bool {
+	e, ok := c.lookup(key)
+	return ok && e.tombstone != "" && !e.expired(c.now())
+}
+
+// Tombstones counts live tombstones by reason.
+func (c *Cache) Tombstones() map[string]int {
+	now := c.now()
+	out := make(map[string]int)
+	c.each(func(_ string, e cacheEntry) {
+		if e.tombstone != "" && !e.expired(now) {
+			out[e.tombstone]++
+		}
+	})
+	return out
+}
+
+// SetTTL stores value for ttl (0 = until evicted) and reports whether it was
+// admitted. A full shard first drops an expired entry if it finds one among
+// a few candidates, then either evicts a random live entry or, with
+// rejectWhenFull, refuses the new key.
+func (c *Cache) SetTTL(key, value string, ttl time.Duration) bool {
+	entry := cacheEntry{value: value}
+	if ttl > 0 {
+		entry.expiresAt = c.now() + int64(ttl)
+	}
+	return c.store(key, entry, fillToken{}, false)
+}
+
+// SetModified is SetTTL for a value whose store modification time is
+// known, so ModifiedAfter can answer without the store.
+func (c *Cache) SetModified(key, value string, ttl time.Duration, modified time.Time) bool {
+	entry := cacheEntry{value: value, version: modified.UnixMicro()}
+	if ttl > 0 {
+		entry.expiresAt = c.now() + int64(ttl)
+	}
+	return c.store(key, entry, fillToken{}, false)
+}
+
+// ModifiedAfter reports that the cached value is known to have been
+// modified after since, in whole seconds.
+func (c *Cache) ModifiedAfter(key string, since time.Time) bool {
+	e, ok := c.lookup(key)
+	return ok && e.tombstone == "" && !e.expired(c.now()) && e.version/1e6 > since.Unix()
+}
+
+// Cacheable reports whether value fits under maxEntryBytes; a longer one is
+// never stored, and a write of one drops the key's entry instead.
+func (c *Cache) Cacheable(value string) bool {
+	return c.maxEntryBytes <= 0 || int64(len(value)) <= c.maxEntryBytes
+}
+
+// store writes entry, bumping the key's generation; a fill instead
+// requires the generation to still equal token and never replaces a
+// tombstone.
+func (c *Cache) store(key string, entry cacheEntry, token fillToken, fill bool) bool {
+	if c.maxKeyBytes > 0 && len(key) > c.maxKeyBytes {
+		atomic.AddInt64(&c.oversizedKeys, 1)
+		return false
+	}
+	if !c.Cacheable(entry.value) {
+		atomic.AddInt64(&c.uncacheable, 1)
+		if !fill {
+			// The older value must not outlive the write.
+			c.Delete(key)
+		}
+		return false
+	}
+	now := c.now()
+	var evicted []eviction
+	admitted := true
+	sh := c.shard(key)
+	sh.lock()
+	if fill {
+		prev, exists := sh.items.get(key)
+		if c.FillToken(key) != token || (exists && prev.tombstone != "" && !prev.expired(now)) {
+			sh.mu.Unlock()
+			return false
+		}
+	} else {
+		c.bump(key)
+	}
+	entry.cachedAt = now
+	if c.maxAge > 0 && entry.tombstone == "" {
+		if limit := now + int64(c.maxAge+c.maxStale); entry.expiresAt == 0 || entry.expiresAt > limit {
+			entry.expiresAt, entry.capped = limit, true
+		}
+	}
+	_, entry.pinned = sh.pins[key]
+	prev, exists := sh.items.get(key)
+	if !exists && entry.pinned {
+		sh.pinnedCached++
+	} else if !exists && sh.items.len()-sh.pinnedCached >= sh.maxSize {
+		victim, e, reason := sh.pickVictim(now)
+		switch {
+		case reason == EvictTTL || !c.rejectWhenFull:
+			evicted = append(evicted, eviction{victim, len(e.value), reason})
+			sh.remove(victim, e)
+		default:
+			evicted = append(evicted, eviction{key, len(entry.value), EvictAdmissionReject})
+			admitted = false
+		}
+	}
+	if admitted {
+		if exists {
+			sh.bytes -= entrySize(key, prev)
+		}
+		sh.items.set(key, entry)
+		sh.bytes += entrySize(key, entry)
+	}
+	sh.mu.Unlock()
+	c.notify(evicted)
+	return admitted
+}
+
+const victimCandidates = 8
+
+// pickVictim must be called with mu held on a shard holding at least one
+// unpinned entry. It prefers an expired entry, and otherwise takes the
+// least recently used of victimCandidates sampled ones.
+func (sh *cacheShard) pickVictim(now int64) (victim string, e cacheEntry, reason EvictReason) {
+	n := 0
+	var oldest int64
+	reason = EvictCapacity
+	sh.items.each(func(k string, ke cacheEntry) bool {
+		if ke.pinned {
+			return true
+		}
+		if ke.expired(now) {
+			victim, e, reason = k, ke, EvictTTL
+			return false
+		}
+		if used := sh.lastUsed(k, ke); n == 0 || used < oldest {
+			victim, e, oldest = k, ke, used
+		}
+		n++
+		return n < victimCandidates
+	})
+	return victim, e, reason
+}
+
+// resizeBatch is how many entries Resize evicts per hold of a shard lock.
+const resizeBatch = 256
+
+// recencyCutoff must be called with mu held. It returns a time before
+// which at most excess unpinned entries were last used, and as close to
+// excess of them as it can, or 0 when nothing is in excess.
+func (sh *cacheShard) recencyCutoff(excess int) int64 {
+	if excess <= 0 {
+		return 0
+	}
+	used := make([]int64, 0, sh.items.len())
+	sh.items.each(func(k string, e cacheEntry) bool {
+		if !e.pinned {
+			used = append(used, sh.lastUsed(k, e))
+		}
+		return true
+	})
+	slices.Sort(used)
+	return used[min(excess, len(used))-1] + 1
+}
+
+// usedBefore must be called with mu held. It returns up to n unpinned
+// keys last used before cutoff.
+func (sh *cacheShard) usedBefore(cutoff int64, n int) []string {
+	var keys []string
+	sh.items.each(func(k string, e cacheEntry) bool {
+		if !e.pinned && sh.lastUsed(k, e) < cutoff {
+			keys = append(keys, k)
+		}
+		return len(keys) < n
+	})
+	return keys
+}
+
+// Resize changes the entry limit in place. Shrinking evicts the entries
+// used longest ago in batches, releasing the shard lock between them so
+// readers and writers are only held up for one batch at a time; a key
+// read while the shrink runs is kept. Fills in flight are dropped rather
+// than let back in behind the evictions. It returns the number of
+// entries evicted.
+func (c *Cache) Resize(maxSize int) int {
+	atomic.AddUint64(&c.epoch, 1)
+	atomic.StoreInt64(&c.maxSize, int64(maxSize))
+	limit := shardLimit(maxSize, len(c.shards))
+	total := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.lock()
+		sh.maxSize = limit
+		cutoff := sh.recencyCutoff(sh.items.len() - sh.pinnedCached - limit)
+		sh.mu.Unlock()
+		evicted := 0
+		for {
+			now := c.now()
+			batch := make([]eviction, 0, resizeBatch)
+			sh.lock()
+			if excess := sh.items.len() - sh.pinnedCached - sh.maxSize; excess > 0 && cutoff > 0 {
+				for _, k := range sh.usedBefore(cutoff, min(excess, resizeBatch)) {
+					e, _ := sh.items.get(k)
+					reason := EvictCapacity
+					if e.expired(now) {
+						reason = EvictTTL
+					}
+					batch = append(batch, eviction{k, len(e.value), reason})
+					sh.remove(k, e)
+				}
+			}
+			// Whatever the cutoff left over, such as entries stored since it
+			// was taken, goes by the sampled policy.
+			for len(batch) < resizeBatch && sh.items.len()-sh.pinnedCached > sh.maxSize {
+				victim, e, reason := sh.pickVictim(now)
+				batch = append(batch, eviction{victim, len(e.value), reason})
+				sh.remove(victim, e)
+			}
+			// Tables never shrink, so copy a much smaller shard into a new one.
+			if len(batch) == 0 && evicted > 2*sh.items.len() {
+				sh.items = sh.items.compacted()
+			}
+			sh.mu.Unlock()
+			c.notify(batch)
+			if len(batch) == 0 {
+				break
+			}
+			evicted += len(batch)
+		}
+		total += evicted
+	}
+	return total
+}
+
+func (c *Cache) MaxSize() int {
+	return int(atomic.LoadInt64(&c.maxSize))
+}
+
+func (c *Cache) Delete(key string) {
+	var evicted []eviction
+	sh := c.shard(key)
+	sh.lock()
+	c.bump(key)
+	if e, ok := sh.items.get(key); ok {
+		sh.remove(key, e)
+		evicted = append(evicted, eviction{key, len(e.value), EvictExplicit})
+	}
+	sh.mu.Unlock()
+	c.notify(evicted)
+}
+
+// Clear drops every entry, including tombstones, and invalidates fills
+// already in flight. It holds every shard lock at once so no write lands
+// half way through, and returns the number of entries dropped.
+func (c *Cache) Clear() int {
+	var evicted []eviction
+	for i := range c.shards {
+		c.shards[i].lock()
+	}
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.items.each(func(k string, e cacheEntry) bool {
+			evicted = append(evicted, eviction{k, len(e.value), EvictExplicit})
+			return true
+		})
+		sh.items = newEntryTable(c.storage)
+		sh.bytes = 0
+		sh.pinnedCached = 0
+	}
+	atomic.AddUint64(&c.epoch, 1)
+	for i := range c.shards {
+		c.shards[i].mu.Unlock()
+	}
+	c.notify(evicted)
+	return len(evicted)
+}
+
+// remove must be called with mu held.
+func (sh *cacheShard) remove(key string, e cacheEntry) {
+	sh.items.delete(key)
+	sh.bytes -= entrySize(key, e)
+	if e.pinned {
+		sh.pinnedCached--
+	}
+}
+
+var (
+	ErrPinBudget  = errors.New("pin budget exhausted")
+	ErrKeyTooLong = errors.New("key is longer than -max-key-bytes")
+)
+
+// Pin exempts key from eviction. Its entry, if any, stays in the cache
+// until deleted or expired; later writes and fills are pinned too.
+func (c *Cache) Pin(key string) error {
+	if c.maxKeyBytes > 0 && len(key) > c.maxKeyBytes {
+		atomic.AddInt64(&c.oversizedKeys, 1)
+		return ErrKeyTooLong
+	}
+	sh := c.shard(key)
+	sh.lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.pins[key]; ok {
+		return nil
+	}
+	for {
+		n := atomic.LoadInt64(&c.pinCount)
+		if n >= int64(c.pinBudget) {
+			return ErrPinBudget
+		}
+		if atomic.CompareAndSwapInt64(&c.pinCount, n, n+1) {
+			break
+		}
+	}
+	sh.pins[key] = struct{}{}
+	if e, ok := sh.items.get(key); ok {
+		e.pinned = true
+		sh.items.set(key, e)
+		sh.pinnedCached++
+	}
+	return nil
+}
+
+// Unpin makes key an ordinary entry again, or evicts it if the unpinned
+// entries already fill its shard. It reports whether key was pinned.
+func (c *Cache) Unpin(key string) bool {
+	var evicted []eviction
+	sh := c.shard(key)
+	sh.lock()
+	if _, ok := sh.pins[key]; !ok {
+		sh.mu.Unlock()
+		return false
+	}
+	delete(sh.pins, key)
+	atomic.AddInt64(&c.pinCount, -1)
+	if e, ok := sh.items.get(key); ok {
+		sh.pinnedCached--
+		e.pinned = false
+		if sh.items.len()-sh.pinnedCached > sh.maxSize {
+			sh.items.delete(key)
+			sh.bytes -= entrySize(key, e)
+			evicted = append(evicted, eviction{key, len(e.value), EvictCapacity})
+		} else {
+			sh.items.set(key, e)
+		}
+	}
+	sh.mu.Unlock()
+	c.notify(evicted)
+	return true
+}
+
+type pinnedKey struct {
+	Key    string `json:"key"`
+	Cached bool   `json:"cached"`
+	Bytes  int    `json:"bytes"`
+}
+
+// Pinned lists pinned keys in order; Cached is false for keys that do not
+// exist or have not been read since they were deleted.
+func (c *Cache) Pinned() []pinnedKey {
+	now := c.now()
+	out := make([]pinnedKey, 0, atomic.LoadInt64(&c.pinCount))
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.rlock()
+		for k := range sh.pins {
+			e, ok := sh.items.get(k)
+			ok = ok && e.tombstone == "" && !e.expired(now)
+			out = append(out, pinnedKey{Key: k, Cached: ok, Bytes: len(e.value)})
+		}
+		sh.mu.RUnlock()
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func (c *Cache) notify(evicted []eviction) {
+	for _, e := range evicted {
+		atomic.AddInt64(&c.evictions[e.reason], 1)
+		atomic.AddInt64(&c.evictedBytes[e.reason], int64(e.size))
+		if c.onEvict != nil {
+			c.onEvict(e.key, e.size, e.reason)
+		}
+	}
+}
+
+// SetStorage switches the shards to storage, storageMap or storageSlab;
+// it must be called before the cache is shared, while it is empty.
+func (c *Cache) SetStorage(storage string) {
+	c.storage = storage
+	for i := range c.shards {
+		c.shards[i].items = newEntryTable(storage)
+	}
+}
+
+// slabStats sums the slab usage of the shards, nil unless storage is
+// storageSlab.
+func (c *Cache) slabStats() *slabStats {
+	if c.storage != storageSlab {
+		return nil
+	}
+	var st slabStats
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.rlock()
+		s := sh.items.(*slabTable).stats()
+		sh.mu.RUnlock()
+		st.Slabs += s.Slabs
+		st.SlabBytes += s.SlabBytes
+		st.LiveBytes += s.LiveBytes
+		st.Compactions += s.Compactions
+	}
+	return &st
+}
+
+// SetEvictHook installs fn; it must be called before the cache is shared.
+func (c *Cache) SetEvictHook(fn EvictHook) {
+	c.onEvict = fn
+}
+
+func (c *Cache) Evictions() map[string]int64 {
+	out := make(map[string]int64, numEvictReasons)
+	for r := EvictReason(0); r < numEvictReasons; r++ {
+		out[r.String()] = atomic.LoadInt64(&c.evictions[r])
+	}
+	return out
+}
+
+// Bytes is the size of the cached keys, values and tombstones.
+func (c *Cache) Bytes() int64 {
+	var n int64
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.rlock()
+		n += sh.bytes
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+func (c *Cache) Len() int {
+	n := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.rlock()
+		n += sh.items.len()
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// unpinnedLen counts the entries that count against the entry limit.
+func (c *Cache) unpinnedLen() int {
+	n := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.rlock()
+		n += sh.items.len() - sh.pinnedCached
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+func NewCache(maxSize int) *Cache {
+	return NewShardedCache(maxSize, 1)
+}
+
+// NewShardedCache splits the cache into shards, which must be a power of
+// two.
+func NewShardedCache(maxSize, shards int) *Cache {
+	c := &Cache{maxSize: int64(maxSize), shards: make([]cacheShard, shards)}
+	for i := range c.shards {
+		c.shards[i] = cacheShard{
+			items:   mapTable{},
+			maxSize: shardLimit(maxSize, shards),
+			pins:    make(map[string]struct{}),
+		}
+	}
+	return c
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The cache benchmarks are named Benchmark<Area>/<knob>=<value>/..., so
+// benchstat can compare runs across eviction-policy and sharding changes
+// with, for example:
+//
+//	go test -run '^$' -bench BenchmarkCache -count 10 > old.txt
+//	benchstat -col /shards old.txt new.txt
+
+const benchCacheSize = 100_000
+
+// benchMixes are the read/write mixes, as the percentage of operations
+// that are Gets, and the working set as a multiple of the cache size.
+var benchMixes = []struct {
+	name     string
+	readPct  int
+	workingX int
+}{
+	{"read95", 95, 1},
+	{"write50", 50, 1},
+	// Twice as many keys as fit keep every Set evicting.
+	{"evict2x", 95, 2},
+}
+
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func BenchmarkCache(b *testing.B) {
+	for _, storage := range []string{storageMap, storageSlab} {
+		for _, shards := range []int{1, 16} {
+			for _, mix := range benchMixes {
+				name := fmt.Sprintf("storage=%s/shards=%d/mix=%s", storage, shards, mix.name)
+				b.Run(name, func(b *testing.B) {
+					benchCacheMix(b, storage, shards, mix.readPct, mix.workingX*benchCacheSize)
+				})
+			}
+		}
+	}
+}
+
+func benchCacheMix(b *testing.B, storage string, shards, readPct, workingSet int) {
+	c := NewShardedCache(benchCacheSize, shards)
+	c.SetStorage(storage)
+	keys := benchKeys(workingSet)
+	for _, k := range keys[:min(workingSet, benchCacheSize)] {
+		c.Set(k, "value-"+k)
+	}
+	var seed atomic.Uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewPCG(seed.Add(1), 0))
+		for pb.Next() {
+			k := keys[rng.IntN(len(keys))]
+			if rng.IntN(100) < readPct {
+				c.Get(k)
+			} else {
+				c.Set(k, "value-"+k)
+			}
+		}
+	})
+}
+
+// BenchmarkHandleGet measures a GET through the routes and middleware,
+// against MemStore so the store costs next to nothing. Misses evict the
+// key first, so they include a Delete and the read-through fill.
+func BenchmarkHandleGet(b *testing.B) {
+	for _, hit := range []bool{true, false} {
+		b.Run(fmt.Sprintf("hit=%t", hit), func(b *testing.B) {
+			s := newTestServer(NewMemStore())
+			h := s.routes()
+			keys := benchKeys(1000)
+			for _, k := range keys {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest("PUT", "/kv/"+k, strings.NewReader("value-"+k)))
+			}
+			var seed atomic.Uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewPCG(seed.Add(1), 0))
+				for pb.Next() {
+					k := keys[rng.IntN(len(keys))]
+					if !hit {
+						s.cache.Delete(k)
+					}
+					w := httptest.NewRecorder()
+					h.ServeHTTP(w, httptest.NewRequest("GET", "/kv/"+k, nil))
+					if w.Code != 200 {
+						b.Fatalf("GET %s: status %d", k, w.Code)
+					}
+				}
+			})
+		})
+	}
+}
+
+type evictEvent struct {
+	key    string
+	size   int
+	reason EvictReason
+}
+
+// recordEvictions installs a hook on c that collects what it reports. The
+// hook reads the cache, which would deadlock were it called under a shard
+// lock.
+func recordEvictions(c *Cache) *[]evictEvent {
+	var events []evictEvent
+	c.SetEvictHook(func(key string, size int, reason EvictReason) {
+		c.Get(key)
+		events = append(events, evictEvent{key, size, reason})
+	})
+	return &events
+}
+
+func TestEvictHookReasons(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		run  func(c *Cache)
+		want []evictEvent
+	}{
+		{"capacity", func(c *Cache) {
+			c.Set("a", "1")
+			c.Set("b", "22")
+		}, []evictEvent{{"a", 1, EvictCapacity}}},
+		{"ttl", func(c *Cache) {
+			c.SetTTL("a", "1", time.Nanosecond)
+			time.Sleep(time.Millisecond)
+			c.Get("a")
+		}, []evictEvent{{"a", 1, EvictTTL}}},
+		{"ttl over capacity", func(c *Cache) {
+			c.SetTTL("a", "1", time.Nanosecond)
+			time.Sleep(time.Millisecond)
+			c.Set("b", "22")
+		}, []evictEvent{{"a", 1, EvictTTL}}},
+		{"delete", func(c *Cache) {
+			c.Set("a", "1")
+			c.Delete("a")
+			c.Delete("missing")
+		}, []evictEvent{{"a", 1, EvictExplicit}}},
+		{"clear", func(c *Cache) {
+			c.Set("a", "1")
+			c.Clear()
+		}, []evictEvent{{"a", 1, EvictExplicit}}},
+		{"admission reject", func(c *Cache) {
+			c.rejectWhenFull = true
+			c.Set("a", "1")
+			c.Set("b", "22")
+		}, []evictEvent{{"b", 2, EvictAdmissionReject}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewCache(1)
+			events := recordEvictions(c)
+			tc.run(c)
+			if !slices.Equal(*events, tc.want) {
+				t.Fatalf("hook saw %+v, want %+v", *events, tc.want)
+			}
+			counts := c.Evictions()
+			for r := EvictReason(0); r < numEvictReasons; r++ {
+				want := int64(0)
+				if r == tc.want[0].reason {
+					want = 1
+				}
+				if counts[r.String()] != want {
+					t.Errorf("evictions[%s] = %d, want %d", r, counts[r.String()], want)
+				}
+			}
+		})
+	}
+}
+
+// TestEvictLeastRecentlyUsed fills a cache smaller than the victim
+// sample, so the eviction sees every entry and must take the one read
+// longest ago.
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	clock := &fakeClock{time.Unix(1_000_000, 0)}
+	c := NewCache(4)
+	c.clock = clock.now
+	for _, k := range []string{"a", "b", "c", "d"} {
+		c.Set(k, "v")
+		clock.advance(time.Second)
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		c.Get(k)
+		clock.advance(time.Second)
+	}
+	events := recordEvictions(c)
+	c.Set("e", "v")
+	if want := []evictEvent{{"b", 1, EvictCapacity}}; !slices.Equal(*events, want) {
+		t.Fatalf("evicted %+v, want %+v", *events, want)
+	}
+}
+
+func TestSampledEvictionLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for range 1000 {
+		sampledEvictionLogger(0)("k", 1, EvictCapacity)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("sample 0 logged:\n%s", buf.String())
+	}
+	hook := sampledEvictionLogger(0.1)
+	for range 1000 {
+		hook("k", 1, EvictCapacity)
+	}
+	if n := strings.Count(buf.String(), "reason=capacity"); n < 50 || n > 150 {
+		t.Errorf("sample 0.1 logged %d of 1000 evictions", n)
+	}
+}
+
+// fakeClock drives a cache's clock from the test.
+type fakeClock struct{ t time.Time }
+
+func (f *fakeClock) now() time.Time          { return f.t }
+func (f *fakeClock) advance(d time.Duration) { f.t = f.t.Add(d) }
+
+func TestCacheMaxAge(t *testing.T) {
+	clock := &fakeClock{time.Unix(1_000_000, 0)}
+	c := NewCache(10)
+	c.clock = clock.now
+	c.maxAge = time.Minute
+
+	c.Set("put", "v")
+	c.Fill("filled", "v", c.FillToken("filled"))
+	c.SetTTL("short", "v", 10*time.Second)
+	c.SetTTL("long", "v", time.Hour)
+
+	clock.advance(10*time.Second - 1)
+	if _, ok := c.Get("short"); !ok {
+		t.Error("short ttl entry gone 1ns before its ttl")
+	}
+	clock.advance(1)
+	if _, ok := c.Get("short"); ok {
+		t.Error("short ttl entry still cached at its ttl: a key's shorter ttl must win")
+	}
+
+	clock.advance(50*time.Second - 1)
+	for _, k := range []string{"put", "filled", "long"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("%s gone 1ns before -cache-ttl", k)
+		}
+	}
+	clock.advance(1)
+	if _, ok := c.Get("put"); ok {
+		t.Error("PUT entry still cached at -cache-ttl")
+	}
+	if _, ok := c.Get("long"); ok {
+		t.Error("entry with a longer ttl still cached at -cache-ttl")
+	}
+	// "filled" was not looked up; the scrubber finds it.
+	if n := c.ScrubExpired(); n != 1 {
+		t.Errorf("scrub removed %d entries, want 1", n)
+	}
+	if c.Len() != 0 {
+		t.Errorf("%d entries left after expiry", c.Len())
+	}
+	if got := atomic.LoadInt64(&c.evictions[EvictTTL]); got != 4 {
+		t.Errorf("%d ttl evictions, want 4", got)
+	}
+	if got := atomic.LoadInt64(&c.evictions[EvictCapacity]); got != 0 {
+		t.Errorf("%d capacity evictions, want 0", got)
+	}
+}
+
+func TestCacheMaxAgeStale(t *testing.T) {
+	clock := &fakeClock{time.Unix(1_000_000, 0)}
+	c := NewCache(10)
+	c.clock = clock.now
+	c.maxAge, c.maxStale = time.Minute, 30*time.Second
+	c.SetModified("k", "v", 0, clock.t)
+
+	// From maxAge on, as without maxStale, the entry is kept only for
+	// reads that accept its age.
+	clock.advance(time.Minute - 1)
+	if _, ok := c.Get("k"); !ok {
+		t.Error("Get missed 1ns before -cache-ttl")
+	}
+	clock.advance(1)
+	if _, ok := c.Get("k"); ok {
+		t.Error("Get hit at -cache-ttl")
+	}
+	if e, fresh, ok := c.GetStale("k", 2*time.Minute); !ok || !fresh || e.age != time.Minute {
+		t.Errorf("GetStale past -cache-ttl: %+v, fresh %v, ok %v", e, fresh, ok)
+	}
+	// A revalidation restarts the age.
+	if !c.Revalidate("k", clock.t.Add(-time.Minute).UnixMicro(), c.FillToken("k")) {
+		t.Fatal("Revalidate refused")
+	}
+	if _, ok := c.Get("k"); !ok {
+		t.Error("Get missed right after a revalidation")
+	}
+	clock.advance(90 * time.Second)
+	if _, _, ok := c.GetStale("k", time.Hour); ok {
+		t.Error("entry outlived -cache-ttl plus -max-staleness")
+	}
+}
+
+func TestCacheTTLStats(t *testing.T) {
+	clock := &fakeClock{time.Unix(1_000_000, 0)}
+	s := newTestServer(NewMemStore())
+	s.cache.clock = clock.now
+	s.cache.maxAge, s.cache.maxStale = time.Minute, 0
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	do(t, "PUT", ts.URL+"/kv/k", "v")
+	if _, _, h := do(t, "GET", ts.URL+"/kv/k", ""); h.Get("X-Cache") != "HIT" {
+		t.Errorf("GET before -cache-ttl: X-Cache %q, want HIT", h.Get("X-Cache"))
+	}
+	clock.advance(time.Minute)
+	if _, body, h := do(t, "GET", ts.URL+"/kv/k", ""); body != "v" || h.Get("X-Cache") != "MISS" {
+		t.Errorf("GET at -cache-ttl: %q, X-Cache %q; want v, MISS", body, h.Get("X-Cache"))
+	}
+	st := s.stats()
+	if st.CacheExpired != 1 || st.CacheTTLSeconds != 60 {
+		t.Errorf("cache_expired %d, cache_ttl_seconds %g; want 1, 60", st.CacheExpired, st.CacheTTLSeconds)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cacheHandler serves /cache/{key} straight from s.kvCache, never touching
+// the Store, so the cache tier can be benchmarked on its own.
+func (s *Server) cacheHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/cache/")
+	if key == "" {
+		http.Error(w, "Key is required", http.StatusBadRequest)
+		return
+	}
+	if s.keyTooLong(w, key) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		value, ok := s.kvCache.Get(key)
+		if !ok {
+			w.Header().Set("X-Cache", "MISS")
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		writeValue(w, r, key, value, "HIT")
+	case "PUT":
+		if !s.checkWrite(w, r) {
+			return
+		}
+		ttl := s.cacheTTL
+		if v := r.URL.Query().Get("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "Invalid ttl", http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		value, ok := s.readValue(w, r)
+		if !ok {
+			return
+		}
+		if !s.kvCache.SetTTL(key, value, ttl) {
+			http.Error(w, "Cache full", http.StatusInsufficientStorage)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case "DELETE":
+		if !s.checkWrite(w, r) {
+			return
+		}
+		s.kvCache.Delete(key)
+		w.WriteHeader(http.StatusOK)
+	case "OPTIONS":
+		allowOptions(w, "GET, PUT, DELETE, OPTIONS")
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE, OPTIONS")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type flushResponse struct {
+	Cleared        int     `json:"cleared"`
+	DurationMillis float64 `json:"duration_ms"`
+}
+
+// flushCacheHandler serves POST /admin/cache/flush, which empties the
+// read-through cache. Reads already on their way to the store when it
+// runs do not put their values back.
+func (s *Server) flushCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	start := time.Now()
+	cleared := s.cache.Clear()
+	s.coldStart.begin()
+	atomic.AddInt64(&s.cacheFlushes, 1)
+	log.Printf("Flushed cache, dropping %d entries in %s", cleared, time.Since(start).Round(time.Millisecond))
+	writeJSON(w, http.StatusOK, flushResponse{
+		Cleared:        cleared,
+		DurationMillis: float64(time.Since(start)) / float64(time.Millisecond),
+	})
+}
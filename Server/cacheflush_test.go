@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+// afterReadStore runs afterRead between reading a value and returning it,
+// so the read-through fill that follows races with whatever it does.
+type afterReadStore struct {
+	Store
+	afterRead func()
+}
+
+func (a *afterReadStore) Get(ctx context.Context, key string) (string, error) {
+	v, err := a.Store.Get(ctx, key)
+	if a.afterRead != nil {
+		a.afterRead()
+	}
+	return v, err
+}
+
+func (a *afterReadStore) GetBounded(ctx context.Context, key string, limit int64) (string, bool, error) {
+	v, ok, err := a.Store.GetBounded(ctx, key, limit)
+	if a.afterRead != nil {
+		a.afterRead()
+	}
+	return v, ok, err
+}
+
+func TestAdminMutationBetweenReadAndFill(t *testing.T) {
+	for _, tc := range []struct {
+		name, path, body string
+		kept             bool
+	}{
+		{"none", "", "", true},
+		{"flush", "/admin/cache/flush", "", false},
+		{"resize", "/admin/cache/resize", `{"max_entries": 500}`, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &afterReadStore{Store: NewMemStore()}
+			s := newTestServer(store)
+			ts := httptest.NewServer(s.routes())
+			defer ts.Close()
+			store.Put(context.Background(), "k", "v")
+			if tc.path != "" {
+				store.afterRead = func() {
+					store.afterRead = nil
+					do(t, "POST", ts.URL+tc.path, tc.body)
+				}
+			}
+
+			if _, body, _ := do(t, "GET", ts.URL+"/kv/k", ""); body != "v" {
+				t.Fatalf("GET = %q", body)
+			}
+			if _, ok := s.cache.Peek("k"); ok != tc.kept {
+				t.Fatalf("cached after the read: %v, want %v", ok, tc.kept)
+			}
+			// The next read is not raced and fills as usual.
+			do(t, "GET", ts.URL+"/kv/k", "")
+			if _, ok := s.cache.Peek("k"); !ok {
+				t.Error("second GET did not fill the cache")
+			}
+		})
+	}
+	// A fill with a token from before Clear is refused directly too.
+	c := NewCache(10)
+	token := c.FillToken("k")
+	c.Clear()
+	if c.Fill("k", "v", token) {
+		t.Error("Fill with a token from before Clear was admitted")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type resizeRequest struct {
+	MaxEntries *int   `json:"max_entries"`
+	MaxBytes   *int64 `json:"max_bytes"`
+}
+
+type resizeResponse struct {
+	MaxEntries     int     `json:"max_entries"`
+	PreviousMax    int     `json:"previous_max_entries"`
+	Evicted        int     `json:"evicted"`
+	Entries        int     `json:"entries"`
+	DurationMillis float64 `json:"duration_ms"`
+}
+
+// resizeCacheHandler serves POST /admin/cache/resize, which changes the
+// read-through cache's entry limit until the next restart.
+func (s *Server) resizeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req resizeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.MaxBytes != nil:
+		http.Error(w, "max_bytes is not supported: the cache is limited by entries only", http.StatusBadRequest)
+		return
+	case req.MaxEntries == nil:
+		http.Error(w, "max_entries is missing", http.StatusBadRequest)
+		return
+	case *req.MaxEntries <= 0:
+		http.Error(w, "max_entries must be positive", http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+	prev := s.cache.MaxSize()
+	evicted := s.cache.Resize(*req.MaxEntries)
+	atomic.AddInt64(&s.cacheResizes, 1)
+	res := resizeResponse{
+		MaxEntries:     *req.MaxEntries,
+		PreviousMax:    prev,
+		Evicted:        evicted,
+		Entries:        s.cache.Len(),
+		DurationMillis: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	log.Printf("Resized cache from %d to %d entries, evicting %d in %s",
+		prev, res.MaxEntries, evicted, time.Since(start).Round(time.Millisecond))
+	writeJSON(w, http.StatusOK, res)
+}
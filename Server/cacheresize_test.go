@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCacheShrink shrinks a full 100k-entry cache to 1k while readers
+// keep reading a set of hot keys. Nothing fills a miss back in, so the
+// hot keys are only cached afterwards if the shrink kept them: every Get
+// during it must hit, and stay quick.
+func TestCacheShrink(t *testing.T) {
+	const full, small, hot = 100_000, 1000, 100
+	c := NewShardedCache(full, 16)
+	for i := range full {
+		c.Set(fmt.Sprintf("key-%d", i), "value")
+	}
+	// Shards fill unevenly, so the fullest have already evicted some
+	// keys; the hot ones are set again to be sure they start cached.
+	var hotKeys []string
+	for i := range hot {
+		hotKeys = append(hotKeys, fmt.Sprintf("key-%d", i*997))
+		c.Set(hotKeys[i], "value")
+	}
+
+	var done, shrinking atomic.Bool
+	var passes, misses atomic.Int64
+	latencies := make([][]time.Duration, 4)
+	var wg sync.WaitGroup
+	for r := range latencies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				for _, k := range hotKeys {
+					measure := shrinking.Load()
+					start := time.Now()
+					_, ok := c.Get(k)
+					if measure {
+						latencies[r] = append(latencies[r], time.Since(start))
+						if !ok {
+							misses.Add(1)
+						}
+					}
+				}
+				passes.Add(1)
+			}
+		}()
+	}
+
+	// Every hot key is read before the shrink starts.
+	for passes.Load() < int64(len(latencies)) {
+		time.Sleep(time.Millisecond)
+	}
+	shrinking.Store(true)
+	c.Resize(small)
+	// Let every reader through one more pass after the shrink.
+	for after := passes.Load(); passes.Load() < after+int64(2*len(latencies)); {
+		time.Sleep(time.Millisecond)
+	}
+	done.Store(true)
+	wg.Wait()
+
+	if n := c.Len(); n > small+16 {
+		t.Errorf("%d entries after shrinking to %d", n, small)
+	}
+	all := slices.Concat(latencies...)
+	if n := misses.Load(); n != 0 {
+		t.Errorf("%d of %d hot-key Gets missed during the shrink, want none", n, len(all))
+	}
+	for _, k := range hotKeys {
+		if _, ok := c.Peek(k); !ok {
+			t.Errorf("hot key %s not cached after the shrink", k)
+		}
+	}
+	slices.Sort(all)
+	if p99 := all[len(all)*99/100]; p99 > 20*time.Millisecond {
+		t.Errorf("p99 Get latency during the shrink %s over %d Gets", p99, len(all))
+	}
+}
+
+func TestCacheResizeEndpoint(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	s.adminToken = testAdminToken
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	for i := range 1000 {
+		s.cache.Set(fmt.Sprint(i), "v")
+	}
+	cached := s.cache.Len()
+	// Each of the 16 shards keeps up to 100/16 entries, rounded up.
+
+	_, body, _ := admin(t, "POST", ts.URL+"/admin/cache/resize", `{"max_entries": 100}`)
+	var res resizeResponse
+	if err := json.Unmarshal([]byte(body), &res); err != nil || res.PreviousMax != 1000 || res.MaxEntries != 100 || res.Entries > 112 || res.Evicted != cached-res.Entries {
+		t.Errorf("shrink answered %s (%v)", body, err)
+	}
+	_, body, _ = admin(t, "POST", ts.URL+"/admin/cache/resize", `{"max_entries": 2000}`)
+	if err := json.Unmarshal([]byte(body), &res); err != nil || res.Evicted != 0 || res.Entries > 112 {
+		t.Errorf("grow answered %s (%v)", body, err)
+	}
+	if st := s.stats(); st.CacheMaxSize != 2000 || st.CacheResizes != 2 {
+		t.Errorf("/stats cache_max_size %d, cache_resizes %d; want 2000, 2", st.CacheMaxSize, st.CacheResizes)
+	}
+
+	for _, body := range []string{`{"max_bytes": 1000}`, `{}`, `{"max_entries": 0}`, `nope`} {
+		if status, _, _ := admin(t, "POST", ts.URL+"/admin/cache/resize", body); status != http.StatusBadRequest {
+			t.Errorf("resize with %s: status %d, want 400", body, status)
+		}
+	}
+	if status, _, _ := do(t, "POST", ts.URL+"/admin/cache/resize", `{"max_entries": 10}`); status != http.StatusUnauthorized {
+		t.Errorf("resize without the token: status %d, want 401", status)
+	}
+	if s.cache.MaxSize() != 2000 {
+		t.Errorf("rejected resizes changed the limit to %d", s.cache.MaxSize())
+	}
+}
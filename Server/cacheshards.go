@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// imbalanceRatio is how many times the mean entry count one shard must
+// hold before the cache is reported as imbalanced. Caches holding fewer
+// than imbalanceMinEntries per shard are never reported, as a few keys
+// land unevenly by chance.
+const (
+	imbalanceRatio      = 2.0
+	imbalanceMinEntries = 10
+)
+
+type shardStatsResponse struct {
+	Shards             int     `json:"shards"`
+	Entries            int     `json:"entries"`
+	MaxEntriesPerShard int     `json:"max_entries_per_shard"`
+	ExpectedSharePct   float64 `json:"expected_share_pct"`
+	MaxSharePct        float64 `json:"max_share_pct"`
+	// ImbalanceRatio is the largest shard's entries over the mean.
+	ImbalanceRatio float64      `json:"imbalance_ratio"`
+	Imbalanced     bool         `json:"imbalanced"`
+	LockSampleRate int          `json:"lock_wait_sample_rate"`
+	PerShard       []shardStats `json:"per_shard"`
+}
+
+type shardStats struct {
+	Shard    int     `json:"shard"`
+	Entries  int     `json:"entries"`
+	Bytes    int64   `json:"bytes"`
+	SharePct float64 `json:"share_pct"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRate  float64 `json:"hit_rate"`
+	Pinned   int     `json:"pinned"`
+	// Lock waits are timed for one acquisition in LockSampleRate;
+	// LockWaitEstMillis scales the sampled total back up.
+	LockAcquisitions  int64   `json:"lock_acquisitions"`
+	LockWaitSamples   int64   `json:"lock_wait_samples"`
+	LockWaitAvgMicros float64 `json:"lock_wait_avg_us"`
+	LockWaitEstMillis float64 `json:"lock_wait_est_ms"`
+}
+
+func (c *Cache) shardStats() shardStatsResponse {
+	res := shardStatsResponse{
+		Shards:           len(c.shards),
+		ExpectedSharePct: 100 / float64(len(c.shards)),
+		LockSampleRate:   lockSampleRate,
+		PerShard:         make([]shardStats, len(c.shards)),
+	}
+	maxEntries := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.RLock()
+		st := shardStats{Shard: i, Entries: sh.items.len(), Bytes: sh.bytes, Pinned: len(sh.pins)}
+		res.MaxEntriesPerShard = sh.maxSize
+		sh.mu.RUnlock()
+		st.Hits = atomic.LoadInt64(&sh.hits)
+		st.Misses = atomic.LoadInt64(&sh.misses)
+		if total := st.Hits + st.Misses; total > 0 {
+			st.HitRate = float64(st.Hits) / float64(total) * 100
+		}
+		st.LockAcquisitions = atomic.LoadInt64(&sh.acquisitions)
+		st.LockWaitSamples = atomic.LoadInt64(&sh.waitSamples)
+		if st.LockWaitSamples > 0 {
+			wait := atomic.LoadInt64(&sh.waitNanos)
+			st.LockWaitAvgMicros = float64(wait) / float64(st.LockWaitSamples) / float64(time.Microsecond)
+			st.LockWaitEstMillis = float64(wait) * lockSampleRate / float64(time.Millisecond)
+		}
+		res.Entries += st.Entries
+		maxEntries = max(maxEntries, st.Entries)
+		res.PerShard[i] = st
+	}
+	if res.Entries > 0 {
+		for i := range res.PerShard {
+			res.PerShard[i].SharePct = float64(res.PerShard[i].Entries) / float64(res.Entries) * 100
+		}
+		res.MaxSharePct = float64(maxEntries) / float64(res.Entries) * 100
+		res.ImbalanceRatio = float64(maxEntries) / (float64(res.Entries) / float64(len(c.shards)))
+		res.Imbalanced = res.Entries >= imbalanceMinEntries*len(c.shards) && res.ImbalanceRatio > imbalanceRatio
+	}
+	return res
+}
+
+// cacheShardsHandler serves GET /admin/cache/shards, the balance of the
+// read-through cache's shards.
+func (s *Server) cacheShardsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.cache.shardStats())
+}
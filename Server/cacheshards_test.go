@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShardBalance(t *testing.T) {
+	const n = 16000
+	rng := rand.New(rand.NewPCG(1, 2))
+	for name, key := range map[string]func(i int) string{
+		"sequential": func(i int) string { return fmt.Sprint(i) },
+		"uuid": func(int) string {
+			return fmt.Sprintf("%08x-%04x-4%03x-%04x-%012x", rng.Uint32(), rng.IntN(1<<16), rng.IntN(1<<12), 0x8000|rng.IntN(1<<14), rng.Uint64()&(1<<48-1))
+		},
+		"common prefix": func(i int) string { return fmt.Sprintf("tenant-42/users/profile/%d", i) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := NewShardedCache(2*n, 16)
+			for i := range n {
+				c.Set(key(i), "v")
+			}
+			st := c.shardStats()
+			if st.Entries != n {
+				t.Fatalf("%d entries, want %d", st.Entries, n)
+			}
+			// The mean shard holds 1000; chance alone puts the largest
+			// within about 10% of it.
+			if st.ImbalanceRatio > 1.2 || st.Imbalanced {
+				t.Errorf("imbalance ratio %.2f over %d shards (largest share %.1f%%)", st.ImbalanceRatio, st.Shards, st.MaxSharePct)
+			}
+		})
+	}
+}
+
+// TestShardImbalanceDetected puts 40% of the keys in one shard, as a bad
+// hash or pathological keys would.
+func TestShardImbalanceDetected(t *testing.T) {
+	c := NewShardedCache(1<<20, 16)
+	for i, crowded := 0, 0; crowded < 400; i++ {
+		k := fmt.Sprint("key-", i)
+		if shardHash(k)&15 == 3 {
+			c.Set(k, "v")
+			crowded++
+		}
+	}
+	for i := range 600 {
+		c.Set(fmt.Sprint("other-", i), "v")
+	}
+	st := c.shardStats()
+	if !st.Imbalanced || st.PerShard[3].SharePct < 40 || st.MaxSharePct != st.PerShard[3].SharePct {
+		t.Errorf("imbalanced %v, shard 3 share %.1f%%, largest %.1f%%", st.Imbalanced, st.PerShard[3].SharePct, st.MaxSharePct)
+	}
+}
+
+func TestCacheShardsEndpoint(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	for i := range 100 {
+		do(t, "PUT", ts.URL+fmt.Sprintf("/kv/k%d", i), "value")
+		do(t, "GET", ts.URL+fmt.Sprintf("/kv/k%d", i), "")
+	}
+	do(t, "GET", ts.URL+"/kv/missing", "")
+
+	status, body, _ := do(t, "GET", ts.URL+"/admin/cache/shards", "")
+	var st shardStatsResponse
+	if err := json.Unmarshal([]byte(body), &st); status != http.StatusOK || err != nil {
+		t.Fatalf("GET /admin/cache/shards: status %d, %v", status, err)
+	}
+	var entries int
+	var bytes, hits, misses int64
+	for _, sh := range st.PerShard {
+		entries += sh.Entries
+		bytes += sh.Bytes
+		hits += sh.Hits
+		misses += sh.Misses
+	}
+	if st.Shards != 16 || len(st.PerShard) != 16 || entries != 100 || st.Entries != 100 {
+		t.Errorf("%d shards, %d entries (%d per shard summed)", st.Shards, st.Entries, entries)
+	}
+	// Keys k0 to k99 add up to 290 bytes.
+	if bytes != 290+100*int64(len("value")) || hits != 100 || misses != 1 {
+		t.Errorf("shards hold %d bytes, %d hits, %d misses", bytes, hits, misses)
+	}
+	if status, _, _ := do(t, "POST", ts.URL+"/admin/cache/shards", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", status)
+	}
+}
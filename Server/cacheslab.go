@@ -0,0 +1,316 @@
+package main
+
+import "math/rand"
+
+const (
+	// slabSize is the size of the byte slabs keys, values and tombstones
+	// are packed into. Larger entries get a slab of their own.
+	slabSize = 1 << 20
+	// A table compacts its slabs once they hold more than twice its live
+	// bytes, unless they add up to less than slabCompactMin.
+	slabCompactMin = 4 * slabSize
+)
+
+// slabRecord locates one entry's bytes, its key followed by its value and
+// tombstone, in a slab. It holds no pointers, so the garbage collector
+// never looks inside the records slice.
+type slabRecord struct {
+	expiresAt int64
+	version   int64
+	cachedAt  int64
+	// slab is -1 for a record on the free list.
+	slab int32
+	// next is the following record whose key has the same hash, or -1.
+	next     int32
+	off      uint32
+	keyLen   uint32
+	valueLen uint32
+	tombLen  uint32
+	pinned   bool
+	capped   bool
+}
+
+func (r *slabRecord) size() int {
+	return int(r.keyLen + r.valueLen + r.tombLen)
+}
+
+// slabTable is the -cache-storage=slab table. Entries live in a slice of
+// pointer-free records found through a map from key hash to record, and
+// their bytes in large slabs, so the pointers the garbage collector scans
+// grow with the number of slabs rather than of entries.
+//
+// Each slab counts its live bytes. A slab whose entries have all been
+// replaced or removed is released at once; otherwise, once less than half
+// of the slab bytes are live, every live entry is copied into fresh slabs.
+type slabTable struct {
+	index   map[uint64]int32
+	records []slabRecord
+	free    []int32
+
+	slabs [][]byte
+	live  []int
+	// cur is the slab new entries are appended to, -1 for none.
+	cur int32
+	// freeSlabs are indexes in slabs whose slab was released; spare is a
+	// released slab kept for reuse.
+	freeSlabs []int32
+	spare     []byte
+
+	n           int
+	liveBytes   int64
+	slabBytes   int64
+	compactions int64
+}
+
+func newSlabTable() *slabTable {
+	return &slabTable{index: make(map[uint64]int32), cur: -1}
+}
+
+func (t *slabTable) bytes(r *slabRecord) []byte {
+	return t.slabs[r.slab][r.off : int(r.off)+r.size()]
+}
+
+// find returns key's record and the one before it on its hash chain, each
+// -1 if there is none.
+func (t *slabTable) find(key string) (h uint64, i, prev int32) {
+	h = shardHash(key)
+	i, ok := t.index[h]
+	if !ok {
+		return h, -1, -1
+	}
+	prev = -1
+	for ; i >= 0; prev, i = i, t.records[i].next {
+		r := &t.records[i]
+		if r.keyLen == uint32(len(key)) && string(t.bytes(r)[:r.keyLen]) == key {
+			return h, i, prev
+		}
+	}
+	return h, -1, -1
+}
+
+func (t *slabTable) entry(r *slabRecord) cacheEntry {
+	b := t.bytes(r)
+	return cacheEntry{
+		value:     string(b[r.keyLen : r.keyLen+r.valueLen]),
+		tombstone: string(b[r.keyLen+r.valueLen:]),
+		expiresAt: r.expiresAt,
+		version:   r.version,
+		cachedAt:  r.cachedAt,
+		pinned:    r.pinned,
+		capped:    r.capped,
+	}
+}
+
+func (t *slabTable) get(key string) (cacheEntry, bool) {
+	_, i, _ := t.find(key)
+	if i < 0 {
+		return cacheEntry{}, false
+	}
+	return t.entry(&t.records[i]), true
+}
+
+// set rewrites the entry's bytes only if its value or tombstone changed,
+// so revalidating or pinning an entry costs no slab space.
+func (t *slabTable) set(key string, e cacheEntry) {
+	h, i, _ := t.find(key)
+	if i >= 0 {
+		r := &t.records[i]
+		b := t.bytes(r)
+		if string(b[r.keyLen:r.keyLen+r.valueLen]) == e.value && string(b[r.keyLen+r.valueLen:]) == e.tombstone {
+			r.setMeta(e)
+			return
+		}
+		t.release(r)
+	} else {
+		if n := len(t.free); n > 0 {
+			i, t.free = t.free[n-1], t.free[:n-1]
+		} else {
+			i = int32(len(t.records))
+			t.records = append(t.records, slabRecord{})
+		}
+		next, ok := t.index[h]
+		if !ok {
+			next = -1
+		}
+		t.records[i].next = next
+		t.index[h] = i
+		t.n++
+	}
+	r := &t.records[i]
+	r.keyLen, r.valueLen, r.tombLen = uint32(len(key)), uint32(len(e.value)), uint32(len(e.tombstone))
+	r.setMeta(e)
+	b := t.reserve(r)
+	n := copy(b, key)
+	n += copy(b[n:], e.value)
+	copy(b[n:], e.tombstone)
+	t.maybeCompact()
+}
+
+func (r *slabRecord) setMeta(e cacheEntry) {
+	r.expiresAt, r.version, r.cachedAt = e.expiresAt, e.version, e.cachedAt
+	r.pinned, r.capped = e.pinned, e.capped
+}
+
+// reserve points r at room for its bytes in a slab and returns that room
+// to copy them into.
+func (t *slabTable) reserve(r *slabRecord) []byte {
+	n := r.size()
+	r.slab = t.alloc(n)
+	b := t.slabs[r.slab]
+	r.off = uint32(len(b))
+	t.slabs[r.slab] = b[:len(b)+n]
+	t.live[r.slab] += n
+	t.liveBytes += int64(n)
+	return b[len(b) : len(b)+n]
+}
+
+// alloc returns a slab with room for n more bytes.
+func (t *slabTable) alloc(n int) int32 {
+	if n > slabSize {
+		return t.addSlab(make([]byte, 0, n))
+	}
+	if t.cur >= 0 && cap(t.slabs[t.cur])-len(t.slabs[t.cur]) >= n {
+		return t.cur
+	}
+	if t.cur >= 0 && t.live[t.cur] == 0 {
+		t.releaseSlab(t.cur)
+	}
+	b := t.spare
+	t.spare = nil
+	if b == nil {
+		b = make([]byte, 0, slabSize)
+	}
+	t.cur = t.addSlab(b)
+	return t.cur
+}
+
+func (t *slabTable) addSlab(b []byte) int32 {
+	t.slabBytes += int64(cap(b))
+	if n := len(t.freeSlabs); n > 0 {
+		i := t.freeSlabs[n-1]
+		t.freeSlabs = t.freeSlabs[:n-1]
+		t.slabs[i] = b
+		return i
+	}
+	t.slabs = append(t.slabs, b)
+	t.live = append(t.live, 0)
+	return int32(len(t.slabs) - 1)
+}
+
+// release gives up r's bytes, releasing its slab if nothing else lives
+// there. The slab being appended to is kept.
+func (t *slabTable) release(r *slabRecord) {
+	n := r.size()
+	t.live[r.slab] -= n
+	t.liveBytes -= int64(n)
+	if t.live[r.slab] == 0 && r.slab != t.cur {
+		t.releaseSlab(r.slab)
+	}
+}
+
+func (t *slabTable) releaseSlab(i int32) {
+	b := t.slabs[i]
+	t.slabBytes -= int64(cap(b))
+	if cap(b) == slabSize {
+		t.spare = b[:0]
+	}
+	t.slabs[i] = nil
+	t.freeSlabs = append(t.freeSlabs, i)
+	if i == t.cur {
+		t.cur = -1
+	}
+}
+
+func (t *slabTable) delete(key string) {
+	h, i, prev := t.find(key)
+	if i < 0 {
+		return
+	}
+	r := &t.records[i]
+	switch {
+	case prev >= 0:
+		t.records[prev].next = r.next
+	case r.next >= 0:
+		t.index[h] = r.next
+	default:
+		delete(t.index, h)
+	}
+	t.release(r)
+	r.slab = -1
+	t.free = append(t.free, i)
+	t.n--
+	t.maybeCompact()
+}
+
+func (t *slabTable) maybeCompact() {
+	if t.slabBytes > slabCompactMin && t.liveBytes*2 < t.slabBytes {
+		t.compact()
+	}
+}
+
+// compact copies every live entry's bytes into fresh slabs, leaving the
+// records and index as they are.
+func (t *slabTable) compact() {
+	old := t.slabs
+	t.slabs, t.live, t.freeSlabs = nil, nil, nil
+	t.cur, t.spare = -1, nil
+	t.liveBytes, t.slabBytes = 0, 0
+	for i := range t.records {
+		r := &t.records[i]
+		if r.slab < 0 {
+			continue
+		}
+		src := old[r.slab][r.off : int(r.off)+r.size()]
+		copy(t.reserve(r), src)
+	}
+	t.compactions++
+}
+
+func (t *slabTable) len() int {
+	return t.n
+}
+
+func (t *slabTable) each(fn func(key string, e cacheEntry) bool) {
+	n := len(t.records)
+	if n == 0 {
+		return
+	}
+	start := rand.Intn(n)
+	for j := 0; j < n; j++ {
+		r := &t.records[(start+j)%n]
+		if r.slab < 0 {
+			continue
+		}
+		if !fn(string(t.bytes(r)[:r.keyLen]), t.entry(r)) {
+			return
+		}
+	}
+}
+
+// compacted rebuilds the table, so that its records and index shrink as
+// well as its slabs.
+func (t *slabTable) compacted() entryTable {
+	out := newSlabTable()
+	out.compactions = t.compactions
+	t.each(func(k string, e cacheEntry) bool {
+		out.set(k, e)
+		return true
+	})
+	return out
+}
+
+type slabStats struct {
+	Slabs       int   `json:"slabs"`
+	SlabBytes   int64 `json:"slab_bytes"`
+	LiveBytes   int64 `json:"live_bytes"`
+	Compactions int64 `json:"compactions"`
+}
+
+func (t *slabTable) stats() slabStats {
+	return slabStats{
+		Slabs:       len(t.slabs) - len(t.freeSlabs),
+		SlabBytes:   t.slabBytes,
+		LiveBytes:   t.liveBytes,
+		Compactions: t.compactions,
+	}
+}
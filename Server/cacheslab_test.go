@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+var gcBenchEntries = flag.Int("gc-bench-entries", 1_000_000, "Entries BenchmarkCacheGC fills the cache with; the slab storage was sized against 5000000")
+
+// checkSlabTable compares t with want entry by entry and checks its byte
+// accounting against its records.
+func checkSlabTable(t *testing.T, st *slabTable, want map[string]string) {
+	t.Helper()
+	if st.len() != len(want) {
+		t.Fatalf("table holds %d entries, want %d", st.len(), len(want))
+	}
+	for k, v := range want {
+		e, ok := st.get(k)
+		if !ok || e.value != v {
+			t.Fatalf("%s = %q, %v; want %q", k, e.value, ok, v)
+		}
+	}
+	var live int64
+	perSlab := make([]int, len(st.slabs))
+	for i := range st.records {
+		r := &st.records[i]
+		if r.slab >= 0 {
+			live += int64(r.size())
+			perSlab[r.slab] += r.size()
+		}
+	}
+	if live != st.liveBytes {
+		t.Fatalf("records hold %d bytes, table counts %d live", live, st.liveBytes)
+	}
+	var slabBytes int64
+	for i, b := range st.slabs {
+		if perSlab[i] != st.live[i] {
+			t.Fatalf("slab %d holds %d live bytes, table counts %d", i, perSlab[i], st.live[i])
+		}
+		slabBytes += int64(cap(b))
+	}
+	if slabBytes != st.slabBytes {
+		t.Fatalf("slabs add up to %d bytes, table counts %d", slabBytes, st.slabBytes)
+	}
+}
+
+func TestSlabTableMatchesMap(t *testing.T) {
+	st := newSlabTable()
+	want := map[string]string{}
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range 200_000 {
+		k := fmt.Sprintf("key-%d", rng.IntN(5000))
+		switch op := rng.IntN(10); {
+		case op < 6:
+			v := strings.Repeat("v", rng.IntN(400))
+			if i%50_000 == 0 {
+				// Larger than a slab, so it gets one of its own.
+				v = strings.Repeat("big", slabSize/2)
+			}
+			st.set(k, cacheEntry{value: v})
+			want[k] = v
+		default:
+			st.delete(k)
+			delete(want, k)
+		}
+	}
+	if st.compactions == 0 {
+		t.Fatalf("churn of 200000 operations never compacted")
+	}
+	checkSlabTable(t, st, want)
+}
+
+func TestSlabCompaction(t *testing.T) {
+	st := newSlabTable()
+	want := map[string]string{}
+	value := strings.Repeat("x", 100)
+	// Ten slabs' worth, then every key but one in ten deleted, so no slab
+	// empties but most of the bytes are dead.
+	n := 10 * slabSize / (len(value) + 10)
+	for i := range n {
+		k := fmt.Sprintf("key-%07d", i)
+		st.set(k, cacheEntry{value: value})
+		want[k] = value
+	}
+	for i := range n {
+		if i%10 != 0 {
+			k := fmt.Sprintf("key-%07d", i)
+			st.delete(k)
+			delete(want, k)
+		}
+	}
+	if st.compactions == 0 {
+		t.Fatalf("%d slab bytes for %d live never compacted", st.slabBytes, st.liveBytes)
+	}
+	if st.slabBytes > slabCompactMin && st.liveBytes*2 < st.slabBytes {
+		t.Fatalf("%d slab bytes left for %d live after compacting", st.slabBytes, st.liveBytes)
+	}
+	checkSlabTable(t, st, want)
+}
+
+func TestSlabReleaseReusesSlab(t *testing.T) {
+	st := newSlabTable()
+	value := strings.Repeat("x", 1000)
+	// Fill the first slab and start a second.
+	var first []string
+	for i := 0; st.cur <= 0; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		st.set(k, cacheEntry{value: value})
+		if st.cur == 0 {
+			first = append(first, k)
+		}
+	}
+	slab0 := &st.slabs[0][:1][0]
+	for _, k := range first {
+		st.delete(k)
+	}
+	if st.slabs[0] != nil || len(st.freeSlabs) != 1 || st.spare == nil {
+		t.Fatalf("emptied slab not released: free %v, spare %v", st.freeSlabs, st.spare != nil)
+	}
+	// Filling the second slab takes the released index and its bytes.
+	slabs := len(st.slabs)
+	for i := 0; st.cur == 1; i++ {
+		st.set(fmt.Sprintf("more-%d", i), cacheEntry{value: value})
+	}
+	if st.cur != 0 || len(st.slabs) != slabs || len(st.freeSlabs) != 0 {
+		t.Fatalf("new slab %d of %d (free %v), want the released slab 0", st.cur, len(st.slabs), st.freeSlabs)
+	}
+	if &st.slabs[0][:1][0] != slab0 {
+		t.Errorf("released slab's bytes not reused")
+	}
+	if st.compactions != 0 {
+		t.Errorf("releasing whole slabs compacted %d times", st.compactions)
+	}
+}
+
+// BenchmarkCacheGC times a full collection with the cache full of small
+// entries, reporting the heap the collector has to scan. Run with
+// -gc-bench-entries 5000000 to see the gap at scale.
+func BenchmarkCacheGC(b *testing.B) {
+	for _, storage := range []string{storageMap, storageSlab} {
+		b.Run("storage="+storage, func(b *testing.B) {
+			c := NewShardedCache(*gcBenchEntries, 16)
+			c.SetStorage(storage)
+			for i := range *gcBenchEntries {
+				c.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+			}
+			runtime.GC()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+			for range b.N {
+				runtime.GC()
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "pause-ns/op")
+			b.ReportMetric(float64(after.HeapInuse)/(1<<20), "heap-MB")
+			b.ReportMetric(float64(after.HeapObjects), "heap-objects")
+			runtime.KeepAlive(c)
+		})
+	}
+}
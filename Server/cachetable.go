@@ -0,0 +1,68 @@
+package main
+
+// entryTable holds a cache shard's entries. It is only used under the
+// shard's lock.
+type entryTable interface {
+	get(key string) (cacheEntry, bool)
+	set(key string, e cacheEntry)
+	delete(key string)
+	len() int
+	// each calls fn for every entry until fn returns false. Like a map's
+	// range, it starts somewhere different on every call, which is what
+	// makes sampled eviction random; fn must not modify the table.
+	each(fn func(key string, e cacheEntry) bool)
+	// compacted returns a copy of the table in as little memory as holds
+	// it.
+	compacted() entryTable
+}
+
+// Cache storage modes for -cache-storage.
+const (
+	storageMap  = "map"
+	storageSlab = "slab"
+)
+
+func newEntryTable(storage string) entryTable {
+	if storage == storageSlab {
+		return newSlabTable()
+	}
+	return mapTable{}
+}
+
+// mapTable is the default storage: a plain map, one string key and value
+// per entry.
+type mapTable map[string]cacheEntry
+
+func (m mapTable) get(key string) (cacheEntry, bool) {
+	e, ok := m[key]
+	return e, ok
+}
+
+func (m mapTable) set(key string, e cacheEntry) {
+	m[key] = e
+}
+
+func (m mapTable) delete(key string) {
+	delete(m, key)
+}
+
+func (m mapTable) len() int {
+	return len(m)
+}
+
+func (m mapTable) each(fn func(key string, e cacheEntry) bool) {
+	for k, e := range m {
+		if !fn(k, e) {
+			return
+		}
+	}
+}
+
+// compacted copies the map, since maps never shrink.
+func (m mapTable) compacted() entryTable {
+	out := make(mapTable, len(m))
+	for k, e := range m {
+		out[k] = e
+	}
+	return out
+}
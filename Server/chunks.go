@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+)
+
+// A streamed value in Postgres is the chunks of one generation, which
+// kv_manifests names along with the chunk count, the length and the SHA-256
+// of the whole. PutStream writes a new generation next to the old one and
+// the manifest last, so a reader that has the manifest reads exactly one
+// upload's chunks; the TTL sweeper deletes the generations no manifest
+// names any more.
+type chunkManifest struct {
+	generation int64
+	chunks     int
+	total      int64
+	checksum   []byte
+}
+
+// ChunkVerifyError means the chunks of a streamed value did not match its
+// manifest. PutStream never writes such a value, so it takes a bug or
+// corruption.
+type ChunkVerifyError struct {
+	Key        string
+	Generation int64
+	Reason     string
+}
+
+func (e *ChunkVerifyError) Error() string {
+	return fmt.Sprintf("key %q generation %d: %s", e.Key, e.Generation, e.Reason)
+}
+
+type chunkVerifyResponse struct {
+	Error      string `json:"error"`
+	Key        string `json:"key"`
+	Generation int64  `json:"generation"`
+	Reason     string `json:"reason"`
+}
+
+// streamChunks hands fn the chunks of m's generation in sequence, checking
+// each against m as it goes and the checksum once all are through. tx must
+// be the snapshot m was read in, which keeps the chunks visible even when
+// the sweeper deletes them meanwhile.
+func streamChunks(ctx context.Context, tx *sql.Tx, key string, m chunkManifest, fn func(total int64, chunk []byte) error) error {
+	fail := func(format string, args ...any) error {
+		return &ChunkVerifyError{Key: key, Generation: m.generation, Reason: fmt.Sprintf(format, args...)}
+	}
+	rows, err := tx.QueryContext(ctx,
+		"SELECT seq, data FROM kv_chunks WHERE key = $1 AND generation = $2 ORDER BY seq", key, m.generation)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	sum := sha256.New()
+	next, read := 0, int64(0)
+	for rows.Next() {
+		var seq int
+		var chunk sql.RawBytes
+		if err := rows.Scan(&seq, &chunk); err != nil {
+			return err
+		}
+		switch {
+		case seq != next:
+			return fail("chunk %d where chunk %d was due", seq, next)
+		case next == m.chunks:
+			return fail("more than the %d chunks of the manifest", m.chunks)
+		case read+int64(len(chunk)) > m.total:
+			return fail("more than the %d bytes of the manifest", m.total)
+		}
+		sum.Write(chunk)
+		read += int64(len(chunk))
+		next++
+		if err := fn(m.total, chunk); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	switch {
+	case next != m.chunks:
+		return fail("%d of the %d chunks of the manifest", next, m.chunks)
+	case read != m.total:
+		return fail("%d of the %d bytes of the manifest", read, m.total)
+	case !bytes.Equal(sum.Sum(nil), m.checksum):
+		return fail("checksum mismatch")
+	}
+	return nil
+}
+
+// chunkSweeper is implemented by stores that keep superseded chunk
+// generations for the sweeper to delete.
+type chunkSweeper interface {
+	// SweepChunks deletes up to limit superseded generations and returns
+	// how many it deleted.
+	SweepChunks(ctx context.Context, limit int) (int64, error)
+}
+
+func sweepChunks(ctx context.Context, store Store, limit int) (int64, error) {
+	if c, ok := store.(chunkSweeper); ok {
+		return c.SweepChunks(ctx, limit)
+	}
+	return 0, nil
+}
+
+// SweepChunks picks generations by their first chunk, which every
+// generation has. Uploads in progress are invisible to it, and readers keep
+// their snapshot of what it deletes.
+func (p *PostgresStore) SweepChunks(ctx context.Context, limit int) (int64, error) {
+	var n int64
+	err := p.db.QueryRowContext(ctx, `
+		WITH stale AS (
+			SELECT c.key, c.generation FROM kv_chunks c
+			WHERE c.seq = 0 AND NOT EXISTS (
+				SELECT 1 FROM kv_manifests m WHERE m.key = c.key AND m.generation = c.generation)
+			LIMIT $1
+		), gone AS (
+			DELETE FROM kv_chunks c USING stale s WHERE c.key = s.key AND c.generation = s.generation
+			RETURNING c.seq
+		)
+		SELECT count(*) FILTER (WHERE seq = 0) FROM gone`, limit).Scan(&n)
+	return n, err
+}
+
+func (s *ShardedStore) SweepChunks(ctx context.Context, limit int) (int64, error) {
+	counts := make([]int64, len(s.shards))
+	err := s.fanOut(func(i int, shard Store) error {
+		n, err := sweepChunks(ctx, shard, limit)
+		counts[i] = n
+		return err
+	})
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	return total, err
+}
+
+func (d *DualStore) SweepChunks(ctx context.Context, limit int) (int64, error) {
+	var n int64
+	first := true
+	err := d.write(ctx, func(ctx context.Context, s Store) error {
+		c, err := sweepChunks(ctx, s, limit)
+		if first {
+			n, first = c, false
+		}
+		return err
+	})
+	return n, err
+}
+
+func (w *stallStore) SweepChunks(ctx context.Context, limit int) (int64, error) {
+	return sweepChunks(ctx, w.Store, limit)
+}
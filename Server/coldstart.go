@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// coldStart bounds the store reads made by cache misses for window after
+// boot and after every flush or promotion, when nearly every GET misses at
+// once. Misses beyond the limiter's slots wait in its queue, if it has one,
+// and are otherwise answered 503 with Retry-After.
+type coldStart struct {
+	window  time.Duration
+	limiter *limiter
+	// until is when the current window ends, in Unix nanoseconds.
+	until   int64
+	windows int64
+	// admitted counts misses let through to the store during a window.
+	admitted int64
+}
+
+type coldStartStats struct {
+	WindowSeconds float64 `json:"window_seconds"`
+	Active        bool    `json:"active"`
+	Windows       int64   `json:"windows"`
+	Admitted      int64   `json:"admitted"`
+	// Rejected misses got 503; Queued are waiting for a slot now.
+	Rejected       int64 `json:"rejected"`
+	Queued         int64 `json:"queued"`
+	MaxConcurrency int   `json:"max_concurrency"`
+}
+
+func newColdStart(window time.Duration, concurrency, queue int, timeout time.Duration) *coldStart {
+	if window <= 0 {
+		return nil
+	}
+	c := &coldStart{window: window, limiter: newLimiter(concurrency, queue, timeout)}
+	c.begin()
+	return c
+}
+
+// begin opens a window from now.
+func (c *coldStart) begin() {
+	if c == nil {
+		return
+	}
+	atomic.StoreInt64(&c.until, time.Now().Add(c.window).UnixNano())
+	atomic.AddInt64(&c.windows, 1)
+}
+
+func (c *coldStart) active() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&c.until)
+}
+
+// admit must be called by a cache miss before it reads the store. Outside a
+// window it returns at once; within one it holds a slot until release is
+// called, or answers 503 and returns false.
+func (c *coldStart) admit(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	if c == nil || !c.active() {
+		return func() {}, true
+	}
+	if !c.limiter.acquire(r.Context()) {
+		retryAfter := max(int(math.Ceil(c.limiter.timeout.Seconds())), 1)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.Header().Set("X-Cache", "MISS")
+		http.Error(w, "Cache warming up, retry shortly", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	atomic.AddInt64(&c.admitted, 1)
+	return c.limiter.release, true
+}
+
+func (c *coldStart) stats() *coldStartStats {
+	if c == nil {
+		return nil
+	}
+	l := c.limiter.stats()
+	return &coldStartStats{
+		WindowSeconds:  c.window.Seconds(),
+		Active:         c.active(),
+		Windows:        atomic.LoadInt64(&c.windows),
+		Admitted:       atomic.LoadInt64(&c.admitted),
+		Rejected:       l.Shed,
+		Queued:         l.Queued,
+		MaxConcurrency: l.MaxInflight,
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrencyStore delays every read and records the most reads in
+// progress at once.
+type concurrencyStore struct {
+	Store
+	delay    time.Duration
+	inflight atomic.Int64
+	peak     atomic.Int64
+}
+
+func (c *concurrencyStore) enter() {
+	n := c.inflight.Add(1)
+	for p := c.peak.Load(); n > p && !c.peak.CompareAndSwap(p, n); p = c.peak.Load() {
+	}
+	time.Sleep(c.delay)
+	c.inflight.Add(-1)
+}
+
+func (c *concurrencyStore) Get(ctx context.Context, key string) (string, error) {
+	c.enter()
+	return c.Store.Get(ctx, key)
+}
+
+func (c *concurrencyStore) GetBounded(ctx context.Context, key string, limit int64) (string, bool, error) {
+	c.enter()
+	return c.Store.GetBounded(ctx, key, limit)
+}
+
+// burst GETs n distinct keys at once and counts the answers by status.
+func burst(t *testing.T, url string, n int) map[int]int {
+	t.Helper()
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, _, h := do(t, "GET", fmt.Sprintf("%s/kv/k%d", url, i), "")
+			if status == http.StatusServiceUnavailable && h.Get("Retry-After") == "" {
+				t.Error("503 without Retry-After")
+			}
+			mu.Lock()
+			statuses[status]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+func coldStartServer(t *testing.T, window time.Duration, queue int, timeout time.Duration) (*Server, *concurrencyStore, *httptest.Server) {
+	store := &concurrencyStore{Store: NewMemStore(), delay: 20 * time.Millisecond}
+	for i := range 100 {
+		store.Put(context.Background(), fmt.Sprint("k", i), "v")
+	}
+	s := newTestServer(store)
+	s.coldStart = newColdStart(window, 4, queue, timeout)
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+	return s, store, ts
+}
+
+func TestColdStartBoundsStoreReads(t *testing.T) {
+	s, store, ts := coldStartServer(t, time.Hour, 0, 50*time.Millisecond)
+	statuses := burst(t, ts.URL, 100)
+	if p := store.peak.Load(); p > 4 {
+		t.Errorf("%d concurrent store reads during the window, want at most 4", p)
+	}
+	st := s.coldStart.stats()
+	if statuses[http.StatusServiceUnavailable] == 0 || int64(statuses[http.StatusServiceUnavailable]) != st.Rejected {
+		t.Errorf("%d misses got 503, stats count %d rejected", statuses[http.StatusServiceUnavailable], st.Rejected)
+	}
+	if int64(statuses[http.StatusOK]) != st.Admitted || !st.Active || st.Windows != 1 || st.MaxConcurrency != 4 {
+		t.Errorf("%d misses got 200; stats %+v", statuses[http.StatusOK], st)
+	}
+
+	// Hits are never held back.
+	for i := range 100 {
+		if _, ok := s.cache.Peek(fmt.Sprint("k", i)); ok {
+			do(t, "GET", fmt.Sprintf("%s/kv/k%d", ts.URL, i), "")
+			if after := s.coldStart.stats(); after.Admitted != st.Admitted || after.Rejected != st.Rejected {
+				t.Errorf("a cache hit went through the cold-start limiter")
+			}
+			break
+		}
+	}
+}
+
+func TestColdStartQueue(t *testing.T) {
+	s, store, ts := coldStartServer(t, time.Hour, 100, 5*time.Second)
+	if statuses := burst(t, ts.URL, 100); statuses[http.StatusOK] != 100 {
+		t.Errorf("queued burst: %v, want every GET answered 200", statuses)
+	}
+	if p := store.peak.Load(); p > 4 {
+		t.Errorf("%d concurrent store reads during the window, want at most 4", p)
+	}
+	if st := s.coldStart.stats(); st.Rejected != 0 || st.Admitted != 100 || st.Queued != 0 {
+		t.Errorf("stats %+v, want 100 admitted through the queue", st)
+	}
+}
+
+func TestColdStartWindowEndsAndReopens(t *testing.T) {
+	s, store, ts := coldStartServer(t, 50*time.Millisecond, 0, 50*time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	if st := s.coldStart.stats(); st.Active {
+		t.Fatal("window still active after it ended")
+	}
+	if statuses := burst(t, ts.URL, 50); statuses[http.StatusOK] != 50 {
+		t.Errorf("burst after the window: %v, want every GET answered 200", statuses)
+	}
+	if p := store.peak.Load(); p <= 4 {
+		t.Errorf("only %d concurrent store reads after the window, want them unbounded", p)
+	}
+
+	// A flush opens another window, this one long enough for the burst.
+	s.coldStart.window = time.Hour
+	do(t, "POST", ts.URL+"/admin/cache/flush", "")
+	store.peak.Store(0)
+	if st := s.coldStart.stats(); !st.Active || st.Windows != 2 {
+		t.Fatalf("after a flush: %+v, want a second, active window", st)
+	}
+	burst(t, ts.URL, 100)
+	if p := store.peak.Load(); p > 4 {
+		t.Errorf("%d concurrent store reads in the window after a flush, want at most 4", p)
+	}
+	if s := newTestServer(NewMemStore()); s.stats().ColdStart != nil {
+		t.Error("cold-start stats reported without -cold-start-window")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIfUnmodifiedSince(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	kv := ts.URL + "/kv/k"
+	ius := func(t time.Time) string { return t.UTC().Format(http.TimeFormat) }
+
+	// A missing key has not been modified since any time: the PUT creates it.
+	status, _, h := do(t, "PUT", kv, "v1", "If-Unmodified-Since", ius(time.Now().Add(-time.Hour)))
+	if status != http.StatusOK || h.Get("X-Created") != "true" {
+		t.Fatalf("conditional PUT of a missing key: status %d, X-Created %q", status, h.Get("X-Created"))
+	}
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		t.Fatalf("Last-Modified %q: %v", h.Get("Last-Modified"), err)
+	}
+
+	for _, cached := range []bool{true, false} {
+		if !cached {
+			s.cache.Delete("k")
+		}
+		// A second before the modification fails, whether the cache or
+		// the store decides.
+		if status, _, _ := do(t, "PUT", kv, "stale", "If-Unmodified-Since", ius(modified.Add(-time.Second))); status != http.StatusPreconditionFailed {
+			t.Errorf("PUT since a second before (cached %t): status %d, want 412", cached, status)
+		}
+		if status, _, _ := do(t, "DELETE", kv, "", "If-Unmodified-Since", ius(modified.Add(-time.Second))); status != http.StatusPreconditionFailed {
+			t.Errorf("DELETE since a second before (cached %t): status %d, want 412", cached, status)
+		}
+	}
+	if _, body, _ := do(t, "GET", kv, ""); body != "v1" {
+		t.Fatalf("value after refused writes = %q, want v1", body)
+	}
+
+	// Equal, to the second, succeeds.
+	status, _, h = do(t, "PUT", kv, "v2", "If-Unmodified-Since", ius(modified))
+	if status != http.StatusOK || h.Get("X-Created") != "false" {
+		t.Fatalf("PUT since the modification time: status %d, X-Created %q", status, h.Get("X-Created"))
+	}
+	// An unparseable date is ignored, as HTTP requires.
+	if status, _, _ := do(t, "PUT", kv, "v3", "If-Unmodified-Since", "yesterday"); status != http.StatusOK {
+		t.Errorf("PUT with an invalid date: status %d, want 200", status)
+	}
+
+	if status, _, h := do(t, "DELETE", kv, "", "If-Unmodified-Since", ius(time.Now().Add(time.Minute))); status != http.StatusOK || h.Get("X-Deleted") != "true" {
+		t.Errorf("DELETE since a later time: status %d, X-Deleted %q", status, h.Get("X-Deleted"))
+	}
+	if status, _, h := do(t, "DELETE", kv, "", "If-Unmodified-Since", ius(time.Now())); status != http.StatusOK || h.Get("X-Deleted") != "false" {
+		t.Errorf("conditional DELETE of a missing key: status %d, X-Deleted %q; want 200, false", status, h.Get("X-Deleted"))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// connGauge tracks client connections across all listeners via
+// http.Server.ConnState.
+type connGauge struct {
+	states   sync.Map // net.Conn -> http.ConnState
+	open     int64
+	active   int64
+	idle     int64
+	accepted int64
+}
+
+type connStats struct {
+	Open     int64 `json:"open"`
+	Active   int64 `json:"active"`
+	Idle     int64 `json:"idle"`
+	Accepted int64 `json:"accepted"`
+}
+
+func (g *connGauge) counter(state http.ConnState) *int64 {
+	switch state {
+	case http.StateActive:
+		return &g.active
+	case http.StateIdle:
+		return &g.idle
+	}
+	return nil
+}
+
+func (g *connGauge) track(c net.Conn, state http.ConnState) {
+	if state == http.StateNew {
+		atomic.AddInt64(&g.accepted, 1)
+		atomic.AddInt64(&g.open, 1)
+	}
+	if prev, ok := g.states.Load(c); ok {
+		if n := g.counter(prev.(http.ConnState)); n != nil {
+			atomic.AddInt64(n, -1)
+		}
+	}
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		g.states.Delete(c)
+		atomic.AddInt64(&g.open, -1)
+	default:
+		g.states.Store(c, state)
+		if n := g.counter(state); n != nil {
+			atomic.AddInt64(n, 1)
+		}
+	}
+}
+
+func (g *connGauge) stats() connStats {
+	return connStats{
+		Open:     atomic.LoadInt64(&g.open),
+		Active:   atomic.LoadInt64(&g.active),
+		Idle:     atomic.LoadInt64(&g.idle),
+		Accepted: atomic.LoadInt64(&g.accepted),
+	}
+}
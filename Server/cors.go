@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	corsAllowedMethods = "GET, HEAD, PUT, DELETE, POST"
+	corsAllowedHeaders = "Authorization, Content-Type, Idempotency-Key, If-Unmodified-Since, X-Durability, X-Lock-Owner, X-Max-Staleness, X-Run-ID, X-Timing"
+	corsMaxAge         = "600"
+)
+
+type corsPolicy struct {
+	anyOrigin bool
+	origins   map[string]bool
+}
+
+func parseCORSOrigins(spec string) *corsPolicy {
+	p := &corsPolicy{origins: make(map[string]bool)}
+	for _, o := range strings.Split(spec, ",") {
+		o = strings.TrimSpace(o)
+		switch o {
+		case "":
+		case "*":
+			p.anyOrigin = true
+		default:
+			p.origins[strings.TrimSuffix(o, "/")] = true
+		}
+	}
+	if !p.anyOrigin && len(p.origins) == 0 {
+		return nil
+	}
+	return p
+}
+
+func (p *corsPolicy) allowed(origin string) bool {
+	return p.anyOrigin || p.origins[origin]
+}
+
+func corsMiddleware(p *corsPolicy, next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && p.allowed(origin)
+		if allowed {
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if p.anyOrigin {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+
+		isPreflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if isPreflight && (strings.HasPrefix(r.URL.Path, "/kv/") || strings.HasPrefix(r.URL.Path, "/cache/")) {
+			if allowed {
+				h := w.Header()
+				h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				h.Set("Access-Control-Max-Age", corsMaxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
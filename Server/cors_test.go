@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func corsTestServer(t *testing.T, origins string) *httptest.Server {
+	s := newTestServer(NewMemStore())
+	s.cors = parseCORSOrigins(origins)
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestCORSPreflight(t *testing.T) {
+	ts := corsTestServer(t, "https://ui.example, https://other.example/")
+
+	status, _, h := do(t, "OPTIONS", ts.URL+"/kv/k", "",
+		"Origin", "https://ui.example", "Access-Control-Request-Method", "PUT")
+	if status != http.StatusNoContent {
+		t.Fatalf("preflight: status %d, want 204", status)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://ui.example",
+		"Access-Control-Allow-Methods": corsAllowedMethods,
+		"Access-Control-Allow-Headers": corsAllowedHeaders,
+		"Access-Control-Max-Age":       corsMaxAge,
+		"Vary":                         "Origin",
+	} {
+		if got := h.Get(name); got != want {
+			t.Errorf("preflight %s = %q, want %q", name, got, want)
+		}
+	}
+
+	// A configured origin with a trailing slash matches the bare origin.
+	_, _, h = do(t, "OPTIONS", ts.URL+"/cache/k", "",
+		"Origin", "https://other.example", "Access-Control-Request-Method", "GET")
+	if got := h.Get("Access-Control-Allow-Origin"); got != "https://other.example" {
+		t.Errorf("preflight from other.example: Access-Control-Allow-Origin = %q", got)
+	}
+}
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	ts := corsTestServer(t, "https://ui.example")
+
+	status, _, h := do(t, "PUT", ts.URL+"/kv/k", "v", "Origin", "https://ui.example")
+	if status >= 300 || h.Get("Access-Control-Allow-Origin") != "https://ui.example" {
+		t.Fatalf("PUT: status %d, Access-Control-Allow-Origin %q", status, h.Get("Access-Control-Allow-Origin"))
+	}
+	// Error responses carry the headers too, or the browser hides them.
+	status, _, h = do(t, "GET", ts.URL+"/kv/missing", "", "Origin", "https://ui.example")
+	if status != http.StatusNotFound || h.Get("Access-Control-Allow-Origin") != "https://ui.example" {
+		t.Fatalf("GET missing: status %d, Access-Control-Allow-Origin %q", status, h.Get("Access-Control-Allow-Origin"))
+	}
+	// Preflight-only headers stay off actual responses.
+	if got := h.Get("Access-Control-Allow-Methods"); got != "" {
+		t.Errorf("GET: Access-Control-Allow-Methods = %q", got)
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	ts := corsTestServer(t, "*")
+	_, _, h := do(t, "GET", ts.URL+"/kv/missing", "", "Origin", "https://anywhere.example")
+	if got := h.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	ts := corsTestServer(t, "https://ui.example")
+
+	status, _, h := do(t, "OPTIONS", ts.URL+"/kv/k", "",
+		"Origin", "https://evil.example", "Access-Control-Request-Method", "PUT")
+	if status != http.StatusNoContent {
+		t.Fatalf("preflight from a disallowed origin: status %d, want 204", status)
+	}
+	status2, _, h2 := do(t, "PUT", ts.URL+"/kv/k", "v", "Origin", "https://evil.example")
+	if status2 >= 300 {
+		t.Fatalf("PUT from a disallowed origin: status %d; the browser, not the server, enforces CORS", status2)
+	}
+	for _, hdr := range []http.Header{h, h2} {
+		for name := range hdr {
+			if strings.HasPrefix(name, "Access-Control") {
+				t.Errorf("disallowed origin got %s: %q", name, hdr.Get(name))
+			}
+		}
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	if p := parseCORSOrigins(" , "); p != nil {
+		t.Fatalf("empty -cors-origins parsed to %+v, want no policy", p)
+	}
+	ts := corsTestServer(t, "")
+	_, _, h := do(t, "GET", ts.URL+"/kv/missing", "", "Origin", "https://ui.example")
+	if got := h.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q without -cors-origins", got)
+	}
+}
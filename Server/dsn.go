@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// resolveDSN picks the connection string from, in order: -db-url,
+// -db-url-file, DATABASE_URL. An empty DSN is returned when only the
+// libpq-style PG* variables are set; pgx reads those while parsing.
+func resolveDSN(dbURL, dbURLFile string) (string, error) {
+	if dbURL != "" && dbURLFile != "" {
+		return "", errors.New("-db-url and -db-url-file are mutually exclusive")
+	}
+	switch {
+	case dbURL != "":
+		return dbURL, nil
+	case dbURLFile != "":
+		data, err := os.ReadFile(dbURLFile)
+		if err != nil {
+			return "", fmt.Errorf("read -db-url-file: %w", err)
+		}
+		dsn := strings.TrimSpace(string(data))
+		if dsn == "" {
+			return "", fmt.Errorf("-db-url-file %s is empty", dbURLFile)
+		}
+		return dsn, nil
+	case os.Getenv("DATABASE_URL") != "":
+		return os.Getenv("DATABASE_URL"), nil
+	case os.Getenv("PGHOST") != "" || os.Getenv("PGSERVICE") != "":
+		return "", nil
+	}
+	return "", errors.New("no database configured: set -db-url, -db-url-file, DATABASE_URL, or PGHOST/PGPASSWORD")
+}
+
+// splitDSNs splits a comma-separated list of postgres:// URLs, one per
+// shard. Commas not followed by a new URL belong to the previous DSN, as in
+// multi-host URLs or keyword/value DSNs.
+func splitDSNs(dsn string) []string {
+	var dsns []string
+	for _, part := range strings.Split(dsn, ",") {
+		trimmed := strings.TrimSpace(part)
+		isURL := strings.HasPrefix(trimmed, "postgres://") || strings.HasPrefix(trimmed, "postgresql://")
+		if len(dsns) > 0 && !isURL {
+			dsns[len(dsns)-1] += "," + part
+			continue
+		}
+		dsns = append(dsns, trimmed)
+	}
+	return dsns
+}
+
+func openDB(dsn string) (*sql.DB, *pgx.ConnConfig, error) {
+	cfg, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse database config: %s", redactSecret(err.Error(), dsn))
+	}
+	return stdlib.OpenDB(*cfg), cfg, nil
+}
+
+func describeDB(cfg *pgx.ConnConfig) string {
+	return fmt.Sprintf("postgres://%s@%s:%d/%s", cfg.User, cfg.Host, cfg.Port, cfg.Database)
+}
+
+var kvPasswordRe = regexp.MustCompile(`(?i)(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// redactDSN hides the password in both URL and keyword/value DSNs.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		q := u.Query()
+		if q.Has("password") {
+			q.Set("password", "xxxxx")
+			u.RawQuery = q.Encode()
+		}
+		return u.Redacted()
+	}
+	return kvPasswordRe.ReplaceAllString(dsn, "${1}xxxxx")
+}
+
+// redactSecret replaces any verbatim copy of dsn in msg with its redacted form.
+func redactSecret(msg, dsn string) string {
+	if dsn != "" {
+		msg = strings.ReplaceAll(msg, dsn, redactDSN(dsn))
+	}
+	return msg
+}
+
+func redactPassword(err error, password string) string {
+	if password == "" {
+		return err.Error()
+	}
+	return strings.ReplaceAll(err.Error(), password, "xxxxx")
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DualStore serves reads from the primary and mirrors every write to the
+// secondary, either in the request (sync) or through a bounded queue
+// (async). Locks live only on the primary. Promote swaps the two, so the
+// old primary keeps receiving writes and can be promoted back.
+type DualStore struct {
+	// mu is held shared by writes and exclusively by Promote, so no write
+	// straddles the swap.
+	mu        sync.RWMutex
+	primary   Store
+	secondary Store
+
+	async   bool
+	queue   chan func() error
+	pending sync.WaitGroup
+
+	mirrored   int64
+	failed     int64
+	dropped    int64
+	promotions int64
+	lastError  atomic.Value
+}
+
+type dualStoreStats struct {
+	Mode       string `json:"mode"`
+	Promoted   bool   `json:"promoted"`
+	Promotions int64  `json:"promotions"`
+	QueueLen   int    `json:"queue_len,omitempty"`
+	QueueCap   int    `json:"queue_cap,omitempty"`
+	Mirrored   int64  `json:"mirrored_writes"`
+	Failed     int64  `json:"failed_writes"`
+	Dropped    int64  `json:"dropped_writes"`
+	Divergence int64  `json:"divergence"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+func NewDualStore(primary, secondary Store, async bool, queueSize int) *DualStore {
+	d := &DualStore{primary: primary, secondary: secondary, async: async}
+	if async {
+		d.queue = make(chan func() error, queueSize)
+		go d.drain()
+	}
+	return d
+}
+
+func (d *DualStore) drain() {
+	for op := range d.queue {
+		d.record(op())
+		d.pending.Done()
+	}
+}
+
+func (d *DualStore) record(err error) {
+	if err == nil {
+		atomic.AddInt64(&d.mirrored, 1)
+		return
+	}
+	atomic.AddInt64(&d.failed, 1)
+	d.lastError.Store(err.Error())
+}
+
+// write runs op on the primary and, if that succeeded, mirrors it. A
+// failed mirror fails the write only in sync mode; in async mode a full
+// queue drops it. Both count towards divergence.
+func (d *DualStore) write(ctx context.Context, op func(ctx context.Context, s Store) error) error {
+	return d.writeSplit(ctx, op, op)
+}
+
+// writeSplit is write with a different operation for the secondary, e.g.
+// to mirror a conditional write unconditionally once the primary took it.
+func (d *DualStore) writeSplit(ctx context.Context, op, mirror func(ctx context.Context, s Store) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if err := op(ctx, d.primary); err != nil {
+		return err
+	}
+	secondary := d.secondary
+	if !d.async {
+		err := mirror(ctx, secondary)
+		d.record(err)
+		return err
+	}
+	d.pending.Add(1)
+	select {
+	case d.queue <- func() error { return mirror(context.Background(), secondary) }:
+	default:
+		d.pending.Done()
+		atomic.AddInt64(&d.dropped, 1)
+	}
+	return nil
+}
+
+func (d *DualStore) reads() Store {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.primary
+}
+
+// Promote waits for queued mirror writes to finish, then swaps the
+// stores. Writes block meanwhile; reads of the old primary in flight
+// complete normally.
+func (d *DualStore) Promote() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending.Wait()
+	d.primary, d.secondary = d.secondary, d.primary
+	atomic.AddInt64(&d.promotions, 1)
+}
+
+func (d *DualStore) stats() *dualStoreStats {
+	if d == nil {
+		return nil
+	}
+	st := &dualStoreStats{
+		Mode:       "sync",
+		Promotions: atomic.LoadInt64(&d.promotions),
+		Mirrored:   atomic.LoadInt64(&d.mirrored),
+		Failed:     atomic.LoadInt64(&d.failed),
+		Dropped:    atomic.LoadInt64(&d.dropped),
+	}
+	st.Promoted = st.Promotions%2 == 1
+	st.Divergence = st.Failed + st.Dropped
+	if d.async {
+		st.Mode = "async"
+		st.QueueLen, st.QueueCap = len(d.queue), cap(d.queue)
+	}
+	if e, ok := d.lastError.Load().(string); ok {
+		st.LastError = e
+	}
+	return st
+}
+
+func (d *DualStore) Get(ctx context.Context, key string) (string, error) {
+	return d.reads().Get(ctx, key)
+}
+
+func (d *DualStore) GetBounded(ctx context.Context, key string, limit int64) (string, bool, error) {
+	return d.reads().GetBounded(ctx, key, limit)
+}
+
+func (d *DualStore) Stream(ctx context.Context, key string, fn func(total int64, chunk []byte) error) error {
+	return d.reads().Stream(ctx, key, fn)
+}
+
+// PutStream cannot replay body, so the secondary gets its copy streamed
+// back out of the primary once the primary committed it.
+func (d *DualStore) PutStream(ctx context.Context, key string, body io.Reader, ttl time.Duration) (bool, int64, error) {
+	var created bool
+	var size int64
+	var primary Store
+	err := d.writeSplit(ctx, func(ctx context.Context, s Store) (err error) {
+		primary = s
+		created, size, err = s.PutStream(ctx, key, body, ttl)
+		return err
+	}, func(ctx context.Context, s Store) error {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(primary.Stream(ctx, key, func(_ int64, chunk []byte) error {
+				_, err := pw.Write(chunk)
+				return err
+			}))
+		}()
+		_, _, err := s.PutStream(ctx, key, pr, ttl)
+		pr.CloseWithError(err)
+		return err
+	})
+	return created, size, err
+}
+
+func (d *DualStore) Put(ctx context.Context, key, value string) (created bool, err error) {
+	return d.PutTTL(ctx, key, value, 0)
+}
+
+func (d *DualStore) PutTTL(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	var created bool
+	first := true
+	err := d.write(ctx, func(ctx context.Context, s Store) error {
+		c, err := s.PutTTL(ctx, key, value, ttl)
+		if first {
+			created, first = c, false
+		}
+		return err
+	})
+	return created, err
+}
+
+func (d *DualStore) PutIfUnmodifiedSince(ctx context.Context, key, value string, ttl time.Duration, since time.Time) (bool, time.Time, error) {
+	var created bool
+	var modified time.Time
+	err := d.writeSplit(ctx, func(ctx context.Context, s Store) (err error) {
+		created, modified, err = s.PutIfUnmodifiedSince(ctx, key, value, ttl, since)
+		return err
+	}, func(ctx context.Context, s Store) error {
+		_, err := s.PutTTL(ctx, key, value, ttl)
+		return err
+	})
+	return created, modified, err
+}
+
+func (d *DualStore) DeleteIfUnmodifiedSince(ctx context.Context, key string, since time.Time, soft bool) (bool, error) {
+	var deleted bool
+	err := d.writeSplit(ctx, func(ctx context.Context, s Store) (err error) {
+		deleted, err = s.DeleteIfUnmodifiedSince(ctx, key, since, soft)
+		return err
+	}, func(ctx context.Context, s Store) error {
+		var err error
+		if soft {
+			_, err = s.SoftDelete(ctx, key)
+		} else {
+			_, err = s.Delete(ctx, key)
+		}
+		return err
+	})
+	return deleted, err
+}
+
+func (d *DualStore) PutMany(ctx context.Context, entries []KeyValue) ([]bool, error) {
+	var created []bool
+	first := true
+	err := d.write(ctx, func(ctx context.Context, s Store) error {
+		c, err := s.PutMany(ctx, entries)
+		if first {
+			created, first = c, false
+		}
+		return err
+	})
+	return created, err
+}
+
+func (d *DualStore) BulkLoad(ctx context.Context, entries []KeyValue) error {
+	return d.write(ctx, func(ctx context.Context, s Store) error {
+		return bulkLoad(ctx, s, entries)
+	})
+}
+
+func (d *DualStore) Delete(ctx context.Context, key string) (bool, error) {
+	return d.writeBool(ctx, func(ctx context.Context, s Store) (bool, error) {
+		return s.Delete(ctx, key)
+	})
+}
+
+func (d *DualStore) SoftDelete(ctx context.Context, key string) (bool, error) {
+	return d.writeBool(ctx, func(ctx context.Context, s Store) (bool, error) {
+		return s.SoftDelete(ctx, key)
+	})
+}
+
+func (d *DualStore) Undelete(ctx context.Context, key string, retention time.Duration) (bool, error) {
+	return d.writeBool(ctx, func(ctx context.Context, s Store) (bool, error) {
+		return s.Undelete(ctx, key, retention)
+	})
+}
+
+// writeBool mirrors op and returns the primary's result.
+func (d *DualStore) writeBool(ctx context.Context, op func(ctx context.Context, s Store) (bool, error)) (bool, error) {
+	var ok bool
+	first := true
+	err := d.write(ctx, func(ctx context.Context, s Store) error {
+		b, err := op(ctx, s)
+		if first {
+			ok, first = b, false
+		}
+		return err
+	})
+	return ok, err
+}
+
+func (d *DualStore) PurgeDeleted(ctx context.Context, retention time.Duration) (int64, error) {
+	var n int64
+	first := true
+	err := d.write(ctx, func(ctx context.Context, s Store) error {
+		c, err := s.PurgeDeleted(ctx, retention)
+		if first {
+			n, first = c, false
+		}
+		return err
+	})
+	return n, err
+}
+
+func (d *DualStore) SweepExpired(ctx context.Context, limit int) ([]string, error) {
+	var keys []string
+	first := true
+	err := d.write(ctx, func(ctx context.Context, s Store) error {
+		k, err := s.SweepExpired(ctx, limit)
+		if first {
+			keys, first = k, false
+		}
+		return err
+	})
+	return keys, err
+}
+
+func (d *DualStore) CountPurge(ctx context.Context, f PurgeFilter) (int64, error) {
+	return d.reads().CountPurge(ctx, f)
+}
+
+func (d *DualStore) PurgeBatch(ctx context.Context, f PurgeFilter, limit int) ([]string, error) {
+	var keys []string
+	first := true
+	err := d.write(ctx, func(ctx context.Context, s Store) error {
+		k, err := s.PurgeBatch(ctx, f, limit)
+		if first {
+			keys, first = k, false
+		}
+		return err
+	})
+	return keys, err
+}
+
+func (d *DualStore) ExpiryLag(ctx context.Context) (time.Duration, error) {
+	return d.reads().ExpiryLag(ctx)
+}
+
+func (d *DualStore) List(ctx context.Context, opts ListOptions) ([]ListedKey, error) {
+	return d.reads().List(ctx, opts)
+}
+
+func (d *DualStore) Scan(ctx context.Context, opts ScanOptions, fn func(key, value string) error) error {
+	return d.reads().Scan(ctx, opts, fn)
+}
+
+func (d *DualStore) UsedBytes(ctx context.Context, prefix string) (int64, error) {
+	return d.reads().UsedBytes(ctx, prefix)
+}
+
+func (d *DualStore) AcquireLock(ctx context.Context, key, owner string, lease time.Duration) (LockInfo, bool, error) {
+	return d.reads().AcquireLock(ctx, key, owner, lease)
+}
+
+func (d *DualStore) RenewLock(ctx context.Context, key, owner string, lease time.Duration) (LockInfo, bool, error) {
+	return d.reads().RenewLock(ctx, key, owner, lease)
+}
+
+func (d *DualStore) ReleaseLock(ctx context.Context, key, owner string) (bool, error) {
+	return d.reads().ReleaseLock(ctx, key, owner)
+}
+
+func (d *DualStore) LockStatus(ctx context.Context, key string) (LockInfo, bool, error) {
+	return d.reads().LockStatus(ctx, key)
+}
+
+func (d *DualStore) Ping(ctx context.Context) error {
+	if p, ok := d.reads().(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (d *DualStore) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending.Wait()
+	return errors.Join(d.primary.Close(), d.secondary.Close())
+}
+
+type verifyResult struct {
+	Scanned            int      `json:"scanned"`
+	Sampled            int      `json:"sampled"`
+	Matched            int      `json:"matched"`
+	Mismatched         int      `json:"mismatched"`
+	MissingOnSecondary int      `json:"missing_on_secondary"`
+	Errors             int      `json:"errors"`
+	Examples           []string `json:"examples,omitempty"`
+}
+
+// VerifySample reservoir-samples n keys from a scan of the primary's keys
+// and compares their values in both stores.
+func (d *DualStore) VerifySample(ctx context.Context, n int) (verifyResult, error) {
+	d.mu.RLock()
+	primary, secondary := d.primary, d.secondary
+	d.mu.RUnlock()
+
+	var res verifyResult
+	sample := make([]string, 0, n)
+	after := ""
+	for {
+		page, err := primary.List(ctx, ListOptions{After: after, Limit: 1000})
+		if err != nil {
+			return res, err
+		}
+		for _, k := range page {
+			res.Scanned++
+			if len(sample) < n {
+				sample = append(sample, k.Key)
+			} else if i := rand.IntN(res.Scanned); i < n {
+				sample[i] = k.Key
+			}
+		}
+		if len(page) < 1000 {
+			break
+		}
+		after = page[len(page)-1].Key
+	}
+
+	for _, key := range sample {
+		res.Sampled++
+		want, err1 := primary.Get(ctx, key)
+		got, err2 := secondary.Get(ctx, key)
+		switch {
+		case err1 == nil && errors.Is(err2, ErrNotFound):
+			res.MissingOnSecondary++
+		case err1 != nil && !errors.Is(err1, ErrNotFound), err2 != nil && !errors.Is(err2, ErrNotFound):
+			res.Errors++
+			continue
+		case want == got && (err1 == nil) == (err2 == nil):
+			res.Matched++
+			continue
+		default:
+			res.Mismatched++
+		}
+		if len(res.Examples) < 10 {
+			res.Examples = append(res.Examples, key)
+		}
+	}
+	return res, nil
+}
+
+// secondaryHandler reports divergence between the primary and secondary.
+func (s *Server) secondaryHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.dualStoreRequest(w, r, "GET") {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.dual.stats())
+}
+
+func (s *Server) verifySampleHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.dualStoreRequest(w, r, "POST") {
+		return
+	}
+	n := 100
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 || n > 10000 {
+			http.Error(w, "n must be between 1 and 10000", http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := s.dual.VerifySample(r.Context(), n)
+	if err != nil {
+		s.dbError(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// promoteSecondaryHandler makes the secondary serve reads and take
+// synchronous writes. The cache is cleared since it was filled from the
+// old primary.
+func (s *Server) promoteSecondaryHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.dualStoreRequest(w, r, "POST") {
+		return
+	}
+	start := time.Now()
+	s.dual.Promote()
+	s.cache.Clear()
+	s.coldStart.begin()
+	log.Printf("Promoted secondary store in %s", time.Since(start).Round(time.Millisecond))
+	writeJSON(w, http.StatusOK, s.dual.stats())
+}
+
+func (s *Server) dualStoreRequest(w http.ResponseWriter, r *http.Request, method string) bool {
+	if s.dual == nil {
+		http.Error(w, "No secondary store configured (-secondary-db-url)", http.StatusNotFound)
+		return false
+	}
+	if r.Method != method {
+		methodNotAllowed(w, method)
+		return false
+	}
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Durability levels a PUT can ask for with X-Durability, weakest first:
+// acknowledged once in the cache, once committed to the store, or once
+// committed with synchronous_commit on. The server has no write-behind
+// mode, so a write asking for cache is committed like db.
+const (
+	durabilityCache = "cache"
+	durabilityDB    = "db"
+	durabilityFlush = "flush"
+)
+
+var durabilityLevels = []string{durabilityCache, durabilityDB, durabilityFlush}
+
+// durabilityPolicy resolves X-Durability against -durability and counts
+// writes by the level they achieved. The zero value asks for nothing, so
+// every write achieves db.
+type durabilityPolicy struct {
+	def        string
+	downgrades bool
+	// writes is indexed like durabilityLevels.
+	writes [3]int64
+}
+
+type durabilityStats struct {
+	Default    string           `json:"default"`
+	Downgrades bool             `json:"downgrades_allowed"`
+	Writes     map[string]int64 `json:"writes"`
+}
+
+// level is the level a PUT asks for: its X-Durability, unless that is
+// weaker than the default and downgrades are off. ok is false for an
+// unknown level.
+func (d *durabilityPolicy) level(r *http.Request) (level string, ok bool) {
+	v := r.Header.Get("X-Durability")
+	if v == "" {
+		return d.def, true
+	}
+	i := slices.Index(durabilityLevels, v)
+	if i < 0 {
+		return "", false
+	}
+	if !d.downgrades && i < slices.Index(durabilityLevels, d.def) {
+		return d.def, true
+	}
+	return v, true
+}
+
+// written echoes the level a write achieved and counts it.
+func (d *durabilityPolicy) written(w http.ResponseWriter, level string) {
+	atomic.AddInt64(&d.writes[slices.Index(durabilityLevels, level)], 1)
+	w.Header().Set("X-Durability", level)
+}
+
+func (d *durabilityPolicy) stats() durabilityStats {
+	st := durabilityStats{Default: d.def, Downgrades: d.downgrades, Writes: make(map[string]int64)}
+	for i, level := range durabilityLevels {
+		st.Writes[level] = atomic.LoadInt64(&d.writes[i])
+	}
+	return st
+}
+
+func (d *durabilityPolicy) writeMetrics(w http.ResponseWriter) {
+	fmt.Fprintln(w, "# HELP kv_writes_by_durability_total PUTs acknowledged, by the durability level they achieved.")
+	fmt.Fprintln(w, "# TYPE kv_writes_by_durability_total counter")
+	for i, level := range durabilityLevels {
+		fmt.Fprintf(w, "kv_writes_by_durability_total{level=%q} %d\n", level, atomic.LoadInt64(&d.writes[i]))
+	}
+}
+
+// syncPutter is implemented by stores that can commit one write with
+// synchronous_commit on, whatever the connection's setting. flushed is
+// false where the write ended up in a store that cannot.
+type syncPutter interface {
+	PutTTLSync(ctx context.Context, key, value string, ttl time.Duration) (created, flushed bool, err error)
+}
+
+func putSync(ctx context.Context, store Store, key, value string, ttl time.Duration) (created, flushed bool, err error) {
+	if p, ok := store.(syncPutter); ok {
+		return p.PutTTLSync(ctx, key, value, ttl)
+	}
+	created, err = store.PutTTL(ctx, key, value, ttl)
+	return created, false, err
+}
+
+// PutTTLSync is PutTTL in a transaction that turns synchronous_commit on
+// for itself, so the commit waits for the WAL flush even when the DSN
+// sets synchronous_commit=off.
+func (p *PostgresStore) PutTTLSync(ctx context.Context, key, value string, ttl time.Duration) (bool, bool, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "SET LOCAL synchronous_commit = on"); err != nil {
+		return false, false, err
+	}
+	var created bool
+	if err := tx.QueryRowContext(ctx, putTTLQuery, key, value, ttl.Seconds()).Scan(&created); err != nil {
+		return false, false, err
+	}
+	return created, true, tx.Commit()
+}
+
+func (s *ShardedStore) PutTTLSync(ctx context.Context, key, value string, ttl time.Duration) (bool, bool, error) {
+	return putSync(ctx, s.shardFor(key), key, value, ttl)
+}
+
+// PutTTLSync flushes the primary's commit; the secondary is mirrored as
+// usual.
+func (d *DualStore) PutTTLSync(ctx context.Context, key, value string, ttl time.Duration) (bool, bool, error) {
+	var created, flushed bool
+	err := d.writeSplit(ctx, func(ctx context.Context, s Store) (err error) {
+		created, flushed, err = putSync(ctx, s, key, value, ttl)
+		return err
+	}, func(ctx context.Context, s Store) error {
+		_, err := s.PutTTL(ctx, key, value, ttl)
+		return err
+	})
+	return created, flushed, err
+}
+
+func (w *stallStore) PutTTLSync(ctx context.Context, key, value string, ttl time.Duration) (bool, bool, error) {
+	defer w.d.write.observe(w.d.write.now())
+	return putSync(ctx, w.Store, key, value, ttl)
+}
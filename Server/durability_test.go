@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pathStore records which write path each PUT took, and can flush.
+type pathStore struct {
+	Store
+	mu    sync.Mutex
+	paths []string
+}
+
+func (p *pathStore) took(path string) {
+	p.mu.Lock()
+	p.paths = append(p.paths, path)
+	p.mu.Unlock()
+}
+
+// last returns the paths taken since the previous call.
+func (p *pathStore) last() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	paths := strings.Join(p.paths, ",")
+	p.paths = nil
+	return paths
+}
+
+func (p *pathStore) Put(ctx context.Context, key, value string) (bool, error) {
+	p.took("put")
+	return p.Store.Put(ctx, key, value)
+}
+
+func (p *pathStore) PutTTL(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	p.took("ttl")
+	return p.Store.PutTTL(ctx, key, value, ttl)
+}
+
+func (p *pathStore) PutIfUnmodifiedSince(ctx context.Context, key, value string, ttl time.Duration, since time.Time) (bool, time.Time, error) {
+	p.took("conditional")
+	return p.Store.PutIfUnmodifiedSince(ctx, key, value, ttl, since)
+}
+
+func (p *pathStore) PutTTLSync(ctx context.Context, key, value string, ttl time.Duration) (bool, bool, error) {
+	p.took(fmt.Sprint("sync ttl=", ttl))
+	created, err := p.Store.PutTTL(ctx, key, value, ttl)
+	return created, true, err
+}
+
+func TestDurabilityMatrix(t *testing.T) {
+	for _, tc := range []struct {
+		def        string
+		downgrades bool
+		// want maps X-Durability to the achieved level and the path.
+		want map[string][2]string
+	}{
+		{durabilityDB, true, map[string][2]string{
+			"": {"db", "put"}, "cache": {"db", "put"}, "db": {"db", "put"}, "flush": {"flush", "sync ttl=0s"},
+		}},
+		{durabilityDB, false, map[string][2]string{
+			"": {"db", "put"}, "cache": {"db", "put"}, "db": {"db", "put"}, "flush": {"flush", "sync ttl=0s"},
+		}},
+		{durabilityFlush, true, map[string][2]string{
+			"": {"flush", "sync ttl=0s"}, "cache": {"db", "put"}, "db": {"db", "put"}, "flush": {"flush", "sync ttl=0s"},
+		}},
+		// Without downgrades every PUT gets at least the default.
+		{durabilityFlush, false, map[string][2]string{
+			"": {"flush", "sync ttl=0s"}, "cache": {"flush", "sync ttl=0s"}, "db": {"flush", "sync ttl=0s"}, "flush": {"flush", "sync ttl=0s"},
+		}},
+	} {
+		t.Run(fmt.Sprintf("%s/downgrades=%v", tc.def, tc.downgrades), func(t *testing.T) {
+			store := &pathStore{Store: NewMemStore()}
+			s := newTestServer(store)
+			s.durability = durabilityPolicy{def: tc.def, downgrades: tc.downgrades}
+			ts := httptest.NewServer(s.routes())
+			defer ts.Close()
+
+			counts := make(map[string]int64)
+			for header, want := range tc.want {
+				var h []string
+				if header != "" {
+					h = []string{"X-Durability", header}
+				}
+				status, _, resp := do(t, "PUT", ts.URL+"/kv/k", "v", h...)
+				if status != http.StatusOK || resp.Get("X-Durability") != want[0] || store.last() != want[1] {
+					t.Errorf("X-Durability %q: status %d, achieved %q; want %s by %s", header, status, resp.Get("X-Durability"), want[0], want[1])
+				}
+				counts[want[0]]++
+			}
+			st := s.stats().Durability
+			for _, level := range durabilityLevels {
+				if st.Writes[level] != counts[level] {
+					t.Errorf("stats count %d %s writes, want %d", st.Writes[level], level, counts[level])
+				}
+			}
+			_, metrics, _ := do(t, "GET", ts.URL+"/metrics", "")
+			if want := fmt.Sprintf("kv_writes_by_durability_total{level=\"flush\"} %d\n", counts["flush"]); !strings.Contains(metrics, want) {
+				t.Errorf("/metrics lacks %q", want)
+			}
+
+			if status, _, _ := do(t, "PUT", ts.URL+"/kv/k", "v", "X-Durability", "disk"); status != http.StatusBadRequest || store.last() != "" {
+				t.Errorf("unknown X-Durability: status %d, want 400 without a write", status)
+			}
+		})
+	}
+}
+
+func TestDurabilityPaths(t *testing.T) {
+	store := &pathStore{Store: NewMemStore()}
+	s := newTestServer(store)
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	flush := []string{"X-Durability", "flush"}
+
+	for _, tc := range []struct {
+		name, url string
+		header    []string
+		level     string
+		path      string
+	}{
+		{"flush with a ttl", "/kv/k?ttl=1m", flush, "flush", "sync ttl=1m0s"},
+		{"ttl", "/kv/k?ttl=1m", nil, "db", "ttl"},
+		// A conditional PUT runs its check in the store, unflushed.
+		{"conditional flush", "/kv/k", append(flush, "If-Unmodified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)), "db", "conditional"},
+	} {
+		status, _, h := do(t, "PUT", ts.URL+tc.url, "v", tc.header...)
+		if status != http.StatusOK || h.Get("X-Durability") != tc.level || store.last() != tc.path {
+			t.Errorf("%s: status %d, achieved %q; want %s by %s", tc.name, status, h.Get("X-Durability"), tc.level, tc.path)
+		}
+	}
+
+	// A store that cannot flush commits as usual and says so.
+	for name, st := range map[string]Store{
+		"memory":  NewMemStore(),
+		"sharded": NewShardedStore([]Store{NewMemStore(), NewMemStore()}),
+	} {
+		s := newTestServer(st)
+		ts := httptest.NewServer(s.routes())
+		if _, _, h := do(t, "PUT", ts.URL+"/kv/k", "v", flush...); h.Get("X-Durability") != "db" {
+			t.Errorf("flush PUT to the %s store achieved %q, want db", name, h.Get("X-Durability"))
+		}
+		ts.Close()
+	}
+	sharded := newTestServer(NewShardedStore([]Store{&pathStore{Store: NewMemStore()}}))
+	ts2 := httptest.NewServer(sharded.routes())
+	defer ts2.Close()
+	if _, _, h := do(t, "PUT", ts2.URL+"/kv/k", "v", flush...); h.Get("X-Durability") != "flush" {
+		t.Errorf("flush PUT through a sharded store to a flushing shard achieved %q, want flush", h.Get("X-Durability"))
+	}
+}
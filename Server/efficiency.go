@@ -0,0 +1,209 @@
+package main
+
+import (
+	"container/heap"
+	"hash/maphash"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTracedAccesses bounds the sampled accesses kept, whatever the window.
+const maxTracedAccesses = 1 << 18
+
+// cacheEfficiency estimates the hit rate a clairvoyant cache of the same
+// size would have had on recent traffic, to compare with the cache's own.
+//
+// Keys are sampled by hash, so every GET and PUT of a sampled key is
+// traced and the rest cost one hash. Replaying the trace through
+// Belady's optimal policy (evict the key needed furthest in the future)
+// with the cache size scaled by the sampling rate approximates the
+// optimal hit rate of the full cache; this is the SHARDS approximation,
+// and it gets noisy when few keys or few cache slots are sampled.
+type cacheEfficiency struct {
+	seed      maphash.Seed
+	threshold uint64
+	rate      float64
+	window    time.Duration
+	cache     *Cache
+
+	mu    sync.Mutex
+	trace []access
+}
+
+// access is one traced request: a GET, which hit or missed, or a PUT,
+// which leaves the value in the cache.
+type access struct {
+	at    int64
+	key   uint64
+	write bool
+	hit   bool
+}
+
+type cacheEfficiencyStats struct {
+	WindowSeconds float64 `json:"window_seconds"`
+	SampleRate    float64 `json:"sample_rate"`
+	SampledKeys   int     `json:"sampled_keys"`
+	SampledGets   int64   `json:"sampled_gets"`
+	// SampledCacheSize is the cache size scaled by the sample rate, the
+	// size the trace is replayed with.
+	SampledCacheSize int `json:"sampled_cache_size"`
+	// ActualHitRate is the cache's own, over the sampled GETs.
+	ActualHitRate float64 `json:"actual_hit_rate"`
+	// EstimatedOptimalHitRate is approximate; it is unset when the scaled
+	// cache holds no entry at all.
+	EstimatedOptimalHitRate *float64 `json:"estimated_optimal_hit_rate,omitempty"`
+}
+
+func newCacheEfficiency(cache *Cache, window time.Duration, rate float64) *cacheEfficiency {
+	e := &cacheEfficiency{seed: maphash.MakeSeed(), threshold: math.MaxUint64, rate: rate, window: window, cache: cache}
+	if rate < 1 {
+		e.threshold = uint64(rate * math.MaxUint64)
+	}
+	return e
+}
+
+// recordGet and recordPut are no-ops on a nil receiver, i.e. without
+// -cache-efficiency-window.
+func (e *cacheEfficiency) recordGet(key string, hit bool) {
+	e.record(key, false, hit)
+}
+
+func (e *cacheEfficiency) recordPut(key string) {
+	e.record(key, true, false)
+}
+
+func (e *cacheEfficiency) record(key string, write, hit bool) {
+	if e == nil {
+		return
+	}
+	h := maphash.String(e.seed, key)
+	if h >= e.threshold {
+		return
+	}
+	e.mu.Lock()
+	if len(e.trace) == maxTracedAccesses {
+		n := copy(e.trace, e.trace[maxTracedAccesses/4:])
+		e.trace = e.trace[:n]
+	}
+	e.trace = append(e.trace, access{at: time.Now().UnixNano(), key: h, write: write, hit: hit})
+	e.mu.Unlock()
+}
+
+func (e *cacheEfficiency) stats() *cacheEfficiencyStats {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	cutoff := time.Now().Add(-e.window).UnixNano()
+	old := sort.Search(len(e.trace), func(i int) bool { return e.trace[i].at >= cutoff })
+	n := copy(e.trace, e.trace[old:])
+	e.trace = e.trace[:n]
+	trace := slices.Clone(e.trace)
+	e.mu.Unlock()
+
+	st := &cacheEfficiencyStats{
+		WindowSeconds:    e.window.Seconds(),
+		SampleRate:       e.rate,
+		SampledCacheSize: int(math.Round(float64(e.cache.MaxSize()) * e.rate)),
+	}
+	keys := make(map[uint64]struct{})
+	var hits int64
+	for _, a := range trace {
+		keys[a.key] = struct{}{}
+		if !a.write {
+			st.SampledGets++
+			if a.hit {
+				hits++
+			}
+		}
+	}
+	st.SampledKeys = len(keys)
+	if st.SampledGets > 0 {
+		st.ActualHitRate = float64(hits) / float64(st.SampledGets) * 100
+	}
+	if st.SampledCacheSize > 0 {
+		var optimal float64
+		if st.SampledGets > 0 {
+			optimal = float64(optimalHits(trace, st.SampledCacheSize)) / float64(st.SampledGets) * 100
+		}
+		st.EstimatedOptimalHitRate = &optimal
+	}
+	return st
+}
+
+// optimalHits replays trace through a cache of size entries that always
+// evicts the key read furthest in the future, and may decline to cache a
+// key read later than all it holds. A key's first read counts as a hit if
+// it was one for the real cache, as neither cache's content before the
+// trace is known.
+func optimalHits(trace []access, size int) int64 {
+	const never = math.MaxInt
+	// next[i] is when the key of trace[i] is next read, or never if it is
+	// written first, since the write brings the value anyway.
+	next := make([]int, len(trace))
+	later := make(map[uint64]int)
+	for i := len(trace) - 1; i >= 0; i-- {
+		next[i] = never
+		if j, ok := later[trace[i].key]; ok && !trace[j].write {
+			next[i] = j
+		}
+		later[trace[i].key] = i
+	}
+
+	var hits int64
+	seen := make(map[uint64]bool)
+	cached := make(map[uint64]int)
+	uses := &nextUses{}
+	for i, a := range trace {
+		_, in := cached[a.key]
+		if !a.write && (in || !seen[a.key] && a.hit) {
+			hits++
+		}
+		seen[a.key] = true
+		if next[i] == never {
+			delete(cached, a.key)
+			continue
+		}
+		if !in && len(cached) >= size {
+			// Entries whose key was dropped or given a new next use
+			// since are stale and skipped.
+			var furthest nextUse
+			for {
+				furthest = heap.Pop(uses).(nextUse)
+				if at, ok := cached[furthest.key]; ok && at == furthest.at {
+					break
+				}
+			}
+			if furthest.at < next[i] {
+				heap.Push(uses, furthest)
+				continue
+			}
+			delete(cached, furthest.key)
+		}
+		cached[a.key] = next[i]
+		heap.Push(uses, nextUse{at: next[i], key: a.key})
+	}
+	return hits
+}
+
+type nextUse struct {
+	at  int
+	key uint64
+}
+
+// nextUses is a max-heap of next uses.
+type nextUses []nextUse
+
+func (h nextUses) Len() int           { return len(h) }
+func (h nextUses) Less(i, j int) bool { return h[i].at > h[j].at }
+func (h nextUses) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *nextUses) Push(x any)        { *h = append(*h, x.(nextUse)) }
+func (h *nextUses) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errNotJSON = errors.New("value is not JSON")
+
+// parseFieldPath splits "user.addresses[0].city" or "user.addresses.0.city"
+// into its segments. Brackets may only hold an array index.
+func parseFieldPath(path string) ([]string, error) {
+	var segs []string
+	for i := 0; i < len(path); {
+		var end int
+		if path[i] == '[' {
+			end = strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("field path %q: unclosed [", path)
+			}
+			index := path[i+1 : i+end]
+			if _, err := strconv.Atoi(index); err != nil {
+				return nil, fmt.Errorf("field path %q: brackets must hold an array index", path)
+			}
+			segs = append(segs, index)
+			end++
+		} else {
+			end = strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("field path %q has an empty segment", path)
+			}
+			segs = append(segs, path[i:i+end])
+		}
+		i += end
+		if i < len(path) && path[i] == '.' {
+			if i++; i == len(path) {
+				return nil, fmt.Errorf("field path %q has an empty segment", path)
+			}
+		} else if i < len(path) && path[i] != '[' {
+			return nil, fmt.Errorf("field path %q: unexpected %q after ]", path, path[i:])
+		}
+	}
+	if len(segs) == 0 {
+		return nil, errors.New("field path is empty")
+	}
+	return segs, nil
+}
+
+// extractField returns the JSON encoding of the value at path in doc.
+// Numbers are decoded as json.Number so they come back unchanged.
+func extractField(doc, path string) ([]byte, error) {
+	segs, err := parseFieldPath(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, errNotJSON
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errNotJSON
+	}
+	for i, seg := range segs {
+		switch node := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = node[seg]; !ok {
+				return nil, fmt.Errorf("field %q not found", strings.Join(segs[:i+1], "."))
+			}
+		case []any:
+			n, err := strconv.Atoi(seg)
+			if err != nil || n < 0 || n >= len(node) {
+				return nil, fmt.Errorf("index %q out of range at %q", seg, strings.Join(segs[:i], "."))
+			}
+			v = node[n]
+		default:
+			return nil, fmt.Errorf("%q is not an object or array", strings.Join(segs[:i], "."))
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
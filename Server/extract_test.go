@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseFieldPath(t *testing.T) {
+	for path, want := range map[string][]string{
+		"user":                  {"user"},
+		"user.name":             {"user", "name"},
+		"items[2]":              {"items", "2"},
+		"items.2":               {"items", "2"},
+		"a[0][1].b":             {"a", "0", "1", "b"},
+		"user.addresses[0].zip": {"user", "addresses", "0", "zip"},
+		"[3]":                   {"3"},
+	} {
+		got, err := parseFieldPath(path)
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("parseFieldPath(%q) = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	for _, path := range []string{"", ".", "a.", ".a", "a..b", "a[", "a[x]", "a[0]b", "a[]"} {
+		if got, err := parseFieldPath(path); err == nil {
+			t.Errorf("parseFieldPath(%q) = %q, want an error", path, got)
+		}
+	}
+}
+
+const extractDoc = `{"user": {"name": "Ada", "tags": ["a", "b"], "age": 36.50, "html": "<b>"}, "items": [{"id": 1}, {"id": 2}], "nil": null}`
+
+func TestExtractField(t *testing.T) {
+	for path, want := range map[string]string{
+		"user.name":   `"Ada"`,
+		"user.tags":   `["a","b"]`,
+		"user.tags.1": `"b"`,
+		"items[1].id": `2`,
+		"user.age":    `36.50`,
+		"user.html":   `"<b>"`,
+		"nil":         `null`,
+	} {
+		got, err := extractField(extractDoc, path)
+		if err != nil || strings.TrimSpace(string(got)) != want {
+			t.Errorf("extractField(%q) = %q, %v; want %s", path, got, err, want)
+		}
+	}
+	for _, path := range []string{"user.missing", "items[2]", "items[-1]", "items.x", "user.name.first"} {
+		if got, err := extractField(extractDoc, path); err == nil {
+			t.Errorf("extractField(%q) = %q, want an error", path, got)
+		}
+	}
+	for _, doc := range []string{"plain text", `{"a": 1} trailing`, `{"a": `} {
+		if _, err := extractField(doc, "a"); err != errNotJSON {
+			t.Errorf("extractField of %q: %v, want errNotJSON", doc, err)
+		}
+	}
+}
+
+func TestGetField(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	do(t, "PUT", ts.URL+"/kv/doc", extractDoc)
+	do(t, "PUT", ts.URL+"/kv/text", "plain text")
+
+	status, body, h := do(t, "GET", ts.URL+"/kv/doc?field="+url.QueryEscape("items[0].id"), "")
+	if status != http.StatusOK || strings.TrimSpace(body) != "1" || h.Get("Content-Type") != "application/json" {
+		t.Errorf("GET ?field=items[0].id: status %d, %q, Content-Type %q", status, body, h.Get("Content-Type"))
+	}
+	for _, q := range []string{"doc?field=user.missing", "text?field=a", "doc?field=a..b"} {
+		if status, _, _ := do(t, "GET", ts.URL+"/kv/"+q, ""); status != http.StatusUnprocessableEntity {
+			t.Errorf("GET %s: status %d, want 422", q, status)
+		}
+	}
+	// The cache holds the whole value, not the field.
+	if v, ok := s.cache.Get("doc"); !ok || v != extractDoc {
+		t.Errorf("cached %q, %v; want the whole document", v, ok)
+	}
+	if _, body, _ := do(t, "GET", ts.URL+"/kv/doc", ""); body != extractDoc {
+		t.Errorf("GET without ?field = %q", body)
+	}
+}
+
+// BenchmarkGetField compares a GET of one field of a 200KB document with
+// a GET of the whole document.
+func BenchmarkGetField(b *testing.B) {
+	var doc strings.Builder
+	doc.WriteString(`{"user": {"name": "Ada"}, "items": [`)
+	for i := 0; doc.Len() < 200<<10; i++ {
+		if i > 0 {
+			doc.WriteString(",")
+		}
+		fmt.Fprintf(&doc, `{"id": %d, "payload": "%s"}`, i, strings.Repeat("x", 100))
+	}
+	doc.WriteString("]}")
+	s := newTestServer(NewMemStore())
+	s.cache.Set("doc", doc.String())
+	h := s.routes()
+	for _, path := range []string{"/kv/doc", "/kv/doc?field=user.name"} {
+		b.Run(fmt.Sprintf("field=%t", strings.Contains(path, "field")), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+				if w.Code != http.StatusOK {
+					b.Fatalf("GET %s: status %d", path, w.Code)
+				}
+				b.SetBytes(int64(w.Body.Len()))
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// faultConfig is the body of POST /admin/faults. Each /kv/ or /cache/
+// request in scope is delayed with probability LatencyPct and then failed
+// with probability ErrorPct. Durations are Go duration strings.
+type faultConfig struct {
+	LatencyPct float64 `json:"latency_pct"`
+	// Latency is the delay for fixed, the minimum for uniform and the mean
+	// for exponential; LatencyMax is the maximum for uniform.
+	Latency     string  `json:"latency,omitempty"`
+	LatencyDist string  `json:"latency_dist,omitempty"`
+	LatencyMax  string  `json:"latency_max,omitempty"`
+	ErrorPct    float64 `json:"error_pct"`
+	ErrorStatus int     `json:"error_status,omitempty"`
+
+	// Methods and Prefix narrow the requests affected; empty means all.
+	Methods []string `json:"methods,omitempty"`
+	Prefix  string   `json:"prefix,omitempty"`
+
+	latency, latencyMax time.Duration
+}
+
+type faultsResponse struct {
+	Active          *faultConfig `json:"active"`
+	Since           *time.Time   `json:"since,omitempty"`
+	InjectedLatency int64        `json:"injected_latency"`
+	InjectedErrors  int64        `json:"injected_errors"`
+}
+
+// faultInjector makes the server misbehave on demand for testing clients.
+// Injected requests carry X-Fault-Injected, which the latency metrics use
+// as a label so they are not mistaken for real behaviour.
+type faultInjector struct {
+	cfg   atomic.Pointer[faultConfig]
+	since atomic.Pointer[time.Time]
+
+	injectedLatency, injectedErrors int64
+}
+
+func (c *faultConfig) validate() error {
+	var err error
+	switch {
+	case c.LatencyPct < 0 || c.LatencyPct > 100 || c.ErrorPct < 0 || c.ErrorPct > 100:
+		return fmt.Errorf("latency_pct and error_pct must be between 0 and 100")
+	case c.LatencyPct == 0 && c.ErrorPct == 0:
+		return fmt.Errorf("latency_pct or error_pct must be set")
+	}
+	if c.LatencyPct > 0 {
+		if c.latency, err = time.ParseDuration(c.Latency); err != nil || c.latency <= 0 {
+			return fmt.Errorf("latency must be a positive duration")
+		}
+		switch c.LatencyDist {
+		case "":
+			c.LatencyDist = "fixed"
+		case "fixed", "exponential":
+		case "uniform":
+			if c.latencyMax, err = time.ParseDuration(c.LatencyMax); err != nil || c.latencyMax < c.latency {
+				return fmt.Errorf("latency_max must be a duration of at least latency")
+			}
+		default:
+			return fmt.Errorf("latency_dist must be fixed, uniform or exponential")
+		}
+	}
+	if c.ErrorPct > 0 {
+		switch c.ErrorStatus {
+		case 0:
+			c.ErrorStatus = http.StatusServiceUnavailable
+		case http.StatusInternalServerError, http.StatusServiceUnavailable:
+		default:
+			return fmt.Errorf("error_status must be 500 or 503")
+		}
+	}
+	for i, m := range c.Methods {
+		c.Methods[i] = strings.ToUpper(m)
+	}
+	return nil
+}
+
+func (c *faultConfig) delay() time.Duration {
+	switch c.LatencyDist {
+	case "uniform":
+		return c.latency + time.Duration(rand.Int63n(int64(c.latencyMax-c.latency)+1))
+	case "exponential":
+		return time.Duration(rand.ExpFloat64() * float64(c.latency))
+	}
+	return c.latency
+}
+
+func (c *faultConfig) applies(r *http.Request) bool {
+	if len(c.Methods) > 0 && !slices.Contains(c.Methods, r.Method) {
+		return false
+	}
+	for _, prefix := range []string{"/kv/", "/cache/"} {
+		if key, ok := strings.CutPrefix(r.URL.Path, prefix); ok {
+			return strings.HasPrefix(key, c.Prefix)
+		}
+	}
+	return false
+}
+
+func (f *faultInjector) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := f.cfg.Load()
+		if c == nil || !c.applies(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if c.LatencyPct > 0 && rand.Float64()*100 < c.LatencyPct {
+			atomic.AddInt64(&f.injectedLatency, 1)
+			w.Header().Set("X-Fault-Injected", "latency")
+			select {
+			case <-time.After(c.delay()):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if c.ErrorPct > 0 && rand.Float64()*100 < c.ErrorPct {
+			atomic.AddInt64(&f.injectedErrors, 1)
+			w.Header().Set("X-Fault-Injected", "error")
+			http.Error(w, "Injected fault", c.ErrorStatus)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *faultInjector) response() faultsResponse {
+	return faultsResponse{
+		Active:          f.cfg.Load(),
+		Since:           f.since.Load(),
+		InjectedLatency: atomic.LoadInt64(&f.injectedLatency),
+		InjectedErrors:  atomic.LoadInt64(&f.injectedErrors),
+	}
+}
+
+// faultsHandler serves GET, POST and DELETE /admin/faults.
+func (s *Server) faultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var c faultConfig
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&c); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := c.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		s.faults.cfg.Store(&c)
+		s.faults.since.Store(&now)
+		log.Printf("Fault injection on: %.1f%% latency (%s %s), %.1f%% errors (%d), methods %v, prefix %q",
+			c.LatencyPct, c.LatencyDist, c.Latency, c.ErrorPct, c.ErrorStatus, c.Methods, c.Prefix)
+	case "DELETE":
+		s.faults.cfg.Store(nil)
+		s.faults.since.Store(nil)
+		log.Printf("Fault injection off")
+	default:
+		methodNotAllowed(w, "GET, POST, DELETE")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.faults.response())
+}
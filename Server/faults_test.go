@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultErrorRate(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	s.adminToken = testAdminToken
+	h := s.routes()
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	admin(t, "PUT", ts.URL+"/kv/k", "v")
+
+	if status, body, _ := admin(t, "POST", ts.URL+"/admin/faults", `{"error_pct": 30}`); status != http.StatusOK {
+		t.Fatalf("POST /admin/faults: status %d (%s)", status, body)
+	}
+	const n, pct = 4000, 30
+	failed := 0
+	for range n {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/kv/k", nil))
+		switch w.Code {
+		case http.StatusServiceUnavailable:
+			if w.Header().Get("X-Fault-Injected") != "error" {
+				t.Fatal("injected 503 without X-Fault-Injected: error")
+			}
+			failed++
+		case http.StatusOK:
+		default:
+			t.Fatalf("GET: status %d", w.Code)
+		}
+	}
+	// Within five standard deviations of the binomial.
+	want, sd := float64(n*pct/100), math.Sqrt(n*pct/100*(1-pct/100.0))
+	if math.Abs(float64(failed)-want) > 5*sd {
+		t.Errorf("%d of %d GETs failed, want %.0f ± %.0f", failed, n, want, 5*sd)
+	}
+	_, body, _ := admin(t, "GET", ts.URL+"/admin/faults", "")
+	var res faultsResponse
+	if err := json.Unmarshal([]byte(body), &res); err != nil || res.Active == nil || res.InjectedErrors != int64(failed) {
+		t.Errorf("GET /admin/faults = %s, want %d injected errors", body, failed)
+	}
+	_, metrics, _ := do(t, "GET", ts.URL+"/metrics", "")
+	if !strings.Contains(metrics, `fault="error"`) {
+		t.Error("/metrics does not label the injected failures")
+	}
+
+	// Clearing takes effect on the very next request.
+	admin(t, "DELETE", ts.URL+"/admin/faults", "")
+	for i := range 100 {
+		if status, _, h := do(t, "GET", ts.URL+"/kv/k", ""); status != http.StatusOK || h.Get("X-Fault-Injected") != "" {
+			t.Fatalf("GET %d after clearing: status %d, X-Fault-Injected %q", i, status, h.Get("X-Fault-Injected"))
+		}
+	}
+	if _, body, _ := admin(t, "GET", ts.URL+"/admin/faults", ""); !strings.Contains(body, `"active":null`) {
+		t.Errorf("GET /admin/faults after DELETE = %s", body)
+	}
+}
+
+func TestFaultScopeAndLatency(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	do(t, "PUT", ts.URL+"/kv/slow-k", "v")
+	do(t, "PUT", ts.URL+"/kv/k", "v")
+
+	if status, body, _ := do(t, "POST", ts.URL+"/admin/faults",
+		`{"latency_pct": 100, "latency": "50ms", "error_pct": 100, "error_status": 500, "methods": ["get"], "prefix": "slow-"}`); status != http.StatusOK {
+		t.Fatalf("POST /admin/faults: status %d (%s)", status, body)
+	}
+	start := time.Now()
+	status, _, h := do(t, "GET", ts.URL+"/kv/slow-k", "")
+	if status != http.StatusInternalServerError || h.Get("X-Fault-Injected") != "error" || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("GET in scope: status %d, X-Fault-Injected %q after %s", status, h.Get("X-Fault-Injected"), time.Since(start))
+	}
+	for _, req := range []struct{ method, key string }{{"GET", "k"}, {"PUT", "slow-k"}} {
+		start := time.Now()
+		if status, _, _ := do(t, req.method, ts.URL+"/kv/"+req.key, "v"); status != http.StatusOK || time.Since(start) > 40*time.Millisecond {
+			t.Errorf("%s %s out of scope: status %d after %s", req.method, req.key, status, time.Since(start))
+		}
+	}
+
+	for _, body := range []string{
+		`{}`,
+		`{"error_pct": 101}`,
+		`{"error_pct": 10, "error_status": 404}`,
+		`{"latency_pct": 10}`,
+		`{"latency_pct": 10, "latency": "1ms", "latency_dist": "uniform", "latency_max": "0s"}`,
+		`{"latency_pct": 10, "latency": "1ms", "latency_dist": "pareto"}`,
+	} {
+		if status, _, _ := do(t, "POST", ts.URL+"/admin/faults", body); status != http.StatusBadRequest {
+			t.Errorf("POST %s: status %d, want 400", body, status)
+		}
+	}
+	s.adminToken = testAdminToken
+	if status, _, _ := do(t, "DELETE", ts.URL+"/admin/faults", ""); status != http.StatusUnauthorized {
+		t.Errorf("DELETE without the token: status %d, want 401", status)
+	}
+}
+
+func TestFaultDelayDistributions(t *testing.T) {
+	c := faultConfig{LatencyPct: 100, Latency: "10ms", LatencyDist: "uniform", LatencyMax: "20ms"}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for range 1000 {
+		if d := c.delay(); d < 10*time.Millisecond || d > 20*time.Millisecond {
+			t.Fatalf("uniform delay %s outside [10ms, 20ms]", d)
+		}
+	}
+	c = faultConfig{LatencyPct: 100, Latency: "10ms", LatencyDist: "exponential"}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	var sum time.Duration
+	for range 10000 {
+		sum += c.delay()
+	}
+	if mean := sum / 10000; mean < 9*time.Millisecond || mean > 11*time.Millisecond {
+		t.Errorf("exponential delay mean %s, want about 10ms", mean)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+const (
+	generateChunk    = 10000
+	maxGenerateCount = 100_000_000
+)
+
+type generateRequest struct {
+	Prefix       string  `json:"prefix"`
+	Start        int     `json:"start"`
+	Count        int     `json:"count"`
+	ValueSize    int     `json:"value_size"`
+	ValueContent string  `json:"value_content"`
+	CacheFill    float64 `json:"cache_fill"`
+}
+
+type generateProgress struct {
+	Inserted  int    `json:"inserted"`
+	Total     int    `json:"total"`
+	Cached    int    `json:"cached,omitempty"`
+	Done      bool   `json:"done,omitempty"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// bulkLoader is implemented by stores with a faster path than PutMany for
+// large writes.
+type bulkLoader interface {
+	BulkLoad(ctx context.Context, entries []KeyValue) error
+}
+
+// BulkLoad copies entries into a temporary table and upserts them from
+// there, since COPY itself cannot resolve conflicts.
+func (p *PostgresStore) BulkLoad(ctx context.Context, entries []KeyValue) error {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn any) error {
+		c := driverConn.(*stdlib.Conn).Conn()
+		tx, err := c.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		if _, err := tx.Exec(ctx, "CREATE TEMP TABLE kv_generate (key TEXT, value TEXT) ON COMMIT DROP"); err != nil {
+			return err
+		}
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"kv_generate"}, []string{"key", "value"},
+			pgx.CopyFromSlice(len(entries), func(i int) ([]any, error) {
+				return []any{entries[i].Key, entries[i].Value}, nil
+			}))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO kv_store (key, value) SELECT key, value FROM kv_generate
+			ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, deleted_at = NULL, expires_at = NULL, updated_at = now()`)
+		if err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+}
+
+func (s *ShardedStore) BulkLoad(ctx context.Context, entries []KeyValue) error {
+	byShard := make([][]KeyValue, len(s.shards))
+	for _, e := range entries {
+		i := s.shardIndex(e.Key)
+		byShard[i] = append(byShard[i], e)
+	}
+	return s.fanOut(func(i int, shard Store) error {
+		if len(byShard[i]) == 0 {
+			return nil
+		}
+		return bulkLoad(ctx, shard, byShard[i])
+	})
+}
+
+func bulkLoad(ctx context.Context, store Store, entries []KeyValue) error {
+	if b, ok := store.(bulkLoader); ok {
+		return b.BulkLoad(ctx, entries)
+	}
+	_, err := store.PutMany(ctx, entries)
+	return err
+}
+
+// generateHandler writes count keys prefix{start}.. in chunks,
+// reporting progress as one JSON line per chunk. The first cache_fill
+// fraction of the keys is put in the cache; the rest is evicted so the
+// cache never serves a value the generator overwrote.
+func (s *Server) generateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if !s.checkWrite(w, r) {
+		return
+	}
+	req := generateRequest{Prefix: "key-", ValueSize: 64, ValueContent: "random"}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Start < 0:
+		http.Error(w, "start must not be negative", http.StatusBadRequest)
+		return
+	case req.Count <= 0 || req.Count > maxGenerateCount:
+		http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxGenerateCount), http.StatusBadRequest)
+		return
+	case req.ValueSize < 0 || int64(req.ValueSize) > s.maxValueBytes:
+		http.Error(w, "value_size is negative or above -max-value-bytes", http.StatusBadRequest)
+		return
+	case len(req.Prefix)+len(strconv.Itoa(req.Start+req.Count)) > s.maxKeyBytes:
+		http.Error(w, "prefix makes keys longer than -max-key-bytes", http.StatusBadRequest)
+		return
+	case req.CacheFill < 0 || req.CacheFill > 1:
+		http.Error(w, "cache_fill must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+	value, err := valueGenerator(req.ValueContent, req.ValueSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.overQuota(w, req.Prefix, int64(req.Count)*int64(req.ValueSize), 0) {
+		return
+	}
+
+	// A large run outlasts -write-timeout; progress lines keep the
+	// connection busy instead.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	start := time.Now()
+	progress := generateProgress{Total: req.Count}
+	send := func() {
+		progress.ElapsedMs = time.Since(start).Milliseconds()
+		enc.Encode(progress)
+		rc.Flush()
+	}
+
+	ctx := r.Context()
+	fill := int(float64(req.Count) * req.CacheFill)
+	entries := make([]KeyValue, 0, min(generateChunk, req.Count))
+	for from := 0; from < req.Count; from += generateChunk {
+		entries = entries[:0]
+		for i := from; i < min(from+generateChunk, req.Count); i++ {
+			key := req.Prefix + strconv.Itoa(req.Start+i)
+			entries = append(entries, KeyValue{Key: key, Value: value(key)})
+		}
+		if err := s.generateChunk(ctx, entries); err != nil {
+			progress.Error = err.Error()
+			if ctx.Err() != nil {
+				progress.Error = "cancelled"
+			}
+			log.Printf("Generate stopped after %d of %d keys: %v", progress.Inserted, req.Count, err)
+			send()
+			return
+		}
+		for i, e := range entries {
+			if from+i < fill && (s.streamThreshold <= 0 || int64(len(e.Value)) <= s.streamThreshold) {
+				s.cache.Set(e.Key, e.Value)
+				progress.Cached++
+			} else {
+				s.cache.Delete(e.Key)
+			}
+		}
+		for _, e := range entries {
+			s.quota.add(e.Key, int64(len(e.Value)))
+		}
+		progress.Inserted += len(entries)
+		send()
+	}
+	progress.Done = true
+	log.Printf("Generated %d keys with prefix %q in %s", req.Count, req.Prefix, time.Since(start).Round(time.Millisecond))
+	send()
+}
+
+func (s *Server) generateChunk(ctx context.Context, entries []KeyValue) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.keys != nil {
+		for _, e := range entries {
+			defer s.keys.adding(e.Key)()
+		}
+	}
+	return bulkLoad(ctx, s.store, entries)
+}
+
+// valueGenerator returns a func producing each key's value: random
+// alphanumerics, a repeated "x", or "data-<key>" as the client primes.
+func valueGenerator(content string, size int) (func(key string) string, error) {
+	switch content {
+	case "", "random":
+		const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+		return func(string) string {
+			b := make([]byte, size)
+			rand.Read(b)
+			for i := range b {
+				b[i] = alphabet[int(b[i])%len(alphabet)]
+			}
+			return string(b)
+		}, nil
+	case "fixed":
+		v := strings.Repeat("x", size)
+		return func(string) string { return v }, nil
+	case "key":
+		return func(key string) string { return "data-" + key }, nil
+	}
+	return nil, fmt.Errorf("unknown value_content %q (want random, fixed, or key)", content)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestResponseHeaders walks each GET, PUT and DELETE path and checks the
+// headers the load generator relies on.
+func TestResponseHeaders(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	s.tombstoneTTL = time.Minute
+	s.skipUnchanged = true
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	kv := ts.URL + "/kv/"
+	large := strings.Repeat("x", int(s.streamThreshold)+1)
+
+	steps := []struct {
+		name         string
+		method, key  string
+		body         string
+		before       func()
+		status       int
+		header, want string
+	}{
+		{"put new", "PUT", "k", "v", nil, http.StatusOK, "X-Created", "true"},
+		{"put existing", "PUT", "k", "v2", nil, http.StatusOK, "X-Created", "false"},
+		{"put unchanged", "PUT", "k", "v2", nil, http.StatusOK, "X-Created", "false"},
+		{"put streamed", "PUT", "large", large, nil, http.StatusOK, "X-Created", "true"},
+		{"get hit", "GET", "k", "", nil, http.StatusOK, "X-Cache", "HIT"},
+		{"get miss", "GET", "k", "", func() { s.cache.Delete("k") }, http.StatusOK, "X-Cache", "MISS"},
+		{"get streamed", "GET", "large", "", nil, http.StatusOK, "X-Cache", "BYPASS"},
+		{"get absent", "GET", "absent", "", nil, http.StatusNotFound, "X-Cache", "MISS"},
+		{"delete existing", "DELETE", "k", "", nil, http.StatusOK, "X-Deleted", "true"},
+		{"get tombstoned", "GET", "k", "", nil, http.StatusNotFound, "X-Cache", "NEGATIVE"},
+		{"delete absent", "DELETE", "absent", "", nil, http.StatusOK, "X-Deleted", "false"},
+		{"put over tombstone", "PUT", "k", "v3", nil, http.StatusOK, "X-Created", "true"},
+		{"get store error", "GET", "k", "", func() {
+			s.cache.Delete("k")
+			s.store = downStore{s.store}
+		}, http.StatusInternalServerError, "X-Cache", "MISS"},
+	}
+	for _, st := range steps {
+		if st.before != nil {
+			st.before()
+		}
+		status, body, h := do(t, st.method, kv+st.key, st.body)
+		if status != st.status {
+			t.Fatalf("%s: status %d, want %d (%s)", st.name, status, st.status, body)
+		}
+		if got := h.Get(st.header); got != st.want {
+			t.Errorf("%s: %s = %q, want %q", st.name, st.header, got, st.want)
+		}
+		if st.method == "GET" && h.Get("Content-Length") != strconv.Itoa(len(body)) {
+			t.Errorf("%s: Content-Length %q for a %d byte body", st.name, h.Get("Content-Length"), len(body))
+		}
+	}
+}
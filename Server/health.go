@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type readyResponse struct {
+	Ready  bool          `json:"ready"`
+	Error  string        `json:"error,omitempty"`
+	Shards []shardHealth `json:"shards,omitempty"`
+	// Degraded reports a store latency stall; it does not fail readiness.
+	Degraded bool `json:"degraded"`
+}
+
+const healthTimeout = 2 * time.Second
+
+func (s *Server) readiness(ctx context.Context) readyResponse {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	resp := readyResponse{Ready: true}
+	switch st := unwrapStore(s.store).(type) {
+	case *ShardedStore:
+		resp.Shards = st.Health(ctx)
+		for _, h := range resp.Shards {
+			if !h.Healthy {
+				resp.Ready = false
+			}
+		}
+	case pinger:
+		if err := st.Ping(ctx); err != nil {
+			resp = readyResponse{Error: err.Error()}
+		}
+	}
+	resp.Degraded = s.stall.degraded()
+	return resp
+}
+
+// readyzHandler answers 503 while any database (or any shard) is unreachable.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+	resp := s.readiness(r.Context())
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
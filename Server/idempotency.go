@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxIdempotencyKeyBytes = 255
+	// maxIdempotencyRecords bounds the table; new keys get 503 while it
+	// is full.
+	maxIdempotencyRecords = 100000
+	// maxReplayBytes is the largest response body kept for replay; larger
+	// responses are not recorded, so a retry runs again.
+	maxReplayBytes = 64 << 10
+)
+
+// replayedHeaders are the response headers a replay repeats.
+var replayedHeaders = []string{"Content-Type", "ETag", "Last-Modified", "Location", "X-Cache", "X-Created", "X-Deleted", "X-Durability", "X-Unchanged"}
+
+// idempotencyTable remembers the response to each mutating /kv/ request
+// that carried an Idempotency-Key header, so a retry with the same key
+// gets that response again instead of running twice. A record holds a
+// hash of the method, URL and body; the same key with a different request
+// gets 422. Keys are scoped to the caller's credentials. Records live in
+// memory for ttl and are lost on restart.
+//
+// Records are deliberately not written in the mutation's transaction,
+// which keeps them out of the Store interface: a crash between the
+// mutation and the record loses it, and a retry then runs again.
+type idempotencyTable struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	records map[string]*idempotencyRecord
+
+	replayed, conflicts, inProgress, full, swept int64
+}
+
+type idempotencyRecord struct {
+	hash    [sha256.Size]byte
+	done    bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+type idempotencyStats struct {
+	TTLSeconds float64 `json:"ttl_seconds"`
+	Records    int     `json:"records"`
+	Replayed   int64   `json:"replayed"`
+	Conflicts  int64   `json:"conflicts"`
+	InProgress int64   `json:"in_progress_rejections"`
+	Full       int64   `json:"table_full_rejections"`
+	Swept      int64   `json:"swept"`
+}
+
+func newIdempotencyTable(ttl time.Duration) *idempotencyTable {
+	return &idempotencyTable{ttl: ttl, records: make(map[string]*idempotencyRecord)}
+}
+
+// requestHasher starts the hash that identifies a request; the body is
+// written to it after.
+func requestHasher(r *http.Request) hash.Hash {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	return h
+}
+
+// middleware is a pass-through on a nil table, i.e. with
+// -idempotency-ttl=0.
+func (t *idempotencyTable) middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyBytes {
+			http.Error(w, "Idempotency-Key is longer than 255 bytes", http.StatusBadRequest)
+			return
+		}
+
+		key = callerScope(r) + key
+		now := time.Now()
+		t.mu.Lock()
+		rec, ok := t.records[key]
+		if ok && now.After(rec.expires) && rec.done {
+			delete(t.records, key)
+			ok = false
+		}
+		switch {
+		case ok:
+			t.mu.Unlock()
+			t.retry(w, r, rec)
+			return
+		case len(t.records) >= maxIdempotencyRecords:
+			t.mu.Unlock()
+			atomic.AddInt64(&t.full, 1)
+			http.Error(w, "Too many idempotency records in flight, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		// The record is reserved before running the request so that a
+		// concurrent retry finds it in progress. A handler that panics,
+		// as an aborted stream does, releases it on the way out.
+		rec = &idempotencyRecord{expires: now.Add(t.ttl)}
+		t.records[key] = rec
+		t.mu.Unlock()
+		finished := false
+		defer func() {
+			if !finished {
+				t.mu.Lock()
+				delete(t.records, key)
+				t.mu.Unlock()
+			}
+		}()
+
+		hasher := requestHasher(r)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, hasher), r.Body}
+		rw := &replayRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		// Whatever the handler left unread is part of the request too;
+		// reading it through the tee hashes it.
+		io.Copy(io.Discard, r.Body)
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		// Failures and oversized answers are not replayed: the retry
+		// runs again. Neither are refusals for want of credentials, so
+		// that the retry that brings them is not held to the refusal.
+		if rw.status >= 500 || rw.overflow || rw.status == http.StatusUnauthorized || rw.status == http.StatusForbidden {
+			return
+		}
+		hasher.Sum(rec.hash[:0])
+		rec.status, rec.header, rec.body = rw.status, rw.saved, rw.body.Bytes()
+		rec.expires = time.Now().Add(t.ttl)
+		rec.done = true
+		finished = true
+	})
+}
+
+// callerScope prefixes a record's key with a hash of the request's
+// credentials, so that one caller's Idempotency-Key never matches
+// another's.
+func callerScope(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return string(sum[:])
+}
+
+// retry answers a request whose key is already recorded.
+func (t *idempotencyTable) retry(w http.ResponseWriter, r *http.Request, rec *idempotencyRecord) {
+	hasher := requestHasher(r)
+	if _, err := io.Copy(hasher, r.Body); err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	var sum [sha256.Size]byte
+	hasher.Sum(sum[:0])
+	t.mu.Lock()
+	done, same := rec.done, rec.hash == sum
+	t.mu.Unlock()
+	switch {
+	case !done:
+		atomic.AddInt64(&t.inProgress, 1)
+		http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+	case !same:
+		atomic.AddInt64(&t.conflicts, 1)
+		http.Error(w, "Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+	default:
+		atomic.AddInt64(&t.replayed, 1)
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(rec.status)
+		w.Write(rec.body)
+	}
+}
+
+// replayRecorder keeps a copy of the response for replay.
+type replayRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	saved       http.Header
+	body        bytes.Buffer
+	overflow    bool
+}
+
+func (rw *replayRecorder) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		rw.status = status
+		rw.saved = make(http.Header)
+		for _, k := range replayedHeaders {
+			if v := rw.Header().Values(k); len(v) > 0 {
+				rw.saved[k] = v
+			}
+		}
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *replayRecorder) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.overflow {
+		if rw.body.Len()+len(b) > maxReplayBytes {
+			rw.overflow = true
+			rw.body = bytes.Buffer{}
+		} else {
+			rw.body.Write(b)
+		}
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *replayRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (t *idempotencyTable) sweepLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n := t.sweep(time.Now()); n > 0 {
+			log.Printf("Swept %d expired idempotency records", n)
+		}
+	}
+}
+
+// sweep drops the completed records that expired before now and returns
+// how many it dropped.
+func (t *idempotencyTable) sweep(now time.Time) int {
+	n := 0
+	t.mu.Lock()
+	for k, rec := range t.records {
+		if rec.done && now.After(rec.expires) {
+			delete(t.records, k)
+			n++
+		}
+	}
+	t.mu.Unlock()
+	atomic.AddInt64(&t.swept, int64(n))
+	return n
+}
+
+func (t *idempotencyTable) stats() *idempotencyStats {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	n := len(t.records)
+	t.mu.Unlock()
+	return &idempotencyStats{
+		TTLSeconds: t.ttl.Seconds(),
+		Records:    n,
+		Replayed:   atomic.LoadInt64(&t.replayed),
+		Conflicts:  atomic.LoadInt64(&t.conflicts),
+		InProgress: atomic.LoadInt64(&t.inProgress),
+		Full:       atomic.LoadInt64(&t.full),
+		Swept:      atomic.LoadInt64(&t.swept),
+	}
+}
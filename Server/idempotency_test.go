@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gatedStore counts Puts, holds each one until gate yields, and fails
+// them while fail is set.
+type gatedStore struct {
+	Store
+	gate chan struct{}
+	puts int
+	fail bool
+}
+
+func (g *gatedStore) Put(ctx context.Context, key, value string) (bool, error) {
+	<-g.gate
+	g.puts++
+	if g.fail {
+		return false, errors.New("store down")
+	}
+	return g.Store.Put(ctx, key, value)
+}
+
+func idempotencyTestServer() (*Server, *gatedStore, *httptest.Server) {
+	store := &gatedStore{Store: NewMemStore(), gate: make(chan struct{})}
+	close(store.gate)
+	s := newTestServer(store)
+	s.idem = newIdempotencyTable(time.Hour)
+	return s, store, httptest.NewServer(s.routes())
+}
+
+func TestIdempotentRetries(t *testing.T) {
+	s, store, ts := idempotencyTestServer()
+	defer ts.Close()
+	kv := ts.URL + "/kv/k"
+
+	steps := []struct {
+		method, url, body, key string
+		status                 int
+		replayed               bool
+		header, value          string
+	}{
+		{"PUT", kv, "one", "put-1", http.StatusOK, false, "X-Created", "true"},
+		// Changed under the first request's feet; the retry must not undo it.
+		{"PUT", kv, "two", "", http.StatusOK, false, "X-Created", "false"},
+		{"PUT", kv, "one", "put-1", http.StatusOK, true, "X-Created", "true"},
+		{"PUT", kv, "three", "put-1", http.StatusUnprocessableEntity, false, "", ""},
+		{"PUT", ts.URL + "/kv/other", "one", "put-1", http.StatusUnprocessableEntity, false, "", ""},
+		{"POST", ts.URL + "/kv/", `{"entries": [{"key": "b1", "value": "v"}]}`, "batch-1", http.StatusOK, false, "", ""},
+		{"POST", ts.URL + "/kv/", `{"entries": [{"key": "b1", "value": "v"}]}`, "batch-1", http.StatusOK, true, "", ""},
+		{"POST", ts.URL + "/kv/", `{"entries": [{"key": "b2", "value": "v"}]}`, "batch-1", http.StatusUnprocessableEntity, false, "", ""},
+		{"DELETE", kv, "", "delete-1", http.StatusOK, false, "X-Deleted", "true"},
+		{"DELETE", kv, "", "delete-1", http.StatusOK, true, "X-Deleted", "true"},
+	}
+	for i, st := range steps {
+		var header []string
+		if st.key != "" {
+			header = []string{"Idempotency-Key", st.key}
+		}
+		status, body, h := do(t, st.method, st.url, st.body, header...)
+		if status != st.status {
+			t.Fatalf("step %d: %s %s: status %d, want %d (%s)", i, st.method, st.url, status, st.status, body)
+		}
+		if replayed := h.Get("Idempotent-Replayed") == "true"; replayed != st.replayed {
+			t.Errorf("step %d: replayed %v, want %v", i, replayed, st.replayed)
+		}
+		if st.header != "" && h.Get(st.header) != st.value {
+			t.Errorf("step %d: %s = %q, want %q", i, st.header, h.Get(st.header), st.value)
+		}
+		if i == 2 {
+			if _, got, _ := do(t, "GET", kv, ""); got != "two" {
+				t.Fatalf("after the replayed PUT k = %q, want two", got)
+			}
+		}
+	}
+	if store.puts != 2 {
+		t.Errorf("%d PUTs reached the store, want 2", store.puts)
+	}
+	if st := s.idem.stats(); st.Replayed != 3 || st.Conflicts != 3 || st.Records != 3 {
+		t.Errorf("stats %+v, want 3 replayed, 3 conflicts, 3 records", st)
+	}
+}
+
+func TestIdempotentRetryInProgress(t *testing.T) {
+	s, store, ts := idempotencyTestServer()
+	defer ts.Close()
+	store.gate = make(chan struct{})
+
+	first := make(chan int)
+	go func() {
+		status, _, _ := do(t, "PUT", ts.URL+"/kv/k", "v", "Idempotency-Key", "slow")
+		first <- status
+	}()
+	for s.idem.stats().Records == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if status, _, _ := do(t, "PUT", ts.URL+"/kv/k", "v", "Idempotency-Key", "slow"); status != http.StatusConflict {
+		t.Errorf("retry while the first request runs: status %d, want 409", status)
+	}
+	close(store.gate)
+	if status := <-first; status != http.StatusOK {
+		t.Fatalf("first PUT: status %d", status)
+	}
+	if _, _, h := do(t, "PUT", ts.URL+"/kv/k", "v", "Idempotency-Key", "slow"); h.Get("Idempotent-Replayed") != "true" {
+		t.Error("retry after the first request finished was not replayed")
+	}
+	if store.puts != 1 {
+		t.Errorf("%d PUTs reached the store, want 1", store.puts)
+	}
+}
+
+func TestIdempotentFailureNotRecorded(t *testing.T) {
+	_, store, ts := idempotencyTestServer()
+	defer ts.Close()
+	store.fail = true
+	if status, _, _ := do(t, "PUT", ts.URL+"/kv/k", "v", "Idempotency-Key", "retry-me"); status != http.StatusInternalServerError {
+		t.Fatalf("PUT to a failing store: status %d, want 500", status)
+	}
+	store.fail = false
+	status, _, h := do(t, "PUT", ts.URL+"/kv/k", "v", "Idempotency-Key", "retry-me")
+	if status != http.StatusOK || h.Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after a 500: status %d, replayed %q; want it run again", status, h.Get("Idempotent-Replayed"))
+	}
+	if store.puts != 2 {
+		t.Errorf("%d PUTs reached the store, want 2", store.puts)
+	}
+
+	long := strings.Repeat("k", maxIdempotencyKeyBytes+1)
+	if status, _, _ := do(t, "PUT", ts.URL+"/kv/k", "v", "Idempotency-Key", long); status != http.StatusBadRequest {
+		t.Errorf("PUT with a %d byte Idempotency-Key: status %d, want 400", len(long), status)
+	}
+}
+
+func TestIdempotencySweep(t *testing.T) {
+	s, _, ts := idempotencyTestServer()
+	defer ts.Close()
+	do(t, "PUT", ts.URL+"/kv/k", "v", "Idempotency-Key", "a")
+	do(t, "PUT", ts.URL+"/kv/k", "v", "Idempotency-Key", "b")
+
+	if n := s.idem.sweep(time.Now().Add(time.Hour - time.Second)); n != 0 {
+		t.Errorf("swept %d records before their ttl", n)
+	}
+	if n := s.idem.sweep(time.Now().Add(time.Hour + time.Second)); n != 2 {
+		t.Errorf("swept %d records after their ttl, want 2", n)
+	}
+	if st := s.idem.stats(); st.Records != 0 || st.Swept != 2 {
+		t.Errorf("stats %+v after the sweep", st)
+	}
+	// The key is free again.
+	if _, _, h := do(t, "PUT", ts.URL+"/kv/k", "w", "Idempotency-Key", "a"); h.Get("Idempotent-Replayed") != "" {
+		t.Error("swept key was replayed")
+	}
+}
+
+func TestIdempotentRejectedBeforeBody(t *testing.T) {
+	_, store, ts := idempotencyTestServer()
+	defer ts.Close()
+	// The bad ttl is refused before the handler reads the body.
+	for i := range 2 {
+		status, _, h := do(t, "PUT", ts.URL+"/kv/a?ttl=bogus", "value", "Idempotency-Key", "bad-ttl")
+		if status != http.StatusBadRequest || (h.Get("Idempotent-Replayed") == "true") != (i == 1) {
+			t.Fatalf("attempt %d: status %d, replayed %q; want 400, replayed on the retry", i, status, h.Get("Idempotent-Replayed"))
+		}
+	}
+	if status, _, _ := do(t, "PUT", ts.URL+"/kv/a?ttl=bogus", "other", "Idempotency-Key", "bad-ttl"); status != http.StatusUnprocessableEntity {
+		t.Errorf("same key with another body: status %d, want 422", status)
+	}
+	if store.puts != 0 {
+		t.Errorf("%d PUTs reached the store, want 0", store.puts)
+	}
+}
+
+func TestIdempotencyKeyPerCaller(t *testing.T) {
+	s, store, ts := idempotencyTestServer()
+	defer ts.Close()
+	s.adminToken = testAdminToken
+
+	// Refused for want of credentials, which the retry brings.
+	if status, _, _ := do(t, "PUT", ts.URL+"/kv/k", "v", "Idempotency-Key", "k1"); status != http.StatusUnauthorized {
+		t.Fatalf("PUT without the token: status %d, want 401", status)
+	}
+	status, _, h := do(t, "PUT", ts.URL+"/kv/k", "v", "Idempotency-Key", "k1", "Authorization", "Bearer "+testAdminToken)
+	if status != http.StatusOK || h.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("authenticated retry: status %d, replayed %q; want it run", status, h.Get("Idempotent-Replayed"))
+	}
+
+	// Another caller's k1 is its own.
+	s.adminToken = ""
+	status, _, h = do(t, "PUT", ts.URL+"/kv/k", "other", "Idempotency-Key", "k1", "Authorization", "Bearer someone-else")
+	if status != http.StatusOK || h.Get("Idempotent-Replayed") != "" {
+		t.Errorf("another caller's k1: status %d, replayed %q; want it run", status, h.Get("Idempotent-Replayed"))
+	}
+	if store.puts != 2 {
+		t.Errorf("%d PUTs reached the store, want 2", store.puts)
+	}
+}
+
+// panicStore aborts every Put the way an aborted stream does.
+type panicStore struct{ Store }
+
+func (panicStore) Put(ctx context.Context, key, value string) (bool, error) {
+	panic(http.ErrAbortHandler)
+}
+
+func TestIdempotentPanicReleasesKey(t *testing.T) {
+	s := newTestServer(panicStore{NewMemStore()})
+	s.idem = newIdempotencyTable(time.Hour)
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/kv/k", strings.NewReader("v"))
+	req.Header.Set("Idempotency-Key", "aborted")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("aborted PUT answered %d", resp.StatusCode)
+	}
+	if st := s.idem.stats(); st.Records != 0 {
+		t.Fatalf("%d records left after the handler panicked, want 0", st.Records)
+	}
+	s.store = NewMemStore()
+	if status, _, _ := do(t, "PUT", ts.URL+"/kv/k", "v", "Idempotency-Key", "aborted"); status != http.StatusOK {
+		t.Errorf("retry after the abort: status %d, want 200", status)
+	}
+}
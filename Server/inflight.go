@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stages handlers mark a request with as it goes, so a stuck request says
+// what it is waiting for. Requests start in stageHandler.
+const (
+	stageHandler = "handler"
+	// stageQueued waits for a -max-inflight or -max-inflight-writes slot,
+	// stageColdStart for a -cold-start-concurrency one.
+	stageQueued    = "queued"
+	stageColdStart = "cold-start"
+	stageBody      = "read-body"
+	// stageKeyLock waits for another write to the same key.
+	stageKeyLock = "key-lock"
+	stageStore   = "store"
+	// stageGroupCommit waits for its -batch-window batch to commit.
+	stageGroupCommit = "group-commit"
+	// stageStream sends or receives a value larger than -stream-threshold,
+	// and stageScan a GET /kv/range; both may take long by design.
+	stageStream  = "stream"
+	stageScan    = "scan"
+	stageRespond = "respond"
+)
+
+// unmatchedRoute is the route of requests for paths no route serves.
+const unmatchedRoute = "unmatched"
+
+// inflightTracker keeps every request being served, with a gauge per route:
+// the pattern the request matched, e.g. /kv/ or /admin/inflight. With a
+// threshold, its watchdog logs requests older than that once, and again
+// when they finish; with hashKeys, those lines carry a hash of the key as
+// -access-log-hash-keys has the access log do.
+type inflightTracker struct {
+	threshold time.Duration
+	hashKeys  bool
+
+	reqs    sync.Map // *inflightRequest -> struct{}
+	byRoute sync.Map // route -> *int64
+	// stuck counts the requests the watchdog has logged.
+	stuck int64
+}
+
+type inflightRequest struct {
+	method, route, key string
+	start              time.Time
+	stage              atomic.Value // string
+	// reported is set once the watchdog has logged the request.
+	reported atomic.Bool
+}
+
+type inflightKey struct{}
+
+type inflightStats struct {
+	ByRoute map[string]int64 `json:"by_route"`
+	// OldestSeconds is the age of the oldest request being served,
+	// OldestStage where it is.
+	OldestSeconds    float64 `json:"oldest_seconds"`
+	OldestStage      string  `json:"oldest_stage,omitempty"`
+	ThresholdSeconds float64 `json:"stuck_threshold_seconds,omitempty"`
+	// Stuck counts requests now older than the threshold; StuckTotal all
+	// the watchdog has logged.
+	Stuck      int   `json:"stuck"`
+	StuckTotal int64 `json:"stuck_total"`
+}
+
+type inflightEntry struct {
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Key       string    `json:"key"`
+	Stage     string    `json:"stage"`
+	Started   time.Time `json:"started"`
+	ElapsedMs float64   `json:"elapsed_ms"`
+}
+
+type inflightResponse struct {
+	MinAgeMs float64         `json:"min_age_ms"`
+	Requests []inflightEntry `json:"requests"`
+}
+
+func newInflightTracker(threshold time.Duration) *inflightTracker {
+	return &inflightTracker{threshold: threshold}
+}
+
+// gauge returns the in-flight gauge of route. Routes are the patterns of
+// the mux, so there are only ever a few.
+func (t *inflightTracker) gauge(route string) *int64 {
+	if g, ok := t.byRoute.Load(route); ok {
+		return g.(*int64)
+	}
+	g, _ := t.byRoute.LoadOrStore(route, new(int64))
+	return g.(*int64)
+}
+
+// logKey is key as the watchdog logs it.
+func (t *inflightTracker) logKey(key string) string {
+	if t.hashKeys {
+		return hashKey(key)
+	}
+	return key
+}
+
+// requestKey is the key of a key route, else the path.
+func requestKey(path string) string {
+	for _, prefix := range []string{"/kv/", "/cache/"} {
+		if rest, ok := strings.CutPrefix(path, prefix); ok && rest != "" {
+			return rest
+		}
+	}
+	return path
+}
+
+// middleware tracks the requests next serves under the route of mux they
+// match.
+func (t *inflightTracker) middleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = unmatchedRoute
+		}
+		req := &inflightRequest{method: methodLabel(r.Method), route: route, key: requestKey(r.URL.Path), start: time.Now()}
+		req.stage.Store(stageHandler)
+		gauge := t.gauge(route)
+		atomic.AddInt64(gauge, 1)
+		t.reqs.Store(req, struct{}{})
+		defer func() {
+			t.reqs.Delete(req)
+			atomic.AddInt64(gauge, -1)
+			if req.reported.Load() {
+				log.Printf("Stuck request finished: method=%s route=%s key=%q elapsed=%s stage=%s",
+					req.method, req.route, t.logKey(req.key), time.Since(req.start).Round(time.Millisecond), req.stage.Load())
+			}
+		}()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), inflightKey{}, req)))
+	})
+}
+
+// markStage records that the request of ctx entered stage; it does nothing
+// for contexts of requests the tracker did not see.
+func markStage(ctx context.Context, stage string) {
+	if req, ok := ctx.Value(inflightKey{}).(*inflightRequest); ok {
+		req.stage.Store(stage)
+	}
+}
+
+// each calls fn for every request being served.
+func (t *inflightTracker) each(fn func(*inflightRequest)) {
+	t.reqs.Range(func(k, _ any) bool {
+		fn(k.(*inflightRequest))
+		return true
+	})
+}
+
+// watchdog scans the requests every quarter threshold, at least every
+// second.
+func (t *inflightTracker) watchdog() {
+	for now := range time.Tick(max(t.threshold/4, time.Second)) {
+		t.scan(now)
+	}
+}
+
+// scan logs the requests that have been served longer than the threshold
+// as of now and not been logged yet, and returns how many it logged.
+func (t *inflightTracker) scan(now time.Time) int {
+	logged := 0
+	t.each(func(req *inflightRequest) {
+		elapsed := now.Sub(req.start)
+		if elapsed < t.threshold || req.reported.Swap(true) {
+			return
+		}
+		atomic.AddInt64(&t.stuck, 1)
+		logged++
+		log.Printf("Stuck request: method=%s route=%s key=%q elapsed=%s stage=%s",
+			req.method, req.route, t.logKey(req.key), elapsed.Round(time.Millisecond), req.stage.Load())
+	})
+	return logged
+}
+
+func (t *inflightTracker) stats() inflightStats {
+	now := time.Now()
+	st := inflightStats{ByRoute: make(map[string]int64), ThresholdSeconds: t.threshold.Seconds(), StuckTotal: atomic.LoadInt64(&t.stuck)}
+	t.byRoute.Range(func(route, g any) bool {
+		st.ByRoute[route.(string)] = atomic.LoadInt64(g.(*int64))
+		return true
+	})
+	t.each(func(req *inflightRequest) {
+		elapsed := now.Sub(req.start)
+		if elapsed.Seconds() > st.OldestSeconds {
+			st.OldestSeconds, st.OldestStage = elapsed.Seconds(), req.stage.Load().(string)
+		}
+		if t.threshold > 0 && elapsed >= t.threshold {
+			st.Stuck++
+		}
+	})
+	return st
+}
+
+// longRunning lists the requests served for at least minAge, oldest
+// first.
+func (t *inflightTracker) longRunning(minAge time.Duration) []inflightEntry {
+	now := time.Now()
+	out := []inflightEntry{}
+	t.each(func(req *inflightRequest) {
+		if elapsed := now.Sub(req.start); elapsed >= minAge {
+			out = append(out, inflightEntry{
+				Method:    req.method,
+				Route:     req.route,
+				Key:       req.key,
+				Stage:     req.stage.Load().(string),
+				Started:   req.start,
+				ElapsedMs: float64(elapsed) / float64(time.Millisecond),
+			})
+		}
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+func (t *inflightTracker) writeMetrics(w http.ResponseWriter) {
+	st := t.stats()
+	routes := make([]string, 0, len(st.ByRoute))
+	for route := range st.ByRoute {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	fmt.Fprintln(w, "# HELP kv_inflight_requests Requests being served, by route.")
+	fmt.Fprintln(w, "# TYPE kv_inflight_requests gauge")
+	for _, route := range routes {
+		fmt.Fprintf(w, "kv_inflight_requests{route=%q} %d\n", route, st.ByRoute[route])
+	}
+	fmt.Fprintln(w, "# HELP kv_inflight_oldest_seconds Age of the oldest request being served.")
+	fmt.Fprintln(w, "# TYPE kv_inflight_oldest_seconds gauge")
+	fmt.Fprintf(w, "kv_inflight_oldest_seconds %g\n", st.OldestSeconds)
+	fmt.Fprintln(w, "# HELP kv_stuck_requests_total Requests the watchdog logged for running past -stuck-request-threshold.")
+	fmt.Fprintln(w, "# TYPE kv_stuck_requests_total counter")
+	fmt.Fprintf(w, "kv_stuck_requests_total %d\n", st.StuckTotal)
+}
+
+// inflightHandler lists the requests served for at least ?min_age=, by
+// default -stuck-request-threshold, oldest first.
+func (s *Server) inflightHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	minAge := s.inflight.threshold
+	if v := r.URL.Query().Get("min_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid min_age", http.StatusBadRequest)
+			return
+		}
+		minAge = d
+	}
+	writeJSON(w, http.StatusOK, inflightResponse{
+		MinAgeMs: float64(minAge) / float64(time.Millisecond),
+		Requests: s.inflight.longRunning(minAge),
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingStore stalls every single-key read until release is closed.
+type blockingStore struct {
+	Store
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStore) stall() {
+	b.entered <- struct{}{}
+	<-b.release
+}
+
+func (b *blockingStore) Get(ctx context.Context, key string) (string, error) {
+	b.stall()
+	return b.Store.Get(ctx, key)
+}
+
+func (b *blockingStore) GetBounded(ctx context.Context, key string, limit int64) (string, bool, error) {
+	b.stall()
+	return b.Store.GetBounded(ctx, key, limit)
+}
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+// stallGet starts a GET of key against a server whose store stalls, and
+// returns once the request is waiting in the store; the returned function
+// releases it and waits for the response.
+func stallGet(t *testing.T, hashKeys bool, key string) (*Server, func()) {
+	mem := NewMemStore()
+	mem.Put(context.Background(), key, "v")
+	store := &blockingStore{Store: mem, entered: make(chan struct{}, 1), release: make(chan struct{})}
+	s := newTestServer(store)
+	s.inflight = newInflightTracker(time.Second)
+	s.inflight.hashKeys = hashKeys
+	ts := httptest.NewServer(s.routes())
+	done := make(chan int)
+	go func() {
+		status, _, _ := do(t, "GET", ts.URL+"/kv/"+key, "")
+		done <- status
+	}()
+	select {
+	case <-store.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the GET never reached the store")
+	}
+	return s, func() {
+		close(store.release)
+		if status := <-done; status != 200 {
+			t.Errorf("stalled GET: status %d", status)
+		}
+		ts.Close()
+	}
+}
+
+func TestWatchdogReportsStuckRequest(t *testing.T) {
+	logs := captureLog(t)
+	s, finish := stallGet(t, false, "slow-key")
+
+	if n := s.inflight.scan(time.Now()); n != 0 {
+		t.Fatalf("watchdog logged %d requests younger than the threshold", n)
+	}
+	if n := s.inflight.scan(time.Now().Add(2 * time.Second)); n != 1 {
+		t.Fatalf("watchdog logged %d requests past the threshold, want 1", n)
+	}
+	if n := s.inflight.scan(time.Now().Add(3 * time.Second)); n != 0 {
+		t.Fatalf("watchdog logged the stuck request again")
+	}
+	line := logs.String()
+	for _, want := range []string{"Stuck request:", "method=GET", "route=/kv/", `key="slow-key"`, "stage=store"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("stuck log %q lacks %q", line, want)
+		}
+	}
+	st := s.inflight.stats()
+	if st.ByRoute["/kv/"] != 1 || st.OldestStage != stageStore || st.StuckTotal != 1 {
+		t.Errorf("stats while stuck: %+v", st)
+	}
+	if reqs := s.inflight.longRunning(0); len(reqs) != 1 || reqs[0].Key != "slow-key" || reqs[0].Route != "/kv/" {
+		t.Errorf("long-running requests while stuck: %+v", reqs)
+	}
+
+	finish()
+	if reqs := s.inflight.longRunning(0); len(reqs) != 0 {
+		t.Errorf("registry still holds %+v after the request finished", reqs)
+	}
+	if st := s.inflight.stats(); st.ByRoute["/kv/"] != 0 {
+		t.Errorf("/kv/ gauge is %d after the request finished", st.ByRoute["/kv/"])
+	}
+	if !strings.Contains(logs.String(), "Stuck request finished:") {
+		t.Errorf("no log line for the stuck request finishing: %q", logs.String())
+	}
+}
+
+func TestWatchdogHashesKeys(t *testing.T) {
+	logs := captureLog(t)
+	s, finish := stallGet(t, true, "secret-key")
+	s.inflight.scan(time.Now().Add(2 * time.Second))
+	finish()
+	if out := logs.String(); strings.Contains(out, "secret-key") || !strings.Contains(out, hashKey("secret-key")) {
+		t.Errorf("stuck log with hashed keys: %q", out)
+	}
+}
+
+func TestInflightGaugesPerRoute(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	do(t, "GET", ts.URL+"/stats", "")
+	do(t, "GET", ts.URL+"/no-such-route", "")
+	st := s.inflight.stats()
+	for _, route := range []string{"/stats", unmatchedRoute} {
+		if v, ok := st.ByRoute[route]; !ok || v != 0 {
+			t.Errorf("gauge of %s: %d (present %t), want 0 once served", route, v, ok)
+		}
+	}
+	if _, ok := st.ByRoute["key"]; ok {
+		t.Errorf("gauges still by route class: %v", st.ByRoute)
+	}
+}
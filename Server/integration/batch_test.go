@@ -0,0 +1,54 @@
+package integration
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// TestBatchDuplicateKeys checks both duplicate policies against the
+// database, and that Postgres fails an upsert with a repeated key with the
+// cardinality violation the server maps to 422.
+func TestBatchDuplicateKeys(t *testing.T) {
+	s := startServer(t)
+	db := openDB(t)
+	p := testKey(t, db)
+	body := `{"entries":[{"key":"` + p + `a","value":"1"},{"key":"` + p + `b","value":"1"},{"key":"` + p + `a","value":"2"}]}`
+
+	if status, resp, _ := do(t, "POST", s.url+"/kv/", strings.NewReader(body)); status != http.StatusUnprocessableEntity || !strings.Contains(resp, `"duplicate_keys":["`+p+`a"]`) {
+		t.Fatalf("batch with a repeated key: status %d (%s), want 422 listing it", status, resp)
+	}
+	var rows int
+	if err := db.QueryRow(`SELECT count(*) FROM kv_store WHERE starts_with(key, $1)`, p).Scan(&rows); err != nil || rows != 0 {
+		t.Fatalf("%d rows after a rejected batch (%v), want 0", rows, err)
+	}
+
+	status, resp, _ := do(t, "POST", s.url+"/kv/?dedupe=last", strings.NewReader(body))
+	var stored struct{ Stored, Deduplicated int }
+	json.Unmarshal([]byte(resp), &stored)
+	if status != http.StatusOK || stored.Stored != 2 || stored.Deduplicated != 1 {
+		t.Fatalf("dedupe=last: status %d (%s)", status, resp)
+	}
+	for k, want := range map[string]string{"a": "2", "b": "1"} {
+		var v string
+		if err := db.QueryRow(`SELECT value FROM kv_store WHERE key = $1`, p+k).Scan(&v); err != nil || v != want {
+			t.Errorf("database has %s%s = %q (%v), want %q", p, k, v, err, want)
+		}
+		if _, got, _ := do(t, "GET", s.url+"/kv/"+p+k, nil); got != want {
+			t.Errorf("GET %s%s = %q, want %q", p, k, got, want)
+		}
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO kv_store (key, value) SELECT * FROM unnest($1::text[], $2::text[])
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`,
+		"{"+p+"c,"+p+"c}", "{1,2}")
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "21000" {
+		t.Errorf("upsert with a repeated key: %v, want SQLSTATE 21000", err)
+	}
+}
@@ -0,0 +1,119 @@
+package integration
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// chunkedValue is a value well over -stream-threshold whose every byte
+// says which value it came from.
+func chunkedValue(fill byte) string {
+	return strings.Repeat(string(fill), 8<<20)
+}
+
+// TestStreamedReadSurvivesOverwrite starts reading a streamed value, has
+// the value overwritten while the read is half done, and checks that the
+// reader still gets all of the old value.
+func TestStreamedReadSurvivesOverwrite(t *testing.T) {
+	s := startServer(t)
+	url := s.url + "/kv/" + testKey(t, openDB(t)) + "k"
+	old, new := chunkedValue('a'), chunkedValue('b')
+	if status, _, _ := do(t, "PUT", url, strings.NewReader(old)); status != http.StatusOK {
+		t.Fatalf("PUT: status %d", status)
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	first := make([]byte, len(old)/2)
+	if _, err := io.ReadFull(br, first); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := do(t, "PUT", url, strings.NewReader(new)); status != http.StatusOK {
+		t.Fatalf("overwriting PUT: status %d", status)
+	}
+	rest, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(first) + string(rest); got != old {
+		t.Fatalf("read across an overwrite: %s", describe(got))
+	}
+	if _, got, _ := do(t, "GET", url, nil); got != new {
+		t.Fatalf("read after the overwrite: %s", describe(got))
+	}
+}
+
+// TestStreamedReadsNeverInterleave has readers stream a key while writers
+// keep replacing it with values of different bytes; every read must be
+// exactly one of them.
+func TestStreamedReadsNeverInterleave(t *testing.T) {
+	s := startServer(t)
+	url := s.url + "/kv/" + testKey(t, openDB(t)) + "k"
+	values := map[byte]string{}
+	for _, fill := range []byte("abcd") {
+		values[fill] = chunkedValue(fill)
+	}
+	do(t, "PUT", url, strings.NewReader(values['a']))
+
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	for _, fill := range []byte("bcd") {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if status, _, _ := do(t, "PUT", url, strings.NewReader(values[fill])); status != http.StatusOK {
+					t.Errorf("PUT %c: status %d", fill, status)
+					return
+				}
+			}
+		}()
+	}
+
+	var readers sync.WaitGroup
+	for range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for range 10 {
+				status, got, _ := do(t, "GET", url, nil)
+				if status != http.StatusOK {
+					t.Errorf("GET: status %d", status)
+					return
+				}
+				if len(got) == 0 || got != values[got[0]] {
+					t.Errorf("GET during overwrites: %s", describe(got))
+					return
+				}
+			}
+		}()
+	}
+	readers.Wait()
+	close(stop)
+	writers.Wait()
+}
+
+// describe sums up a read value by its runs of bytes.
+func describe(v string) string {
+	var runs []string
+	for len(v) > 0 {
+		n := len(v) - len(strings.TrimLeft(v, v[:1]))
+		runs = append(runs, fmt.Sprintf("%d×%q", n, v[0]))
+		v = v[n:]
+	}
+	return fmt.Sprintf("%d runs: %s", len(runs), strings.Join(runs, " "))
+}
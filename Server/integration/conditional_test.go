@@ -0,0 +1,53 @@
+package integration
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestIfUnmodifiedSince checks the conditional UPDATE against updated_at,
+// with a restarted server so no cached modification time can answer.
+func TestIfUnmodifiedSince(t *testing.T) {
+	s := startServer(t)
+	kv := s.url + "/kv/" + testKey(t, openDB(t)) + "k"
+	ius := func(t time.Time) string { return t.UTC().Format(http.TimeFormat) }
+	send := func(method, body, since string) (int, http.Header) {
+		req, err := http.NewRequest(method, kv, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("If-Unmodified-Since", since)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header
+	}
+
+	status, h := send("PUT", "v1", ius(time.Now().Add(-time.Hour)))
+	if status != http.StatusOK || h.Get("X-Created") != "true" {
+		t.Fatalf("conditional PUT of a missing key: status %d, X-Created %q", status, h.Get("X-Created"))
+	}
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		t.Fatalf("Last-Modified %q: %v", h.Get("Last-Modified"), err)
+	}
+	s = startServer(t)
+	kv = s.url + kv[strings.Index(kv, "/kv/"):]
+
+	if status, _ := send("PUT", "stale", ius(modified.Add(-time.Second))); status != http.StatusPreconditionFailed {
+		t.Errorf("PUT since a second before: status %d, want 412", status)
+	}
+	if status, _ := send("DELETE", "", ius(modified.Add(-time.Second))); status != http.StatusPreconditionFailed {
+		t.Errorf("DELETE since a second before: status %d, want 412", status)
+	}
+	if status, _ := send("PUT", "v2", ius(modified)); status != http.StatusOK {
+		t.Errorf("PUT since the modification time: status %d, want 200", status)
+	}
+	if _, body, _ := do(t, "GET", kv, nil); body != "v2" {
+		t.Errorf("value = %q, want v2", body)
+	}
+}
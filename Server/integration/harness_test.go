@@ -0,0 +1,198 @@
+// Package integration runs the server binary against a disposable
+// Postgres in Docker, or against the database KV_TEST_DATABASE_URL names.
+// The tests are skipped with -short, or when neither is available.
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+var (
+	// skipReason is why the tests cannot run, or "" when they can.
+	skipReason string
+	// dsn is the disposable database's connection string.
+	dsn string
+	// serverBin is the server built from the parent directory.
+	serverBin string
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	if testing.Short() {
+		skipReason = "integration tests need Postgres in Docker; skipped with -short"
+		return m.Run()
+	}
+	if dsn = os.Getenv("KV_TEST_DATABASE_URL"); dsn != "" {
+		return buildAndRun(m)
+	}
+	pool, err := dockertest.NewPool("")
+	if err == nil {
+		err = pool.Client.Ping()
+	}
+	if err != nil {
+		skipReason = fmt.Sprintf("Docker is not available: %v", err)
+		return m.Run()
+	}
+	pool.MaxWait = 2 * time.Minute
+
+	pg, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        "16-alpine",
+		Env:        []string{"POSTGRES_PASSWORD=secret", "POSTGRES_DB=kv"},
+	}, func(c *docker.HostConfig) {
+		c.AutoRemove = true
+		c.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		log.Printf("Starting Postgres: %v", err)
+		return 1
+	}
+	defer pool.Purge(pg)
+	pg.Expire(600)
+
+	dsn = fmt.Sprintf("postgres://postgres:secret@%s/kv?sslmode=disable", pg.GetHostPort("5432/tcp"))
+	if err := pool.Retry(func() error {
+		db, err := sql.Open("pgx", dsn)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.Ping()
+	}); err != nil {
+		log.Printf("Postgres did not come up: %v", err)
+		return 1
+	}
+	return buildAndRun(m)
+}
+
+// buildAndRun builds the server and runs the tests.
+func buildAndRun(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "kv-integration")
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	serverBin = filepath.Join(dir, "server")
+	build := exec.Command("go", "build", "-o", serverBin, ".")
+	build.Dir = ".."
+	if out, err := build.CombinedOutput(); err != nil {
+		log.Printf("Building the server: %v\n%s", err, out)
+		return 1
+	}
+	return m.Run()
+}
+
+// server is a running server binary.
+type server struct {
+	url string
+	cmd *exec.Cmd
+	log *strings.Builder
+}
+
+// startServer runs the server on an ephemeral port against the test
+// database with the given extra flags, and stops it when t ends. The
+// server applies the migrations as it starts.
+func startServer(t *testing.T, args ...string) *server {
+	t.Helper()
+	if skipReason != "" {
+		t.Skip(skipReason)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s := &server{url: "http://" + addr, log: &strings.Builder{}}
+	s.cmd = exec.Command(serverBin, append([]string{"-addr", addr, "-db-url", dsn, "-migrate", "up"}, args...)...)
+	s.cmd.Stdout, s.cmd.Stderr = s.log, s.log
+	if err := s.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+		if t.Failed() {
+			t.Logf("server output:\n%s", s.log)
+		}
+	})
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		resp, err := http.Get(s.url + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return s
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not ready after 30s: %v\n%s", err, s.log)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// testKey returns a key prefix of the test's own, first deleting whatever
+// an earlier run left under it in a reused database.
+func testKey(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	prefix := strings.ReplaceAll(t.Name(), "/", "-") + "-"
+	if _, err := db.Exec(`DELETE FROM kv_store WHERE starts_with(key, $1)`, prefix); err != nil {
+		t.Fatal(err)
+	}
+	return prefix
+}
+
+// openDB connects to the test database directly.
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// do sends a request and returns the status, body and headers.
+func do(t testing.TB, method, url string, body io.Reader) (int, string, http.Header) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(context.Background(), method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b), resp.Header
+}
@@ -0,0 +1,205 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMigrationsApplied(t *testing.T) {
+	startServer(t)
+	out, err := exec.Command(serverBin, "-db-url", dsn, "-migrate", "status").CombinedOutput()
+	if err != nil {
+		t.Fatalf("-migrate status: %v\n%s", err, out)
+	}
+	if strings.Contains(string(out), "pending") || !strings.Contains(string(out), "applied") {
+		t.Errorf("migrations not all applied after startup:\n%s", out)
+	}
+	// A second server against the migrated database starts as well.
+	startServer(t)
+}
+
+func TestGetPutDeleteMatrix(t *testing.T) {
+	s := startServer(t)
+	kv := s.url + "/kv/" + testKey(t, openDB(t))
+
+	steps := []struct {
+		method, key, body string
+		status            int
+		want              string
+		header, value     string
+	}{
+		{"GET", "a", "", http.StatusNotFound, "", "", ""},
+		{"DELETE", "a", "", http.StatusOK, "", "X-Deleted", "false"},
+		{"PUT", "a", "one", http.StatusOK, "", "X-Created", "true"},
+		{"GET", "a", "", http.StatusOK, "one", "", ""},
+		// The upsert reports that it updated rather than inserted.
+		{"PUT", "a", "two", http.StatusOK, "", "X-Created", "false"},
+		{"GET", "a", "", http.StatusOK, "two", "", ""},
+		{"PUT", "b", "", http.StatusOK, "", "X-Created", "true"},
+		{"GET", "b", "", http.StatusOK, "", "", ""},
+		{"DELETE", "a", "", http.StatusOK, "", "X-Deleted", "true"},
+		{"GET", "a", "", http.StatusNotFound, "", "", ""},
+		{"PUT", "a", "three", http.StatusOK, "", "X-Created", "true"},
+		{"GET", "a", "", http.StatusOK, "three", "", ""},
+		{"PATCH", "a", "", http.StatusMethodNotAllowed, "", "Allow", "GET, HEAD, PUT, DELETE, OPTIONS"},
+	}
+	for i, st := range steps {
+		status, body, h := do(t, st.method, kv+st.key, strings.NewReader(st.body))
+		if status != st.status {
+			t.Fatalf("step %d: %s %s: status %d, want %d (%s)", i, st.method, st.key, status, st.status, body)
+		}
+		if st.method == "GET" && status == http.StatusOK && body != st.want {
+			t.Fatalf("step %d: GET %s = %q, want %q", i, st.key, body, st.want)
+		}
+		if st.header != "" && h.Get(st.header) != st.value {
+			t.Fatalf("step %d: %s %s: %s = %q, want %q", i, st.method, st.key, st.header, h.Get(st.header), st.value)
+		}
+	}
+}
+
+// slowBody sends value in small pieces with pauses, so the server sees it
+// over many reads.
+func slowBody(value string) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		for len(value) > 0 {
+			n := min(len(value), 4096)
+			if _, err := pw.Write([]byte(value[:n])); err != nil {
+				return
+			}
+			value = value[n:]
+			time.Sleep(time.Millisecond)
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// TestPutNotTruncated sends bodies in pieces, which a server reading the
+// body with a single Read cuts short: one under -stream-threshold, read
+// whole, and one over it, streamed into chunks.
+func TestPutNotTruncated(t *testing.T) {
+	s := startServer(t)
+	db := openDB(t)
+	for _, size := range []int{100 << 10, 3 << 20} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			value := strings.Repeat("0123456789abcdef", size/16)
+			key := testKey(t, db) + "k"
+			url := s.url + "/kv/" + key
+			req, err := http.NewRequest("PUT", url, slowBody(value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.ContentLength = int64(size)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("PUT of %d bytes: status %d", size, resp.StatusCode)
+			}
+			status, body, _ := do(t, "GET", url, nil)
+			if status != http.StatusOK || body != value {
+				t.Fatalf("GET after PUT of %d bytes: status %d, %d bytes back", size, status, len(body))
+			}
+			var stored int
+			if err := db.QueryRow(`SELECT coalesce(octet_length(value), chunked_size) FROM kv_store WHERE key = $1`, key).Scan(&stored); err != nil {
+				t.Fatal(err)
+			}
+			if stored != size {
+				t.Errorf("database holds %d bytes, want %d", stored, size)
+			}
+		})
+	}
+}
+
+func TestPutTooLarge(t *testing.T) {
+	s := startServer(t, "-max-value-bytes", "1024")
+	url := s.url + "/kv/" + testKey(t, openDB(t)) + "k"
+	if status, _, _ := do(t, "PUT", url, strings.NewReader(strings.Repeat("x", 1025))); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("PUT over -max-value-bytes: status %d, want 413", status)
+	}
+	if status, _, _ := do(t, "GET", url, nil); status != http.StatusNotFound {
+		t.Fatalf("GET after a rejected PUT: status %d, want 404", status)
+	}
+}
+
+// TestConcurrentWritesOneKey has many writers race on one key, then checks
+// that the key holds one of the written values and the cache agrees with
+// the database.
+func TestConcurrentWritesOneKey(t *testing.T) {
+	s := startServer(t)
+	db := openDB(t)
+	key := testKey(t, db) + "k"
+	url := s.url + "/kv/" + key
+	const writers, puts = 32, 50
+
+	written := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range puts {
+				v := fmt.Sprintf("writer-%d-put-%d", w, i)
+				mu.Lock()
+				written[v] = true
+				mu.Unlock()
+				if status, body, _ := do(t, "PUT", url, strings.NewReader(v)); status != http.StatusOK {
+					t.Errorf("PUT %s: status %d (%s)", v, status, body)
+					return
+				}
+				if status, _, _ := do(t, "GET", url, nil); status != http.StatusOK {
+					t.Errorf("GET during writes: status %d", status)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, got, _ := do(t, "GET", url, nil)
+	if !written[got] {
+		t.Fatalf("key holds %q, which no writer wrote", got)
+	}
+	var stored string
+	var rows int
+	if err := db.QueryRow(`SELECT value, (SELECT count(*) FROM kv_store WHERE key = $1) FROM kv_store WHERE key = $1`, key).Scan(&stored, &rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 || stored != got {
+		t.Errorf("database holds %d rows, value %q; the server answers %q", rows, stored, got)
+	}
+}
+
+// TestFlushDurability checks a PUT asking for flush commits through the
+// synchronous_commit path and achieves it against the database.
+func TestFlushDurability(t *testing.T) {
+	s := startServer(t)
+	url := s.url + "/kv/" + testKey(t, openDB(t)) + "k"
+	for level, want := range map[string]string{"": "db", "db": "db", "cache": "db", "flush": "flush"} {
+		req, _ := http.NewRequest("PUT", url, strings.NewReader("v-"+level))
+		if level != "" {
+			req.Header.Set("X-Durability", level)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Durability") != want {
+			t.Errorf("PUT with X-Durability %q: status %d, achieved %q, want %s", level, resp.StatusCode, resp.Header.Get("X-Durability"), want)
+		}
+		if _, body, _ := do(t, "GET", url, nil); body != "v-"+level {
+			t.Errorf("GET after a %q PUT = %q", level, body)
+		}
+	}
+}
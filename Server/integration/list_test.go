@@ -0,0 +1,70 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestListCursorStableUnderWrites pages through 10k keys in the database
+// while keys sorting between them are put and deleted, and checks every
+// key present throughout is listed exactly once.
+func TestListCursorStableUnderWrites(t *testing.T) {
+	s := startServer(t)
+	db := openDB(t)
+	prefix := testKey(t, db)
+	const n = 10000
+	if _, err := db.Exec(`INSERT INTO kv_store (key, value) SELECT $1 || lpad(i::text, 5, '0'), 'v' FROM generate_series(0, $2 - 1) i`, prefix, n); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; ; i += 4 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				kv := fmt.Sprintf("%s/kv/%s%05d-churn", s.url, prefix, i%n)
+				do(t, "PUT", kv, strings.NewReader("v"))
+				do(t, "DELETE", kv, nil)
+			}
+		}()
+	}
+
+	seen := make(map[string]int)
+	for next, first := "", true; first || next != ""; first = false {
+		status, body, _ := do(t, "GET", s.url+"/kv/?limit=100&prefix="+url.QueryEscape(prefix)+"&after="+url.QueryEscape(next), nil)
+		if status != http.StatusOK {
+			t.Fatalf("listing: status %d (%s)", status, body)
+		}
+		var page struct {
+			Keys []string `json:"keys"`
+			Next string   `json:"next"`
+		}
+		if err := json.Unmarshal([]byte(body), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range page.Keys {
+			seen[k]++
+		}
+		next = page.Next
+	}
+	close(stop)
+	wg.Wait()
+
+	for i := range n {
+		if k := fmt.Sprintf("%s%05d", prefix, i); seen[k] != 1 {
+			t.Errorf("%s listed %d times", k, seen[k])
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lockRequest sends method to a lock URL as owner and returns the status.
+func lockRequest(t *testing.T, method, url, owner string) int {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	req.Header.Set("X-Lock-Owner", owner)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestLockOneHolderAtATime has 20 owners compete for one lock through the
+// conditional upsert, each holding it briefly, then checks that a lease
+// left to run out is taken over.
+func TestLockOneHolderAtATime(t *testing.T) {
+	s := startServer(t)
+	db := openDB(t)
+	key := testKey(t, db) + "k"
+	if _, err := db.Exec(`DELETE FROM kv_locks WHERE key = $1`, key); err != nil {
+		t.Fatal(err)
+	}
+	url := s.url + "/kv/" + key + "/lock"
+
+	var holders, acquired atomic.Int64
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			owner := fmt.Sprintf("owner-%d", i)
+			for lockRequest(t, "POST", url+"?lease=1m", owner) == http.StatusConflict {
+				time.Sleep(time.Millisecond)
+			}
+			if n := holders.Add(1); n != 1 {
+				t.Errorf("%d holders at once", n)
+			}
+			acquired.Add(1)
+			time.Sleep(2 * time.Millisecond)
+			holders.Add(-1)
+			if status := lockRequest(t, "DELETE", url, owner); status != http.StatusOK {
+				t.Errorf("%s releasing: status %d", owner, status)
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired.Load() != 20 {
+		t.Fatalf("%d of 20 owners got the lock", acquired.Load())
+	}
+
+	if status := lockRequest(t, "POST", url+"?lease=200ms", "a"); status != http.StatusOK {
+		t.Fatalf("a acquiring: status %d", status)
+	}
+	if status := lockRequest(t, "POST", url, "b"); status != http.StatusConflict {
+		t.Fatalf("b acquiring a held lock: status %d, want 409", status)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if status := lockRequest(t, "POST", url, "b"); status != http.StatusOK {
+		t.Fatalf("b taking over an expired lease: status %d", status)
+	}
+	if status := lockRequest(t, "DELETE", url, "a"); status != http.StatusConflict {
+		t.Errorf("a releasing after the takeover: status %d, want 409", status)
+	}
+}
@@ -0,0 +1,165 @@
+package integration
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// freshDB creates an empty database of the test's own next to the test
+// database, and returns its connection string.
+func freshDB(t *testing.T) string {
+	return freshDBNamed(t, "")
+}
+
+// freshDBNamed is freshDB for tests needing more than one, told apart by
+// suffix.
+func freshDBNamed(t *testing.T, suffix string) string {
+	t.Helper()
+	if skipReason != "" {
+		t.Skip(skipReason)
+	}
+	db := openDB(t)
+	name := "kv_" + strings.ToLower(strings.NewReplacer("/", "_", "-", "_").Replace(t.Name()+suffix))
+	if _, err := db.Exec(`DROP DATABASE IF EXISTS ` + name + ` WITH (FORCE)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE DATABASE ` + name); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Path = "/" + name
+	return u.String()
+}
+
+// appliedVersions lists the versions schema_migrations records, in order.
+func appliedVersions(t *testing.T, db *sql.DB) []int {
+	t.Helper()
+	rows, err := db.Query(`SELECT version FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var versions []int
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return versions
+}
+
+// checkAllApplied checks that every migration is recorded once and that
+// -migrate status agrees.
+func checkAllApplied(t *testing.T, dbURL string, db *sql.DB) {
+	t.Helper()
+	versions := appliedVersions(t, db)
+	for i, v := range versions {
+		if v != i+1 {
+			t.Fatalf("applied versions %v, want 1 to %d with no gaps", versions, len(versions))
+		}
+	}
+	out, err := exec.Command(serverBin, "-db-url", dbURL, "-migrate", "status").CombinedOutput()
+	if err != nil {
+		t.Fatalf("-migrate status: %v\n%s", err, out)
+	}
+	if strings.Contains(string(out), "pending") || strings.Count(string(out), "applied") != len(versions) {
+		t.Errorf("-migrate status after startup:\n%s", out)
+	}
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	dbURL := freshDB(t)
+	// Before anything runs, every migration is pending.
+	out, err := exec.Command(serverBin, "-db-url", dbURL, "-migrate", "status").CombinedOutput()
+	if err != nil || strings.Contains(string(out), "applied") {
+		t.Fatalf("-migrate status on an empty database: %v\n%s", err, out)
+	}
+
+	// Two servers starting at once take turns on the advisory lock.
+	t.Run("concurrent", func(t *testing.T) {
+		for i := range 2 {
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				t.Parallel()
+				s := startServer(t, "-db-url", dbURL)
+				key := fmt.Sprintf("/kv/k%d", i)
+				if status, _, _ := do(t, "PUT", s.url+key, strings.NewReader("v")); status != http.StatusOK {
+					t.Fatalf("PUT on the migrated database: status %d", status)
+				}
+				if _, body, _ := do(t, "GET", s.url+key, nil); body != "v" {
+					t.Errorf("GET %s = %q, want v", key, body)
+				}
+			})
+		}
+	})
+	db, err := sql.Open("pgx", dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkAllApplied(t, dbURL, db)
+}
+
+func TestMigrateBaselinesV0Schema(t *testing.T) {
+	dbURL := freshDB(t)
+	db, err := sql.Open("pgx", dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The schema main created before migrations existed.
+	for _, stmt := range []string{
+		`CREATE TABLE kv_store (key TEXT PRIMARY KEY, value TEXT)`,
+		`INSERT INTO kv_store (key, value) VALUES ('old', 'from v0')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := startServer(t, "-db-url", dbURL)
+	var name string
+	if err := db.QueryRow(`SELECT name FROM schema_migrations WHERE version = 1`).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(name, "baseline") {
+		t.Errorf("version 1 recorded as %q, want the baseline", name)
+	}
+	checkAllApplied(t, dbURL, db)
+
+	if _, body, _ := do(t, "GET", s.url+"/kv/old", nil); body != "from v0" {
+		t.Errorf("v0 row reads %q after migrating, want %q", body, "from v0")
+	}
+	if status, _, h := do(t, "PUT", s.url+"/kv/old", strings.NewReader("new")); status != http.StatusOK || h.Get("X-Created") != "false" {
+		t.Errorf("PUT over the v0 row: status %d, X-Created %q", status, h.Get("X-Created"))
+	}
+}
+
+func TestMigrateSkip(t *testing.T) {
+	dbURL := freshDB(t)
+	// Skipping migrations on an unmigrated database fails the startup
+	// schema check instead of serving from a missing table.
+	cmd := exec.Command(serverBin, "-addr", "127.0.0.1:0", "-db-url", dbURL, "-migrate", "skip")
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != 4 || !strings.Contains(string(out), "schema_migrations") {
+		t.Fatalf("-migrate skip on an empty database: %v, want exit status 4\n%s", err, out)
+	}
+
+	// Once migrated, a server skipping migrations starts.
+	startServer(t, "-db-url", dbURL)
+	startServer(t, "-db-url", dbURL, "-migrate", "skip")
+}
@@ -0,0 +1,79 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type purgeLine struct {
+	Deleted      int    `json:"deleted"`
+	TotalDeleted int64  `json:"total_deleted"`
+	Matched      *int64 `json:"matched"`
+	Done         bool   `json:"done"`
+	Error        string `json:"error"`
+}
+
+func purge(t *testing.T, url, body string) purgeLine {
+	t.Helper()
+	status, resp, _ := do(t, "POST", url+"/admin/purge", strings.NewReader(body))
+	if status != http.StatusOK {
+		t.Fatalf("POST /admin/purge %s: status %d (%s)", body, status, resp)
+	}
+	lines := strings.Split(strings.TrimSpace(resp), "\n")
+	var final purgeLine
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &final); err != nil {
+		t.Fatal(err)
+	}
+	if !final.Done {
+		t.Fatalf("purge %s did not finish: %+v", body, final)
+	}
+	return final
+}
+
+// TestPurgeDryRunMatchesDeletions ages rows in the database and checks a
+// parallel purge deletes exactly the rows its dry run counted, leaving
+// newer rows and other prefixes alone.
+func TestPurgeDryRunMatchesDeletions(t *testing.T) {
+	s := startServer(t)
+	db := openDB(t)
+	prefix := testKey(t, db)
+	if _, err := db.Exec(`
+		INSERT INTO kv_store (key, value, created_at)
+		SELECT $1 || 'junk-' || i, 'v', now() - CASE WHEN i % 4 = 0 THEN interval '1 hour' ELSE interval '2 days' END
+		FROM generate_series(1, 5000) i`, prefix); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO kv_store (key, value, created_at) SELECT $1 || 'keep-' || i, 'v', now() - interval '2 days' FROM generate_series(1, 500) i`, prefix); err != nil {
+		t.Fatal(err)
+	}
+	// A soft-deleted row goes too.
+	if _, err := db.Exec(`UPDATE kv_store SET deleted_at = now() WHERE key = $1`, prefix+"junk-1"); err != nil {
+		t.Fatal(err)
+	}
+	do(t, "GET", s.url+"/kv/"+prefix+"junk-2", nil)
+
+	filter := `"prefix":"` + prefix + `junk-","older_than":"24h"`
+	dry := purge(t, s.url, `{`+filter+`,"dry_run":true}`)
+	if dry.Matched == nil || *dry.Matched != 3750 {
+		t.Fatalf("dry run = %+v, want 3750 matched", dry)
+	}
+	if got := purge(t, s.url, `{`+filter+`,"batch":100,"parallelism":8}`); got.TotalDeleted != *dry.Matched {
+		t.Fatalf("purge deleted %d rows, the dry run counted %d", got.TotalDeleted, *dry.Matched)
+	}
+
+	var junk, keep int
+	if err := db.QueryRow(`SELECT count(*) FILTER (WHERE key LIKE $1 || 'junk-%'), count(*) FILTER (WHERE key LIKE $1 || 'keep-%') FROM kv_store WHERE starts_with(key, $1)`, prefix).Scan(&junk, &keep); err != nil {
+		t.Fatal(err)
+	}
+	if junk != 1250 || keep != 500 {
+		t.Errorf("%d junk and %d keep rows left, want the 1250 new junk rows and all 500 keep rows", junk, keep)
+	}
+	if status, _, _ := do(t, "GET", s.url+"/kv/"+prefix+"junk-2", nil); status != http.StatusNotFound {
+		t.Errorf("GET of a purged, cached key: status %d, want 404", status)
+	}
+	if again := purge(t, s.url, `{`+filter+`}`); again.TotalDeleted != 0 {
+		t.Errorf("second purge deleted %d rows, want 0", again.TotalDeleted)
+	}
+}
@@ -0,0 +1,92 @@
+package integration
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestShardsSplitKeys runs the server over two databases as shards,
+// checks that keys land on both, then takes one down and checks that only
+// its keys fail.
+func TestShardsSplitKeys(t *testing.T) {
+	dsns := []string{freshDBNamed(t, "_0"), freshDBNamed(t, "_1")}
+	s := startServer(t, "-db-url", strings.Join(dsns, ","))
+
+	const n = 100
+	for i := range n {
+		if status, body, _ := do(t, "PUT", fmt.Sprintf("%s/kv/key-%d", s.url, i), strings.NewReader("v")); status != http.StatusOK {
+			t.Fatalf("PUT key-%d: status %d (%s)", i, status, body)
+		}
+	}
+	onShard := make([]map[string]bool, len(dsns))
+	total := 0
+	for i, d := range dsns {
+		db, err := sql.Open("pgx", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := db.Query(`SELECT key FROM kv_store`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		onShard[i] = map[string]bool{}
+		for rows.Next() {
+			var k string
+			rows.Scan(&k)
+			onShard[i][k] = true
+		}
+		rows.Close()
+		db.Close()
+		if len(onShard[i]) == 0 {
+			t.Errorf("shard %d holds no keys", i)
+		}
+		total += len(onShard[i])
+	}
+	if total != n {
+		t.Fatalf("shards hold %d keys between them, want %d", total, n)
+	}
+
+	// Refuse new connections to shard 1 and cut its existing ones.
+	u, err := url.Parse(dsns[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.TrimPrefix(u.Path, "/")
+	admin := openDB(t)
+	for _, stmt := range []string{
+		`ALTER DATABASE ` + name + ` WITH ALLOW_CONNECTIONS false`,
+		`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '` + name + `'`,
+	} {
+		if _, err := admin.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { admin.Exec(`ALTER DATABASE ` + name + ` WITH ALLOW_CONNECTIONS true`) })
+	// Reads must reach the shards rather than the cached PUTs.
+	if status, _, _ := do(t, "POST", s.url+"/admin/cache/flush", nil); status != http.StatusOK {
+		t.Fatalf("flushing the cache: status %d", status)
+	}
+
+	for i := range n {
+		k := fmt.Sprintf("key-%d", i)
+		status, _, _ := do(t, "GET", s.url+"/kv/"+k, nil)
+		if onShard[1][k] != (status != http.StatusOK) {
+			t.Errorf("GET %s (on shard 1: %t) with shard 1 down: status %d", k, onShard[1][k], status)
+		}
+	}
+	status, body, _ := do(t, "GET", s.url+"/readyz", nil)
+	var ready struct {
+		Shards []struct {
+			Healthy bool `json:"healthy"`
+		} `json:"shards"`
+	}
+	json.Unmarshal([]byte(body), &ready)
+	if status != http.StatusServiceUnavailable || len(ready.Shards) != 2 || !ready.Shards[0].Healthy || ready.Shards[1].Healthy {
+		t.Errorf("/readyz with shard 1 down: status %d, %s", status, body)
+	}
+}
@@ -0,0 +1,200 @@
+package integration
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// heapInuse reads the server's heap in use from /stats.
+func heapInuse(t *testing.T, s *server) int64 {
+	t.Helper()
+	_, body, _ := do(t, "GET", s.url+"/stats", nil)
+	var st struct {
+		Runtime struct {
+			HeapInuseBytes int64 `json:"heap_inuse_bytes"`
+		} `json:"runtime"`
+	}
+	if err := json.Unmarshal([]byte(body), &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Runtime.HeapInuseBytes
+}
+
+// TestLargeValueStreamed reads a 20MB value, checking the server's heap
+// half way through each read: streamed from Postgres, the value is never
+// in memory whole, nor cached afterwards.
+func TestLargeValueStreamed(t *testing.T) {
+	const size = 20 << 20
+	s := startServer(t)
+	url := s.url + "/kv/" + testKey(t, openDB(t)) + "k"
+	value := strings.Repeat("0123456789abcdef", size/16)
+	if status, body, _ := do(t, "PUT", url, strings.NewReader(value)); status != http.StatusOK {
+		t.Fatalf("PUT: status %d (%s)", status, body)
+	}
+
+	base := heapInuse(t, s)
+	for i := range 3 {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ContentLength != size || resp.Header.Get("X-Cache") != "BYPASS" {
+			t.Fatalf("GET %d: Content-Length %d, X-Cache %q; want %d, BYPASS",
+				i, resp.ContentLength, resp.Header.Get("X-Cache"), size)
+		}
+		got := make([]byte, size)
+		if _, err := io.ReadFull(resp.Body, got[:size/2]); err != nil {
+			t.Fatal(err)
+		}
+		// Loosely: a quarter of the value, where holding it would take
+		// all of it at least once.
+		if grown := heapInuse(t, s) - base; grown > size/4 {
+			t.Errorf("GET %d: server heap grew %d bytes half way through a %d byte value", i, grown, size)
+		}
+		if _, err := io.ReadFull(resp.Body, got[size/2:]); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if string(got) != value {
+			t.Fatalf("GET %d: value differs from what was written", i)
+		}
+	}
+
+	_, body, _ := do(t, "GET", s.url+"/stats", nil)
+	var st struct {
+		StreamThresholdBytes int64 `json:"stream_threshold_bytes"`
+		StreamedGets         int64 `json:"streamed_gets"`
+	}
+	if err := json.Unmarshal([]byte(body), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.StreamedGets != 3 || st.StreamThresholdBytes != 1<<20 {
+		t.Errorf("/stats streamed_gets = %d, stream_threshold_bytes = %d; want 3 and the default %d",
+			st.StreamedGets, st.StreamThresholdBytes, 1<<20)
+	}
+}
+
+// pattern is an endless reader of a repeating 251 byte pattern, so large
+// values need not be held in the test's memory either.
+type pattern struct{ off int }
+
+func (p *pattern) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte((p.off + i) % 251)
+	}
+	p.off += len(b)
+	return len(b), nil
+}
+
+// TestHugeValueRoundTrip PUTs and GETs a 100MB value, checking the
+// server's heap half way through each direction.
+func TestHugeValueRoundTrip(t *testing.T) {
+	const size = 100 << 20
+	s := startServer(t)
+	kv := s.url + "/kv/" + testKey(t, openDB(t)) + "k"
+	base := heapInuse(t, s)
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("PUT", kv, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = size
+	result := make(chan int, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			result <- 0
+			return
+		}
+		resp.Body.Close()
+		result <- resp.StatusCode
+	}()
+	want := sha256.New()
+	src := io.TeeReader(&pattern{}, want)
+	if _, err := io.CopyN(pw, src, size/2); err != nil {
+		t.Fatal(err)
+	}
+	if grown := heapInuse(t, s) - base; grown > size/4 {
+		t.Errorf("server heap grew %d bytes half way through a %d byte PUT", grown, size)
+	}
+	if _, err := io.CopyN(pw, src, size/2); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	if status := <-result; status != http.StatusOK {
+		t.Fatalf("PUT of %d bytes: status %d", size, status)
+	}
+
+	resp, err := http.Get(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got := sha256.New()
+	if _, err := io.CopyN(got, resp.Body, size/2); err != nil {
+		t.Fatal(err)
+	}
+	if grown := heapInuse(t, s) - base; grown > size/4 {
+		t.Errorf("server heap grew %d bytes half way through a %d byte GET", grown, size)
+	}
+	if n, err := io.Copy(got, resp.Body); err != nil || n != size/2 {
+		t.Fatalf("GET: %d bytes after the first half (%v), want %d", n, err, size/2)
+	}
+	if !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		t.Error("value read back differs from the one written")
+	}
+}
+
+// TestAbortedUploadLeavesNoChunks hangs up part way through a streamed
+// PUT and checks the previous value stays and no chunks are left behind.
+func TestAbortedUploadLeavesNoChunks(t *testing.T) {
+	s := startServer(t)
+	db := openDB(t)
+	key := testKey(t, db) + "k"
+	kv := s.url + "/kv/" + key
+	do(t, "PUT", kv, strings.NewReader("old"))
+
+	u, err := url.Parse(s.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(c, "PUT /kv/%s HTTP/1.1\r\nHost: kv\r\nContent-Length: %d\r\n\r\n", key, 50<<20)
+	io.CopyN(c, &pattern{}, 3<<20)
+	c.Close()
+
+	// The upload holds the row locked until it rolls back; wait for that,
+	// then look at what is committed.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunked sql.NullInt64
+	if err := tx.QueryRow(`SELECT chunked_size FROM kv_store WHERE key = $1 FOR UPDATE`, key).Scan(&chunked); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	var chunks int
+	if err := db.QueryRow(`SELECT count(*) FROM kv_chunks WHERE key = $1`, key).Scan(&chunks); err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 0 || chunked.Valid {
+		t.Errorf("aborted upload left %d chunks, chunked_size %v", chunks, chunked)
+	}
+	if _, body, _ := do(t, "GET", kv, nil); body != "old" {
+		t.Errorf("GET after the aborted upload: %d bytes, want the previous value", len(body))
+	}
+}
@@ -0,0 +1,108 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTTLSweepSoak writes tens of thousands of short-TTL keys through two
+// servers, whose sweepers share the table, and checks that the table stays
+// about the size of the keys still alive.
+func TestTTLSweepSoak(t *testing.T) {
+	args := []string{"-ttl-sweep-interval", "100ms", "-ttl-sweep-batch", "500"}
+	servers := []*server{startServer(t, args...), startServer(t, args...)}
+	db := openDB(t)
+	prefix := testKey(t, db)
+
+	const (
+		writers = 8
+		keys    = 30_000
+		ttl     = 200 * time.Millisecond
+	)
+	// Keys alive at once, at the rate the writers manage, bound what the
+	// table should hold; measure the rate as the writes go.
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := servers[w%len(servers)]
+			for i := w; i < keys; i += writers {
+				url := fmt.Sprintf("%s/kv/%s%d?ttl=%s", s.url, prefix, i, ttl)
+				if status, body, _ := do(t, "PUT", url, strings.NewReader("v")); status != http.StatusOK {
+					t.Errorf("PUT: status %d (%s)", status, body)
+					return
+				}
+			}
+		}()
+	}
+
+	var counts []int
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	for sampling := true; sampling; {
+		select {
+		case <-done:
+			sampling = false
+		case <-time.After(250 * time.Millisecond):
+			var n int
+			if err := db.QueryRow(`SELECT count(*) FROM kv_store WHERE starts_with(key, $1)`, prefix).Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			counts = append(counts, n)
+		}
+	}
+	rate := float64(keys) / time.Since(start).Seconds()
+	// A key lives its ttl plus up to one sweep interval; allow three times
+	// that for sweeps running late under the write load.
+	limit := int(3 * rate * (ttl + 100*time.Millisecond).Seconds())
+	for i, n := range counts {
+		if n > limit {
+			t.Errorf("sample %d: %d rows in the table at %.0f writes/s, want at most %d", i, n, rate, limit)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var n int
+		if err := db.QueryRow(`SELECT count(*) FROM kv_store WHERE starts_with(key, $1)`, prefix).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d expired rows left 5s after the last write", n)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var swept int64
+	for _, s := range servers {
+		_, body, _ := do(t, "GET", s.url+"/stats", nil)
+		var st struct {
+			TTLSweeper struct {
+				RowsSwept    int64   `json:"rows_swept"`
+				MaxBatchRows int64   `json:"max_batch_rows"`
+				LagSeconds   float64 `json:"lag_seconds"`
+			} `json:"ttl_sweeper"`
+		}
+		if err := json.Unmarshal([]byte(body), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.TTLSweeper.MaxBatchRows > 500 {
+			t.Errorf("a batch swept %d rows, over -ttl-sweep-batch 500", st.TTLSweeper.MaxBatchRows)
+		}
+		swept += st.TTLSweeper.RowsSwept
+	}
+	// Other tests' keys may be swept too, but never a row twice.
+	if swept < keys {
+		t.Errorf("sweepers report %d rows swept between them, want at least %d", swept, keys)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// maxSketchKeyBytes bounds the keys the request summary keeps verbatim;
+// longer ones are kept by their start and a hash.
+const maxSketchKeyBytes = 256
+
+func sketchKey(key string) string {
+	if len(key) <= maxSketchKeyBytes {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return key[:64] + "...#" + hex.EncodeToString(sum[:8])
+}
+
+// keyTooLong answers 414 for a key longer than -max-key-bytes.
+func (s *Server) keyTooLong(w http.ResponseWriter, key string) bool {
+	if len(key) <= s.maxKeyBytes {
+		return false
+	}
+	http.Error(w, "Key longer than "+strconv.Itoa(s.maxKeyBytes)+" bytes", http.StatusRequestURITooLong)
+	return true
+}
+
+func (s *Server) writeKeyMetrics(w http.ResponseWriter) {
+	fmt.Fprintln(w, "# HELP kv_cache_oversized_keys_total Keys refused by a cache for exceeding -max-key-bytes.")
+	fmt.Fprintln(w, "# TYPE kv_cache_oversized_keys_total counter")
+	fmt.Fprintf(w, "kv_cache_oversized_keys_total{cache=\"read-through\"} %d\n", atomic.LoadInt64(&s.cache.oversizedKeys))
+	fmt.Fprintf(w, "kv_cache_oversized_keys_total{cache=\"endpoints\"} %d\n", atomic.LoadInt64(&s.kvCache.oversizedKeys))
+	fmt.Fprintln(w, "# HELP kv_cache_uncacheable_values_total Values kept out of the read-through cache for exceeding -cache-max-entry-bytes.")
+	fmt.Fprintln(w, "# TYPE kv_cache_uncacheable_values_total counter")
+	fmt.Fprintf(w, "kv_cache_uncacheable_values_total %d\n", atomic.LoadInt64(&s.cache.uncacheable))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLongKeysEverywhere throws keys of one to three megabytes at every
+// entry point that takes a key, over HTTP and on the caches directly.
+// None may panic, be stored, or leave memory behind.
+func TestLongKeysEverywhere(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	s.tombstoneTTL = time.Minute
+	h := s.routes()
+	serve := func(method, target, body string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w.Code
+	}
+
+	heap := func() uint64 {
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	before := heap()
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range 4 {
+		key := strings.Repeat(string(rune('a'+i%26)), 1<<20+rng.IntN(2<<20))
+		for _, req := range []struct {
+			method, target, body string
+			status               int
+		}{
+			{"GET", "/kv/" + key, "", http.StatusRequestURITooLong},
+			{"HEAD", "/kv/" + key, "", http.StatusRequestURITooLong},
+			{"PUT", "/kv/" + key, "v", http.StatusRequestURITooLong},
+			{"DELETE", "/kv/" + key, "", http.StatusRequestURITooLong},
+			{"GET", "/kv/" + key + "/meta", "", http.StatusRequestURITooLong},
+			{"GET", "/cache/" + key, "", http.StatusRequestURITooLong},
+			{"PUT", "/cache/" + key, "v", http.StatusRequestURITooLong},
+			{"POST", "/admin/pin/" + key, "", http.StatusRequestURITooLong},
+			// It can never have been pinned.
+			{"POST", "/admin/unpin/" + key, "", http.StatusNotFound},
+		} {
+			if status := serve(req.method, req.target, req.body); status != req.status {
+				t.Fatalf("%s %s... with a %d byte key: status %d, want %d", req.method, req.target[:10], len(key), status, req.status)
+			}
+		}
+		if status := serve("POST", "/kv/", fmt.Sprintf(`{"entries": [{"key": "ok", "value": "v"}, {"key": %q, "value": "v"}]}`, key)); status != http.StatusRequestURITooLong {
+			t.Fatalf("batch PUT with a %d byte key: status %d, want 414", len(key), status)
+		}
+		if status := serve("POST", "/admin/generate", fmt.Sprintf(`{"prefix": %q, "count": 1}`, key)); status != http.StatusBadRequest {
+			t.Fatalf("generate with a %d byte prefix: status %d, want 400", len(key), status)
+		}
+
+		for _, c := range []*Cache{s.cache, s.kvCache} {
+			c.Set(key, "v")
+			c.SetTTL(key, "v", time.Minute)
+			c.Fill(key, "v", c.FillToken(key))
+			c.Tombstone(key, "delete", time.Minute)
+			if err := c.Pin(key); err == nil {
+				t.Fatalf("pinned a %d byte key", len(key))
+			}
+			if _, ok := c.Get(key); ok {
+				t.Fatalf("cached a %d byte key", len(key))
+			}
+		}
+	}
+
+	for name, c := range map[string]*Cache{"read-through": s.cache, "endpoints": s.kvCache} {
+		if c.Len() != 0 || c.Bytes() != 0 {
+			t.Errorf("%s cache holds %d entries, %d bytes", name, c.Len(), c.Bytes())
+		}
+		if c.oversizedKeys < 4*4 {
+			t.Errorf("%s cache counted %d oversized keys", name, c.oversizedKeys)
+		}
+	}
+	if grown := int64(heap()) - int64(before); grown > 4<<20 {
+		t.Errorf("heap grew %d bytes after 4 long keys", grown)
+	}
+}
+
+func TestSketchKey(t *testing.T) {
+	short := strings.Repeat("k", maxSketchKeyBytes)
+	if sketchKey(short) != short {
+		t.Errorf("key of %d bytes not kept verbatim", len(short))
+	}
+	long := strings.Repeat("k", 4<<20)
+	sk := sketchKey(long)
+	if len(sk) > maxSketchKeyBytes || !strings.HasPrefix(sk, long[:64]) {
+		t.Errorf("sketchKey of a %d byte key = %q", len(long), sk)
+	}
+	if sketchKey(long+"x") == sk {
+		t.Error("long keys differing at the end share a sketch key")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyTracker records server-side service time per method, route class,
+// injected fault if any and, for GETs, cache outcome.
+type latencyTracker struct {
+	mu     sync.RWMutex
+	series map[latencyKey]*latencySeries
+	since  time.Time
+}
+
+type latencyKey struct {
+	method string
+	route  string
+	cache  string
+	fault  string
+}
+
+type latencySeries struct {
+	mu sync.Mutex
+	h  *histogram
+}
+
+type latencySummary struct {
+	Count  int64   `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	P999Ms float64 `json:"p999_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+type latencySeriesStats struct {
+	Method string `json:"method"`
+	Route  string `json:"route"`
+	Cache  string `json:"cache,omitempty"`
+	Fault  string `json:"fault,omitempty"`
+	latencySummary
+}
+
+type latencyStats struct {
+	Since  time.Time            `json:"since"`
+	Series []latencySeriesStats `json:"series"`
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{series: make(map[latencyKey]*latencySeries), since: time.Now()}
+}
+
+// routeClass groups paths into key (one key, including its subresources),
+// batch (list and batch PUT on /kv/) and admin (everything else).
+func routeClass(path string) string {
+	for _, prefix := range []string{"/kv/", "/cache/"} {
+		if rest, ok := strings.CutPrefix(path, prefix); ok {
+			if rest == "" {
+				return "batch"
+			}
+			return "key"
+		}
+	}
+	return "admin"
+}
+
+func methodLabel(m string) string {
+	switch m {
+	case "GET", "HEAD", "PUT", "POST", "DELETE", "OPTIONS":
+		return m
+	}
+	return "OTHER"
+}
+
+func (t *latencyTracker) record(k latencyKey, d time.Duration) {
+	t.mu.RLock()
+	s, ok := t.series[k]
+	t.mu.RUnlock()
+	if !ok {
+		t.mu.Lock()
+		if s, ok = t.series[k]; !ok {
+			s = &latencySeries{h: newHistogram()}
+			t.series[k] = s
+		}
+		t.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.h.record(d)
+	s.mu.Unlock()
+}
+
+func (t *latencyTracker) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		k := latencyKey{method: methodLabel(r.Method), route: routeClass(r.URL.Path), fault: w.Header().Get("X-Fault-Injected")}
+		if r.Method == "GET" && k.route == "key" {
+			k.cache = w.Header().Get("X-Cache")
+		}
+		t.record(k, time.Since(start))
+	})
+}
+
+func (t *latencyTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.series {
+		s.mu.Lock()
+		s.h.reset()
+		s.mu.Unlock()
+	}
+	t.since = time.Now()
+}
+
+func (t *latencyTracker) stats() *latencyStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	st := &latencyStats{Since: t.since, Series: make([]latencySeriesStats, 0, len(t.series))}
+	for k, s := range t.series {
+		s.mu.Lock()
+		if s.h.count() > 0 {
+			st.Series = append(st.Series, latencySeriesStats{
+				Method:         k.method,
+				Route:          k.route,
+				Cache:          k.cache,
+				Fault:          k.fault,
+				latencySummary: s.h.summary(),
+			})
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(st.Series, func(i, j int) bool {
+		a, b := st.Series[i], st.Series[j]
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		if a.Cache != b.Cache {
+			return a.Cache < b.Cache
+		}
+		return a.Fault < b.Fault
+	})
+	return st
+}
+
+var metricQuantiles = []struct {
+	pct   float64
+	label string
+}{{50, "0.5"}, {90, "0.9"}, {99, "0.99"}, {99.9, "0.999"}}
+
+// writeMetrics renders the histograms as Prometheus summaries.
+func (t *latencyTracker) writeMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP kv_request_duration_seconds Server-side request service time.")
+	fmt.Fprintln(w, "# TYPE kv_request_duration_seconds summary")
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for k, s := range t.series {
+		labels := fmt.Sprintf(`method=%q,route=%q,cache=%q,fault=%q`, k.method, k.route, k.cache, k.fault)
+		s.mu.Lock()
+		for _, q := range metricQuantiles {
+			fmt.Fprintf(w, "kv_request_duration_seconds{%s,quantile=%q} %g\n", labels, q.label, s.h.percentile(q.pct).Seconds())
+		}
+		fmt.Fprintf(w, "kv_request_duration_seconds_sum{%s} %g\n", labels, s.h.sum.Seconds())
+		fmt.Fprintf(w, "kv_request_duration_seconds_count{%s} %d\n", labels, s.h.count())
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	s.latency.writeMetrics(w)
+	s.deciles.writeMetrics(w)
+	s.durability.writeMetrics(w)
+	s.pressure.writeMetrics(w)
+	s.inflight.writeMetrics(w)
+	s.writeKeyMetrics(w)
+}
+
+// resetLatencyHandler clears the histograms, e.g. between test phases.
+func (s *Server) resetLatencyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.latency.reset()
+	w.WriteHeader(http.StatusNoContent)
+}
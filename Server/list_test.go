@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestListCursorStableUnderWrites lists 10k keys in pages of 100 while
+// other keys, sorting between them, are put and deleted. Every key present
+// throughout must be listed exactly once.
+func TestListCursorStableUnderWrites(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	const n = 10000
+	for i := range n {
+		if _, err := s.store.Put(context.Background(), fmt.Sprintf("k%05d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	var churned atomic.Int64
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; ; i += 4 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				kv := fmt.Sprintf("%s/kv/k%05d-churn", ts.URL, i%n)
+				do(t, "PUT", kv, "v")
+				do(t, "DELETE", kv, "")
+				churned.Add(1)
+			}
+		}()
+	}
+
+	seen := make(map[string]int)
+	pages := 0
+	for next := ""; pages == 0 || next != ""; pages++ {
+		page := listKeys(t, ts.URL+"/kv/?prefix=k&limit=100&after="+url.QueryEscape(next))
+		for _, k := range page.Keys {
+			seen[k]++
+		}
+		next = page.Next
+	}
+	close(stop)
+	wg.Wait()
+
+	if churned.Load() == 0 {
+		t.Fatal("no writes happened during the listing")
+	}
+	for i := range n {
+		if k := fmt.Sprintf("k%05d", i); seen[k] != 1 {
+			t.Errorf("%s listed %d times", k, seen[k])
+		}
+	}
+	if pages < n/100 {
+		t.Errorf("%d pages for %d keys", pages, n)
+	}
+}
+
+func TestListCursorRejected(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	for _, k := range []string{"a1", "a2", "a3", "b1"} {
+		do(t, "PUT", ts.URL+"/kv/"+k, "v")
+	}
+	page := listKeys(t, ts.URL+"/kv/?prefix=a&limit=2")
+	if page.Next == "" || page.Next == "a2" {
+		t.Fatalf("next = %q, want an opaque cursor", page.Next)
+	}
+	if got := listKeys(t, ts.URL+"/kv/?prefix=a&limit=2&after="+page.Next); len(got.Keys) != 1 || got.Keys[0] != "a3" {
+		t.Errorf("second page = %v, want [a3]", got.Keys)
+	}
+	for _, q := range []string{"?prefix=b&after=" + page.Next, "?after=" + page.Next, "?prefix=a&after=a2", "?prefix=a&after=%21%21"} {
+		if status, _, _ := do(t, "GET", ts.URL+"/kv/"+q, ""); status != http.StatusBadRequest {
+			t.Errorf("GET /kv/%s: status %d, want 400", q, status)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type listenerSpec struct {
+	name    string
+	network string
+	addr    string
+	handler http.Handler
+}
+
+// listenerSpecs returns one listener serving everything, or, when read and
+// write addresses are given, one per side restricted to its methods.
+func (s *Server) listenerSpecs(addr, readAddr, writeAddr string) ([]listenerSpec, error) {
+	if readAddr == "" && writeAddr == "" {
+		return []listenerSpec{{name: "server", network: "tcp", addr: addr, handler: s.routes()}}, nil
+	}
+	if readAddr == "" || writeAddr == "" {
+		return nil, errors.New("-read-addr and -write-addr must be set together")
+	}
+	return []listenerSpec{
+		{name: "read", network: "tcp", addr: readAddr, handler: s.routes("GET", "HEAD", "OPTIONS")},
+		{name: "write", network: "tcp", addr: writeAddr, handler: s.routes("PUT", "DELETE", "POST", "OPTIONS")},
+	}, nil
+}
+
+func (s *Server) unixListenerSpec(path string) listenerSpec {
+	return listenerSpec{name: "unix", network: "unix", addr: path, handler: s.routes()}
+}
+
+// listenUnix replaces a stale socket left by an unclean exit (but never a
+// regular file) and applies mode. The listener unlinks the socket on Close,
+// which Shutdown triggers.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func allowMethods(methods []string, next http.Handler) http.Handler {
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "Method not allowed on this listener", http.StatusMethodNotAllowed)
+	})
+}
+
+// serveOptions configures the http.Servers built by serve. The timeouts
+// and header limit keep slow or oversized requests from pinning
+// connections.
+type serveOptions struct {
+	socketMode      os.FileMode
+	shutdownTimeout time.Duration
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+
+	conns *connGauge
+}
+
+// server builds the http.Server for one listener.
+func (opts serveOptions) server(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: opts.readHeaderTimeout,
+		ReadTimeout:       opts.readTimeout,
+		WriteTimeout:      opts.writeTimeout,
+		IdleTimeout:       opts.idleTimeout,
+		MaxHeaderBytes:    opts.maxHeaderBytes,
+	}
+	if opts.conns != nil {
+		srv.ConnState = opts.conns.track
+	}
+	return srv
+}
+
+// serve runs every listener until SIGINT/SIGTERM, then drains them all
+// within shutdownTimeout.
+func serve(specs []listenerSpec, opts serveOptions) error {
+	servers := make([]*http.Server, len(specs))
+	lns := make([]net.Listener, len(specs))
+	var described []string
+	for i, spec := range specs {
+		var ln net.Listener
+		var err error
+		if spec.network == "unix" {
+			ln, err = listenUnix(spec.addr, opts.socketMode)
+		} else {
+			ln, err = net.Listen(spec.network, spec.addr)
+		}
+		if err != nil {
+			for _, prev := range lns[:i] {
+				prev.Close()
+			}
+			return fmt.Errorf("listen on %s: %w", spec.addr, err)
+		}
+		lns[i] = ln
+		servers[i] = opts.server(spec.handler)
+
+		desc := ln.Addr().String()
+		switch spec.name {
+		case "read":
+			desc += " (reads)"
+		case "write":
+			desc += " (writes)"
+		case "unix":
+			desc = "unix:" + desc
+		}
+		described = append(described, desc)
+	}
+	fmt.Printf("Server starting on %s...\n", strings.Join(described, " and "))
+
+	errs := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func() {
+			if err := srv.Serve(lns[i]); !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("%s listener: %w", specs[i].name, err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, draining in-flight requests (timeout %s)", opts.shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+	defer cancel()
+	var firstErr error
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
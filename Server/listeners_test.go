@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.sock")
+	ln, err := listenUnix(path, 0o660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o660 {
+		t.Fatalf("socket mode %v (%v), want 0660", fi.Mode().Perm(), err)
+	}
+	go http.Serve(ln, http.NotFoundHandler())
+	if _, err := listenUnix(path, 0o660); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("second listener on a live socket: %v, want in use", err)
+	}
+	ln.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket left behind after Close: %v", err)
+	}
+
+	// A socket left by an unclean exit is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err = listenUnix(path, 0o600)
+	if err != nil {
+		t.Fatalf("listening over a stale socket: %v", err)
+	}
+	ln.Close()
+
+	// A regular file is never removed.
+	file := filepath.Join(t.TempDir(), "not-a-socket")
+	os.WriteFile(file, []byte("data"), 0o644)
+	if _, err := listenUnix(file, 0o600); err == nil {
+		t.Fatalf("listening over a regular file succeeded")
+	}
+	if data, _ := os.ReadFile(file); string(data) != "data" {
+		t.Errorf("regular file clobbered: %q", data)
+	}
+}
+
+// TestUnixAndTCPServeIdentical serves one server on a TCP and a Unix
+// listener at once and compares their responses.
+func TestUnixAndTCPServeIdentical(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	path := filepath.Join(t.TempDir(), "kv.sock")
+	specs := []listenerSpec{{name: "server", network: "tcp", addr: "127.0.0.1:0", handler: s.routes()}, s.unixListenerSpec(path)}
+	var urls []string
+	clients := []*http.Client{http.DefaultClient}
+	for _, spec := range specs {
+		var ln net.Listener
+		var err error
+		if spec.network == "unix" {
+			ln, err = listenUnix(spec.addr, 0o600)
+		} else {
+			ln, err = net.Listen(spec.network, spec.addr)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: spec.handler}
+		go srv.Serve(ln)
+		t.Cleanup(func() { srv.Shutdown(context.Background()) })
+		urls = append(urls, "http://"+ln.Addr().String())
+	}
+	urls[1] = "http://kv"
+	var d net.Dialer
+	clients = append(clients, &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", path)
+		},
+	}})
+
+	req, _ := http.NewRequest("PUT", urls[0]+"/kv/k", strings.NewReader("value"))
+	if _, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	type response struct {
+		status int
+		body   string
+	}
+	for _, path := range []string{"/kv/k", "/kv/missing", "/kv/"} {
+		var got []response
+		for i, c := range clients {
+			resp, err := c.Get(urls[i] + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			got = append(got, response{resp.StatusCode, string(body)})
+		}
+		if got[0] != got[1] {
+			t.Errorf("GET %s: TCP %+v, Unix socket %+v", path, got[0], got[1])
+		}
+	}
+}
+
+func TestSlowHeadersDisconnected(t *testing.T) {
+	var conns connGauge
+	opts := serveOptions{readHeaderTimeout: 200 * time.Millisecond, maxHeaderBytes: 1 << 10, conns: &conns}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := opts.server(newTestServer(NewMemStore()).routes())
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// A request line and half a header, then nothing more.
+	io.WriteString(c, "GET /kv/k HTTP/1.1\r\nHost: kv\r\nX-Slow: ")
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c); err != nil {
+		t.Fatalf("stalled connection not closed by the server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stalled connection closed after %s, want about the 200ms header timeout", elapsed)
+	}
+	deadline := time.Now().Add(time.Second)
+	for conns.stats().Open != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := conns.stats(); st.Open != 0 || st.Accepted != 1 {
+		t.Errorf("connection gauge %+v after the close, want 1 accepted and none open", st)
+	}
+}
+
+func TestOversizedHeadersRejected(t *testing.T) {
+	opts := serveOptions{maxHeaderBytes: 1 << 10}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := opts.server(newTestServer(NewMemStore()).routes())
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/kv/k", nil)
+	req.Header.Set("X-Big", strings.Repeat("x", 8<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("8KB of headers over a 1KB limit: status %d, want 431", resp.StatusCode)
+	}
+}
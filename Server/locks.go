@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	defaultLockLease = 30 * time.Second
+	maxLockLease     = time.Hour
+)
+
+type lockResponse struct {
+	Key         string     `json:"key"`
+	Owner       string     `json:"owner,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	RemainingMs int64      `json:"remaining_ms,omitempty"`
+	Held        bool       `json:"held"`
+}
+
+func newLockResponse(key string, lock LockInfo, held bool) lockResponse {
+	resp := lockResponse{Key: key, Held: held}
+	if held {
+		resp.Owner = lock.Owner
+		resp.ExpiresAt = &lock.ExpiresAt
+		resp.RemainingMs = max(time.Until(lock.ExpiresAt).Milliseconds(), 0)
+	}
+	return resp
+}
+
+// lockParams reads the owner token from X-Lock-Owner and the lease from the
+// lease query parameter.
+func lockParams(w http.ResponseWriter, r *http.Request) (owner string, lease time.Duration, ok bool) {
+	owner = r.Header.Get("X-Lock-Owner")
+	if owner == "" {
+		http.Error(w, "X-Lock-Owner header is required", http.StatusBadRequest)
+		return "", 0, false
+	}
+	lease = defaultLockLease
+	if v := r.URL.Query().Get("lease"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxLockLease {
+			http.Error(w, "lease must be a positive duration of at most 1h", http.StatusBadRequest)
+			return "", 0, false
+		}
+		lease = d
+	}
+	return owner, lease, true
+}
+
+func (s *Server) handleLockStatus(w http.ResponseWriter, r *http.Request, key string) {
+	lock, held, err := s.store.LockStatus(r.Context(), key)
+	if err != nil {
+		s.dbError(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, newLockResponse(key, lock, held))
+}
+
+func (s *Server) handleLockAcquire(w http.ResponseWriter, r *http.Request, key string) {
+	owner, lease, ok := lockParams(w, r)
+	if !ok {
+		return
+	}
+	lock, acquired, err := s.store.AcquireLock(r.Context(), key, owner, lease)
+	if err != nil {
+		s.dbError(w)
+		return
+	}
+	status := http.StatusOK
+	if !acquired {
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, newLockResponse(key, lock, lock.Owner != ""))
+}
+
+func (s *Server) handleLockRenew(w http.ResponseWriter, r *http.Request, key string) {
+	owner, lease, ok := lockParams(w, r)
+	if !ok {
+		return
+	}
+	lock, renewed, err := s.store.RenewLock(r.Context(), key, owner, lease)
+	if err != nil {
+		s.dbError(w)
+		return
+	}
+	if !renewed {
+		writeJSON(w, http.StatusConflict, newLockResponse(key, lock, lock.Owner != ""))
+		return
+	}
+	writeJSON(w, http.StatusOK, newLockResponse(key, lock, true))
+}
+
+func (s *Server) handleLockRelease(w http.ResponseWriter, r *http.Request, key string) {
+	owner, _, ok := lockParams(w, r)
+	if !ok {
+		return
+	}
+	released, err := s.store.ReleaseLock(r.Context(), key, owner)
+	if err != nil {
+		s.dbError(w)
+		return
+	}
+	if !released {
+		lock, held, err := s.store.LockStatus(r.Context(), key)
+		if err != nil {
+			s.dbError(w)
+			return
+		}
+		writeJSON(w, http.StatusConflict, newLockResponse(key, lock, held))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
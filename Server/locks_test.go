@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func lockTestServer(t *testing.T) (*MemStore, string) {
+	m := NewMemStore()
+	ts := httptest.NewServer(newTestServer(m).routes())
+	t.Cleanup(ts.Close)
+	return m, ts.URL + "/kv/k/lock"
+}
+
+func lockRequest(t *testing.T, method, url, owner string) (int, lockResponse) {
+	t.Helper()
+	status, body, _ := do(t, method, url, "", "X-Lock-Owner", owner)
+	var resp lockResponse
+	if body != "" {
+		json.Unmarshal([]byte(body), &resp)
+	}
+	return status, resp
+}
+
+// expireLock moves key's lease into the past, standing in for a clock
+// that has moved on.
+func expireLock(m *MemStore, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.locks[key]
+	l.ExpiresAt = time.Now().Add(-time.Millisecond)
+	m.locks[key] = l
+}
+
+func TestLockOneHolderAtATime(t *testing.T) {
+	_, url := lockTestServer(t)
+	var holders, acquired atomic.Int64
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			owner := fmt.Sprintf("owner-%d", i)
+			for {
+				status, _ := lockRequest(t, "POST", url+"?lease=1h", owner)
+				if status == http.StatusConflict {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if status != http.StatusOK {
+					t.Errorf("%s acquiring: status %d", owner, status)
+					return
+				}
+				if n := holders.Add(1); n != 1 {
+					t.Errorf("%d holders at once", n)
+				}
+				acquired.Add(1)
+				time.Sleep(time.Millisecond)
+				holders.Add(-1)
+				if status, _ := lockRequest(t, "DELETE", url, owner); status != http.StatusOK {
+					t.Errorf("%s releasing: status %d", owner, status)
+				}
+				return
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired.Load() != 20 {
+		t.Errorf("%d of 20 owners got the lock", acquired.Load())
+	}
+}
+
+func TestLockContentionAndTakeover(t *testing.T) {
+	m, url := lockTestServer(t)
+	if status, _ := lockRequest(t, "POST", url+"?lease=1m", "a"); status != http.StatusOK {
+		t.Fatalf("a acquiring: status %d", status)
+	}
+	status, resp := lockRequest(t, "POST", url, "b")
+	if status != http.StatusConflict || resp.Owner != "a" || resp.RemainingMs <= 0 || resp.RemainingMs > time.Minute.Milliseconds() {
+		t.Fatalf("b acquiring a held lock: status %d, %+v; want 409 naming a and its lease", status, resp)
+	}
+	if status, _ := lockRequest(t, "DELETE", url, "b"); status != http.StatusConflict {
+		t.Errorf("b releasing a's lock: status %d, want 409", status)
+	}
+	if status, resp := lockRequest(t, "POST", url+"/renew?lease=1h", "a"); status != http.StatusOK || resp.RemainingMs <= time.Minute.Milliseconds() {
+		t.Errorf("a renewing: status %d, %+v", status, resp)
+	}
+
+	expireLock(m, "k")
+	if status, resp := lockRequest(t, "GET", url, ""); status != http.StatusOK || resp.Held {
+		t.Errorf("status of an expired lock: %d, %+v; want not held", status, resp)
+	}
+	if status, resp := lockRequest(t, "POST", url, "b"); status != http.StatusOK || resp.Owner != "b" {
+		t.Fatalf("b taking over an expired lease: status %d, %+v", status, resp)
+	}
+	if status, resp := lockRequest(t, "POST", url+"/renew", "a"); status != http.StatusConflict || resp.Owner != "b" {
+		t.Errorf("a renewing after the takeover: status %d, %+v; want 409 naming b", status, resp)
+	}
+	if status, _ := lockRequest(t, "DELETE", url, "a"); status != http.StatusConflict {
+		t.Errorf("a releasing after the takeover: status %d, want 409", status)
+	}
+}
+
+func TestLockNotCached(t *testing.T) {
+	m, url := lockTestServer(t)
+	lockRequest(t, "POST", url, "a")
+	if _, resp := lockRequest(t, "GET", url, ""); !resp.Held || resp.Owner != "a" {
+		t.Fatalf("lock status after acquiring: %+v", resp)
+	}
+	// A change behind the server's back shows on the next read.
+	m.ReleaseLock(context.Background(), "k", "a")
+	if _, resp := lockRequest(t, "GET", url, ""); resp.Held {
+		t.Errorf("lock status after release: %+v, want not held", resp)
+	}
+	if status, _, _ := do(t, "GET", url[:len(url)-len("/lock")], ""); status != http.StatusNotFound {
+		t.Errorf("GET of the locked key: status %d, want 404; a lock is not a value", status)
+	}
+}
+
+func TestLockParams(t *testing.T) {
+	_, url := lockTestServer(t)
+	for _, tc := range []struct{ url, owner string }{
+		{url, ""},
+		{url + "?lease=0s", "a"},
+		{url + "?lease=2h", "a"},
+		{url + "?lease=soon", "a"},
+	} {
+		if status, _ := lockRequest(t, "POST", tc.url, tc.owner); status != http.StatusBadRequest {
+			t.Errorf("POST %s owner %q: status %d, want 400", tc.url, tc.owner, status)
+		}
+	}
+}
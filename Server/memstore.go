@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memEntry struct {
+	value     string
+	deletedAt time.Time
+	expiresAt time.Time
+	updatedAt time.Time
+	createdAt time.Time
+}
+
+func (e memEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// MemStore keeps everything in process memory. It lets the server run
+// without Postgres, e.g. to benchmark the HTTP and cache tiers alone.
+type MemStore struct {
+	mu    sync.RWMutex
+	items map[string]memEntry
+	locks map[string]LockInfo
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{items: make(map[string]memEntry), locks: make(map[string]LockInfo)}
+}
+
+func (m *MemStore) Get(ctx context.Context, key string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.live(key) {
+		return "", ErrNotFound
+	}
+	return m.items[key].value, nil
+}
+
+func (m *MemStore) GetBounded(ctx context.Context, key string, limit int64) (string, bool, error) {
+	v, err := m.Get(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	if int64(len(v)) > limit {
+		return "", false, nil
+	}
+	return v, true, nil
+}
+
+func (m *MemStore) Stream(ctx context.Context, key string, fn func(total int64, chunk []byte) error) error {
+	v, err := m.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	return fn(int64(len(v)), []byte(v))
+}
+
+func (m *MemStore) PutStream(ctx context.Context, key string, body io.Reader, ttl time.Duration) (bool, int64, error) {
+	value, err := io.ReadAll(body)
+	if err != nil {
+		return false, 0, err
+	}
+	created, err := m.PutTTL(ctx, key, string(value), ttl)
+	return created, int64(len(value)), err
+}
+
+func (m *MemStore) live(key string) bool {
+	e, ok := m.items[key]
+	return ok && e.deletedAt.IsZero() && !e.expired(time.Now())
+}
+
+// createdAt is when key's row was created, or now for a new one. As in
+// Postgres, a soft-deleted or expired row keeps its creation time when it
+// is written again. It must be called with mu held.
+func (m *MemStore) createdAt(key string, now time.Time) time.Time {
+	if e, ok := m.items[key]; ok {
+		return e.createdAt
+	}
+	return now
+}
+
+func (m *MemStore) Put(ctx context.Context, key, value string) (bool, error) {
+	return m.PutTTL(ctx, key, value, 0)
+}
+
+func (m *MemStore) PutTTL(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	created := !m.live(key)
+	e := memEntry{value: value, updatedAt: time.Now()}
+	e.createdAt = m.createdAt(key, e.updatedAt)
+	if ttl > 0 {
+		e.expiresAt = e.updatedAt.Add(ttl)
+	}
+	m.items[key] = e
+	return created, nil
+}
+
+// modifiedSince must be called with mu held.
+func (m *MemStore) modifiedSince(key string, since time.Time) bool {
+	return m.live(key) && m.items[key].updatedAt.Truncate(time.Second).After(since)
+}
+
+func (m *MemStore) PutIfUnmodifiedSince(ctx context.Context, key, value string, ttl time.Duration, since time.Time) (bool, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.modifiedSince(key, since) {
+		return false, time.Time{}, ErrPreconditionFailed
+	}
+	created := !m.live(key)
+	e := memEntry{value: value, updatedAt: time.Now()}
+	e.createdAt = m.createdAt(key, e.updatedAt)
+	if ttl > 0 {
+		e.expiresAt = e.updatedAt.Add(ttl)
+	}
+	m.items[key] = e
+	return created, e.updatedAt, nil
+}
+
+func (m *MemStore) DeleteIfUnmodifiedSince(ctx context.Context, key string, since time.Time, soft bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.modifiedSince(key, since) {
+		return false, ErrPreconditionFailed
+	}
+	if !m.live(key) {
+		return false, nil
+	}
+	if !soft {
+		delete(m.items, key)
+		return true, nil
+	}
+	e := m.items[key]
+	e.deletedAt = time.Now()
+	e.updatedAt = e.deletedAt
+	m.items[key] = e
+	return true, nil
+}
+
+func (m *MemStore) PutMany(ctx context.Context, entries []KeyValue) ([]bool, error) {
+	// Fail as Postgres does, rather than silently keeping the last value.
+	if len(duplicateKeys(entries)) > 0 {
+		return nil, ErrDuplicateKeys
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	created := make([]bool, len(entries))
+	for i, e := range entries {
+		created[i] = !m.live(e.Key)
+		now := time.Now()
+		m.items[e.Key] = memEntry{value: e.Value, updatedAt: now, createdAt: m.createdAt(e.Key, now)}
+	}
+	return created, nil
+}
+
+func (m *MemStore) Delete(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := m.live(key)
+	delete(m.items, key)
+	return deleted, nil
+}
+
+func (m *MemStore) SoftDelete(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.live(key) {
+		return false, nil
+	}
+	e := m.items[key]
+	e.deletedAt = time.Now()
+	e.updatedAt = e.deletedAt
+	m.items[key] = e
+	return true, nil
+}
+
+func (m *MemStore) Undelete(ctx context.Context, key string, retention time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.items[key]
+	if !ok || e.deletedAt.IsZero() || time.Since(e.deletedAt) >= retention {
+		return false, nil
+	}
+	e.deletedAt = time.Time{}
+	e.updatedAt = time.Now()
+	m.items[key] = e
+	return true, nil
+}
+
+func (m *MemStore) PurgeDeleted(ctx context.Context, retention time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for k, e := range m.items {
+		if !e.deletedAt.IsZero() && time.Since(e.deletedAt) >= retention {
+			delete(m.items, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemStore) SweepExpired(ctx context.Context, limit int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for k, e := range m.items {
+		if len(keys) == limit {
+			break
+		}
+		if e.expired(now) {
+			delete(m.items, k)
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (m *MemStore) CountPurge(ctx context.Context, f PurgeFilter) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	var n int64
+	for k, e := range m.items {
+		if f.matches(k, e.createdAt, now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemStore) PurgeBatch(ctx context.Context, f PurgeFilter, limit int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for k, e := range m.items {
+		if len(keys) == limit {
+			break
+		}
+		if f.matches(k, e.createdAt, now) {
+			delete(m.items, k)
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (m *MemStore) ExpiryLag(ctx context.Context) (time.Duration, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	var lag time.Duration
+	for _, e := range m.items {
+		if e.expired(now) {
+			lag = max(lag, now.Sub(e.expiresAt))
+		}
+	}
+	return lag, nil
+}
+
+func (m *MemStore) List(ctx context.Context, opts ListOptions) ([]ListedKey, error) {
+	m.mu.RLock()
+	keys := []ListedKey{}
+	now := time.Now()
+	for k, e := range m.items {
+		deleted := !e.deletedAt.IsZero()
+		if strings.HasPrefix(k, opts.Prefix) && k > opts.After && (!deleted || opts.IncludeDeleted) && !e.expired(now) {
+			keys = append(keys, ListedKey{Key: k, Deleted: deleted})
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	if len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+	}
+	return keys, nil
+}
+
+// Scan sorts the keys in range up front and then reads each value as it
+// gets to it, so writes during the scan show up as they would in a query
+// over an index: a key changed before the scan reaches it is read as
+// changed.
+func (m *MemStore) Scan(ctx context.Context, opts ScanOptions, fn func(key, value string) error) error {
+	m.mu.RLock()
+	var keys []string
+	for k, e := range m.items {
+		if opts.includes(k, int64(len(e.value))) {
+			keys = append(keys, k)
+		}
+	}
+	m.mu.RUnlock()
+	sort.Strings(keys)
+
+	n := 0
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		e, ok := m.items[k], m.live(k)
+		m.mu.RUnlock()
+		if !ok || !opts.includes(k, int64(len(e.value))) {
+			continue
+		}
+		if err := fn(k, e.value); err != nil {
+			return err
+		}
+		if n++; n == opts.Limit {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) UsedBytes(ctx context.Context, prefix string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var n int64
+	for k, e := range m.items {
+		if strings.HasPrefix(k, prefix) {
+			n += int64(len(e.value))
+		}
+	}
+	return n, nil
+}
+
+func (m *MemStore) AcquireLock(ctx context.Context, key, owner string, lease time.Duration) (LockInfo, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if cur, ok := m.locks[key]; ok && cur.ExpiresAt.After(now) {
+		return cur, false, nil
+	}
+	lock := LockInfo{Owner: owner, ExpiresAt: now.Add(lease)}
+	m.locks[key] = lock
+	return lock, true, nil
+}
+
+func (m *MemStore) RenewLock(ctx context.Context, key, owner string, lease time.Duration) (LockInfo, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	cur, ok := m.locks[key]
+	if !ok || !cur.ExpiresAt.After(now) {
+		return LockInfo{}, false, nil
+	}
+	if cur.Owner != owner {
+		return cur, false, nil
+	}
+	cur.ExpiresAt = now.Add(lease)
+	m.locks[key] = cur
+	return cur, true, nil
+}
+
+func (m *MemStore) ReleaseLock(ctx context.Context, key, owner string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur, ok := m.locks[key]
+	if !ok || cur.Owner != owner || !cur.ExpiresAt.After(time.Now()) {
+		return false, nil
+	}
+	delete(m.locks, key)
+	return true, nil
+}
+
+func (m *MemStore) LockStatus(ctx context.Context, key string) (LockInfo, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cur, ok := m.locks[key]
+	if !ok || !cur.ExpiresAt.After(time.Now()) {
+		return LockInfo{}, false, nil
+	}
+	return cur, true, nil
+}
+
+func (m *MemStore) Close() error {
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// migrations must only ever be appended to; applied versions are recorded
+// in schema_migrations and never re-run.
+var migrations = []migration{
+	{1, "create kv_store", []string{
+		`CREATE TABLE IF NOT EXISTS kv_store (
+			key TEXT PRIMARY KEY,
+			value TEXT
+		)`,
+	}},
+	{2, "add soft-delete tombstones", []string{
+		`ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+		`CREATE INDEX IF NOT EXISTS kv_store_deleted_at_idx ON kv_store (deleted_at) WHERE deleted_at IS NOT NULL`,
+	}},
+	{3, "create kv_locks", []string{
+		`CREATE TABLE IF NOT EXISTS kv_locks (
+			key TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		)`,
+	}},
+	{4, "create kv_shard", []string{
+		`CREATE TABLE IF NOT EXISTS kv_shard (
+			id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+			shard_index INT NOT NULL,
+			shard_count INT NOT NULL
+		)`,
+	}},
+	{5, "add kv_store expiry", []string{
+		`ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+		`CREATE INDEX IF NOT EXISTS kv_store_expires_at_idx ON kv_store (expires_at) WHERE expires_at IS NOT NULL`,
+	}},
+	{6, "add kv_store modification time", []string{
+		`ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	}},
+	// A streamed value has value NULL and its bytes in kv_chunks;
+	// chunked_size doubles as the marker that the row is chunked. Any
+	// write that sets value drops the chunks through the trigger.
+	{7, "create kv_chunks for streamed values", []string{
+		`ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS chunked_size BIGINT`,
+		`CREATE TABLE IF NOT EXISTS kv_chunks (
+			key TEXT NOT NULL REFERENCES kv_store (key) ON DELETE CASCADE,
+			seq INT NOT NULL,
+			data BYTEA NOT NULL,
+			PRIMARY KEY (key, seq)
+		)`,
+		`CREATE OR REPLACE FUNCTION kv_store_unchunk() RETURNS trigger AS $$
+		BEGIN
+			IF NEW.value IS NOT NULL AND OLD.chunked_size IS NOT NULL THEN
+				NEW.chunked_size := NULL;
+				DELETE FROM kv_chunks WHERE key = OLD.key;
+			END IF;
+			RETURN NEW;
+		END $$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS kv_store_unchunk ON kv_store`,
+		`CREATE TRIGGER kv_store_unchunk BEFORE UPDATE OF value ON kv_store
+			FOR EACH ROW EXECUTE FUNCTION kv_store_unchunk()`,
+	}},
+	// Rows from before this migration get their last modification time,
+	// the best guess at their age there is.
+	{8, "add kv_store creation time", []string{
+		`ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ`,
+		`UPDATE kv_store SET created_at = updated_at WHERE created_at IS NULL`,
+		`ALTER TABLE kv_store ALTER COLUMN created_at SET DEFAULT now(), ALTER COLUMN created_at SET NOT NULL`,
+	}},
+	// Each streamed upload writes its chunks as a new generation and
+	// then the manifest naming it; see chunkManifest. Values streamed
+	// before this migration become generation 0. Writing a value over a
+	// streamed one now only drops the manifest, leaving the chunks to the
+	// sweeper like any superseded generation.
+	{9, "add kv_manifests and chunk generations", []string{
+		`ALTER TABLE kv_chunks ADD COLUMN IF NOT EXISTS generation BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE kv_chunks DROP CONSTRAINT IF EXISTS kv_chunks_pkey`,
+		`ALTER TABLE kv_chunks ADD PRIMARY KEY (key, generation, seq)`,
+		`CREATE SEQUENCE IF NOT EXISTS kv_chunk_generations START 1`,
+		`CREATE TABLE IF NOT EXISTS kv_manifests (
+			key TEXT PRIMARY KEY REFERENCES kv_store (key) ON DELETE CASCADE,
+			generation BIGINT NOT NULL,
+			chunk_count INT NOT NULL,
+			total_bytes BIGINT NOT NULL,
+			checksum BYTEA NOT NULL
+		)`,
+		`INSERT INTO kv_manifests (key, generation, chunk_count, total_bytes, checksum)
+			SELECT key, 0, count(*), sum(octet_length(data)), sha256(string_agg(data, '' ORDER BY seq))
+			FROM kv_chunks GROUP BY key
+			ON CONFLICT (key) DO NOTHING`,
+		`CREATE OR REPLACE FUNCTION kv_store_unchunk() RETURNS trigger AS $$
+		BEGIN
+			IF NEW.value IS NOT NULL AND OLD.chunked_size IS NOT NULL THEN
+				NEW.chunked_size := NULL;
+				DELETE FROM kv_manifests WHERE key = OLD.key;
+			END IF;
+			RETURN NEW;
+		END $$ LANGUAGE plpgsql`,
+	}},
+}
+
+// migrationLockID is the advisory lock key serialising migrations across
+// server instances that start at the same time.
+const migrationLockID = 7_405_377_001
+
+func runMigrations(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	if err := baselineIfNeeded(ctx, conn); err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d (%s)", m.version, m.name)
+	}
+	return nil
+}
+
+// baselineIfNeeded handles installations created before migrations existed:
+// kv_store is present but schema_migrations is not, so version 1 is recorded
+// as applied without running it.
+func baselineIfNeeded(ctx context.Context, conn *sql.Conn) error {
+	var hasMigrations, hasStore bool
+	err := conn.QueryRowContext(ctx, `
+		SELECT to_regclass('schema_migrations') IS NOT NULL,
+		       to_regclass('kv_store') IS NOT NULL`).Scan(&hasMigrations, &hasStore)
+	if err != nil {
+		return err
+	}
+	if hasMigrations {
+		return nil
+	}
+
+	if _, err := conn.ExecContext(ctx, `
+		CREATE TABLE schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	if hasStore {
+		if _, err := conn.ExecContext(ctx,
+			"INSERT INTO schema_migrations (version, name) VALUES (1, 'baseline: existing kv_store')"); err != nil {
+			return err
+		}
+		log.Printf("Existing kv_store found; recorded baseline migration 1")
+	}
+	return nil
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w\nstatement:\n%s", m.version, m.name, err, stmt)
+		}
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func printMigrationStatus(ctx context.Context, db *sql.DB) error {
+	applied := make(map[int]time.Time)
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var v int
+			var at time.Time
+			if err := rows.Scan(&v, &at); err != nil {
+				return err
+			}
+			applied[v] = at
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range migrations {
+		if at, ok := applied[m.version]; ok {
+			fmt.Printf("%4d  applied %s  %s\n", m.version, at.Format(time.RFC3339), m.name)
+		} else {
+			fmt.Printf("%4d  pending                    %s\n", m.version, m.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %q is version %d at position %d; versions must run 1, 2, 3, ...", m.name, m.version, i)
+		}
+		if m.name == "" || len(m.statements) == 0 {
+			t.Errorf("migration %d has no name or no statements", m.version)
+		}
+		for _, stmt := range m.statements {
+			if strings.TrimSpace(stmt) == "" {
+				t.Errorf("migration %d (%s) has an empty statement", m.version, m.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var errTooLargeToPin = errors.New("value is larger than -stream-threshold and is never cached")
+
+// pinKey pins key and loads its current value from the store. A key that
+// does not exist yet is still pinned and gets cached on its first PUT.
+func (s *Server) pinKey(ctx context.Context, key string) (pinnedKey, error) {
+	token := s.cache.FillToken(key)
+	if err := s.cache.Pin(key); err != nil {
+		return pinnedKey{}, err
+	}
+	value, fits := "", true
+	var err error
+	if s.streamThreshold > 0 {
+		value, fits, err = s.store.GetBounded(ctx, key, s.streamThreshold)
+	} else {
+		value, err = s.store.Get(ctx, key)
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return pinnedKey{Key: key}, nil
+	case err != nil:
+		return pinnedKey{}, err
+	case !fits:
+		s.cache.Unpin(key)
+		return pinnedKey{}, errTooLargeToPin
+	}
+	cached := s.cache.Fill(key, value, token)
+	return pinnedKey{Key: key, Cached: cached, Bytes: len(value)}, nil
+}
+
+// loadPinnedKeys pins every key listed in path, one per line; blank lines
+// and lines starting with # are ignored.
+func (s *Server) loadPinnedKeys(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n := 0
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		key := strings.TrimSpace(lines.Text())
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if _, err := s.pinKey(context.Background(), key); err != nil {
+			return fmt.Errorf("pinning %q: %w", key, err)
+		}
+		n++
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	log.Printf("Pinned %d keys from %s", n, path)
+	return nil
+}
+
+// pinHandler serves POST /admin/pin/{key} and POST /admin/unpin/{key}.
+func (s *Server) pinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if key, ok := strings.CutPrefix(r.URL.Path, "/admin/unpin/"); ok && key != "" {
+		if !s.cache.Unpin(key) {
+			http.Error(w, "Key is not pinned", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/admin/pin/")
+	if key == "" {
+		http.Error(w, "Key is missing", http.StatusBadRequest)
+		return
+	}
+	pinned, err := s.pinKey(r.Context(), key)
+	switch {
+	case errors.Is(err, ErrPinBudget):
+		http.Error(w, fmt.Sprintf("Pin budget of %d keys exhausted (-pin-budget)", s.cache.pinBudget), http.StatusInsufficientStorage)
+	case errors.Is(err, ErrKeyTooLong):
+		http.Error(w, "Key longer than "+strconv.Itoa(s.maxKeyBytes)+" bytes", http.StatusRequestURITooLong)
+	case errors.Is(err, errTooLargeToPin):
+		http.Error(w, "Value too large to pin", http.StatusRequestEntityTooLarge)
+	case err != nil:
+		s.dbError(w)
+	default:
+		writeJSON(w, http.StatusOK, pinned)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPinnedKeySurvivesEvictionFlood(t *testing.T) {
+	c := NewShardedCache(100, 4)
+	c.pinBudget = 10
+	if err := c.Pin("config"); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("config", "pinned")
+	for i := range 10_000 {
+		c.Set(fmt.Sprintf("key-%d", i), "v")
+	}
+	if v, ok := c.Get("config"); !ok || v != "pinned" {
+		t.Fatalf("pinned key after a flood of Sets = %q, %v", v, ok)
+	}
+	if n := c.unpinnedLen(); n > 100 {
+		t.Errorf("%d unpinned entries in a cache of 100", n)
+	}
+	// Once unpinned, it is evicted like any other.
+	c.Unpin("config")
+	for i := range 10_000 {
+		c.Set(fmt.Sprintf("more-%d", i), "v")
+	}
+	if _, ok := c.Get("config"); ok {
+		t.Errorf("unpinned key survived a flood of Sets")
+	}
+}
+
+func TestPinBudget(t *testing.T) {
+	c := NewCache(100)
+	c.pinBudget = 2
+	for _, k := range []string{"a", "b"} {
+		if err := c.Pin(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Pin("a"); err != nil {
+		t.Errorf("pinning a pinned key again: %v", err)
+	}
+	if err := c.Pin("c"); err != ErrPinBudget {
+		t.Fatalf("pin over budget: %v, want ErrPinBudget", err)
+	}
+	c.Unpin("a")
+	if err := c.Pin("c"); err != nil {
+		t.Errorf("pin after freeing budget: %v", err)
+	}
+}
+
+func TestPinEndpoints(t *testing.T) {
+	m := NewMemStore()
+	m.Put(context.Background(), "config", "from-store")
+	s := newTestServer(m)
+	s.adminToken = testAdminToken
+	s.cache.pinBudget = 1
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	if status, _, _ := do(t, "POST", ts.URL+"/admin/pin/config", ""); status != http.StatusUnauthorized {
+		t.Fatalf("pin without the admin token: status %d, want 401", status)
+	}
+	status, body, _ := admin(t, "POST", ts.URL+"/admin/pin/config", "")
+	var pinned pinnedKey
+	json.Unmarshal([]byte(body), &pinned)
+	if status != http.StatusOK || !pinned.Cached || pinned.Bytes != len("from-store") {
+		t.Fatalf("pin: status %d, %s; want the store's value loaded", status, body)
+	}
+	if _, _, h := do(t, "GET", ts.URL+"/kv/config", ""); h.Get("X-Cache") != "HIT" {
+		t.Errorf("GET of a pinned key: X-Cache %q, want HIT", h.Get("X-Cache"))
+	}
+	// A PUT refreshes the pinned entry like any other.
+	admin(t, "PUT", ts.URL+"/kv/config", "updated")
+	if _, body, h := do(t, "GET", ts.URL+"/kv/config", ""); body != "updated" || h.Get("X-Cache") != "HIT" {
+		t.Errorf("GET after a PUT: %q, X-Cache %q", body, h.Get("X-Cache"))
+	}
+	if status, _, _ := admin(t, "POST", ts.URL+"/admin/pin/other", ""); status != http.StatusInsufficientStorage {
+		t.Errorf("pin over budget: status %d, want 507", status)
+	}
+
+	_, body, _ = do(t, "GET", ts.URL+"/stats", "")
+	var st struct {
+		Pinned []pinnedKey `json:"pinned"`
+	}
+	json.Unmarshal([]byte(body), &st)
+	if len(st.Pinned) != 1 || st.Pinned[0] != (pinnedKey{Key: "config", Cached: true, Bytes: len("updated")}) {
+		t.Errorf("/stats pinned = %+v", st.Pinned)
+	}
+
+	if status, _, _ := admin(t, "POST", ts.URL+"/admin/unpin/config", ""); status != http.StatusNoContent {
+		t.Errorf("unpin: status %d, want 204", status)
+	}
+	if status, _, _ := admin(t, "POST", ts.URL+"/admin/unpin/config", ""); status != http.StatusNotFound {
+		t.Errorf("unpinning a key that is not pinned: status %d, want 404", status)
+	}
+}
+
+func TestLoadPinnedKeys(t *testing.T) {
+	m := NewMemStore()
+	m.Put(context.Background(), "a", "1")
+	s := newTestServer(m)
+	path := filepath.Join(t.TempDir(), "pinned")
+	os.WriteFile(path, []byte("# critical keys\na\n\n  not-yet-written  \n"), 0o644)
+	if err := s.loadPinnedKeys(path); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, p := range s.cache.Pinned() {
+		keys = append(keys, fmt.Sprintf("%s:%t", p.Key, p.Cached))
+	}
+	if got := strings.Join(keys, " "); got != "a:true not-yet-written:false" {
+		t.Errorf("pinned from file: %s", got)
+	}
+}
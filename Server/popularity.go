@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"hash/maphash"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sketchRows  = 4
+	sketchWidth = 1 << 16
+	// maxSampledKeys bounds the distinct-key sample the decile boundaries
+	// are computed from.
+	maxSampledKeys = 4096
+)
+
+// popularityStats breaks read-through cache hits and misses down by the
+// popularity decile of the key, decile 1 being the 10% most requested keys.
+//
+// GET counts are estimated with a count-min sketch whose counters are
+// halved every window, so old traffic fades out. A key's decile comes
+// from comparing its estimate with boundaries recomputed every second
+// from a sample of distinct keys. Keys enter the sample by hash, not by
+// traffic, so it is uniform over keys whatever their popularity; when it
+// fills up the sampling rate halves. Only hashes are kept, so long keys
+// cost no memory. Get pays a hash, the sketch update and one counter
+// increment.
+type popularityStats struct {
+	seed   maphash.Seed
+	sketch [sketchRows][sketchWidth]atomic.Uint32
+	window time.Duration
+
+	// bounds[d] is the smallest estimate in decile d+1.
+	bounds [9]atomic.Uint32
+	hits   [10]atomic.Int64
+	misses [10]atomic.Int64
+
+	mu         sync.Mutex
+	sampleMask atomic.Uint64
+	sample     map[uint64]struct{}
+}
+
+type decileStats struct {
+	Decile      int     `json:"decile"`
+	MinRequests uint32  `json:"min_requests"`
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	HitRate     float64 `json:"hit_rate"`
+}
+
+type popularityResponse struct {
+	WindowSeconds float64       `json:"window_seconds"`
+	SampledKeys   int           `json:"sampled_keys"`
+	Deciles       []decileStats `json:"deciles"`
+}
+
+func newPopularityStats(window time.Duration) *popularityStats {
+	return &popularityStats{seed: maphash.MakeSeed(), window: window, sample: make(map[uint64]struct{})}
+}
+
+// recordGet is a no-op on a nil receiver, i.e. without -popularity-deciles.
+func (p *popularityStats) recordGet(key string, hit bool) {
+	if p == nil {
+		return
+	}
+	h := maphash.String(p.seed, key)
+	est := p.add(h)
+	d := 0
+	for d < len(p.bounds) && est < p.bounds[d].Load() {
+		d++
+	}
+	if hit {
+		p.hits[d].Add(1)
+	} else {
+		p.misses[d].Add(1)
+	}
+	if h&p.sampleMask.Load() == 0 {
+		p.addSample(h)
+	}
+}
+
+// add counts one request for the key hashed to h and returns its new
+// estimate.
+func (p *popularityStats) add(h uint64) uint32 {
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	est := ^uint32(0)
+	for i := range p.sketch {
+		est = min(est, p.sketch[i][(h1+uint32(i)*h2)%sketchWidth].Add(1))
+	}
+	return est
+}
+
+func (p *popularityStats) estimate(h uint64) uint32 {
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	est := ^uint32(0)
+	for i := range p.sketch {
+		est = min(est, p.sketch[i][(h1+uint32(i)*h2)%sketchWidth].Load())
+	}
+	return est
+}
+
+func (p *popularityStats) addSample(h uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	mask := p.sampleMask.Load()
+	if h&mask != 0 {
+		return
+	}
+	p.sample[h] = struct{}{}
+	for len(p.sample) > maxSampledKeys {
+		mask = mask<<1 | 1
+		for k := range p.sample {
+			if k&mask != 0 {
+				delete(p.sample, k)
+			}
+		}
+	}
+	p.sampleMask.Store(mask)
+}
+
+// loop recomputes the decile boundaries every second and ages the sketch
+// every window.
+func (p *popularityStats) loop() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	lastAged := time.Now()
+	for now := range tick.C {
+		if now.Sub(lastAged) >= p.window {
+			p.age()
+			lastAged = now
+		}
+		p.updateBounds()
+	}
+}
+
+// age halves every counter and forgets sampled keys that faded out.
+func (p *popularityStats) age() {
+	for i := range p.sketch {
+		for j := range p.sketch[i] {
+			c := &p.sketch[i][j]
+			for {
+				v := c.Load()
+				if v == 0 || c.CompareAndSwap(v, v/2) {
+					break
+				}
+			}
+		}
+	}
+	p.mu.Lock()
+	for k := range p.sample {
+		if p.estimate(k) == 0 {
+			delete(p.sample, k)
+		}
+	}
+	p.mu.Unlock()
+}
+
+func (p *popularityStats) updateBounds() {
+	p.mu.Lock()
+	counts := make([]uint32, 0, len(p.sample))
+	for k := range p.sample {
+		counts = append(counts, p.estimate(k))
+	}
+	p.mu.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] > counts[j] })
+	for d := range p.bounds {
+		rank := (len(counts)*(d+1) + 9) / 10
+		p.bounds[d].Store(counts[max(rank-1, 0)])
+	}
+}
+
+func (p *popularityStats) stats() *popularityResponse {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	sampled := len(p.sample)
+	p.mu.Unlock()
+	out := &popularityResponse{WindowSeconds: p.window.Seconds(), SampledKeys: sampled, Deciles: make([]decileStats, 10)}
+	for d := range out.Deciles {
+		ds := decileStats{Decile: d + 1, Hits: p.hits[d].Load(), Misses: p.misses[d].Load()}
+		if d < len(p.bounds) {
+			ds.MinRequests = p.bounds[d].Load()
+		}
+		if total := ds.Hits + ds.Misses; total > 0 {
+			ds.HitRate = float64(ds.Hits) / float64(total) * 100
+		}
+		out.Deciles[d] = ds
+	}
+	return out
+}
+
+func (p *popularityStats) writeMetrics(w http.ResponseWriter) {
+	if p == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP kv_cache_decile_requests_total Read-through cache lookups by key popularity decile (1 = most requested).")
+	fmt.Fprintln(w, "# TYPE kv_cache_decile_requests_total counter")
+	for d := range p.hits {
+		fmt.Fprintf(w, "kv_cache_decile_requests_total{decile=\"%d\",result=\"hit\"} %d\n", d+1, p.hits[d].Load())
+		fmt.Fprintf(w, "kv_cache_decile_requests_total{decile=\"%d\",result=\"miss\"} %d\n", d+1, p.misses[d].Load())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math/rand/v2"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countGets requests key-i i+1 times for i below n, so popularity rises
+// with i.
+func countGets(p *popularityStats, n int) {
+	for i := range n {
+		for range i + 1 {
+			p.recordGet(fmt.Sprintf("key-%d", i), false)
+		}
+	}
+}
+
+func TestPopularityDeciles(t *testing.T) {
+	p := newPopularityStats(time.Minute)
+	countGets(p, 100)
+	p.updateBounds()
+
+	// Decile 1 starts at the tenth most requested key, key-90 with 91.
+	if got := p.bounds[0].Load(); got != 91 {
+		t.Fatalf("decile 1 starts at %d requests, want 91", got)
+	}
+	hits, misses := p.hits[0].Load(), p.misses[9].Load()
+	p.recordGet("key-99", true)
+	p.recordGet("key-0", false)
+	if p.hits[0].Load() != hits+1 {
+		t.Errorf("hit on the most requested key not counted in decile 1: %+v", p.stats().Deciles[0])
+	}
+	if p.misses[9].Load() != misses+1 {
+		t.Errorf("miss on the least requested key not counted in decile 10: %+v", p.stats().Deciles[9])
+	}
+}
+
+func TestPopularityAgeing(t *testing.T) {
+	p := newPopularityStats(time.Minute)
+	for range 10 {
+		p.recordGet("hot", true)
+	}
+	p.recordGet("once", true)
+	if got := len(p.sample); got != 2 {
+		t.Fatalf("%d keys sampled, want 2", got)
+	}
+	p.age()
+	if got := p.estimate(maphash.String(p.seed, "hot")); got != 5 {
+		t.Errorf("hot key estimated at %d after ageing, want 5", got)
+	}
+	// A key halved to nothing leaves the sample.
+	if got := len(p.sample); got != 1 {
+		t.Errorf("%d keys sampled after ageing, want 1", got)
+	}
+}
+
+func TestPopularitySampleBounded(t *testing.T) {
+	p := newPopularityStats(time.Minute)
+	for i := range 4 * maxSampledKeys {
+		p.recordGet(fmt.Sprintf("key-%d", i), false)
+	}
+	if n := len(p.sample); n > maxSampledKeys || n < maxSampledKeys/4 {
+		t.Errorf("%d keys sampled out of %d, want at most %d and a fair share", n, 4*maxSampledKeys, maxSampledKeys)
+	}
+}
+
+// BenchmarkDecileGet measures a cache hit with and without the decile
+// bookkeeping handleGet adds; the difference is the overhead per Get,
+// which should stay under 100ns.
+func BenchmarkDecileGet(b *testing.B) {
+	for _, on := range []bool{false, true} {
+		b.Run(fmt.Sprintf("deciles=%t", on), func(b *testing.B) {
+			c := NewShardedCache(benchCacheSize, 16)
+			keys := benchKeys(10_000)
+			for _, k := range keys {
+				c.Set(k, "value-"+k)
+			}
+			var p *popularityStats
+			if on {
+				p = newPopularityStats(time.Minute)
+				countGets(p, 1000)
+				p.updateBounds()
+			}
+			var seed atomic.Uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewPCG(seed.Add(1), 0))
+				zipf := rand.NewZipf(rng, 1.1, 1, uint64(len(keys)-1))
+				for pb.Next() {
+					k := keys[zipf.Uint64()]
+					_, ok := c.Get(k)
+					p.recordGet(k, ok)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofOnlyOnPrivateListener(t *testing.T) {
+	private := httptest.NewServer(pprofMux())
+	defer private.Close()
+	public := httptest.NewServer(newTestServer(NewMemStore()).routes())
+	defer public.Close()
+
+	status, body, _ := do(t, "GET", private.URL+"/debug/pprof/heap?debug=1", "")
+	if status != http.StatusOK || len(body) == 0 {
+		t.Fatalf("heap profile from the private listener: status %d, %d bytes", status, len(body))
+	}
+	for _, path := range []string{"/debug/pprof/heap", "/debug/pprof/"} {
+		if status, _, _ := do(t, "GET", public.URL+path, ""); status != http.StatusNotFound {
+			t.Errorf("GET %s on the public listener: status %d, want 404", path, status)
+		}
+	}
+}
+
+func TestStatsRuntime(t *testing.T) {
+	ts := httptest.NewServer(newTestServer(NewMemStore()).routes())
+	defer ts.Close()
+	_, body, _ := do(t, "GET", ts.URL+"/stats", "")
+	var st struct {
+		Runtime runtimeStats `json:"runtime"`
+	}
+	if err := json.Unmarshal([]byte(body), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Runtime.Goroutines == 0 || st.Runtime.HeapInuseBytes == 0 {
+		t.Errorf("/stats runtime = %+v, want goroutines and heap in use", st.Runtime)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// prefixStats counts read-through cache traffic for a fixed set of key
+// prefixes, e.g. one per tenant. Only configured prefixes are tracked so
+// arbitrary keys cannot grow the counters.
+type prefixStats struct {
+	prefixes []string
+	counters []prefixCounters
+}
+
+type prefixCounters struct {
+	hits   int64
+	misses int64
+	puts   int64
+}
+
+type prefixStatsResponse struct {
+	Prefix      string  `json:"prefix"`
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	HitRate     float64 `json:"hit_rate"`
+	Puts        int64   `json:"puts"`
+	CachedKeys  int     `json:"cached_keys"`
+	CachedBytes int64   `json:"cached_bytes"`
+}
+
+func parsePrefixStats(spec string) *prefixStats {
+	p := &prefixStats{}
+	for _, prefix := range strings.Split(spec, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			p.prefixes = append(p.prefixes, prefix)
+		}
+	}
+	if len(p.prefixes) == 0 {
+		return nil
+	}
+	p.counters = make([]prefixCounters, len(p.prefixes))
+	return p
+}
+
+// match returns the counters of the longest configured prefix of key.
+func (p *prefixStats) match(key string) *prefixCounters {
+	if p == nil {
+		return nil
+	}
+	best := -1
+	for i, prefix := range p.prefixes {
+		if strings.HasPrefix(key, prefix) && (best < 0 || len(prefix) > len(p.prefixes[best])) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	return &p.counters[best]
+}
+
+func (p *prefixStats) recordGet(key string, hit bool) {
+	c := p.match(key)
+	switch {
+	case c == nil:
+	case hit:
+		atomic.AddInt64(&c.hits, 1)
+	default:
+		atomic.AddInt64(&c.misses, 1)
+	}
+}
+
+func (p *prefixStats) recordPut(key string) {
+	if c := p.match(key); c != nil {
+		atomic.AddInt64(&c.puts, 1)
+	}
+}
+
+// stats reports the counters together with how much of cache each prefix
+// currently occupies.
+func (p *prefixStats) stats(cache *Cache) []prefixStatsResponse {
+	if p == nil {
+		return nil
+	}
+	out := make([]prefixStatsResponse, len(p.prefixes))
+	index := make(map[*prefixCounters]int, len(p.prefixes))
+	for i, prefix := range p.prefixes {
+		c := &p.counters[i]
+		index[c] = i
+		out[i] = prefixStatsResponse{
+			Prefix: prefix,
+			Hits:   atomic.LoadInt64(&c.hits),
+			Misses: atomic.LoadInt64(&c.misses),
+			Puts:   atomic.LoadInt64(&c.puts),
+		}
+		if total := out[i].Hits + out[i].Misses; total > 0 {
+			out[i].HitRate = float64(out[i].Hits) / float64(total) * 100
+		}
+	}
+	cache.each(func(key string, e cacheEntry) {
+		if c := p.match(key); c != nil && e.tombstone == "" {
+			out[index[c]].CachedKeys++
+			out[index[c]].CachedBytes += int64(len(e.value))
+		}
+	})
+	return out
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The pressure monitor samples the read-through cache's fill every
+// pressureInterval and works out its eviction rates over the last
+// pressureRateSlots samples.
+const (
+	pressureInterval  = time.Second
+	pressureRateSlots = 10
+)
+
+// cachePressure warns before the cache fills. The cache is bounded by
+// entries, not bytes, so its fill is the unpinned entries over the entry
+// limit, which is what starts capacity evictions; bytes are reported
+// alongside. Each threshold is crossed upwards when the fill reaches it and
+// back once it drops hysteresis points below, so a fill hovering at a
+// threshold does not flap.
+type cachePressure struct {
+	cache      *Cache
+	hysteresis float64
+
+	mu         sync.Mutex
+	thresholds []pressureThreshold
+	fill       float64
+	entries    int
+	bytes      int64
+	// samples are the capacity evictions and their bytes so far at the
+	// last pressureRateSlots+1 samples, oldest first.
+	samples []pressureSample
+}
+
+type pressureThreshold struct {
+	pct       float64
+	above     bool
+	since     time.Time
+	crossings int64
+	// spent is the time above the threshold before since.
+	spent time.Duration
+}
+
+type pressureSample struct {
+	at           time.Time
+	evictions    int64
+	evictedBytes int64
+}
+
+type cachePressureStats struct {
+	FillPct       float64 `json:"fill_pct"`
+	Entries       int     `json:"entries"`
+	MaxEntries    int     `json:"max_entries"`
+	Bytes         int64   `json:"bytes"`
+	HysteresisPct float64 `json:"hysteresis_pct"`
+	// The rates count capacity evictions over the last RateWindowSeconds.
+	RateWindowSeconds     float64                  `json:"rate_window_seconds"`
+	EvictionsPerSecond    float64                  `json:"evictions_per_second"`
+	EvictedBytesPerSecond float64                  `json:"evicted_bytes_per_second"`
+	Thresholds            []pressureThresholdStats `json:"thresholds"`
+}
+
+type pressureThresholdStats struct {
+	ThresholdPct float64    `json:"threshold_pct"`
+	Above        bool       `json:"above"`
+	AboveSince   *time.Time `json:"above_since,omitempty"`
+	Crossings    int64      `json:"crossings"`
+	// SecondsAbove includes the current stretch.
+	SecondsAbove float64 `json:"seconds_above"`
+}
+
+// parsePressureThresholds parses -cache-pressure-thresholds, percentages
+// separated by commas, into ascending order.
+func parsePressureThresholds(spec string) ([]float64, error) {
+	var out []float64
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSuffix(strings.TrimSpace(part), "%")
+		if part == "" {
+			continue
+		}
+		pct, err := strconv.ParseFloat(part, 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return nil, fmt.Errorf("bad -cache-pressure-thresholds entry %q (want a percentage above 0 and at most 100)", part)
+		}
+		out = append(out, pct)
+	}
+	sort.Float64s(out)
+	return out, nil
+}
+
+func newCachePressure(cache *Cache, thresholds []float64, hysteresis float64) *cachePressure {
+	if len(thresholds) == 0 {
+		return nil
+	}
+	p := &cachePressure{cache: cache, hysteresis: hysteresis}
+	for _, pct := range thresholds {
+		p.thresholds = append(p.thresholds, pressureThreshold{pct: pct})
+	}
+	return p
+}
+
+func (p *cachePressure) loop() {
+	for now := range time.Tick(pressureInterval) {
+		entries, maxEntries := p.cache.unpinnedLen(), p.cache.MaxSize()
+		p.observe(now, entries, maxEntries, p.cache.Bytes(),
+			atomic.LoadInt64(&p.cache.evictions[EvictCapacity]), atomic.LoadInt64(&p.cache.evictedBytes[EvictCapacity]))
+	}
+}
+
+// observe records a sample taken at now, logs every threshold it crosses
+// and returns how many it crossed.
+func (p *cachePressure) observe(now time.Time, entries, maxEntries int, bytes, evictions, evictedBytes int64) int {
+	fill := 100.0
+	if maxEntries > 0 {
+		fill = float64(entries) / float64(maxEntries) * 100
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fill, p.entries, p.bytes = fill, entries, bytes
+	p.samples = append(p.samples, pressureSample{at: now, evictions: evictions, evictedBytes: evictedBytes})
+	if len(p.samples) > pressureRateSlots+1 {
+		p.samples = p.samples[1:]
+	}
+	crossed := 0
+	for i := range p.thresholds {
+		t := &p.thresholds[i]
+		switch {
+		case !t.above && fill >= t.pct:
+			t.above, t.since = true, now
+			t.crossings++
+		case t.above && fill < t.pct-p.hysteresis:
+			t.above = false
+			t.spent += now.Sub(t.since)
+		default:
+			continue
+		}
+		crossed++
+		p.logCrossing(t, now, maxEntries)
+	}
+	return crossed
+}
+
+// logCrossing must be called with mu held, after t's state changed.
+func (p *cachePressure) logCrossing(t *pressureThreshold, now time.Time, maxEntries int) {
+	evictions, evictedBytes, _ := p.rates()
+	if t.above {
+		log.Printf("Cache above %g%% of capacity: fill=%.1f%% entries=%d max_entries=%d bytes=%d evictions_per_sec=%.1f evicted_bytes_per_sec=%.0f",
+			t.pct, p.fill, p.entries, maxEntries, p.bytes, evictions, evictedBytes)
+		return
+	}
+	log.Printf("Cache back below %g%% of capacity after %s: fill=%.1f%% entries=%d max_entries=%d bytes=%d evictions_per_sec=%.1f evicted_bytes_per_sec=%.0f",
+		t.pct, now.Sub(t.since).Round(time.Second), p.fill, p.entries, maxEntries, p.bytes, evictions, evictedBytes)
+}
+
+// rates must be called with mu held. They are zero until two samples are
+// in.
+func (p *cachePressure) rates() (evictions, evictedBytes float64, window time.Duration) {
+	if len(p.samples) < 2 {
+		return 0, 0, 0
+	}
+	first, last := p.samples[0], p.samples[len(p.samples)-1]
+	window = last.at.Sub(first.at)
+	if window <= 0 {
+		return 0, 0, 0
+	}
+	return float64(last.evictions-first.evictions) / window.Seconds(),
+		float64(last.evictedBytes-first.evictedBytes) / window.Seconds(), window
+}
+
+// timeAbove is how long t has been above its threshold in all, as of now.
+func (t *pressureThreshold) timeAbove(now time.Time) time.Duration {
+	if t.above {
+		return t.spent + now.Sub(t.since)
+	}
+	return t.spent
+}
+
+func (p *cachePressure) stats() *cachePressureStats {
+	if p == nil {
+		return nil
+	}
+	return p.statsAt(time.Now())
+}
+
+func (p *cachePressure) statsAt(now time.Time) *cachePressureStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	evictions, evictedBytes, window := p.rates()
+	st := &cachePressureStats{
+		FillPct:               p.fill,
+		Entries:               p.entries,
+		MaxEntries:            p.cache.MaxSize(),
+		Bytes:                 p.bytes,
+		HysteresisPct:         p.hysteresis,
+		RateWindowSeconds:     window.Seconds(),
+		EvictionsPerSecond:    evictions,
+		EvictedBytesPerSecond: evictedBytes,
+		Thresholds:            make([]pressureThresholdStats, len(p.thresholds)),
+	}
+	for i := range p.thresholds {
+		t := &p.thresholds[i]
+		ts := pressureThresholdStats{ThresholdPct: t.pct, Above: t.above, Crossings: t.crossings, SecondsAbove: t.timeAbove(now).Seconds()}
+		if t.above {
+			since := t.since
+			ts.AboveSince = &since
+		}
+		st.Thresholds[i] = ts
+	}
+	return st
+}
+
+func (p *cachePressure) writeMetrics(w http.ResponseWriter) {
+	if p == nil {
+		return
+	}
+	st := p.stats()
+	fmt.Fprintln(w, "# HELP kv_cache_fill_ratio Unpinned read-through cache entries over the entry limit, as last sampled.")
+	fmt.Fprintln(w, "# TYPE kv_cache_fill_ratio gauge")
+	fmt.Fprintf(w, "kv_cache_fill_ratio %g\n", st.FillPct/100)
+	fmt.Fprintln(w, "# HELP kv_cache_pressure_above Whether the cache fill is above the threshold (percent), with hysteresis.")
+	fmt.Fprintln(w, "# TYPE kv_cache_pressure_above gauge")
+	for _, t := range st.Thresholds {
+		above := 0
+		if t.Above {
+			above = 1
+		}
+		fmt.Fprintf(w, "kv_cache_pressure_above{threshold=\"%g\"} %d\n", t.ThresholdPct, above)
+	}
+	fmt.Fprintln(w, "# HELP kv_cache_pressure_seconds_total Time the cache fill spent above the threshold (percent).")
+	fmt.Fprintln(w, "# TYPE kv_cache_pressure_seconds_total counter")
+	for _, t := range st.Thresholds {
+		fmt.Fprintf(w, "kv_cache_pressure_seconds_total{threshold=\"%g\"} %g\n", t.ThresholdPct, t.SecondsAbove)
+	}
+	fmt.Fprintln(w, "# HELP kv_cache_capacity_evictions_per_second Read-through cache evictions for space per second, over the last 10s.")
+	fmt.Fprintln(w, "# TYPE kv_cache_capacity_evictions_per_second gauge")
+	fmt.Fprintf(w, "kv_cache_capacity_evictions_per_second %g\n", st.EvictionsPerSecond)
+	fmt.Fprintln(w, "# HELP kv_cache_evicted_bytes_per_second Value bytes of read-through cache evictions for space per second, over the last 10s.")
+	fmt.Fprintln(w, "# TYPE kv_cache_evicted_bytes_per_second gauge")
+	fmt.Fprintf(w, "kv_cache_evicted_bytes_per_second %g\n", st.EvictedBytesPerSecond)
+}
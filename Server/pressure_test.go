@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParsePressureThresholds(t *testing.T) {
+	got, err := parsePressureThresholds(" 95, 80% ,")
+	if err != nil || !slices.Equal(got, []float64{80, 95}) {
+		t.Errorf("parse = %v, %v; want [80 95]", got, err)
+	}
+	if got, err := parsePressureThresholds(""); err != nil || newCachePressure(NewCache(10), got, 5) != nil {
+		t.Errorf("empty thresholds: %v, %v; want the monitor off", got, err)
+	}
+	for _, bad := range []string{"0", "101", "-5", "eighty", "80,x"} {
+		if _, err := parsePressureThresholds(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+// TestPressureHysteresis walks the fill of a 100-entry cache up through
+// both thresholds and back down, one sample a second, and checks when each
+// threshold is crossed and how long it counts as above.
+func TestPressureHysteresis(t *testing.T) {
+	p := newCachePressure(NewCache(100), []float64{80, 95}, 5)
+	clock := &fakeClock{time.Unix(1_000_000, 0)}
+	steps := []struct {
+		fill    int
+		crossed int
+		above   [2]bool
+	}{
+		{50, 0, [2]bool{false, false}},
+		{80, 1, [2]bool{true, false}},
+		{96, 1, [2]bool{true, true}},
+		// Within 5 points of 95 the fill is still above it.
+		{91, 0, [2]bool{true, true}},
+		{96, 0, [2]bool{true, true}},
+		{89, 1, [2]bool{true, false}},
+		{76, 0, [2]bool{true, false}},
+		{95, 1, [2]bool{true, true}},
+		{74, 2, [2]bool{false, false}},
+		{79, 0, [2]bool{false, false}},
+	}
+	for i, st := range steps {
+		clock.advance(time.Second)
+		if n := p.observe(clock.now(), st.fill, 100, 0, 0, 0); n != st.crossed {
+			t.Fatalf("step %d (fill %d): %d crossings, want %d", i, st.fill, n, st.crossed)
+		}
+		stats := p.statsAt(clock.now())
+		for j, th := range stats.Thresholds {
+			if th.Above != st.above[j] || (th.AboveSince != nil) != th.Above {
+				t.Fatalf("step %d (fill %d): %g%% above %v since %v, want above %v", i, st.fill, th.ThresholdPct, th.Above, th.AboveSince, st.above[j])
+			}
+		}
+	}
+
+	// 80% was above from step 1 to step 8, 95% from 2 to 5 and 7 to 8.
+	stats := p.statsAt(clock.now().Add(time.Minute))
+	for i, want := range []struct {
+		crossings int64
+		seconds   float64
+	}{{1, 7}, {2, 4}} {
+		if th := stats.Thresholds[i]; th.Crossings != want.crossings || th.SecondsAbove != want.seconds {
+			t.Errorf("%g%%: %d crossings, %gs above; want %d, %gs", th.ThresholdPct, th.Crossings, th.SecondsAbove, want.crossings, want.seconds)
+		}
+	}
+
+	// The current stretch counts as of the time asked.
+	clock.advance(time.Second)
+	p.observe(clock.now(), 100, 100, 0, 0, 0)
+	if th := p.statsAt(clock.now().Add(30 * time.Second)).Thresholds[0]; th.SecondsAbove != 37 {
+		t.Errorf("80%% above for %gs including the current 30s, want 37s", th.SecondsAbove)
+	}
+}
+
+func TestPressureEvictionRates(t *testing.T) {
+	p := newCachePressure(NewCache(100), []float64{80}, 5)
+	clock := &fakeClock{time.Unix(1_000_000, 0)}
+	p.observe(clock.now(), 100, 100, 0, 0, 0)
+	if st := p.statsAt(clock.now()); st.EvictionsPerSecond != 0 || st.RateWindowSeconds != 0 {
+		t.Errorf("rates from one sample: %+v", st)
+	}
+	// 50 evictions a second for 5s, then 10 a second: the rates cover the
+	// last 10 samples only.
+	var evictions int64
+	for i := range 15 {
+		clock.advance(time.Second)
+		if i < 5 {
+			evictions += 50
+		} else {
+			evictions += 10
+		}
+		p.observe(clock.now(), 100, 100, 0, evictions, evictions*100)
+	}
+	st := p.statsAt(clock.now())
+	if st.RateWindowSeconds != 10 || st.EvictionsPerSecond != 10 || st.EvictedBytesPerSecond != 1000 {
+		t.Errorf("rates %g evictions/s, %g bytes/s over %gs; want 10, 1000 over 10s", st.EvictionsPerSecond, st.EvictedBytesPerSecond, st.RateWindowSeconds)
+	}
+}
+
+func TestPressureFromCache(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	s.cache = NewCache(4)
+	s.pressure = newCachePressure(s.cache, []float64{50, 100}, 10)
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	for i := range 6 {
+		s.cache.Set(fmt.Sprint("k", i), strings.Repeat("v", 10))
+	}
+	if got := atomic.LoadInt64(&s.cache.evictedBytes[EvictCapacity]); got != 20 {
+		t.Errorf("%d bytes evicted for capacity, want the 20 of two values", got)
+	}
+
+	p := s.pressure
+	p.observe(time.Now(), s.cache.unpinnedLen(), s.cache.MaxSize(), s.cache.Bytes(),
+		atomic.LoadInt64(&s.cache.evictions[EvictCapacity]), atomic.LoadInt64(&s.cache.evictedBytes[EvictCapacity]))
+	if st := s.stats().Pressure; st == nil || st.FillPct != 100 || st.Entries != 4 || !st.Thresholds[1].Above {
+		t.Fatalf("/stats cache_pressure = %+v, want a full cache above both thresholds", st)
+	}
+	_, metrics, _ := do(t, "GET", ts.URL+"/metrics", "")
+	for _, want := range []string{
+		"kv_cache_fill_ratio 1\n",
+		`kv_cache_pressure_above{threshold="50"} 1` + "\n",
+		`kv_cache_pressure_above{threshold="100"} 1` + "\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("/metrics lacks %q", want)
+		}
+	}
+	if newTestServer(NewMemStore()).stats().Pressure != nil {
+		t.Error("cache_pressure reported without thresholds")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPurgeBatch = 1000
+	maxPurgeBatch     = 10000
+	defaultPurgeJobs  = 4
+	maxPurgeJobs      = 16
+)
+
+// purgeRequest is the body of POST /admin/purge. OlderThan is a Go
+// duration string.
+type purgeRequest struct {
+	Prefix      string `json:"prefix"`
+	OlderThan   string `json:"older_than"`
+	DryRun      bool   `json:"dry_run"`
+	Batch       int    `json:"batch"`
+	Parallelism int    `json:"parallelism"`
+}
+
+// purgeProgress is one line of the purge stream: one per batch, then a
+// final one with Done or Error set.
+type purgeProgress struct {
+	Batch        int    `json:"batch,omitempty"`
+	Deleted      int    `json:"deleted"`
+	TotalDeleted int64  `json:"total_deleted"`
+	DryRun       bool   `json:"dry_run,omitempty"`
+	Matched      *int64 `json:"matched,omitempty"`
+	Done         bool   `json:"done,omitempty"`
+	ElapsedMs    int64  `json:"elapsed_ms"`
+	Error        string `json:"error,omitempty"`
+}
+
+// purgeHandler serves POST /admin/purge, which deletes every row under a
+// prefix created more than older_than ago, live or not, and drops the keys
+// from the read-through cache. parallelism workers delete batches of batch
+// rows, each its own transaction, streaming a JSON line per batch. A
+// cancelled purge can simply be run again; with dry_run it only counts.
+func (s *Server) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if !s.checkWrite(w, r) {
+		return
+	}
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	f := PurgeFilter{Prefix: req.Prefix}
+	if req.OlderThan != "" {
+		d, err := time.ParseDuration(req.OlderThan)
+		if err != nil || d <= 0 {
+			http.Error(w, "older_than must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		f.OlderThan = d
+	}
+	if f.Prefix == "" && f.OlderThan == 0 {
+		http.Error(w, "Refusing to purge every key: set a prefix, older_than, or both", http.StatusBadRequest)
+		return
+	}
+	if req.Batch == 0 {
+		req.Batch = defaultPurgeBatch
+	}
+	if req.Parallelism == 0 {
+		req.Parallelism = defaultPurgeJobs
+	}
+	if req.Batch < 0 || req.Batch > maxPurgeBatch || req.Parallelism < 0 || req.Parallelism > maxPurgeJobs {
+		http.Error(w, "batch must be between 1 and 10000 and parallelism between 1 and 16", http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	var mu sync.Mutex
+	final := s.purge(r.Context(), f, req, func(p purgeProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(p)
+		rc.Flush()
+	})
+	enc.Encode(final)
+}
+
+// purge runs the purge or, with req.DryRun, counts what it would delete.
+// progress is called once per batch, from the worker that deleted it.
+func (s *Server) purge(ctx context.Context, f PurgeFilter, req purgeRequest, progress func(purgeProgress)) purgeProgress {
+	start := time.Now()
+	if req.DryRun {
+		n, err := s.store.CountPurge(ctx, f)
+		res := purgeProgress{DryRun: true, Matched: &n, Done: err == nil, ElapsedMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		return res
+	}
+
+	var mu sync.Mutex
+	var batches int
+	var total int64
+	var firstErr error
+	var wg sync.WaitGroup
+	for range req.Parallelism {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A short batch means every matching row left is locked by
+			// another worker, which will delete it.
+			for n := req.Batch; n == req.Batch && ctx.Err() == nil; {
+				keys, err := s.store.PurgeBatch(ctx, f, req.Batch)
+				for _, k := range keys {
+					s.cache.Delete(k)
+				}
+				n = len(keys)
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				if n == 0 {
+					mu.Unlock()
+					return
+				}
+				batches++
+				total += int64(n)
+				p := purgeProgress{Batch: batches, Deleted: n, TotalDeleted: total, ElapsedMs: time.Since(start).Milliseconds()}
+				mu.Unlock()
+				progress(p)
+			}
+		}()
+	}
+	wg.Wait()
+
+	res := purgeProgress{TotalDeleted: total, ElapsedMs: time.Since(start).Milliseconds()}
+	switch {
+	case firstErr != nil:
+		res.Error = firstErr.Error()
+	case ctx.Err() != nil:
+		res.Error = "cancelled"
+	default:
+		res.Done = true
+	}
+	if s.quota != nil && total > 0 {
+		if err := s.quota.refresh(context.Background()); err != nil {
+			log.Printf("Failed to refresh storage usage after a purge: %v", err)
+		}
+	}
+	log.Printf("Purged %d keys under %q older than %s in %d batches in %s", total, f.Prefix, f.OlderThan, batches, time.Since(start).Round(time.Millisecond))
+	return res
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ageCreated moves key's creation back by d.
+func ageCreated(m *MemStore, key string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.items[key]
+	e.createdAt = e.createdAt.Add(-d)
+	m.items[key] = e
+}
+
+// runPurge posts a purge with the admin token and returns its progress
+// lines, the final one last.
+func runPurge(t *testing.T, url, body string) []purgeProgress {
+	t.Helper()
+	status, resp, _ := admin(t, "POST", url, body)
+	if status != http.StatusOK {
+		t.Fatalf("POST %s %s: status %d (%s)", url, body, status, resp)
+	}
+	var lines []purgeProgress
+	dec := json.NewDecoder(strings.NewReader(resp))
+	for dec.More() {
+		var p purgeProgress
+		if err := dec.Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, p)
+	}
+	return lines
+}
+
+// purgeTestStore holds 100 junk- keys a day old, one of them
+// soft-deleted, 10 fresh junk- keys and 20 day-old keep- keys.
+func purgeTestStore() *MemStore {
+	m := NewMemStore()
+	ctx := context.Background()
+	for i := range 100 {
+		k := fmt.Sprintf("junk-%03d", i)
+		m.Put(ctx, k, "v")
+		ageCreated(m, k, 48*time.Hour)
+	}
+	m.SoftDelete(ctx, "junk-000")
+	for i := range 10 {
+		m.Put(ctx, fmt.Sprintf("junk-new-%d", i), "v")
+	}
+	for i := range 20 {
+		k := fmt.Sprintf("keep-%02d", i)
+		m.Put(ctx, k, "v")
+		ageCreated(m, k, 48*time.Hour)
+	}
+	return m
+}
+
+func TestPurgeDryRunMatchesDeletions(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		want   int64
+	}{
+		{`"prefix":"junk-","older_than":"24h"`, 100},
+		{`"prefix":"junk-"`, 110},
+		{`"older_than":"24h"`, 120},
+		{`"prefix":"junk-new-","older_than":"24h"`, 0},
+	} {
+		t.Run(tc.filter, func(t *testing.T) {
+			store := purgeTestStore()
+			s := newTestServer(store)
+			s.adminToken = testAdminToken
+			ts := httptest.NewServer(s.routes())
+			defer ts.Close()
+			for _, k := range []string{"junk-001", "junk-new-1", "keep-01"} {
+				do(t, "GET", ts.URL+"/kv/"+k, "")
+			}
+			before, _ := store.CountPurge(context.Background(), PurgeFilter{})
+
+			dry := runPurge(t, ts.URL+"/admin/purge", `{`+tc.filter+`,"dry_run":true}`)
+			if len(dry) != 1 || !dry[0].Done || dry[0].Matched == nil || *dry[0].Matched != tc.want {
+				t.Fatalf("dry run = %+v, want %d matched", dry, tc.want)
+			}
+			if n, _ := store.CountPurge(context.Background(), PurgeFilter{}); n != before {
+				t.Fatalf("dry run left %d rows of %d", n, before)
+			}
+
+			lines := runPurge(t, ts.URL+"/admin/purge", `{`+tc.filter+`,"batch":7,"parallelism":3}`)
+			final := lines[len(lines)-1]
+			var sum int64
+			for _, p := range lines[:len(lines)-1] {
+				if p.Deleted == 0 || p.Deleted > 7 {
+					t.Errorf("batch line %+v, want 1 to 7 rows", p)
+				}
+				sum += int64(p.Deleted)
+			}
+			if !final.Done || final.TotalDeleted != tc.want || sum != tc.want {
+				t.Fatalf("purge = %+v with batches summing to %d, want the %d the dry run counted", final, sum, tc.want)
+			}
+			if n, _ := store.CountPurge(context.Background(), PurgeFilter{}); n != before-tc.want {
+				t.Errorf("%d rows left of %d, want %d", n, before, before-tc.want)
+			}
+
+			// Purged keys are gone from the cache too; the rest still read.
+			for _, k := range []string{"junk-001", "junk-new-1", "keep-01"} {
+				status, _, _ := do(t, "GET", ts.URL+"/kv/"+k, "")
+				_, cached := s.cache.Peek(k)
+				if purged := status == http.StatusNotFound; purged == cached {
+					t.Errorf("GET %s: status %d, cached %v", k, status, cached)
+				}
+			}
+
+			// Running it again is harmless.
+			if again := runPurge(t, ts.URL+"/admin/purge", `{`+tc.filter+`}`); len(again) != 1 || again[0].TotalDeleted != 0 || !again[0].Done {
+				t.Errorf("second purge = %+v, want nothing left to delete", again)
+			}
+		})
+	}
+}
+
+func TestPurgeRefusals(t *testing.T) {
+	s := newTestServer(purgeTestStore())
+	s.adminToken = testAdminToken
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	for _, body := range []string{
+		`{}`, `{"dry_run":true}`, `{"prefix":"","older_than":""}`,
+		`{"prefix":"junk-","older_than":"-1h"}`, `{"prefix":"junk-","older_than":"soon"}`,
+		`{"prefix":"junk-","batch":10001}`, `{"prefix":"junk-","parallelism":17}`, `not json`,
+	} {
+		if status, _, _ := admin(t, "POST", ts.URL+"/admin/purge", body); status != http.StatusBadRequest {
+			t.Errorf("POST /admin/purge %s: status %d, want 400", body, status)
+		}
+	}
+	if status, _, _ := do(t, "POST", ts.URL+"/admin/purge", `{"prefix":"junk-"}`); status != http.StatusUnauthorized {
+		t.Errorf("purge without the admin token: status %d, want 401", status)
+	}
+	if status, _, _ := admin(t, "GET", ts.URL+"/admin/purge", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/purge: status %d, want 405", status)
+	}
+	if n, _ := s.store.CountPurge(context.Background(), PurgeFilter{}); n != 130 {
+		t.Errorf("%d rows left after refused purges, want all 130", n)
+	}
+}
+
+func TestPurgeCancelAndResume(t *testing.T) {
+	store := purgeTestStore()
+	s := newTestServer(store)
+	f := PurgeFilter{Prefix: "junk-", OlderThan: 24 * time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	res := s.purge(ctx, f, purgeRequest{Batch: 10, Parallelism: 1}, func(purgeProgress) { cancel() })
+	if res.Done || res.Error != "cancelled" || res.TotalDeleted != 10 {
+		t.Fatalf("cancelled purge = %+v, want cancelled after one batch of 10", res)
+	}
+	if n, _ := store.CountPurge(context.Background(), f); n != 90 {
+		t.Fatalf("%d matching rows left, want 90", n)
+	}
+	res = s.purge(context.Background(), f, purgeRequest{Batch: 10, Parallelism: 4}, func(purgeProgress) {})
+	if !res.Done || res.TotalDeleted != 90 {
+		t.Errorf("resumed purge = %+v, want the other 90", res)
+	}
+}
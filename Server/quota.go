@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// storageQuota caps the bytes of values in the store, in total and
+// optionally per key prefix. Usage is tracked in memory from each write's
+// size, starting from and periodically reset to the store's own sum. A
+// write's previous size is only known when the key is cached, so the
+// tracked figure drifts between corrections; the quota is approximate.
+type storageQuota struct {
+	store    Store
+	total    quotaCounter
+	prefixes []string
+	limits   []quotaCounter
+
+	rejected    int64
+	corrections int64
+	lastDrift   int64
+	failed      int64
+}
+
+type quotaCounter struct {
+	max  int64
+	used int64
+}
+
+type quotaStats struct {
+	UsedBytes      int64              `json:"used_bytes"`
+	MaxBytes       int64              `json:"max_bytes,omitempty"`
+	UsedPct        float64            `json:"used_pct,omitempty"`
+	RejectedWrites int64              `json:"rejected_writes"`
+	Corrections    int64              `json:"corrections"`
+	LastDriftBytes int64              `json:"last_drift_bytes"`
+	Failed         int64              `json:"failed_corrections"`
+	Prefixes       []prefixQuotaStats `json:"prefixes,omitempty"`
+}
+
+type prefixQuotaStats struct {
+	Prefix    string  `json:"prefix"`
+	UsedBytes int64   `json:"used_bytes"`
+	MaxBytes  int64   `json:"max_bytes"`
+	UsedPct   float64 `json:"used_pct"`
+}
+
+// newStorageQuota reads the per-prefix quotas, one "prefix bytes" pair per
+// line, from path if it is set; maxTotal 0 leaves the total unlimited.
+func newStorageQuota(store Store, maxTotal int64, path string) (*storageQuota, error) {
+	q := &storageQuota{store: store, total: quotaCounter{max: maxTotal}}
+	if path == "" {
+		return q, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"prefix bytes\"", path, n)
+		}
+		limit, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("%s:%d: quota must be a positive number of bytes", path, n)
+		}
+		// The store's sums would count a key under every prefix of it.
+		for _, p := range q.prefixes {
+			if strings.HasPrefix(p, fields[0]) || strings.HasPrefix(fields[0], p) {
+				return nil, fmt.Errorf("%s:%d: prefix %q overlaps %q", path, n, fields[0], p)
+			}
+		}
+		q.prefixes = append(q.prefixes, fields[0])
+		q.limits = append(q.limits, quotaCounter{max: limit})
+	}
+	return q, sc.Err()
+}
+
+// match returns the index of the configured prefix of key, or -1.
+func (q *storageQuota) match(key string) int {
+	for i, prefix := range q.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+// exceeded names the quota that growing the data under key by delta bytes
+// would exceed, or returns "" if it fits. Writes that do not grow the data
+// are always let through, so keys can be shrunk or deleted at the limit.
+func (q *storageQuota) exceeded(key string, delta int64) string {
+	if q == nil || delta <= 0 {
+		return ""
+	}
+	if q.total.max > 0 && atomic.LoadInt64(&q.total.used)+delta > q.total.max {
+		return "-max-total-bytes"
+	}
+	if i := q.match(key); i >= 0 && atomic.LoadInt64(&q.limits[i].used)+delta > q.limits[i].max {
+		return fmt.Sprintf("for prefix %q", q.prefixes[i])
+	}
+	return ""
+}
+
+// exceededBatch is exceeded for an atomic batch writing entries over
+// values of old bytes (-1 if unknown). The growth is summed per prefix, so
+// each prefix's quota is checked against its own keys, and the total
+// against all of them.
+func (q *storageQuota) exceededBatch(entries []KeyValue, old []int64) string {
+	if q == nil {
+		return ""
+	}
+	var total int64
+	byPrefix := make([]int64, len(q.prefixes))
+	for i, e := range entries {
+		delta := int64(len(e.Value)) - max(old[i], 0)
+		total += delta
+		if p := q.match(e.Key); p >= 0 {
+			byPrefix[p] += delta
+		}
+	}
+	if total > 0 && q.total.max > 0 && atomic.LoadInt64(&q.total.used)+total > q.total.max {
+		return "-max-total-bytes"
+	}
+	for p, delta := range byPrefix {
+		if delta > 0 && atomic.LoadInt64(&q.limits[p].used)+delta > q.limits[p].max {
+			return fmt.Sprintf("for prefix %q", q.prefixes[p])
+		}
+	}
+	return ""
+}
+
+func (q *storageQuota) add(key string, delta int64) {
+	if q == nil || delta == 0 {
+		return
+	}
+	atomic.AddInt64(&q.total.used, delta)
+	if i := q.match(key); i >= 0 {
+		atomic.AddInt64(&q.limits[i].used, delta)
+	}
+}
+
+// written accounts for a write of size bytes over a value of old bytes,
+// where old is -1 when the previous size is unknown. An overwrite of an
+// unknown value is left for the next correction rather than guessed.
+func (q *storageQuota) written(key string, size, old int64, created bool) {
+	switch {
+	case created:
+		q.add(key, size)
+	case old >= 0:
+		q.add(key, size-old)
+	}
+}
+
+// refresh replaces the tracked usage with the store's sums. Writes that
+// land while the sums are taken are lost until the next refresh.
+func (q *storageQuota) refresh(ctx context.Context) error {
+	total, err := q.store.UsedBytes(ctx, "")
+	if err != nil {
+		return err
+	}
+	used := make([]int64, len(q.prefixes))
+	for i, prefix := range q.prefixes {
+		if used[i], err = q.store.UsedBytes(ctx, prefix); err != nil {
+			return err
+		}
+	}
+	old := atomic.SwapInt64(&q.total.used, total)
+	for i := range q.limits {
+		atomic.StoreInt64(&q.limits[i].used, used[i])
+	}
+	atomic.StoreInt64(&q.lastDrift, total-old)
+	atomic.AddInt64(&q.corrections, 1)
+	return nil
+}
+
+func (q *storageQuota) correctLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := q.refresh(context.Background()); err != nil {
+			atomic.AddInt64(&q.failed, 1)
+			log.Printf("Storage quota correction failed: %v", err)
+		}
+	}
+}
+
+func (q *storageQuota) stats() *quotaStats {
+	if q == nil {
+		return nil
+	}
+	st := &quotaStats{
+		UsedBytes:      atomic.LoadInt64(&q.total.used),
+		MaxBytes:       q.total.max,
+		RejectedWrites: atomic.LoadInt64(&q.rejected),
+		Corrections:    atomic.LoadInt64(&q.corrections),
+		LastDriftBytes: atomic.LoadInt64(&q.lastDrift),
+		Failed:         atomic.LoadInt64(&q.failed),
+	}
+	if st.MaxBytes > 0 {
+		st.UsedPct = float64(st.UsedBytes) / float64(st.MaxBytes) * 100
+	}
+	for i, prefix := range q.prefixes {
+		p := prefixQuotaStats{Prefix: prefix, UsedBytes: atomic.LoadInt64(&q.limits[i].used), MaxBytes: q.limits[i].max}
+		p.UsedPct = float64(p.UsedBytes) / float64(p.MaxBytes) * 100
+		st.Prefixes = append(st.Prefixes, p)
+	}
+	return st
+}
+
+// cachedSize is the size of key's current value if the cache holds it,
+// else -1.
+func (s *Server) cachedSize(key string) int64 {
+	if v, ok := s.cache.Peek(key); ok {
+		return int64(len(v))
+	}
+	return -1
+}
+
+// overQuota answers 507 if writing size bytes over a value of old bytes
+// (-1 if unknown) would exceed a storage quota.
+func (s *Server) overQuota(w http.ResponseWriter, key string, size, old int64) bool {
+	return s.quotaExhausted(w, s.quota.exceeded(key, size-max(old, 0)))
+}
+
+// overQuotaBatch is overQuota for a batch, which is admitted or rejected
+// as a whole.
+func (s *Server) overQuotaBatch(w http.ResponseWriter, entries []KeyValue, old []int64) bool {
+	return s.quotaExhausted(w, s.quota.exceededBatch(entries, old))
+}
+
+func (s *Server) quotaExhausted(w http.ResponseWriter, name string) bool {
+	if name == "" {
+		return false
+	}
+	atomic.AddInt64(&s.quota.rejected, 1)
+	http.Error(w, "Storage quota "+name+" exhausted", http.StatusInsufficientStorage)
+	return true
+}
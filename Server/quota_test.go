@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testQuota(total int64, prefixes map[string]int64) *storageQuota {
+	q := &storageQuota{store: NewMemStore(), total: quotaCounter{max: total}}
+	for p, limit := range prefixes {
+		q.prefixes = append(q.prefixes, p)
+		q.limits = append(q.limits, quotaCounter{max: limit})
+	}
+	return q
+}
+
+func TestExceededBatchChecksEachPrefix(t *testing.T) {
+	q := testQuota(0, map[string]int64{"a/": 10, "b/": 10})
+	unknown := []int64{-1, -1}
+
+	// 8 bytes under each prefix fit, although 16 would not fit either.
+	fits := []KeyValue{{Key: "a/1", Value: "aaaaaaaa"}, {Key: "b/1", Value: "bbbbbbbb"}}
+	if name := q.exceededBatch(fits, unknown); name != "" {
+		t.Fatalf("batch within both prefixes rejected by %s", name)
+	}
+	// The first key's prefix has room; the second's does not.
+	over := []KeyValue{{Key: "a/1", Value: "a"}, {Key: "b/1", Value: "bbbbbbbbbbbb"}}
+	if name := q.exceededBatch(over, unknown); !strings.Contains(name, `"b/"`) {
+		t.Fatalf("batch over b/ rejected by %q, want the b/ quota", name)
+	}
+}
+
+func TestExceededBatchTotal(t *testing.T) {
+	q := testQuota(10, map[string]int64{"a/": 100})
+	batch := []KeyValue{{Key: "a/1", Value: "aaaaaa"}, {Key: "other", Value: "oooooo"}}
+	if name := q.exceededBatch(batch, []int64{-1, -1}); name != "-max-total-bytes" {
+		t.Fatalf("batch of 12 bytes under a 10 byte total rejected by %q", name)
+	}
+	// Shrinking a cached value makes room for the rest.
+	if name := q.exceededBatch(batch, []int64{6, 4}); name != "" {
+		t.Fatalf("batch growing the data by 2 bytes rejected by %s", name)
+	}
+}
+
+func TestBatchPutRecordsUsagePerPrefix(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	s.quota = testQuota(0, map[string]int64{"a/": 10, "b/": 10})
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	body := `{"entries":[{"key":"a/1","value":"aaaa"},{"key":"b/1","value":"bbbbbbbb"}]}`
+	resp, err := http.Post(ts.URL+"/kv/", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("batch PUT: status %d", resp.StatusCode)
+	}
+	st := s.quota.stats()
+	got := map[string]int64{}
+	for _, p := range st.Prefixes {
+		got[p.Prefix] = p.UsedBytes
+	}
+	if got["a/"] != 4 || got["b/"] != 8 || st.UsedBytes != 12 {
+		t.Fatalf("usage after batch: total %d, per prefix %v; want 12, a/ 4, b/ 8", st.UsedBytes, got)
+	}
+
+	// b/ now has 2 bytes left; a batch led by an a/ key must not slip by.
+	body = `{"entries":[{"key":"a/2","value":"a"},{"key":"b/2","value":"bbb"}]}`
+	resp, err = http.Post(ts.URL+"/kv/", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("batch over the b/ quota: status %d, want 507", resp.StatusCode)
+	}
+}
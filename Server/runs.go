@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxActiveRuns = 100
+	maxRunIDBytes = 128
+	// runIdleTimeout ends runs whose client went away without a stop
+	// marker: no marker or X-Run-ID request for this long.
+	runIdleTimeout = 10 * time.Minute
+)
+
+// runTracker keeps the load-generator runs announced through POST
+// /admin/run-marker, so the server log and stats can be matched up with
+// client reports. Several clients may start the same run ID, as the
+// joiners of a distributed run do; it ends when all of them have stopped.
+type runTracker struct {
+	mu   sync.RWMutex
+	runs map[string]*activeRun
+}
+
+type activeRun struct {
+	labels   map[string]string
+	started  time.Time
+	clients  int
+	requests int64
+	lastSeen int64 // unix nanos
+}
+
+type runMarkerRequest struct {
+	RunID  string            `json:"run_id"`
+	Event  string            `json:"event"`
+	Labels map[string]string `json:"labels"`
+}
+
+type runStats struct {
+	RunID    string            `json:"run_id"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Started  time.Time         `json:"started"`
+	Clients  int               `json:"clients"`
+	Requests int64             `json:"requests"`
+}
+
+func newRunTracker() *runTracker {
+	return &runTracker{runs: make(map[string]*activeRun)}
+}
+
+// middleware counts requests carrying the X-Run-ID of an active run.
+func (t *runTracker) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The canonical spelling saves Get an allocation per request.
+		if id := r.Header.Get("X-Run-Id"); id != "" {
+			t.mu.RLock()
+			if run, ok := t.runs[id]; ok {
+				atomic.AddInt64(&run.requests, 1)
+				atomic.StoreInt64(&run.lastSeen, time.Now().UnixNano())
+			}
+			t.mu.RUnlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mark applies a marker and returns the run's state after it, or an
+// HTTP status explaining why it was refused.
+func (t *runTracker) mark(m runMarkerRequest) (runStats, int) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	run, ok := t.runs[m.RunID]
+	switch m.Event {
+	case "start":
+		if !ok {
+			if len(t.runs) >= maxActiveRuns {
+				return runStats{}, http.StatusServiceUnavailable
+			}
+			run = &activeRun{labels: m.Labels, started: now}
+			t.runs[m.RunID] = run
+			log.Printf("Run %s started%s", m.RunID, formatLabels(m.Labels))
+		}
+		run.clients++
+	case "stop":
+		if !ok {
+			return runStats{}, http.StatusNotFound
+		}
+		if run.clients--; run.clients == 0 {
+			delete(t.runs, m.RunID)
+			log.Printf("Run %s stopped after %s, %d requests%s",
+				m.RunID, now.Sub(run.started).Round(time.Second), atomic.LoadInt64(&run.requests), formatLabels(run.labels))
+		}
+	}
+	atomic.StoreInt64(&run.lastSeen, now.UnixNano())
+	return run.stats(m.RunID), http.StatusOK
+}
+
+func (r *activeRun) stats(id string) runStats {
+	return runStats{RunID: id, Labels: r.labels, Started: r.started, Clients: r.clients, Requests: atomic.LoadInt64(&r.requests)}
+}
+
+func (t *runTracker) expireLoop() {
+	for now := range time.Tick(time.Minute) {
+		t.mu.Lock()
+		for id, run := range t.runs {
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&run.lastSeen))) > runIdleTimeout {
+				delete(t.runs, id)
+				log.Printf("Run %s expired without a stop marker after %s idle", id, runIdleTimeout)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// stats lists the active runs, oldest first.
+func (t *runTracker) stats() []runStats {
+	t.mu.RLock()
+	out := make([]runStats, 0, len(t.runs))
+	for id, run := range t.runs {
+		out = append(out, run.stats(id))
+	}
+	t.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// ids is the active run IDs for the periodic log line.
+func (t *runTracker) ids() string {
+	runs := t.stats()
+	ids := make([]string, len(runs))
+	for i, r := range runs {
+		ids[i] = r.RunID
+	}
+	return strings.Join(ids, ",")
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + labels[k]
+	}
+	return " (" + strings.Join(keys, " ") + ")"
+}
+
+// runMarkerHandler serves POST /admin/run-marker.
+func (s *Server) runMarkerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var m runMarkerRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&m); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case m.RunID == "" || len(m.RunID) > maxRunIDBytes:
+		http.Error(w, "run_id must be 1 to 128 bytes", http.StatusBadRequest)
+		return
+	case m.Event != "start" && m.Event != "stop":
+		http.Error(w, "event must be start or stop", http.StatusBadRequest)
+		return
+	}
+	st, status := s.runs.mark(m)
+	switch status {
+	case http.StatusServiceUnavailable:
+		http.Error(w, "Too many active runs", status)
+	case http.StatusNotFound:
+		http.Error(w, "Run is not active", status)
+	default:
+		writeJSON(w, status, st)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// scanFlushEvery is how often a range scan flushes the rows it has
+// written, so slow scans still reach the client steadily.
+const scanFlushEvery = 100 * time.Millisecond
+
+var (
+	errScanLimit  = errors.New("scan reached its limit")
+	errScanBudget = errors.New("scan reached its byte budget")
+)
+
+type scanRow struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// isScan reports whether a GET of /kv/range asks for a range scan rather
+// than the key "range": it does when it has a start, end or cursor.
+func isScan(q url.Values) bool {
+	return q.Has("start") || q.Has("end") || q.Has("cursor")
+}
+
+// handleScan serves GET /kv/range?start=a&end=b&limit=N, streaming the
+// live keys in [start, end) with their values as NDJSON. min-size and
+// max-size keep only values of those sizes; limit 0 means no limit.
+//
+// As it returns values, a scan is held to -scan-rate bytes per second and
+// stops after -scan-max-bytes, unless -admin-token is set and the request
+// carries it. The X-Scan-Complete trailer says whether every row in range
+// was sent; if not, X-Scan-Cursor resumes after the last one sent.
+func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := ScanOptions{Start: q.Get("start"), End: q.Get("end")}
+	var limit int
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"min-size", &opts.MinSize}, {"max-size", &opts.MaxSize}} {
+		if v := q.Get(p.name); v != "" {
+			if *p.dst, err = strconv.ParseInt(v, 10, 64); err != nil || *p.dst < 0 {
+				http.Error(w, p.name+" must be a non-negative number of bytes", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if opts.End != "" && opts.End <= opts.Start {
+		http.Error(w, "end must be after start", http.StatusBadRequest)
+		return
+	}
+	if c := q.Get("cursor"); c != "" {
+		if opts.After, err = decodeScanCursor(c, opts.Start, opts.End); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if limit > 0 {
+		// One row more tells whether the limit cut the scan short.
+		opts.Limit = limit + 1
+	}
+	rate, budget := s.scanRate, s.scanMaxBytes
+	if s.adminToken != "" && s.authorized(r) {
+		rate, budget = 0, 0
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", "X-Scan-Complete, X-Scan-Cursor")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	start, flushed := time.Now(), time.Now()
+	last, rows, sent := opts.After, 0, int64(0)
+	markStage(r.Context(), stageScan)
+	err = s.store.Scan(r.Context(), opts, func(key, value string) error {
+		size := int64(len(key) + len(value))
+		switch {
+		case rows == limit && limit > 0:
+			return errScanLimit
+		case budget > 0 && rows > 0 && sent+size > budget:
+			return errScanBudget
+		}
+		if err := enc.Encode(scanRow{key, value}); err != nil {
+			return err
+		}
+		last, rows, sent = key, rows+1, sent+size
+		if rate > 0 {
+			if ahead := time.Duration(float64(sent)/float64(rate)*float64(time.Second)) - time.Since(start); ahead > 0 {
+				rc.Flush()
+				flushed = time.Now()
+				t := time.NewTimer(ahead)
+				select {
+				case <-t.C:
+				case <-r.Context().Done():
+					t.Stop()
+					return r.Context().Err()
+				}
+			}
+		}
+		if time.Since(flushed) >= scanFlushEvery {
+			rc.Flush()
+			flushed = time.Now()
+		}
+		return nil
+	})
+
+	w.Header().Set("X-Scan-Complete", strconv.FormatBool(err == nil))
+	if err != nil && last != "" {
+		w.Header().Set("X-Scan-Cursor", encodeScanCursor(last, opts.Start, opts.End))
+	}
+	if err != nil && !errors.Is(err, errScanLimit) && !errors.Is(err, errScanBudget) && r.Context().Err() == nil {
+		log.Printf("Range scan [%q, %q) failed after %d rows: %v", opts.Start, opts.End, rows, err)
+	}
+}
+
+// scanCursor is the opaque X-Scan-Cursor. Like listCursor, it holds the
+// last key sent, and the range it belongs to so it cannot be replayed
+// against another.
+type scanCursor struct {
+	Last  string `json:"k"`
+	Start string `json:"s"`
+	End   string `json:"e"`
+}
+
+func encodeScanCursor(last, start, end string) string {
+	data, _ := json.Marshal(scanCursor{last, start, end})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeScanCursor(s, start, end string) (string, error) {
+	var c scanCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return "", errors.New("Invalid cursor")
+	}
+	if c.Start != start || c.End != end {
+		return "", errors.New("Cursor belongs to a different range")
+	}
+	return c.Last, nil
+}
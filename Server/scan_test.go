@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scan runs a range scan and returns its rows, whether it says it
+// completed, and the cursor to resume it.
+func scan(t *testing.T, url string, header ...string) (rows []scanRow, complete bool, cursor string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", url, resp.StatusCode)
+	}
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		var row scanRow
+		if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+			t.Fatalf("GET %s: row %q: %v", url, sc.Text(), err)
+		}
+		rows = append(rows, row)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return rows, resp.Trailer.Get("X-Scan-Complete") == "true", resp.Trailer.Get("X-Scan-Cursor")
+}
+
+func scanKeys(rows []scanRow) []string {
+	var keys []string
+	for _, r := range rows {
+		keys = append(keys, r.Key)
+	}
+	return keys
+}
+
+func TestScanRange(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	ctx := context.Background()
+	for _, k := range []string{"a", "b1", "b2", "b3", "c"} {
+		s.store.Put(ctx, k, "value-"+k)
+	}
+	s.store.Put(ctx, "b4", "long value of b4")
+	s.store.Put(ctx, "range", "the key range")
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"start=b&end=c", []string{"b1", "b2", "b3", "b4"}},
+		{"start=b", []string{"b1", "b2", "b3", "b4", "c", "range"}},
+		{"end=b2", []string{"a", "b1"}},
+		{"start=b&end=c&max-size=8", []string{"b1", "b2", "b3"}},
+		{"start=b&end=c&min-size=9", []string{"b4"}},
+		{"start=b&end=c&limit=4", []string{"b1", "b2", "b3", "b4"}},
+	} {
+		rows, complete, cursor := scan(t, ts.URL+"/kv/range?"+tc.query)
+		if !slices.Equal(scanKeys(rows), tc.want) || !complete || cursor != "" {
+			t.Errorf("%s: %v, complete %v, cursor %q; want %v, complete", tc.query, scanKeys(rows), complete, cursor, tc.want)
+		}
+		for _, r := range rows {
+			if v, _ := s.store.Get(ctx, r.Key); r.Value != v {
+				t.Errorf("%s: %s scanned as %q, stored %q", tc.query, r.Key, r.Value, v)
+			}
+		}
+	}
+
+	// Without start, end or cursor it is a GET of the key "range".
+	if _, body, _ := do(t, "GET", ts.URL+"/kv/range", ""); body != "the key range" {
+		t.Errorf("GET /kv/range = %q, want the value of the key range", body)
+	}
+
+	_, _, cursor := scan(t, ts.URL+"/kv/range?start=b&end=c&limit=1")
+	for _, q := range []string{
+		"start=b&end=a", "start=b&end=b", "start=a&limit=-1", "start=a&limit=x",
+		"start=a&min-size=-1", "start=a&max-size=x", "start=a&cursor=not-a-cursor",
+		// A cursor only resumes the range it came from.
+		"start=b&end=d&cursor=" + url.QueryEscape(cursor),
+	} {
+		if status, _, _ := do(t, "GET", ts.URL+"/kv/range?"+q, ""); status != http.StatusBadRequest {
+			t.Errorf("GET /kv/range?%s: status %d, want 400", q, status)
+		}
+	}
+}
+
+// TestScanResumeAcrossWrites pages through a range by its cursor while
+// keys on both sides of the cursor are put, changed and deleted between
+// pages, and checks each page sees the writes after its cursor and none
+// before.
+func TestScanResumeAcrossWrites(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	ctx := context.Background()
+	for i := range 10 {
+		s.store.Put(ctx, fmt.Sprintf("k%d", i), "v1")
+	}
+	base := ts.URL + "/kv/range?start=k&end=l&limit=4"
+
+	rows, complete, cursor := scan(t, base)
+	if complete || cursor == "" || !slices.Equal(scanKeys(rows), []string{"k0", "k1", "k2", "k3"}) {
+		t.Fatalf("first page: %v, complete %v, cursor %q", scanKeys(rows), complete, cursor)
+	}
+	// Behind the cursor: changed and added keys are not sent again.
+	s.store.Put(ctx, "k1", "v2")
+	s.store.Put(ctx, "k2a", "v1")
+	// Ahead of it: a deleted key is skipped, and changed and new ones are
+	// read as they are now.
+	s.store.Delete(ctx, "k5")
+	s.store.Put(ctx, "k6", "v2")
+	s.store.Put(ctx, "k4a", "v1")
+
+	var got []scanRow
+	for cursor != "" {
+		rows, complete, cursor = scan(t, base+"&cursor="+url.QueryEscape(cursor))
+		got = append(got, rows...)
+		if complete != (cursor == "") {
+			t.Fatalf("page ending at %v: complete %v with cursor %q", scanKeys(rows), complete, cursor)
+		}
+	}
+	if want := []string{"k4", "k4a", "k6", "k7", "k8", "k9"}; !slices.Equal(scanKeys(got), want) {
+		t.Fatalf("resumed scan: %v, want %v", scanKeys(got), want)
+	}
+	if got[2].Value != "v2" {
+		t.Errorf("k6 resumed as %q, want the value written after the first page", got[2].Value)
+	}
+}
+
+// writeDuringScan makes a write once the scan has sent its first row.
+type writeDuringScan struct {
+	Store
+	write func()
+}
+
+func (w *writeDuringScan) Scan(ctx context.Context, opts ScanOptions, fn func(key, value string) error) error {
+	first := true
+	return w.Store.Scan(ctx, opts, func(key, value string) error {
+		if err := fn(key, value); err != nil {
+			return err
+		}
+		if first {
+			first = false
+			w.write()
+		}
+		return nil
+	})
+}
+
+func TestScanWriteMidScan(t *testing.T) {
+	store := NewMemStore()
+	ctx := context.Background()
+	for i := range 5 {
+		store.Put(ctx, fmt.Sprintf("k%d", i), "v1")
+	}
+	s := newTestServer(&writeDuringScan{Store: store, write: func() {
+		store.Put(ctx, "k0", "v2")
+		store.Put(ctx, "k3", "v2")
+		store.Delete(ctx, "k4")
+	}})
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	rows, complete, _ := scan(t, ts.URL+"/kv/range?start=k")
+	if !complete || !slices.Equal(scanKeys(rows), []string{"k0", "k1", "k2", "k3"}) {
+		t.Fatalf("scan: %v, complete %v", scanKeys(rows), complete)
+	}
+	if rows[0].Value != "v1" || rows[3].Value != "v2" {
+		t.Errorf("k0 = %q, k3 = %q; want the value before and after the write", rows[0].Value, rows[3].Value)
+	}
+}
+
+func TestScanBudget(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	ctx := context.Background()
+	for i := range 10 {
+		s.store.Put(ctx, fmt.Sprintf("k%d", i), strings.Repeat("v", 98))
+	}
+
+	// Each row is 100 bytes of key and value.
+	s.scanMaxBytes = 350
+	var all []string
+	pages := 0
+	for cursor, first := "", true; first || cursor != ""; first = false {
+		var rows []scanRow
+		rows, _, cursor = scan(t, ts.URL+"/kv/range?start=k&cursor="+url.QueryEscape(cursor))
+		all = append(all, scanKeys(rows)...)
+		pages++
+	}
+	if pages != 4 || len(all) != 10 {
+		t.Errorf("scan over a 350 byte budget took %d pages for %d keys, want 4 for 10", pages, len(all))
+	}
+
+	// The admin token lifts the budget and the rate.
+	s.adminToken = testAdminToken
+	s.scanRate = 100
+	start := time.Now()
+	rows, complete, _ := scan(t, ts.URL+"/kv/range?start=k", "Authorization", "Bearer "+testAdminToken)
+	if len(rows) != 10 || !complete || time.Since(start) > time.Second {
+		t.Errorf("admin scan: %d rows, complete %v in %s", len(rows), complete, time.Since(start))
+	}
+}
+
+// scanDone reports each Scan's error once it returns.
+type scanDone struct {
+	Store
+	done chan error
+}
+
+func (s *scanDone) Scan(ctx context.Context, opts ScanOptions, fn func(key, value string) error) error {
+	err := s.Store.Scan(ctx, opts, fn)
+	s.done <- err
+	return err
+}
+
+func TestScanRateAndDisconnect(t *testing.T) {
+	store := &scanDone{Store: NewMemStore(), done: make(chan error, 1)}
+	s := newTestServer(store)
+	s.scanRate = 1000
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	ctx := context.Background()
+	for i := range 100 {
+		store.Put(ctx, fmt.Sprintf("k%02d", i), strings.Repeat("v", 97))
+	}
+
+	// At 1000 bytes a second, 3 rows of 100 bytes take at least 200ms.
+	start := time.Now()
+	if rows, _, _ := scan(t, ts.URL+"/kv/range?start=k&limit=3"); len(rows) != 3 {
+		t.Fatalf("%d rows, want 3", len(rows))
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("300 bytes at 1000 bytes/s took %s", elapsed)
+	}
+	<-store.done
+
+	// The full scan would take 10s; hanging up stops it.
+	req, _ := http.NewRequest("GET", ts.URL+"/kv/range?start=k", nil)
+	cctx, cancel := context.WithCancel(ctx)
+	resp, err := http.DefaultClient.Do(req.WithContext(cctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Read(make([]byte, 100))
+	cancel()
+	resp.Body.Close()
+	select {
+	case err := <-store.done:
+		if err == nil {
+			t.Error("scan completed after the client hung up")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan still running after the client hung up")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Exit codes for failed startup checks, so deployment scripts can tell
+// what is wrong without parsing the log.
+const (
+	exitConfig   = 2
+	exitDatabase = 3
+	exitSchema   = 4
+	exitCache    = 5
+	exitListen   = 6
+	exitWrite    = 7
+)
+
+func checkFailed(code int, format string, args ...any) {
+	log.Printf("Startup check failed: "+format, args...)
+	os.Exit(code)
+}
+
+type cacheConfig struct {
+	endpointSize    int
+	endpointTTL     time.Duration
+	tombstoneTTL    time.Duration
+	evictionSample  float64
+	streamThreshold int64
+	maxAge          time.Duration
+}
+
+func checkCacheConfig(cfg cacheConfig) error {
+	switch {
+	case cfg.endpointSize <= 0:
+		return fmt.Errorf("-cache-endpoint-size must be positive, got %d", cfg.endpointSize)
+	case cfg.endpointTTL < 0:
+		return fmt.Errorf("-cache-endpoint-ttl must not be negative, got %s", cfg.endpointTTL)
+	case cfg.tombstoneTTL < 0:
+		return fmt.Errorf("-delete-tombstone-ttl must not be negative, got %s", cfg.tombstoneTTL)
+	case cfg.evictionSample < 0 || cfg.evictionSample > 1:
+		return fmt.Errorf("-log-evictions-sample must be between 0 and 1, got %g", cfg.evictionSample)
+	case cfg.streamThreshold < 0:
+		return fmt.Errorf("-stream-threshold must not be negative, got %d", cfg.streamThreshold)
+	case cfg.maxAge < 0:
+		return fmt.Errorf("-cache-ttl must not be negative, got %s", cfg.maxAge)
+	}
+	return nil
+}
+
+// waitForDB pings db until it answers or wait has passed, so the server
+// can start alongside Postgres.
+func waitForDB(db *sql.DB, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(time.Second).After(deadline) {
+			return err
+		}
+		if attempt == 1 {
+			log.Printf("Database not reachable yet, retrying for up to %s: %v", wait, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// checkSchema reports migrations that have not been applied, for runs
+// with -migrate skip.
+func checkSchema(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var exists bool
+	if err := conn.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("schema_migrations table is missing; start once with -migrate up")
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for _, m := range migrations {
+		if !applied[m.version] {
+			pending = append(pending, fmt.Sprintf("%d (%s)", m.version, m.name))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("pending migrations %s; run with -migrate up", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// checkListeners binds and releases every TCP address; unix sockets are
+// checked by listenUnix itself.
+func checkListeners(specs []listenerSpec) error {
+	for _, spec := range specs {
+		if spec.network != "tcp" {
+			continue
+		}
+		ln, err := net.Listen(spec.network, spec.addr)
+		if err != nil {
+			return fmt.Errorf("cannot listen on %s: %w (is another server running?)", spec.addr, err)
+		}
+		ln.Close()
+	}
+	return nil
+}
+
+// checkStoreRoundTrip writes, reads back and deletes a probe key.
+func checkStoreRoundTrip(store Store) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	host, _ := os.Hostname()
+	key := fmt.Sprintf("__startup-check-%s-%d", host, os.Getpid())
+	value := time.Now().Format(time.RFC3339Nano)
+
+	if _, err := store.Put(ctx, key, value); err != nil {
+		return fmt.Errorf("put probe key: %w (does the database user have write access to kv_store?)", err)
+	}
+	got, err := store.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("get probe key: %w", err)
+	}
+	if got != value {
+		return fmt.Errorf("probe key read back %q, wrote %q", got, value)
+	}
+	if _, err := store.Delete(ctx, key); err != nil {
+		return fmt.Errorf("delete probe key: %w", err)
+	}
+	return nil
+}
@@ -1,93 +1,463 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-type Cache struct {
-	mu      sync.RWMutex
-	items   map[string]string
-	maxSize int
-	hits    int64
-	misses  int64
-}
+type Server struct {
+	store Store
+	// dual is store when -secondary-db-url is set, for the admin endpoints.
+	dual       *DualStore
+	cache      *Cache
+	cors       *corsPolicy
+	adminToken string
+	readOnly   bool
+	// features is what GET /version advertises.
+	features   featureRegistry
+	durability durabilityPolicy
 
-func (c *Cache) Get(key string) (string, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	val, ok := c.items[key]
-	if ok {
-		atomic.AddInt64(&c.hits, 1)
-	} else {
-		atomic.AddInt64(&c.misses, 1)
-	}
-	return val, ok
-}
+	maxValueBytes   int64
+	maxKeyBytes     int
+	streamThreshold int64
+	streamedGets    int64
+	streamedPuts    int64
+	// chunkVerifyFailures counts streamed GETs whose chunks did not match
+	// the manifest.
+	chunkVerifyFailures int64
 
-func (c *Cache) Set(key, value string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if len(c.items) >= c.maxSize {
-		for k := range c.items {
-			delete(c.items, k)
-			break
-		}
-	}
-	c.items[key] = value
-}
+	// scanRate and scanMaxBytes bound range scans without the admin token.
+	scanRate     int64
+	scanMaxBytes int64
 
-func (c *Cache) Delete(key string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	delete(c.items, key)
+	softDelete          bool
+	softDeleteRetention time.Duration
+
+	// skipUnchanged makes PUT compare against the current value under
+	// writeLocks and skip the store write when it is identical.
+	skipUnchanged   bool
+	writeLocks      keyMutex
+	unchangedWrites int64
+
+	// tombstoneTTL > 0 makes DELETE leave a cache tombstone so GETs
+	// answer 404 from the cache for that long.
+	tombstoneTTL time.Duration
+
+	readLimiter  *limiter
+	writeLimiter *limiter
+	// coldStart is nil without -cold-start-window.
+	coldStart *coldStart
+
+	// kvCache backs the cache-only /cache/ endpoints and is separate from
+	// the read-through cache in front of the store.
+	kvCache  *Cache
+	cacheTTL time.Duration
+
+	cacheResizes int64
+	cacheFlushes int64
+	staleness    stalenessStats
+	audits       auditLog
+
+	accessLog *accessLogger
+	batcher   *putBatcher
+	keys      *keyFilter
+	prefixes  *prefixStats
+	idem      *idempotencyTable
+	deciles   *popularityStats
+	optimal   *cacheEfficiency
+	pressure  *cachePressure
+	quota     *storageQuota
+	stall     *stallDetector
+	sweeper   *ttlSweeper
+	conns     connGauge
+	faults    faultInjector
+	latency   *latencyTracker
+	inflight  *inflightTracker
+	requests  *requestStats
+	runs      *runTracker
 }
 
-func NewCache(maxSize int) *Cache {
-	return &Cache{
-		items:   make(map[string]string),
-		maxSize: maxSize,
-	}
+type valueEnvelope struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Cache string `json:"cache"`
 }
 
-type Server struct {
-	db    *sql.DB
-	cache *Cache
+type listResponse struct {
+	Keys    []string `json:"keys"`
+	Deleted []string `json:"deleted,omitempty"`
+	Next    string   `json:"next,omitempty"`
 }
 
 func main() {
-	connStr := "user=postgres password=R@jat010120 host=localhost port=5432 dbname=kv_store"
+	addr := flag.String("addr", ":8080", "Address to listen on")
+	storeKind := flag.String("store", "postgres", "Backing store: postgres, or memory for runs without a database")
+	dbURL := flag.String("db-url", "", "Postgres connection string (also read from DATABASE_URL or PG* variables)")
+	dbURLFile := flag.String("db-url-file", "", "File containing the Postgres connection string, e.g. a mounted secret")
+	corsOrigins := flag.String("cors-origins", "", "Comma-separated origins allowed for CORS (\"*\" allows any)")
+	adminToken := flag.String("admin-token", "", "Bearer token required for writes (empty disables auth)")
+	readOnly := flag.Bool("read-only", false, "Reject all writes with 403")
+	pprofAddr := flag.String("pprof-addr", "", "Private address for pprof handlers, e.g. 127.0.0.1:6060 (disabled when empty)")
+	maxValueBytes := flag.Int64("max-value-bytes", 64<<20, "Largest value accepted by PUT")
+	idempotencyTTL := flag.Duration("idempotency-ttl", 24*time.Hour, "How long the response to a mutating request with an Idempotency-Key header is kept for replay to retries (0 disables)")
+	maxKeyBytes := flag.Int("max-key-bytes", 1024, "Longest key accepted, in bytes; longer keys get 414 and are never cached")
+	cacheMaxEntryBytes := flag.Int64("cache-max-entry-bytes", 0, "Largest value the read-through cache holds, in bytes; longer values are served from the store with X-Cache: UNCACHEABLE (0 = no limit)")
+	migrateMode := flag.String("migrate", "up", "Schema migrations at startup: up, status (print and exit), or skip")
+	dbWait := flag.Duration("db-wait", 30*time.Second, "Keep retrying the database connection at startup for this long")
+	checkOnly := flag.Bool("check-only", false, "Run the startup checks and exit (0 when all pass)")
+	logEvictionsSample := flag.Float64("log-evictions-sample", 0, "Fraction of cache evictions to log, e.g. 0.01 (0 disables)")
+	softDelete := flag.Bool("soft-delete", false, "DELETE keeps a tombstone that POST /kv/{key}/undelete can restore")
+	softDeleteRetention := flag.Duration("soft-delete-retention", 24*time.Hour, "How long soft-deleted keys can be undeleted before they are purged")
+	maxInflight := flag.Int("max-inflight", 0, "Maximum concurrently executing reads (0 disables limiting)")
+	maxQueue := flag.Int("max-queue", 0, "Maximum reads waiting for a slot before new ones are shed with 503")
+	maxInflightWrites := flag.Int("max-inflight-writes", -1, "Maximum concurrently executing writes (default: -max-inflight)")
+	maxQueueWrites := flag.Int("max-queue-writes", -1, "Maximum writes waiting for a slot (default: -max-queue)")
+	queueTimeout := flag.Duration("queue-timeout", 100*time.Millisecond, "Longest a queued request waits before it is shed with 503")
+	coldStartWindow := flag.Duration("cold-start-window", 0, "For this long after boot and after each cache flush, bound the store reads of cache misses (0 disables)")
+	coldStartConcurrency := flag.Int("cold-start-concurrency", 8, "During -cold-start-window, cache misses reading the store at once")
+	coldStartQueue := flag.Int("cold-start-queue", 0, "During -cold-start-window, misses that may wait for a slot; others get 503 with Retry-After")
+	coldStartTimeout := flag.Duration("cold-start-queue-timeout", 50*time.Millisecond, "Longest a miss waits in the -cold-start-queue before it gets 503")
+	readAddr := flag.String("read-addr", "", "Serve only GET/HEAD on this address (requires -write-addr; replaces -addr)")
+	writeAddr := flag.String("write-addr", "", "Serve only PUT/DELETE/POST on this address (requires -read-addr)")
+	listenUnixPath := flag.String("listen-unix", "", "Also serve on this Unix domain socket path")
+	unixSocketMode := flag.Uint("unix-socket-mode", 0o660, "Permission bits for the -listen-unix socket")
+	enableH2C := flag.Bool("h2c", false, "Also accept cleartext HTTP/2 (h2c) on the TCP and Unix listeners")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to drain in-flight requests on SIGINT/SIGTERM")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 5*time.Second, "Close connections that have not sent complete request headers within this time")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "Maximum time to read a whole request including the body (0 disables)")
+	writeTimeout := flag.Duration("write-timeout", 60*time.Second, "Maximum time to write a response, including streamed values (0 disables)")
+	idleTimeout := flag.Duration("idle-timeout", 120*time.Second, "Close keep-alive connections idle for this long")
+	maxHeaderBytes := flag.Int("max-header-bytes", 64<<10, "Maximum size of request headers")
+	cacheEndpointSize := flag.Int("cache-endpoint-size", 100000, "Maximum keys held by the cache-only /cache/ endpoints; PUTs beyond it get 507")
+	cacheEndpointTTL := flag.Duration("cache-endpoint-ttl", 0, "Default TTL for /cache/ PUTs without ?ttl= (0 = no expiry)")
+	accessLogPath := flag.String("access-log", "", "Write a JSON line per request to this file")
+	accessLogSample := flag.Float64("access-log-sample", 1, "Fraction of requests to write to the access log")
+	accessLogHashKeys := flag.Bool("access-log-hash-keys", false, "Log a hash of each key instead of the key itself, in the access log and in stuck-request lines")
+	accessLogMaxBytes := flag.Int64("access-log-max-bytes", 256<<20, "Rotate the access log to <file>.1 once it reaches this size (0 disables)")
+	batchWindow := flag.Duration("batch-window", 0, "Group PUTs arriving within this window into one transaction (0 disables group commit)")
+	batchMax := flag.Int("batch-max", 256, "Flush a group-commit batch once it holds this many PUTs")
+	bloom := flag.Bool("bloom", false, "Answer GETs for keys that were never written with 404 without querying the store")
+	bloomExpectedKeys := flag.Int("bloom-expected-keys", 1_000_000, "Number of keys the key filter is sized for")
+	bloomFPRate := flag.Float64("bloom-fp-rate", 0.01, "Target false-positive rate of the key filter")
+	bloomRebuild := flag.Duration("bloom-rebuild-interval", 10*time.Minute, "Rebuild the key filter from a key scan this often, dropping deleted keys")
+	skipUnchanged := flag.Bool("skip-unchanged-writes", false, "Skip the database write when a PUT carries the value the key already has")
+	durability := flag.String("durability", durabilityDB, "Durability of PUTs without X-Durability: db (acknowledged after the commit) or flush (after a commit with synchronous_commit on, even if the DSN turns it off)")
+	durabilityDowngrades := flag.Bool("durability-downgrades", true, "Let a PUT's X-Durability ask for less than -durability; otherwise such PUTs get -durability")
+	ttlSweepInterval := flag.Duration("ttl-sweep-interval", time.Second, "How often to delete keys whose PUT ?ttl= has passed (0 disables the sweeper)")
+	ttlSweepBatch := flag.Int("ttl-sweep-batch", 500, "Expired keys deleted per sweeper statement")
+	tombstoneTTL := flag.Duration("delete-tombstone-ttl", 0, "After a DELETE, answer GETs for the key with 404 from the cache for this long (0 disables)")
+	secondaryDBURL := flag.String("secondary-db-url", "", "Postgres connection string of a second store that receives every write, e.g. during a migration")
+	secondaryMode := flag.String("secondary-mode", "async", "How writes reach the secondary store: sync (in the request) or async (through a queue)")
+	secondaryQueue := flag.Int("secondary-queue", 10000, "Writes queued for the secondary store in async mode before further ones are dropped")
+	pinBudget := flag.Int("pin-budget", 100, "Maximum keys pinned in the cache via -pinned-keys-file or /admin/pin, on top of its regular size")
+	pinnedKeysFile := flag.String("pinned-keys-file", "", "File of keys, one per line, to load into the cache at startup and never evict")
+	shutdownReport := flag.String("shutdown-report", "", "On graceful shutdown also write the final JSON summary (as served by /admin/report) to this file")
+	statsPrefixes := flag.String("stats-prefixes", "", "Comma-separated key prefixes to break cache hits, misses and occupancy down by in /stats, e.g. tenantA-,tenantB-")
+	streamThreshold := flag.Int64("stream-threshold", 1<<20, "Values larger than this many bytes are streamed from the database and never cached (0 disables)")
+	scanRate := flag.Int64("scan-rate", 8<<20, "Bytes per second a GET /kv/range scan may send without the admin token (0 disables the limit)")
+	scanMaxBytes := flag.Int64("scan-max-bytes", 256<<20, "Bytes a GET /kv/range scan sends without the admin token before stopping with a resume cursor (0 disables the limit)")
+	cacheMaxAge := flag.Duration("cache-ttl", 0, "Drop every read-through cache entry after this long, even for keys without a ttl, so values are re-read from the store (0 disables)")
+	maxStale := flag.Duration("max-staleness", 30*time.Second, "With -cache-ttl, keep entries this much longer for GETs whose X-Max-Staleness accepts them")
+	stallFactor := flag.Float64("stall-factor", 3, "Log a warning and report the store as degraded when the p99 of store reads or writes over 10s exceeds that over the previous 5m by this factor (0 disables)")
+	cacheShards := flag.Int("cache-shards", 16, "Number of independently locked shards the read-through cache is split into; must be a power of two")
+	cacheStorage := flag.String("cache-storage", storageMap, "How the caches hold their entries: map, or slab to pack keys and values into large byte slabs so millions of small entries cost the garbage collector little")
+	maxTotalBytes := flag.Int64("max-total-bytes", 0, "Reject PUTs with 507 once the stored values add up to this many bytes (0 disables)")
+	quotaFile := flag.String("quota-file", "", "File of per-prefix storage quotas, one \"prefix bytes\" pair per line")
+	quotaCorrection := flag.Duration("quota-correction-interval", time.Minute, "How often to reset the tracked storage usage to the store's actual sum")
+	popularityDeciles := flag.Bool("popularity-deciles", false, "Break read-through cache hits and misses down by key popularity decile in /stats and /metrics")
+	popularityWindow := flag.Duration("popularity-window", time.Minute, "Half-life of the request counts that rank keys for -popularity-deciles")
+	efficiencyWindow := flag.Duration("cache-efficiency-window", 0, "Estimate the hit rate a clairvoyant cache of the same size would have had over this much recent traffic, and report it next to the actual one in /stats and the shutdown report (0 disables)")
+	efficiencySample := flag.Float64("cache-efficiency-sample", 0.1, "Fraction of keys whose requests -cache-efficiency-window traces")
+	pressureThresholds := flag.String("cache-pressure-thresholds", "80,95", "Comma-separated fills of the read-through cache, in percent of its entry limit, at which to log a warning and raise kv_cache_pressure_above in /metrics (empty disables)")
+	pressureHysteresis := flag.Float64("cache-pressure-hysteresis", 5, "Points below a -cache-pressure-thresholds fill the cache must drop to before it counts as back below")
+	stuckThreshold := flag.Duration("stuck-request-threshold", 30*time.Second, "Log requests still being served after this long, with the stage they are in, and again when they finish (0 disables the watchdog)")
+	flag.Parse()
+	b := currentBuild()
+	log.Printf("KV server %s (commit %s, %s, %s), API %s", b.Version, b.Commit, b.Time, b.Go, serverVersion)
 
-	db, err := sql.Open("pgx", connStr)
-	if err != nil {
-		log.Fatalf("Failed to open database connection: %v", err)
+	if *maxInflightWrites < 0 {
+		*maxInflightWrites = *maxInflight
 	}
-
-	if err := db.Ping(); err != nil {
-		log.Fatalf("Failed to ping database: %v", err)
+	if *maxQueueWrites < 0 {
+		*maxQueueWrites = *maxQueue
+	}
+	if *coldStartWindow > 0 && (*coldStartConcurrency <= 0 || *coldStartQueue < 0 || *coldStartTimeout <= 0) {
+		log.Fatalf("-cold-start-concurrency and -cold-start-queue-timeout must be positive and -cold-start-queue not negative")
 	}
 
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS kv_store (
-		key TEXT PRIMARY KEY,
-		value TEXT
-	);`
+	if *scanRate < 0 || *scanMaxBytes < 0 {
+		log.Fatalf("-scan-rate and -scan-max-bytes must not be negative")
+	}
+	if *softDelete && *softDeleteRetention <= 0 {
+		log.Fatalf("-soft-delete-retention must be positive")
+	}
+	err := checkCacheConfig(cacheConfig{
+		endpointSize:    *cacheEndpointSize,
+		endpointTTL:     *cacheEndpointTTL,
+		tombstoneTTL:    *tombstoneTTL,
+		evictionSample:  *logEvictionsSample,
+		streamThreshold: *streamThreshold,
+		maxAge:          *cacheMaxAge,
+	})
+	if err != nil {
+		checkFailed(exitCache, "%v", err)
+	}
 
-	if _, err := db.Exec(createTableSQL); err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+	var store Store
+	switch *storeKind {
+	case "postgres":
+		store = openPostgresStore(*dbURL, *dbURLFile, *migrateMode, *dbWait)
+	case "memory":
+		store = NewMemStore()
+	default:
+		log.Fatalf("Unknown -store %q (want postgres or memory)", *storeKind)
+	}
+	var dual *DualStore
+	if *secondaryDBURL != "" {
+		if *secondaryMode != "sync" && *secondaryMode != "async" {
+			log.Fatalf("Unknown -secondary-mode %q (want sync or async)", *secondaryMode)
+		}
+		if *secondaryQueue <= 0 {
+			log.Fatalf("-secondary-queue must be positive")
+		}
+		secondary := openPostgresStore(*secondaryDBURL, "", *migrateMode, *dbWait)
+		dual = NewDualStore(store, secondary, *secondaryMode == "async", *secondaryQueue)
+		store = dual
+		log.Printf("Mirroring writes to the secondary store (%s)", *secondaryMode)
+	}
+	if !*readOnly {
+		if err := checkStoreRoundTrip(store); err != nil {
+			checkFailed(exitWrite, "%v", err)
+		}
 	}
 
+	var stall *stallDetector
+	switch {
+	case *stallFactor < 0 || (*stallFactor > 0 && *stallFactor <= 1):
+		log.Fatalf("-stall-factor must be above 1, or 0 to disable")
+	case *stallFactor > 0:
+		stall = newStallDetector(*stallFactor, store)
+		store = &stallStore{Store: store, d: stall}
+		go stall.loop()
+	}
+	if *cacheShards <= 0 || *cacheShards&(*cacheShards-1) != 0 {
+		log.Fatalf("-cache-shards must be a power of two, got %d", *cacheShards)
+	}
+	if *cacheStorage != storageMap && *cacheStorage != storageSlab {
+		log.Fatalf("Unknown -cache-storage %q (want map or slab)", *cacheStorage)
+	}
+	switch *durability {
+	case durabilityDB, durabilityFlush:
+	case durabilityCache:
+		log.Fatalf("-durability=cache needs a write-behind mode, which this server does not have")
+	default:
+		log.Fatalf("Unknown -durability %q (want db or flush)", *durability)
+	}
 	s := &Server{
-		db:    db,
-		cache: NewCache(1000),
+		store:      store,
+		dual:       dual,
+		stall:      stall,
+		cache:      NewShardedCache(1000, *cacheShards),
+		cors:       parseCORSOrigins(*corsOrigins),
+		adminToken: *adminToken,
+		readOnly:   *readOnly,
+
+		maxValueBytes:   *maxValueBytes,
+		maxKeyBytes:     *maxKeyBytes,
+		streamThreshold: *streamThreshold,
+		scanRate:        *scanRate,
+		scanMaxBytes:    *scanMaxBytes,
+
+		softDelete:          *softDelete,
+		softDeleteRetention: *softDeleteRetention,
+		tombstoneTTL:        *tombstoneTTL,
+		skipUnchanged:       *skipUnchanged,
+
+		durability: durabilityPolicy{def: *durability, downgrades: *durabilityDowngrades},
+
+		readLimiter:  newLimiter(*maxInflight, *maxQueue, *queueTimeout),
+		writeLimiter: newLimiter(*maxInflightWrites, *maxQueueWrites, *queueTimeout),
+		coldStart:    newColdStart(*coldStartWindow, *coldStartConcurrency, *coldStartQueue, *coldStartTimeout),
+
+		kvCache:  NewCache(*cacheEndpointSize),
+		cacheTTL: *cacheEndpointTTL,
+
+		prefixes: parsePrefixStats(*statsPrefixes),
+		latency:  newLatencyTracker(),
+		inflight: newInflightTracker(*stuckThreshold),
+		requests: newRequestStats(),
+		runs:     newRunTracker(),
+	}
+	s.features.register("field", "inflight", "list", "max-staleness", "range-scan", "report", "run-markers", "time")
+	if !s.readOnly {
+		s.features.register("batch", "durability", "generate", "if-unmodified-since", "locks", "purge", "ttl")
+	}
+	if dual != nil {
+		s.features.register("secondary")
+	}
+	s.kvCache.rejectWhenFull = true
+	if *cacheEndpointSize > 0 && !s.readOnly {
+		s.features.register("cache-endpoints")
+	}
+	s.cache.SetStorage(*cacheStorage)
+	s.kvCache.SetStorage(*cacheStorage)
+	if *maxKeyBytes <= 0 {
+		log.Fatalf("-max-key-bytes must be positive")
+	}
+	s.cache.maxKeyBytes = *maxKeyBytes
+	s.kvCache.maxKeyBytes = *maxKeyBytes
+	if *cacheMaxEntryBytes < 0 {
+		log.Fatalf("-cache-max-entry-bytes must not be negative")
+	}
+	s.cache.maxEntryBytes = *cacheMaxEntryBytes
+	s.cache.maxAge = *cacheMaxAge
+	if *maxStale < 0 {
+		log.Fatalf("-max-staleness must not be negative")
+	}
+	s.cache.maxStale = *maxStale
+	s.cache.pinBudget = *pinBudget
+	if *pinBudget > 0 {
+		s.features.register("pin")
+	}
+	if *pinnedKeysFile != "" {
+		if err := s.loadPinnedKeys(*pinnedKeysFile); err != nil {
+			checkFailed(exitCache, "-pinned-keys-file: %v", err)
+		}
+	}
+	if *bloom {
+		if *bloomFPRate <= 0 || *bloomFPRate >= 1 {
+			log.Fatalf("-bloom-fp-rate must be between 0 and 1")
+		}
+		s.keys = newKeyFilter(store, *bloomExpectedKeys, *bloomFPRate)
+		start := time.Now()
+		if err := s.keys.rebuild(context.Background()); err != nil {
+			log.Fatalf("Failed to build key filter: %v", err)
+		}
+		log.Printf("Key filter built in %s", time.Since(start).Round(time.Millisecond))
+		if *bloomRebuild > 0 {
+			go s.keys.rebuildLoop(*bloomRebuild)
+		}
+	}
+	if *maxTotalBytes < 0 {
+		log.Fatalf("-max-total-bytes must not be negative")
+	}
+	if *maxTotalBytes > 0 || *quotaFile != "" {
+		if *quotaCorrection <= 0 {
+			log.Fatalf("-quota-correction-interval must be positive")
+		}
+		q, err := newStorageQuota(store, *maxTotalBytes, *quotaFile)
+		if err != nil {
+			log.Fatalf("Failed to load -quota-file: %v", err)
+		}
+		if err := q.refresh(context.Background()); err != nil {
+			log.Fatalf("Failed to measure storage usage: %v", err)
+		}
+		log.Printf("Storage usage: %d bytes", q.stats().UsedBytes)
+		s.quota = q
+		go q.correctLoop(*quotaCorrection)
+		s.features.register("storage-quota")
+	}
+	if *idempotencyTTL < 0 {
+		log.Fatalf("-idempotency-ttl must not be negative")
+	}
+	if *idempotencyTTL > 0 {
+		s.idem = newIdempotencyTable(*idempotencyTTL)
+		go s.idem.sweepLoop(min(*idempotencyTTL, time.Minute))
+	}
+	if *popularityDeciles {
+		if *popularityWindow <= 0 {
+			log.Fatalf("-popularity-window must be positive")
+		}
+		s.deciles = newPopularityStats(*popularityWindow)
+		go s.deciles.loop()
+		s.features.register("popularity-deciles")
+	}
+	if *efficiencyWindow < 0 {
+		log.Fatalf("-cache-efficiency-window must not be negative")
+	}
+	if *efficiencyWindow > 0 {
+		if *efficiencySample <= 0 || *efficiencySample > 1 {
+			log.Fatalf("-cache-efficiency-sample must be above 0 and at most 1")
+		}
+		s.optimal = newCacheEfficiency(s.cache, *efficiencyWindow, *efficiencySample)
+		if scaled := float64(s.cache.MaxSize()) * *efficiencySample; scaled < 100 {
+			log.Printf("Warning: -cache-efficiency-sample %g scales the cache to %.0f entries; the estimate will be noisy", *efficiencySample, scaled)
+		}
+		s.features.register("cache-efficiency")
+	}
+	thresholds, err := parsePressureThresholds(*pressureThresholds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *pressureHysteresis < 0 {
+		log.Fatalf("-cache-pressure-hysteresis must not be negative")
+	}
+	if s.pressure = newCachePressure(s.cache, thresholds, *pressureHysteresis); s.pressure != nil {
+		go s.pressure.loop()
+		s.features.register("cache-pressure")
+	}
+	if *stuckThreshold < 0 {
+		log.Fatalf("-stuck-request-threshold must not be negative")
+	}
+	s.inflight.hashKeys = *accessLogHashKeys
+	if *stuckThreshold > 0 {
+		go s.inflight.watchdog()
+	}
+	if *batchWindow > 0 {
+		if *batchMax <= 0 {
+			log.Fatalf("-batch-max must be positive")
+		}
+		s.batcher = newPutBatcher(store, s.cache, *batchWindow, *batchMax)
+	}
+	if *accessLogPath != "" {
+		if err := validateAccessLogSample(*accessLogSample); err != nil {
+			log.Fatal(err)
+		}
+		al, err := newAccessLogger(*accessLogPath, *accessLogSample, *accessLogHashKeys, *accessLogMaxBytes)
+		if err != nil {
+			log.Fatalf("Failed to open access log: %v", err)
+		}
+		s.accessLog = al
+	}
+	specs, err := s.listenerSpecs(*addr, *readAddr, *writeAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *listenUnixPath != "" {
+		specs = append(specs, s.unixListenerSpec(*listenUnixPath))
+	}
+	if err := checkListeners(specs); err != nil {
+		checkFailed(exitListen, "%v", err)
+	}
+	if *checkOnly {
+		log.Printf("All startup checks passed")
+		store.Close()
+		return
+	}
+	if *enableH2C {
+		for i := range specs {
+			specs[i].handler = h2c.NewHandler(specs[i].handler, &http2.Server{})
+		}
+	}
+	if *logEvictionsSample > 0 {
+		s.cache.SetEvictHook(sampledEvictionLogger(*logEvictionsSample))
 	}
 
 	go func() {
@@ -98,84 +468,718 @@ func main() {
 			total := h + m
 			if total > 0 {
 				rate := float64(h) / float64(total) * 100
-				log.Printf("Cache Hits: %d | Misses: %d | Hit Rate: %.2f%%", h, m, rate)
+				line := fmt.Sprintf("Cache Hits: %d | Misses: %d | Hit Rate: %.2f%%", h, m, rate)
+				if ids := s.runs.ids(); ids != "" {
+					line += " | Runs: " + ids
+				}
+				log.Print(line)
 			}
 		}
 	}()
 
-	http.HandleFunc("/kv/", s.kvHandler)
-	fmt.Println("Server starting on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	go s.requests.sampleLoop(s.cache)
+	go s.runs.expireLoop()
+	if *cacheMaxAge > 0 {
+		go scrubLoop(s.cache, max(*cacheMaxAge/2, time.Second))
+	}
+	if s.softDelete {
+		go s.purgeDeletedLoop()
+		s.features.register("soft-delete")
+	}
+	if *ttlSweepInterval > 0 {
+		if *ttlSweepBatch <= 0 {
+			log.Fatalf("-ttl-sweep-batch must be positive")
+		}
+		s.sweeper = newTTLSweeper(store, s.cache, *ttlSweepInterval, *ttlSweepBatch)
+		go s.sweeper.loop()
+	}
+
+	if *pprofAddr != "" {
+		startPprofServer(*pprofAddr)
+	}
+
+	err = serve(specs, serveOptions{
+		socketMode:      os.FileMode(*unixSocketMode),
+		shutdownTimeout: *shutdownTimeout,
+
+		readHeaderTimeout: *readHeaderTimeout,
+		readTimeout:       *readTimeout,
+		writeTimeout:      *writeTimeout,
+		idleTimeout:       *idleTimeout,
+		maxHeaderBytes:    *maxHeaderBytes,
+
+		conns: &s.conns,
+	})
+	if err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
+	s.logSummary(*shutdownReport)
+	if s.accessLog != nil {
+		s.accessLog.Close()
+	}
+	if err := s.store.Close(); err != nil {
+		log.Printf("Failed to close store: %v", err)
+	}
+}
+
+// openPostgresStore connects to every shard in the DSN list, returning a
+// plain PostgresStore when there is only one.
+func openPostgresStore(dbURL, dbURLFile, migrateMode string, dbWait time.Duration) Store {
+	switch migrateMode {
+	case "up", "status", "skip":
+	default:
+		log.Fatalf("Unknown -migrate mode %q (want up, status, or skip)", migrateMode)
+	}
+	dsn, err := resolveDSN(dbURL, dbURLFile)
+	if err != nil {
+		checkFailed(exitConfig, "database configuration: %v", err)
+	}
+	dsns := splitDSNs(dsn)
+
+	shards := make([]Store, len(dsns))
+	for i, dsn := range dsns {
+		shards[i] = openPostgresShard(dsn, i, len(dsns), migrateMode, dbWait)
+	}
+	if migrateMode == "status" {
+		os.Exit(0)
+	}
+	if len(shards) == 1 {
+		return shards[0]
+	}
+	log.Printf("Sharding keys across %d databases", len(shards))
+	return NewShardedStore(shards)
+}
+
+func openPostgresShard(dsn string, index, count int, migrateMode string, dbWait time.Duration) *PostgresStore {
+	db, dbConfig, err := openDB(dsn)
+	if err != nil {
+		checkFailed(exitConfig, "invalid database connection string: %v", err)
+	}
+	name := describeDB(dbConfig)
+	if count > 1 {
+		name = fmt.Sprintf("shard %d/%d %s", index, count, name)
+	}
+	log.Printf("Connecting to %s", name)
+
+	if err := waitForDB(db, dbWait); err != nil {
+		checkFailed(exitDatabase, "cannot reach %s after %s: %s (is Postgres running and -db-url correct?)",
+			name, dbWait, redactPassword(err, dbConfig.Password))
+	}
+
+	ctx := context.Background()
+	switch migrateMode {
+	case "up":
+		if err := runMigrations(ctx, db); err != nil {
+			checkFailed(exitSchema, "migrating schema on %s: %v", name, err)
+		}
+		if err := checkShardIdentity(ctx, db, index, count); err != nil {
+			checkFailed(exitConfig, "shard identity on %s: %v", name, err)
+		}
+	case "status":
+		if count > 1 {
+			fmt.Printf("%s:\n", name)
+		}
+		if err := printMigrationStatus(ctx, db); err != nil {
+			log.Fatalf("Failed to read migration status on %s: %v", name, err)
+		}
+	case "skip":
+		if err := checkSchema(ctx, db); err != nil {
+			checkFailed(exitSchema, "schema on %s: %v", name, err)
+		}
+	}
+	return NewPostgresStore(db)
+}
+
+func sampledEvictionLogger(fraction float64) EvictHook {
+	return func(key string, size int, reason EvictReason) {
+		if rand.Float64() < fraction {
+			log.Printf("DEBUG cache evict key=%q size=%d reason=%s", key, size, reason)
+		}
+	}
+}
+
+// routes restricts the handler to methods when any are given.
+func (s *Server) routes(methods ...string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/kv/", limitMiddleware(s.readLimiter, s.writeLimiter, s.idem.middleware(http.HandlerFunc(s.kvHandler))))
+	mux.Handle("/cache/", limitMiddleware(s.readLimiter, s.writeLimiter, http.HandlerFunc(s.cacheHandler)))
+	mux.HandleFunc("/stats", s.statsHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	mux.HandleFunc("/version", s.versionHandler)
+	mux.HandleFunc("/ui", uiHandler)
+	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.HandleFunc("/admin/latency/reset", s.resetLatencyHandler)
+	mux.HandleFunc("/admin/generate", s.generateHandler)
+	mux.HandleFunc("/admin/report", s.reportHandler)
+	mux.HandleFunc("/admin/pin/", s.pinHandler)
+	mux.HandleFunc("/admin/cache/resize", s.resizeCacheHandler)
+	mux.HandleFunc("/admin/cache/shards", s.cacheShardsHandler)
+	mux.HandleFunc("/admin/cache/flush", s.flushCacheHandler)
+	mux.HandleFunc("/admin/audit", s.auditHandler)
+	mux.HandleFunc("/admin/purge", s.purgeHandler)
+	mux.HandleFunc("/admin/unpin/", s.pinHandler)
+	mux.HandleFunc("/admin/secondary", s.secondaryHandler)
+	mux.HandleFunc("/admin/verify-sample", s.verifySampleHandler)
+	mux.HandleFunc("/admin/promote-secondary", s.promoteSecondaryHandler)
+	mux.HandleFunc("/admin/faults", s.faultsHandler)
+	mux.HandleFunc("/admin/run-marker", s.runMarkerHandler)
+	mux.HandleFunc("/admin/time", s.timeHandler)
+	mux.HandleFunc("/admin/inflight", s.inflightHandler)
+	var h http.Handler = s.inflight.middleware(mux, s.latency.middleware(s.faults.middleware(mux)))
+	if len(methods) > 0 {
+		h = allowMethods(methods, h)
+	}
+	return s.requests.middleware(s.runs.middleware(s.accessLog.middleware(corsMiddleware(s.cors, h))))
 }
 
 func (s *Server) kvHandler(w http.ResponseWriter, r *http.Request) {
-	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	key, sub := kvPath(r.URL.Path)
 	if key == "" {
-		http.Error(w, "Key is missing", http.StatusBadRequest)
+		switch r.Method {
+		case "GET", "HEAD":
+			s.handleList(w, r)
+		case "POST":
+			if s.checkWrite(w, r) {
+				s.handleBatchPut(w, r)
+			}
+		case "OPTIONS":
+			allowOptions(w, kvCollectionMethods)
+		default:
+			methodNotAllowed(w, kvCollectionMethods)
+		}
+		return
+	}
+	if key == "range" && sub == "" && (r.Method == "GET" || r.Method == "HEAD") && isScan(r.URL.Query()) {
+		s.handleScan(w, r)
+		return
+	}
+	if s.keyTooLong(w, key) {
+		return
+	}
+	if sub != "" {
+		s.subresourceHandler(w, r, key, sub)
 		return
 	}
 
 	switch r.Method {
-	case "GET":
+	case "GET", "HEAD":
 		s.handleGet(w, r, key)
 	case "PUT":
-		s.handlePut(w, r, key)
+		if s.checkWrite(w, r) {
+			s.handlePut(w, r, key)
+		}
 	case "DELETE":
-		s.handleDelete(w, r, key)
+		if s.checkWrite(w, r) {
+			s.handleDelete(w, r, key)
+		}
+	case "OPTIONS":
+		allowOptions(w, kvItemMethods)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, kvItemMethods)
+	}
+}
+
+// Methods accepted on /kv/ paths, sent in Allow on OPTIONS and 405.
+const (
+	kvCollectionMethods = "GET, HEAD, POST, OPTIONS"
+	kvItemMethods       = "GET, HEAD, PUT, DELETE, OPTIONS"
+)
+
+var subresourceMethods = map[string]string{
+	"undelete":   "POST, OPTIONS",
+	"lock":       "GET, POST, DELETE, OPTIONS",
+	"lock/renew": "POST, OPTIONS",
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+func allowOptions(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// subresources are path suffixes reserved for operations on a key rather
+// than part of the key itself. Longer suffixes come first.
+var subresources = []string{"/lock/renew", "/lock", "/undelete"}
+
+// kvPath takes a /kv/ path apart into the key and the subresource after
+// it, if any. Both are substrings of the path, so routing a request
+// allocates nothing.
+func kvPath(path string) (key, sub string) {
+	return splitSubresource(strings.TrimPrefix(path, "/kv/"))
+}
+
+func splitSubresource(path string) (key, sub string) {
+	for _, suffix := range subresources {
+		if k, ok := strings.CutSuffix(path, suffix); ok && k != "" {
+			return k, suffix[1:]
+		}
+	}
+	return path, ""
+}
+
+func (s *Server) subresourceHandler(w http.ResponseWriter, r *http.Request, key, sub string) {
+	switch {
+	case sub == "undelete" && r.Method == "POST":
+		if s.checkWrite(w, r) {
+			s.handleUndelete(w, r, key)
+		}
+	case sub == "lock" && r.Method == "GET":
+		s.handleLockStatus(w, r, key)
+	case sub == "lock" && r.Method == "POST":
+		if s.checkWrite(w, r) {
+			s.handleLockAcquire(w, r, key)
+		}
+	case sub == "lock" && r.Method == "DELETE":
+		if s.checkWrite(w, r) {
+			s.handleLockRelease(w, r, key)
+		}
+	case sub == "lock/renew" && r.Method == "POST":
+		if s.checkWrite(w, r) {
+			s.handleLockRenew(w, r, key)
+		}
+	case r.Method == "OPTIONS":
+		allowOptions(w, subresourceMethods[sub])
+	default:
+		methodNotAllowed(w, subresourceMethods[sub])
 	}
 }
 
 func (s *Server) handleGet(w http.ResponseWriter, r *http.Request, key string) {
+	w, r, timing := withTiming(w, r)
+	// Taken first so a write, flush or resize at any point before the
+	// fill keeps the value read from the store out of the cache.
+	token := s.cache.FillToken(key)
+	if bound, bounded, err := maxStaleness(r); err != nil {
+		http.Error(w, "Invalid X-Max-Staleness", http.StatusBadRequest)
+		return
+	} else if bounded {
+		s.handleBoundedGet(w, r, key, bound, token)
+		return
+	}
+	start := timing.now()
 	val, ok := s.cache.Get(key)
+	timing.cacheSince(start)
+	s.prefixes.recordGet(key, ok)
+	s.deciles.recordGet(key, ok)
+	s.optimal.recordGet(key, ok)
 	if ok {
-		fmt.Println("Cache HIT for key:", key)
-		w.Write([]byte(val))
+		markStage(r.Context(), stageRespond)
+		writeValue(w, r, key, val, "HIT")
 		return
 	}
+	s.readThrough(w, r, key, token, false)
+}
 
-	fmt.Println("Cache MISS for key:", key)
+// readThrough serves a cache miss from the store and fills the cache.
+// With versioned, the value's modification time is read and cached too
+// when the store has it.
+func (s *Server) readThrough(w http.ResponseWriter, r *http.Request, key string, token fillToken, versioned bool) {
+	timing := timingFrom(r.Context())
+	if s.tombstoneTTL > 0 && s.cache.Tombstoned(key) {
+		w.Header().Set("X-Cache", "NEGATIVE")
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if s.keys != nil && !s.keys.mayContain(key) {
+		w.Header().Set("X-Cache", "NEGATIVE")
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	markStage(r.Context(), stageColdStart)
+	release, ok := s.coldStart.admit(w, r)
+	if !ok {
+		return
+	}
+	markStage(r.Context(), stageStore)
+	start := time.Now()
+	var modified time.Time
+	if versioned {
+		// Read before the value, so a write in between leaves the entry
+		// with an older version, which only costs a refetch.
+		modified, _ = version(r.Context(), s.store, key)
+	}
 	var valueFromDB string
-	err := s.db.QueryRow("SELECT value FROM kv_store WHERE key = $1", key).Scan(&valueFromDB)
+	var err error
+	fits := true
+	if s.streamThreshold > 0 && !wantsJSON(r) && !hasFieldParam(r) {
+		valueFromDB, fits, err = s.store.GetBounded(r.Context(), key, s.streamThreshold)
+	} else {
+		valueFromDB, err = s.store.Get(r.Context(), key)
+	}
+	release()
+	timing.dbSince(start)
+	if err == nil && !fits {
+		s.streamValue(w, r, key)
+		return
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
+		w.Header().Set("X-Cache", "MISS")
+		if errors.Is(err, ErrNotFound) {
+			if s.keys != nil {
+				s.keys.falsePositive()
+			}
 			http.Error(w, "Key not found", http.StatusNotFound)
 		} else {
-			http.Error(w, "Database error", http.StatusInternalServerError)
+			s.dbError(w)
 		}
 		return
 	}
 
-	s.cache.Set(key, valueFromDB)
-	w.Write([]byte(valueFromDB))
+	start = time.Now()
+	if modified.IsZero() {
+		s.cache.Fill(key, valueFromDB, token)
+	} else {
+		s.cache.FillVersion(key, valueFromDB, modified, token)
+	}
+	timing.cacheSince(start)
+	status := "MISS"
+	if !s.cache.Cacheable(valueFromDB) {
+		status = "UNCACHEABLE"
+	}
+	markStage(r.Context(), stageRespond)
+	writeValue(w, r, key, valueFromDB, status)
+}
+
+func (s *Server) readValue(w http.ResponseWriter, r *http.Request) (string, bool) {
+	markStage(r.Context(), stageBody)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxValueBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Value too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+		}
+		return "", false
+	}
+	return string(body), true
 }
 
 func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, key string) {
-	body := make([]byte, 1024*1024)
-	n, _ := r.Body.Read(body)
-	value := string(body[:n])
+	var ttl time.Duration
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	level, ok := s.durability.level(r)
+	if !ok {
+		http.Error(w, "Invalid X-Durability (want cache, db or flush)", http.StatusBadRequest)
+		return
+	}
+	since, conditional := ifUnmodifiedSince(r)
+	if s.streamThreshold > 0 && !conditional && (r.ContentLength < 0 || r.ContentLength > s.streamThreshold) {
+		s.streamPut(w, r, key, ttl)
+		return
+	}
+	value, ok := s.readValue(w, r)
+	if !ok {
+		return
+	}
+	if conditional && s.cache.ModifiedAfter(key, since) {
+		http.Error(w, "Key modified since If-Unmodified-Since", http.StatusPreconditionFailed)
+		return
+	}
+	old := s.cachedSize(key)
+	if s.overQuota(w, key, int64(len(value)), old) {
+		return
+	}
 
-	_, err := s.db.Exec(`
-		INSERT INTO kv_store (key, value) VALUES ($1, $2)
-		ON CONFLICT (key) DO UPDATE SET value = $2`,
-		key, value)
+	// A PUT with a ttl always writes, to move the expiry; a conditional
+	// PUT always runs its check in the store; a flushed PUT always
+	// commits, as the value it finds may not have been flushed.
+	if s.skipUnchanged && ttl == 0 && !conditional && level != durabilityFlush {
+		markStage(r.Context(), stageKeyLock)
+		defer s.writeLocks.lock(key)()
+		markStage(r.Context(), stageStore)
+		same, err := s.unchanged(r.Context(), key, value)
+		if err != nil {
+			s.dbError(w)
+			return
+		}
+		if same {
+			atomic.AddInt64(&s.unchangedWrites, 1)
+			w.Header().Set("X-Created", "false")
+			w.Header().Set("X-Unchanged", "true")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
 
+	put := s.store.Put
+	var modified time.Time
+	// Writes asking for cache are committed too, for want of a
+	// write-behind mode; conditional ones are never flushed.
+	achieved := durabilityDB
+	stage := stageStore
+	batched := false
+	switch {
+	case conditional:
+		put = func(ctx context.Context, key, value string) (created bool, err error) {
+			created, modified, err = s.store.PutIfUnmodifiedSince(ctx, key, value, ttl, since)
+			return created, err
+		}
+	case level == durabilityFlush:
+		put = func(ctx context.Context, key, value string) (bool, error) {
+			created, flushed, err := putSync(ctx, s.store, key, value, ttl)
+			if flushed {
+				achieved = durabilityFlush
+			}
+			return created, err
+		}
+	case ttl > 0:
+		put = func(ctx context.Context, key, value string) (bool, error) {
+			return s.store.PutTTL(ctx, key, value, ttl)
+		}
+	case s.batcher != nil:
+		put = s.batcher.Put
+		stage = stageGroupCommit
+		batched = true
+	}
+	if s.keys != nil {
+		defer s.keys.adding(key)()
+	}
+	markStage(r.Context(), stage)
+	created, err := put(r.Context(), key, value)
+	if errors.Is(err, ErrPreconditionFailed) {
+		http.Error(w, "Key modified since If-Unmodified-Since", http.StatusPreconditionFailed)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		s.dbError(w)
 		return
 	}
+	s.prefixes.recordPut(key)
+	s.optimal.recordPut(key)
+	s.quota.written(key, int64(len(value)), old, created)
+	w.Header().Set("X-Created", strconv.FormatBool(created))
+	s.durability.written(w, achieved)
 
-	s.cache.Set(key, value)
+	switch {
+	case s.streamThreshold > 0 && int64(len(value)) > s.streamThreshold:
+		s.cache.Delete(key)
+	case conditional:
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		s.cache.SetModified(key, value, ttl, modified)
+	case batched:
+		// The batcher cached the value its batch stored, which may be a
+		// later PUT's.
+	default:
+		s.cache.SetTTL(key, value, ttl)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, key string) {
-	_, err := s.db.Exec("DELETE FROM kv_store WHERE key = $1", key)
+	if s.skipUnchanged {
+		markStage(r.Context(), stageKeyLock)
+		defer s.writeLocks.lock(key)()
+	}
+	del := s.store.Delete
+	if s.softDelete {
+		del = s.store.SoftDelete
+	}
+	if since, ok := ifUnmodifiedSince(r); ok {
+		if s.cache.ModifiedAfter(key, since) {
+			http.Error(w, "Key modified since If-Unmodified-Since", http.StatusPreconditionFailed)
+			return
+		}
+		del = func(ctx context.Context, key string) (bool, error) {
+			return s.store.DeleteIfUnmodifiedSince(ctx, key, since, s.softDelete)
+		}
+	}
+	old := s.cachedSize(key)
+	markStage(r.Context(), stageStore)
+	deleted, err := del(r.Context(), key)
+	if errors.Is(err, ErrPreconditionFailed) {
+		http.Error(w, "Key modified since If-Unmodified-Since", http.StatusPreconditionFailed)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		s.dbError(w)
 		return
 	}
-	s.cache.Delete(key)
+	// Soft-deleted rows keep their space until they are purged.
+	if deleted && !s.softDelete && old > 0 {
+		s.quota.add(key, -old)
+	}
+	switch {
+	case s.tombstoneTTL <= 0:
+		s.cache.Delete(key)
+	case s.softDelete:
+		s.cache.Tombstone(key, "soft-delete", s.tombstoneTTL)
+	default:
+		s.cache.Tombstone(key, "delete", s.tombstoneTTL)
+	}
+	w.Header().Set("X-Deleted", strconv.FormatBool(deleted))
 	w.WriteHeader(http.StatusOK)
 }
+
+// ifUnmodifiedSince parses the header; as HTTP requires, an invalid date
+// is ignored.
+func ifUnmodifiedSince(r *http.Request) (time.Time, bool) {
+	v := r.Header.Get("If-Unmodified-Since")
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(v)
+	return t, err == nil
+}
+
+func (s *Server) checkWrite(w http.ResponseWriter, r *http.Request) bool {
+	if s.readOnly {
+		http.Error(w, "Server is in read-only mode", http.StatusForbidden)
+		return false
+	}
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.adminToken == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	prefix, after := q.Get("prefix"), ""
+	if c := q.Get("after"); c != "" {
+		var err error
+		if after, err = decodeListCursor(c, prefix); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	listed, err := s.store.List(r.Context(), ListOptions{
+		Prefix:         prefix,
+		After:          after,
+		Limit:          limit + 1,
+		IncludeDeleted: q.Get("include-deleted") == "true",
+	})
+	if err != nil {
+		s.dbError(w)
+		return
+	}
+
+	resp := listResponse{Keys: make([]string, 0, len(listed))}
+	for i, k := range listed {
+		resp.Keys = append(resp.Keys, k.Key)
+		if k.Deleted && i < limit {
+			resp.Deleted = append(resp.Deleted, k.Key)
+		}
+	}
+	if len(resp.Keys) > limit {
+		resp.Keys = resp.Keys[:limit]
+		resp.Next = encodeListCursor(resp.Keys[limit-1], prefix)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// listCursor is the opaque "next" of a listing page. Listing is keyset
+// paginated (key > last ORDER BY key), so keys written or deleted between
+// pages never shift the others; the prefix is embedded so a cursor cannot
+// be replayed against a different filter.
+type listCursor struct {
+	Last   string `json:"k"`
+	Prefix string `json:"p"`
+}
+
+func encodeListCursor(last, prefix string) string {
+	data, _ := json.Marshal(listCursor{last, prefix})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(s, prefix string) (string, error) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return "", errors.New("Invalid cursor")
+	}
+	if c.Prefix != prefix {
+		return "", errors.New("Cursor belongs to a different prefix")
+	}
+	return c.Last, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// hasFieldParam skips parsing the query of the many requests without one.
+func hasFieldParam(r *http.Request) bool {
+	return r.URL.RawQuery != "" && r.URL.Query().Has("field")
+}
+
+// xCacheValues are shared X-Cache header values, saving an allocation per
+// GET; nothing modifies a header value in place.
+var xCacheValues = map[string][]string{"HIT": {"HIT"}, "MISS": {"MISS"}, "UNCACHEABLE": {"UNCACHEABLE"}}
+
+func writeValue(w http.ResponseWriter, r *http.Request, key, val, cacheStatus string) {
+	if v, ok := xCacheValues[cacheStatus]; ok {
+		w.Header()["X-Cache"] = v
+	} else {
+		w.Header().Set("X-Cache", cacheStatus)
+	}
+	if hasFieldParam(r) {
+		field, err := extractField(val, r.URL.Query().Get("field"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(field)))
+		w.Write(field)
+		return
+	}
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, valueEnvelope{Key: key, Value: val, Cache: cacheStatus})
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(val)))
+	// WriteString hands the cached string to the connection's buffer
+	// without copying it into a []byte first.
+	io.WriteString(w, val)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Encoding error", http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer builds a Server on store the way main does with the
+// default flags, minus the background loops.
+func newTestServer(store Store) *Server {
+	s := &Server{
+		store:           store,
+		cache:           NewShardedCache(1000, 16),
+		maxValueBytes:   64 << 20,
+		maxKeyBytes:     1024,
+		streamThreshold: 1 << 20,
+		durability:      durabilityPolicy{def: durabilityDB, downgrades: true},
+		kvCache:         NewCache(100000),
+		latency:         newLatencyTracker(),
+		inflight:        newInflightTracker(30 * time.Second),
+		requests:        newRequestStats(),
+		runs:            newRunTracker(),
+	}
+	s.features.register("field", "inflight", "list", "max-staleness", "range-scan", "report", "run-markers", "time",
+		"batch", "durability", "generate", "if-unmodified-since", "locks", "purge", "ttl", "cache-endpoints")
+	s.kvCache.rejectWhenFull = true
+	s.cache.maxKeyBytes = s.maxKeyBytes
+	s.kvCache.maxKeyBytes = s.maxKeyBytes
+	s.cache.maxStale = 30 * time.Second
+	s.cache.pinBudget = 100
+	return s
+}
+
+// do sends a request to url and returns the status, body and headers.
+func do(t testing.TB, method, url, body string, header ...string) (int, string, http.Header) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b), resp.Header
+}
+
+func TestKVPath(t *testing.T) {
+	for path, want := range map[string][2]string{
+		"/kv/":              {"", ""},
+		"/kv/a":             {"a", ""},
+		"/kv/a/b":           {"a/b", ""},
+		"/kv/a/lock":        {"a", "lock"},
+		"/kv/a/lock/renew":  {"a", "lock/renew"},
+		"/kv/a/b/undelete":  {"a/b", "undelete"},
+		"/kv/lock":          {"lock", ""},
+		"/kv//lock":         {"/lock", ""},
+		"/kv/lock/undelete": {"lock", "undelete"},
+	} {
+		if key, sub := kvPath(path); key != want[0] || sub != want[1] {
+			t.Errorf("kvPath(%q) = %q, %q; want %q, %q", path, key, sub, want[0], want[1])
+		}
+	}
+	if n := testing.AllocsPerRun(100, func() { kvPath("/kv/some/key/lock/renew") }); n != 0 {
+		t.Errorf("kvPath allocates %.0f times", n)
+	}
+}
+
+// discardWriter is a ResponseWriter that keeps nothing of the body, so
+// allocation counts are the handler's own.
+type discardWriter struct {
+	h    http.Header
+	code int
+}
+
+func (w *discardWriter) Header() http.Header               { return w.h }
+func (w *discardWriter) WriteHeader(code int)              { w.code = code }
+func (w *discardWriter) Write(b []byte) (int, error)       { return len(b), nil }
+func (w *discardWriter) WriteString(s string) (int, error) { return len(s), nil }
+
+// getAllocBytes returns the bytes allocated by a cached GET of a
+// size-byte value through the full routes.
+func getAllocBytes(t *testing.T, h http.Handler, size int) int64 {
+	key := fmt.Sprintf("/kv/alloc-%d", size)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", key, strings.NewReader(strings.Repeat("v", size))))
+	req := httptest.NewRequest("GET", key, nil)
+	w := &discardWriter{h: http.Header{}}
+	res := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			clear(w.h)
+			h.ServeHTTP(w, req)
+		}
+	})
+	if w.code != 0 && w.code != http.StatusOK {
+		t.Fatalf("GET %s: status %d", key, w.code)
+	}
+	return res.AllocedBytesPerOp()
+}
+
+// A cache hit writes the cached string as it is, with no copy into a
+// []byte, so what it allocates does not grow with the value.
+func TestGetHitAllocsIndependentOfSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures allocations over a benchmark run")
+	}
+	h := newTestServer(NewMemStore()).routes()
+	small, large := getAllocBytes(t, h, 16), getAllocBytes(t, h, 64<<10)
+	if large > small+64 {
+		t.Errorf("cached GET of 64KB allocates %d bytes, of 16 bytes %d", large, small)
+	}
+}
+
+func BenchmarkKVHandlerGetHit(b *testing.B) {
+	for _, size := range []int{16, 512, 64 << 10} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			h := newTestServer(NewMemStore()).routes()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/kv/k", strings.NewReader(strings.Repeat("v", size))))
+			req := httptest.NewRequest("GET", "/kv/k", nil)
+			w := &discardWriter{h: http.Header{}}
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for range b.N {
+				clear(w.h)
+				h.ServeHTTP(w, req)
+			}
+		})
+	}
+}
+
+func TestAllowHeaders(t *testing.T) {
+	ts := httptest.NewServer(newTestServer(NewMemStore()).routes())
+	defer ts.Close()
+	for path, allow := range map[string]string{
+		"/kv/":                kvCollectionMethods,
+		"/kv/k":               kvItemMethods,
+		"/kv/a/b":             kvItemMethods,
+		"/kv/k/undelete":      subresourceMethods["undelete"],
+		"/kv/k/lock":          subresourceMethods["lock"],
+		"/kv/k/lock/renew":    subresourceMethods["lock/renew"],
+		"/kv/nested/key/lock": subresourceMethods["lock"],
+	} {
+		status, _, h := do(t, "OPTIONS", ts.URL+path, "")
+		if status != http.StatusNoContent || h.Get("Allow") != allow {
+			t.Errorf("OPTIONS %s: status %d, Allow %q; want 204, %q", path, status, h.Get("Allow"), allow)
+		}
+		for _, method := range []string{"GET", "HEAD", "PUT", "POST", "DELETE", "PATCH"} {
+			status, _, h := do(t, method, ts.URL+path, "", "X-Lock-Owner", "o")
+			allowed := strings.Contains(allow, method)
+			switch {
+			case allowed && status == http.StatusMethodNotAllowed:
+				t.Errorf("%s %s: 405 though Allow lists it", method, path)
+			case !allowed && (status != http.StatusMethodNotAllowed || h.Get("Allow") != allow):
+				t.Errorf("%s %s: status %d, Allow %q; want 405, %q", method, path, status, h.Get("Allow"), allow)
+			}
+		}
+	}
+}
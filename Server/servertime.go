@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+type serverTime struct {
+	// UnixNanos is the wall clock; MonotonicNanos counts from startup
+	// and never jumps, for telling a clock step from drift.
+	UnixNanos      int64 `json:"unix_nanos"`
+	MonotonicNanos int64 `json:"monotonic_nanos"`
+}
+
+// timeHandler serves GET /admin/time, which clients sample to line their
+// timestamps up with the server's.
+func (s *Server) timeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	now := time.Now()
+	writeJSON(w, http.StatusOK, serverTime{UnixNanos: now.UnixNano(), MonotonicNanos: int64(now.Sub(s.requests.started))})
+}
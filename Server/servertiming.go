@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers a GET sent with X-Timing: true gets back: the time spent in the
+// cache, in the store, and in the handler as a whole, in microseconds.
+const (
+	timingCacheHeader = "X-Timing-Cache-us"
+	timingDBHeader    = "X-Timing-DB-us"
+	timingTotalHeader = "X-Timing-Total-us"
+)
+
+// getTiming adds up where a GET's time went. Its methods do nothing on a
+// nil *getTiming, which is what requests without X-Timing carry.
+type getTiming struct {
+	start     time.Time
+	cache, db time.Duration
+	// trailers is set for streamed responses, whose headers go out
+	// before the store has finished.
+	trailers bool
+}
+
+type timingKey struct{}
+
+// withTiming starts timing r if it asks for it, returning the writer that
+// adds the headers and the request carrying the timing.
+func withTiming(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, *getTiming) {
+	if r.Header.Get("X-Timing") != "true" {
+		return w, r, nil
+	}
+	t := &getTiming{start: time.Now()}
+	return &timingWriter{ResponseWriter: w, t: t}, r.WithContext(context.WithValue(r.Context(), timingKey{}, t)), t
+}
+
+func timingFrom(ctx context.Context) *getTiming {
+	t, _ := ctx.Value(timingKey{}).(*getTiming)
+	return t
+}
+
+// now is the zero time for a nil *getTiming, sparing untimed GETs the
+// clock read.
+func (t *getTiming) now() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// cacheSince and dbSince add the time since start to a stage.
+func (t *getTiming) cacheSince(start time.Time) {
+	if t != nil {
+		t.cache += time.Since(start)
+	}
+}
+
+func (t *getTiming) dbSince(start time.Time) {
+	if t != nil {
+		t.db += time.Since(start)
+	}
+}
+
+// useTrailers declares the timing headers as trailers; it must be called
+// before the header is written, and without a Content-Length.
+func (t *getTiming) useTrailers(h http.Header) {
+	if t == nil {
+		return
+	}
+	t.trailers = true
+	h.Set("Trailer", timingCacheHeader+", "+timingDBHeader+", "+timingTotalHeader)
+}
+
+func (t *getTiming) set(h http.Header) {
+	if t == nil {
+		return
+	}
+	h.Set(timingCacheHeader, strconv.FormatInt(t.cache.Microseconds(), 10))
+	h.Set(timingDBHeader, strconv.FormatInt(t.db.Microseconds(), 10))
+	h.Set(timingTotalHeader, strconv.FormatInt(time.Since(t.start).Microseconds(), 10))
+}
+
+// timingWriter adds the timing headers just before the header is written,
+// unless they are sent as trailers.
+type timingWriter struct {
+	http.ResponseWriter
+	t           *getTiming
+	wroteHeader bool
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if !w.t.trailers {
+			w.t.set(w.Header())
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timingWriter) WriteString(s string) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return io.WriteString(w.ResponseWriter, s)
+}
+
+func (w *timingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
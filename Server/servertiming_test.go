@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowStore makes every read of a value take at least delay.
+type slowStore struct {
+	Store
+	delay time.Duration
+}
+
+func (s *slowStore) Get(ctx context.Context, key string) (string, error) {
+	time.Sleep(s.delay)
+	return s.Store.Get(ctx, key)
+}
+
+func (s *slowStore) GetBounded(ctx context.Context, key string, limit int64) (string, bool, error) {
+	time.Sleep(s.delay)
+	return s.Store.GetBounded(ctx, key, limit)
+}
+
+func (s *slowStore) Stream(ctx context.Context, key string, fn func(total int64, chunk []byte) error) error {
+	time.Sleep(s.delay)
+	return s.Store.Stream(ctx, key, fn)
+}
+
+// timedGet sends a GET with X-Timing and returns the stages from its
+// headers, or its trailers when streamed, and the latency seen here.
+func timedGet(t *testing.T, url string, header ...string) (resp *http.Response, cache, db, total, client time.Duration) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("X-Timing", "true")
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	client = time.Since(start)
+	h := resp.Header
+	if h.Get(timingTotalHeader) == "" {
+		h = resp.Trailer
+	}
+	stage := func(name string) time.Duration {
+		us, err := strconv.ParseInt(h.Get(name), 10, 64)
+		if err != nil {
+			t.Fatalf("GET %s: %s = %q", url, name, h.Get(name))
+		}
+		return time.Duration(us) * time.Microsecond
+	}
+	return resp, stage(timingCacheHeader), stage(timingDBHeader), stage(timingTotalHeader), client
+}
+
+func TestServerTiming(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	s := newTestServer(&slowStore{Store: NewMemStore(), delay: delay})
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	do(t, "PUT", ts.URL+"/kv/k", "v")
+	do(t, "PUT", ts.URL+"/kv/big", strings.Repeat("x", int(s.streamThreshold)+1))
+	s.cache.Delete("k")
+
+	for _, tc := range []struct {
+		name, key string
+		header    []string
+		cache     string
+		fromStore bool
+		trailers  bool
+	}{
+		{"miss", "k", nil, "MISS", true, false},
+		{"hit", "k", nil, "HIT", false, false},
+		{"bounded hit", "k", []string{"X-Max-Staleness", "1h"}, "HIT", false, false},
+		{"not found", "missing", nil, "MISS", true, false},
+		{"streamed", "big", nil, "BYPASS", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, cache, db, total, client := timedGet(t, ts.URL+"/kv/"+tc.key, tc.header...)
+			if got := resp.Header.Get("X-Cache"); got != tc.cache {
+				t.Errorf("X-Cache = %q, want %s", got, tc.cache)
+			}
+			if trailers := resp.Header.Get(timingTotalHeader) == ""; trailers != tc.trailers {
+				t.Errorf("timing sent as trailers: %v, want %v", trailers, tc.trailers)
+			}
+			if fromStore := db >= delay; fromStore != tc.fromStore {
+				t.Errorf("db = %s with a store taking %s, want it counted: %v", db, delay, tc.fromStore)
+			}
+			if cache+db > total || total > client {
+				t.Errorf("cache %s + db %s, total %s, client %s: want stages <= total <= client", cache, db, total, client)
+			}
+		})
+	}
+
+	// Without X-Timing nothing is added, and a streamed value keeps its
+	// Content-Length.
+	for _, key := range []string{"k", "big"} {
+		_, _, h := do(t, "GET", ts.URL+"/kv/"+key, "")
+		if h.Get(timingTotalHeader) != "" || h.Get("Trailer") != "" {
+			t.Errorf("GET %s without X-Timing: timing headers %v", key, h)
+		}
+		if key == "big" && h.Get("Content-Length") == "" {
+			t.Error("streamed GET without X-Timing lost its Content-Length")
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ShardedStore spreads keys over several stores by FNV-1a hash modulo the
+// shard count. The count and each shard's position are recorded in the
+// shard itself (see checkShardIdentity), since changing either remaps keys.
+type ShardedStore struct {
+	shards []Store
+}
+
+func NewShardedStore(shards []Store) *ShardedStore {
+	return &ShardedStore{shards: shards}
+}
+
+func (s *ShardedStore) shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *ShardedStore) shardFor(key string) Store {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (s *ShardedStore) Get(ctx context.Context, key string) (string, error) {
+	return s.shardFor(key).Get(ctx, key)
+}
+
+func (s *ShardedStore) GetBounded(ctx context.Context, key string, limit int64) (string, bool, error) {
+	return s.shardFor(key).GetBounded(ctx, key, limit)
+}
+
+func (s *ShardedStore) Stream(ctx context.Context, key string, fn func(total int64, chunk []byte) error) error {
+	return s.shardFor(key).Stream(ctx, key, fn)
+}
+
+func (s *ShardedStore) PutStream(ctx context.Context, key string, body io.Reader, ttl time.Duration) (bool, int64, error) {
+	return s.shardFor(key).PutStream(ctx, key, body, ttl)
+}
+
+func (s *ShardedStore) PutTTL(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return s.shardFor(key).PutTTL(ctx, key, value, ttl)
+}
+
+func (s *ShardedStore) Put(ctx context.Context, key, value string) (bool, error) {
+	return s.shardFor(key).Put(ctx, key, value)
+}
+
+// PutMany is atomic per shard only: if one shard fails, entries for the
+// others may already be committed.
+func (s *ShardedStore) PutMany(ctx context.Context, entries []KeyValue) ([]bool, error) {
+	byShard := make([][]KeyValue, len(s.shards))
+	positions := make([][]int, len(s.shards))
+	for pos, e := range entries {
+		i := s.shardIndex(e.Key)
+		byShard[i] = append(byShard[i], e)
+		positions[i] = append(positions[i], pos)
+	}
+	created := make([]bool, len(entries))
+	err := s.fanOut(func(i int, shard Store) error {
+		if len(byShard[i]) == 0 {
+			return nil
+		}
+		c, err := shard.PutMany(ctx, byShard[i])
+		for j, pos := range positions[i] {
+			if j < len(c) {
+				created[pos] = c[j]
+			}
+		}
+		return err
+	})
+	return created, err
+}
+
+func (s *ShardedStore) Delete(ctx context.Context, key string) (bool, error) {
+	return s.shardFor(key).Delete(ctx, key)
+}
+
+func (s *ShardedStore) SoftDelete(ctx context.Context, key string) (bool, error) {
+	return s.shardFor(key).SoftDelete(ctx, key)
+}
+
+func (s *ShardedStore) DeleteIfUnmodifiedSince(ctx context.Context, key string, since time.Time, soft bool) (bool, error) {
+	return s.shardFor(key).DeleteIfUnmodifiedSince(ctx, key, since, soft)
+}
+
+func (s *ShardedStore) PutIfUnmodifiedSince(ctx context.Context, key, value string, ttl time.Duration, since time.Time) (bool, time.Time, error) {
+	return s.shardFor(key).PutIfUnmodifiedSince(ctx, key, value, ttl, since)
+}
+
+func (s *ShardedStore) Undelete(ctx context.Context, key string, retention time.Duration) (bool, error) {
+	return s.shardFor(key).Undelete(ctx, key, retention)
+}
+
+func (s *ShardedStore) PurgeDeleted(ctx context.Context, retention time.Duration) (int64, error) {
+	counts := make([]int64, len(s.shards))
+	err := s.fanOut(func(i int, shard Store) error {
+		n, err := shard.PurgeDeleted(ctx, retention)
+		counts[i] = n
+		return err
+	})
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	return total, err
+}
+
+func (s *ShardedStore) SweepExpired(ctx context.Context, limit int) ([]string, error) {
+	swept := make([][]string, len(s.shards))
+	err := s.fanOut(func(i int, shard Store) error {
+		keys, err := shard.SweepExpired(ctx, limit)
+		swept[i] = keys
+		return err
+	})
+	var keys []string
+	for _, k := range swept {
+		keys = append(keys, k...)
+	}
+	return keys, err
+}
+
+func (s *ShardedStore) CountPurge(ctx context.Context, f PurgeFilter) (int64, error) {
+	counts := make([]int64, len(s.shards))
+	err := s.fanOut(func(i int, shard Store) error {
+		n, err := shard.CountPurge(ctx, f)
+		counts[i] = n
+		return err
+	})
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	return total, err
+}
+
+func (s *ShardedStore) PurgeBatch(ctx context.Context, f PurgeFilter, limit int) ([]string, error) {
+	purged := make([][]string, len(s.shards))
+	err := s.fanOut(func(i int, shard Store) error {
+		keys, err := shard.PurgeBatch(ctx, f, limit)
+		purged[i] = keys
+		return err
+	})
+	var keys []string
+	for _, k := range purged {
+		keys = append(keys, k...)
+	}
+	return keys, err
+}
+
+func (s *ShardedStore) ExpiryLag(ctx context.Context) (time.Duration, error) {
+	lags := make([]time.Duration, len(s.shards))
+	err := s.fanOut(func(i int, shard Store) error {
+		lag, err := shard.ExpiryLag(ctx)
+		lags[i] = lag
+		return err
+	})
+	return slices.Max(lags), err
+}
+
+// List asks every shard for a full page and keeps the first Limit keys of
+// the merged, sorted result, so paging with After works as on one store.
+func (s *ShardedStore) List(ctx context.Context, opts ListOptions) ([]ListedKey, error) {
+	pages := make([][]ListedKey, len(s.shards))
+	err := s.fanOut(func(i int, shard Store) error {
+		page, err := shard.List(ctx, opts)
+		pages[i] = page
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var merged []ListedKey
+	for _, page := range pages {
+		merged = append(merged, page...)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Key < merged[j].Key })
+	if opts.Limit > 0 && len(merged) > opts.Limit {
+		merged = merged[:opts.Limit]
+	}
+	return merged, nil
+}
+
+// shardScanPage is how many rows a ShardedStore scan reads from each shard
+// at a time.
+const shardScanPage = 1000
+
+// Scan merges pages of every shard's scan. Each round, the rows up to the
+// lowest last key of the shards that filled their page are in order and
+// complete; the next round resumes after that key.
+func (s *ShardedStore) Scan(ctx context.Context, opts ScanOptions, fn func(key, value string) error) error {
+	emitted := 0
+	for {
+		page := opts
+		page.Limit = shardScanPage
+		rows := make([][]KeyValue, len(s.shards))
+		err := s.fanOut(func(i int, shard Store) error {
+			return shard.Scan(ctx, page, func(key, value string) error {
+				rows[i] = append(rows[i], KeyValue{key, value})
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		var merged []KeyValue
+		cutoff, more := "", false
+		for _, r := range rows {
+			merged = append(merged, r...)
+			if len(r) == shardScanPage {
+				if last := r[len(r)-1].Key; !more || last < cutoff {
+					cutoff = last
+				}
+				more = true
+			}
+		}
+		sort.Slice(merged, func(i, j int) bool { return merged[i].Key < merged[j].Key })
+		for _, kv := range merged {
+			if more && kv.Key > cutoff {
+				break
+			}
+			if err := fn(kv.Key, kv.Value); err != nil {
+				return err
+			}
+			if emitted++; emitted == opts.Limit {
+				return nil
+			}
+		}
+		if !more {
+			return nil
+		}
+		opts.After = cutoff
+	}
+}
+
+func (s *ShardedStore) UsedBytes(ctx context.Context, prefix string) (int64, error) {
+	sizes := make([]int64, len(s.shards))
+	err := s.fanOut(func(i int, shard Store) error {
+		n, err := shard.UsedBytes(ctx, prefix)
+		sizes[i] = n
+		return err
+	})
+	var total int64
+	for _, n := range sizes {
+		total += n
+	}
+	return total, err
+}
+
+func (s *ShardedStore) AcquireLock(ctx context.Context, key, owner string, lease time.Duration) (LockInfo, bool, error) {
+	return s.shardFor(key).AcquireLock(ctx, key, owner, lease)
+}
+
+func (s *ShardedStore) RenewLock(ctx context.Context, key, owner string, lease time.Duration) (LockInfo, bool, error) {
+	return s.shardFor(key).RenewLock(ctx, key, owner, lease)
+}
+
+func (s *ShardedStore) ReleaseLock(ctx context.Context, key, owner string) (bool, error) {
+	return s.shardFor(key).ReleaseLock(ctx, key, owner)
+}
+
+func (s *ShardedStore) LockStatus(ctx context.Context, key string) (LockInfo, bool, error) {
+	return s.shardFor(key).LockStatus(ctx, key)
+}
+
+func (s *ShardedStore) Close() error {
+	var errs []error
+	for _, shard := range s.shards {
+		errs = append(errs, shard.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// fanOut runs fn on every shard concurrently and joins their errors.
+func (s *ShardedStore) fanOut(fn func(i int, shard Store) error) error {
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, shard := range s.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(i, shard); err != nil {
+				errs[i] = fmt.Errorf("shard %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+type shardHealth struct {
+	Shard   int    `json:"shard"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+func (s *ShardedStore) Health(ctx context.Context) []shardHealth {
+	health := make([]shardHealth, len(s.shards))
+	s.fanOut(func(i int, shard Store) error {
+		health[i] = shardHealth{Shard: i, Healthy: true}
+		if p, ok := shard.(pinger); ok {
+			if err := p.Ping(ctx); err != nil {
+				health[i] = shardHealth{Shard: i, Error: err.Error()}
+			}
+		}
+		return nil
+	})
+	return health
+}
+
+// checkShardIdentity records the shard's position on first start and
+// refuses to run if the DSN list has since been reordered or resized.
+func checkShardIdentity(ctx context.Context, db *sql.DB, index, count int) error {
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO kv_shard (shard_index, shard_count) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING`,
+		index, count)
+	if err != nil {
+		return err
+	}
+	var gotIndex, gotCount int
+	if err := db.QueryRowContext(ctx, "SELECT shard_index, shard_count FROM kv_shard").Scan(&gotIndex, &gotCount); err != nil {
+		return err
+	}
+	if gotIndex != index || gotCount != count {
+		return fmt.Errorf("database was set up as shard %d of %d but is now listed as shard %d of %d; resharding is not supported",
+			gotIndex, gotCount, index, count)
+	}
+	return nil
+}
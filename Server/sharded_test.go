@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+var errShardDown = errors.New("shard down")
+
+// downStore stands in for a shard whose database is unreachable.
+type downStore struct{ Store }
+
+func (downStore) Get(ctx context.Context, key string) (string, error) { return "", errShardDown }
+func (downStore) GetBounded(ctx context.Context, key string, limit int64) (string, bool, error) {
+	return "", false, errShardDown
+}
+func (downStore) PutTTL(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return false, errShardDown
+}
+func (downStore) List(ctx context.Context, opts ListOptions) ([]ListedKey, error) {
+	return nil, errShardDown
+}
+func (downStore) Ping(ctx context.Context) error { return errShardDown }
+
+func TestShardedStoreDistributesKeys(t *testing.T) {
+	shards := []*MemStore{NewMemStore(), NewMemStore()}
+	st := NewShardedStore([]Store{shards[0], shards[1]})
+	ctx := context.Background()
+	var batch []KeyValue
+	for i := range 1000 {
+		k := fmt.Sprintf("key-%d", i)
+		if i%2 == 0 {
+			st.Put(ctx, k, "v")
+		} else {
+			batch = append(batch, KeyValue{k, "v"})
+		}
+	}
+	if _, err := st.PutMany(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range shards {
+		if n := len(m.items); n < 400 || n > 600 {
+			t.Errorf("shard %d holds %d of 1000 keys", i, n)
+		}
+		for k := range m.items {
+			if st.shardIndex(k) != i {
+				t.Fatalf("%s stored on shard %d, maps to %d", k, i, st.shardIndex(k))
+			}
+		}
+	}
+}
+
+func TestShardedStoreListAndScanMerge(t *testing.T) {
+	st := NewShardedStore([]Store{NewMemStore(), NewMemStore(), NewMemStore()})
+	ctx := context.Background()
+	var want []string
+	for i := range 2500 {
+		k := fmt.Sprintf("key-%05d", i)
+		st.Put(ctx, k, "v"+k)
+		want = append(want, k)
+	}
+
+	var listed []string
+	after := ""
+	for {
+		page, err := st.List(ctx, ListOptions{After: after, Limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, k := range page {
+			listed = append(listed, k.Key)
+		}
+		after = page[len(page)-1].Key
+	}
+	if !slices.Equal(listed, want) {
+		t.Errorf("paged listing returned %d keys, want all %d in order", len(listed), len(want))
+	}
+
+	var scanned []string
+	err := st.Scan(ctx, ScanOptions{}, func(key, value string) error {
+		if value != "v"+key {
+			t.Fatalf("%s scanned with value %q", key, value)
+		}
+		scanned = append(scanned, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(scanned, want) {
+		t.Errorf("scan returned %d keys, want all %d in order", len(scanned), len(want))
+	}
+}
+
+// TestShardDownFailsOnlyItsKeys takes one of two shards down and checks
+// that only the keys mapped to it fail, and that /readyz names it.
+func TestShardDownFailsOnlyItsKeys(t *testing.T) {
+	shards := []Store{NewMemStore(), NewMemStore()}
+	st := NewShardedStore(shards)
+	s := newTestServer(st)
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	var keys []string
+	for i := range 50 {
+		k := fmt.Sprintf("key-%d", i)
+		do(t, "PUT", ts.URL+"/kv/"+k, "v")
+		keys = append(keys, k)
+	}
+
+	st.shards[1] = downStore{shards[1]}
+	for _, k := range keys {
+		s.cache.Delete(k)
+		status, _, _ := do(t, "GET", ts.URL+"/kv/"+k, "")
+		want := http.StatusOK
+		if st.shardIndex(k) == 1 {
+			want = http.StatusInternalServerError
+		}
+		if status != want {
+			t.Errorf("GET %s on shard %d: status %d, want %d", k, st.shardIndex(k), status, want)
+		}
+	}
+
+	status, body, _ := do(t, "GET", ts.URL+"/readyz", "")
+	var ready readyResponse
+	json.Unmarshal([]byte(body), &ready)
+	if status != http.StatusServiceUnavailable || len(ready.Shards) != 2 || !ready.Shards[0].Healthy || ready.Shards[1].Healthy {
+		t.Errorf("/readyz with shard 1 down: status %d, %s", status, body)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	smokeWorkers = 8
+	// smokeKeys is how many keys each worker owns.
+	smokeKeys = 200
+	// smokeOps is how many operations the workers issue between them
+	// after writing their keys.
+	smokeOps = 5000
+	// smokeMinHitRate is the lowest percentage of GETs hitting the cache
+	// that passes; the Zipf skew keeps the real rate well above it.
+	smokeMinHitRate = 50
+)
+
+// smokeResult counts what the smoke workload saw. A violation is a GET
+// whose answer differs from what its worker last wrote to the key.
+type smokeResult struct {
+	ops, gets, hits, puts, deletes int64
+	serverErrors, violations       int64
+	examples                       []string
+}
+
+// TestSmoke drives a mixed workload through the server's own handlers
+// over MemStore, then checks that there were no 5xx responses, that every
+// GET saw its worker's last write, that the skewed reads mostly hit the
+// cache, and that an audit of the whole cache finds it agreeing with the
+// store. It needs no database, so every change can be gated on it.
+func TestSmoke(t *testing.T) {
+	for _, storage := range []string{storageMap, storageSlab} {
+		t.Run(storage, func(t *testing.T) {
+			s := newTestServer(NewMemStore())
+			s.cache.SetStorage(storage)
+			s.kvCache.SetStorage(storage)
+			ts := httptest.NewServer(s.routes())
+			defer ts.Close()
+
+			var res smokeResult
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			for w := range smokeWorkers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r := smokeWorker(t, ts, w, smokeOps/smokeWorkers, rand.New(rand.NewPCG(1, uint64(w))))
+					mu.Lock()
+					res.merge(r)
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+
+			if res.serverErrors > 0 {
+				t.Errorf("%d responses with a 5xx status or a transport error", res.serverErrors)
+			}
+			if res.violations > 0 {
+				t.Errorf("%d reads did not see their own writes, e.g. %s", res.violations, strings.Join(res.examples, "; "))
+			}
+			if hitRate := float64(res.hits) / float64(res.gets) * 100; hitRate < smokeMinHitRate {
+				t.Errorf("cache hit rate %.1f%% of %d GETs is below %d%%", hitRate, res.gets, smokeMinHitRate)
+			}
+			audit := s.audit(context.Background(), s.cache.Len(), 0, false, nil)
+			mismatches := 0
+			for _, n := range audit.Mismatches {
+				mismatches += n
+			}
+			if mismatches > 0 || audit.Errors > 0 {
+				t.Errorf("audit of %d cached keys found %d mismatches (%v) and %d errors, e.g. %v",
+					audit.Checked, mismatches, audit.Mismatches, audit.Errors, audit.Examples)
+			}
+			t.Logf("%d operations (%d GETs, %d PUTs, %d DELETEs), %d cached keys audited",
+				res.ops, res.gets, res.puts, res.deletes, audit.Checked)
+		})
+	}
+}
+
+func (r *smokeResult) merge(o smokeResult) {
+	r.ops += o.ops
+	r.gets += o.gets
+	r.hits += o.hits
+	r.puts += o.puts
+	r.deletes += o.deletes
+	r.serverErrors += o.serverErrors
+	r.violations += o.violations
+	for _, e := range o.examples {
+		if len(r.examples) < 5 {
+			r.examples = append(r.examples, e)
+		}
+	}
+}
+
+// smokeWorker writes each of its own keys, then issues ops operations:
+// three in four are GETs skewed towards its first keys, the rest PUTs
+// and, one in five of them, DELETEs. It tracks what each key should hold,
+// so every GET checks read-your-writes.
+func smokeWorker(t *testing.T, ts *httptest.Server, worker, ops int, rng *rand.Rand) smokeResult {
+	client := ts.Client()
+	var res smokeResult
+	want := make([]string, smokeKeys) // "" for deleted
+	var version int64
+	do := func(method string, i int, body string) (int, string, string) {
+		key := fmt.Sprintf("smoke-%d-%d", worker, i)
+		req, err := http.NewRequest(method, ts.URL+"/kv/"+key, strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			return 0, "", ""
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			res.serverErrors++
+			return 0, "", ""
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			res.serverErrors++
+		}
+		return resp.StatusCode, string(b), resp.Header.Get("X-Cache")
+	}
+	put := func(i int) {
+		version++
+		value := fmt.Sprintf("value-%d-%d-%d", worker, i, version)
+		res.puts++
+		if status, _, _ := do("PUT", i, value); status < 300 && status > 0 {
+			want[i] = value
+		}
+	}
+	for i := range smokeKeys {
+		put(i)
+	}
+
+	zipf := rand.NewZipf(rng, 1.2, 1, smokeKeys-1)
+	for range ops {
+		res.ops++
+		i := int(zipf.Uint64())
+		switch op := rng.IntN(20); {
+		case op < 15:
+			res.gets++
+			status, body, cache := do("GET", i, "")
+			if cache == "HIT" {
+				res.hits++
+			}
+			var ok bool
+			switch {
+			case status == 0 || status >= 500:
+				continue
+			case want[i] == "":
+				ok = status == http.StatusNotFound
+			default:
+				ok = status == http.StatusOK && body == want[i]
+			}
+			if !ok {
+				res.violations++
+				if len(res.examples) < 5 {
+					res.examples = append(res.examples, fmt.Sprintf("smoke-%d-%d: HTTP %d %q, want %q", worker, i, status, body, want[i]))
+				}
+			}
+		case op < 19:
+			put(i)
+		default:
+			res.deletes++
+			if status, _, _ := do("DELETE", i, ""); status < 300 && status > 0 {
+				want[i] = ""
+			}
+		}
+	}
+	return res
+}
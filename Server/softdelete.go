@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+func (s *Server) handleUndelete(w http.ResponseWriter, r *http.Request, key string) {
+	if !s.softDelete {
+		http.Error(w, "Soft delete is disabled", http.StatusNotFound)
+		return
+	}
+	if s.keys != nil {
+		defer s.keys.adding(key)()
+	}
+	restored, err := s.store.Undelete(r.Context(), key, s.softDeleteRetention)
+	if err != nil {
+		s.dbError(w)
+		return
+	}
+	if !restored {
+		http.Error(w, "No deleted key within the retention window", http.StatusNotFound)
+		return
+	}
+	s.cache.Delete(key)
+	w.WriteHeader(http.StatusOK)
+}
+
+// purgeDeletedLoop removes tombstones once they fall out of the undelete
+// retention window.
+func (s *Server) purgeDeletedLoop() {
+	interval := min(s.softDeleteRetention/10, time.Minute)
+	for {
+		time.Sleep(interval)
+		n, err := s.store.PurgeDeleted(context.Background(), s.softDeleteRetention)
+		if err != nil {
+			log.Printf("Purging soft-deleted keys failed: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Purged %d soft-deleted keys", n)
+		}
+	}
+}
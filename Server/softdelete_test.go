@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "secret"
+
+func softDeleteTestServer(t *testing.T) (*Server, *MemStore, *httptest.Server) {
+	m := NewMemStore()
+	s := newTestServer(m)
+	s.softDelete = true
+	s.softDeleteRetention = time.Hour
+	s.adminToken = testAdminToken
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+	return s, m, ts
+}
+
+// admin sends a request with the admin token.
+func admin(t *testing.T, method, url, body string) (int, string, http.Header) {
+	t.Helper()
+	return do(t, method, url, body, "Authorization", "Bearer "+testAdminToken)
+}
+
+// ageTombstone moves key's deletion back by d, standing in for a clock
+// that has moved on.
+func ageTombstone(m *MemStore, key string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.items[key]
+	e.deletedAt = e.deletedAt.Add(-d)
+	m.items[key] = e
+}
+
+func listKeys(t *testing.T, url string) listResponse {
+	t.Helper()
+	_, body, _ := do(t, "GET", url, "")
+	var resp listResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("GET %s: %v (%s)", url, err, body)
+	}
+	return resp
+}
+
+func TestSoftDeleteUndelete(t *testing.T) {
+	_, _, ts := softDeleteTestServer(t)
+	kv := ts.URL + "/kv/k"
+	admin(t, "PUT", kv, "v")
+	admin(t, "PUT", ts.URL+"/kv/other", "v")
+	do(t, "GET", kv, "") // cached
+
+	if _, _, h := admin(t, "DELETE", kv, ""); h.Get("X-Deleted") != "true" {
+		t.Fatalf("DELETE: X-Deleted = %q", h.Get("X-Deleted"))
+	}
+	if status, _, _ := do(t, "GET", kv, ""); status != http.StatusNotFound {
+		t.Fatalf("GET after soft delete: status %d, want 404", status)
+	}
+	if got := listKeys(t, ts.URL+"/kv/"); !slices.Equal(got.Keys, []string{"other"}) {
+		t.Errorf("listing = %v, want only the live key", got.Keys)
+	}
+	if got := listKeys(t, ts.URL+"/kv/?include-deleted=true"); !slices.Equal(got.Keys, []string{"k", "other"}) || !slices.Equal(got.Deleted, []string{"k"}) {
+		t.Errorf("listing with include-deleted = %+v, want k marked deleted", got)
+	}
+
+	if status, _, _ := do(t, "POST", kv+"/undelete", ""); status != http.StatusUnauthorized {
+		t.Fatalf("undelete without the admin token: status %d, want 401", status)
+	}
+	if status, body, _ := admin(t, "POST", kv+"/undelete", ""); status != http.StatusOK {
+		t.Fatalf("undelete: status %d (%s)", status, body)
+	}
+	if status, body, _ := do(t, "GET", kv, ""); status != http.StatusOK || body != "v" {
+		t.Fatalf("GET after undelete: status %d, %q", status, body)
+	}
+	if status, _, _ := admin(t, "POST", kv+"/undelete", ""); status != http.StatusNotFound {
+		t.Errorf("undeleting a live key: status %d, want 404", status)
+	}
+}
+
+func TestSoftDeletePutResurrects(t *testing.T) {
+	_, _, ts := softDeleteTestServer(t)
+	kv := ts.URL + "/kv/k"
+	admin(t, "PUT", kv, "old")
+	admin(t, "DELETE", kv, "")
+	if _, _, h := admin(t, "PUT", kv, "new"); h.Get("X-Created") != "true" {
+		t.Errorf("PUT over a tombstone: X-Created = %q, want true", h.Get("X-Created"))
+	}
+	if status, body, _ := do(t, "GET", kv, ""); status != http.StatusOK || body != "new" {
+		t.Fatalf("GET after PUT: status %d, %q", status, body)
+	}
+}
+
+func TestSoftDeletePurgedAfterRetention(t *testing.T) {
+	s, m, ts := softDeleteTestServer(t)
+	kv := ts.URL + "/kv/"
+	for _, k := range []string{"old", "recent"} {
+		admin(t, "PUT", kv+k, "v")
+		admin(t, "DELETE", kv+k, "")
+	}
+	ageTombstone(m, "old", s.softDeleteRetention)
+	ageTombstone(m, "recent", s.softDeleteRetention-time.Minute)
+
+	if status, _, _ := admin(t, "POST", kv+"old/undelete", ""); status != http.StatusNotFound {
+		t.Errorf("undelete past the retention window: status %d, want 404", status)
+	}
+	n, err := m.PurgeDeleted(context.Background(), s.softDeleteRetention)
+	if err != nil || n != 1 {
+		t.Fatalf("PurgeDeleted = %d, %v; want the one key past retention", n, err)
+	}
+	if got := listKeys(t, kv+"?include-deleted=true"); !slices.Equal(got.Keys, []string{"recent"}) {
+		t.Errorf("listing with include-deleted after purge = %v, want only recent", got.Keys)
+	}
+	if status, _, _ := admin(t, "POST", kv+"recent/undelete", ""); status != http.StatusOK {
+		t.Errorf("undelete within the retention window: status %d, want 200", status)
+	}
+}
+
+func TestUndeleteDisabled(t *testing.T) {
+	ts := httptest.NewServer(newTestServer(NewMemStore()).routes())
+	defer ts.Close()
+	if status, _, _ := do(t, "POST", ts.URL+"/kv/k/undelete", ""); status != http.StatusNotFound {
+		t.Errorf("undelete without -soft-delete: status %d, want 404", status)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// errNoVersions is returned by stores that cannot read modification times.
+var errNoVersions = errors.New("store does not track versions")
+
+// versioner is implemented by stores that can tell when a key was last
+// modified. Bounded-staleness reads use that time as the value's version,
+// so revalidating a cached value only reads the timestamp.
+type versioner interface {
+	Version(ctx context.Context, key string) (time.Time, error)
+}
+
+type stalenessStats struct {
+	Reads       int64 `json:"reads"`
+	Served      int64 `json:"served_from_cache"`
+	Revalidated int64 `json:"revalidated"`
+	Refetched   int64 `json:"refetched"`
+}
+
+// maxStaleness parses X-Max-Staleness, a Go duration or whole seconds.
+func maxStaleness(r *http.Request) (time.Duration, bool, error) {
+	v := r.Header.Get("X-Max-Staleness")
+	if v == "" {
+		return 0, false, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, serr := strconv.ParseInt(v, 10, 64)
+		if serr != nil {
+			return 0, false, err
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d < 0 {
+		return 0, false, errors.New("negative")
+	}
+	return d, true, nil
+}
+
+func setAge(w http.ResponseWriter, age time.Duration) {
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+}
+
+// handleBoundedGet serves a GET with X-Max-Staleness: from the cache if
+// the entry is young enough, else after checking its version with the
+// store, else like a miss.
+func (s *Server) handleBoundedGet(w http.ResponseWriter, r *http.Request, key string, bound time.Duration, token fillToken) {
+	atomic.AddInt64(&s.staleness.Reads, 1)
+	timing := timingFrom(r.Context())
+	start := timing.now()
+	e, fresh, ok := s.cache.GetStale(key, bound)
+	timing.cacheSince(start)
+	s.prefixes.recordGet(key, fresh)
+	s.deciles.recordGet(key, fresh)
+	s.optimal.recordGet(key, fresh)
+	if fresh {
+		atomic.AddInt64(&s.staleness.Served, 1)
+		setAge(w, e.age)
+		writeValue(w, r, key, e.value, "HIT")
+		return
+	}
+	if vs, isV := s.store.(versioner); isV && ok && e.version != 0 {
+		start := timing.now()
+		modified, err := vs.Version(r.Context(), key)
+		timing.dbSince(start)
+		switch {
+		case err == nil && modified.UnixMicro() == e.version && s.cache.Revalidate(key, e.version, token):
+			atomic.AddInt64(&s.staleness.Revalidated, 1)
+			setAge(w, 0)
+			writeValue(w, r, key, e.value, "REVALIDATED")
+			return
+		case err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, errNoVersions):
+			w.Header().Set("X-Cache", "MISS")
+			s.dbError(w)
+			return
+		}
+	}
+	atomic.AddInt64(&s.staleness.Refetched, 1)
+	setAge(w, 0)
+	if ok {
+		// Whatever the store says now, the entry is outdated.
+		s.cache.Delete(key)
+		token = s.cache.FillToken(key)
+	}
+	s.readThrough(w, r, key, token, true)
+}
+
+func (s *Server) stalenessStats() *stalenessStats {
+	if atomic.LoadInt64(&s.staleness.Reads) == 0 {
+		return nil
+	}
+	return &stalenessStats{
+		Reads:       atomic.LoadInt64(&s.staleness.Reads),
+		Served:      atomic.LoadInt64(&s.staleness.Served),
+		Revalidated: atomic.LoadInt64(&s.staleness.Revalidated),
+		Refetched:   atomic.LoadInt64(&s.staleness.Refetched),
+	}
+}
+
+func (p *PostgresStore) Version(ctx context.Context, key string) (time.Time, error) {
+	var modified time.Time
+	err := p.db.QueryRowContext(ctx, "SELECT updated_at FROM kv_store WHERE key = $1 AND "+liveRow, key).Scan(&modified)
+	if err == sql.ErrNoRows {
+		return time.Time{}, ErrNotFound
+	}
+	return modified, err
+}
+
+func (m *MemStore) Version(ctx context.Context, key string) (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.live(key) {
+		return time.Time{}, ErrNotFound
+	}
+	return m.items[key].updatedAt, nil
+}
+
+func (s *ShardedStore) Version(ctx context.Context, key string) (time.Time, error) {
+	return version(ctx, s.shardFor(key), key)
+}
+
+func (d *DualStore) Version(ctx context.Context, key string) (time.Time, error) {
+	return version(ctx, d.reads(), key)
+}
+
+func (w *stallStore) Version(ctx context.Context, key string) (time.Time, error) {
+	defer w.d.read.observe(w.d.read.now())
+	return version(ctx, w.Store, key)
+}
+
+func version(ctx context.Context, st Store, key string) (time.Time, error) {
+	if v, ok := st.(versioner); ok {
+		return v.Version(ctx, key)
+	}
+	return time.Time{}, errNoVersions
+}
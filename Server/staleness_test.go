@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestBoundedStaleness reads a cached entry of each age with each
+// X-Max-Staleness, with the key unchanged and changed in the store since
+// it was cached.
+func TestBoundedStaleness(t *testing.T) {
+	for _, age := range []time.Duration{0, 10 * time.Second, 70 * time.Second} {
+		for _, header := range []string{"0", "5s", "30", "1h"} {
+			for _, changed := range []bool{false, true} {
+				t.Run(fmt.Sprintf("age=%s/bound=%s/changed=%t", age, header, changed), func(t *testing.T) {
+					bound, _ := time.ParseDuration(header)
+					if secs, err := strconv.Atoi(header); err == nil {
+						bound = time.Duration(secs) * time.Second
+					}
+					testBoundedRead(t, age, bound, header, changed)
+				})
+			}
+		}
+	}
+}
+
+func testBoundedRead(t *testing.T, age, bound time.Duration, header string, changed bool) {
+	clock := &fakeClock{time.Now()}
+	store := NewMemStore()
+	s := newTestServer(store)
+	s.cache.clock = clock.now
+	s.cache.maxAge = time.Minute
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	ctx := context.Background()
+	store.Put(ctx, "k", "old")
+	// A bounded read on a miss caches the value with its version.
+	if _, _, h := do(t, "GET", ts.URL+"/kv/k", "", "X-Max-Staleness", "1h"); h.Get("X-Cache") != "MISS" {
+		t.Fatalf("first read: X-Cache %q, want MISS", h.Get("X-Cache"))
+	}
+	if changed {
+		time.Sleep(time.Millisecond)
+		store.Put(ctx, "k", "new")
+	}
+	clock.advance(age)
+
+	var wantCache, wantBody string
+	wantAge := "0"
+	switch {
+	case age <= bound:
+		wantCache, wantBody, wantAge = "HIT", "old", strconv.Itoa(int(age/time.Second))
+	case !changed:
+		wantCache, wantBody = "REVALIDATED", "old"
+	default:
+		wantCache, wantBody = "MISS", "new"
+	}
+	status, body, h := do(t, "GET", ts.URL+"/kv/k", "", "X-Max-Staleness", header)
+	if status != http.StatusOK || body != wantBody || h.Get("X-Cache") != wantCache || h.Get("Age") != wantAge {
+		t.Errorf("GET: status %d, %q, X-Cache %q, Age %q; want %q, %s, Age %s", status, body, h.Get("X-Cache"), h.Get("Age"), wantBody, wantCache, wantAge)
+	}
+	// Whatever happened, the entry is now at most bound old, or fresh.
+	if wantCache != "HIT" {
+		if _, _, h := do(t, "GET", ts.URL+"/kv/k", "", "X-Max-Staleness", "0s"); h.Get("X-Cache") != "HIT" || h.Get("Age") != "0" {
+			t.Errorf("read right after: X-Cache %q, Age %q; want HIT, 0", h.Get("X-Cache"), h.Get("Age"))
+		}
+	}
+}
+
+func TestBoundedStalenessEdges(t *testing.T) {
+	clock := &fakeClock{time.Now()}
+	store := NewMemStore()
+	s := newTestServer(store)
+	s.cache.clock = clock.now
+	s.cache.maxAge = time.Minute
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	do(t, "PUT", ts.URL+"/kv/k", "v")
+
+	// Past -cache-ttl a plain GET misses, a tolerant one does not.
+	clock.advance(70 * time.Second)
+	if _, _, h := do(t, "GET", ts.URL+"/kv/k", "", "X-Max-Staleness", "80s"); h.Get("X-Cache") != "HIT" || h.Get("Age") != "70" {
+		t.Errorf("tolerant GET past -cache-ttl: X-Cache %q, Age %q; want HIT, 70", h.Get("X-Cache"), h.Get("Age"))
+	}
+	if _, _, h := do(t, "GET", ts.URL+"/kv/k", ""); h.Get("X-Cache") != "MISS" {
+		t.Errorf("plain GET past -cache-ttl: X-Cache %q, want MISS", h.Get("X-Cache"))
+	}
+
+	// A key deleted behind the cache's back is a 404, and leaves it.
+	store.Delete(context.Background(), "k")
+	clock.advance(10 * time.Second)
+	if status, _, _ := do(t, "GET", ts.URL+"/kv/k", "", "X-Max-Staleness", "5s"); status != http.StatusNotFound {
+		t.Errorf("GET of a deleted key past the bound: status %d, want 404", status)
+	}
+	if _, ok := s.cache.Peek("k"); ok {
+		t.Error("deleted key still cached")
+	}
+
+	for _, v := range []string{"soon", "-5s", "-1"} {
+		if status, _, _ := do(t, "GET", ts.URL+"/kv/k", "", "X-Max-Staleness", v); status != http.StatusBadRequest {
+			t.Errorf("X-Max-Staleness %q: status %d, want 400", v, status)
+		}
+	}
+	if st := s.stalenessStats(); st == nil || st.Reads != 2 || st.Served != 1 || st.Refetched != 1 {
+		t.Errorf("bounded_staleness stats %+v", st)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// The stall detector keeps per-slot latency histograms of store reads and
+// writes. After each slot it compares the p99 of the last stallShortSlots
+// with that of the stallLongSlots before them, leaving out slots that were
+// already degraded so a long stall does not become the baseline.
+const (
+	stallSlot       = 5 * time.Second
+	stallShortSlots = 2
+	stallLongSlots  = 60
+	// Below these the percentiles are too noisy to compare.
+	stallMinSamples = 50
+	stallMinP99     = 2 * time.Millisecond
+	// Once degraded, the ratio must stay under the midpoint between 1 and
+	// the factor for stallRecoverSlots slots in a row before recovering.
+	stallRecoverSlots = 3
+)
+
+type stallDetector struct {
+	factor float64
+	pool   func() (sql.DBStats, bool)
+	read   *stallSeries
+	write  *stallSeries
+}
+
+type stallSeries struct {
+	kind string
+	// clock replaces time.Now for timing operations, in tests.
+	clock func() time.Time
+
+	mu       sync.Mutex
+	slots    [stallShortSlots + stallLongSlots]*histogram
+	excluded [stallShortSlots + stallLongSlots]bool
+	cur      int
+
+	degraded   bool
+	degradedAt time.Time
+	calm       int
+	ratio      float64
+	shortP99   time.Duration
+	longP99    time.Duration
+	stalls     int64
+}
+
+type stallStats struct {
+	Factor float64          `json:"factor"`
+	Read   stallSeriesStats `json:"read"`
+	Write  stallSeriesStats `json:"write"`
+}
+
+type stallSeriesStats struct {
+	Degraded      bool       `json:"degraded"`
+	DegradedSince *time.Time `json:"degraded_since,omitempty"`
+	ShortP99Ms    float64    `json:"short_p99_ms"`
+	LongP99Ms     float64    `json:"long_p99_ms"`
+	Ratio         float64    `json:"ratio"`
+	Stalls        int64      `json:"stalls"`
+}
+
+func newStallDetector(factor float64, store Store) *stallDetector {
+	d := &stallDetector{factor: factor, read: newStallSeries("read"), write: newStallSeries("write")}
+	if p, ok := store.(poolStatser); ok {
+		d.pool = func() (sql.DBStats, bool) { return p.PoolStats(), true }
+	} else {
+		d.pool = func() (sql.DBStats, bool) { return sql.DBStats{}, false }
+	}
+	return d
+}
+
+func newStallSeries(kind string) *stallSeries {
+	s := &stallSeries{kind: kind}
+	for i := range s.slots {
+		s.slots[i] = newHistogram()
+	}
+	return s
+}
+
+func (s *stallSeries) record(d time.Duration) {
+	s.mu.Lock()
+	s.slots[s.cur].record(d)
+	s.mu.Unlock()
+}
+
+// close ends the current slot, updates the state and reports whether it
+// changed.
+func (s *stallSeries) close(factor float64, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.slots)
+	short, long := newHistogram(), newHistogram()
+	for i := 0; i < n; i++ {
+		j := (s.cur - i + n) % n
+		switch {
+		case i < stallShortSlots:
+			short.merge(s.slots[j])
+		case !s.excluded[j]:
+			long.merge(s.slots[j])
+		}
+	}
+	s.shortP99, s.longP99 = short.percentile(99), long.percentile(99)
+	s.ratio = 0
+	if short.count() >= stallMinSamples && long.count() >= stallMinSamples && s.longP99 > 0 {
+		s.ratio = float64(s.shortP99) / float64(s.longP99)
+	}
+	changed := false
+	switch {
+	case !s.degraded && s.ratio > factor && s.shortP99 >= stallMinP99:
+		s.degraded, s.degradedAt, s.calm, changed = true, now, 0, true
+		s.stalls++
+	case s.degraded && s.ratio < (1+factor)/2:
+		if s.calm++; s.calm >= stallRecoverSlots {
+			s.degraded, changed = false, true
+		}
+	case s.degraded:
+		s.calm = 0
+	}
+	if s.degraded {
+		for i := 0; i < stallShortSlots; i++ {
+			s.excluded[(s.cur-i+n)%n] = true
+		}
+	}
+	s.cur = (s.cur + 1) % n
+	s.slots[s.cur].reset()
+	s.excluded[s.cur] = false
+	return changed
+}
+
+func (d *stallDetector) loop() {
+	for now := range time.Tick(stallSlot) {
+		for _, s := range []*stallSeries{d.read, d.write} {
+			if s.close(d.factor, now) {
+				d.logChange(s, now)
+			}
+		}
+	}
+}
+
+func (d *stallDetector) logChange(s *stallSeries, now time.Time) {
+	s.mu.Lock()
+	degraded, since, shortP99, longP99, ratio := s.degraded, s.degradedAt, s.shortP99, s.longP99, s.ratio
+	s.mu.Unlock()
+	pool := "pool=none"
+	if ps, ok := d.pool(); ok {
+		pool = fmt.Sprintf("pool_open=%d pool_in_use=%d pool_idle=%d pool_wait_count=%d pool_wait=%s",
+			ps.OpenConnections, ps.InUse, ps.Idle, ps.WaitCount, ps.WaitDuration.Round(time.Millisecond))
+	}
+	if degraded {
+		log.Printf("Store %s latency degraded: p99_%s=%s p99_%s=%s ratio=%.1f threshold=%.1f %s",
+			s.kind, stallSlot*stallShortSlots, shortP99.Round(time.Microsecond),
+			stallSlot*stallLongSlots, longP99.Round(time.Microsecond), ratio, d.factor, pool)
+		return
+	}
+	log.Printf("Store %s latency recovered after %s: p99_%s=%s p99_%s=%s ratio=%.1f %s",
+		s.kind, now.Sub(since).Round(time.Second), stallSlot*stallShortSlots, shortP99.Round(time.Microsecond),
+		stallSlot*stallLongSlots, longP99.Round(time.Microsecond), ratio, pool)
+}
+
+func (s *stallSeries) stats() stallSeriesStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := stallSeriesStats{
+		Degraded:   s.degraded,
+		ShortP99Ms: float64(s.shortP99) / float64(time.Millisecond),
+		LongP99Ms:  float64(s.longP99) / float64(time.Millisecond),
+		Ratio:      s.ratio,
+		Stalls:     s.stalls,
+	}
+	if s.degraded {
+		since := s.degradedAt
+		st.DegradedSince = &since
+	}
+	return st
+}
+
+func (d *stallDetector) stats() *stallStats {
+	if d == nil {
+		return nil
+	}
+	return &stallStats{Factor: d.factor, Read: d.read.stats(), Write: d.write.stats()}
+}
+
+// degraded is false on a nil detector, i.e. with -stall-factor=0.
+func (d *stallDetector) degraded() bool {
+	if d == nil {
+		return false
+	}
+	return d.read.stats().Degraded || d.write.stats().Degraded
+}
+
+// poolStatser is implemented by stores backed by database/sql pools.
+type poolStatser interface {
+	PoolStats() sql.DBStats
+}
+
+func (p *PostgresStore) PoolStats() sql.DBStats {
+	return p.db.Stats()
+}
+
+// PoolStats adds up the shards' pools.
+func (s *ShardedStore) PoolStats() sql.DBStats {
+	var total sql.DBStats
+	for _, shard := range s.shards {
+		if p, ok := shard.(poolStatser); ok {
+			st := p.PoolStats()
+			total.MaxOpenConnections += st.MaxOpenConnections
+			total.OpenConnections += st.OpenConnections
+			total.InUse += st.InUse
+			total.Idle += st.Idle
+			total.WaitCount += st.WaitCount
+			total.WaitDuration += st.WaitDuration
+		}
+	}
+	return total
+}
+
+// PoolStats is the primary's.
+func (d *DualStore) PoolStats() sql.DBStats {
+	if p, ok := d.reads().(poolStatser); ok {
+		return p.PoolStats()
+	}
+	return sql.DBStats{}
+}
+
+// stallStore times the single-key reads and the writes of the store it
+// wraps for a stallDetector. Streams are left out, as their latency
+// follows the value size.
+type stallStore struct {
+	Store
+	d *stallDetector
+}
+
+// unwrapStore returns the store a stallStore wraps, for type checks.
+func unwrapStore(st Store) Store {
+	if w, ok := st.(*stallStore); ok {
+		return w.Store
+	}
+	return st
+}
+
+func (w *stallStore) Ping(ctx context.Context) error {
+	if p, ok := w.Store.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (w *stallStore) BulkLoad(ctx context.Context, entries []KeyValue) error {
+	return bulkLoad(ctx, w.Store, entries)
+}
+
+func (w *stallStore) Get(ctx context.Context, key string) (string, error) {
+	defer w.d.read.observe(w.d.read.now())
+	return w.Store.Get(ctx, key)
+}
+
+func (w *stallStore) GetBounded(ctx context.Context, key string, limit int64) (string, bool, error) {
+	defer w.d.read.observe(w.d.read.now())
+	return w.Store.GetBounded(ctx, key, limit)
+}
+
+func (w *stallStore) Put(ctx context.Context, key, value string) (bool, error) {
+	defer w.d.write.observe(w.d.write.now())
+	return w.Store.Put(ctx, key, value)
+}
+
+func (w *stallStore) PutTTL(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	defer w.d.write.observe(w.d.write.now())
+	return w.Store.PutTTL(ctx, key, value, ttl)
+}
+
+func (w *stallStore) PutIfUnmodifiedSince(ctx context.Context, key, value string, ttl time.Duration, since time.Time) (bool, time.Time, error) {
+	defer w.d.write.observe(w.d.write.now())
+	return w.Store.PutIfUnmodifiedSince(ctx, key, value, ttl, since)
+}
+
+func (w *stallStore) PutMany(ctx context.Context, entries []KeyValue) ([]bool, error) {
+	defer w.d.write.observe(w.d.write.now())
+	return w.Store.PutMany(ctx, entries)
+}
+
+func (w *stallStore) Delete(ctx context.Context, key string) (bool, error) {
+	defer w.d.write.observe(w.d.write.now())
+	return w.Store.Delete(ctx, key)
+}
+
+func (w *stallStore) SoftDelete(ctx context.Context, key string) (bool, error) {
+	defer w.d.write.observe(w.d.write.now())
+	return w.Store.SoftDelete(ctx, key)
+}
+
+func (w *stallStore) DeleteIfUnmodifiedSince(ctx context.Context, key string, since time.Time, soft bool) (bool, error) {
+	defer w.d.write.observe(w.d.write.now())
+	return w.Store.DeleteIfUnmodifiedSince(ctx, key, since, soft)
+}
+
+func (s *stallSeries) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
+
+func (s *stallSeries) observe(start time.Time) {
+	s.record(s.now().Sub(start))
+}
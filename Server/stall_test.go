@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// scriptedStore makes every Get take latency on clock.
+type scriptedStore struct {
+	Store
+	clock   *fakeClock
+	latency time.Duration
+}
+
+func (s *scriptedStore) Get(ctx context.Context, key string) (string, error) {
+	s.clock.advance(s.latency)
+	return s.Store.Get(ctx, key)
+}
+
+// TestStallTriggerAndRecovery feeds the detector slots of 1ms reads, then
+// 10ms reads, then 1ms reads again. It must turn degraded on the first
+// slow slot and recover stallRecoverSlots slots after the first window
+// of fast reads.
+func TestStallTriggerAndRecovery(t *testing.T) {
+	clock := &fakeClock{time.Unix(1_000_000, 0)}
+	scripted := &scriptedStore{Store: NewMemStore(), clock: clock}
+	d := newStallDetector(3, scripted)
+	d.read.clock, d.write.clock = clock.now, clock.now
+	store := &stallStore{Store: scripted, d: d}
+	s := newTestServer(store)
+	s.stall = d
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	slot := func(latency time.Duration) {
+		scripted.latency = latency
+		for range 30 {
+			store.Get(context.Background(), "k")
+		}
+	}
+	readyDegraded := func() bool {
+		_, body, _ := do(t, "GET", ts.URL+"/readyz", "")
+		var resp readyResponse
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if !resp.Ready {
+			t.Fatalf("/readyz not ready: %s", body)
+		}
+		return resp.Degraded
+	}
+
+	script := []time.Duration{
+		time.Millisecond, time.Millisecond, time.Millisecond, time.Millisecond,
+		10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond,
+		time.Millisecond, time.Millisecond, time.Millisecond, time.Millisecond, time.Millisecond, time.Millisecond,
+	}
+	const triggerAt, recoverAt = 4, 12
+	now := time.Unix(1_000_000, 0)
+	for i, latency := range script {
+		slot(latency)
+		now = now.Add(stallSlot)
+		changed := d.read.close(d.factor, now)
+		d.write.close(d.factor, now)
+		if want := i == triggerAt || i == recoverAt; changed != want {
+			st := d.read.stats()
+			t.Fatalf("slot %d (%s reads): changed %v, want %v; ratio %.2f, short p99 %.2fms, long p99 %.2fms",
+				i, latency, changed, want, st.Ratio, st.ShortP99Ms, st.LongP99Ms)
+		}
+		if want := i >= triggerAt && i < recoverAt; d.degraded() != want || readyDegraded() != want {
+			t.Fatalf("slot %d: degraded %v, /readyz degraded %v; want %v", i, d.degraded(), readyDegraded(), want)
+		}
+		if i == triggerAt {
+			if st := d.read.stats(); st.DegradedSince == nil || !st.DegradedSince.Equal(now) || st.Ratio <= 3 {
+				t.Errorf("stats on triggering %+v", st)
+			}
+		}
+	}
+	st := s.stats().DBStall
+	if st == nil || st.Read.Stalls != 1 || st.Read.Degraded || st.Write.Stalls != 0 {
+		t.Errorf("/stats store_stall = %+v, want one read stall, recovered", st)
+	}
+}
+
+// TestStallFlapResistance alternates slow and fast slots; once degraded,
+// the detector must not recover while slow slots keep interrupting.
+func TestStallFlapResistance(t *testing.T) {
+	d := newStallDetector(3, NewMemStore())
+	now := time.Unix(1_000_000, 0)
+	fill := func(latency time.Duration) {
+		for range 30 {
+			d.read.record(latency)
+		}
+		now = now.Add(stallSlot)
+	}
+	for range 4 {
+		fill(time.Millisecond)
+		d.read.close(d.factor, now)
+	}
+	changes := 0
+	for i := range 20 {
+		latency := time.Millisecond
+		if i%3 == 0 {
+			latency = 10 * time.Millisecond
+		}
+		fill(latency)
+		if d.read.close(d.factor, now) {
+			changes++
+		}
+	}
+	if st := d.read.stats(); changes != 1 || !st.Degraded || st.Stalls != 1 {
+		t.Errorf("%d state changes, stats %+v; want one stall and no recovery", changes, st)
+	}
+}
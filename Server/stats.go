@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+)
+
+type statsResponse struct {
+	CacheHits    int64   `json:"cache_hits"`
+	CacheMisses  int64   `json:"cache_misses"`
+	HitRate      float64 `json:"hit_rate"`
+	CacheSize    int     `json:"cache_size"`
+	CacheMaxSize int     `json:"cache_max_size"`
+	// CacheResizes counts POST /admin/cache/resize calls since startup.
+	CacheResizes int64 `json:"cache_resizes,omitempty"`
+	// CacheFlushes counts POST /admin/cache/flush calls since startup.
+	CacheFlushes int64 `json:"cache_flushes,omitempty"`
+	// CacheExpired counts entries dropped for their age (a PUT ttl or
+	// -cache-ttl), as opposed to evicted for space.
+	CacheExpired    int64   `json:"cache_expired"`
+	CacheTTLSeconds float64 `json:"cache_ttl_seconds,omitempty"`
+	// CacheBytes counts keys as well as values and tombstones.
+	CacheBytes         int64 `json:"cache_bytes"`
+	CacheOversizedKeys int64 `json:"cache_oversized_keys"`
+	// CacheUncacheable counts values kept out of the cache for exceeding
+	// CacheMaxEntryBytes, on reads and writes alike.
+	CacheMaxEntryBytes int64 `json:"cache_max_entry_bytes,omitempty"`
+	CacheUncacheable   int64 `json:"cache_uncacheable_values"`
+	// CacheSlabs is only set with -cache-storage=slab.
+	CacheSlabs *slabStats `json:"cache_slabs,omitempty"`
+
+	SkippedUnchangedWrites int64 `json:"skipped_unchanged_writes"`
+
+	Evictions  map[string]int64 `json:"evictions"`
+	Tombstones map[string]int   `json:"tombstones,omitempty"`
+	Pinned     []pinnedKey      `json:"pinned"`
+	PinBudget  int              `json:"pin_budget"`
+	ReadOnly   bool             `json:"read_only"`
+	Build      buildInfo        `json:"build"`
+	Durability durabilityStats  `json:"durability"`
+
+	StreamThresholdBytes int64 `json:"stream_threshold_bytes"`
+	StreamedGets         int64 `json:"streamed_gets"`
+	StreamedPuts         int64 `json:"streamed_puts"`
+	ChunkVerifyFailures  int64 `json:"chunk_verify_failures"`
+
+	CacheEndpoint cacheEndpointStats `json:"cache_endpoint"`
+
+	ReadLimiter  *limiterStats `json:"read_limiter,omitempty"`
+	WriteLimiter *limiterStats `json:"write_limiter,omitempty"`
+	// ColdStart is only set with -cold-start-window.
+	ColdStart *coldStartStats `json:"cold_start,omitempty"`
+
+	AccessLog *accessLogStats `json:"access_log,omitempty"`
+
+	GroupCommit *batcherStats    `json:"group_commit,omitempty"`
+	KeyFilter   *keyFilterStats  `json:"key_filter,omitempty"`
+	TTLSweeper  *ttlSweeperStats `json:"ttl_sweeper,omitempty"`
+	Secondary   *dualStoreStats  `json:"secondary,omitempty"`
+
+	Shards   []shardHealth         `json:"shards,omitempty"`
+	Prefixes []prefixStatsResponse `json:"prefixes,omitempty"`
+	Quota    *quotaStats           `json:"storage_quota,omitempty"`
+	Deciles  *popularityResponse   `json:"popularity_deciles,omitempty"`
+	Idem     *idempotencyStats     `json:"idempotency,omitempty"`
+	DBStall  *stallStats           `json:"store_stall,omitempty"`
+	Stale    *stalenessStats       `json:"bounded_staleness,omitempty"`
+	Runs     []runStats            `json:"active_runs"`
+	// Audits are the latest POST /admin/audit summaries, oldest first.
+	Audits []auditSummary `json:"audits,omitempty"`
+	// Optimal is only set with -cache-efficiency-window.
+	Optimal *cacheEfficiencyStats `json:"cache_efficiency,omitempty"`
+	// Pressure is unset with empty -cache-pressure-thresholds.
+	Pressure *cachePressureStats `json:"cache_pressure,omitempty"`
+
+	Latency     *latencyStats `json:"latency"`
+	Connections connStats     `json:"connections"`
+	Runtime     runtimeStats  `json:"runtime"`
+	Inflight    inflightStats `json:"inflight"`
+}
+
+type cacheEndpointStats struct {
+	Hits      int64            `json:"hits"`
+	Misses    int64            `json:"misses"`
+	Size      int              `json:"size"`
+	MaxSize   int              `json:"max_size"`
+	Evictions map[string]int64 `json:"evictions"`
+}
+
+type runtimeStats struct {
+	Goroutines     int    `json:"goroutines"`
+	HeapInuseBytes uint64 `json:"heap_inuse_bytes"`
+	HeapObjects    uint64 `json:"heap_objects"`
+	NumGC          uint32 `json:"num_gc"`
+	GCPauseTotalNs uint64 `json:"gc_pause_total_ns"`
+	LastGCPauseNs  uint64 `json:"last_gc_pause_ns"`
+}
+
+func readRuntimeStats() runtimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	rs := runtimeStats{
+		Goroutines:     runtime.NumGoroutine(),
+		HeapInuseBytes: ms.HeapInuse,
+		HeapObjects:    ms.HeapObjects,
+		NumGC:          ms.NumGC,
+		GCPauseTotalNs: ms.PauseTotalNs,
+	}
+	if ms.NumGC > 0 {
+		rs.LastGCPauseNs = ms.PauseNs[(ms.NumGC+255)%256]
+	}
+	return rs
+}
+
+func (s *Server) stats() statsResponse {
+	h := atomic.LoadInt64(&s.cache.hits)
+	m := atomic.LoadInt64(&s.cache.misses)
+	st := statsResponse{
+		CacheHits:    h,
+		CacheMisses:  m,
+		CacheSize:    s.cache.Len(),
+		CacheMaxSize: s.cache.MaxSize(),
+		CacheResizes: atomic.LoadInt64(&s.cacheResizes),
+		CacheFlushes: atomic.LoadInt64(&s.cacheFlushes),
+		CacheExpired: atomic.LoadInt64(&s.cache.evictions[EvictTTL]),
+
+		CacheTTLSeconds:    s.cache.maxAge.Seconds(),
+		CacheBytes:         s.cache.Bytes(),
+		CacheOversizedKeys: atomic.LoadInt64(&s.cache.oversizedKeys),
+		CacheMaxEntryBytes: s.cache.maxEntryBytes,
+		CacheUncacheable:   atomic.LoadInt64(&s.cache.uncacheable),
+		CacheSlabs:         s.cache.slabStats(),
+		Evictions:          s.cache.Evictions(),
+		Pinned:             s.cache.Pinned(),
+		PinBudget:          s.cache.pinBudget,
+		ReadOnly:           s.readOnly,
+		Build:              currentBuild(),
+		Durability:         s.durability.stats(),
+
+		SkippedUnchangedWrites: s.skippedWrites(),
+
+		StreamThresholdBytes: s.streamThreshold,
+		StreamedGets:         atomic.LoadInt64(&s.streamedGets),
+		StreamedPuts:         atomic.LoadInt64(&s.streamedPuts),
+		ChunkVerifyFailures:  atomic.LoadInt64(&s.chunkVerifyFailures),
+
+		CacheEndpoint: cacheEndpointStats{
+			Hits:      atomic.LoadInt64(&s.kvCache.hits),
+			Misses:    atomic.LoadInt64(&s.kvCache.misses),
+			Size:      s.kvCache.Len(),
+			MaxSize:   s.kvCache.MaxSize(),
+			Evictions: s.kvCache.Evictions(),
+		},
+
+		ReadLimiter:  s.readLimiter.stats(),
+		WriteLimiter: s.writeLimiter.stats(),
+		ColdStart:    s.coldStart.stats(),
+
+		AccessLog:   s.accessLog.stats(),
+		GroupCommit: s.batcher.stats(),
+		KeyFilter:   s.keys.stats(),
+		TTLSweeper:  s.sweeper.stats(),
+		Secondary:   s.dual.stats(),
+		Prefixes:    s.prefixes.stats(s.cache),
+		Quota:       s.quota.stats(),
+		Deciles:     s.deciles.stats(),
+		Idem:        s.idem.stats(),
+		DBStall:     s.stall.stats(),
+		Stale:       s.stalenessStats(),
+		Runs:        s.runs.stats(),
+		Audits:      s.audits.stats(),
+		Optimal:     s.optimal.stats(),
+		Pressure:    s.pressure.stats(),
+
+		Latency:     s.latency.stats(),
+		Connections: s.conns.stats(),
+		Runtime:     readRuntimeStats(),
+		Inflight:    s.inflight.stats(),
+	}
+	if s.tombstoneTTL > 0 {
+		st.Tombstones = s.cache.Tombstones()
+	}
+	if sharded, ok := unwrapStore(s.store).(*ShardedStore); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+		st.Shards = sharded.Health(ctx)
+		cancel()
+	}
+	if total := h + m; total > 0 {
+		st.HitRate = float64(h) / float64(total) * 100
+	}
+	return st
+}
+
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.stats())
+}
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var ErrNotFound = errors.New("key not found")
+
+// ErrPreconditionFailed means a conditional write found the key modified
+// after the given time.
+var ErrPreconditionFailed = errors.New("key modified since")
+
+// ErrDuplicateKeys means a PutMany was given the same key twice; nothing
+// was stored.
+var ErrDuplicateKeys = errors.New("batch has the same key more than once")
+
+// Store is the persistence tier behind the cache.
+type Store interface {
+	Get(ctx context.Context, key string) (string, error)
+	// GetBounded returns the value only when it is at most limit bytes long;
+	// for larger values it reports ok=false without transferring them.
+	GetBounded(ctx context.Context, key string, limit int64) (value string, ok bool, err error)
+	// Stream hands the value to fn in chunks, passing the total length with
+	// each one, without materialising it in memory.
+	Stream(ctx context.Context, key string, fn func(total int64, chunk []byte) error) error
+	// PutStream is PutTTL with the value read from body a chunk at a time.
+	// Until it returns, readers see the previous value; if it fails,
+	// including through ctx being cancelled, nothing is written.
+	PutStream(ctx context.Context, key string, body io.Reader, ttl time.Duration) (created bool, size int64, err error)
+	// Put stores the value, resurrecting the key if it was soft-deleted or
+	// expired, and clears any expiry. created reports that the key was not
+	// live before.
+	Put(ctx context.Context, key, value string) (created bool, err error)
+	// PutTTL is Put with the key expiring after ttl (0 = never).
+	PutTTL(ctx context.Context, key, value string, ttl time.Duration) (created bool, err error)
+	// PutIfUnmodifiedSince is PutTTL, except that it fails with
+	// ErrPreconditionFailed if the key is live and was modified after
+	// since, compared in whole seconds. It returns the new modification
+	// time.
+	PutIfUnmodifiedSince(ctx context.Context, key, value string, ttl time.Duration, since time.Time) (created bool, modified time.Time, err error)
+	// PutMany stores all entries atomically; keys must be distinct, or
+	// it fails with ErrDuplicateKeys.
+	// created[i] reports whether entries[i] was not live before.
+	PutMany(ctx context.Context, entries []KeyValue) (created []bool, err error)
+	// Delete and SoftDelete report whether a live key was removed.
+	Delete(ctx context.Context, key string) (bool, error)
+	// SoftDelete marks the key deleted while keeping the row so Undelete
+	// can restore it until PurgeDeleted removes it for good.
+	SoftDelete(ctx context.Context, key string) (bool, error)
+	// DeleteIfUnmodifiedSince is Delete, or SoftDelete with soft, that
+	// fails like PutIfUnmodifiedSince.
+	DeleteIfUnmodifiedSince(ctx context.Context, key string, since time.Time, soft bool) (bool, error)
+	Undelete(ctx context.Context, key string, retention time.Duration) (bool, error)
+	PurgeDeleted(ctx context.Context, retention time.Duration) (int64, error)
+	// SweepExpired deletes up to limit expired keys and returns them.
+	// Concurrent sweepers skip each other's rows instead of waiting.
+	SweepExpired(ctx context.Context, limit int) ([]string, error)
+	// ExpiryLag is the age of the oldest expired key still stored.
+	ExpiryLag(ctx context.Context) (time.Duration, error)
+	// CountPurge counts the rows PurgeBatch would delete, live or not.
+	CountPurge(ctx context.Context, f PurgeFilter) (int64, error)
+	// PurgeBatch deletes up to limit rows matching f, whether live,
+	// soft-deleted or expired, and returns their keys. Like SweepExpired,
+	// concurrent callers skip each other's rows.
+	PurgeBatch(ctx context.Context, f PurgeFilter, limit int) ([]string, error)
+	List(ctx context.Context, opts ListOptions) ([]ListedKey, error)
+	// Scan calls fn with each live key in the range and its value, in key
+	// order, as the rows arrive from one query. An error from fn stops the
+	// scan and is returned.
+	Scan(ctx context.Context, opts ScanOptions, fn func(key, value string) error) error
+	// UsedBytes sums the size of the values stored under prefix, counting
+	// soft-deleted and expired rows until they are purged or swept.
+	UsedBytes(ctx context.Context, prefix string) (int64, error)
+
+	// AcquireLock takes the lease only if the key is unlocked or the
+	// current lease has expired. On contention it returns the current
+	// holder with ok=false.
+	AcquireLock(ctx context.Context, key, owner string, lease time.Duration) (lock LockInfo, ok bool, err error)
+	RenewLock(ctx context.Context, key, owner string, lease time.Duration) (lock LockInfo, ok bool, err error)
+	ReleaseLock(ctx context.Context, key, owner string) (bool, error)
+	LockStatus(ctx context.Context, key string) (lock LockInfo, held bool, err error)
+
+	Close() error
+}
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+type LockInfo struct {
+	Owner     string
+	ExpiresAt time.Time
+}
+
+type ListOptions struct {
+	Prefix         string
+	After          string
+	Limit          int
+	IncludeDeleted bool
+}
+
+// ScanOptions select keys k with Start <= k < End (no upper bound for an
+// empty End) and k > After, whose value sizes are between MinSize and
+// MaxSize (no upper bound for 0). Limit 0 means no limit.
+type ScanOptions struct {
+	Start, End, After string
+	MinSize, MaxSize  int64
+	Limit             int
+}
+
+func (o ScanOptions) includes(key string, size int64) bool {
+	return key >= o.Start && key > o.After && (o.End == "" || key < o.End) &&
+		size >= o.MinSize && (o.MaxSize == 0 || size <= o.MaxSize)
+}
+
+// PurgeFilter matches the keys under Prefix created more than OlderThan
+// ago (any age for 0).
+type PurgeFilter struct {
+	Prefix    string
+	OlderThan time.Duration
+}
+
+func (f PurgeFilter) matches(key string, created, now time.Time) bool {
+	return strings.HasPrefix(key, f.Prefix) && (f.OlderThan == 0 || created.Before(now.Add(-f.OlderThan)))
+}
+
+// purgeMatch is PurgeFilter as SQL, with the prefix pattern as $1 and the
+// age in seconds as $2.
+const purgeMatch = `key LIKE $1 ESCAPE '\' AND ($2::float8 = 0 OR created_at < now() - make_interval(secs => $2::float8))`
+
+type ListedKey struct {
+	Key     string
+	Deleted bool
+}
+
+// liveRow is the condition for rows that reads can see.
+const liveRow = "deleted_at IS NULL AND (expires_at IS NULL OR expires_at > now())"
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// chunkedValue reassembles the streamed value of row v from the chunks of
+// the generation its manifest names.
+const chunkedValue = `(SELECT COALESCE(string_agg(c.data, '' ORDER BY c.seq), '') FROM kv_chunks c
+	JOIN kv_manifests m ON m.key = c.key AND m.generation = c.generation WHERE c.key = v.key)`
+
+// Get reassembles a streamed value in the same statement that finds the
+// row, so it never mixes chunks of two uploads.
+func (p *PostgresStore) Get(ctx context.Context, key string) (string, error) {
+	var value sql.NullString
+	var chunked []byte
+	err := p.db.QueryRowContext(ctx, `
+		SELECT v.value, CASE WHEN v.chunked_size IS NOT NULL THEN `+chunkedValue+` END
+		FROM kv_store v WHERE v.key = $1 AND `+liveRow, key).Scan(&value, &chunked)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if chunked != nil {
+		return string(chunked), err
+	}
+	return value.String, err
+}
+
+func (p *PostgresStore) GetBounded(ctx context.Context, key string, limit int64) (string, bool, error) {
+	var small sql.NullString
+	err := p.db.QueryRowContext(ctx, `
+		SELECT CASE WHEN chunked_size IS NULL AND (value IS NULL OR octet_length(value) <= $2) THEN COALESCE(value, '') END
+		FROM kv_store WHERE key = $1 AND `+liveRow,
+		key, limit).Scan(&small)
+	if err == sql.ErrNoRows {
+		return "", false, ErrNotFound
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return small.String, small.Valid, nil
+}
+
+// streamChunkChars is the size, in characters, of each chunk fetched when
+// streaming a value. Chunks are cut with substr so multi-byte UTF-8
+// sequences are never split.
+const streamChunkChars = 256 * 1024
+
+// Stream reads the value one chunk per row, cut from the value column or
+// taken from kv_chunks for a streamed value. It reads the row and its
+// manifest first, then the chunks, in one read-only repeatable read
+// transaction, so the length and every chunk come from a single snapshot
+// and a concurrent PutStream or sweep cannot change what it reads.
+func (p *PostgresStore) Stream(ctx context.Context, key string, fn func(total int64, chunk []byte) error) error {
+	tx, err := p.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var chunked bool
+	var generation, chunks, total sql.NullInt64
+	var checksum []byte
+	err = tx.QueryRowContext(ctx, `
+		SELECT v.chunked_size IS NOT NULL, m.generation, m.chunk_count, m.total_bytes, m.checksum
+		FROM kv_store v LEFT JOIN kv_manifests m ON m.key = v.key
+		WHERE v.key = $1 AND `+liveRow, key).Scan(&chunked, &generation, &chunks, &total, &checksum)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if chunked {
+		if !generation.Valid {
+			return &ChunkVerifyError{Key: key, Reason: "no manifest"}
+		}
+		return streamChunks(ctx, tx, key, chunkManifest{
+			generation: generation.Int64,
+			chunks:     int(chunks.Int64),
+			total:      total.Int64,
+			checksum:   checksum,
+		}, fn)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT octet_length(v.value)::bigint, convert_to(substr(v.value, g, $2), 'UTF8')
+		FROM kv_store v, generate_series(1, greatest(char_length(v.value), 1), $2) g
+		WHERE v.key = $1
+		ORDER BY g`,
+		key, streamChunkChars)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		var total int64
+		var chunk sql.RawBytes
+		if err := rows.Scan(&total, &chunk); err != nil {
+			return err
+		}
+		found = true
+		if err := fn(total, chunk); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// putChunkBytes is the size of the kv_chunks rows PutStream writes.
+const putChunkBytes = 1 << 20
+
+// PutStream writes the row and every chunk in one transaction, so readers
+// keep the previous value until the commit, and a failed read of body or a
+// cancelled ctx rolls all of it back. Only one chunk is held in memory. The
+// chunks go in as a new generation and the manifest naming it last; the
+// previous generation is left to the sweeper, as readers may still be
+// streaming it.
+func (p *PostgresStore) PutStream(ctx context.Context, key string, body io.Reader, ttl time.Duration) (bool, int64, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	var created bool
+	err = tx.QueryRowContext(ctx, `
+		WITH live AS (SELECT 1 FROM kv_store WHERE key = $1 AND `+liveRow+`),
+		     exp AS (SELECT CASE WHEN $2::float8 > 0 THEN now() + make_interval(secs => $2::float8) END AS at)
+		INSERT INTO kv_store (key, value, expires_at, chunked_size) VALUES ($1, NULL, (SELECT at FROM exp), 0)
+		ON CONFLICT (key) DO UPDATE SET value = NULL, chunked_size = 0, deleted_at = NULL, expires_at = EXCLUDED.expires_at, updated_at = now()
+		RETURNING NOT EXISTS (SELECT 1 FROM live)`,
+		key, ttl.Seconds()).Scan(&created)
+	if err != nil {
+		return false, 0, err
+	}
+	var generation int64
+	if err := tx.QueryRowContext(ctx, "SELECT nextval('kv_chunk_generations')").Scan(&generation); err != nil {
+		return false, 0, err
+	}
+
+	buf := make([]byte, putChunkBytes)
+	sum := sha256.New()
+	var size int64
+	chunks := 0
+	for seq := 0; ; seq++ {
+		n, readErr := io.ReadFull(body, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return false, 0, readErr
+		}
+		// An empty value still gets its one empty chunk, which Stream
+		// needs to find the row and the sweeper the generation.
+		if n > 0 || seq == 0 {
+			if _, err := tx.ExecContext(ctx,
+				"INSERT INTO kv_chunks (key, generation, seq, data) VALUES ($1, $2, $3, $4)", key, generation, seq, buf[:n]); err != nil {
+				return false, 0, err
+			}
+			sum.Write(buf[:n])
+			size += int64(n)
+			chunks++
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE kv_store SET chunked_size = $2 WHERE key = $1", key, size); err != nil {
+		return false, 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO kv_manifests (key, generation, chunk_count, total_bytes, checksum) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (key) DO UPDATE SET generation = EXCLUDED.generation, chunk_count = EXCLUDED.chunk_count,
+			total_bytes = EXCLUDED.total_bytes, checksum = EXCLUDED.checksum`,
+		key, generation, chunks, size, sum.Sum(nil)); err != nil {
+		return false, 0, err
+	}
+	return created, size, tx.Commit()
+}
+
+// The CTEs in Put and PutMany see the rows as they were before the upsert.
+func (p *PostgresStore) Put(ctx context.Context, key, value string) (bool, error) {
+	return p.PutTTL(ctx, key, value, 0)
+}
+
+const putTTLQuery = `
+	WITH live AS (SELECT 1 FROM kv_store WHERE key = $1 AND ` + liveRow + `),
+	     exp AS (SELECT CASE WHEN $3::float8 > 0 THEN now() + make_interval(secs => $3::float8) END AS at)
+	INSERT INTO kv_store (key, value, expires_at) VALUES ($1, $2, (SELECT at FROM exp))
+	ON CONFLICT (key) DO UPDATE SET value = $2, deleted_at = NULL, expires_at = EXCLUDED.expires_at, updated_at = now()
+	RETURNING NOT EXISTS (SELECT 1 FROM live)`
+
+func (p *PostgresStore) PutTTL(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	var created bool
+	err := p.db.QueryRowContext(ctx, putTTLQuery, key, value, ttl.Seconds()).Scan(&created)
+	return created, err
+}
+
+// modifiedSince is true for rows changed after $since, at the second
+// granularity of HTTP dates.
+const modifiedSince = "date_trunc('second', kv_store.updated_at) > $%d::timestamptz"
+
+// PutIfUnmodifiedSince makes the check part of the upsert: ON CONFLICT
+// locks the existing row and skips the update when the condition fails,
+// so no row is returned.
+func (p *PostgresStore) PutIfUnmodifiedSince(ctx context.Context, key, value string, ttl time.Duration, since time.Time) (bool, time.Time, error) {
+	var created bool
+	var modified time.Time
+	err := p.db.QueryRowContext(ctx, `
+		WITH live AS (SELECT 1 FROM kv_store WHERE key = $1 AND `+liveRow+`),
+		     exp AS (SELECT CASE WHEN $3::float8 > 0 THEN now() + make_interval(secs => $3::float8) END AS at)
+		INSERT INTO kv_store (key, value, expires_at) VALUES ($1, $2, (SELECT at FROM exp))
+		ON CONFLICT (key) DO UPDATE SET value = $2, deleted_at = NULL, expires_at = EXCLUDED.expires_at, updated_at = now()
+		WHERE NOT (kv_store.deleted_at IS NULL AND (kv_store.expires_at IS NULL OR kv_store.expires_at > now()))
+		   OR NOT `+fmt.Sprintf(modifiedSince, 4)+`
+		RETURNING NOT EXISTS (SELECT 1 FROM live), updated_at`,
+		key, value, ttl.Seconds(), since).Scan(&created, &modified)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, time.Time{}, ErrPreconditionFailed
+	}
+	return created, modified, err
+}
+
+func (p *PostgresStore) PutMany(ctx context.Context, entries []KeyValue) ([]bool, error) {
+	keys := make([]string, len(entries))
+	values := make([]string, len(entries))
+	index := make(map[string]int, len(entries))
+	for i, e := range entries {
+		keys[i], values[i] = e.Key, e.Value
+		index[e.Key] = i
+	}
+	rows, err := p.db.QueryContext(ctx, `
+		WITH live AS (SELECT key FROM kv_store WHERE key = ANY($1) AND `+liveRow+`)
+		INSERT INTO kv_store (key, value)
+		SELECT * FROM unnest($1::text[], $2::text[])
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, deleted_at = NULL, expires_at = NULL, updated_at = now()
+		RETURNING key, key NOT IN (SELECT key FROM live)`,
+		keys, values)
+	if err != nil {
+		return nil, duplicateKeysError(err)
+	}
+	defer rows.Close()
+
+	created := make([]bool, len(entries))
+	for rows.Next() {
+		var key string
+		var c bool
+		if err := rows.Scan(&key, &c); err != nil {
+			return nil, err
+		}
+		created[index[key]] = c
+	}
+	return created, duplicateKeysError(rows.Err())
+}
+
+// cardinalityViolation is the SQLSTATE of ON CONFLICT DO UPDATE affecting
+// a row twice.
+const cardinalityViolation = "21000"
+
+// duplicateKeysError turns the error an upsert gets for updating a row
+// twice into ErrDuplicateKeys.
+func duplicateKeysError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == cardinalityViolation {
+		return fmt.Errorf("%w: %v", ErrDuplicateKeys, err)
+	}
+	return err
+}
+
+func (p *PostgresStore) Delete(ctx context.Context, key string) (bool, error) {
+	var live bool
+	err := p.db.QueryRowContext(ctx,
+		"DELETE FROM kv_store WHERE key = $1 RETURNING "+liveRow, key).Scan(&live)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return live, err
+}
+
+func (p *PostgresStore) SoftDelete(ctx context.Context, key string) (bool, error) {
+	res, err := p.db.ExecContext(ctx,
+		"UPDATE kv_store SET deleted_at = now(), updated_at = now() WHERE key = $1 AND "+liveRow, key)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteIfUnmodifiedSince checks the condition in the DELETE or UPDATE
+// itself, which Postgres re-evaluates against a concurrently updated row.
+// The live CTE only tells a failed condition from a missing key.
+func (p *PostgresStore) DeleteIfUnmodifiedSince(ctx context.Context, key string, since time.Time, soft bool) (bool, error) {
+	write := "DELETE FROM kv_store"
+	if soft {
+		write = "UPDATE kv_store SET deleted_at = now(), updated_at = now()"
+	}
+	var live, deleted bool
+	err := p.db.QueryRowContext(ctx, `
+		WITH live AS (SELECT 1 FROM kv_store WHERE key = $1 AND `+liveRow+`),
+		     done AS (`+write+` WHERE key = $1 AND `+liveRow+` AND NOT `+fmt.Sprintf(modifiedSince, 2)+` RETURNING 1)
+		SELECT EXISTS (SELECT 1 FROM live), EXISTS (SELECT 1 FROM done)`,
+		key, since).Scan(&live, &deleted)
+	if err == nil && live && !deleted {
+		err = ErrPreconditionFailed
+	}
+	return deleted, err
+}
+
+func (p *PostgresStore) Undelete(ctx context.Context, key string, retention time.Duration) (bool, error) {
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE kv_store SET deleted_at = NULL, updated_at = now()
+		WHERE key = $1 AND deleted_at > now() - make_interval(secs => $2)`,
+		key, retention.Seconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (p *PostgresStore) PurgeDeleted(ctx context.Context, retention time.Duration) (int64, error) {
+	res, err := p.db.ExecContext(ctx,
+		"DELETE FROM kv_store WHERE deleted_at <= now() - make_interval(secs => $1)", retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// SweepExpired picks expired rows through the partial expires_at index and
+// locks them with SKIP LOCKED, so sweepers on several servers take
+// disjoint batches, then deletes them by primary key.
+func (p *PostgresStore) SweepExpired(ctx context.Context, limit int) ([]string, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		WITH expired AS (
+			SELECT key FROM kv_store
+			WHERE expires_at IS NOT NULL AND expires_at <= now()
+			ORDER BY expires_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		DELETE FROM kv_store k USING expired e WHERE k.key = e.key
+		RETURNING k.key`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (p *PostgresStore) CountPurge(ctx context.Context, f PurgeFilter) (int64, error) {
+	var n int64
+	err := p.db.QueryRowContext(ctx, `SELECT count(*) FROM kv_store WHERE `+purgeMatch,
+		escapeLike(f.Prefix)+"%", f.OlderThan.Seconds()).Scan(&n)
+	return n, err
+}
+
+func (p *PostgresStore) PurgeBatch(ctx context.Context, f PurgeFilter, limit int) ([]string, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		WITH doomed AS (
+			SELECT key FROM kv_store WHERE `+purgeMatch+`
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		DELETE FROM kv_store k USING doomed d WHERE k.key = d.key
+		RETURNING k.key`,
+		escapeLike(f.Prefix)+"%", f.OlderThan.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (p *PostgresStore) ExpiryLag(ctx context.Context) (time.Duration, error) {
+	var secs sql.NullFloat64
+	err := p.db.QueryRowContext(ctx, `
+		SELECT extract(epoch FROM now() - min(expires_at)) FROM kv_store
+		WHERE expires_at IS NOT NULL AND expires_at <= now()`).Scan(&secs)
+	if err != nil || !secs.Valid {
+		return 0, err
+	}
+	return time.Duration(secs.Float64 * float64(time.Second)), nil
+}
+
+func (p *PostgresStore) List(ctx context.Context, opts ListOptions) ([]ListedKey, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT key, deleted_at IS NOT NULL FROM kv_store
+		WHERE key LIKE $1 ESCAPE '\' AND key > $2 AND (deleted_at IS NULL OR $4)
+		  AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY key LIMIT $3`,
+		escapeLike(opts.Prefix)+"%", opts.After, opts.Limit, opts.IncludeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []ListedKey{}
+	for rows.Next() {
+		var k ListedKey
+		if err := rows.Scan(&k.Key, &k.Deleted); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Scan reassembles streamed values like Get. The rows are read as the
+// driver receives them, so a long scan never holds its result in memory.
+func (p *PostgresStore) Scan(ctx context.Context, opts ScanOptions, fn func(key, value string) error) error {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT v.key, v.value, CASE WHEN v.chunked_size IS NOT NULL THEN `+chunkedValue+` END
+		FROM kv_store v
+		WHERE v.key >= $1 AND v.key > $2 AND ($3 = '' OR v.key < $3) AND `+liveRow+`
+		  AND COALESCE(v.chunked_size, octet_length(v.value), 0) >= $4
+		  AND ($5 = 0 OR COALESCE(v.chunked_size, octet_length(v.value), 0) <= $5)
+		ORDER BY v.key LIMIT NULLIF($6, 0)`,
+		opts.Start, opts.After, opts.End, opts.MinSize, opts.MaxSize, opts.Limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value sql.NullString
+		var chunked []byte
+		if err := rows.Scan(&key, &value, &chunked); err != nil {
+			return err
+		}
+		v := value.String
+		if chunked != nil {
+			v = string(chunked)
+		}
+		if err := fn(key, v); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (p *PostgresStore) UsedBytes(ctx context.Context, prefix string) (int64, error) {
+	var n int64
+	err := p.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(COALESCE(chunked_size, octet_length(value), 0)), 0)::bigint
+		FROM kv_store WHERE key LIKE $1 ESCAPE '\'`, escapeLike(prefix)+"%").Scan(&n)
+	return n, err
+}
+
+func (p *PostgresStore) AcquireLock(ctx context.Context, key, owner string, lease time.Duration) (LockInfo, bool, error) {
+	var lock LockInfo
+	err := p.db.QueryRowContext(ctx, `
+		INSERT INTO kv_locks (key, owner, expires_at)
+		VALUES ($1, $2, now() + make_interval(secs => $3))
+		ON CONFLICT (key) DO UPDATE SET owner = EXCLUDED.owner, expires_at = EXCLUDED.expires_at
+		WHERE kv_locks.expires_at <= now()
+		RETURNING owner, expires_at`,
+		key, owner, lease.Seconds()).Scan(&lock.Owner, &lock.ExpiresAt)
+	if err == nil {
+		return lock, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return LockInfo{}, false, err
+	}
+	lock, _, err = p.LockStatus(ctx, key)
+	return lock, false, err
+}
+
+func (p *PostgresStore) RenewLock(ctx context.Context, key, owner string, lease time.Duration) (LockInfo, bool, error) {
+	var lock LockInfo
+	err := p.db.QueryRowContext(ctx, `
+		UPDATE kv_locks SET expires_at = now() + make_interval(secs => $3)
+		WHERE key = $1 AND owner = $2 AND expires_at > now()
+		RETURNING owner, expires_at`,
+		key, owner, lease.Seconds()).Scan(&lock.Owner, &lock.ExpiresAt)
+	if err == sql.ErrNoRows {
+		lock, _, err = p.LockStatus(ctx, key)
+		return lock, false, err
+	}
+	return lock, err == nil, err
+}
+
+func (p *PostgresStore) ReleaseLock(ctx context.Context, key, owner string) (bool, error) {
+	res, err := p.db.ExecContext(ctx,
+		"DELETE FROM kv_locks WHERE key = $1 AND owner = $2 AND expires_at > now()", key, owner)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (p *PostgresStore) LockStatus(ctx context.Context, key string) (LockInfo, bool, error) {
+	var lock LockInfo
+	err := p.db.QueryRowContext(ctx,
+		"SELECT owner, expires_at FROM kv_locks WHERE key = $1 AND expires_at > now()",
+		key).Scan(&lock.Owner, &lock.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return LockInfo{}, false, nil
+	}
+	return lock, err == nil, err
+}
+
+func (p *PostgresStore) Ping(ctx context.Context) error {
+	return p.db.PingContext(ctx)
+}
+
+func (p *PostgresStore) Close() error {
+	return p.db.Close()
+}
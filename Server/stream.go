@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// streamValue copies a value too large for the cache straight from the store
+// to the response so it is never held in memory whole.
+func (s *Server) streamValue(w http.ResponseWriter, r *http.Request, key string) {
+	markStage(r.Context(), stageStream)
+	w.Header().Set("X-Cache", "BYPASS")
+	// Timings go out as trailers, which a Content-Length would rule out.
+	timing := timingFrom(r.Context())
+	start := time.Now()
+	started := false
+	err := s.store.Stream(r.Context(), key, func(total int64, chunk []byte) error {
+		if !started {
+			if timing == nil {
+				w.Header().Set("Content-Length", strconv.FormatInt(total, 10))
+			}
+			timing.useTrailers(w.Header())
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		_, err := w.Write(chunk)
+		return err
+	})
+	timing.dbSince(start)
+	if started {
+		timing.set(w.Header())
+	}
+
+	var verifyErr *ChunkVerifyError
+	if errors.As(err, &verifyErr) {
+		atomic.AddInt64(&s.chunkVerifyFailures, 1)
+		log.Printf("Streamed value failed verification: key=%q generation=%d reason=%q sent=%t",
+			key, verifyErr.Generation, verifyErr.Reason, started)
+	}
+	switch {
+	case started && verifyErr != nil:
+		// The status is out, so cut the connection rather than end the
+		// body as if the value were whole.
+		panic(http.ErrAbortHandler)
+	case started && err != nil:
+		log.Printf("Streaming key %q aborted: %v", key, err)
+	case started:
+		atomic.AddInt64(&s.streamedGets, 1)
+	case verifyErr != nil:
+		writeJSON(w, http.StatusBadGateway, chunkVerifyResponse{
+			Error:      "Stored chunks do not match the value's manifest",
+			Key:        key,
+			Generation: verifyErr.Generation,
+			Reason:     verifyErr.Reason,
+		})
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "Key not found", http.StatusNotFound)
+	default:
+		s.dbError(w)
+	}
+}
+
+// bodyReader remembers the first error reading the request body, to tell
+// a client failure from a store failure.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// streamPut writes a body above -stream-threshold, or of unknown length,
+// through the store in chunks. Like streamed GETs it bypasses the cache;
+// an upload cut short leaves the previous value in place.
+func (s *Server) streamPut(w http.ResponseWriter, r *http.Request, key string, ttl time.Duration) {
+	markStage(r.Context(), stageStream)
+	if s.keys != nil {
+		defer s.keys.adding(key)()
+	}
+	// Without a Content-Length, only a quota that is already full rejects
+	// the upload up front.
+	old := s.cachedSize(key)
+	if s.overQuota(w, key, max(r.ContentLength, 1), old) {
+		return
+	}
+	body := &bodyReader{r: http.MaxBytesReader(w, r.Body, s.maxValueBytes)}
+	created, size, err := s.store.PutStream(r.Context(), key, body, ttl)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(body.err, &tooLarge):
+		http.Error(w, "Value too large", http.StatusRequestEntityTooLarge)
+		return
+	case body.err != nil || r.Context().Err() != nil:
+		log.Printf("Streamed PUT of key %q aborted, previous value kept: %v", key, err)
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	case err != nil:
+		s.dbError(w)
+		return
+	}
+	s.cache.Delete(key)
+	s.prefixes.recordPut(key)
+	s.quota.written(key, size, old, created)
+	atomic.AddInt64(&s.streamedPuts, 1)
+	w.Header().Set("X-Created", strconv.FormatBool(created))
+	s.durability.written(w, durabilityDB)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamLargeValue(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	value := strings.Repeat("0123456789", int(s.streamThreshold)/10+1)
+	if status, body, _ := do(t, "PUT", ts.URL+"/kv/big", value); status != http.StatusOK {
+		t.Fatalf("PUT: status %d (%s)", status, body)
+	}
+	if n := atomic.LoadInt64(&s.streamedPuts); n != 1 {
+		t.Errorf("%d streamed PUTs, want 1", n)
+	}
+	for range 2 {
+		status, body, h := do(t, "GET", ts.URL+"/kv/big", "")
+		if status != http.StatusOK || body != value {
+			t.Fatalf("GET: status %d, %d bytes, want %d", status, len(body), len(value))
+		}
+		if got := h.Get("X-Cache"); got != "BYPASS" {
+			t.Errorf("X-Cache = %q, want BYPASS", got)
+		}
+		if got := h.Get("Content-Length"); got != strconv.Itoa(len(value)) {
+			t.Errorf("Content-Length = %q, want %d", got, len(value))
+		}
+	}
+	if _, ok := s.cache.Get("big"); ok {
+		t.Errorf("streamed value was cached")
+	}
+	// A streamed GET is counted once its body is out, which the client
+	// can see before the handler gets there.
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&s.streamedGets) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&s.streamedGets); n != 2 {
+		t.Errorf("%d streamed GETs, want 2", n)
+	}
+
+	// At the threshold the value goes through the cache as usual.
+	small := value[:s.streamThreshold]
+	do(t, "PUT", ts.URL+"/kv/small", small)
+	_, body, h := do(t, "GET", ts.URL+"/kv/small", "")
+	if body != small || h.Get("X-Cache") != "HIT" {
+		t.Errorf("GET small: %d bytes, X-Cache %q; want %d bytes, HIT", len(body), h.Get("X-Cache"), len(small))
+	}
+}
+
+func TestUncacheableValue(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	s.cache.maxEntryBytes = 100
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	value := strings.Repeat("x", 101)
+	do(t, "PUT", ts.URL+"/kv/k", value)
+	for range 2 {
+		_, body, h := do(t, "GET", ts.URL+"/kv/k", "")
+		if body != value || h.Get("X-Cache") != "UNCACHEABLE" {
+			t.Fatalf("GET: %d bytes, X-Cache %q; want %d bytes, UNCACHEABLE", len(body), h.Get("X-Cache"), len(value))
+		}
+	}
+}
+
+func TestStreamPutChunked(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	// Without a Content-Length the body is streamed, however small.
+	value := strings.Repeat("0123456789", 1000)
+	req, _ := http.NewRequest("PUT", ts.URL+"/kv/k", &chunkedReader{data: []byte(value)})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt64(&s.streamedPuts); resp.StatusCode != http.StatusOK || n != 1 {
+		t.Fatalf("chunked PUT: status %d, %d streamed PUTs", resp.StatusCode, n)
+	}
+	if _, body, _ := do(t, "GET", ts.URL+"/kv/k", ""); body != value {
+		t.Errorf("GET: %d bytes, want %d", len(body), len(value))
+	}
+
+	s.maxValueBytes = 1000
+	req, _ = http.NewRequest("PUT", ts.URL+"/kv/k", &chunkedReader{data: []byte(value)})
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked PUT over -max-value-bytes: status %d, want 413", resp.StatusCode)
+	}
+	if _, body, _ := do(t, "GET", ts.URL+"/kv/k", ""); body != value {
+		t.Errorf("GET after a rejected PUT: %d bytes, want the previous %d", len(body), len(value))
+	}
+}
+
+// putStreamSignal reports each PutStream's error once it returns.
+type putStreamSignal struct {
+	Store
+	done chan error
+}
+
+func (p *putStreamSignal) PutStream(ctx context.Context, key string, body io.Reader, ttl time.Duration) (bool, int64, error) {
+	created, size, err := p.Store.PutStream(ctx, key, body, ttl)
+	p.done <- err
+	return created, size, err
+}
+
+func TestStreamPutAborted(t *testing.T) {
+	store := &putStreamSignal{Store: NewMemStore(), done: make(chan error, 1)}
+	s := newTestServer(store)
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	do(t, "PUT", ts.URL+"/kv/k", "old")
+
+	// Promise 10MB, send 3MB and hang up.
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(c, "PUT /kv/k HTTP/1.1\r\nHost: kv\r\nContent-Length: %d\r\n\r\n", 10<<20)
+	io.WriteString(c, strings.Repeat("x", 3<<20))
+	c.Close()
+
+	select {
+	case err := <-store.done:
+		if err == nil {
+			t.Fatal("PutStream of a cut-short body succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PutStream still running after the client hung up")
+	}
+	if _, body, _ := do(t, "GET", ts.URL+"/kv/k", ""); body != "old" {
+		t.Errorf("GET after the aborted upload: %d bytes, want the previous value", len(body))
+	}
+	if n := atomic.LoadInt64(&s.streamedPuts); n != 0 {
+		t.Errorf("%d streamed PUTs counted, want 0", n)
+	}
+}
+
+func TestUncacheableWrites(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	s.cache.maxEntryBytes = 100
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	large := strings.Repeat("x", 101)
+
+	// A plain PUT and a batch entry over the limit each drop the smaller
+	// value cached before them.
+	do(t, "PUT", ts.URL+"/kv/a", "small")
+	do(t, "PUT", ts.URL+"/kv/b", "small")
+	do(t, "PUT", ts.URL+"/kv/a", large)
+	do(t, "POST", ts.URL+"/kv/", `{"entries":[{"key":"b","value":"`+large+`"},{"key":"c","value":"small"}]}`)
+	for _, k := range []string{"a", "b"} {
+		if _, ok := s.cache.Peek(k); ok {
+			t.Errorf("%s still cached after a write over the limit", k)
+		}
+		if _, body, h := do(t, "GET", ts.URL+"/kv/"+k, ""); body != large || h.Get("X-Cache") != "UNCACHEABLE" {
+			t.Errorf("GET %s: %d bytes, X-Cache %q; want %d bytes, UNCACHEABLE", k, len(body), h.Get("X-Cache"), len(large))
+		}
+	}
+	if h := xCache(t, ts.URL+"/kv/c"); h != "HIT" {
+		t.Errorf("GET c: X-Cache %q, want HIT for a batch entry under the limit", h)
+	}
+
+	// Two writes and two reads were kept out.
+	st := s.stats()
+	if st.CacheMaxEntryBytes != 100 || st.CacheUncacheable != 4 {
+		t.Errorf("stats: max entry bytes %d, uncacheable %d; want 100, 4", st.CacheMaxEntryBytes, st.CacheUncacheable)
+	}
+	if _, body, _ := do(t, "GET", ts.URL+"/metrics", ""); !strings.Contains(body, "kv_cache_uncacheable_values_total 4\n") {
+		t.Error("/metrics lacks kv_cache_uncacheable_values_total 4")
+	}
+}
+
+// xCache GETs url and returns its X-Cache.
+func xCache(t *testing.T, url string) string {
+	t.Helper()
+	_, _, h := do(t, "GET", url, "")
+	return h.Get("X-Cache")
+}
+
+// TestUncacheableKeepsHotKeys reads 50 small hot keys between reads of
+// many large values, through a cache with room for 100 entries. Without
+// -cache-max-entry-bytes the large values evict the hot keys; with it the
+// hot keys keep hitting.
+func TestUncacheableKeepsHotKeys(t *testing.T) {
+	for _, tc := range []struct {
+		maxEntryBytes int64
+		minRate       float64
+		maxRate       float64
+	}{
+		{0, 0, 0.5},
+		{1000, 0.99, 1},
+	} {
+		t.Run(fmt.Sprint(tc.maxEntryBytes), func(t *testing.T) {
+			s := newTestServer(NewMemStore())
+			s.cache = NewShardedCache(100, 1)
+			s.cache.maxEntryBytes = tc.maxEntryBytes
+			ts := httptest.NewServer(s.routes())
+			defer ts.Close()
+			ctx := context.Background()
+			large := strings.Repeat("x", 2000)
+			for i := range 50 {
+				s.store.Put(ctx, fmt.Sprint("hot", i), "v")
+			}
+			for i := range 1000 {
+				s.store.Put(ctx, fmt.Sprint("large", i), large)
+			}
+
+			var hits, reads int
+			next := 0
+			for round := range 4 {
+				for i := range 50 {
+					cache := xCache(t, ts.URL+fmt.Sprint("/kv/hot", i))
+					// The first round only fills the cache.
+					if round > 0 {
+						reads++
+						if cache == "HIT" {
+							hits++
+						}
+					}
+					for range 2 {
+						xCache(t, ts.URL+fmt.Sprint("/kv/large", next))
+						next++
+					}
+				}
+			}
+			if rate := float64(hits) / float64(reads); rate < tc.minRate || rate > tc.maxRate {
+				t.Errorf("hot key hit rate %.2f, want between %.2f and %.2f", rate, tc.minRate, tc.maxRate)
+			}
+		})
+	}
+}
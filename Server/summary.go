@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestStats counts every request by method and status, the peak number
+// in flight, and the most requested keys. It is updated on the request
+// path, so summary only copies.
+type requestStats struct {
+	started time.Time
+
+	mu       sync.Mutex
+	byStatus map[string]map[int]int64
+	hot      hotKeys
+
+	inflight    int64
+	maxInflight int64
+	dbErrors    int64
+
+	// window holds the cache's cumulative hits and misses once a second
+	// for the last minute, oldest first.
+	windowMu sync.Mutex
+	window   []hitSample
+}
+
+type hitSample struct{ hits, misses int64 }
+
+const hotKeyCounters = 64
+
+// hotKeys is a space-saving sketch: it tracks hotKeyCounters keys, and a
+// new key replaces the least counted one, inheriting its count. Counts
+// are therefore upper bounds, but any key requested more often than
+// 1/hotKeyCounters of the time is guaranteed to be present.
+type hotKeys map[string]int64
+
+func (h hotKeys) add(key string) {
+	if _, ok := h[key]; ok || len(h) < hotKeyCounters {
+		h[key]++
+		return
+	}
+	var minKey string
+	var minCount int64 = -1
+	for k, n := range h {
+		if minCount < 0 || n < minCount {
+			minKey, minCount = k, n
+		}
+	}
+	delete(h, minKey)
+	h[key] = minCount + 1
+}
+
+type hotKey struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+type hitRate struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+type serverSummary struct {
+	Build         buildInfo                   `json:"build"`
+	GeneratedAt   time.Time                   `json:"generated_at"`
+	StartedAt     time.Time                   `json:"started_at"`
+	UptimeSeconds float64                     `json:"uptime_seconds"`
+	Requests      int64                       `json:"requests"`
+	ByMethod      map[string]map[string]int64 `json:"requests_by_method"`
+	Cache         hitRate                     `json:"cache"`
+	CacheLastMin  hitRate                     `json:"cache_last_minute"`
+	Evictions     map[string]int64            `json:"evictions"`
+	HotKeys       []hotKey                    `json:"hot_keys"`
+	DBErrors      int64                       `json:"db_errors"`
+	MaxInflight   int64                       `json:"max_inflight"`
+	// CacheEfficiency is only set with -cache-efficiency-window.
+	CacheEfficiency *cacheEfficiencyStats `json:"cache_efficiency,omitempty"`
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{
+		started:  time.Now(),
+		byStatus: make(map[string]map[int]int64),
+		hot:      make(hotKeys),
+	}
+}
+
+func (rs *requestStats) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&rs.inflight, 1)
+		for {
+			peak := atomic.LoadInt64(&rs.maxInflight)
+			if n <= peak || atomic.CompareAndSwapInt64(&rs.maxInflight, peak, n) {
+				break
+			}
+		}
+		rec := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		atomic.AddInt64(&rs.inflight, -1)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		key, isKey := strings.CutPrefix(r.URL.Path, "/kv/")
+		isKey = isKey && key != "" && !strings.Contains(key, "/")
+		method := methodLabel(r.Method)
+		rs.mu.Lock()
+		m := rs.byStatus[method]
+		if m == nil {
+			m = make(map[int]int64)
+			rs.byStatus[method] = m
+		}
+		m[rec.status]++
+		if isKey {
+			rs.hot.add(sketchKey(key))
+		}
+		rs.mu.Unlock()
+	})
+}
+
+// sampleLoop records the cache counters every second for the last-minute
+// hit rate.
+func (rs *requestStats) sampleLoop(c *Cache) {
+	for range time.Tick(time.Second) {
+		s := hitSample{atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)}
+		rs.windowMu.Lock()
+		rs.window = append(rs.window, s)
+		if len(rs.window) > 61 {
+			rs.window = rs.window[1:]
+		}
+		rs.windowMu.Unlock()
+	}
+}
+
+func newHitRate(hits, misses int64) hitRate {
+	h := hitRate{Hits: hits, Misses: misses}
+	if hits+misses > 0 {
+		h.HitRate = float64(hits) / float64(hits+misses) * 100
+	}
+	return h
+}
+
+// summary snapshots the counters while traffic keeps flowing.
+func (s *Server) summary() serverSummary {
+	rs := s.requests
+	now := time.Now()
+	sum := serverSummary{
+		Build:         currentBuild(),
+		GeneratedAt:   now.UTC(),
+		StartedAt:     rs.started.UTC(),
+		UptimeSeconds: now.Sub(rs.started).Seconds(),
+		ByMethod:      make(map[string]map[string]int64),
+		Evictions:     s.cache.Evictions(),
+		DBErrors:      atomic.LoadInt64(&rs.dbErrors),
+		MaxInflight:   atomic.LoadInt64(&rs.maxInflight),
+
+		CacheEfficiency: s.optimal.stats(),
+	}
+
+	rs.mu.Lock()
+	for method, statuses := range rs.byStatus {
+		m := make(map[string]int64, len(statuses))
+		for status, n := range statuses {
+			m[strconv.Itoa(status)] = n
+			sum.Requests += n
+		}
+		sum.ByMethod[method] = m
+	}
+	for k, n := range rs.hot {
+		sum.HotKeys = append(sum.HotKeys, hotKey{k, n})
+	}
+	rs.mu.Unlock()
+	sort.Slice(sum.HotKeys, func(i, j int) bool {
+		a, b := sum.HotKeys[i], sum.HotKeys[j]
+		return a.Count > b.Count || a.Count == b.Count && a.Key < b.Key
+	})
+	sum.HotKeys = sum.HotKeys[:min(10, len(sum.HotKeys))]
+
+	h, m := atomic.LoadInt64(&s.cache.hits), atomic.LoadInt64(&s.cache.misses)
+	sum.Cache = newHitRate(h, m)
+	rs.windowMu.Lock()
+	if len(rs.window) > 0 {
+		oldest := rs.window[0]
+		sum.CacheLastMin = newHitRate(h-oldest.hits, m-oldest.misses)
+	} else {
+		sum.CacheLastMin = sum.Cache
+	}
+	rs.windowMu.Unlock()
+	return sum
+}
+
+// reportHandler serves GET /admin/report.
+func (s *Server) reportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.summary())
+}
+
+// logSummary writes the final summary to the log and, if path is set, to
+// that file.
+func (s *Server) logSummary(path string) {
+	data, err := json.MarshalIndent(s.summary(), "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode shutdown report: %v", err)
+		return
+	}
+	log.Printf("Shutdown report:\n%s", data)
+	if e := s.optimal.stats(); e != nil && e.EstimatedOptimalHitRate != nil && e.SampledGets > 0 {
+		log.Printf("Cache hit rate over the last %s: %.1f%% of an achievable ~%.1f%% (approximate, from %d sampled GETs)",
+			time.Duration(e.WindowSeconds*float64(time.Second)), e.ActualHitRate, *e.EstimatedOptimalHitRate, e.SampledGets)
+	}
+	if path == "" {
+		return
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		log.Printf("Failed to write -shutdown-report: %v", err)
+	}
+}
+
+// dbError answers 500 for a failed store call and counts it.
+func (s *Server) dbError(w http.ResponseWriter) {
+	atomic.AddInt64(&s.requests.dbErrors, 1)
+	http.Error(w, "Database error", http.StatusInternalServerError)
+}
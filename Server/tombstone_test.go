@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func tombstoneTestServer(t *testing.T, ttl time.Duration) (*Server, *MemStore, string) {
+	m := NewMemStore()
+	s := newTestServer(m)
+	s.tombstoneTTL = ttl
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+	return s, m, ts.URL
+}
+
+func TestTombstoneHidesLaggingStore(t *testing.T) {
+	_, m, url := tombstoneTestServer(t, 100*time.Millisecond)
+	do(t, "PUT", url+"/kv/k", "old")
+	do(t, "DELETE", url+"/kv/k", "")
+	// The row reappears, as it would on a replica that has not seen the
+	// delete yet; within the window GETs still answer 404.
+	m.Put(context.Background(), "k", "old")
+	for range 3 {
+		if status, _, h := do(t, "GET", url+"/kv/k", ""); status != http.StatusNotFound || h.Get("X-Cache") != "NEGATIVE" {
+			t.Fatalf("GET during the tombstone: status %d, X-Cache %q; want 404, NEGATIVE", status, h.Get("X-Cache"))
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+	if status, body, _ := do(t, "GET", url+"/kv/k", ""); status != http.StatusOK || body != "old" {
+		t.Errorf("GET after the tombstone expired: status %d, %q; want the store's value", status, body)
+	}
+}
+
+func TestPutReplacesTombstone(t *testing.T) {
+	s, _, url := tombstoneTestServer(t, time.Minute)
+	do(t, "PUT", url+"/kv/k", "old")
+	do(t, "DELETE", url+"/kv/k", "")
+	if !s.cache.Tombstoned("k") {
+		t.Fatalf("DELETE left no tombstone")
+	}
+	do(t, "PUT", url+"/kv/k", "new")
+	if s.cache.Tombstoned("k") {
+		t.Errorf("tombstone survived the PUT")
+	}
+	if status, body, h := do(t, "GET", url+"/kv/k", ""); status != http.StatusOK || body != "new" || h.Get("X-Cache") != "HIT" {
+		t.Errorf("GET after the PUT: status %d, %q, X-Cache %q", status, body, h.Get("X-Cache"))
+	}
+}
+
+func TestFillDoesNotReplaceTombstone(t *testing.T) {
+	c := NewCache(10)
+	token := c.FillToken("k")
+	c.Tombstone("k", "delete", time.Minute)
+	// A read that started before the delete, and one that starts after,
+	// both leave the tombstone in place.
+	c.Fill("k", "old", token)
+	c.Fill("k", "old", c.FillToken("k"))
+	if !c.Tombstoned("k") {
+		t.Errorf("read-through fill replaced the tombstone")
+	}
+}
+
+func TestTombstoneStats(t *testing.T) {
+	s, _, url := tombstoneTestServer(t, time.Minute)
+	s.softDelete = true
+	s.softDeleteRetention = time.Hour
+	for _, k := range []string{"a", "b"} {
+		do(t, "PUT", url+"/kv/"+k, "v")
+		do(t, "DELETE", url+"/kv/"+k, "")
+	}
+	s.softDelete = false
+	do(t, "PUT", url+"/kv/c", "v")
+	do(t, "DELETE", url+"/kv/c", "")
+
+	_, body, _ := do(t, "GET", url+"/stats", "")
+	var st struct {
+		Tombstones map[string]int `json:"tombstones"`
+	}
+	if err := json.Unmarshal([]byte(body), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Tombstones["soft-delete"] != 2 || st.Tombstones["delete"] != 1 {
+		t.Errorf("/stats tombstones = %v, want 2 soft-delete and 1 delete", st.Tombstones)
+	}
+}
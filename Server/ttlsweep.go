@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ttlSweeper deletes expired keys in batches every interval and drops them
+// from the cache. It also deletes the chunk generations streamed values no
+// longer use.
+type ttlSweeper struct {
+	store    Store
+	cache    *Cache
+	interval time.Duration
+	batch    int
+
+	sweeps        int64
+	batches       int64
+	rows          int64
+	lastBatchRows int64
+	maxBatchRows  int64
+	failed        int64
+	lagNanos      int64
+	// chunkGenerations counts the superseded chunk generations deleted.
+	chunkGenerations int64
+}
+
+type ttlSweeperStats struct {
+	Sweeps        int64   `json:"sweeps"`
+	Batches       int64   `json:"batches"`
+	RowsSwept     int64   `json:"rows_swept"`
+	LastBatchRows int64   `json:"last_batch_rows"`
+	MaxBatchRows  int64   `json:"max_batch_rows"`
+	Failed        int64   `json:"failed_sweeps"`
+	LagSeconds    float64 `json:"lag_seconds"`
+
+	ChunkGenerationsSwept int64 `json:"chunk_generations_swept"`
+}
+
+func newTTLSweeper(store Store, cache *Cache, interval time.Duration, batch int) *ttlSweeper {
+	return &ttlSweeper{store: store, cache: cache, interval: interval, batch: batch}
+}
+
+func (t *ttlSweeper) loop() {
+	for range time.Tick(t.interval) {
+		if err := t.sweep(context.Background()); err != nil {
+			atomic.AddInt64(&t.failed, 1)
+			log.Printf("TTL sweep failed: %v", err)
+		}
+	}
+}
+
+// sweep deletes batches until one comes back short, then records how far
+// behind the oldest remaining expired key is and deletes the superseded
+// chunk generations, in batches the same way.
+func (t *ttlSweeper) sweep(ctx context.Context) error {
+	atomic.AddInt64(&t.sweeps, 1)
+	for {
+		keys, err := t.store.SweepExpired(ctx, t.batch)
+		for _, k := range keys {
+			t.cache.Delete(k)
+		}
+		n := int64(len(keys))
+		atomic.AddInt64(&t.batches, 1)
+		atomic.AddInt64(&t.rows, n)
+		atomic.StoreInt64(&t.lastBatchRows, n)
+		if n > atomic.LoadInt64(&t.maxBatchRows) {
+			atomic.StoreInt64(&t.maxBatchRows, n)
+		}
+		if err != nil {
+			return err
+		}
+		if n < int64(t.batch) {
+			break
+		}
+	}
+	lag, err := t.store.ExpiryLag(ctx)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&t.lagNanos, int64(lag))
+	for {
+		n, err := sweepChunks(ctx, t.store, t.batch)
+		atomic.AddInt64(&t.chunkGenerations, n)
+		if err != nil {
+			return err
+		}
+		if n < int64(t.batch) {
+			return nil
+		}
+	}
+}
+
+func (t *ttlSweeper) stats() *ttlSweeperStats {
+	if t == nil {
+		return nil
+	}
+	return &ttlSweeperStats{
+		Sweeps:        atomic.LoadInt64(&t.sweeps),
+		Batches:       atomic.LoadInt64(&t.batches),
+		RowsSwept:     atomic.LoadInt64(&t.rows),
+		LastBatchRows: atomic.LoadInt64(&t.lastBatchRows),
+		MaxBatchRows:  atomic.LoadInt64(&t.maxBatchRows),
+		Failed:        atomic.LoadInt64(&t.failed),
+		LagSeconds:    time.Duration(atomic.LoadInt64(&t.lagNanos)).Seconds(),
+
+		ChunkGenerationsSwept: atomic.LoadInt64(&t.chunkGenerations),
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTTLSweepBatches(t *testing.T) {
+	m := NewMemStore()
+	c := NewCache(1000)
+	ctx := context.Background()
+	for i := range 250 {
+		k := fmt.Sprintf("short-%d", i)
+		m.PutTTL(ctx, k, "v", time.Millisecond)
+		c.SetTTL(k, "v", time.Hour)
+	}
+	m.PutTTL(ctx, "long", "v", time.Hour)
+	m.Put(ctx, "forever", "v")
+	time.Sleep(5 * time.Millisecond)
+	if lag, _ := m.ExpiryLag(ctx); lag <= 0 {
+		t.Fatalf("expiry lag %s with 250 expired keys, want above zero", lag)
+	}
+
+	sw := newTTLSweeper(m, c, time.Hour, 100)
+	if err := sw.sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+	st := sw.stats()
+	if st.RowsSwept != 250 || st.Batches != 3 || st.MaxBatchRows != 100 || st.LastBatchRows != 50 {
+		t.Errorf("stats after sweeping 250 keys 100 at a time: %+v", st)
+	}
+	if st.LagSeconds != 0 {
+		t.Errorf("lag %gs after the sweep, want 0", st.LagSeconds)
+	}
+	if n := c.Len(); n != 0 {
+		t.Errorf("%d swept keys left in the cache", n)
+	}
+	for _, k := range []string{"long", "forever"} {
+		if _, err := m.Get(ctx, k); err != nil {
+			t.Errorf("unexpired %s swept: %v", k, err)
+		}
+	}
+}
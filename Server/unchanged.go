@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// keyMutex serialises writes to the same key within this server using a
+// fixed set of striped locks.
+type keyMutex struct {
+	stripes [cacheGenStripes]sync.Mutex
+}
+
+func (m *keyMutex) lock(key string) func() {
+	mu := &m.stripes[genStripe(key)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// unchanged reports whether key already holds value, checking the cache
+// first and the store only on a miss. Callers hold the key's write lock.
+func (s *Server) unchanged(ctx context.Context, key, value string) (bool, error) {
+	if cached, ok := s.cache.Peek(key); ok {
+		return cached == value, nil
+	}
+	current, fits, err := s.store.GetBounded(ctx, key, int64(len(value)))
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fits && current == value, nil
+}
+
+func (s *Server) skippedWrites() int64 {
+	return atomic.LoadInt64(&s.unchangedWrites)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sync"
+)
+
+// serverVersion is bumped whenever the HTTP API gains or changes an
+// endpoint, so clients can tell servers apart.
+const serverVersion = "1.9.0"
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.buildVersion=1.9.0 -X main.buildCommit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without them, the commit and its time come from the VCS stamp go build
+// embeds, if any.
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+	buildTime    = ""
+)
+
+// buildInfo describes the binary, as opposed to the API version.
+type buildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Time    string `json:"time"`
+	Go      string `json:"go"`
+}
+
+var currentBuild = sync.OnceValue(func() buildInfo {
+	b := buildInfo{Version: buildVersion, Commit: buildCommit, Time: buildTime, Go: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value[:min(len(s.Value), 12)]
+			case s.Key == "vcs.time" && b.Time == "":
+				b.Time = s.Value
+			case s.Key == "vcs.modified" && s.Value == "true" && buildCommit == "":
+				b.Commit += "-dirty"
+			}
+		}
+	}
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.Time == "" {
+		b.Time = "unknown"
+	}
+	return b
+})
+
+type versionInfo struct {
+	Version      string    `json:"version"`
+	Build        buildInfo `json:"build"`
+	Features     []string  `json:"features"`
+	AuthRequired bool      `json:"auth_required"`
+}
+
+// featureRegistry holds the optional parts of the API this server answers.
+// Each subsystem registers its names as main sets it up, so /version
+// lists what the running configuration serves.
+type featureRegistry struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (f *featureRegistry) register(names ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, n := range names {
+		if !slices.Contains(f.names, n) {
+			f.names = append(f.names, n)
+		}
+	}
+}
+
+// list returns the registered names in order.
+func (f *featureRegistry) list() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := slices.Clone(f.names)
+	slices.Sort(names)
+	return names
+}
+
+// versionHandler serves GET /version.
+func (s *Server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+	writeJSON(w, http.StatusOK, versionInfo{
+		Version:      serverVersion,
+		Build:        currentBuild(),
+		Features:     s.features.list(),
+		AuthRequired: s.adminToken != "",
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	s := newTestServer(NewMemStore())
+	s.features.register("ttl", "batch")
+	s.features.register("batch", "cas")
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	status, body, h := do(t, "GET", ts.URL+"/version", "")
+	if status != http.StatusOK || h.Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /version: status %d, Content-Type %q", status, h.Get("Content-Type"))
+	}
+	var v versionInfo
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != serverVersion || v.Build.Go != runtime.Version() || v.AuthRequired {
+		t.Errorf("/version = %+v", v)
+	}
+	// Each registered once, sorted.
+	unique := slices.Compact(slices.Clone(v.Features))
+	if !slices.IsSorted(v.Features) || len(unique) != len(v.Features) || !slices.Contains(v.Features, "cas") {
+		t.Errorf("features %q, want sorted, without duplicates, with cas", v.Features)
+	}
+
+	s.adminToken = testAdminToken
+	_, body, _ = do(t, "GET", ts.URL+"/version", "")
+	if err := json.Unmarshal([]byte(body), &v); err != nil || !v.AuthRequired {
+		t.Errorf("/version with an admin token = %s, want auth_required", body)
+	}
+	if status, _, h := do(t, "POST", ts.URL+"/version", ""); status != http.StatusMethodNotAllowed || h.Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST /version: status %d, Allow %q", status, h.Get("Allow"))
+	}
+}
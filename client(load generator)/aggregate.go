@@ -0,0 +1,305 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type intervalStats struct {
+	requests int64
+	errors   int64
+	latency  *histogram
+	cache    hitCounts
+}
+
+func newIntervalStats() intervalStats {
+	return intervalStats{latency: newHistogram()}
+}
+
+func (iv *intervalStats) merge(o *intervalStats) {
+	iv.requests += o.requests
+	iv.errors += o.errors
+	iv.latency.merge(o.latency)
+	iv.cache.hits += o.cache.hits
+	iv.cache.misses += o.cache.misses
+}
+
+func (iv *intervalStats) reset() {
+	iv.requests = 0
+	iv.errors = 0
+	iv.latency.reset()
+	iv.cache = hitCounts{}
+}
+
+// aggregator accumulates results into histograms and counters. Each worker
+// records into its own aggregator, so the lock is only contended when the
+// progress printer takes an interval snapshot; they are merged at the end.
+type aggregator struct {
+	mu sync.Mutex
+
+	requests      int64
+	errors        int64
+	errorsByClass [errQuota + 1]int64
+	retries       int64
+	retriedOps    int64
+	service       *histogram
+	corrected     *histogram
+
+	trackCorrected bool
+	interval       intervalStats
+	coherence      coherenceStats
+	ttl            ttlStats
+	deleteChurn    deleteChurnStats
+	backpressure   backpressureStats
+	// timing is nil until a response carries server timing.
+	timing *timingStats
+	// split is only set with -latency-export.
+	split *latencySplit
+
+	bytesSent     int64
+	bytesReceived int64
+	valueSizes    sizeHistogram
+	violations    violationCounts
+
+	cache hitCounts
+	// timeline holds hit counts per churnBucket since start; it is only
+	// kept when trackTimeline is set.
+	trackTimeline bool
+	start         time.Time
+	timeline      []hitCounts
+
+	// With -outage, the worker's own outage windows and its successful
+	// requests per outageBucket since start.
+	trackOutage bool
+	outage      outageState
+	successes   []int64
+}
+
+func newAggregator(trackCorrected, trackTimeline bool, start time.Time) *aggregator {
+	a := &aggregator{
+		service:        newHistogram(),
+		trackCorrected: trackCorrected,
+		interval:       newIntervalStats(),
+		coherence:      coherenceStats{convergence: newHistogram()},
+		violations:     make(violationCounts),
+		trackTimeline:  trackTimeline,
+		start:          start,
+	}
+	if trackCorrected {
+		a.corrected = newHistogram()
+	}
+	return a
+}
+
+func (a *aggregator) record(res Result) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.requests++
+	a.service.record(res.responseTime)
+	if a.trackCorrected {
+		a.corrected.record(res.correctedTime)
+	}
+	if res.isError {
+		a.errors++
+		a.errorsByClass[res.errClass]++
+	}
+	if res.retries > 0 {
+		a.retriedOps++
+		a.retries += int64(res.retries)
+	}
+	if res.coherence != nil {
+		a.coherence.add(res.coherence)
+	}
+	if res.ttl != nil {
+		a.ttl.add(res.ttl)
+	}
+	if res.deleteChurn != nil {
+		a.deleteChurn.add(res.deleteChurn)
+	}
+	a.backpressure.add(&res)
+	if res.timing.ok && res.retries == 0 {
+		if a.timing == nil {
+			t := newTimingStats()
+			a.timing = &t
+		}
+		a.timing.record(res.timing, res.responseTime)
+	}
+	if a.split != nil {
+		a.split.record(&res)
+	}
+	a.bytesSent += res.bytesSent
+	a.bytesReceived += res.bytesReceived
+	if res.gotValue {
+		a.valueSizes.record(res.valueSize)
+	}
+	for _, v := range res.violations {
+		a.violations.add(v.check, 1, []string{v.example})
+	}
+
+	if a.trackOutage {
+		a.outage.record(res.sent, res.sent.Add(res.responseTime), res.unavailable)
+		if !res.isError {
+			b := int(time.Since(a.start) / outageBucket)
+			for len(a.successes) <= b {
+				a.successes = append(a.successes, 0)
+			}
+			a.successes[b]++
+		}
+	}
+
+	if res.cache != cacheUnknown {
+		hit := res.cache == cacheHit
+		countHit(&a.cache, hit)
+		countHit(&a.interval.cache, hit)
+		if a.trackTimeline {
+			b := int(time.Since(a.start) / churnBucket)
+			for len(a.timeline) <= b {
+				a.timeline = append(a.timeline, hitCounts{})
+			}
+			countHit(&a.timeline[b], hit)
+		}
+	}
+
+	a.interval.requests++
+	a.interval.latency.record(res.responseTime)
+	if res.isError {
+		a.interval.errors++
+	}
+}
+
+// takeInterval adds the worker's interval stats to into, resets them, and
+// returns the worker's request total so far.
+func (a *aggregator) takeInterval(into *intervalStats) int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	into.merge(&a.interval)
+	a.interval.reset()
+	return a.requests
+}
+
+// merge folds o into a; o must no longer be recording.
+func (a *aggregator) merge(o *aggregator) {
+	a.requests += o.requests
+	a.errors += o.errors
+	for i, n := range o.errorsByClass {
+		a.errorsByClass[i] += n
+	}
+	a.retries += o.retries
+	a.retriedOps += o.retriedOps
+	a.service.merge(o.service)
+	if a.trackCorrected {
+		a.corrected.merge(o.corrected)
+	}
+	a.coherence.merge(&o.coherence)
+	a.ttl.merge(&o.ttl)
+	a.deleteChurn.merge(&o.deleteChurn)
+	a.backpressure.merge(&o.backpressure)
+	if o.timing != nil {
+		if a.timing == nil {
+			t := newTimingStats()
+			a.timing = &t
+		}
+		a.timing.merge(o.timing)
+	}
+	if o.split != nil {
+		if a.split == nil {
+			a.split = newLatencySplit()
+		}
+		a.split.merge(o.split)
+	}
+	a.bytesSent += o.bytesSent
+	a.bytesReceived += o.bytesReceived
+	a.valueSizes.merge(&o.valueSizes)
+	for _, v := range o.violations {
+		a.violations.add(v.Check, v.Count, v.Examples)
+	}
+	a.cache.hits += o.cache.hits
+	a.cache.misses += o.cache.misses
+	for len(a.timeline) < len(o.timeline) {
+		a.timeline = append(a.timeline, hitCounts{})
+	}
+	for i, h := range o.timeline {
+		a.timeline[i].hits += h.hits
+		a.timeline[i].misses += h.misses
+	}
+	for len(a.successes) < len(o.successes) {
+		a.successes = append(a.successes, 0)
+	}
+	for i, n := range o.successes {
+		a.successes[i] += n
+	}
+}
+
+func countHit(h *hitCounts, hit bool) {
+	if hit {
+		h.hits++
+	} else {
+		h.misses++
+	}
+}
+
+// addBackoff counts a worker's pause after an operation that was pushed
+// back.
+func (a *aggregator) addBackoff(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.backpressure.backoff += d
+}
+
+// succeeded counts operations that neither failed nor, with
+// -respect-backpressure, were pushed back on every attempt.
+func (a *aggregator) succeeded() int64 {
+	return a.requests - a.errors - a.backpressure.rejected
+}
+
+func (a *aggregator) avgResponseTime() time.Duration {
+	return a.service.mean()
+}
+
+func (a *aggregator) fill(r *Report, testDuration time.Duration) {
+	r.TotalRequests = a.requests
+	r.Success = a.succeeded()
+	r.Failed = a.errors
+	r.Errors = errorBreakdown{
+		Timeout:    a.errorsByClass[errTimeout],
+		Connection: a.errorsByClass[errConnection],
+		HTTP:       a.errorsByClass[errHTTP],
+		Request:    a.errorsByClass[errRequest],
+		Quota:      a.errorsByClass[errQuota],
+	}
+	r.Retries = a.retries
+	r.RetriedOps = a.retriedOps
+	r.Throughput = float64(r.Success) / testDuration.Seconds()
+	r.ServiceTime = a.service.summary()
+	if a.trackCorrected {
+		rt := a.corrected.summary()
+		r.ResponseTime = &rt
+	}
+	r.SampleWarnings = sampleWarnings(r.latency())
+	if a.coherence.writeCount > 0 {
+		r.Coherence = a.coherence.report()
+	}
+	if a.ttl.writes > 0 {
+		r.TTL = a.ttl.report()
+	}
+	if a.deleteChurn.creates > 0 {
+		r.DeleteChurn = a.deleteChurn.report()
+	}
+	if a.timing != nil {
+		r.ServerTiming = a.timing.report()
+	}
+	if rate, ok := a.cache.rate(); ok {
+		r.CacheHitRatePct = &rate
+	}
+	r.BytesSent = a.bytesSent
+	r.BytesReceived = a.bytesReceived
+	r.MBpsOut = float64(a.bytesSent) / 1e6 / testDuration.Seconds()
+	r.MBpsIn = float64(a.bytesReceived) / 1e6 / testDuration.Seconds()
+	r.ValueSizes = a.valueSizes.report()
+	r.ProtocolViolations = a.violations.report()
+	if a.requests > 0 {
+		r.ErrorRatePct = float64(a.errors) / float64(a.requests) * 100
+		r.AvgLatencyMs = float64(a.avgResponseTime()) / float64(time.Millisecond)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCorrectedLatencyShowsStall runs one open-loop worker against a
+// server that stalls a single request for 500ms. The requests scheduled
+// during the stall go out late, so the corrected p99 carries the stall
+// while the service time p99, which only the stalled request sees, does
+// not.
+func TestCorrectedLatencyShowsStall(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a worker for 1.5s")
+	}
+	const stall = 500 * time.Millisecond
+	var n atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n.Add(1) == 50 {
+			time.Sleep(stall)
+		}
+		w.Write([]byte("data-key-1"))
+	}))
+	defer ts.Close()
+
+	cfg := &workerConfig{
+		workload:      "get-popular",
+		readTargets:   []string{ts.URL},
+		writeTargets:  []string{ts.URL},
+		pathPrefix:    "/kv/",
+		keysPerClient: 100,
+		allClients:    1,
+		opTimeout:     5 * time.Second,
+		interval:      5 * time.Millisecond,
+		seed:          1,
+	}
+	stats := newAggregator(true, false, time.Now())
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go runClient(0, cfg, http.DefaultTransport, stats, &wg, stop)
+	time.Sleep(1500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	service, corrected := stats.service.percentile(99), stats.corrected.percentile(99)
+	t.Logf("%d requests: service p99 %v, corrected p99 %v", stats.requests, service, corrected)
+	if corrected < stall/2 {
+		t.Errorf("corrected p99 %v does not show the %v stall", corrected, stall)
+	}
+	if service > stall/5 {
+		t.Errorf("service time p99 %v moved with a single stalled request", service)
+	}
+	if stats.service.max < stall {
+		t.Errorf("service time max %v, want the stalled request's %v", stats.service.max, stall)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// A window passes only if the clients achieved this share of the
+	// offered rate and stayed within this error rate.
+	autoTuneMinAchieved = 0.95
+	autoTuneMaxErrorPct = 1.0
+	// The search stops once the lowest failing rate is within this factor
+	// of the highest passing one.
+	autoTunePrecision = 1.05
+)
+
+// autoTuneParams are the -auto-tune flags.
+type autoTuneParams struct {
+	percentile float64
+	target     time.Duration
+	window     time.Duration
+	warmup     time.Duration
+	minRate    float64
+	maxRate    float64
+	maxWindows int
+	cache      string
+}
+
+type autoTuneWindow struct {
+	Rate         float64 `json:"offered_rps"`
+	Throughput   float64 `json:"throughput_rps"`
+	LatencyMs    float64 `json:"latency_ms"`
+	ErrorRatePct float64 `json:"error_rate_pct"`
+	Requests     int64   `json:"requests"`
+	Pass         bool    `json:"pass"`
+	Reason       string  `json:"reason,omitempty"`
+	Decision     string  `json:"decision,omitempty"`
+}
+
+// autoTuneReport is the search: every window with the decision taken
+// after it, and the result. The highest sustainable rate lies between
+// SustainableRate, the highest rate that passed, and UpperBound, the
+// lowest that failed; without UpperBound even -auto-tune-max-rate passed.
+type autoTuneReport struct {
+	Percentile      float64          `json:"percentile"`
+	TargetMs        float64          `json:"target_ms"`
+	WindowSec       float64          `json:"window_sec"`
+	WarmupSec       float64          `json:"warmup_sec"`
+	Cache           string           `json:"cache"`
+	Seed            int64            `json:"seed"`
+	Windows         []autoTuneWindow `json:"windows"`
+	SustainableRate float64          `json:"sustainable_rps"`
+	UpperBound      *float64         `json:"upper_bound_rps,omitempty"`
+	Confirmation    *autoTuneWindow  `json:"confirmation,omitempty"`
+	Interrupted     bool             `json:"interrupted,omitempty"`
+}
+
+// autoTuner runs the search. Its workers are started afresh for every
+// window with the same seeds, so each issues the same requests in every
+// window, and the cache is either flushed before each window or carried
+// over from the last; with -seed the whole search can be repeated. A
+// warm-up at the window's own rate, whose results are dropped, settles the
+// connections and the cache before it is measured.
+type autoTuner struct {
+	cfg          *workerConfig
+	p            autoTuneParams
+	transportFor func(i int) http.RoundTripper
+	interrupt    chan os.Signal
+	report       *autoTuneReport
+}
+
+// autoTune searches for the highest rate whose latency percentile stays
+// within the target. The rate doubles from -auto-tune-min-rate until a
+// window fails, then the search bisects between the highest passing and
+// lowest failing rates. Before returning it warms up at the rate found
+// for the confirmation run.
+func autoTune(cfg *workerConfig, p autoTuneParams, transportFor func(i int) http.RoundTripper) *autoTuneReport {
+	t := &autoTuner{
+		cfg:          cfg,
+		p:            p,
+		transportFor: transportFor,
+		interrupt:    make(chan os.Signal, 1),
+		report: &autoTuneReport{
+			Percentile: p.percentile,
+			TargetMs:   durationMs(p.target),
+			WindowSec:  p.window.Seconds(),
+			WarmupSec:  p.warmup.Seconds(),
+			Cache:      p.cache,
+			Seed:       cfg.seed,
+		},
+	}
+	signal.Notify(t.interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(t.interrupt)
+
+	var lo, hi float64
+	rate := p.minRate
+	for len(t.report.Windows) < p.maxWindows {
+		w, ok := t.measure(rate)
+		if !ok {
+			t.report.Interrupted = true
+			break
+		}
+		if w.Pass {
+			lo = rate
+		} else {
+			hi = rate
+		}
+		done := true
+		switch {
+		case w.Pass && hi == 0 && rate >= p.maxRate:
+			w.Decision = "-auto-tune-max-rate sustained; stopping"
+		case w.Pass && hi == 0:
+			rate, done = min(rate*2, p.maxRate), false
+			w.Decision = fmt.Sprintf("raising to %.0f reqs/sec", rate)
+		case lo == 0:
+			w.Decision = "-auto-tune-min-rate not sustained; stopping"
+		case hi/lo <= autoTunePrecision:
+			w.Decision = fmt.Sprintf("converged between %.0f and %.0f reqs/sec", lo, hi)
+		default:
+			done = false
+			rate = math.Sqrt(lo * hi)
+			w.Decision = fmt.Sprintf("bisecting between %.0f and %.0f: trying %.0f reqs/sec", lo, hi, rate)
+		}
+		t.report.Windows = append(t.report.Windows, w)
+		log.Printf("Auto-tune window %d: %.0f reqs/sec offered, %.0f achieved, p%g %.3f ms, %.2f%% errors: %s; %s",
+			len(t.report.Windows), w.Rate, w.Throughput, p.percentile, w.LatencyMs, w.ErrorRatePct, passLabel(w), w.Decision)
+		if done {
+			break
+		}
+		if len(t.report.Windows) == p.maxWindows {
+			t.report.Windows[len(t.report.Windows)-1].Decision = "-auto-tune-max-windows reached; stopping"
+		}
+	}
+	t.report.SustainableRate = lo
+	if hi > 0 {
+		t.report.UpperBound = &hi
+	}
+	if lo > 0 && !t.report.Interrupted {
+		if !t.prepare(lo) {
+			t.report.Interrupted = true
+		}
+	}
+	return t.report
+}
+
+func (r *autoTuneReport) print() {
+	fmt.Println("-----------------------------------")
+	fmt.Printf("AUTO-TUNE (p%g <= %.3f ms, %gs windows, cache %s):\n", r.Percentile, r.TargetMs, r.WindowSec, r.Cache)
+	for i, w := range r.Windows {
+		fmt.Printf("  #%-2d %8.0f reqs/sec: p%g %.3f ms, %.0f achieved, %s\n", i+1, w.Rate, r.Percentile, w.LatencyMs, w.Throughput, passLabel(w))
+	}
+	switch {
+	case r.SustainableRate == 0:
+		fmt.Println("Sustainable rate:    none")
+	case r.UpperBound != nil:
+		fmt.Printf("Sustainable rate:    %.0f reqs/sec (fails at %.0f)\n", r.SustainableRate, *r.UpperBound)
+	default:
+		fmt.Printf("Sustainable rate:    %.0f reqs/sec (at least; the maximum rate tried)\n", r.SustainableRate)
+	}
+	if c := r.Confirmation; c != nil {
+		fmt.Printf("Confirmation:        p%g %.3f ms, %.0f achieved, %s\n", r.Percentile, c.LatencyMs, c.Throughput, passLabel(*c))
+	}
+}
+
+func passLabel(w autoTuneWindow) string {
+	if w.Pass {
+		return "pass"
+	}
+	return "fail (" + w.Reason + ")"
+}
+
+// measure runs one window at rate after its cache treatment and warm-up.
+// It reports false if the run was interrupted.
+func (t *autoTuner) measure(rate float64) (autoTuneWindow, bool) {
+	if !t.prepare(rate) {
+		return autoTuneWindow{}, false
+	}
+	agg, ok := t.run(rate, t.p.window)
+	return t.p.judge(agg, rate, t.p.window), ok
+}
+
+func (t *autoTuner) prepare(rate float64) bool {
+	if t.p.cache == "flush" {
+		flushCaches(t.cfg)
+	}
+	if t.p.warmup <= 0 {
+		return true
+	}
+	_, ok := t.run(rate, t.p.warmup)
+	return ok
+}
+
+// run drives fresh workers at rate for d and merges their results.
+func (t *autoTuner) run(rate float64, d time.Duration) (*aggregator, bool) {
+	cfg := *t.cfg
+	cfg.interval = time.Duration(float64(cfg.clients) / rate * float64(time.Second))
+	cfg.start = time.Now()
+	churn := cfg.workload == "churn"
+	workers := make([]*aggregator, cfg.clients)
+	stopChan := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = newAggregator(true, churn, cfg.start)
+		wg.Add(1)
+		go runClient(i, &cfg, newTrackingTransport(t.transportFor(i)), workers[i], &wg, stopChan)
+	}
+	ok := true
+	select {
+	case <-time.After(d):
+	case <-t.interrupt:
+		ok = false
+	}
+	close(stopChan)
+	wg.Wait()
+	agg := newAggregator(true, churn, cfg.start)
+	for _, w := range workers {
+		agg.merge(w)
+	}
+	return agg, ok
+}
+
+// judge measures a window that ran at rate for d against the target.
+// Latency is the response time from each request's intended send time,
+// so a server falling behind the schedule fails the window.
+func (p autoTuneParams) judge(agg *aggregator, rate float64, d time.Duration) autoTuneWindow {
+	w := autoTuneWindow{
+		Rate:       rate,
+		Throughput: float64(agg.succeeded()) / d.Seconds(),
+		LatencyMs:  durationMs(agg.corrected.percentile(p.percentile)),
+		Requests:   agg.requests,
+	}
+	if agg.requests > 0 {
+		w.ErrorRatePct = float64(agg.errors) / float64(agg.requests) * 100
+	}
+	switch {
+	case agg.requests == 0:
+		w.Reason = "no requests completed"
+	case w.LatencyMs > durationMs(p.target):
+		w.Reason = fmt.Sprintf("p%g %.3f ms over %s", p.percentile, w.LatencyMs, p.target)
+	case w.Throughput < rate*autoTuneMinAchieved:
+		w.Reason = fmt.Sprintf("only %.0f of %.0f reqs/sec achieved", w.Throughput, rate)
+	case w.ErrorRatePct > autoTuneMaxErrorPct:
+		w.Reason = fmt.Sprintf("error rate %.2f%%", w.ErrorRatePct)
+	default:
+		w.Pass = true
+	}
+	return w
+}
+
+// flushCaches empties the cache of every target through POST
+// /admin/cache/flush, so each window starts cold.
+func flushCaches(cfg *workerConfig) {
+	client := &http.Client{Timeout: 30 * time.Second, Transport: cfg.transport}
+	var flushed []string
+	for _, target := range slices.Concat(cfg.targets, cfg.readTargets, cfg.writeTargets) {
+		if slices.Contains(flushed, target) {
+			continue
+		}
+		flushed = append(flushed, target)
+		req, err := http.NewRequest("POST", target+"/admin/cache/flush", nil)
+		if err != nil {
+			log.Fatalf("Cannot flush the cache of %s: %v", target, err)
+		}
+		if cfg.adminToken != "" {
+			req.Header.Set("Authorization", "Bearer "+cfg.adminToken)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Fatalf("Cannot flush the cache of %s: %v", target, err)
+		}
+		drainClose(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("Cannot flush the cache of %s: HTTP %d", target, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// backpressureStatus reports whether status asks the client to slow down:
+// 429 (rate limited), 503 (shedding or queue full) or 507 (quota).
+func backpressureStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusInsufficientStorage:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as an HTTP
+// date, returning 0 if it is missing or malformed.
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(h, 10, 64); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		// Anything beyond an hour is capped by the caller anyway; this
+		// keeps the multiplication from overflowing.
+		return time.Duration(min(secs, 3600)) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
+
+// backpressureWait is how long to wait after the n-th backpressure response
+// in a row (from 0): its Retry-After if it has one, else an exponential
+// backoff from -retry-backoff, both capped at -max-backoff.
+func (cfg *workerConfig) backpressureWait(out outcome, n int) time.Duration {
+	wait := out.retryAfter
+	if wait == 0 {
+		wait = cfg.retryBackoff << min(n, 30)
+	}
+	return min(wait, cfg.maxBackoff)
+}
+
+// backpressureStats counts backpressure responses, which with
+// -respect-backpressure are neither successes nor errors.
+type backpressureStats struct {
+	responses [3]int64 // 429, 503, 507
+	// rejected counts operations whose final attempt was still pushed
+	// back.
+	rejected int64
+	backoff  time.Duration
+}
+
+func (s *backpressureStats) add(res *Result) {
+	for i, n := range res.backpressure {
+		s.responses[i] += int64(n)
+	}
+	if res.rejected {
+		s.rejected++
+	}
+	s.backoff += res.backoff
+}
+
+func (s *backpressureStats) merge(o *backpressureStats) {
+	for i, n := range o.responses {
+		s.responses[i] += n
+	}
+	s.rejected += o.rejected
+	s.backoff += o.backoff
+}
+
+// countBackpressure adds status to counts, indexed like
+// backpressureStats.responses.
+func countBackpressure(counts *[3]int, status int) {
+	switch status {
+	case http.StatusTooManyRequests:
+		counts[0]++
+	case http.StatusServiceUnavailable:
+		counts[1]++
+	case http.StatusInsufficientStorage:
+		counts[2]++
+	}
+}
+
+type backpressureReport struct {
+	TooManyRequests    int64 `json:"429"`
+	ServiceUnavailable int64 `json:"503"`
+	QuotaExceeded      int64 `json:"507"`
+	// Rejected operations were still pushed back after every retry.
+	Rejected  int64   `json:"rejected_ops"`
+	BackoffMs float64 `json:"backoff_ms"`
+	// BackoffPct is the share of the workers' time spent backing off.
+	BackoffPct float64 `json:"backoff_pct"`
+	// GoodputRps is successful operations per second.
+	GoodputRps float64 `json:"goodput_rps"`
+}
+
+func (s *backpressureStats) report(clients int, success int64, testDuration time.Duration) *backpressureReport {
+	r := &backpressureReport{
+		TooManyRequests:    s.responses[0],
+		ServiceUnavailable: s.responses[1],
+		QuotaExceeded:      s.responses[2],
+		Rejected:           s.rejected,
+		BackoffMs:          float64(s.backoff) / float64(time.Millisecond),
+		GoodputRps:         float64(success) / testDuration.Seconds(),
+	}
+	if workerTime := time.Duration(clients) * testDuration; workerTime > 0 {
+		r.BackoffPct = float64(s.backoff) / float64(workerTime) * 100
+	}
+	return r
+}
+
+func (b *backpressureReport) print() {
+	fmt.Println("-----------------------------------")
+	fmt.Println("BACKPRESSURE:")
+	fmt.Printf("Responses:           %d x 429, %d x 503, %d x 507\n", b.TooManyRequests, b.ServiceUnavailable, b.QuotaExceeded)
+	fmt.Printf("Rejected operations: %d (pushed back on every attempt)\n", b.Rejected)
+	fmt.Printf("Backing off:         %s (%.1f%% of worker time)\n", time.Duration(b.BackoffMs*float64(time.Millisecond)).Round(time.Millisecond), b.BackoffPct)
+	fmt.Printf("GOODPUT:             %.2f reqs/sec\n", b.GoodputRps)
+}
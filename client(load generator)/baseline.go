@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// metricDelta compares one metric against the baseline run. Change is in
+// percent, except for the error rate, where it is in percentage points.
+// A percentile whose confidence intervals in both runs overlap has not
+// measurably changed, so it neither regressed nor improved.
+type metricDelta struct {
+	Metric     string    `json:"metric"`
+	Baseline   float64   `json:"baseline"`
+	Current    float64   `json:"current"`
+	Change     float64   `json:"change"`
+	Unit       string    `json:"unit"`
+	BaselineCI *interval `json:"baseline_ci,omitempty"`
+	CurrentCI  *interval `json:"current_ci,omitempty"`
+	Overlap    bool      `json:"intervals_overlap,omitempty"`
+	Regressed  bool      `json:"regressed"`
+	Improved   bool      `json:"improved,omitempty"`
+	// exitBit is the SLA exit bit of the metric, set when it regressed.
+	exitBit int
+}
+
+type baselineComparison struct {
+	Path       string        `json:"path"`
+	Threshold  float64       `json:"threshold_pct,omitempty"`
+	Mismatches []string      `json:"parameter_mismatches,omitempty"`
+	Deltas     []metricDelta `json:"deltas"`
+}
+
+func loadBaseline(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("%s is not a -json-out report: %w", path, err)
+	}
+	return &r, nil
+}
+
+// parsePercent accepts "5" or "5%".
+func parsePercent(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return v, nil
+}
+
+// compareBaseline diffs r against base. With threshold > 0 a metric that
+// got worse by more than threshold percent (points, for the error rate)
+// is marked regressed.
+func compareBaseline(path string, base, r *Report, threshold float64) *baselineComparison {
+	c := &baselineComparison{Path: path, Threshold: threshold}
+	param := func(name string, was, now any) {
+		if fmt.Sprint(was) != fmt.Sprint(now) {
+			c.Mismatches = append(c.Mismatches, fmt.Sprintf("%s: baseline %v, this run %v", name, was, now))
+		}
+	}
+	param("workload", base.Workload, r.Workload)
+	param("clients", base.Clients, r.Clients)
+	param("duration", math.Round(base.DurationSec), math.Round(r.DurationSec))
+	param("keyspace", base.Keyspace, r.Keyspace)
+	param("keys", base.Keys, r.Keys)
+	param("target rate", base.TargetRate, r.TargetRate)
+	param("transport", base.Transport, r.Transport)
+	param("interrupted", base.Interrupted, r.Interrupted)
+
+	relative := func(name string, exitBit int, was, now float64, higherIsBetter bool, wasCI, nowCI *interval) {
+		d := metricDelta{Metric: name, Baseline: was, Current: now, Unit: "%", BaselineCI: wasCI, CurrentCI: nowCI, exitBit: exitBit}
+		if was != 0 {
+			d.Change = (now - was) / was * 100
+		}
+		worse := d.Change
+		if higherIsBetter {
+			worse = -d.Change
+		}
+		// Reports from before the intervals, or with too few samples for
+		// them, are judged by the threshold alone.
+		d.Overlap = wasCI != nil && nowCI != nil && wasCI.overlaps(nowCI)
+		d.Regressed = threshold > 0 && worse > threshold && !d.Overlap
+		d.Improved = threshold > 0 && -worse > threshold && !d.Overlap
+		c.Deltas = append(c.Deltas, d)
+	}
+	relative("throughput (reqs/s)", exitThroughput, base.Throughput, r.Throughput, true, nil, nil)
+	baseLat, lat := base.latency(), r.latency()
+	relative("p50 (ms)", exitP99, baseLat.P50Ms, lat.P50Ms, false, baseLat.P50CI, lat.P50CI)
+	relative("p99 (ms)", exitP99, baseLat.P99Ms, lat.P99Ms, false, baseLat.P99CI, lat.P99CI)
+
+	d := metricDelta{Metric: "error rate (%)", Baseline: base.ErrorRatePct, Current: r.ErrorRatePct, Unit: "pts", exitBit: exitErrorRate}
+	d.Change = r.ErrorRatePct - base.ErrorRatePct
+	d.Regressed = threshold > 0 && d.Change > threshold
+	d.Improved = threshold > 0 && -d.Change > threshold
+	c.Deltas = append(c.Deltas, d)
+	return c
+}
+
+// latency is the response time with a target rate, else the service time,
+// as the -max-p99 check uses.
+func (r *Report) latency() latencySummary {
+	if r.ResponseTime != nil {
+		return *r.ResponseTime
+	}
+	return r.ServiceTime
+}
+
+// regressions lists the regressed metrics with the exit bits of the SLA
+// thresholds they correspond to: a latency regression sets the -max-p99
+// bit, and so on.
+func (c *baselineComparison) regressions() (out []string, code int) {
+	for _, d := range c.Deltas {
+		if d.Regressed {
+			out = append(out, fmt.Sprintf("%s regressed %+.1f%s vs baseline (limit %.1f%%)", d.Metric, d.Change, d.Unit, c.Threshold))
+			code |= d.exitBit
+		}
+	}
+	return out, code
+}
+
+func (c *baselineComparison) print() {
+	fmt.Println("-----------------------------------")
+	fmt.Printf("BASELINE %s:\n", c.Path)
+	if len(c.Mismatches) > 0 {
+		fmt.Println("  WARNING: runs are not comparable, parameters differ:")
+		for _, m := range c.Mismatches {
+			fmt.Printf("  WARNING:   %s\n", m)
+		}
+	}
+	fmt.Printf("  %-20s %12s %12s %10s\n", "Metric", "Baseline", "Current", "Change")
+	for _, d := range c.Deltas {
+		mark := ""
+		switch {
+		case d.Regressed:
+			mark = "  REGRESSED"
+		case d.Improved:
+			mark = "  IMPROVED"
+		case d.Overlap && math.Abs(d.Change) > c.Threshold && c.Threshold > 0:
+			mark = "  within noise (intervals overlap)"
+		}
+		fmt.Printf("  %-20s %12.2f %12.2f %+9.1f%s%s\n", d.Metric, d.Baseline, d.Current, d.Change, d.Unit, mark)
+	}
+}
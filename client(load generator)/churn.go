@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// churnBucket is the resolution of the hit-rate timeline used to measure
+// recovery after each churn event.
+const churnBucket = 100 * time.Millisecond
+
+// churnKeys draws keys from a hot set of cfg.hotKeys keys that slides by
+// half its size every cfg.churnInterval: during window w the set is
+// hot-{w*step} .. hot-{w*step+hotKeys-1}, or the -key-template IDs that
+// far past -key-min.
+type churnKeys struct {
+	start time.Time
+	rng   *rand.Rand
+	zipf  *rand.Zipf
+}
+
+func newChurnKeys(cfg *workerConfig, id int) *churnKeys {
+	c := &churnKeys{
+		start: cfg.start,
+		rng:   cfg.rng(cfg.idBase + id),
+	}
+	if cfg.keyDist == "zipf" && cfg.hotKeys > 1 {
+		c.zipf = rand.NewZipf(c.rng, 1.1, 1, uint64(cfg.hotKeys-1))
+	}
+	return c
+}
+
+func churnStep(hotKeys int) int {
+	return max(hotKeys/2, 1)
+}
+
+func (c *churnKeys) next(cfg *workerConfig) string {
+	window := int(time.Since(c.start) / cfg.churnInterval)
+	var offset int
+	if c.zipf != nil {
+		offset = int(c.zipf.Uint64())
+	} else {
+		offset = c.rng.Intn(cfg.hotKeys)
+	}
+	return churnKey(cfg.keyTemplate, window*churnStep(cfg.hotKeys)+offset)
+}
+
+// churnKey is hot-{i}, or the key of the i-th -key-template ID.
+func churnKey(t *keyTemplate, i int) string {
+	if t != nil {
+		return t.key(t.lo + int64(i))
+	}
+	return fmt.Sprintf("hot-%d", i)
+}
+
+// churnKeyCount is how many keys a run of duration touches.
+func churnKeyCount(hotKeys int, interval, duration time.Duration) int {
+	windows := int(duration/interval) + 1
+	return hotKeys + (windows-1)*churnStep(hotKeys)
+}
+
+// churnPrimeKeys lists every key the run can touch, in reverse order of
+// first use: priming writes through the server cache, so the keys of later
+// windows go in first and are the likeliest to have been evicted again by
+// the time the run starts.
+func churnPrimeKeys(t *keyTemplate, hotKeys int, interval, duration time.Duration) []string {
+	total := churnKeyCount(hotKeys, interval, duration)
+	keys := make([]string, 0, total)
+	for i := total - 1; i >= 0; i-- {
+		keys = append(keys, churnKey(t, i))
+	}
+	return keys
+}
+
+func validateKeyDist(dist string) error {
+	switch dist {
+	case "uniform", "zipf":
+		return nil
+	}
+	return fmt.Errorf("unknown -key-dist %q (want uniform or zipf)", dist)
+}
+
+type hitCounts struct {
+	hits   int64
+	misses int64
+}
+
+func (h hitCounts) rate() (float64, bool) {
+	total := h.hits + h.misses
+	if total == 0 {
+		return 0, false
+	}
+	return float64(h.hits) / float64(total) * 100, true
+}
+
+type churnReport struct {
+	HotKeys          int     `json:"hot_keys"`
+	Interval         string  `json:"interval"`
+	KeyDist          string  `json:"key_dist"`
+	RecoverHitRate   float64 `json:"recover_hit_rate_pct"`
+	Events           int     `json:"events"`
+	Recovered        int     `json:"recovered"`
+	AvgRecoveryMs    float64 `json:"avg_recovery_ms"`
+	MaxRecoveryMs    float64 `json:"max_recovery_ms"`
+	TimelineBucketMs int64   `json:"timeline_bucket_ms"`
+}
+
+// churnRecovery finds, for each churn event, the first timeline bucket
+// before the next event whose hit rate reaches threshold, and measures the
+// time from the event to the end of that bucket.
+func churnRecovery(timeline []hitCounts, interval time.Duration, threshold float64) (events, recovered int, avg, worst time.Duration) {
+	perWindow := int(interval / churnBucket)
+	var total time.Duration
+	for event := perWindow; event < len(timeline); event += perWindow {
+		events++
+		end := min(event+perWindow, len(timeline))
+		for b := event; b < end; b++ {
+			if rate, ok := timeline[b].rate(); ok && rate >= threshold {
+				d := time.Duration(b-event+1) * churnBucket
+				total += d
+				worst = max(worst, d)
+				recovered++
+				break
+			}
+		}
+	}
+	if recovered > 0 {
+		avg = total / time.Duration(recovered)
+	}
+	return events, recovered, avg, worst
+}
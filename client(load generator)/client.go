@@ -1,111 +1,1047 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
+	"math"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type Result struct {
-	responseTime time.Duration
-	isError      bool
+	// method is the HTTP method of a plain operation; workloads that run
+	// their own sequences leave it empty.
+	method        string
+	responseTime  time.Duration
+	correctedTime time.Duration
+	isError       bool
+	errClass      errorClass
+	retries       int
+	cache         cacheOutcome
+	bytesSent     int64
+	bytesReceived int64
+	// valueSize is the body size of a successful GET (gotValue).
+	gotValue    bool
+	valueSize   int64
+	violations  []violation
+	coherence   *coherenceSample
+	ttl         *ttlSample
+	deleteChurn *deleteSample
+	timing      serverTiming
+	// With -respect-backpressure, the backpressure responses and time
+	// backing off between attempts, and whether the operation was pushed
+	// back on every attempt, which makes it neither a success nor an error.
+	backpressure [3]int
+	backoff      time.Duration
+	rejected     bool
+
+	// sent is when the request went out; unavailable marks a failure that
+	// suggests the server is down: no connection, a timeout, or a 5xx.
+	sent        time.Time
+	unavailable bool
 }
 
-var popularKeys = []string{"key-1", "key-2", "key-3", "key-4", "key-5"}
+type workerConfig struct {
+	workload     string
+	clients      int
+	targets      []string
+	readTargets  []string
+	writeTargets []string
+	pathPrefix   string
+	transport    http.RoundTripper
 
-func primePopularKeys() {
-	client := &http.Client{Timeout: 5 * time.Second}
-	for _, key := range popularKeys {
-		val := "data-" + key
-		req, err := http.NewRequest("PUT", "http://localhost:8080/kv/"+key, bytes.NewBufferString(val))
-		if err != nil {
-			log.Printf("Failed to create prime request: %v", err)
-			continue
-		}
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("Failed to prime key %s: %v", key, err)
-			continue
-		}
-		resp.Body.Close()
-	}
+	keysPerClient int
+	readOthers    bool
+	// keyTemplate is nil unless -key-template is set.
+	keyTemplate *keyTemplate
+	// In a distributed run, workers are numbered from idBase and
+	// allClients counts the workers of every joiner.
+	idBase     int
+	allClients int
+
+	start         time.Time
+	hotKeys       int
+	churnInterval time.Duration
+	keyDist       string
+	interval      time.Duration
+	thinkTime     time.Duration
+	thinkDist     string
+	opTimeout     time.Duration
+	retries       int
+	retryBackoff  time.Duration
+	// respectBackpressure treats 429, 503 and 507 as backpressure, waiting
+	// up to maxBackoff before trying again.
+	respectBackpressure bool
+	maxBackoff          time.Duration
+
+	coherenceKeys    int
+	coherenceTimeout time.Duration
+	coherencePoll    time.Duration
+
+	ttlMin       time.Duration
+	ttlMax       time.Duration
+	ttlTolerance time.Duration
+
+	deleteReadsBefore int
+	deleteReadsAfter  int
+	deleteWindow      time.Duration
+
+	tenants        []tenant
+	tenantByClient []int
+
+	strict       bool
+	serverTiming bool
+	seed         int64
+
+	primeConcurrency int
+	primeBatch       int
+	primeMaxFailures float64
+	primeServerSide  bool
+	cacheFill        float64
+	adminToken       string
+	runID            string
+	labels           map[string]string
+	quiet            bool
+
+	// server is the target's /version answer, nil for servers without it.
+	server *serverInfo
+	// clock is the server clock estimate, nil if the server has no
+	// /admin/time.
+	clock *clockSync
+	// metrics is nil unless -metrics-addr or -pushgateway-url is set.
+	metrics *clientMetrics
+
+	// recorder is nil unless -record is set.
+	recorder *recorder
+
+	// pools is nil unless -writer-clients or -reader-clients is set.
+	pools *workerPools
+
+	// outage is nil unless -outage is set.
+	outage        *outageTracker
+	backup        string
+	failoverAfter int
+	failbackProbe time.Duration
 }
 
 func main() {
 	numClients := flag.Int("clients", 10, "Number of concurrent clients")
 	durationSec := flag.Int("duration", 30, "Test duration in seconds")
-	workloadType := flag.String("workload", "get-popular", "Type: get-popular, put-all, get-all, or mixed")
+	workloadType := flag.String("workload", "get-popular", "Type: get-popular, put-all, get-all, mixed, churn, tenants, coherence, ttl, or churn-delete")
+	targetSpec := flag.String("target", "http://localhost:8080", "Server base URL; comma-separate several to spread clients across them")
+	readTargetSpec := flag.String("read-target", "", "Base URL(s) for GETs, e.g. a server's -read-addr (default: -target)")
+	writeTargetSpec := flag.String("write-target", "", "Base URL(s) for PUTs, e.g. a server's -write-addr (default: -target)")
+	pathPrefix := flag.String("path-prefix", "/kv/", "Key path on the server: /kv/ for the store, /cache/ for the cache-only endpoints")
+	keysPerClient := flag.Int("keys-per-client", 1000, "Keys in each client's range key-{client}-{0..N-1} for put-all, get-all and mixed writes")
+	keyTemplateSpec := flag.String("key-template", "", "Name the keys of get-popular, put-all, get-all, mixed and churn after an existing dataset's: a printf format with one integer verb, e.g. user:%d:profile, or user:{{.ID}}:profile, applied to the IDs -key-min..-key-max, which replace -keys-per-client")
+	keyMin := flag.Int64("key-min", 0, "With -key-template, the first ID")
+	keyMax := flag.Int64("key-max", -1, "With -key-template, the last ID")
+	readOthers := flag.Bool("read-others", false, "get-all reads from every client's key range instead of only its own")
+	useHTTP2 := flag.Bool("http2", false, "Use cleartext HTTP/2 (h2c, prior knowledge); the server needs -h2c")
+	http2Fraction := flag.Float64("http2-fraction", 1, "With -http2, the fraction of clients using HTTP/2; the rest use HTTP/1.1")
+	unixSocket := flag.String("unix-socket", "", "Send all requests over this Unix socket (e.g. a server's -listen-unix); target URLs keep their scheme and path")
+	tenantSpec := flag.String("tenants", "", "Tenants for -workload=tenants, e.g. \"A:40%:read=95:keys=1000;B:60%:read=10:keys=1000000\"")
+	hotKeys := flag.Int("hot-keys", 500, "Size of the hot set in the churn workload")
+	churnInterval := flag.Duration("churn-interval", 10*time.Second, "How often the churn workload slides its hot set by half its size")
+	keyDist := flag.String("key-dist", "uniform", "Distribution of churn reads over the hot set, and with -key-template of get-all reads over the IDs: uniform or zipf")
+	recoverHitRate := flag.Float64("recover-hit-rate", 90, "Hit rate (percent) that counts as recovered after a churn event")
+	prime := flag.String("prime", "auto", "Keys written before the run: auto (what the workload reads), keyspace (also every client's key range), or none")
+	primeOnly := flag.Bool("prime-only", false, "Exit after priming, e.g. to prepare a dataset for several get-all runs")
+	primeConcurrency := flag.Int("prime-concurrency", 16, "Concurrent requests while priming")
+	primeBatch := flag.Int("prime-batch", 100, "Keys per batch PUT while priming, if the server supports it (1 disables batching)")
+	primeMaxFailures := flag.Float64("prime-max-failures", 1, "Abort if more than this percentage of keys fail to prime")
+	primeServerSide := flag.Bool("prime-server-side", false, "Have the server generate the primed keys via POST /admin/generate, falling back to client-side priming if it cannot")
+	cacheFill := flag.Float64("cache-fill", 0, "With -prime-server-side, fraction (0-1) of each generated range the server also puts in its cache")
+	adminToken := flag.String("admin-token", "", "Bearer token for the server's admin endpoints")
+	maxErrorRate := flag.Float64("max-error-rate", 0, "Fail with a non-zero exit code if the error rate exceeds this percentage")
+	maxP99 := flag.Duration("max-p99", 0, "Fail with a non-zero exit code if p99 latency exceeds this duration")
+	minThroughput := flag.Float64("min-throughput", 0, "Fail with a non-zero exit code if throughput falls below this many reqs/sec")
+	jsonOut := flag.String("json-out", "", "Write the report as JSON to this file")
+	latencyExport := flag.String("latency-export", "", "Write the latency percentiles in HdrHistogram's .hgrm format to this file, and per method and cache hit/miss to files named after it (e.g. run.get.hgrm)")
+	baselinePath := flag.String("baseline", "", "Compare the run with this -json-out report and print the changes")
+	failOnRegression := flag.String("fail-on-regression", "", "With -baseline, exit non-zero if throughput, p50 or p99 got worse by more than this percentage (e.g. 5%), or the error rate rose by more than this many points")
+	strict := flag.Bool("strict", false, "Check responses for missing or malformed headers and report protocol violations; any violation fails the run")
+	serverTiming := flag.Bool("server-timing", false, "Ask the server how long each GET spent in its cache and store (X-Timing) and report those stages and the network + client remainder")
+	targetRate := flag.Float64("rate", 0, "Target aggregate request rate in reqs/sec (0 runs closed-loop as fast as possible)")
+	thinkTime := flag.Duration("think-time", 0, "Mean pause between operations per client (cannot be combined with -rate)")
+	thinkDist := flag.String("think-time-dist", thinkFixed, "Think time distribution: fixed, uniform, or exponential")
+	writerClients := flag.Int("writer-clients", 0, "With -workload=mixed, clients that only write, with their own connections; with -reader-clients, replaces -clients")
+	readerClients := flag.Int("reader-clients", 0, "With -workload=mixed, clients that only read, with their own connections; with -writer-clients, replaces -clients")
+	writerRate := flag.Float64("writer-rate", 0, "Target aggregate rate of the -writer-clients in reqs/sec (0: as fast as possible)")
+	readerRate := flag.Float64("reader-rate", 0, "Target aggregate rate of the -reader-clients in reqs/sec (0: as fast as possible)")
+	writerKeys := flag.String("writer-keys", writeSequential, "Keys the -writer-clients write in their own ranges: sequential or random")
+	readerKeys := flag.String("reader-keys", "", "Keys the -reader-clients read: popular, uniform (any key of the writers' ranges) or recent (keys the writers have written) (default: recent with -read-lag, else popular)")
+	readLag := flag.Duration("read-lag", 0, "With -reader-clients, only read keys the writers wrote at least this long ago")
+	opTimeout := flag.Duration("op-timeout", 10*time.Second, "Timeout for each request attempt")
+	retries := flag.Int("retries", 0, "Retries for idempotent operations that time out, fail to connect, or return 5xx")
+	retryBackoff := flag.Duration("retry-backoff", 10*time.Millisecond, "Initial backoff between retries, doubled on each attempt")
+	respectBackpressure := flag.Bool("respect-backpressure", false, "Treat 429, 503 and 507 as backpressure: wait for their Retry-After (or back off exponentially) before retrying or sending more, and count them apart from errors")
+	maxBackoff := flag.Duration("max-backoff", 10*time.Second, "With -respect-backpressure, the longest wait a Retry-After or backoff can ask for")
+	progressInterval := flag.Duration("progress-interval", 0, "Print one progress line per interval (default: a live status line on terminals)")
+	quiet := flag.Bool("quiet", false, "Suppress progress output")
+	liveDashboard := flag.Bool("live-dashboard", false, "Instead of the progress line, redraw a dashboard of the last 60s of hit rate, req/s, p99 and error rate every second on stdout (one line per second when stdout is not a terminal), and add the per-second series to the report")
+	metricsAddr := flag.String("metrics-addr", "", "Serve live client metrics in Prometheus format on this address, e.g. :9100")
+	pushgatewayURL := flag.String("pushgateway-url", "", "Push live client metrics to this Prometheus Pushgateway, e.g. http://pushgateway:9091")
+	pushInterval := flag.Duration("push-interval", 10*time.Second, "How often to push to -pushgateway-url")
+	coherenceKeys := flag.Int("coherence-keys", 16, "Keys owned by each client in the coherence workload")
+	coherenceTimeout := flag.Duration("coherence-timeout", 5*time.Second, "Give up on a coherence write that is not visible on the second target after this long")
+	coherencePoll := flag.Duration("coherence-poll", time.Millisecond, "Pause between coherence reads of the second target")
+	ttlMin := flag.Duration("ttl-min", 2*time.Second, "Shortest TTL the ttl workload writes")
+	ttlMax := flag.Duration("ttl-max", 5*time.Second, "Longest TTL the ttl workload writes; each key's TTL is uniform in [-ttl-min, -ttl-max]")
+	deleteReadsBefore := flag.Int("delete-reads-before", 3, "Reads of each key the churn-delete workload issues between its PUT and its DELETE")
+	deleteReadsAfter := flag.Int("delete-reads-after", 5, "Reads of each key the churn-delete workload issues after its DELETE is acknowledged, each expecting 404")
+	deleteWindow := flag.Duration("delete-check-window", 2*time.Second, "How long after a DELETE the churn-delete workload keeps reading the key; reads after the first are spread log-uniformly over it")
+	dryRunFlag := flag.Bool("dry-run", false, "Validate flags, check the server, send one sample of each operation the workload issues, print estimates for the run, and exit")
+	recordPath := flag.String("record", "", "Append every operation (send time, client, method, key, value size, status, latency) to this trace file")
+	outageMode := flag.Bool("outage", false, "Keep running through server outages and report each one: downtime, requests failed during it, and time until throughput is back to 95%")
+	backupTarget := flag.String("backup-target", "", "With -outage, fail over to this base URL after -failover-after consecutive failures, probing the primary's /readyz to fail back")
+	failoverAfter := flag.Int("failover-after", 3, "Consecutive failures against the primary before a client switches to -backup-target")
+	failbackProbe := flag.Duration("failback-probe", time.Second, "How often a client on -backup-target probes the primary")
+	ttlTolerance := flag.Duration("ttl-tolerance", 250*time.Millisecond, "Margin around a key's expected expiry within which the ttl workload accepts either answer (clock drift, sweeper lag)")
+	coordinatorAddr := flag.String("coordinator", "", "Coordinate a distributed run on this address, e.g. :7070: hand these flags to -joiners load generators started with -join, start them together and merge their results")
+	joinerCount := flag.Int("joiners", 1, "With -coordinator, how many load generators to wait for; each runs -clients clients")
+	runID := flag.String("run-id", "", "ID of this run, sent to the server as X-Run-ID and in run markers, and included in the report (default: a random UUID)")
+	labels := labelFlag{}
+	flag.Var(labels, "label", "Annotate the run with key=value, sent in the run markers and included in the report; may be repeated")
+	seed := flag.Int64("seed", 0, "Seed the clients' random choices (keys, read/write mix, think times) so a run repeats the same requests (0: seed from the clock)")
+	autoTuneFlag := flag.Bool("auto-tune", false, "Search for the highest -rate that keeps the -auto-tune-percentile latency within -auto-tune-target, then run -duration at it to confirm")
+	autoTuneTarget := flag.Duration("auto-tune-target", 10*time.Millisecond, "With -auto-tune, the latency the percentile must stay within")
+	autoTunePercentile := flag.Float64("auto-tune-percentile", 99, "With -auto-tune, the latency percentile held to -auto-tune-target")
+	autoTuneWindow := flag.Duration("auto-tune-window", 10*time.Second, "With -auto-tune, how long each measured window runs")
+	autoTuneWarmup := flag.Duration("auto-tune-warmup", 2*time.Second, "With -auto-tune, an unmeasured run at the window's rate before each window and the confirmation run")
+	autoTuneMinRate := flag.Float64("auto-tune-min-rate", 100, "With -auto-tune, the first rate tried in reqs/sec; the rate doubles from it until a window fails")
+	autoTuneMaxRate := flag.Float64("auto-tune-max-rate", 100000, "With -auto-tune, the highest rate tried in reqs/sec")
+	autoTuneMaxWindows := flag.Int("auto-tune-max-windows", 16, "With -auto-tune, the most windows the search runs")
+	autoTuneCache := flag.String("auto-tune-cache", "carry", "With -auto-tune, the cache state each window starts from: carry (whatever the previous window left) or flush (empty, via POST /admin/cache/flush)")
+	joinAddr := flag.String("join", "", "Take part in a distributed run: get the flags from the -coordinator at this address, e.g. host:7070, and report to it")
 	flag.Parse()
+	if *runID == "" {
+		// Set through the flag so a coordinator hands the same ID to its
+		// joiners.
+		flag.Set("run-id", newRunID())
+	}
+
+	var joined *joinSession
+	if *joinAddr != "" {
+		var err error
+		if joined, err = joinRun(*joinAddr); err != nil {
+			log.Fatalf("Cannot join %s: %v", *joinAddr, err)
+		}
+	}
+
+	// Every flag is checked before giving up, so one run lists all the
+	// problems.
+	var problems []string
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if !slices.Contains(workloads, *workloadType) {
+		problem("Unknown -workload %q (want %s)", *workloadType, strings.Join(workloads, ", "))
+	}
+	pooled := *writerClients > 0 || *readerClients > 0
+	if pooled {
+		clientsSet := false
+		flag.Visit(func(f *flag.Flag) { clientsSet = clientsSet || f.Name == "clients" })
+		if clientsSet {
+			problem("-clients cannot be combined with -writer-clients and -reader-clients, which replace it")
+		}
+		*numClients = *writerClients + *readerClients
+	}
+	if *numClients <= 0 || *durationSec <= 0 {
+		problem("-clients and -duration must be positive")
+	}
+	targets, err := parseTargets(*targetSpec)
+	if err != nil {
+		problem("%v", err)
+	}
+	readTargets, writeTargets := targets, targets
+	if *readTargetSpec != "" {
+		if readTargets, err = parseTargets(*readTargetSpec); err != nil {
+			problem("%v", err)
+		}
+	}
+	if *writeTargetSpec != "" {
+		if writeTargets, err = parseTargets(*writeTargetSpec); err != nil {
+			problem("%v", err)
+		}
+	}
+	if *workloadType == "coherence" {
+		if len(targets) < 2 {
+			problem("-workload=coherence needs two targets: writes go to the first, reads to the second")
+		}
+		if *coherenceKeys <= 0 {
+			problem("-coherence-keys must be positive")
+		}
+	}
+
+	if *workloadType == "ttl" {
+		if *ttlMin < time.Millisecond || *ttlMax < *ttlMin {
+			problem("-ttl-min must be at least 1ms and -ttl-max at least -ttl-min")
+		}
+		if *ttlTolerance < 0 {
+			problem("-ttl-tolerance must not be negative")
+		}
+	}
+
+	if *workloadType == "churn-delete" {
+		if *deleteReadsBefore < 0 || *deleteReadsAfter < 0 {
+			problem("-delete-reads-before and -delete-reads-after must not be negative")
+		}
+		if *deleteWindow < time.Millisecond {
+			problem("-delete-check-window must be at least 1ms")
+		}
+	}
+
+	if *targetRate < 0 {
+		problem("-rate must not be negative")
+	}
+	if *thinkTime < 0 {
+		problem("-think-time must not be negative")
+	}
+	if *targetRate > 0 && *thinkTime > 0 {
+		problem("-rate and -think-time are mutually exclusive: -rate paces an open loop, -think-time a closed one")
+	}
+	if *writerClients < 0 || *readerClients < 0 || *writerRate < 0 || *readerRate < 0 || *readLag < 0 {
+		problem("-writer-clients, -reader-clients, -writer-rate, -reader-rate and -read-lag must not be negative")
+	}
+	if pooled {
+		if *workloadType != "mixed" {
+			problem("-writer-clients and -reader-clients only apply to -workload=mixed")
+		}
+		if *targetRate > 0 || *thinkTime > 0 {
+			problem("-writer-clients and -reader-clients pace themselves with -writer-rate and -reader-rate, not -rate or -think-time")
+		}
+		if *useHTTP2 {
+			problem("-writer-clients and -reader-clients cannot be combined with -http2")
+		}
+	} else if *writerRate > 0 || *readerRate > 0 || *readerKeys != "" || *readLag > 0 || *writerKeys != writeSequential {
+		problem("-writer-rate, -reader-rate, -writer-keys, -reader-keys and -read-lag need -writer-clients or -reader-clients")
+	}
+	if err := validateThinkDist(*thinkDist); err != nil {
+		problem("%v", err)
+	}
+	if *workloadType == "churn" {
+		if *hotKeys <= 0 {
+			problem("-hot-keys must be positive")
+		}
+		if *churnInterval < churnBucket {
+			problem("-churn-interval must be at least %s", churnBucket)
+		}
+	}
+	var tenants []tenant
+	var tenantByClient []int
+	if (*workloadType == "tenants") != (*tenantSpec != "") {
+		problem("-workload=tenants and -tenants must be used together")
+	}
+	if *tenantSpec != "" {
+		if tenants, err = parseTenants(*tenantSpec); err != nil {
+			problem("%v", err)
+		}
+		if tenantByClient, err = assignTenants(tenants, *numClients); err != nil {
+			problem("%v", err)
+		}
+	}
+	if err := validateKeyDist(*keyDist); err != nil {
+		problem("%v", err)
+	}
+	switch *prime {
+	case "auto", "keyspace", "none":
+	default:
+		problem("Unknown -prime %q (want auto, keyspace, or none)", *prime)
+	}
+	if *primeConcurrency <= 0 || *primeBatch <= 0 {
+		problem("-prime-concurrency and -prime-batch must be positive")
+	}
+	if *cacheFill < 0 || *cacheFill > 1 {
+		problem("-cache-fill must be between 0 and 1")
+	}
+	if *keysPerClient <= 0 {
+		problem("-keys-per-client must be positive")
+	}
+	var keyTmpl *keyTemplate
+	keyFlagsSet := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { keyFlagsSet[f.Name] = true })
+	switch {
+	case *keyTemplateSpec != "":
+		if !slices.Contains(templateWorkloads, *workloadType) {
+			problem("-key-template does not apply to -workload=%s, which names its own keys (want %s)", *workloadType, strings.Join(templateWorkloads, ", "))
+		}
+		if !keyFlagsSet["key-max"] {
+			problem("-key-template needs -key-max")
+		} else if keyTmpl, err = parseKeyTemplate(*keyTemplateSpec, *keyMin, *keyMax); err != nil {
+			problem("%v", err)
+		}
+		if keyFlagsSet["keys-per-client"] {
+			problem("-keys-per-client does not apply to -key-template, whose keyspace is -key-min..-key-max")
+		}
+	case keyFlagsSet["key-min"] || keyFlagsSet["key-max"]:
+		problem("-key-min and -key-max need -key-template")
+	}
+	if keyTmpl != nil {
+		allClients := int64(*numClients)
+		if *coordinatorAddr != "" {
+			allClients *= int64(*joinerCount)
+		}
+		if keyTmpl.size() < allClients {
+			problem("-key-min..-key-max holds %d IDs, fewer than the %d clients that each need a slice of them", keyTmpl.size(), allClients)
+		}
+		if *workloadType == "churn" && *hotKeys > 0 && *churnInterval >= churnBucket {
+			if n := churnKeyCount(*hotKeys, *churnInterval, time.Duration(*durationSec)*time.Second); int64(n) > keyTmpl.size() {
+				problem("-workload=churn slides over %d keys in %ds, more than the %d IDs of -key-min..-key-max", n, *durationSec, keyTmpl.size())
+			}
+		}
+	}
+	if *opTimeout <= 0 {
+		problem("-op-timeout must be positive")
+	}
+	if *liveDashboard && (*quiet || *progressInterval > 0) {
+		problem("-live-dashboard cannot be combined with -quiet or -progress-interval")
+	}
+	if *retries < 0 {
+		problem("-retries must not be negative")
+	}
+	if *respectBackpressure && *maxBackoff <= 0 {
+		problem("-max-backoff must be positive")
+	}
+	if *pushgatewayURL != "" && *pushInterval <= 0 {
+		problem("-push-interval must be positive")
+	}
+	if *recordPath != "" && (*workloadType == "coherence" || *workloadType == "ttl" || *workloadType == "churn-delete") {
+		problem("-record does not apply to -workload=%s", *workloadType)
+	}
+	if *coordinatorAddr != "" || *joinAddr != "" {
+		if *coordinatorAddr != "" && *joinAddr != "" {
+			problem("-coordinator and -join are mutually exclusive")
+		}
+		if !slices.Contains(distributedWorkloads, *workloadType) {
+			problem("-workload=%s cannot run distributed (want %s)", *workloadType, strings.Join(distributedWorkloads, ", "))
+		}
+		if *recordPath != "" || *outageMode || *strict || *serverTiming || *respectBackpressure || *liveDashboard || *latencyExport != "" {
+			problem("-record, -outage, -strict, -server-timing, -respect-backpressure, -live-dashboard and -latency-export do not apply to a distributed run")
+		}
+		if pooled {
+			problem("-writer-clients and -reader-clients do not apply to a distributed run")
+		}
+	}
+	if *coordinatorAddr != "" {
+		if *joinerCount <= 0 {
+			problem("-joiners must be positive")
+		}
+		if *dryRunFlag || *primeOnly {
+			problem("-dry-run and -prime-only do not apply to -coordinator")
+		}
+		if *metricsAddr != "" || *pushgatewayURL != "" {
+			problem("-metrics-addr and -pushgateway-url apply to the joiners, not -coordinator")
+		}
+	}
+	if *autoTuneFlag {
+		switch *workloadType {
+		case "coherence", "ttl", "churn-delete":
+			problem("-auto-tune does not apply to -workload=%s", *workloadType)
+		}
+		if *targetRate > 0 || *thinkTime > 0 || pooled {
+			problem("-auto-tune chooses the rate itself and cannot be combined with -rate, -think-time, -writer-clients or -reader-clients")
+		}
+		if *coordinatorAddr != "" || *joinAddr != "" || *outageMode {
+			problem("-auto-tune does not apply to a distributed run or -outage")
+		}
+		if *autoTuneTarget <= 0 || *autoTuneWindow <= 0 || *autoTuneMaxWindows <= 0 {
+			problem("-auto-tune-target, -auto-tune-window and -auto-tune-max-windows must be positive")
+		}
+		if *autoTunePercentile <= 0 || *autoTunePercentile > 100 {
+			problem("-auto-tune-percentile must be above 0 and at most 100")
+		}
+		if *autoTuneWarmup < 0 {
+			problem("-auto-tune-warmup must not be negative")
+		}
+		if *autoTuneMinRate <= 0 || *autoTuneMaxRate < *autoTuneMinRate {
+			problem("-auto-tune-min-rate must be positive and -auto-tune-max-rate at least -auto-tune-min-rate")
+		}
+		if *autoTuneCache != "carry" && *autoTuneCache != "flush" {
+			problem("Unknown -auto-tune-cache %q (want carry or flush)", *autoTuneCache)
+		}
+	}
+	var backup []string
+	if *backupTarget != "" {
+		if !*outageMode {
+			problem("-backup-target requires -outage")
+		}
+		if len(targets) > 1 || *readTargetSpec != "" || *writeTargetSpec != "" {
+			problem("-backup-target needs a single -target and no -read-target or -write-target")
+		}
+		if *workloadType == "coherence" || *workloadType == "ttl" || *workloadType == "churn-delete" {
+			problem("-backup-target does not apply to -workload=%s", *workloadType)
+		}
+		if backup, err = parseTargets(*backupTarget); err != nil || len(backup) != 1 {
+			problem("-backup-target must be a single base URL")
+		}
+		if *failoverAfter <= 0 || *failbackProbe <= 0 {
+			problem("-failover-after and -failback-probe must be positive")
+		}
+	}
+	cfg := &workerConfig{
+		workload:     *workloadType,
+		clients:      *numClients,
+		targets:      targets,
+		readTargets:  readTargets,
+		writeTargets: writeTargets,
+		pathPrefix:   normalizePathPrefix(*pathPrefix),
+
+		keysPerClient: *keysPerClient,
+		readOthers:    *readOthers,
+		keyTemplate:   keyTmpl,
+		allClients:    *numClients,
+
+		hotKeys:       *hotKeys,
+		churnInterval: *churnInterval,
+		keyDist:       *keyDist,
+		thinkTime:     *thinkTime,
+		thinkDist:     *thinkDist,
+		opTimeout:     *opTimeout,
+		retries:       *retries,
+		retryBackoff:  *retryBackoff,
+
+		respectBackpressure: *respectBackpressure,
+		maxBackoff:          *maxBackoff,
+
+		coherenceKeys:    *coherenceKeys,
+		coherenceTimeout: *coherenceTimeout,
+		coherencePoll:    *coherencePoll,
+
+		ttlMin:       *ttlMin,
+		ttlMax:       *ttlMax,
+		ttlTolerance: *ttlTolerance,
+
+		deleteReadsBefore: *deleteReadsBefore,
+		deleteReadsAfter:  *deleteReadsAfter,
+		deleteWindow:      *deleteWindow,
+
+		tenants:        tenants,
+		tenantByClient: tenantByClient,
+
+		strict:       *strict,
+		serverTiming: *serverTiming,
+		seed:         *seed,
+
+		primeConcurrency: *primeConcurrency,
+		primeBatch:       *primeBatch,
+		primeMaxFailures: *primeMaxFailures,
+		primeServerSide:  *primeServerSide,
+		cacheFill:        *cacheFill,
+		adminToken:       *adminToken,
+		runID:            *runID,
+		labels:           labels,
+		quiet:            *quiet,
+
+		failoverAfter: *failoverAfter,
+		failbackProbe: *failbackProbe,
+	}
+	if *outageMode {
+		cfg.outage = &outageTracker{}
+	}
+	if joined != nil {
+		cfg.idBase, cfg.allClients = joined.IDBase, joined.AllClients
+	}
+	if len(backup) == 1 {
+		cfg.backup = backup[0]
+	}
+	transportName := "tcp"
+	if *unixSocket != "" {
+		cfg.transport = unixTransport(*unixSocket)
+		transportName = "unix:" + *unixSocket
+	}
+	cfg.transport = &runIDTransport{base: cfg.transport, runID: *runID}
+	if pooled {
+		if *readerKeys == "" {
+			*readerKeys = readPopular
+			if *readLag > 0 {
+				*readerKeys = readRecent
+			}
+		}
+		// Each pool opens its own connections, so readers never queue
+		// behind writers for one.
+		poolTransport := func() http.RoundTripper {
+			if *unixSocket != "" {
+				return &runIDTransport{base: unixTransport(*unixSocket), runID: *runID}
+			}
+			return &runIDTransport{base: http.DefaultTransport.(*http.Transport).Clone(), runID: *runID}
+		}
+		if cfg.pools, err = newWorkerPools(*writerClients, *readerClients, *writerRate, *readerRate, *writerKeys, *readerKeys, *readLag, poolTransport); err != nil {
+			problem("%v", err)
+		}
+	}
+	if *http2Fraction < 0 || *http2Fraction > 1 {
+		problem("-http2-fraction must be between 0 and 1")
+	}
+	numHTTP2 := 0
+	var h2 http.RoundTripper
+	if *useHTTP2 {
+		h2 = &runIDTransport{base: h2cTransport(*unixSocket), runID: *runID}
+		numHTTP2 = int(math.Round(*http2Fraction * float64(*numClients)))
+	}
+	if *targetRate > 0 {
+		cfg.interval = time.Duration(float64(*numClients) / *targetRate * float64(time.Second))
+	}
+
+	thresholds := slaFromFlags(maxErrorRate, maxP99, minThroughput)
+	var baseline *Report
+	var regressionLimit float64
+	if *baselinePath != "" {
+		if baseline, err = loadBaseline(*baselinePath); err != nil {
+			problem("Cannot load -baseline: %v", err)
+		}
+	}
+	if *failOnRegression != "" {
+		if *baselinePath == "" {
+			problem("-fail-on-regression requires -baseline")
+		}
+		if regressionLimit, err = parsePercent(*failOnRegression); err != nil || regressionLimit == 0 {
+			problem("-fail-on-regression must be a positive percentage like 5%%")
+		}
+	}
+	if len(problems) > 0 {
+		log.Fatalf("Invalid flags:\n  - %s", strings.Join(problems, "\n  - "))
+	}
 
-	if *workloadType == "get-popular" || *workloadType == "mixed" {
-		primePopularKeys()
+	if keyTmpl != nil {
+		popularKeys = keyTmpl.popular()
 	}
 
-	rand.New(rand.NewSource(time.Now().UnixNano()))
-	resultsChan := make(chan Result)
+	cfg.server = discoverServer(cfg, targets[0])
+	cfg.clock = syncClock(cfg, targets[0])
+	// The checks allow -ttl-tolerance either side of the expiry for the
+	// time a request spends in flight, which the clock sync measured.
+	if *workloadType == "ttl" && cfg.clock != nil && *ttlTolerance < 2*cfg.clock.rtt {
+		log.Printf("WARNING: -ttl-tolerance %s is less than twice the %s round trip to the server; expect spurious violations",
+			*ttlTolerance, cfg.clock.rtt.Round(time.Microsecond))
+	}
+	featureErr := checkFeatures(cfg)
+	if featureErr != nil && !*dryRunFlag {
+		log.Fatal(featureErr)
+	}
+	primeServerSideSet := false
+	flag.Visit(func(f *flag.Flag) { primeServerSideSet = primeServerSideSet || f.Name == "prime-server-side" })
+	if !primeServerSideSet && *prime != "none" && autoPrimeServerSide(cfg) {
+		log.Printf("Server supports /admin/generate; priming server-side (-prime-server-side=false to disable)")
+		cfg.primeServerSide = true
+	}
+
+	var primeSet []string
+	switch {
+	case *prime == "none":
+	case *workloadType == "get-popular" || *workloadType == "mixed":
+		primeSet = popularKeys
+	case *workloadType == "tenants":
+		primeSet = tenantKeys(tenants)
+	case *workloadType == "churn":
+		primeSet = churnPrimeKeys(keyTmpl, *hotKeys, *churnInterval, time.Duration(*durationSec)*time.Second)
+	}
+	if *prime == "auto" && cfg.pools != nil && cfg.pools.readers.keyPolicy == readUniform {
+		// The writers are the first clients, so this is their ranges.
+		primeSet = append(primeSet, keyspaceKeys(keyTmpl, *writerClients, *numClients, *keysPerClient)...)
+	}
+	if *prime == "keyspace" {
+		allClients := *numClients
+		if *coordinatorAddr != "" {
+			allClients *= *joinerCount
+		}
+		primeSet = append(primeSet, keyspaceKeys(keyTmpl, allClients, allClients, *keysPerClient)...)
+	}
+	if keyTmpl != nil {
+		// The popular keys are the first IDs, which the keyspace holds too.
+		primeSet = uniqueKeys(primeSet)
+	}
+	if *dryRunFlag {
+		cfg.start = time.Now()
+		os.Exit(dryRun(cfg, dryRunPlan{
+			duration:   time.Duration(*durationSec) * time.Second,
+			targetRate: *targetRate,
+			primeKeys:  len(primeSet),
+			featureErr: featureErr,
+		}))
+	}
+	if len(primeSet) > 0 {
+		if err := primeKeys(cfg, writeTargets[0], primeSet); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *primeOnly {
+		os.Exit(0)
+	}
+	var tuned *autoTuneReport
+	var tuneParams autoTuneParams
+	if *autoTuneFlag {
+		tuneParams = autoTuneParams{
+			percentile: *autoTunePercentile,
+			target:     *autoTuneTarget,
+			window:     *autoTuneWindow,
+			warmup:     *autoTuneWarmup,
+			minRate:    *autoTuneMinRate,
+			maxRate:    *autoTuneMaxRate,
+			maxWindows: *autoTuneMaxWindows,
+			cache:      *autoTuneCache,
+		}
+		tuned = autoTune(cfg, tuneParams, func(i int) http.RoundTripper {
+			if i < numHTTP2 {
+				return h2
+			}
+			return cfg.transport
+		})
+		if tuned.SustainableRate == 0 || tuned.Interrupted {
+			report := &Report{
+				RunID:       *runID,
+				Labels:      labels,
+				Workload:    *workloadType,
+				Clients:     *numClients,
+				Interrupted: tuned.Interrupted,
+				Transport:   transportName,
+				Server:      cfg.server,
+				Seed:        *seed,
+				AutoTune:    tuned,
+			}
+			os.Exit(finishRun(report, thresholds, "", nil, 0, *jsonOut))
+		}
+		// The confirmation is the regular run at the rate found; the
+		// search has already warmed up at it.
+		*targetRate = tuned.SustainableRate
+		cfg.interval = time.Duration(float64(*numClients) / *targetRate * float64(time.Second))
+		log.Printf("Auto-tune: confirming %.0f reqs/sec for %ds", *targetRate, *durationSec)
+	}
+	if *coordinatorAddr != "" {
+		coord := newCoordinator(*joinerCount, *numClients, *targetRate)
+		if err := coord.serve(*coordinatorAddr); err != nil {
+			log.Fatalf("Cannot serve -coordinator: %v", err)
+		}
+		testDuration := time.Duration(*durationSec) * time.Second
+		agg, joiners, startTime, interrupted, protocols, connections, reused := coord.run(*quiet, *progressInterval, testDuration, cfg.interval > 0)
+		if interrupted {
+			testDuration = time.Since(startTime)
+		}
+		report := &Report{
+			RunID:       *runID,
+			Labels:      labels,
+			Workload:    *workloadType,
+			Clients:     *numClients * *joinerCount,
+			DurationSec: testDuration.Seconds(),
+			Interrupted: interrupted,
+			Transport:   transportName,
+			Protocols:   protocols,
+			Connections: connections,
+			Reused:      reused,
+			TargetRate:  *targetRate,
+			Server:      cfg.server,
+			Joiners:     joiners,
+		}
+		report.setStart(startTime, cfg.clock)
+		agg.fill(report, testDuration)
+		if *workloadType != "get-popular" {
+			report.Keyspace = int64(report.Clients) * int64(*keysPerClient)
+			if keyTmpl != nil {
+				report.Keyspace = keyTmpl.size()
+			}
+		}
+		report.Keys = keyTmpl.report()
+		os.Exit(finishRun(report, thresholds, *baselinePath, baseline, regressionLimit, *jsonOut))
+	}
+
+	if *metricsAddr != "" || *pushgatewayURL != "" {
+		cfg.metrics = newClientMetrics(*targetRate)
+	}
+	if *recordPath != "" {
+		if cfg.recorder, err = newRecorder(*recordPath); err != nil {
+			log.Fatalf("Cannot create -record file: %v", err)
+		}
+	}
+	if *metricsAddr != "" {
+		if err := cfg.metrics.serve(*metricsAddr); err != nil {
+			log.Fatalf("Cannot serve -metrics-addr: %v", err)
+		}
+	}
+
+	if joined != nil {
+		if err := joined.waitStart(); err != nil {
+			log.Fatalf("Coordinator did not start the run: %v", err)
+		}
+	}
 	var wg sync.WaitGroup
 	stopChan := make(chan struct{})
 
-	for i := 0; i < *numClients; i++ {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	var interrupted atomic.Bool
+
+	sendRunMarkers(cfg, "start")
+	startTime := time.Now()
+	cfg.start = startTime
+	stopPush, pushed := make(chan struct{}), make(chan struct{})
+	if cfg.metrics != nil {
+		cfg.metrics.start = startTime
+	}
+	if cfg.recorder != nil {
+		cfg.recorder.begin(startTime, cfg.clock)
+	}
+	if *pushgatewayURL != "" {
+		go cfg.metrics.pushLoop(*pushgatewayURL, *pushInterval, stopPush, pushed)
+	} else {
+		close(pushed)
+	}
+	gcStart := readGC()
+	workers := make([]*aggregator, *numClients)
+	transports := make([]*trackingTransport, *numClients)
+	for i := range workers {
+		workers[i] = newAggregator(cfg.interval > 0 || cfg.pools.openLoop(), *workloadType == "churn", startTime)
+		workers[i].trackOutage = *outageMode
+		if *latencyExport != "" {
+			workers[i].split = newLatencySplit()
+		}
+		base := cfg.transport
+		if i < numHTTP2 {
+			base = h2
+		}
+		if cfg.pools != nil {
+			base = cfg.pools.of(i).transport
+		}
+		transports[i] = newTrackingTransport(base)
 		wg.Add(1)
-		go runClient(i, *workloadType, resultsChan, &wg, stopChan)
+		go runClient(i, cfg, transports[i], workers[i], &wg, stopChan)
 	}
 
 	go func() {
-		time.Sleep(time.Duration(*durationSec) * time.Second)
+		select {
+		case <-time.After(time.Duration(*durationSec) * time.Second):
+		case <-sigChan:
+			interrupted.Store(true)
+		case <-joined.stopped():
+			interrupted.Store(true)
+		}
+		signal.Stop(sigChan)
 		close(stopChan)
 	}()
 
+	done := make(chan struct{})
 	go func() {
 		wg.Wait()
-		close(resultsChan)
+		close(done)
 	}()
 
-	var totalRequests int64
-	var totalErrors int64
-	var totalResponseTime time.Duration
+	progress := newProgressPrinter(*quiet, *liveDashboard, *progressInterval, time.Duration(*durationSec)*time.Second, startTime)
+	if progress != nil {
+		progress.outage = cfg.outage
+	}
+	tick := progress.ticks()
+	joinerTick := joined.ticks()
+
+wait:
+	for {
+		select {
+		case <-done:
+			break wait
+		case now := <-tick:
+			progress.print(workers, now)
+		case <-joinerTick:
+			joined.report(workers)
+		}
+	}
+	gcEnd := readGC()
+	progress.finish()
+	sendRunMarkers(cfg, "stop")
+	close(stopPush)
+	<-pushed
+	if cfg.recorder != nil {
+		if err := cfg.recorder.Close(); err != nil {
+			log.Printf("Failed to write -record file: %v", err)
+		}
+	}
 
-	for res := range resultsChan {
-		totalRequests++
-		totalResponseTime += res.responseTime
-		if res.isError {
-			totalErrors++
+	agg := newAggregator(cfg.interval > 0 || cfg.pools.openLoop(), *workloadType == "churn", startTime)
+	for _, w := range workers {
+		agg.merge(w)
+	}
+	protocols := make(map[string]int64)
+	var connections, reused int64
+	for _, t := range transports {
+		connections += t.conns.Load()
+		reused += t.reused.Load()
+		for proto, n := range t.protos {
+			protocols[proto] += n
 		}
 	}
+	if joined != nil {
+		joined.report(workers)
+		joined.finish(agg, connections, reused, protocols)
+	}
 
 	testDuration := time.Duration(*durationSec) * time.Second
-	successfulRequests := totalRequests - totalErrors
-	throughput := float64(successfulRequests) / testDuration.Seconds()
-
-	var avgResponseTimeMs int64
-	if totalRequests > 0 {
-		avgResponseTimeMs = (totalResponseTime / time.Duration(totalRequests)).Milliseconds()
-	}
-
-	fmt.Println("\n===================================")
-	fmt.Println("       LOAD TEST RESULTS")
-	fmt.Println("===================================")
-	fmt.Printf("Workload:            %s\n", *workloadType)
-	fmt.Printf("Active Clients:      %d\n", *numClients)
-	fmt.Printf("Duration:            %s\n", testDuration)
-	fmt.Println("-----------------------------------")
-	fmt.Printf("Total Requests:      %d\n", totalRequests)
-	fmt.Printf("Success:             %d\n", successfulRequests)
-	fmt.Printf("Failed:              %d\n", totalErrors)
-	fmt.Println("-----------------------------------")
-	fmt.Printf("THROUGHPUT:          %.2f reqs/sec\n", throughput)
-	fmt.Printf("AVG RESPONSE TIME:   %d ms\n", avgResponseTimeMs)
-	fmt.Println("===================================")
+	if interrupted.Load() {
+		testDuration = time.Since(startTime)
+	}
+
+	report := &Report{
+		RunID:       *runID,
+		Labels:      labels,
+		Strict:      *strict,
+		Workload:    *workloadType,
+		Clients:     *numClients,
+		DurationSec: testDuration.Seconds(),
+		Interrupted: interrupted.Load(),
+		Transport:   transportName,
+		Protocols:   protocols,
+		Connections: connections,
+		Reused:      reused,
+		TargetRate:  *targetRate,
+		Server:      cfg.server,
+		Seed:        *seed,
+	}
+	report.setStart(startTime, cfg.clock)
+	agg.fill(report, testDuration)
+	if tuned != nil {
+		c := tuneParams.judge(agg, tuned.SustainableRate, testDuration)
+		tuned.Confirmation = &c
+		report.AutoTune = tuned
+	}
+	report.ClientGC = gcReport(gcStart, gcEnd, agg.requests)
+	if progress != nil && progress.dashboard {
+		report.Series = progress.series
+	}
+	if *latencyExport != "" {
+		written, err := agg.exportLatency(*latencyExport)
+		if err != nil {
+			log.Printf("Failed to write -latency-export: %v", err)
+		}
+		if len(written) > 0 {
+			log.Printf("Wrote latency percentiles to %s", strings.Join(written, ", "))
+		}
+	}
+	if *respectBackpressure {
+		report.Backpressure = agg.backpressure.report(*numClients, report.Success, testDuration)
+	}
+	if *workloadType == "tenants" {
+		report.Tenants = tenantReports(tenants, tenantByClient, workers, testDuration)
+	}
+	if cfg.pools != nil {
+		report.Pools = poolReports(cfg.pools, workers, transports, testDuration)
+	}
+	if *workloadType == "churn" {
+		events, recovered, avg, worst := churnRecovery(agg.timeline, *churnInterval, *recoverHitRate)
+		report.Churn = &churnReport{
+			HotKeys:          *hotKeys,
+			Interval:         churnInterval.String(),
+			KeyDist:          *keyDist,
+			RecoverHitRate:   *recoverHitRate,
+			Events:           events,
+			Recovered:        recovered,
+			AvgRecoveryMs:    float64(avg) / float64(time.Millisecond),
+			MaxRecoveryMs:    float64(worst) / float64(time.Millisecond),
+			TimelineBucketMs: churnBucket.Milliseconds(),
+		}
+	}
+	if report.TTL != nil {
+		report.TTL.Tolerance = ttlTolerance.String()
+		report.TTL.checkClock(cfg.clock)
+	}
+	if cfg.outage != nil {
+		report.Outage = outageReportFor(cfg.outage.state.all(), workers, agg.successes, startTime, startTime.Add(testDuration))
+		report.Outage.Backup = cfg.backup
+		report.Outage.Failovers = cfg.outage.failovers.Load()
+		report.Outage.Failbacks = cfg.outage.failbacks.Load()
+		report.Outage.BackupRequests = cfg.outage.backupRequests.Load()
+		for i := range report.Outage.Outages {
+			o := &report.Outage.Outages[i]
+			o.StartServer = cfg.clock.serverTime(o.Start)
+			if o.End != nil {
+				o.EndServer = cfg.clock.serverTime(*o.End)
+			}
+		}
+	}
+	if *workloadType == "put-all" || *workloadType == "get-all" || *workloadType == "mixed" {
+		report.Keyspace = int64(*numClients) * int64(*keysPerClient)
+		if keyTmpl != nil {
+			report.Keyspace = keyTmpl.size()
+		}
+	}
+	report.Keys = keyTmpl.report()
+	if *thinkTime > 0 {
+		report.ThinkTime = thinkTime.String()
+		report.ThinkDist = *thinkDist
+		cycle := *thinkTime + agg.avgResponseTime()
+		report.OfferedLoad = float64(*numClients) / cycle.Seconds()
+	}
+
+	os.Exit(finishRun(report, thresholds, *baselinePath, baseline, regressionLimit, *jsonOut))
 }
 
-func runClient(id int, workload string, results chan<- Result, wg *sync.WaitGroup, stopChan <-chan struct{}) {
+// finishRun checks the report against the thresholds and the baseline,
+// prints and saves it, and returns the exit code.
+func finishRun(report *Report, thresholds slaThresholds, baselinePath string, baseline *Report, regressionLimit float64, jsonOut string) int {
+	report.Client = currentBuild()
+	violations, exitCode := thresholds.check(report)
+	if baseline != nil {
+		report.Baseline = compareBaseline(baselinePath, baseline, report, regressionLimit)
+		for _, m := range report.Baseline.Mismatches {
+			log.Printf("WARNING: baseline was run with different parameters (%s)", m)
+		}
+		regressed, code := report.Baseline.regressions()
+		violations = append(violations, regressed...)
+		exitCode |= code
+	}
+	report.Violations = violations
+	report.Print()
+
+	if jsonOut != "" {
+		if err := report.WriteJSON(jsonOut); err != nil {
+			log.Printf("Failed to write JSON report: %v", err)
+		}
+	}
+	return exitCode
+}
+
+func runClient(id int, cfg *workerConfig, transport http.RoundTripper, stats *aggregator, wg *sync.WaitGroup, stopChan <-chan struct{}) {
 	defer wg.Done()
-	client := &http.Client{Timeout: 10 * time.Second}
+	cfg.metrics.workerStarted()
+	defer cfg.metrics.workerStopped()
+	client := &http.Client{Transport: transport}
+	rq := newRequester(client, cfg)
+	// pause serves every wait of the loop, as time.After would allocate
+	// a timer each time.
+	pause := time.NewTimer(time.Hour)
+	pause.Stop()
+	keys := &workerKeys{id: cfg.idBase + id, rng: cfg.rng(cfg.idBase + id)}
+	if cfg.tenantByClient != nil {
+		keys.tenant = cfg.tenantByClient[id]
+	}
+	if cfg.workload == "churn" {
+		keys.churn = newChurnKeys(cfg, id)
+	}
+	var coherence *coherenceWorker
+	if cfg.workload == "coherence" {
+		coherence = newCoherenceWorker(id, cfg)
+	}
+	var ttl *ttlWorker
+	if cfg.workload == "ttl" {
+		ttl = newTTLWorker(id, cfg)
+	}
+	var del *deleteChurnWorker
+	if cfg.workload == "churn-delete" {
+		del = newDeleteChurnWorker(id, cfg)
+	}
+	var fo *failover
+	if cfg.backup != "" {
+		fo = &failover{primary: cfg.targets[0], backup: cfg.backup, after: cfg.failoverAfter, probeEvery: cfg.failbackProbe}
+	}
+
+	// In open-loop mode each request has an intended send time on a fixed
+	// schedule; measuring from it rather than from the actual send keeps
+	// server stalls from hiding in the requests that were never sent.
+	nextSend := time.Now()
+	interval := cfg.intervalFor(id)
 
 	for {
 		select {
@@ -114,51 +1050,103 @@ func runClient(id int, workload string, results chan<- Result, wg *sync.WaitGrou
 		default:
 		}
 
-		startTime := time.Now()
-		var req *http.Request
-		var err error
-
-		switch workload {
-		case "get-popular":
-			key := popularKeys[rand.Intn(len(popularKeys))]
-			req, err = http.NewRequest("GET", "http://localhost:8080/kv/"+key, nil)
-
-		case "put-all":
-			key := fmt.Sprintf("key-%d-%d", id, time.Now().UnixNano())
-			val := "some-data-payload"
-			req, err = http.NewRequest("PUT", "http://localhost:8080/kv/"+key, bytes.NewBufferString(val))
-
-		case "get-all":
-			key := fmt.Sprintf("key-%d-%d", id, time.Now().UnixNano())
-			req, err = http.NewRequest("GET", "http://localhost:8080/kv/"+key, nil)
-
-		case "mixed":
-			if rand.Float32() < 0.5 {
-				key := popularKeys[rand.Intn(len(popularKeys))]
-				req, err = http.NewRequest("GET", "http://localhost:8080/kv/"+key, nil)
-			} else {
-				key := fmt.Sprintf("key-%d-%d", id, time.Now().UnixNano())
-				val := "data-mixed-" + key
-				req, err = http.NewRequest("PUT", "http://localhost:8080/kv/"+key, bytes.NewBufferString(val))
+		var intendedStart time.Time
+		if interval > 0 {
+			if wait := time.Until(nextSend); wait > 0 && !sleep(pause, wait, stopChan) {
+				return
 			}
+			intendedStart = nextSend
+			nextSend = nextSend.Add(interval)
+		}
 
+		startTime := time.Now()
+		if intendedStart.IsZero() {
+			intendedStart = startTime
+		}
+		var res Result
+		var backoff time.Duration
+		switch {
+		case coherence != nil:
+			res = coherence.step(rq, cfg, stopChan)
+		case ttl != nil:
+			res = ttl.step(client, cfg, stopChan)
+		case del != nil:
+			res = del.step(client, cfg, stopChan)
 		default:
-			log.Fatalf("Unknown workload type: %s", workload)
+			op := nextOperation(cfg, keys)
+			if op.method == "" {
+				// A lagged reader with nothing old enough to read yet.
+				if !sleep(pause, readLagPoll, stopChan) {
+					return
+				}
+				continue
+			}
+			if fo != nil {
+				op = fo.route(op, client, cfg)
+			}
+			out := op.execute(rq, cfg, stopChan)
+			completed := time.Now()
+			backoff = out.pause
+			cfg.recorder.record(id, op, out, startTime, completed.Sub(startTime), cfg.pathPrefix)
+			if op.method == "PUT" && out.class == errNone {
+				cfg.pools.published(op, keys)
+			}
+			res = Result{
+				method:        op.method,
+				responseTime:  completed.Sub(startTime),
+				correctedTime: completed.Sub(intendedStart),
+				isError:       out.class != errNone && !out.rejected,
+				errClass:      out.class,
+				retries:       out.retries,
+				cache:         out.cache,
+				bytesSent:     out.sent,
+				bytesReceived: out.received,
+				gotValue:      op.method == "GET" && out.class == errNone,
+				valueSize:     out.bodySize,
+				violations:    out.violations,
+				timing:        out.timing,
+				backpressure:  out.backpressure,
+				backoff:       out.backoff,
+				rejected:      out.rejected,
+				unavailable:   out.class != errNone && !out.rejected && retryable(out.class, out.status),
+			}
 		}
-
-		if err != nil {
-			results <- Result{0, true}
-			continue
+		res.sent = startTime
+		res.unavailable = res.unavailable || res.isError && (res.errClass == errConnection || res.errClass == errTimeout)
+		stats.record(res)
+		cfg.metrics.record(res)
+		if cfg.outage != nil {
+			cfg.outage.record(startTime, startTime.Add(res.responseTime), res.unavailable)
+			if fo != nil {
+				fo.observe(res.unavailable, cfg)
+			}
+			if res.unavailable && !sleep(pause, outagePause, stopChan) {
+				return
+			}
+		}
+		if backoff > 0 {
+			slept := time.Now()
+			ok := sleep(pause, backoff, stopChan)
+			stats.addBackoff(time.Since(slept))
+			if !ok {
+				return
+			}
 		}
 
-		resp, err := client.Do(req)
-		responseTime := time.Since(startTime)
-
-		isError := err != nil || resp.StatusCode >= 400
-		if resp != nil {
-			resp.Body.Close()
+		if think := cfg.nextThinkTime(keys.rng); think > 0 && !sleep(pause, think, stopChan) {
+			return
 		}
+	}
+}
 
-		results <- Result{responseTime, isError}
+// sleep waits for d on t and reports whether the run is still going.
+func sleep(t *time.Timer, d time.Duration, stopChan <-chan struct{}) bool {
+	t.Reset(d)
+	select {
+	case <-stopChan:
+		t.Stop()
+		return false
+	case <-t.C:
+		return true
 	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const clockSyncSamples = 8
+
+// clockSync estimates the server's clock offset (server minus client) from
+// GET /admin/time. Each sample brackets the server's reading between the
+// client's send and receive times; the sample with the shortest round
+// trip brackets it most tightly, so its midpoint is taken and half its
+// round trip is the uncertainty.
+type clockSync struct {
+	offset      time.Duration
+	uncertainty time.Duration
+	rtt         time.Duration
+	samples     int
+}
+
+type clockSyncReport struct {
+	OffsetMs      float64 `json:"offset_ms"`
+	UncertaintyMs float64 `json:"uncertainty_ms"`
+	MinRTTMs      float64 `json:"min_rtt_ms"`
+	Samples       int     `json:"samples"`
+}
+
+// syncClock returns nil for servers without the time feature or when no
+// sample succeeds; timestamps are then only given in local time.
+func syncClock(cfg *workerConfig, target string) *clockSync {
+	if !cfg.server.has("time") {
+		return nil
+	}
+	client := &http.Client{Timeout: 5 * time.Second, Transport: cfg.transport}
+	var best *clockSync
+	n := 0
+	for i := 0; i < clockSyncSamples; i++ {
+		offset, rtt, err := sampleClock(client, target)
+		if err != nil {
+			log.Printf("Clock sync sample failed: %v", err)
+			continue
+		}
+		n++
+		if best == nil || rtt < best.rtt {
+			best = &clockSync{offset: offset, rtt: rtt, uncertainty: rtt / 2}
+		}
+	}
+	if best != nil {
+		best.samples = n
+		log.Printf("Server clock offset %+.3f ms ± %.3f ms (%d samples)",
+			durationMs(best.offset), durationMs(best.uncertainty), best.samples)
+	}
+	return best
+}
+
+func sampleClock(client *http.Client, target string) (offset, rtt time.Duration, err error) {
+	sent := time.Now()
+	resp, err := client.Get(target + "/admin/time")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	var st struct {
+		UnixNanos int64 `json:"unix_nanos"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return 0, 0, err
+	}
+	// The monotonic readings give the round trip even if the wall clock
+	// steps meanwhile.
+	rtt = time.Since(sent)
+	mid := sent.Add(rtt / 2)
+	return time.Unix(0, st.UnixNanos).Sub(mid), rtt, nil
+}
+
+// serverTime converts a client timestamp to the server's clock; it is nil
+// without an estimate.
+func (c *clockSync) serverTime(t time.Time) *time.Time {
+	if c == nil || t.IsZero() {
+		return nil
+	}
+	st := t.Add(c.offset).Round(0)
+	return &st
+}
+
+func (c *clockSync) report() *clockSyncReport {
+	if c == nil {
+		return nil
+	}
+	return &clockSyncReport{
+		OffsetMs:      durationMs(c.offset),
+		UncertaintyMs: durationMs(c.uncertainty),
+		MinRTTMs:      durationMs(c.rtt),
+		Samples:       c.samples,
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
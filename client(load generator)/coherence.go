@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const maxReportedUnconverged = 20
+
+type coherenceSample struct {
+	key       string
+	converged bool
+	reads     int
+	elapsed   time.Duration
+}
+
+type coherenceReport struct {
+	Writes          int64          `json:"writes"`
+	Converged       int64          `json:"converged"`
+	NeverConverged  int64          `json:"never_converged"`
+	AvgReads        float64        `json:"avg_reads_to_converge"`
+	Convergence     latencySummary `json:"convergence_time"`
+	UnconvergedKeys []string       `json:"unconverged_keys,omitempty"`
+}
+
+// coherenceWorker writes through the first target and polls the second
+// until the new value is visible there. Each worker owns its own key range,
+// so no other writer can make a read look stale or converged.
+type coherenceWorker struct {
+	id     int
+	seq    int
+	writer string
+	reader string
+}
+
+func newCoherenceWorker(id int, cfg *workerConfig) *coherenceWorker {
+	return &coherenceWorker{id: id, writer: cfg.targets[0], reader: cfg.targets[1]}
+}
+
+func (c *coherenceWorker) step(rq *requester, cfg *workerConfig, stopChan <-chan struct{}) Result {
+	key := fmt.Sprintf("coherence-%d-%d", c.id, c.seq%cfg.coherenceKeys)
+	c.seq++
+	value := fmt.Sprintf("v-%d-%d-%d", c.id, c.seq, time.Now().UnixNano())
+
+	start := time.Now()
+	put := operation{method: "PUT", url: c.writer + cfg.pathPrefix + key, body: value}
+	out := put.execute(rq, cfg, stopChan)
+	retries := out.retries
+	if out.class != errNone {
+		return Result{responseTime: time.Since(start), isError: true, errClass: out.class, retries: retries, bytesSent: out.sent, violations: out.violations}
+	}
+
+	written := time.Now()
+	deadline := written.Add(cfg.coherenceTimeout)
+	sample := &coherenceSample{key: key}
+	for {
+		sample.reads++
+		if got, ok := fetchValue(rq.client, c.reader+cfg.pathPrefix+key, cfg.opTimeout); ok && got == value {
+			sample.converged = true
+			break
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-stopChan:
+			return Result{responseTime: time.Since(start), retries: retries}
+		case <-time.After(cfg.coherencePoll):
+		}
+	}
+	sample.elapsed = time.Since(written)
+
+	return Result{
+		responseTime:  time.Since(start),
+		correctedTime: time.Since(start),
+		retries:       retries,
+		bytesSent:     out.sent,
+		violations:    out.violations,
+		coherence:     sample,
+	}
+}
+
+func fetchValue(client *http.Client, url string, timeout time.Duration) (string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", false
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return "", false
+	}
+	return string(body), true
+}
+
+type coherenceStats struct {
+	convergence *histogram
+	reads       int64
+	converged   int64
+	never       int64
+	neverKeys   []string
+	writeCount  int64
+}
+
+func (cs *coherenceStats) add(s *coherenceSample) {
+	cs.writeCount++
+	if !s.converged {
+		cs.never++
+		if len(cs.neverKeys) < maxReportedUnconverged {
+			cs.neverKeys = append(cs.neverKeys, s.key)
+		}
+		return
+	}
+	cs.converged++
+	cs.reads += int64(s.reads)
+	cs.convergence.record(s.elapsed)
+}
+
+func (cs *coherenceStats) merge(o *coherenceStats) {
+	cs.writeCount += o.writeCount
+	cs.converged += o.converged
+	cs.never += o.never
+	cs.reads += o.reads
+	cs.convergence.merge(o.convergence)
+	for _, k := range o.neverKeys {
+		if len(cs.neverKeys) < maxReportedUnconverged {
+			cs.neverKeys = append(cs.neverKeys, k)
+		}
+	}
+}
+
+func (cs *coherenceStats) report() *coherenceReport {
+	r := &coherenceReport{
+		Writes:          cs.writeCount,
+		Converged:       cs.converged,
+		NeverConverged:  cs.never,
+		Convergence:     cs.convergence.summary(),
+		UnconvergedKeys: cs.neverKeys,
+	}
+	if cs.converged > 0 {
+		r.AvgReads = float64(cs.reads) / float64(cs.converged)
+	}
+	sort.Strings(r.UnconvergedKeys)
+	return r
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// ciZ is the normal quantile of the two-sided 95% confidence intervals.
+const ciZ = 1.96
+
+// minBeyond is how many samples must lie beyond a percentile for the
+// report not to warn about it.
+const minBeyond = 10
+
+// interval is a confidence interval in milliseconds, low then high.
+type interval [2]float64
+
+func (i *interval) String() string {
+	if i == nil {
+		return "[too few samples]"
+	}
+	return fmt.Sprintf("[%.2f, %.2f]", i[0], i[1])
+}
+
+func (i *interval) overlaps(o *interval) bool {
+	return i[0] <= o[1] && o[0] <= i[1]
+}
+
+// percentileCI brackets percentile p by order statistics: the number of
+// samples below the true percentile is binomial(n, p), so with the normal
+// approximation the ranks nq ± z·sqrt(nq(1-q)) bound it with about 95%
+// confidence. ok is false when either rank falls outside the samples.
+func (h *histogram) percentileCI(p float64) (lo, hi time.Duration, ok bool) {
+	n := float64(h.n)
+	q := p / 100
+	spread := ciZ * math.Sqrt(n*q*(1-q))
+	l, u := int64(math.Floor(n*q-spread)), int64(math.Ceil(n*q+spread))
+	if l < 1 || u > h.n {
+		return 0, 0, false
+	}
+	return min(max(h.atRank(l), h.min), h.max), min(max(h.atRank(u), h.min), h.max), true
+}
+
+// sampleWarnings flags the reported percentiles that too few samples lie
+// beyond to mean much.
+func sampleWarnings(s latencySummary) []string {
+	var out []string
+	for _, p := range []struct {
+		name string
+		pct  float64
+	}{{"p50", 50}, {"p90", 90}, {"p99", 99}, {"p99.9", 99.9}} {
+		need := int64(math.Round(minBeyond * 100 / (100 - p.pct)))
+		if s.Samples > 0 && s.Samples < need {
+			out = append(out, fmt.Sprintf("%s comes from %d samples; it needs at least %d (%d beyond it) to be more than noise, so run longer", p.name, s.Samples, need, minBeyond))
+		}
+	}
+	return out
+}
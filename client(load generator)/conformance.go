@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// responseInfo is what conformance checks see of one response.
+type responseInfo struct {
+	method        string
+	path          string
+	status        int
+	header        http.Header
+	contentLength int64 // -1 when the server sent none
+	bodyLen       int64
+}
+
+// conformanceCheck describes a violation in resp, or returns "" when it
+// conforms. Add a check here when the server grows a header.
+type conformanceCheck struct {
+	name  string
+	check func(resp *responseInfo) string
+}
+
+var conformanceChecks = []conformanceCheck{
+	{"content-length", checkContentLength},
+	{"empty-get", checkEmptyGet},
+	{"x-cache", checkXCache},
+	{"x-created", checkBoolHeader("PUT", "X-Created")},
+	{"x-deleted", checkBoolHeader("DELETE", "X-Deleted")},
+	{"x-value-version", checkValueVersion},
+	{"allow-on-405", checkAllow},
+}
+
+func checkContentLength(resp *responseInfo) string {
+	switch {
+	case resp.contentLength >= 0 && resp.contentLength != resp.bodyLen:
+		return fmt.Sprintf("Content-Length %d but body has %d bytes", resp.contentLength, resp.bodyLen)
+	case resp.method == "GET" && resp.status == http.StatusOK && resp.contentLength < 0:
+		return "no Content-Length"
+	}
+	return ""
+}
+
+func checkEmptyGet(resp *responseInfo) string {
+	if resp.method == "GET" && resp.status == http.StatusOK && resp.bodyLen == 0 {
+		return "empty body"
+	}
+	return ""
+}
+
+func isKVKey(path string) bool {
+	key, ok := strings.CutPrefix(path, "/kv/")
+	return ok && key != ""
+}
+
+func checkXCache(resp *responseInfo) string {
+	if resp.method != "GET" || !isKVKey(resp.path) || (resp.status != http.StatusOK && resp.status != http.StatusNotFound) {
+		return ""
+	}
+	switch v := resp.header.Get("X-Cache"); v {
+	case "HIT", "MISS", "STALE", "BYPASS", "NEGATIVE", "UNCACHEABLE":
+		return ""
+	case "":
+		return "no X-Cache"
+	default:
+		return fmt.Sprintf("unknown X-Cache %q", v)
+	}
+}
+
+func checkBoolHeader(method, name string) func(*responseInfo) string {
+	return func(resp *responseInfo) string {
+		if resp.method != method || !isKVKey(resp.path) || resp.status != http.StatusOK {
+			return ""
+		}
+		v := resp.header.Get(name)
+		if v == "" {
+			return "no " + name
+		}
+		if v != "true" && v != "false" {
+			return fmt.Sprintf("%s %q is not true or false", name, v)
+		}
+		return ""
+	}
+}
+
+func checkValueVersion(resp *responseInfo) string {
+	v := resp.header.Get("X-Value-Version")
+	if v == "" {
+		return ""
+	}
+	if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+		return fmt.Sprintf("X-Value-Version %q is not an integer", v)
+	}
+	return ""
+}
+
+func checkAllow(resp *responseInfo) string {
+	if resp.status == http.StatusMethodNotAllowed && resp.header.Get("Allow") == "" {
+		return "405 without Allow"
+	}
+	return ""
+}
+
+type violation struct {
+	check   string
+	example string
+}
+
+func checkConformance(resp *responseInfo) []violation {
+	var out []violation
+	for _, c := range conformanceChecks {
+		if msg := c.check(resp); msg != "" {
+			out = append(out, violation{c.name, fmt.Sprintf("%s %s -> %d: %s", resp.method, resp.path, resp.status, msg)})
+		}
+	}
+	return out
+}
+
+func newResponseInfo(op operation, resp *http.Response, bodyLen int64) *responseInfo {
+	path := op.url
+	if u, err := url.Parse(op.url); err == nil {
+		path = u.Path
+	}
+	return &responseInfo{
+		method:        op.method,
+		path:          path,
+		status:        resp.StatusCode,
+		header:        resp.Header,
+		contentLength: resp.ContentLength,
+		bodyLen:       bodyLen,
+	}
+}
+
+const violationExamples = 3
+
+type violationCounts map[string]*protocolViolation
+
+type protocolViolation struct {
+	Check    string   `json:"check"`
+	Count    int64    `json:"count"`
+	Examples []string `json:"examples"`
+}
+
+func (vc violationCounts) add(check string, count int64, examples []string) {
+	v, ok := vc[check]
+	if !ok {
+		v = &protocolViolation{Check: check}
+		vc[check] = v
+	}
+	v.Count += count
+	for _, e := range examples {
+		if len(v.Examples) < violationExamples {
+			v.Examples = append(v.Examples, e)
+		}
+	}
+}
+
+func (vc violationCounts) report() []protocolViolation {
+	out := make([]protocolViolation, 0, len(vc))
+	for _, v := range vc {
+		out = append(out, *v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Check < out[j].Check })
+	return out
+}
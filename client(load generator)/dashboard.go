@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// dashboardWindow is how many one-second points the -live-dashboard
+// sparklines show.
+const dashboardWindow = 60
+
+// intervalPoint is one progress interval: what the progress line and the
+// dashboard show, and, with -live-dashboard, a point of the report's
+// series, so the three always agree.
+type intervalPoint struct {
+	OffsetSec    float64  `json:"offset_s"`
+	Requests     int64    `json:"requests"`
+	Rps          float64  `json:"rps"`
+	ErrorRatePct float64  `json:"error_rate_pct"`
+	P99Ms        float64  `json:"p99_ms"`
+	HitRatePct   *float64 `json:"hit_rate_pct,omitempty"`
+}
+
+func newIntervalPoint(iv *intervalStats, offset, window time.Duration) intervalPoint {
+	pt := intervalPoint{
+		OffsetSec: offset.Seconds(),
+		Requests:  iv.requests,
+		Rps:       float64(iv.requests) / window.Seconds(),
+		P99Ms:     float64(iv.latency.percentile(99)) / float64(time.Millisecond),
+	}
+	if iv.requests > 0 {
+		pt.ErrorRatePct = float64(iv.errors) / float64(iv.requests) * 100
+	}
+	if rate, ok := iv.cache.rate(); ok {
+		pt.HitRatePct = &rate
+	}
+	return pt
+}
+
+// stdoutIsTerminal reports whether the dashboard can redraw itself in
+// place.
+func stdoutIsTerminal() bool {
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+var sparkLevels = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws one character per value, scaled from 0 to top; NaN
+// values, for seconds without any, are blank.
+func sparkline(values []float64, top float64) string {
+	var b strings.Builder
+	for range dashboardWindow - len(values) {
+		b.WriteByte(' ')
+	}
+	for _, v := range values {
+		switch {
+		case math.IsNaN(v):
+			b.WriteByte(' ')
+		case top <= 0:
+			b.WriteRune(sparkLevels[0])
+		default:
+			i := int(v / top * float64(len(sparkLevels)-1))
+			b.WriteRune(sparkLevels[min(max(i, 0), len(sparkLevels)-1)])
+		}
+	}
+	return b.String()
+}
+
+// liveDashboard renders the last dashboardWindow points of series in place:
+// a header, then per metric its latest value and a sparkline. lines is
+// how many lines the previous frame took, to move back over.
+type liveDashboard struct {
+	lines int
+}
+
+func (d *liveDashboard) render(series []intervalPoint, header string) {
+	window := series[max(len(series)-dashboardWindow, 0):]
+	last := window[len(window)-1]
+	column := func(get func(intervalPoint) float64) ([]float64, float64) {
+		values := make([]float64, len(window))
+		top := 0.0
+		for i, pt := range window {
+			values[i] = get(pt)
+			if !math.IsNaN(values[i]) {
+				top = max(top, values[i])
+			}
+		}
+		return values, top
+	}
+	hit, _ := column(func(pt intervalPoint) float64 {
+		if pt.HitRatePct == nil {
+			return math.NaN()
+		}
+		return *pt.HitRatePct
+	})
+	rps, topRps := column(func(pt intervalPoint) float64 { return pt.Rps })
+	p99, topP99 := column(func(pt intervalPoint) float64 { return pt.P99Ms })
+	errs, topErrs := column(func(pt intervalPoint) float64 { return pt.ErrorRatePct })
+
+	hitNow := "   n/a"
+	if last.HitRatePct != nil {
+		hitNow = fmt.Sprintf("%5.1f%%", *last.HitRatePct)
+	}
+	frame := []string{
+		header,
+		fmt.Sprintf("hit rate  %10s  %s  0-100%%", hitNow, sparkline(hit, 100)),
+		fmt.Sprintf("req/s     %10.0f  %s  max %.0f", last.Rps, sparkline(rps, topRps), topRps),
+		fmt.Sprintf("p99       %7.2f ms  %s  max %.2f ms", last.P99Ms, sparkline(p99, topP99), topP99),
+		fmt.Sprintf("errors    %9.2f%%  %s  max %.2f%%", last.ErrorRatePct, sparkline(errs, topErrs), topErrs),
+	}
+	var b strings.Builder
+	if d.lines > 0 {
+		fmt.Fprintf(&b, "\033[%dA", d.lines)
+	}
+	for _, line := range frame {
+		b.WriteString("\r\033[K")
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	d.lines = len(frame)
+	os.Stdout.WriteString(b.String())
+}
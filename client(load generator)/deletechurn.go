@@ -0,0 +1,333 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	maxReportedDeleteViolations = 20
+	// deleteMaxPending caps the deleted keys a worker still has reads
+	// after the delete to do; at the cap it waits for the next one instead
+	// of creating another key.
+	deleteMaxPending = 256
+)
+
+// deleteBuckets are the upper bounds of the windows the checks are broken
+// down by: time since the PUT was acknowledged for reads before the delete,
+// time since the DELETE was acknowledged for reads after it.
+var deleteBuckets = [...]time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second, 10 * time.Second}
+
+type deleteCheckKind int
+
+const (
+	deleteCreate deleteCheckKind = iota
+	deleteLiveRead
+	deleteDelete
+	deleteGoneRead
+)
+
+// deleteSample is the outcome of one step of the churn-delete workload.
+// since is the read's send time relative to the acknowledgement of the
+// PUT (live reads) or of the DELETE (reads after it).
+type deleteSample struct {
+	kind        deleteCheckKind
+	since       time.Duration
+	violation   string
+	unconfirmed bool
+}
+
+type deleteBucketReport struct {
+	Window     string  `json:"window"`
+	Reads      int64   `json:"reads"`
+	Violations int64   `json:"violations"`
+	RatePct    float64 `json:"violation_rate_pct"`
+}
+
+type deleteChurnReport struct {
+	Keys            int64                `json:"keys_created"`
+	Deletes         int64                `json:"deletes_confirmed"`
+	Unconfirmed     int64                `json:"deletes_unconfirmed"`
+	ReadsBefore     int64                `json:"reads_before_delete"`
+	ReadsAfter      int64                `json:"reads_after_delete"`
+	Premature       int64                `json:"premature_losses"`
+	Resurrected     int64                `json:"resurrections"`
+	PrematurePct    float64              `json:"premature_loss_rate_pct"`
+	ResurrectionPct float64              `json:"resurrection_rate_pct"`
+	BeforeDelete    []deleteBucketReport `json:"before_delete,omitempty"`
+	AfterDelete     []deleteBucketReport `json:"after_delete,omitempty"`
+	Examples        []string             `json:"violation_examples,omitempty"`
+}
+
+// liveKey is a key created and not yet deleted.
+type liveKey struct {
+	key   string
+	acked time.Time
+	reads int
+}
+
+// deletedKey is a key whose DELETE was acknowledged; due is when its next
+// read goes out.
+type deletedKey struct {
+	key   string
+	acked time.Time
+	due   time.Time
+	left  int
+}
+
+type deleteQueue []*deletedKey
+
+func (q deleteQueue) Len() int           { return len(q) }
+func (q deleteQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q deleteQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *deleteQueue) Push(x any)        { *q = append(*q, x.(*deletedKey)) }
+func (q *deleteQueue) Pop() any {
+	old := *q
+	k := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return k
+}
+
+// deleteChurnWorker creates keys from its own never-reused key range, reads
+// each -delete-reads-before times, deletes it and reads it -delete-reads-after
+// more times. The first read after the delete goes out at once and the
+// rest at log-uniform random delays up to -delete-check-window, so every
+// window of the breakdown gets reads. A 404 before the delete is a
+// premature loss; a 200 for a read sent after the DELETE was acknowledged
+// is a resurrection. Writes and deletes go to the worker's write target,
+// reads to its read target.
+type deleteChurnWorker struct {
+	id        int
+	seq       int
+	readBase  string
+	writeBase string
+	live      *liveKey
+	pending   deleteQueue
+	rng       *rand.Rand
+}
+
+func newDeleteChurnWorker(id int, cfg *workerConfig) *deleteChurnWorker {
+	return &deleteChurnWorker{
+		id:        id,
+		readBase:  cfg.readTargetFor(id) + cfg.pathPrefix,
+		writeBase: cfg.writeTargetFor(id) + cfg.pathPrefix,
+		rng:       cfg.rng(cfg.idBase + id),
+	}
+}
+
+func (d *deleteChurnWorker) step(client *http.Client, cfg *workerConfig, stopChan <-chan struct{}) Result {
+	if d.live == nil && len(d.pending) >= deleteMaxPending {
+		select {
+		case <-stopChan:
+			return Result{}
+		case <-time.After(time.Until(d.pending[0].due)):
+		}
+	}
+	switch {
+	case len(d.pending) > 0 && !time.Now().Before(d.pending[0].due):
+		return d.readGone(client, cfg, heap.Pop(&d.pending).(*deletedKey))
+	case d.live == nil:
+		return d.create(client, cfg)
+	case d.live.reads < cfg.deleteReadsBefore:
+		return d.readLive(client, cfg)
+	}
+	return d.delete(client, cfg)
+}
+
+func (d *deleteChurnWorker) create(client *http.Client, cfg *workerConfig) Result {
+	key := fmt.Sprintf("churn-delete-%d-%d", d.id, d.seq)
+	d.seq++
+	res, status, _, _, acked := ttlRequest(client, "PUT", d.writeBase+key, "churn-delete-"+key, cfg.opTimeout)
+	res.deleteChurn = &deleteSample{kind: deleteCreate}
+	if !res.isError && status >= 300 {
+		res.isError, res.errClass = true, httpErrorClass(status)
+	}
+	if !res.isError {
+		d.live = &liveKey{key: key, acked: acked}
+	}
+	return res
+}
+
+func (d *deleteChurnWorker) readLive(client *http.Client, cfg *workerConfig) Result {
+	k := d.live
+	k.reads++
+	res, status, _, sent, _ := ttlRequest(client, "GET", d.readBase+k.key, "", cfg.opTimeout)
+	if res.isError {
+		return res
+	}
+	s := &deleteSample{kind: deleteLiveRead, since: sent.Sub(k.acked)}
+	res.deleteChurn = s
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		s.violation = fmt.Sprintf("%s gone %s after the PUT was acknowledged, before its DELETE%s",
+			k.key, s.since.Round(time.Microsecond), atServerTime(cfg.clock, sent))
+	default:
+		res.isError, res.errClass, res.deleteChurn = true, httpErrorClass(status), nil
+	}
+	return res
+}
+
+func (d *deleteChurnWorker) delete(client *http.Client, cfg *workerConfig) Result {
+	k := d.live
+	d.live = nil
+	res, status, _, _, acked := ttlRequest(client, "DELETE", d.writeBase+k.key, "", cfg.opTimeout)
+	s := &deleteSample{kind: deleteDelete}
+	res.deleteChurn = s
+	if !res.isError && status >= 300 {
+		res.isError, res.errClass = true, httpErrorClass(status)
+	}
+	// Without an acknowledgement the key may or may not be gone, so no
+	// read after it can be judged.
+	if res.isError {
+		s.unconfirmed = true
+		return res
+	}
+	if cfg.deleteReadsAfter > 0 {
+		heap.Push(&d.pending, &deletedKey{key: k.key, acked: acked, due: acked, left: cfg.deleteReadsAfter})
+	}
+	return res
+}
+
+func (d *deleteChurnWorker) readGone(client *http.Client, cfg *workerConfig, k *deletedKey) Result {
+	k.left--
+	if k.left > 0 {
+		k.due = k.acked.Add(logUniform(d.rng, time.Millisecond, cfg.deleteWindow))
+		heap.Push(&d.pending, k)
+	}
+	res, status, _, sent, _ := ttlRequest(client, "GET", d.readBase+k.key, "", cfg.opTimeout)
+	if res.isError {
+		return res
+	}
+	s := &deleteSample{kind: deleteGoneRead, since: sent.Sub(k.acked)}
+	res.deleteChurn = s
+	switch status {
+	case http.StatusNotFound:
+	case http.StatusOK:
+		s.violation = fmt.Sprintf("%s readable %s after the DELETE was acknowledged%s",
+			k.key, s.since.Round(time.Microsecond), atServerTime(cfg.clock, sent))
+	default:
+		res.isError, res.errClass, res.deleteChurn = true, httpErrorClass(status), nil
+	}
+	return res
+}
+
+// logUniform returns a random duration in [lo, hi] whose logarithm is
+// uniform, so short and long delays are equally well covered.
+func logUniform(rng *rand.Rand, lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return hi
+	}
+	return time.Duration(float64(lo) * math.Pow(float64(hi)/float64(lo), rng.Float64()))
+}
+
+type deleteWindowStats [len(deleteBuckets) + 1]struct{ reads, violations int64 }
+
+func (w *deleteWindowStats) add(since time.Duration, violation bool) {
+	i := sort.Search(len(deleteBuckets), func(i int) bool { return since < deleteBuckets[i] })
+	w[i].reads++
+	if violation {
+		w[i].violations++
+	}
+}
+
+func (w *deleteWindowStats) merge(o *deleteWindowStats) {
+	for i := range w {
+		w[i].reads += o[i].reads
+		w[i].violations += o[i].violations
+	}
+}
+
+func (w *deleteWindowStats) report() []deleteBucketReport {
+	var out []deleteBucketReport
+	for i, b := range w {
+		if b.reads == 0 {
+			continue
+		}
+		var window string
+		switch {
+		case i == 0:
+			window = "<" + deleteBuckets[0].String()
+		case i == len(deleteBuckets):
+			window = ">=" + deleteBuckets[i-1].String()
+		default:
+			window = deleteBuckets[i-1].String() + "-" + deleteBuckets[i].String()
+		}
+		out = append(out, deleteBucketReport{Window: window, Reads: b.reads, Violations: b.violations, RatePct: pct(b.violations, b.reads)})
+	}
+	return out
+}
+
+type deleteChurnStats struct {
+	creates, deletes, unconfirmed int64
+	before, after                 deleteWindowStats
+	examples                      []string
+}
+
+func (ds *deleteChurnStats) add(s *deleteSample) {
+	switch s.kind {
+	case deleteCreate:
+		ds.creates++
+	case deleteDelete:
+		if s.unconfirmed {
+			ds.unconfirmed++
+		} else {
+			ds.deletes++
+		}
+	case deleteLiveRead:
+		ds.before.add(s.since, s.violation != "")
+	case deleteGoneRead:
+		ds.after.add(s.since, s.violation != "")
+	}
+	if s.violation != "" && len(ds.examples) < maxReportedDeleteViolations {
+		ds.examples = append(ds.examples, s.violation)
+	}
+}
+
+func (ds *deleteChurnStats) merge(o *deleteChurnStats) {
+	ds.creates += o.creates
+	ds.deletes += o.deletes
+	ds.unconfirmed += o.unconfirmed
+	ds.before.merge(&o.before)
+	ds.after.merge(&o.after)
+	for _, e := range o.examples {
+		if len(ds.examples) < maxReportedDeleteViolations {
+			ds.examples = append(ds.examples, e)
+		}
+	}
+}
+
+func (ds *deleteChurnStats) report() *deleteChurnReport {
+	r := &deleteChurnReport{
+		Keys:         ds.creates,
+		Deletes:      ds.deletes,
+		Unconfirmed:  ds.unconfirmed,
+		BeforeDelete: ds.before.report(),
+		AfterDelete:  ds.after.report(),
+		Examples:     ds.examples,
+	}
+	for _, b := range ds.before {
+		r.ReadsBefore += b.reads
+		r.Premature += b.violations
+	}
+	for _, b := range ds.after {
+		r.ReadsAfter += b.reads
+		r.Resurrected += b.violations
+	}
+	r.PrematurePct = pct(r.Premature, r.ReadsBefore)
+	r.ResurrectionPct = pct(r.Resurrected, r.ReadsAfter)
+	sort.Strings(r.Examples)
+	return r
+}
+
+func pct(n, of int64) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) / float64(of) * 100
+}
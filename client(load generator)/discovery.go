@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// serverInfo is the server's GET /version answer. A nil *serverInfo means
+// the server predates /version, so nothing is known about its features and
+// the client keeps its probing behaviour.
+type serverInfo struct {
+	Version string `json:"version"`
+	// Build is nil for servers that do not report their build.
+	Build        *buildInfo `json:"build,omitempty"`
+	Features     []string   `json:"features"`
+	AuthRequired bool       `json:"auth_required,omitempty"`
+}
+
+// has reports whether the server advertises feature.
+func (si *serverInfo) has(feature string) bool {
+	return si != nil && slices.Contains(si.Features, feature)
+}
+
+// lacks reports whether the server is known not to support feature.
+func (si *serverInfo) lacks(feature string) bool {
+	return si != nil && !slices.Contains(si.Features, feature)
+}
+
+// discoverServer fetches target's /version. Any failure, including an old
+// server answering 404, is logged and yields nil.
+func discoverServer(cfg *workerConfig, target string) *serverInfo {
+	client := &http.Client{Timeout: 5 * time.Second, Transport: cfg.transport}
+	resp, err := client.Get(target + "/version")
+	if err != nil {
+		log.Printf("Cannot reach %s/version (%v); assuming baseline features", target, err)
+		return nil
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Server has no /version (HTTP %d); assuming baseline features", resp.StatusCode)
+		return nil
+	}
+	var si serverInfo
+	if err := json.NewDecoder(resp.Body).Decode(&si); err != nil || si.Version == "" {
+		log.Printf("Unrecognised /version answer; assuming baseline features")
+		return nil
+	}
+	if si.Build != nil {
+		log.Printf("Server version %s, build %s, features: %s", si.Version, si.Build, strings.Join(si.Features, ", "))
+	} else {
+		log.Printf("Server version %s, features: %s", si.Version, strings.Join(si.Features, ", "))
+	}
+	return &si
+}
+
+// requiredFeatures lists the server features the run cannot do without.
+// Plain GET and PUT on /kv/ are always there.
+func requiredFeatures(cfg *workerConfig) []string {
+	var req []string
+	if cfg.pathPrefix == "/cache/" {
+		req = append(req, "cache-endpoints")
+	}
+	return req
+}
+
+// checkFeatures fails if the server is known to lack a required feature.
+func checkFeatures(cfg *workerConfig) error {
+	for _, f := range requiredFeatures(cfg) {
+		if cfg.server.lacks(f) {
+			return fmt.Errorf("-workload=%s with -path-prefix=%s needs the server feature %q, which server %s does not have",
+				cfg.workload, cfg.pathPrefix, f, cfg.server.Version)
+		}
+	}
+	return nil
+}
+
+// autoPrimeServerSide reports whether to prime via /admin/generate even
+// though -prime-server-side was not given: the server must advertise it,
+// the keys must live in the store, and a required token must be at hand.
+func autoPrimeServerSide(cfg *workerConfig) bool {
+	return cfg.server.has("generate") && cfg.pathPrefix == "/kv/" &&
+		(!cfg.server.AuthRequired || cfg.adminToken != "")
+}
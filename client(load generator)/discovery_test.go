@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// versionStub answers GET /version with body, or 404s it when body is
+// empty, as a server predating /version does.
+func versionStub(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/version" || body == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestDiscoverServer(t *testing.T) {
+	ts := versionStub(`{"version": "1.9.0", "build": {"version": "dev"}, "features": ["batch", "ttl"], "auth_required": true}`)
+	defer ts.Close()
+	si := discoverServer(&workerConfig{}, ts.URL)
+	if si == nil || si.Version != "1.9.0" || !si.AuthRequired || si.Build == nil {
+		t.Fatalf("discoverServer = %+v", si)
+	}
+	if !si.has("batch") || si.lacks("ttl") || !si.lacks("cas") {
+		t.Errorf("features %q: has(batch), !lacks(ttl) and lacks(cas) expected", si.Features)
+	}
+	b, _ := json.Marshal(Report{Server: si})
+	if !strings.Contains(string(b), `"server":{"version":"1.9.0"`) {
+		t.Errorf("report does not record the server: %s", b)
+	}
+
+	for name, body := range map[string]string{"404": "", "not json": "<html>", "no version": `{"features": ["batch"]}`} {
+		ts := versionStub(body)
+		if si := discoverServer(&workerConfig{}, ts.URL); si != nil {
+			t.Errorf("%s: discoverServer = %+v, want nil", name, si)
+		}
+		ts.Close()
+	}
+	// Nothing is known about an old server, so it has and lacks nothing.
+	var old *serverInfo
+	if old.has("batch") || old.lacks("batch") {
+		t.Errorf("nil serverInfo claims to know its features")
+	}
+	b, _ = json.Marshal(Report{Server: old})
+	if strings.Contains(string(b), `"server"`) {
+		t.Errorf("report records an unknown server: %s", b)
+	}
+}
+
+func TestCheckFeatures(t *testing.T) {
+	for _, tc := range []struct {
+		prefix string
+		server *serverInfo
+		ok     bool
+	}{
+		{"/kv/", &serverInfo{Version: "1.9.0"}, true},
+		{"/cache/", nil, true},
+		{"/cache/", &serverInfo{Version: "1.9.0", Features: []string{"cache-endpoints"}}, true},
+		{"/cache/", &serverInfo{Version: "1.9.0", Features: []string{"ttl"}}, false},
+	} {
+		cfg := &workerConfig{pathPrefix: tc.prefix, server: tc.server, workload: "get-all"}
+		err := checkFeatures(cfg)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s against %+v: %v", tc.prefix, tc.server, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), `"cache-endpoints"`) {
+			t.Errorf("error does not name the missing feature: %v", err)
+		}
+	}
+}
+
+func TestAutoPrimeServerSide(t *testing.T) {
+	gen := &serverInfo{Version: "1.9.0", Features: []string{"generate"}}
+	genAuth := &serverInfo{Version: "1.9.0", Features: []string{"generate"}, AuthRequired: true}
+	for _, tc := range []struct {
+		server       *serverInfo
+		prefix, auth string
+		want         bool
+	}{
+		{nil, "/kv/", "", false},
+		{&serverInfo{Version: "1.9.0"}, "/kv/", "", false},
+		{gen, "/kv/", "", true},
+		{gen, "/cache/", "", false},
+		{genAuth, "/kv/", "", false},
+		{genAuth, "/kv/", "secret", true},
+	} {
+		cfg := &workerConfig{server: tc.server, pathPrefix: tc.prefix, adminToken: tc.auth}
+		if got := autoPrimeServerSide(cfg); got != tc.want {
+			t.Errorf("server %+v, prefix %s, token %q: %v, want %v", tc.server, tc.prefix, tc.auth, got, tc.want)
+		}
+	}
+}
+
+// TestPrimeBatchDiscovery primes a server that answers batches, and checks
+// the batch probe runs only when /version said nothing.
+func TestPrimeBatchDiscovery(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		server      *serverInfo
+		wantBatches bool
+	}{
+		{"old server", nil, true},
+		{"batch listed", &serverInfo{Version: "1.9.0", Features: []string{"batch"}}, true},
+		{"batch not listed", &serverInfo{Version: "1.9.0"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kv := newFlakyKV(true)
+			var posts, probes atomic.Int64
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "POST" {
+					posts.Add(1)
+					if r.ContentLength == int64(len(`{"entries":null}`)) {
+						probes.Add(1)
+					}
+				}
+				kv.ServeHTTP(w, r)
+			}))
+			defer ts.Close()
+			cfg := &workerConfig{pathPrefix: "/kv/", primeConcurrency: 4, primeBatch: 50, quiet: true, server: tc.server}
+			if err := primeKeys(cfg, ts.URL, testPrimeKeys(10)); err != nil {
+				t.Fatal(err)
+			}
+			if wantProbe := tc.server == nil; (probes.Load() > 0) != wantProbe {
+				t.Errorf("%d batch probes, want probe %v", probes.Load(), wantProbe)
+			}
+			if batches := posts.Load() - probes.Load(); (batches > 0) != tc.wantBatches {
+				t.Errorf("%d batch writes, want batches %v", batches, tc.wantBatches)
+			}
+		})
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A distributed run has one -coordinator process and -joiners processes
+// started with -join. The coordinator hands every joiner its own flags,
+// releases them together once all are ready, prints their merged progress
+// and merges their final results into one report. It sends no load itself.
+const (
+	// joinerInterval is how often joiners send their interval stats.
+	joinerInterval = time.Second
+	// joinerSilence without stats marks a joiner as failed.
+	joinerSilence = 5 * time.Second
+	// joinerStartDelay gives the start signal time to reach every joiner.
+	joinerStartDelay = 500 * time.Millisecond
+	// joinRetryFor is how long a joiner keeps trying to reach the
+	// coordinator.
+	joinRetryFor = 30 * time.Second
+)
+
+// distributedWorkloads are the workloads whose results merge from counters
+// and histograms alone.
+var distributedWorkloads = []string{"get-popular", "put-all", "get-all", "mixed"}
+
+// coordinatorOnly flags are not passed on: they concern the report, the
+// coordinator's own output, or priming, which the coordinator does once.
+// -rate is passed on divided between the joiners.
+var coordinatorOnly = map[string]bool{
+	"coordinator": true, "joiners": true, "join": true, "dry-run": true,
+	"json-out": true, "baseline": true, "fail-on-regression": true,
+	"max-error-rate": true, "max-p99": true, "min-throughput": true,
+	"metrics-addr": true, "pushgateway-url": true, "push-interval": true,
+	"prime": true, "prime-only": true, "prime-concurrency": true, "prime-batch": true,
+	"prime-max-failures": true, "prime-server-side": true, "cache-fill": true,
+	"progress-interval": true, "quiet": true, "rate": true,
+}
+
+// assignment is the coordinator's answer to a join. Worker i of joiner n
+// runs as worker IDBase+i, so joiners' key ranges never overlap.
+type assignment struct {
+	ID         int      `json:"id"`
+	Args       []string `json:"args"`
+	IDBase     int      `json:"id_base"`
+	AllClients int      `json:"all_clients"`
+}
+
+type joinerMessage struct {
+	ID       int           `json:"id"`
+	Host     string        `json:"host,omitempty"`
+	Interval *intervalJSON `json:"interval,omitempty"`
+	Final    *nodeJSON     `json:"final,omitempty"`
+}
+
+type startReply struct {
+	StartInMs int64 `json:"start_in_ms"`
+}
+
+type intervalReply struct {
+	Stop bool `json:"stop"`
+}
+
+// histogramJSON carries a histogram between processes; only non-empty
+// buckets are sent.
+type histogramJSON struct {
+	Counts map[int]int64 `json:"counts"`
+	N      int64         `json:"n"`
+	SumNs  int64         `json:"sum_ns"`
+	MinNs  int64         `json:"min_ns"`
+	MaxNs  int64         `json:"max_ns"`
+}
+
+func (h *histogram) toJSON() histogramJSON {
+	j := histogramJSON{Counts: make(map[int]int64), N: h.n, SumNs: int64(h.sum), MinNs: int64(h.min), MaxNs: int64(h.max)}
+	for i, c := range h.counts {
+		if c != 0 {
+			j.Counts[i] = c
+		}
+	}
+	return j
+}
+
+func (j histogramJSON) histogram() *histogram {
+	h := newHistogram()
+	for i, c := range j.Counts {
+		if i >= 0 && i < len(h.counts) {
+			h.counts[i] = c
+		}
+	}
+	h.n, h.sum, h.min, h.max = j.N, time.Duration(j.SumNs), time.Duration(j.MinNs), time.Duration(j.MaxNs)
+	return h
+}
+
+type intervalJSON struct {
+	Total    int64         `json:"total"`
+	Requests int64         `json:"requests"`
+	Errors   int64         `json:"errors"`
+	Hits     int64         `json:"hits"`
+	Misses   int64         `json:"misses"`
+	Latency  histogramJSON `json:"latency"`
+}
+
+// nodeJSON is a joiner's final result: its merged aggregator and its
+// connection counts.
+type nodeJSON struct {
+	Requests      int64          `json:"requests"`
+	Errors        int64          `json:"errors"`
+	ErrorsByClass []int64        `json:"errors_by_class"`
+	Retries       int64          `json:"retries"`
+	RetriedOps    int64          `json:"retried_ops"`
+	Service       histogramJSON  `json:"service"`
+	Corrected     *histogramJSON `json:"corrected,omitempty"`
+	BytesSent     int64          `json:"bytes_sent"`
+	BytesReceived int64          `json:"bytes_received"`
+	ValueSizes    [65]int64      `json:"value_sizes"`
+	ValueSizeSum  int64          `json:"value_size_sum"`
+	ValueSizeMax  int64          `json:"value_size_max"`
+	Hits          int64          `json:"hits"`
+	Misses        int64          `json:"misses"`
+
+	Connections int64            `json:"connections"`
+	Reused      int64            `json:"reused"`
+	Protocols   map[string]int64 `json:"protocols"`
+}
+
+func (a *aggregator) node() nodeJSON {
+	n := nodeJSON{
+		Requests:      a.requests,
+		Errors:        a.errors,
+		ErrorsByClass: a.errorsByClass[:],
+		Retries:       a.retries,
+		RetriedOps:    a.retriedOps,
+		Service:       a.service.toJSON(),
+		BytesSent:     a.bytesSent,
+		BytesReceived: a.bytesReceived,
+		ValueSizes:    a.valueSizes.counts,
+		ValueSizeSum:  a.valueSizes.sum,
+		ValueSizeMax:  a.valueSizes.max,
+		Hits:          a.cache.hits,
+		Misses:        a.cache.misses,
+	}
+	if a.trackCorrected {
+		c := a.corrected.toJSON()
+		n.Corrected = &c
+	}
+	return n
+}
+
+// mergeNode folds a joiner's final result into a, which must not be
+// recording.
+func (a *aggregator) mergeNode(n nodeJSON) {
+	o := newAggregator(a.trackCorrected, false, a.start)
+	o.requests, o.errors = n.Requests, n.Errors
+	copy(o.errorsByClass[:], n.ErrorsByClass)
+	o.retries, o.retriedOps = n.Retries, n.RetriedOps
+	o.service = n.Service.histogram()
+	if a.trackCorrected && n.Corrected != nil {
+		o.corrected = n.Corrected.histogram()
+	}
+	o.bytesSent, o.bytesReceived = n.BytesSent, n.BytesReceived
+	o.valueSizes.counts, o.valueSizes.sum, o.valueSizes.max = n.ValueSizes, n.ValueSizeSum, n.ValueSizeMax
+	for _, c := range n.ValueSizes {
+		o.valueSizes.n += c
+	}
+	o.cache = hitCounts{hits: n.Hits, misses: n.Misses}
+	a.merge(o)
+}
+
+type joinerState struct {
+	id       int
+	host     string
+	ready    bool
+	live     *aggregator
+	lastSeen time.Time
+	final    *nodeJSON
+	failed   string
+}
+
+type joinerReport struct {
+	ID       int    `json:"id"`
+	Host     string `json:"host"`
+	Clients  int    `json:"clients"`
+	Requests int64  `json:"requests"`
+	// Error is why the joiner was given up on; its requests are then the
+	// ones it reported before failing and are not in the merged results.
+	Error string `json:"error,omitempty"`
+}
+
+type coordinator struct {
+	mu      sync.Mutex
+	want    int
+	clients int
+	args    []string
+	joiners []*joinerState
+	started chan struct{}
+	start   time.Time
+	stop    atomic.Bool
+}
+
+// newCoordinator captures every flag except the coordinator-only ones to
+// send to the joiners; -clients and -rate apply to each joiner and to the
+// whole run respectively.
+func newCoordinator(joiners, clients int, rate float64) *coordinator {
+	c := &coordinator{want: joiners, clients: clients, started: make(chan struct{})}
+	flag.VisitAll(func(f *flag.Flag) {
+		if !coordinatorOnly[f.Name] {
+			c.args = append(c.args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	c.args = append(c.args, "-prime=none", "-quiet", fmt.Sprintf("-rate=%g", rate/float64(joiners)))
+	return c
+}
+
+func (c *coordinator) serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/join", c.handleJoin)
+	mux.HandleFunc("/ready", c.handleReady)
+	mux.HandleFunc("/interval", c.handleInterval)
+	mux.HandleFunc("/final", c.handleFinal)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Coordinating on %s", ln.Addr())
+	go http.Serve(ln, mux)
+	return nil
+}
+
+func readMessage(w http.ResponseWriter, r *http.Request) (joinerMessage, bool) {
+	var msg joinerMessage
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return msg, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return msg, false
+	}
+	return msg, true
+}
+
+func replyJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// joiner returns the joiner the message is from, answering 404 if there
+// is none; it must be called with mu held.
+func (c *coordinator) joiner(w http.ResponseWriter, msg joinerMessage) *joinerState {
+	if msg.ID < 0 || msg.ID >= len(c.joiners) {
+		http.Error(w, "Unknown joiner", http.StatusNotFound)
+		return nil
+	}
+	return c.joiners[msg.ID]
+}
+
+func (c *coordinator) handleJoin(w http.ResponseWriter, r *http.Request) {
+	msg, ok := readMessage(w, r)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.joiners) == c.want {
+		http.Error(w, fmt.Sprintf("The run already has its %d joiners", c.want), http.StatusConflict)
+		return
+	}
+	js := &joinerState{id: len(c.joiners), host: msg.Host, live: newAggregator(false, false, time.Now())}
+	c.joiners = append(c.joiners, js)
+	log.Printf("Joiner %d joined from %s (%d/%d)", js.id, js.host, len(c.joiners), c.want)
+	replyJSON(w, assignment{ID: js.id, Args: c.args, IDBase: js.id * c.clients, AllClients: c.want * c.clients})
+}
+
+// handleReady holds every joiner's request until the last one is ready,
+// then answers them all with the same start time.
+func (c *coordinator) handleReady(w http.ResponseWriter, r *http.Request) {
+	msg, ok := readMessage(w, r)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	js := c.joiner(w, msg)
+	if js == nil {
+		c.mu.Unlock()
+		return
+	}
+	js.ready = true
+	ready := 0
+	for _, j := range c.joiners {
+		if j.ready {
+			ready++
+		}
+	}
+	if ready == c.want && c.start.IsZero() {
+		c.start = time.Now().Add(joinerStartDelay)
+		for _, j := range c.joiners {
+			j.lastSeen = c.start
+		}
+		close(c.started)
+	}
+	c.mu.Unlock()
+	select {
+	case <-c.started:
+	case <-r.Context().Done():
+		return
+	}
+	replyJSON(w, startReply{StartInMs: max(time.Until(c.start).Milliseconds(), 0)})
+}
+
+func (c *coordinator) handleInterval(w http.ResponseWriter, r *http.Request) {
+	msg, ok := readMessage(w, r)
+	if !ok || msg.Interval == nil {
+		if ok {
+			http.Error(w, "interval is missing", http.StatusBadRequest)
+		}
+		return
+	}
+	c.mu.Lock()
+	js := c.joiner(w, msg)
+	if js == nil {
+		c.mu.Unlock()
+		return
+	}
+	// A joiner given up on stops, since its results will not count.
+	stop := c.stop.Load() || js.failed != ""
+	if js.failed == "" {
+		js.lastSeen = time.Now()
+		iv := intervalStats{
+			requests: msg.Interval.Requests,
+			errors:   msg.Interval.Errors,
+			latency:  msg.Interval.Latency.histogram(),
+			cache:    hitCounts{hits: msg.Interval.Hits, misses: msg.Interval.Misses},
+		}
+		js.live.mu.Lock()
+		js.live.interval.merge(&iv)
+		js.live.requests = msg.Interval.Total
+		js.live.mu.Unlock()
+	}
+	c.mu.Unlock()
+	replyJSON(w, intervalReply{Stop: stop})
+}
+
+func (c *coordinator) handleFinal(w http.ResponseWriter, r *http.Request) {
+	msg, ok := readMessage(w, r)
+	if !ok || msg.Final == nil {
+		if ok {
+			http.Error(w, "final is missing", http.StatusBadRequest)
+		}
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	js := c.joiner(w, msg)
+	if js == nil {
+		return
+	}
+	if js.failed != "" {
+		http.Error(w, "Joiner was given up on: "+js.failed, http.StatusGone)
+		return
+	}
+	js.final = msg.Final
+	log.Printf("Joiner %d (%s) finished: %d requests", js.id, js.host, msg.Final.Requests)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// check gives up on joiners that have gone quiet and reports whether every
+// joiner has either finished or been given up on.
+func (c *coordinator) check(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	done := true
+	for _, js := range c.joiners {
+		if js.final != nil || js.failed != "" {
+			continue
+		}
+		if quiet := now.Sub(js.lastSeen); quiet > joinerSilence {
+			js.failed = fmt.Sprintf("no stats for %s", quiet.Round(time.Second))
+			log.Printf("JOINER %d (%s) FAILED: %s", js.id, js.host, js.failed)
+			continue
+		}
+		done = false
+	}
+	return done
+}
+
+// run waits for the joiners, follows the run until each has finished or
+// failed, and merges their results.
+func (c *coordinator) run(quiet bool, progressEvery, duration time.Duration, trackCorrected bool) (agg *aggregator, joiners []joinerReport, start time.Time, interrupted bool, protocols map[string]int64, connections, reused int64) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	log.Printf("Waiting for %d joiners", c.want)
+	select {
+	case <-c.started:
+	case <-sigChan:
+		log.Fatal("Interrupted before every joiner was ready")
+	}
+	start = c.start
+	time.Sleep(time.Until(start))
+
+	lives := make([]*aggregator, len(c.joiners))
+	for i, js := range c.joiners {
+		lives[i] = js.live
+	}
+	progress := newProgressPrinter(quiet, false, progressEvery, duration, start)
+	tick := progress.ticks()
+	check := time.NewTicker(joinerInterval)
+	defer check.Stop()
+wait:
+	for {
+		select {
+		case now := <-tick:
+			progress.print(lives, now)
+		case now := <-check.C:
+			if c.check(now) {
+				break wait
+			}
+		case <-sigChan:
+			if !interrupted {
+				interrupted = true
+				c.stop.Store(true)
+			}
+		}
+	}
+	progress.finish()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	agg = newAggregator(trackCorrected, false, start)
+	protocols = make(map[string]int64)
+	for _, js := range c.joiners {
+		jr := joinerReport{ID: js.id, Host: js.host, Clients: c.clients, Error: js.failed}
+		if n := js.final; n != nil {
+			jr.Requests = n.Requests
+			agg.mergeNode(*n)
+			connections += n.Connections
+			reused += n.Reused
+			for p, k := range n.Protocols {
+				protocols[p] += k
+			}
+		} else {
+			jr.Requests = js.live.requests
+		}
+		joiners = append(joiners, jr)
+	}
+	return agg, joiners, start, interrupted, protocols, connections, reused
+}
+
+// joinSession is a joiner's connection to its coordinator.
+type joinSession struct {
+	assignment
+	base     string
+	client   *http.Client
+	stop     chan struct{}
+	stopOnce sync.Once
+	ticker   *time.Ticker
+	interval intervalStats
+	failing  bool
+}
+
+// joinRun registers with the coordinator at addr and applies the flags it
+// hands out over the joiner's own.
+func joinRun(addr string) (*joinSession, error) {
+	j := &joinSession{base: addr, client: &http.Client{}, stop: make(chan struct{}), interval: newIntervalStats()}
+	if !strings.Contains(addr, "://") {
+		j.base = "http://" + addr
+	}
+	host, _ := os.Hostname()
+	// Joiners may well be started before the coordinator is listening.
+	var err error
+	for deadline := time.Now().Add(joinRetryFor); ; time.Sleep(time.Second) {
+		var netErr *net.OpError
+		err = j.post("/join", joinerMessage{Host: host}, &j.assignment)
+		if !errors.As(err, &netErr) || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := flag.CommandLine.Parse(j.Args); err != nil {
+		return nil, fmt.Errorf("coordinator sent unusable flags: %v", err)
+	}
+	log.Printf("Joined %s as joiner %d (worker IDs from %d)", addr, j.ID, j.IDBase)
+	return j, nil
+}
+
+func (j *joinSession) post(path string, msg, reply any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := j.client.Post(j.base+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(text)))
+	}
+	if reply == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// waitStart reports ready and sleeps until the coordinator's start time.
+func (j *joinSession) waitStart() error {
+	var reply startReply
+	if err := j.post("/ready", joinerMessage{ID: j.ID}, &reply); err != nil {
+		return err
+	}
+	time.Sleep(time.Duration(reply.StartInMs) * time.Millisecond)
+	return nil
+}
+
+// ticks and stopped are nil, and so never ready, outside a distributed
+// run.
+func (j *joinSession) ticks() <-chan time.Time {
+	if j == nil {
+		return nil
+	}
+	j.ticker = time.NewTicker(joinerInterval)
+	return j.ticker.C
+}
+
+func (j *joinSession) stopped() <-chan struct{} {
+	if j == nil {
+		return nil
+	}
+	return j.stop
+}
+
+// report sends the workers' stats since the last report. A coordinator
+// that cannot be reached is logged once; the run goes on regardless.
+func (j *joinSession) report(workers []*aggregator) {
+	iv := &j.interval
+	iv.reset()
+	var total int64
+	for _, w := range workers {
+		total += w.takeInterval(iv)
+	}
+	var reply intervalReply
+	err := j.post("/interval", joinerMessage{ID: j.ID, Interval: &intervalJSON{
+		Total:    total,
+		Requests: iv.requests,
+		Errors:   iv.errors,
+		Hits:     iv.cache.hits,
+		Misses:   iv.cache.misses,
+		Latency:  iv.latency.toJSON(),
+	}}, &reply)
+	switch {
+	case err != nil && !j.failing:
+		log.Printf("Cannot reach coordinator: %v", err)
+		j.failing = true
+	case err == nil:
+		j.failing = false
+		if reply.Stop {
+			j.stopOnce.Do(func() { close(j.stop) })
+		}
+	}
+}
+
+func (j *joinSession) finish(agg *aggregator, connections, reused int64, protocols map[string]int64) {
+	j.ticker.Stop()
+	n := agg.node()
+	n.Connections, n.Reused, n.Protocols = connections, reused, protocols
+	if err := j.post("/final", joinerMessage{ID: j.ID, Final: &n}, nil); err != nil {
+		log.Printf("Failed to send results to the coordinator: %v", err)
+	}
+}
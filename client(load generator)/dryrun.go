@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// dryRunPlan is what the real run would do, for the estimates.
+type dryRunPlan struct {
+	duration   time.Duration
+	targetRate float64
+	primeKeys  int
+	featureErr error
+}
+
+// sampleOperations returns one operation of each method the workload
+// issues, built the way its workers build them.
+func sampleOperations(cfg *workerConfig) []operation {
+	switch cfg.workload {
+	case "coherence":
+		key := "coherence-0-0"
+		return []operation{
+			{method: "PUT", url: cfg.targets[0] + cfg.pathPrefix + key, body: "dry-run"},
+			{method: "GET", url: cfg.targets[1] + cfg.pathPrefix + key},
+		}
+	case "ttl":
+		base := cfg.writeTargetFor(0) + cfg.pathPrefix + "ttl-dry-run"
+		return []operation{
+			{method: "PUT", url: base + "?ttl=" + cfg.ttlMin.String(), body: "ttl-dry-run"},
+			{method: "GET", url: base},
+		}
+	case "churn-delete":
+		key := cfg.pathPrefix + "churn-delete-dry-run"
+		return []operation{
+			{method: "PUT", url: cfg.writeTargetFor(0) + key, body: "churn-delete-dry-run"},
+			{method: "GET", url: cfg.readTargetFor(0) + key},
+			{method: "DELETE", url: cfg.writeTargetFor(0) + key},
+		}
+	}
+	keys := &workerKeys{id: 0, rng: cfg.rng(0)}
+	if cfg.workload == "churn" {
+		keys.churn = newChurnKeys(cfg, 0)
+	}
+	var ops []operation
+	seen := make(map[string]bool)
+	// Mixed workloads pick the method at random; a thousand draws find
+	// every method they use with overwhelming probability.
+	for i := 0; i < 1000; i++ {
+		if cfg.tenants != nil {
+			keys.tenant = i % len(cfg.tenants)
+		}
+		if cfg.pools != nil {
+			keys.id = i % cfg.clients
+		}
+		op := nextOperation(cfg, keys)
+		if op.method != "" && !seen[op.method] {
+			seen[op.method] = true
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// dryRun checks the server, sends one sample of each operation instead of
+// running the test, and prints what the run would amount to. It returns
+// the exit code.
+func dryRun(cfg *workerConfig, plan dryRunPlan) int {
+	var problems []string
+	client := &http.Client{Transport: cfg.transport}
+	fmt.Println("DRY RUN (nothing below is a measurement)")
+	fmt.Println("-----------------------------------")
+
+	if plan.featureErr != nil {
+		problems = append(problems, plan.featureErr.Error())
+	}
+	if cfg.server == nil {
+		fmt.Println("Server version:      unknown (no /version)")
+	} else {
+		fmt.Printf("Server version:      %s (%s)\n", cfg.server.Version, strings.Join(cfg.server.Features, ", "))
+		if cfg.server.AuthRequired && cfg.adminToken == "" {
+			problems = append(problems, "the server requires a bearer token and -admin-token is empty")
+		}
+	}
+	targets := slices.Concat(cfg.readTargets, cfg.writeTargets)
+	slices.Sort(targets)
+	for _, target := range slices.Compact(targets) {
+		ready := operation{method: "GET", url: target + "/readyz"}
+		out := ready.attempt(client, cfg.opTimeout, false)
+		fmt.Printf("Readiness:           %s\n", describeSample(ready, out, 0))
+		if out.status != http.StatusOK {
+			problems = append(problems, fmt.Sprintf("%s/readyz did not answer 200", target))
+		}
+	}
+
+	fmt.Println("-----------------------------------")
+	fmt.Println("SAMPLE OPERATIONS:")
+	var total time.Duration
+	var bytes int64
+	var putLatency time.Duration
+	ops := sampleOperations(cfg)
+	for _, op := range ops {
+		start := time.Now()
+		out := op.attempt(client, cfg.opTimeout, cfg.strict)
+		took := time.Since(start)
+		total += took
+		bytes += out.sent + out.received
+		if op.method == "PUT" {
+			putLatency = took
+		}
+		fmt.Printf("  %s\n", describeSample(op, out, took))
+		switch {
+		case out.class != errNone && out.class != errHTTP && out.class != errQuota:
+			problems = append(problems, fmt.Sprintf("%s %s failed", op.method, op.url))
+		case out.status == http.StatusNotFound && op.method == "GET":
+			// Nothing was primed, so a missing key is expected.
+		case out.status >= 400:
+			problems = append(problems, fmt.Sprintf("%s %s answered %d", op.method, op.url, out.status))
+		}
+		for _, v := range out.violations {
+			problems = append(problems, fmt.Sprintf("%s %s: protocol violation %s", op.method, op.url, v.check))
+		}
+	}
+
+	fmt.Println("-----------------------------------")
+	fmt.Println("ESTIMATES (rough, from the samples above):")
+	if len(ops) > 0 {
+		avgLatency := total / time.Duration(len(ops))
+		var requests float64
+		if plan.targetRate > 0 {
+			requests = plan.targetRate * plan.duration.Seconds()
+		} else {
+			cycle := avgLatency + cfg.thinkTime
+			requests = float64(cfg.clients) * plan.duration.Seconds() / cycle.Seconds()
+		}
+		fmt.Printf("Requests:            ~%.0f over %s\n", requests, plan.duration)
+		fmt.Printf("Data volume:         ~%.1f MB (bodies only)\n", requests*float64(bytes)/float64(len(ops))/1e6)
+	}
+	switch {
+	case plan.primeKeys == 0:
+		fmt.Println("Priming:             none")
+	case cfg.primeServerSide:
+		fmt.Printf("Priming:             %d keys server-side via /admin/generate\n", plan.primeKeys)
+	default:
+		if putLatency == 0 {
+			putLatency = total / time.Duration(max(len(ops), 1))
+		}
+		batch := 1
+		if cfg.primeBatch > 1 && !cfg.server.lacks("batch") {
+			batch = cfg.primeBatch
+		}
+		puts := (plan.primeKeys + batch - 1) / batch
+		est := time.Duration(puts) * putLatency / time.Duration(cfg.primeConcurrency)
+		fmt.Printf("Priming:             %d keys in %d requests, ~%s\n", plan.primeKeys, puts, est.Round(time.Millisecond))
+	}
+
+	if len(problems) > 0 {
+		fmt.Println("-----------------------------------")
+		fmt.Println("PROBLEMS:")
+		for _, p := range problems {
+			fmt.Printf("  - %s\n", p)
+		}
+		return 1
+	}
+	return 0
+}
+
+func describeSample(op operation, out outcome, took time.Duration) string {
+	result := fmt.Sprintf("HTTP %d", out.status)
+	switch out.class {
+	case errTimeout:
+		result = "timed out"
+	case errConnection:
+		result = "connection failed"
+	case errRequest:
+		result = "bad request"
+	}
+	line := fmt.Sprintf("%s %s -> %s", op.method, op.url, result)
+	if took > 0 {
+		line += fmt.Sprintf(" in %s (%d B sent, %d B received)", took.Round(time.Microsecond), out.sent, out.received)
+	}
+	return line
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// clientGCReport shows how much the client's own garbage collection may
+// have disturbed the measurements: every pause stalls the workers too.
+type clientGCReport struct {
+	Cycles       uint32  `json:"cycles"`
+	PauseTotalMs float64 `json:"pause_total_ms"`
+	PauseMaxMs   float64 `json:"pause_max_ms"`
+	HeapInuseMB  float64 `json:"heap_inuse_mb"`
+	AllocsPerOp  float64 `json:"allocs_per_request"`
+	BytesPerOp   float64 `json:"alloc_bytes_per_request"`
+}
+
+func readGC() *runtime.MemStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return &m
+}
+
+// gcReport compares the client's memory stats at the start and the end of
+// the run.
+func gcReport(start, end *runtime.MemStats, requests int64) *clientGCReport {
+	r := &clientGCReport{
+		Cycles:       end.NumGC - start.NumGC,
+		PauseTotalMs: durationMs(time.Duration(end.PauseTotalNs - start.PauseTotalNs)),
+		HeapInuseMB:  float64(end.HeapInuse) / (1 << 20),
+	}
+	// PauseNs only holds the most recent 256 pauses, so in longer runs
+	// the maximum is that of the last 256 cycles.
+	for i := uint32(0); i < min(r.Cycles, uint32(len(end.PauseNs))); i++ {
+		pause := time.Duration(end.PauseNs[(end.NumGC-1-i)%uint32(len(end.PauseNs))])
+		r.PauseMaxMs = max(r.PauseMaxMs, durationMs(pause))
+	}
+	if requests > 0 {
+		r.AllocsPerOp = float64(end.Mallocs-start.Mallocs) / float64(requests)
+		r.BytesPerOp = float64(end.TotalAlloc-start.TotalAlloc) / float64(requests)
+	}
+	return r
+}
+
+func (r *clientGCReport) String() string {
+	return fmt.Sprintf("%d cycles, %.2f ms paused (max %.2f ms), heap %.1f MB, %.1f allocs (%.0f B) per request",
+		r.Cycles, r.PauseTotalMs, r.PauseMaxMs, r.HeapInuseMB, r.AllocsPerOp, r.BytesPerOp)
+}
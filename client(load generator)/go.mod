@@ -4,6 +4,8 @@ go 1.23.0
 
 toolchain go1.24.10
 
+require golang.org/x/net v0.39.0
+
 require (
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hgrmTicksPerHalfDistance is how many rows HdrHistogram's percentile
+// output has for each halving of the distance to 100%.
+const hgrmTicksPerHalfDistance = 5
+
+// latencySplit holds the latency histograms -latency-export writes besides
+// the overall one: per HTTP method, and for GETs by cache hit or miss.
+type latencySplit struct {
+	byMethod  map[string]*histogram
+	hit, miss *histogram
+}
+
+func newLatencySplit() *latencySplit {
+	return &latencySplit{byMethod: make(map[string]*histogram), hit: newHistogram(), miss: newHistogram()}
+}
+
+func (s *latencySplit) record(res *Result) {
+	if res.method != "" {
+		h := s.byMethod[res.method]
+		if h == nil {
+			h = newHistogram()
+			s.byMethod[res.method] = h
+		}
+		h.record(res.responseTime)
+	}
+	switch res.cache {
+	case cacheHit:
+		s.hit.record(res.responseTime)
+	case cacheMiss:
+		s.miss.record(res.responseTime)
+	}
+}
+
+func (s *latencySplit) merge(o *latencySplit) {
+	for m, oh := range o.byMethod {
+		h := s.byMethod[m]
+		if h == nil {
+			h = newHistogram()
+			s.byMethod[m] = h
+		}
+		h.merge(oh)
+	}
+	s.hit.merge(o.hit)
+	s.miss.merge(o.miss)
+}
+
+type hgrmFile struct {
+	suffix string
+	h      *histogram
+}
+
+// exportLatency writes the overall latency to path in HdrHistogram's .hgrm
+// percentile format, and next to it the corrected latency and the split
+// ones with the part in the name: run.hgrm, run.corrected.hgrm,
+// run.get.hgrm, run.hit.hgrm and so on. It returns the files written.
+func (a *aggregator) exportLatency(path string) ([]string, error) {
+	files := []hgrmFile{{"", a.service}}
+	if a.trackCorrected {
+		files = append(files, hgrmFile{"corrected", a.corrected})
+	}
+	if a.split != nil {
+		methods := make([]string, 0, len(a.split.byMethod))
+		for m := range a.split.byMethod {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		for _, m := range methods {
+			files = append(files, hgrmFile{strings.ToLower(m), a.split.byMethod[m]})
+		}
+		files = append(files, hgrmFile{"hit", a.split.hit}, hgrmFile{"miss", a.split.miss})
+	}
+
+	var written []string
+	for _, f := range files {
+		if f.suffix != "" && f.h.count() == 0 {
+			continue
+		}
+		p := exportPath(path, f.suffix)
+		if err := writeHgrmFile(p, f.h); err != nil {
+			return written, err
+		}
+		written = append(written, p)
+	}
+	return written, nil
+}
+
+// exportPath puts suffix before the extension of path, or at its end if it
+// has none.
+func exportPath(path, suffix string) string {
+	if suffix == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + suffix + ext
+}
+
+func writeHgrmFile(path string, h *histogram) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeHgrm(f, h); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeHgrm writes h as HdrHistogram's outputPercentileDistribution does,
+// with values in milliseconds. Rows step towards 100% in the same ticks,
+// each giving the value at that percentile and the count at or below it;
+// the last row is the max at 100%. Values are bucket midpoints clamped to
+// the observed min and max, as in percentile, so they never decrease.
+func writeHgrm(w io.Writer, h *histogram) error {
+	bw := bufio.NewWriter(w)
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	fmt.Fprintf(bw, "%12s %14s %10s %14s\n\n", "Value", "Percentile", "TotalCount", "1/(1-Percentile)")
+
+	if h.n > 0 {
+		bucket, seen := 0, h.counts[0]
+		for p := 0.0; ; {
+			rank := max(int64(math.Ceil(float64(h.n)*p/100)), 1)
+			for seen < rank {
+				bucket++
+				seen += h.counts[bucket]
+			}
+			v := min(max(bucketValue(bucket), h.min), h.max)
+			fmt.Fprintf(bw, "%12.3f %2.12f %10d %14.2f\n", ms(v), p/100, seen, 1/(1-p/100))
+			if seen == h.n {
+				break
+			}
+			halfDistance := math.Pow(2, math.Floor(math.Log2(100/(100-p)))+1)
+			p += 100 / (hgrmTicksPerHalfDistance * halfDistance)
+		}
+		fmt.Fprintf(bw, "%12.3f %2.12f %10d\n", ms(h.max), 1.0, h.n)
+	}
+
+	fmt.Fprintf(bw, "#[Mean    = %12.3f, StdDeviation   = %12.3f]\n", ms(h.mean()), ms(h.stddev()))
+	fmt.Fprintf(bw, "#[Max     = %12.3f, Total count    = %12d]\n", ms(h.max), h.n)
+	fmt.Fprintf(bw, "#[Buckets = %12d, SubBuckets     = %12d]\n", histBuckets, 1)
+	return bw.Flush()
+}
+
+// stddev estimates the standard deviation from the bucket midpoints.
+func (h *histogram) stddev() time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	mean := float64(h.mean())
+	var sq float64
+	for i, c := range h.counts {
+		if c != 0 {
+			d := float64(min(max(bucketValue(i), h.min), h.max)) - mean
+			sq += d * d * float64(c)
+		}
+	}
+	return time.Duration(math.Sqrt(sq / float64(h.n)))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files in testdata from the current output")
+
+// goldenHistogram holds 1000 latencies from 1ms to 1s, one per millisecond,
+// so every row of the export is predictable.
+func goldenHistogram() *histogram {
+	h := newHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	return h
+}
+
+func TestWriteHgrmGolden(t *testing.T) {
+	for name, h := range map[string]*histogram{
+		"latency.hgrm": goldenHistogram(),
+		"empty.hgrm":   newHistogram(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeHgrm(&buf, h); err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", name)
+			if *update {
+				if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("writeHgrm output differs from %s (run with -update if the change is intended):\n%s", golden, buf.String())
+			}
+		})
+	}
+}
+
+func TestExportLatencyFiles(t *testing.T) {
+	a := &aggregator{service: goldenHistogram(), corrected: goldenHistogram(), trackCorrected: true, split: newLatencySplit()}
+	a.split.record(&Result{method: "GET", cache: cacheHit, responseTime: time.Millisecond})
+	a.split.record(&Result{method: "PUT", responseTime: time.Millisecond})
+
+	dir := t.TempDir()
+	written, err := a.exportLatency(filepath.Join(dir, "run.hgrm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range written {
+		names = append(names, filepath.Base(p))
+	}
+	// The empty miss histogram is left out.
+	want := []string{"run.hgrm", "run.corrected.hgrm", "run.get.hgrm", "run.put.hgrm", "run.hit.hgrm"}
+	if !slices.Equal(names, want) {
+		t.Errorf("exported %v, want %v", names, want)
+	}
+	if got := exportPath("run", "get"); got != "run.get" {
+		t.Errorf("exportPath without an extension = %q", got)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// histogram is a fixed-size latency histogram with logarithmic buckets:
+// bucket i covers [histMin*histGrowth^i, histMin*histGrowth^(i+1)), giving
+// about 2% resolution from 1us to 60s. Values outside the range land in the
+// first or last bucket; min and max are kept exactly.
+type histogram struct {
+	counts []int64
+	n      int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+const (
+	histMin    = time.Microsecond
+	histMax    = 60 * time.Second
+	histGrowth = 1.02
+)
+
+var (
+	histLogGrowth = math.Log(histGrowth)
+	histBuckets   = int(math.Ceil(math.Log(float64(histMax/histMin))/histLogGrowth)) + 1
+)
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int64, histBuckets)}
+}
+
+func histBucket(d time.Duration) int {
+	if d <= histMin {
+		return 0
+	}
+	i := int(math.Log(float64(d)/float64(histMin)) / histLogGrowth)
+	return min(i, histBuckets-1)
+}
+
+// bucketValue is the geometric midpoint of bucket i.
+func bucketValue(i int) time.Duration {
+	return time.Duration(float64(histMin) * math.Pow(histGrowth, float64(i)+0.5))
+}
+
+func (h *histogram) record(d time.Duration) {
+	if h.n == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.counts[histBucket(d)]++
+	h.n++
+	h.sum += d
+}
+
+func (h *histogram) merge(o *histogram) {
+	if o.n == 0 {
+		return
+	}
+	if h.n == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.n += o.n
+	h.sum += o.sum
+}
+
+func (h *histogram) reset() {
+	clear(h.counts)
+	h.n, h.sum, h.min, h.max = 0, 0, 0, 0
+}
+
+func (h *histogram) count() int64 {
+	return h.n
+}
+
+func (h *histogram) mean() time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.n)
+}
+
+// percentile uses the same nearest-rank definition as an exact sort,
+// clamped to the observed min and max.
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	return h.atRank(max(int64(float64(h.n)*p/100+0.5), 1))
+}
+
+// atRank is the rank-th smallest value, 1-based, to bucket precision.
+func (h *histogram) atRank(rank int64) time.Duration {
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			return min(max(bucketValue(i), h.min), h.max)
+		}
+	}
+	return h.max
+}
+
+func (h *histogram) summary() latencySummary {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	ci := func(p float64) *interval {
+		lo, hi, ok := h.percentileCI(p)
+		if !ok {
+			return nil
+		}
+		return &interval{ms(lo), ms(hi)}
+	}
+	return latencySummary{
+		P50Ms:   ms(h.percentile(50)),
+		P90Ms:   ms(h.percentile(90)),
+		P99Ms:   ms(h.percentile(99)),
+		P999Ms:  ms(h.percentile(99.9)),
+		MaxMs:   ms(h.max),
+		Samples: h.n,
+		P50CI:   ci(50),
+		P90CI:   ci(90),
+		P99CI:   ci(99),
+		P999CI:  ci(99.9),
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+// exactPercentile is the nearest-rank percentile of sorted values, the
+// definition histogram.percentile approximates.
+func exactPercentile(sorted []time.Duration, p float64) time.Duration {
+	rank := max(int(float64(len(sorted))*p/100+0.5), 1)
+	return sorted[rank-1]
+}
+
+func TestHistogramPercentilesWithinBucketError(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for name, gen := range map[string]func() time.Duration{
+		// Log-normal around 2ms, the shape of a healthy server.
+		"lognormal": func() time.Duration {
+			return time.Duration(float64(2*time.Millisecond) * math.Exp(rng.NormFloat64()))
+		},
+		// Mostly fast with a slow tail, where p99 and p50 are far apart.
+		"bimodal": func() time.Duration {
+			if rng.IntN(100) < 3 {
+				return 200*time.Millisecond + time.Duration(rng.Int64N(int64(time.Second)))
+			}
+			return 100*time.Microsecond + time.Duration(rng.Int64N(int64(time.Millisecond)))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := newHistogram()
+			values := make([]time.Duration, 100_000)
+			for i := range values {
+				values[i] = gen()
+				h.record(values[i])
+			}
+			slices.Sort(values)
+			for _, p := range []float64{1, 50, 90, 99, 99.9, 100} {
+				got, want := h.percentile(p), exactPercentile(values, p)
+				// A bucket midpoint is within half a bucket of any value
+				// in the bucket.
+				if err := math.Abs(float64(got-want)) / float64(want); err > histGrowth-1 {
+					t.Errorf("p%g = %v, exact %v (%.2f%% off)", p, got, want, err*100)
+				}
+			}
+		})
+	}
+}
+
+func TestHistogramMergeMatchesSingle(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	all, a, b := newHistogram(), newHistogram(), newHistogram()
+	for i := range 10_000 {
+		d := time.Duration(rng.Int64N(int64(100 * time.Millisecond)))
+		all.record(d)
+		if i%3 == 0 {
+			a.record(d)
+		} else {
+			b.record(d)
+		}
+	}
+	a.merge(b)
+	for _, p := range []float64{50, 99, 100} {
+		if a.percentile(p) != all.percentile(p) {
+			t.Errorf("merged p%g = %v, single histogram %v", p, a.percentile(p), all.percentile(p))
+		}
+	}
+	if a.count() != all.count() || a.mean() != all.mean() || a.min != all.min || a.max != all.max {
+		t.Errorf("merged count, mean, min, max = %d %v %v %v; want %d %v %v %v",
+			a.count(), a.mean(), a.min, a.max, all.count(), all.mean(), all.min, all.max)
+	}
+}
+
+// Values outside the buckets land in the first or last one, and the
+// clamp to the observed min and max keeps percentiles between them.
+func TestHistogramOutOfRange(t *testing.T) {
+	h := newHistogram()
+	h.record(0)
+	h.record(2 * histMax)
+	for _, p := range []float64{1, 50, 100} {
+		if v := h.percentile(p); v < h.min || v > h.max {
+			t.Errorf("p%g = %v, outside the observed %v to %v", p, v, h.min, h.max)
+		}
+	}
+	if h.percentile(1) > 2*histMin {
+		t.Errorf("p1 = %v, want the first bucket", h.percentile(1))
+	}
+	if h.percentile(100) < histMax {
+		t.Errorf("p100 = %v, want the last bucket", h.percentile(100))
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// keyTemplate names the keys of the keyspace workloads after an existing
+// dataset's: the IDs lo..hi, formatted through a printf format with one
+// integer verb. With it, worker w of n owns the w-th of n even slices of
+// the range in place of key-{w}-{0..keysPerClient-1}, and the popular keys
+// are the first IDs.
+type keyTemplate struct {
+	spec   string
+	format string
+	lo, hi int64
+}
+
+type keyTemplateReport struct {
+	Template string `json:"template"`
+	Min      int64  `json:"min"`
+	Max      int64  `json:"max"`
+}
+
+// templateWorkloads are the workloads -key-template applies to. The others
+// make up keys of their own, which they check or delete.
+var templateWorkloads = []string{"get-popular", "put-all", "get-all", "mixed", "churn"}
+
+// parseKeyTemplate takes a printf format, e.g. "user:%d:profile", or a
+// template using {{.ID}}, e.g. "user:{{.ID}}:profile". Either must format
+// the ID exactly once with an integer verb: as the rest of the key is the
+// same for every ID and integers format to distinct strings, the keys of
+// the range are then unique.
+func parseKeyTemplate(spec string, lo, hi int64) (*keyTemplate, error) {
+	if lo < 0 || hi < lo {
+		return nil, fmt.Errorf("-key-min must not be negative and -key-max must be at least -key-min")
+	}
+	format := spec
+	if strings.Contains(spec, "{{") {
+		format = strings.ReplaceAll(spec, "%", "%%")
+		for _, action := range []string{"{{.ID}}", "{{ .ID }}"} {
+			format = strings.ReplaceAll(format, action, "%d")
+		}
+		if strings.Contains(format, "{{") {
+			return nil, fmt.Errorf("-key-template %q: only {{.ID}} is supported", spec)
+		}
+	}
+	verbs := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		j := i + 1
+		for j < len(format) && strings.IndexByte("+-# 0123456789.", format[j]) >= 0 {
+			j++
+		}
+		switch {
+		case j == len(format):
+			return nil, fmt.Errorf("-key-template %q ends in an incomplete verb", spec)
+		case format[j] == '%' && j == i+1:
+		case strings.IndexByte("dxXob", format[j]) >= 0:
+			verbs++
+		default:
+			return nil, fmt.Errorf("-key-template %q: %s is not an integer verb (want %%d, %%x, %%X, %%o or %%b)", spec, format[i:j+1])
+		}
+		i = j
+	}
+	if verbs != 1 {
+		return nil, fmt.Errorf("-key-template %q must format the ID exactly once, e.g. user:%%d:profile or user:{{.ID}}:profile; it formats it %d times", spec, verbs)
+	}
+	t := &keyTemplate{spec: spec, format: format, lo: lo, hi: hi}
+	for _, id := range []int64{lo, hi} {
+		k := t.key(id)
+		if k == "" || strings.ContainsAny(k, "/?#% \t\r\n") {
+			return nil, fmt.Errorf("-key-template %q makes ID %d the key %q, which cannot be a URL path segment", spec, id, k)
+		}
+	}
+	return t, nil
+}
+
+func (t *keyTemplate) size() int64 {
+	return t.hi - t.lo + 1
+}
+
+func (t *keyTemplate) key(id int64) string {
+	return string(t.appendKey(nil, id))
+}
+
+func (t *keyTemplate) appendKey(buf []byte, id int64) []byte {
+	return fmt.Appendf(buf, t.format, id)
+}
+
+// slice returns the IDs worker w of n owns.
+func (t *keyTemplate) slice(w, n int) (first, count int64) {
+	first = t.size() * int64(w) / int64(n)
+	return t.lo + first, t.size()*int64(w+1)/int64(n) - first
+}
+
+// keys lists the keys of IDs first..first+count-1.
+func (t *keyTemplate) keys(first, count int64) []string {
+	keys := make([]string, 0, count)
+	for id := first; id < first+count; id++ {
+		keys = append(keys, t.key(id))
+	}
+	return keys
+}
+
+func (t *keyTemplate) popular() []string {
+	return t.keys(t.lo, min(t.size(), int64(len(popularKeys))))
+}
+
+func (t *keyTemplate) report() *keyTemplateReport {
+	if t == nil {
+		return nil
+	}
+	return &keyTemplateReport{Template: t.spec, Min: t.lo, Max: t.hi}
+}
+
+func (r *keyTemplateReport) String() string {
+	if r == nil {
+		return "key-{client}-{n}"
+	}
+	return fmt.Sprintf("%s, IDs %d..%d", r.Template, r.Min, r.Max)
+}
+
+// idPicker draws offsets into a range of IDs by -key-dist.
+type idPicker struct {
+	count int64
+	zipf  *rand.Zipf
+}
+
+func newIDPicker(rng *rand.Rand, dist string, count int64) *idPicker {
+	p := &idPicker{count: count}
+	if dist == "zipf" && count > 1 {
+		p.zipf = rand.NewZipf(rng, 1.1, 1, uint64(count-1))
+	}
+	return p
+}
+
+func (p *idPicker) next(rng *rand.Rand) int64 {
+	if p.zipf != nil {
+		return int64(p.zipf.Uint64())
+	}
+	return rng.Int63n(p.count)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metricBuckets are the latency histogram's upper bounds in seconds.
+var metricBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// clientMetrics mirrors the aggregators' totals with atomic counters and a
+// preallocated histogram, so exposing them live costs each request a few
+// atomic adds and never takes a lock. The final report stays the source of
+// truth; its totals equal these once the run ends.
+type clientMetrics struct {
+	start      time.Time
+	targetRate float64
+
+	requests atomic.Int64
+	errors   [errQuota + 1]atomic.Int64
+	buckets  []atomic.Int64
+	sumNanos atomic.Int64
+	active   atomic.Int64
+}
+
+var errClassNames = [...]string{errRequest: "request", errTimeout: "timeout", errConnection: "connection", errHTTP: "http", errQuota: "quota"}
+
+func newClientMetrics(targetRate float64) *clientMetrics {
+	return &clientMetrics{start: time.Now(), targetRate: targetRate, buckets: make([]atomic.Int64, len(metricBuckets)+1)}
+}
+
+// record is a no-op on a nil receiver, i.e. without -metrics-addr or
+// -pushgateway-url.
+func (m *clientMetrics) record(res Result) {
+	if m == nil {
+		return
+	}
+	m.requests.Add(1)
+	if res.isError {
+		m.errors[res.errClass].Add(1)
+	}
+	secs := res.responseTime.Seconds()
+	i := 0
+	for i < len(metricBuckets) && secs > metricBuckets[i] {
+		i++
+	}
+	m.buckets[i].Add(1)
+	m.sumNanos.Add(int64(res.responseTime))
+}
+
+func (m *clientMetrics) workerStarted() {
+	if m != nil {
+		m.active.Add(1)
+	}
+}
+
+func (m *clientMetrics) workerStopped() {
+	if m != nil {
+		m.active.Add(-1)
+	}
+}
+
+func (m *clientMetrics) write(w io.Writer) {
+	requests := m.requests.Load()
+	fmt.Fprintln(w, "# HELP kvload_requests_total Requests completed by the load generator.")
+	fmt.Fprintln(w, "# TYPE kvload_requests_total counter")
+	fmt.Fprintf(w, "kvload_requests_total %d\n", requests)
+	fmt.Fprintln(w, "# HELP kvload_errors_total Failed requests by error class.")
+	fmt.Fprintln(w, "# TYPE kvload_errors_total counter")
+	for class := errRequest; class <= errQuota; class++ {
+		fmt.Fprintf(w, "kvload_errors_total{class=%q} %d\n", errClassNames[class], m.errors[class].Load())
+	}
+
+	fmt.Fprintln(w, "# HELP kvload_request_duration_seconds Service time of completed requests.")
+	fmt.Fprintln(w, "# TYPE kvload_request_duration_seconds histogram")
+	var cumulative int64
+	for i, le := range metricBuckets {
+		cumulative += m.buckets[i].Load()
+		fmt.Fprintf(w, "kvload_request_duration_seconds_bucket{le=\"%g\"} %d\n", le, cumulative)
+	}
+	cumulative += m.buckets[len(metricBuckets)].Load()
+	fmt.Fprintf(w, "kvload_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "kvload_request_duration_seconds_sum %g\n", time.Duration(m.sumNanos.Load()).Seconds())
+	fmt.Fprintf(w, "kvload_request_duration_seconds_count %d\n", cumulative)
+
+	fmt.Fprintln(w, "# HELP kvload_active_workers Client goroutines currently sending requests.")
+	fmt.Fprintln(w, "# TYPE kvload_active_workers gauge")
+	fmt.Fprintf(w, "kvload_active_workers %d\n", m.active.Load())
+	fmt.Fprintln(w, "# HELP kvload_offered_rate_rps Target request rate from -rate; 0 runs closed-loop.")
+	fmt.Fprintln(w, "# TYPE kvload_offered_rate_rps gauge")
+	fmt.Fprintf(w, "kvload_offered_rate_rps %g\n", m.targetRate)
+	fmt.Fprintln(w, "# HELP kvload_achieved_rate_rps Requests completed per second since the run started.")
+	fmt.Fprintln(w, "# TYPE kvload_achieved_rate_rps gauge")
+	fmt.Fprintf(w, "kvload_achieved_rate_rps %g\n", float64(requests)/time.Since(m.start).Seconds())
+}
+
+func (m *clientMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// serve exposes /metrics on addr for the rest of the process's life.
+func (m *clientMetrics) serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	log.Printf("Serving client metrics on http://%s/metrics", ln.Addr())
+	go http.Serve(ln, mux)
+	return nil
+}
+
+// pushLoop PUTs the metrics to a Prometheus Pushgateway every interval
+// until stop is closed, then once more so the final totals land.
+func (m *clientMetrics) pushLoop(url string, every time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	host, _ := os.Hostname()
+	url = strings.TrimSuffix(url, "/") + "/metrics/job/kvload/instance/" + host
+	client := &http.Client{Timeout: 10 * time.Second}
+	push := func() {
+		var buf bytes.Buffer
+		m.write(&buf)
+		req, err := http.NewRequest("PUT", url, &buf)
+		if err != nil {
+			log.Printf("Pushgateway: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Pushgateway: %v", err)
+			return
+		}
+		drainClose(resp.Body)
+		if resp.StatusCode >= 300 {
+			log.Printf("Pushgateway: HTTP %d", resp.StatusCode)
+		}
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			push()
+		case <-stop:
+			push()
+			return
+		}
+	}
+}
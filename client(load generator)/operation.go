@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type operation struct {
+	method string
+	url    string
+	body   string
+}
+
+type errorClass int
+
+const (
+	errNone errorClass = iota
+	errRequest
+	errTimeout
+	errConnection
+	errHTTP
+	// errQuota is a 507 Insufficient Storage: the server's storage quota
+	// is exhausted, so retrying is pointless until space is freed.
+	errQuota
+)
+
+func httpErrorClass(status int) errorClass {
+	if status == http.StatusInsufficientStorage {
+		return errQuota
+	}
+	return errHTTP
+}
+
+// idempotent reports whether op may be retried safely: GET and DELETE always,
+// PUT because every attempt sends the same body.
+func (op operation) idempotent() bool {
+	switch op.method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+type cacheOutcome int
+
+const (
+	cacheUnknown cacheOutcome = iota
+	cacheHit
+	cacheMiss
+)
+
+func parseCacheOutcome(h string) cacheOutcome {
+	switch h {
+	case "HIT":
+		return cacheHit
+	case "MISS", "NEGATIVE", "BYPASS", "UNCACHEABLE":
+		return cacheMiss
+	}
+	return cacheUnknown
+}
+
+// outcome describes an executed operation. sent and received count body
+// bytes over all attempts; status, cache and the body size are from the
+// last one.
+type outcome struct {
+	class    errorClass
+	status   int
+	retries  int
+	cache    cacheOutcome
+	sent     int64
+	received int64
+	bodySize int64
+	// timing is the server's timing of a GET sent with X-Timing.
+	timing serverTiming
+
+	// With -respect-backpressure: the 429, 503 and 507 responses over all
+	// attempts, indexed like backpressureStats.responses; the last attempt's
+	// Retry-After; the time spent waiting between attempts; whether the
+	// last attempt was pushed back too; and if so, how long to wait before
+	// the next operation.
+	backpressure [3]int
+	retryAfter   time.Duration
+	backoff      time.Duration
+	rejected     bool
+	pause        time.Duration
+
+	violations []violation
+}
+
+// attempt reads the response body to the end before closing it, so the
+// connection can be reused and the body size counted. With strict, the
+// response is run through the conformance checks.
+func (op operation) attempt(client *http.Client, timeout time.Duration, strict bool) outcome {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var body io.Reader
+	if op.body != "" {
+		body = strings.NewReader(op.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, op.method, op.url, body)
+	if err != nil {
+		return outcome{class: errRequest}
+	}
+	return op.send(client, req, strict)
+}
+
+// doer is an *http.Client or a worker's requester.
+type doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// send sends req, built for op, and reads the response.
+func (op operation) send(client doer, req *http.Request, strict bool) outcome {
+	resp, err := client.Do(req)
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return outcome{class: errTimeout, sent: int64(len(op.body))}
+		}
+		return outcome{class: errConnection}
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	out := outcome{
+		status:   resp.StatusCode,
+		cache:    parseCacheOutcome(resp.Header.Get("X-Cache")),
+		sent:     int64(len(op.body)),
+		received: n,
+		bodySize: n,
+	}
+	if backpressureStatus(resp.StatusCode) {
+		out.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	if err == nil && req.Header.Get("X-Timing") == "true" {
+		out.timing = parseServerTiming(resp)
+	}
+	switch {
+	case resp.StatusCode >= 400:
+		out.class = httpErrorClass(resp.StatusCode)
+	case err != nil:
+		out.class = errConnection
+	}
+	if strict && err == nil {
+		out.violations = checkConformance(newResponseInfo(op, resp, n))
+	}
+	return out
+}
+
+// maxDrain bounds how much of an unwanted response body drainClose reads.
+// Reading the rest of a body lets the connection be reused; beyond this
+// much, opening a new connection is cheaper.
+const maxDrain = 256 << 10
+
+// drainClose closes a body the caller has no use for, draining it first so
+// the connection goes back to the pool.
+func drainClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrain))
+	body.Close()
+}
+
+func retryable(class errorClass, status int) bool {
+	return class == errTimeout || class == errConnection || (status >= 500 && class != errQuota)
+}
+
+// execute runs op with the configured retry policy. Retries back off
+// exponentially and are abandoned as soon as the test is stopped. With
+// -respect-backpressure, a 429, 503 or 507 is retried whatever the method,
+// since the server did not act on it, after its Retry-After; if the last
+// attempt is still pushed back, out.pause is how long the worker should
+// wait before its next operation.
+func (op operation) execute(rq *requester, cfg *workerConfig, stopChan <-chan struct{}) outcome {
+	out := rq.attempt(op, cfg.strict)
+	pushedBack := func(out outcome) bool {
+		return cfg.respectBackpressure && backpressureStatus(out.status)
+	}
+	if pushedBack(out) {
+		countBackpressure(&out.backpressure, out.status)
+	}
+	for out.retries < cfg.retries && (pushedBack(out) || retryable(out.class, out.status) && op.idempotent()) {
+		wait := cfg.retryBackoff << out.retries
+		if pushedBack(out) {
+			wait = cfg.backpressureWait(out, out.retries)
+		}
+		start := time.Now()
+		select {
+		case <-stopChan:
+			if pushedBack(out) {
+				out.backoff += time.Since(start)
+				out.rejected = true
+			}
+			return out
+		case <-time.After(wait):
+		}
+		backoff := out.backoff
+		if pushedBack(out) {
+			backoff += time.Since(start)
+		}
+		next := rq.attempt(op, cfg.strict)
+		next.retries = out.retries + 1
+		next.sent += out.sent
+		next.received += out.received
+		next.violations = append(out.violations, next.violations...)
+		next.backpressure = out.backpressure
+		if pushedBack(next) {
+			countBackpressure(&next.backpressure, next.status)
+		}
+		next.backoff = backoff
+		out = next
+	}
+	if pushedBack(out) {
+		out.rejected = true
+		out.pause = cfg.backpressureWait(out, out.retries)
+	}
+	return out
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// outageBucket is the resolution of the throughput timeline used to
+	// measure recovery after an outage.
+	outageBucket = 100 * time.Millisecond
+	// outageBaseline is how much of the run before an outage sets the
+	// throughput it has to recover to.
+	outageBaseline = 10 * time.Second
+	// outagePause keeps a worker whose connections are refused outright
+	// from spinning.
+	outagePause = 10 * time.Millisecond
+	// recoverFraction of the pre-outage throughput, over a one-second
+	// window, counts as recovered.
+	recoverFraction = 0.95
+)
+
+// outageWindow runs from the send of the first request that found the
+// server unavailable to the completion of the first request sent after it
+// that succeeded. A zero end means the run finished first.
+type outageWindow struct {
+	start, end time.Time
+	failed     int64
+}
+
+// outageState follows one sequence of results, a worker's or all of them,
+// and cuts it into outage windows.
+type outageState struct {
+	open    *outageWindow
+	windows []outageWindow
+}
+
+// record returns true when it opens or closes a window.
+func (o *outageState) record(sent, done time.Time, unavailable bool) bool {
+	switch {
+	case unavailable && o.open == nil:
+		o.open = &outageWindow{start: sent, failed: 1}
+		return true
+	case unavailable:
+		o.open.failed++
+	case o.open != nil && !sent.Before(o.open.start):
+		o.open.end = done
+		o.windows = append(o.windows, *o.open)
+		o.open = nil
+		return true
+	}
+	return false
+}
+
+// all returns the windows, including one still open.
+func (o *outageState) all() []outageWindow {
+	if o.open == nil {
+		return o.windows
+	}
+	return append(o.windows[:len(o.windows):len(o.windows)], *o.open)
+}
+
+// outageTracker is the global view across workers. Results only take the
+// lock while a window is open or about to open, so a healthy run pays one
+// atomic load per request.
+type outageTracker struct {
+	mu     sync.Mutex
+	state  outageState
+	isOpen atomic.Bool
+
+	failovers, failbacks, backupRequests atomic.Int64
+}
+
+func (t *outageTracker) record(sent, done time.Time, unavailable bool) {
+	if !unavailable && !t.isOpen.Load() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.state.record(sent, done, unavailable) {
+		return
+	}
+	if t.state.open != nil {
+		t.isOpen.Store(true)
+		log.Printf("OUTAGE started at %s", sent.UTC().Format(time.RFC3339Nano))
+		return
+	}
+	t.isOpen.Store(false)
+	w := t.state.windows[len(t.state.windows)-1]
+	log.Printf("OUTAGE ended at %s after %s (%d failed requests)",
+		w.end.UTC().Format(time.RFC3339Nano), w.end.Sub(w.start).Round(time.Millisecond), w.failed)
+}
+
+// since returns how long the current outage has lasted, or 0.
+func (t *outageTracker) since(now time.Time) time.Duration {
+	if t == nil || !t.isOpen.Load() {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state.open == nil {
+		return 0
+	}
+	return now.Sub(t.state.open.start)
+}
+
+// failover moves one worker to the backup target after a run of failures
+// against the primary, and back once the primary's /readyz answers 200.
+type failover struct {
+	primary, backup string
+	after           int
+	probeEvery      time.Duration
+
+	failures  int
+	onBackup  bool
+	lastProbe time.Time
+}
+
+func (f *failover) route(op operation, client *http.Client, cfg *workerConfig) operation {
+	if !f.onBackup {
+		return op
+	}
+	if time.Since(f.lastProbe) >= f.probeEvery {
+		f.lastProbe = time.Now()
+		probe := operation{method: "GET", url: f.primary + "/readyz"}
+		if out := probe.attempt(client, cfg.opTimeout, false); out.status == http.StatusOK {
+			f.onBackup, f.failures = false, 0
+			cfg.outage.failbacks.Add(1)
+			return op
+		}
+	}
+	if rest, ok := strings.CutPrefix(op.url, f.primary); ok {
+		op.url = f.backup + rest
+	}
+	cfg.outage.backupRequests.Add(1)
+	return op
+}
+
+func (f *failover) observe(unavailable bool, cfg *workerConfig) {
+	if f.onBackup {
+		return
+	}
+	if !unavailable {
+		f.failures = 0
+		return
+	}
+	if f.failures++; f.failures >= f.after {
+		f.onBackup, f.lastProbe = true, time.Now()
+		cfg.outage.failovers.Add(1)
+	}
+}
+
+type outageReport struct {
+	Outages             []outageWindowReport `json:"outages"`
+	WorkersAffected     int                  `json:"workers_affected"`
+	WorkerDowntimeAvgMs float64              `json:"worker_downtime_avg_ms"`
+	WorkerDowntimeMaxMs float64              `json:"worker_downtime_max_ms"`
+	Backup              string               `json:"backup_target,omitempty"`
+	Failovers           int64                `json:"failovers,omitempty"`
+	Failbacks           int64                `json:"failbacks,omitempty"`
+	BackupRequests      int64                `json:"backup_requests,omitempty"`
+}
+
+type outageWindowReport struct {
+	Start          time.Time  `json:"start"`
+	End            *time.Time `json:"end,omitempty"`
+	StartServer    *time.Time `json:"start_server,omitempty"`
+	EndServer      *time.Time `json:"end_server,omitempty"`
+	StartOffsetMs  float64    `json:"start_offset_ms"`
+	DowntimeMs     float64    `json:"downtime_ms"`
+	FailedRequests int64      `json:"failed_requests"`
+	PreOutageRps   float64    `json:"pre_outage_rps"`
+	// RecoveryMs is from the end of the outage until the start of the
+	// first second with throughput back to 95% of PreOutageRps; absent if
+	// there was none.
+	RecoveryMs *float64 `json:"recovery_ms,omitempty"`
+}
+
+// outageReportFor measures each global window against the merged
+// throughput timeline; per-worker windows give the downtime spread.
+func outageReportFor(global []outageWindow, workers []*aggregator, successes []int64, start, end time.Time) *outageReport {
+	r := &outageReport{Outages: []outageWindowReport{}}
+	var total, worst time.Duration
+	var count int
+	for _, w := range workers {
+		windows := w.outage.all()
+		if len(windows) > 0 {
+			r.WorkersAffected++
+		}
+		for _, win := range windows {
+			d := win.downtime(end)
+			total += d
+			worst = max(worst, d)
+			count++
+		}
+	}
+	if count > 0 {
+		r.WorkerDowntimeAvgMs = float64(total/time.Duration(count)) / float64(time.Millisecond)
+		r.WorkerDowntimeMaxMs = float64(worst) / float64(time.Millisecond)
+	}
+
+	prevEnd := start
+	for _, win := range global {
+		wr := outageWindowReport{
+			Start:          win.start,
+			StartOffsetMs:  float64(win.start.Sub(start)) / float64(time.Millisecond),
+			DowntimeMs:     float64(win.downtime(end)) / float64(time.Millisecond),
+			FailedRequests: win.failed,
+		}
+		from := max(bucketOf(prevEnd, start), bucketOf(win.start.Add(-outageBaseline), start))
+		to := bucketOf(win.start, start)
+		if to > from {
+			wr.PreOutageRps = float64(sumBuckets(successes, from, to)) / (float64(to-from) * outageBucket.Seconds())
+		}
+		if !win.end.IsZero() {
+			e := win.end
+			wr.End = &e
+			if rec, ok := recoveryAfter(successes, bucketOf(e, start), wr.PreOutageRps); ok {
+				ms := float64(max(start.Add(time.Duration(rec)*outageBucket).Sub(e), 0)) / float64(time.Millisecond)
+				wr.RecoveryMs = &ms
+			}
+			prevEnd = e
+		}
+		r.Outages = append(r.Outages, wr)
+	}
+	return r
+}
+
+func (w outageWindow) downtime(runEnd time.Time) time.Duration {
+	if w.end.IsZero() {
+		return runEnd.Sub(w.start)
+	}
+	return w.end.Sub(w.start)
+}
+
+func bucketOf(t, start time.Time) int {
+	return max(int(t.Sub(start)/outageBucket), 0)
+}
+
+func sumBuckets(b []int64, from, to int) int64 {
+	var n int64
+	for i := from; i < min(to, len(b)); i++ {
+		n += b[i]
+	}
+	return n
+}
+
+// recoveryAfter returns the first bucket from bucket from on that starts a
+// one-second window whose throughput reaches recoverFraction of rps.
+// The outage's own bucket counts, so a fast recovery can come out at 0.
+func recoveryAfter(successes []int64, from int, rps float64) (int, bool) {
+	if rps <= 0 {
+		return 0, false
+	}
+	span := int(time.Second / outageBucket)
+	for b := from; b+span <= len(successes); b++ {
+		if float64(sumBuckets(successes, b, b+span)) >= rps*recoverFraction {
+			return b, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key policies of the mixed workload's reader and writer pools.
+const (
+	// Readers: the popular keys, any key of any writer's range, or keys
+	// writers have written, at least -read-lag ago.
+	readPopular = "popular"
+	readUniform = "uniform"
+	readRecent  = "recent"
+	// Writers: their own range in order, as mixed does, or at random.
+	writeSequential = "sequential"
+	writeRandom     = "random"
+)
+
+// readLagPoll is how long a reader with nothing old enough to read waits
+// before looking again.
+const readLagPoll = 10 * time.Millisecond
+
+// workerPool is a set of workers that only read or only write, with their
+// own transport and, if rate is set, their own pace. Its workers are
+// first to first+clients-1.
+type workerPool struct {
+	name      string
+	method    string
+	first     int
+	clients   int
+	rate      float64
+	interval  time.Duration
+	keyPolicy string
+	transport http.RoundTripper
+}
+
+// workerPools splits the mixed workload's workers into writers, numbered
+// first, and readers.
+type workerPools struct {
+	writers, readers workerPool
+	readLag          time.Duration
+	// written is nil unless the readers read recent keys.
+	written *writtenKeys
+}
+
+func newWorkerPools(writers, readers int, writerRate, readerRate float64, writePolicy, readPolicy string, readLag time.Duration, transport func() http.RoundTripper) (*workerPools, error) {
+	switch writePolicy {
+	case writeSequential, writeRandom:
+	default:
+		return nil, fmt.Errorf("unknown -writer-keys %q (want %s or %s)", writePolicy, writeSequential, writeRandom)
+	}
+	switch readPolicy {
+	case readPopular, readUniform, readRecent:
+	default:
+		return nil, fmt.Errorf("unknown -reader-keys %q (want %s, %s or %s)", readPolicy, readPopular, readUniform, readRecent)
+	}
+	if readLag > 0 && readPolicy != readRecent {
+		return nil, fmt.Errorf("-read-lag needs -reader-keys=%s", readRecent)
+	}
+	if readPolicy != readPopular && writers == 0 {
+		return nil, fmt.Errorf("-reader-keys=%s reads what writers write and needs -writer-clients", readPolicy)
+	}
+	p := &workerPools{
+		writers: workerPool{name: "writers", method: "PUT", clients: writers, rate: writerRate, keyPolicy: writePolicy},
+		readers: workerPool{name: "readers", method: "GET", first: writers, clients: readers, rate: readerRate, keyPolicy: readPolicy},
+		readLag: readLag,
+	}
+	if readPolicy == readRecent {
+		p.written = newWrittenKeys()
+	}
+	for _, pool := range []*workerPool{&p.writers, &p.readers} {
+		if pool.rate > 0 && pool.clients > 0 {
+			pool.interval = time.Duration(float64(pool.clients) / pool.rate * float64(time.Second))
+		}
+		pool.transport = transport()
+	}
+	return p, nil
+}
+
+func (p *workerPools) of(id int) *workerPool {
+	if id < p.readers.first {
+		return &p.writers
+	}
+	return &p.readers
+}
+
+func (p *workerPools) openLoop() bool {
+	return p != nil && (p.writers.interval > 0 || p.readers.interval > 0)
+}
+
+// intervalFor is worker id's pace: its pool's with pools, else -rate's.
+func (cfg *workerConfig) intervalFor(id int) time.Duration {
+	if cfg.pools != nil {
+		return cfg.pools.of(id).interval
+	}
+	return cfg.interval
+}
+
+// next is the operation of a pooled worker. A reader of recent keys
+// returns an empty operation while no write is old enough.
+func (p *workerPools) next(cfg *workerConfig, keys *workerKeys) operation {
+	if p.of(keys.id).method == "PUT" {
+		url := keys.nextWrite(cfg)
+		switch {
+		case p.writers.keyPolicy != writeRandom:
+		case cfg.keyTemplate != nil:
+			first, count := cfg.keyTemplate.slice(keys.id, cfg.allClients)
+			url = keys.idURL(keys.writeBase, cfg.keyTemplate, first+keys.rng.Int63n(count))
+		default:
+			url = keys.url(keys.writeBase, keys.id, keys.rng.Intn(cfg.keysPerClient))
+		}
+		return operation{method: "PUT", url: url, body: "data-mixed-" + strings.TrimPrefix(url, keys.writeBase)}
+	}
+	switch p.readers.keyPolicy {
+	case readUniform:
+		if t := cfg.keyTemplate; t != nil {
+			// The writers' slices, as they are the first workers.
+			last, count := t.slice(p.writers.clients-1, cfg.allClients)
+			return operation{method: "GET", url: keys.idURL(keys.readBase, t, t.lo+keys.rng.Int63n(last+count-t.lo))}
+		}
+		return operation{method: "GET", url: keys.url(keys.readBase, keys.rng.Intn(p.writers.clients), keys.rng.Intn(cfg.keysPerClient))}
+	case readRecent:
+		key, ok := p.written.pick(keys.rng, time.Now().Add(-p.readLag))
+		if !ok {
+			return operation{}
+		}
+		return operation{method: "GET", url: keys.keyURL(keys.readBase, key)}
+	}
+	key := popularKeys[keys.rng.Intn(len(popularKeys))]
+	return operation{method: "GET", url: keys.keyURL(keys.readBase, key)}
+}
+
+// published tells lagged readers about an acknowledged PUT.
+func (p *workerPools) published(op operation, keys *workerKeys) {
+	if p == nil || p.written == nil {
+		return
+	}
+	p.written.publish(strings.TrimPrefix(op.url, keys.writeBase))
+}
+
+// writtenKeysCap bounds the writes readers of recent keys choose from.
+const writtenKeysCap = 1 << 16
+
+// writtenKeys is where writers publish the keys of acknowledged PUTs, with
+// the time, for readers to pick from. It keeps the last writtenKeysCap in
+// a ring; as times are taken under the lock, the ring is in time order.
+type writtenKeys struct {
+	mu   sync.RWMutex
+	keys []string
+	at   []int64
+	// n counts every key published; the ring holds the last
+	// min(n, writtenKeysCap) of them.
+	n int
+}
+
+func newWrittenKeys() *writtenKeys {
+	return &writtenKeys{keys: make([]string, writtenKeysCap), at: make([]int64, writtenKeysCap)}
+}
+
+func (w *writtenKeys) publish(key string) {
+	w.mu.Lock()
+	i := w.n % writtenKeysCap
+	w.keys[i], w.at[i] = key, time.Now().UnixNano()
+	w.n++
+	w.mu.Unlock()
+}
+
+// pick returns one of the kept keys written before t, at random.
+func (w *writtenKeys) pick(rng *rand.Rand, t time.Time) (string, bool) {
+	before := t.UnixNano()
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	oldest := max(w.n-writtenKeysCap, 0)
+	// Kept writes oldest+0 .. oldest+old-1 are old enough.
+	old := sort.Search(w.n-oldest, func(j int) bool { return w.at[(oldest+j)%writtenKeysCap] > before })
+	if old == 0 {
+		return "", false
+	}
+	return w.keys[(oldest+rng.Intn(old))%writtenKeysCap], true
+}
+
+type poolReport struct {
+	Name      string  `json:"name"`
+	Clients   int     `json:"clients"`
+	KeyPolicy string  `json:"keys"`
+	TargetRps float64 `json:"target_rps,omitempty"`
+	// ReadLagMs is the readers' -read-lag.
+	ReadLagMs       float64        `json:"read_lag_ms,omitempty"`
+	Requests        int64          `json:"requests"`
+	Failed          int64          `json:"failed"`
+	Throughput      float64        `json:"throughput_rps"`
+	CacheHitRatePct *float64       `json:"cache_hit_rate_pct,omitempty"`
+	Connections     int64          `json:"connections_opened"`
+	Reused          int64          `json:"connections_reused"`
+	ServiceTime     latencySummary `json:"service_time"`
+}
+
+func poolReports(p *workerPools, workers []*aggregator, transports []*trackingTransport, testDuration time.Duration) []poolReport {
+	var reports []poolReport
+	for _, pool := range []*workerPool{&p.writers, &p.readers} {
+		if pool.clients == 0 {
+			continue
+		}
+		r := poolReport{Name: pool.name, Clients: pool.clients, KeyPolicy: pool.keyPolicy, TargetRps: pool.rate}
+		if pool == &p.readers {
+			r.ReadLagMs = float64(p.readLag) / float64(time.Millisecond)
+		}
+		a := newAggregator(false, false, time.Time{})
+		for id := pool.first; id < pool.first+pool.clients; id++ {
+			a.merge(workers[id])
+			r.Connections += transports[id].conns.Load()
+			r.Reused += transports[id].reused.Load()
+		}
+		r.Requests = a.requests
+		r.Failed = a.errors
+		r.Throughput = float64(a.succeeded()) / testDuration.Seconds()
+		r.ServiceTime = a.service.summary()
+		if rate, ok := a.cache.rate(); ok {
+			r.CacheHitRatePct = &rate
+		}
+		reports = append(reports, r)
+	}
+	return reports
+}
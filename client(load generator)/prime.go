@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var popularKeys = []string{"key-1", "key-2", "key-3", "key-4", "key-5"}
+
+const (
+	// primeRetries is how many more times a key that failed to write or
+	// to read back is primed; the waits between attempts double from
+	// primeRetryBackoff.
+	primeRetries      = 3
+	primeRetryBackoff = 100 * time.Millisecond
+	// primeVerifyEvery is how many primed keys share one read-back; popular
+	// keys are always read back.
+	primeVerifyEvery = 16
+)
+
+// primeValue is what priming and tenant writes store under key,
+// and what the server's generator writes for "value_content": "key".
+func primeValue(key string) string {
+	return "data-" + key
+}
+
+// keyspaceKeys lists every key the first clients of allClients write in
+// put-all and mixed, and read in get-all.
+func keyspaceKeys(t *keyTemplate, clients, allClients, keysPerClient int) []string {
+	if t != nil {
+		last, count := t.slice(clients-1, allClients)
+		return t.keys(t.lo, last+count-t.lo)
+	}
+	keys := make([]string, 0, clients*keysPerClient)
+	for i := 0; i < clients; i++ {
+		for j := 0; j < keysPerClient; j++ {
+			keys = append(keys, fmt.Sprintf("key-%d-%d", i, j))
+		}
+	}
+	return keys
+}
+
+// uniqueKeys drops repeated keys, keeping the first of each in place.
+func uniqueKeys(keys []string) []string {
+	seen := make(map[string]bool, len(keys))
+	out := keys[:0]
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+type batchEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type primer struct {
+	cfg    *workerConfig
+	url    string
+	client *http.Client
+	batch  int
+
+	done    atomic.Int64
+	failed  atomic.Int64
+	written atomic.Int64
+
+	mu sync.Mutex
+	// failedPopular are popularKeys that could not be primed.
+	failedPopular []string
+}
+
+// primeKeys writes primeValue(key) for every key with cfg.primeConcurrency
+// workers, using the server's batch PUT (POST to the collection) when a
+// probe shows it exists, and reads a sample of the keys back to check them.
+// Chunks that fail either step are primed again up to primeRetries times. It fails if
+// any popular key could not be primed, or more than cfg.primeMaxFailures
+// percent of all keys.
+func primeKeys(cfg *workerConfig, target string, keys []string) error {
+	p := &primer{
+		cfg:    cfg,
+		url:    target + cfg.pathPrefix,
+		client: &http.Client{Timeout: 30 * time.Second, Transport: cfg.transport},
+		batch:  1,
+	}
+	if cfg.primeServerSide {
+		err := primeServerSide(cfg, target, keys)
+		if err == nil {
+			return p.checkPopular(keys)
+		}
+		if !errors.Is(err, errNoGenerator) {
+			return err
+		}
+		log.Printf("Server-side priming unavailable (%v); priming from the client", err)
+	}
+	// A server that lists its features needs no probe.
+	if cfg.primeBatch > 1 && (cfg.server.has("batch") || cfg.server == nil && p.post(nil)) {
+		p.batch = cfg.primeBatch
+	}
+	mode := "single PUTs"
+	if p.batch > 1 {
+		mode = fmt.Sprintf("batches of %d", p.batch)
+	}
+	log.Printf("Priming %d keys (%s, %d workers)", len(keys), mode, cfg.primeConcurrency)
+
+	chunks := make(chan []string)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.primeConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				p.write(chunk)
+			}
+		}()
+	}
+
+	start := time.Now()
+	stopProgress := p.progress(len(keys), start)
+	for i := 0; i < len(keys); i += p.batch {
+		chunks <- keys[i:min(i+p.batch, len(keys))]
+	}
+	close(chunks)
+	wg.Wait()
+	stopProgress()
+
+	failed := p.failed.Load()
+	log.Printf("Primed and verified %d keys in %s (%d failed)", len(keys)-int(failed), time.Since(start).Round(time.Millisecond), failed)
+	if len(p.failedPopular) > 0 {
+		return fmt.Errorf("priming failed for popular keys %s; refusing to run a workload that would read missing keys", strings.Join(p.failedPopular, ", "))
+	}
+	if pct := float64(failed) / float64(len(keys)) * 100; pct > cfg.primeMaxFailures {
+		return fmt.Errorf("priming failed for %d of %d keys (%.1f%%, limit %.1f%% from -prime-max-failures); refusing to run against a half-primed keyspace",
+			failed, len(keys), pct, cfg.primeMaxFailures)
+	}
+	return nil
+}
+
+// write primes keys and reads a sample of them back, retrying the whole
+// chunk when a sampled key does not hold the value written.
+func (p *primer) write(keys []string) {
+	pending := keys
+	for attempt := 0; ; attempt++ {
+		entries := make([]batchEntry, len(pending))
+		for i, k := range pending {
+			entries[i] = batchEntry{Key: k, Value: primeValue(k)}
+		}
+		var ok bool
+		if p.batch > 1 {
+			ok = p.post(entries)
+		} else {
+			ok = p.put(entries[0])
+		}
+		if ok && p.verified(entries) {
+			pending = nil
+		}
+		if len(pending) == 0 || attempt == primeRetries {
+			break
+		}
+		time.Sleep(primeRetryBackoff << attempt)
+	}
+	p.done.Add(int64(len(keys)))
+	p.failed.Add(int64(len(pending)))
+	for _, k := range pending {
+		if slices.Contains(popularKeys, k) {
+			p.mu.Lock()
+			p.failedPopular = append(p.failedPopular, k)
+			p.mu.Unlock()
+		}
+	}
+}
+
+// verified reads back every popular key among entries and one in every
+// primeVerifyEvery of the rest, reporting whether each holds the value
+// written. A server that acknowledges writes it does not keep fails the
+// sample as surely as a full read-back, at a fraction of the requests.
+func (p *primer) verified(entries []batchEntry) bool {
+	for _, e := range entries {
+		sampled := p.written.Add(1)%primeVerifyEvery == 1
+		if (sampled || slices.Contains(popularKeys, e.Key)) && !p.verify(e.Key, e.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *primer) verify(key, want string) bool {
+	req, err := http.NewRequest("GET", p.url+key, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(len(want))+1))
+	return err == nil && resp.StatusCode == http.StatusOK && string(body) == want
+}
+
+// checkPopular verifies the popular keys among keys after the server
+// generated them, priming from the client any that do not read back.
+func (p *primer) checkPopular(keys []string) error {
+	for _, k := range keys {
+		if slices.Contains(popularKeys, k) && !p.verify(k, primeValue(k)) {
+			p.write([]string{k})
+		}
+	}
+	if len(p.failedPopular) > 0 {
+		return fmt.Errorf("priming failed for popular keys %s; refusing to run a workload that would read missing keys", strings.Join(p.failedPopular, ", "))
+	}
+	return nil
+}
+
+func (p *primer) put(e batchEntry) bool {
+	req, err := http.NewRequest("PUT", p.url+e.Key, bytes.NewBufferString(e.Value))
+	if err != nil {
+		return false
+	}
+	return p.do(req)
+}
+
+// post sends entries as one batch; with none it probes for batch support.
+func (p *primer) post(entries []batchEntry) bool {
+	body, err := json.Marshal(map[string][]batchEntry{"entries": entries})
+	if err != nil {
+		return false
+	}
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return p.do(req)
+}
+
+func (p *primer) do(req *http.Request) bool {
+	if p.cfg.adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.cfg.adminToken)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false
+	}
+	drainClose(resp.Body)
+	return resp.StatusCode < 300
+}
+
+// progress prints a line every few seconds until the returned func is called.
+func (p *primer) progress(total int, start time.Time) func() {
+	if p.cfg.quiet {
+		return func() {}
+	}
+	ticker := time.NewTicker(3 * time.Second)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				done := p.done.Load()
+				fmt.Fprintf(os.Stderr, "Priming: %d/%d keys (%.0f%%, %d failed, %.0f keys/s)\n",
+					done, total, float64(done)/float64(total)*100, p.failed.Load(),
+					float64(done)/time.Since(start).Seconds())
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stop)
+		wg.Wait()
+	}
+}
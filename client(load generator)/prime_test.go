@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// flakyKV is a /kv/ stub that fails the first write of every key, as a
+// server shedding load at the start of a run might. With keep false it
+// acknowledges writes without storing them.
+type flakyKV struct {
+	keep bool
+
+	mu     sync.Mutex
+	values map[string]string
+	tried  map[string]bool
+	gets   atomic.Int64
+}
+
+func newFlakyKV(keep bool) *flakyKV {
+	return &flakyKV{keep: keep, values: map[string]string{}, tried: map[string]bool{}}
+}
+
+// firstTry reports whether any of keys is written for the first time.
+func (f *flakyKV) firstTry(keys ...string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	first := false
+	for _, k := range keys {
+		first = first || !f.tried[k]
+		f.tried[k] = true
+	}
+	return first
+}
+
+func (f *flakyKV) store(key, value string) {
+	if f.keep {
+		f.mu.Lock()
+		f.values[key] = value
+		f.mu.Unlock()
+	}
+}
+
+func (f *flakyKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	switch r.Method {
+	case "GET":
+		f.gets.Add(1)
+		f.mu.Lock()
+		v, ok := f.values[key]
+		f.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, v)
+	case "PUT":
+		body, _ := io.ReadAll(r.Body)
+		if f.firstTry(key) {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		f.store(key, string(body))
+	case "POST":
+		var req struct{ Entries []batchEntry }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		keys := make([]string, len(req.Entries))
+		for i, e := range req.Entries {
+			keys[i] = e.Key
+		}
+		if f.firstTry(keys...) {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		for _, e := range req.Entries {
+			f.store(e.Key, e.Value)
+		}
+	}
+}
+
+func testPrimeKeys(n int) []string {
+	keys := append([]string(nil), popularKeys...)
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("key-0-%d", i))
+	}
+	return keys
+}
+
+func TestPrimeRetriesFailedWrites(t *testing.T) {
+	for _, batch := range []int{1, 50} {
+		t.Run(fmt.Sprintf("batch=%d", batch), func(t *testing.T) {
+			kv := newFlakyKV(true)
+			ts := httptest.NewServer(kv)
+			defer ts.Close()
+			cfg := &workerConfig{pathPrefix: "/kv/", primeConcurrency: 64, primeBatch: batch, quiet: true}
+
+			keys := testPrimeKeys(300)
+			if err := primeKeys(cfg, ts.URL, keys); err != nil {
+				t.Fatalf("priming failed: %v", err)
+			}
+			for _, k := range keys {
+				if got := kv.values[k]; got != primeValue(k) {
+					t.Fatalf("%s = %q after priming, want %q", k, got, primeValue(k))
+				}
+			}
+			// Popular keys and a sample are read back, not every key.
+			if gets := kv.gets.Load(); gets > int64(len(keys)/4) {
+				t.Errorf("%d GETs to verify %d keys", gets, len(keys))
+			}
+		})
+	}
+}
+
+func TestPrimeFailsWhenPopularKeysAreLost(t *testing.T) {
+	ts := httptest.NewServer(newFlakyKV(false))
+	defer ts.Close()
+	cfg := &workerConfig{pathPrefix: "/kv/", primeConcurrency: 4, primeBatch: 1, primeMaxFailures: 100, quiet: true}
+
+	err := primeKeys(cfg, ts.URL, testPrimeKeys(10))
+	if err == nil || !strings.Contains(err.Error(), "popular keys") {
+		t.Fatalf("priming a server that drops writes: %v, want a popular key failure", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNoGenerator means the server has no /admin/generate endpoint.
+var errNoGenerator = errors.New("server does not support /admin/generate")
+
+// keyRun is the keys prefix{start}..prefix{start+count-1}.
+type keyRun struct {
+	prefix string
+	start  int
+	count  int
+}
+
+// keyRuns groups keys into runs of consecutive numeric suffixes, which is
+// what the server-side generator can produce. ok is false if any key has
+// no plain decimal suffix.
+func keyRuns(keys []string) (runs []keyRun, ok bool) {
+	byPrefix := make(map[string][]int)
+	var prefixes []string
+	for _, k := range keys {
+		digits := len(k) - len(strings.TrimRight(k, "0123456789"))
+		n, err := strconv.Atoi(k[len(k)-digits:])
+		if digits == 0 || err != nil || strconv.Itoa(n) != k[len(k)-digits:] {
+			return nil, false
+		}
+		prefix := k[:len(k)-digits]
+		if _, seen := byPrefix[prefix]; !seen {
+			prefixes = append(prefixes, prefix)
+		}
+		byPrefix[prefix] = append(byPrefix[prefix], n)
+	}
+	for _, prefix := range prefixes {
+		nums := byPrefix[prefix]
+		slices.Sort(nums)
+		nums = slices.Compact(nums)
+		run := keyRun{prefix: prefix, start: nums[0], count: 1}
+		for _, n := range nums[1:] {
+			if n == run.start+run.count {
+				run.count++
+				continue
+			}
+			runs = append(runs, run)
+			run = keyRun{prefix: prefix, start: n, count: 1}
+		}
+		runs = append(runs, run)
+	}
+	return runs, true
+}
+
+type generateProgress struct {
+	Inserted  int    `json:"inserted"`
+	Total     int    `json:"total"`
+	Cached    int    `json:"cached"`
+	Done      bool   `json:"done"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+	Error     string `json:"error"`
+}
+
+// primeServerSide asks the server to generate primeValue(key) for every key,
+// one request per run. It returns errNoGenerator when the endpoint is
+// missing so the caller can fall back to priming over the wire.
+func primeServerSide(cfg *workerConfig, target string, keys []string) error {
+	runs, ok := keyRuns(keys)
+	if !ok {
+		return fmt.Errorf("keys are not numbered ranges: %w", errNoGenerator)
+	}
+	client := &http.Client{Transport: cfg.transport}
+	log.Printf("Priming %d keys server-side (%d ranges)", len(keys), len(runs))
+	start := time.Now()
+	for i, run := range runs {
+		if err := generateRun(cfg, client, target, run); err != nil {
+			if i == 0 && errors.Is(err, errNoGenerator) {
+				return err
+			}
+			return fmt.Errorf("server-side priming of %s%d..%s%d failed: %w",
+				run.prefix, run.start, run.prefix, run.start+run.count-1, err)
+		}
+	}
+	log.Printf("Primed %d keys server-side in %s", len(keys), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func generateRun(cfg *workerConfig, client *http.Client, target string, run keyRun) error {
+	body, _ := json.Marshal(map[string]any{
+		"prefix":        run.prefix,
+		"start":         run.start,
+		"count":         run.count,
+		"value_content": "key",
+		"cache_fill":    cfg.cacheFill,
+	})
+	req, err := http.NewRequest("POST", target+"/admin/generate", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.adminToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainClose(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+		return errNoGenerator
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	var last generateProgress
+	printed := time.Now()
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		if err := json.Unmarshal(lines.Bytes(), &last); err != nil {
+			return fmt.Errorf("bad progress line %q: %w", lines.Text(), err)
+		}
+		if last.Error != "" {
+			return errors.New(last.Error)
+		}
+		if !cfg.quiet && !last.Done && time.Since(printed) >= 3*time.Second {
+			printed = time.Now()
+			fmt.Fprintf(os.Stderr, "Priming %s*: %d/%d keys (%.0f%%, %.0f keys/s)\n",
+				run.prefix, last.Inserted, last.Total, float64(last.Inserted)/float64(last.Total)*100,
+				float64(last.Inserted)/(float64(last.ElapsedMs)/1000+1e-9))
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	if !last.Done {
+		return fmt.Errorf("stream ended after %d of %d keys", last.Inserted, run.count)
+	}
+	return nil
+}
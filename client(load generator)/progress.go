@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+type progressPrinter struct {
+	every   time.Duration
+	inPlace bool
+	total   time.Duration
+	start   time.Time
+	last    time.Time
+	ticker  *time.Ticker
+
+	interval intervalStats
+	outage   *outageTracker
+
+	// With -live-dashboard, series keeps every point for the report, and
+	// dash is set when stdout is a terminal to draw them on.
+	dashboard bool
+	series    []intervalPoint
+	dash      *liveDashboard
+}
+
+// newProgressPrinter returns nil when progress is disabled. Without an
+// explicit interval it rewrites a single status line once a second on a
+// terminal and falls back to one line every five seconds otherwise. With
+// dashboard, it takes a point every second and draws the live dashboard
+// on stdout, or prints one line per point if stdout is not a terminal.
+func newProgressPrinter(quiet, dashboard bool, every, total time.Duration, start time.Time) *progressPrinter {
+	if quiet {
+		return nil
+	}
+	p := &progressPrinter{every: every, total: total, start: start, last: start, interval: newIntervalStats(), dashboard: dashboard}
+	if dashboard {
+		p.every = time.Second
+		if stdoutIsTerminal() {
+			p.dash = &liveDashboard{}
+		}
+		return p
+	}
+	if every <= 0 {
+		if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			p.every = time.Second
+			p.inPlace = true
+		} else {
+			p.every = 5 * time.Second
+		}
+	}
+	return p
+}
+
+// ticks returns the channel driving print; it is nil, and so never ready,
+// when progress is disabled.
+func (p *progressPrinter) ticks() <-chan time.Time {
+	if p == nil {
+		return nil
+	}
+	p.ticker = time.NewTicker(p.every)
+	return p.ticker.C
+}
+
+func (p *progressPrinter) print(workers []*aggregator, now time.Time) {
+	window := now.Sub(p.last)
+	p.last = now
+
+	iv := &p.interval
+	iv.reset()
+	var requests int64
+	for _, w := range workers {
+		requests += w.takeInterval(iv)
+	}
+	pt := newIntervalPoint(iv, now.Sub(p.start), window)
+	if p.dashboard {
+		p.series = append(p.series, pt)
+	}
+	line := fmt.Sprintf("[%s/%s] requests=%d  rate=%.0f req/s  errors=%.2f%%  p99=%.2f ms",
+		now.Sub(p.start).Round(time.Second), p.total, requests, pt.Rps, pt.ErrorRatePct, pt.P99Ms)
+	if pt.HitRatePct != nil && p.dash == nil {
+		line += fmt.Sprintf("  hit=%.1f%%", *pt.HitRatePct)
+	}
+	if down := p.outage.since(now); down > 0 {
+		line += fmt.Sprintf("  OUTAGE for %s", down.Round(100*time.Millisecond))
+	}
+
+	switch {
+	case p.dash != nil:
+		p.dash.render(p.series, line)
+	case p.inPlace:
+		fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+	default:
+		fmt.Fprintln(os.Stderr, line)
+	}
+}
+
+func (p *progressPrinter) finish() {
+	if p == nil {
+		return
+	}
+	p.ticker.Stop()
+	if p.inPlace {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceHeader starts every -record file. Each following line is one
+// operation, tab-separated:
+//
+//	offset_us  worker  method  key  value_bytes  status  latency_us
+//
+// offset_us is when the operation was sent, relative to the start of the
+// run; value_bytes is the body sent by a PUT or received by a GET; status
+// is 0 when no response arrived. Lines are in completion order.
+//
+// A second comment line gives the start of the run in local time and,
+// when the server's clock could be estimated, in server time:
+//
+//	# start 2006-01-02T15:04:05.999999999Z07:00 server 2006-01-02T15:04:05.999999999Z07:00 uncertainty_us 120
+const traceHeader = "# kvload trace v1"
+
+// recorder appends operations to the trace through one buffered writer.
+// The lock is held only for formatting a line into the buffer.
+type recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	start time.Time
+	err   error
+}
+
+func newRecorder(path string) (*recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &recorder{f: f, w: bufio.NewWriterSize(f, 256<<10)}
+	fmt.Fprintln(r.w, traceHeader)
+	return r, nil
+}
+
+func (r *recorder) begin(start time.Time, clock *clockSync) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.start = start
+	line := "# start " + start.Format(time.RFC3339Nano)
+	if st := clock.serverTime(start); st != nil {
+		line += fmt.Sprintf(" server %s uncertainty_us %d", st.Format(time.RFC3339Nano), clock.uncertainty.Microseconds())
+	}
+	_, r.err = fmt.Fprintln(r.w, line)
+}
+
+func (r *recorder) record(worker int, op operation, out outcome, sent time.Time, latency time.Duration, pathPrefix string) {
+	if r == nil {
+		return
+	}
+	size := int64(len(op.body))
+	if op.method == "GET" {
+		size = out.bodySize
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	_, r.err = fmt.Fprintf(r.w, "%d\t%d\t%s\t%s\t%d\t%d\t%d\n",
+		sent.Sub(r.start).Microseconds(), worker, op.method, traceKey(op.url, pathPrefix),
+		size, out.status, latency.Microseconds())
+}
+
+func (r *recorder) Close() error {
+	if err := r.w.Flush(); r.err == nil {
+		r.err = err
+	}
+	if err := r.f.Close(); r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+// traceKey is the key in an operation URL base + pathPrefix + key, so the
+// trace does not depend on the target it was recorded against.
+func traceKey(url, pathPrefix string) string {
+	_, rest, _ := strings.Cut(url, "://")
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest = rest[i:]
+	}
+	return strings.TrimPrefix(rest, pathPrefix)
+}
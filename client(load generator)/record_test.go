@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRecordMatchesServer runs a mixed workload from several workers with
+// -record, and checks the trace holds exactly the operations the server
+// saw, per method and key.
+func TestRecordMatchesServer(t *testing.T) {
+	var mu sync.Mutex
+	served := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		served[r.Method+" "+strings.TrimPrefix(r.URL.Path, "/kv/")]++
+		mu.Unlock()
+		io.WriteString(w, "value")
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "ops.log")
+	rec, err := newRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &workerConfig{
+		workload:      "mixed",
+		readTargets:   []string{ts.URL},
+		writeTargets:  []string{ts.URL},
+		pathPrefix:    "/kv/",
+		keysPerClient: 50,
+		allClients:    4,
+		opTimeout:     time.Second,
+		seed:          1,
+		recorder:      rec,
+	}
+	start := time.Now()
+	rec.begin(start, nil)
+	var wg sync.WaitGroup
+	for id := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rq := newRequester(&http.Client{}, cfg)
+			keys := &workerKeys{id: id, rng: cfg.rng(id)}
+			for range 200 {
+				sent := time.Now()
+				op := nextOperation(cfg, keys)
+				out := op.execute(rq, cfg, nil)
+				cfg.recorder.record(id, op, out, sent, time.Since(sent), cfg.pathPrefix)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() || sc.Text() != traceHeader {
+		t.Fatalf("first line %q, want %q", sc.Text(), traceHeader)
+	}
+	if !sc.Scan() || !strings.HasPrefix(sc.Text(), "# start "+start.Format(time.RFC3339Nano)) {
+		t.Fatalf("second line %q, want the start of the run", sc.Text())
+	}
+	recorded := make(map[string]int)
+	lines := 0
+	for sc.Scan() {
+		var offset, latency, size int64
+		var worker, status int
+		var method, key string
+		if _, err := fmt.Sscanf(sc.Text(), "%d\t%d\t%s\t%s\t%d\t%d\t%d", &offset, &worker, &method, &key, &size, &status, &latency); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		if offset < 0 || worker < 0 || worker >= 4 || status != http.StatusOK || latency < 0 {
+			t.Errorf("line %q out of range", sc.Text())
+		}
+		if method == "GET" && size != int64(len("value")) {
+			t.Errorf("GET line %q: value_bytes %d, want the %d received", sc.Text(), size, len("value"))
+		}
+		recorded[method+" "+key]++
+		lines++
+	}
+	if lines != 4*200 {
+		t.Errorf("%d operations recorded, want %d", lines, 4*200)
+	}
+	for op, n := range served {
+		if recorded[op] != n {
+			t.Errorf("%s: served %d times, recorded %d", op, n, recorded[op])
+		}
+	}
+	if len(recorded) != len(served) {
+		t.Errorf("%d distinct operations recorded, %d served", len(recorded), len(served))
+	}
+}
+
+func TestTraceKey(t *testing.T) {
+	for url, want := range map[string]string{
+		"http://localhost:8080/kv/key-1-2": "key-1-2",
+		"http://h/cache/k":                 "/cache/k",
+	} {
+		if got := traceKey(url, "/kv/"); got != want {
+			t.Errorf("traceKey(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
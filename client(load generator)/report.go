@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type latencySummary struct {
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	P999Ms float64 `json:"p999_ms"`
+	MaxMs  float64 `json:"max_ms"`
+
+	// Samples is how many latencies the percentiles come from. The
+	// intervals are approximate 95% confidence intervals of the
+	// percentiles, unset when too few samples lie beyond one to bound it.
+	Samples int64     `json:"samples,omitempty"`
+	P50CI   *interval `json:"p50_ci_ms,omitempty"`
+	P90CI   *interval `json:"p90_ci_ms,omitempty"`
+	P99CI   *interval `json:"p99_ci_ms,omitempty"`
+	P999CI  *interval `json:"p999_ci_ms,omitempty"`
+}
+
+type errorBreakdown struct {
+	Timeout    int64 `json:"timeout"`
+	Connection int64 `json:"connection"`
+	HTTP       int64 `json:"http"`
+	Request    int64 `json:"request"`
+	Quota      int64 `json:"quota"`
+}
+
+type Report struct {
+	RunID       string            `json:"run_id,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Workload    string            `json:"workload"`
+	Clients     int               `json:"clients"`
+	DurationSec float64           `json:"duration_sec"`
+	Interrupted bool              `json:"interrupted"`
+	Keyspace    int64             `json:"keyspace,omitempty"`
+	Transport   string            `json:"transport"`
+	Seed        int64             `json:"seed,omitempty"`
+	// Keys is nil unless the keys were named by -key-template.
+	Keys *keyTemplateReport `json:"key_template,omitempty"`
+
+	// Client is the load generator's own build; Server is nil for servers
+	// without GET /version.
+	Client buildInfo   `json:"client"`
+	Server *serverInfo `json:"server,omitempty"`
+
+	// Start is when the run started on the client's clock and, with a
+	// clock estimate, on the server's, so the per-second series (offsets
+	// from Start) can be overlaid on the server's logs.
+	Start       time.Time        `json:"start"`
+	StartServer *time.Time       `json:"start_server,omitempty"`
+	ClockSync   *clockSyncReport `json:"clock_sync,omitempty"`
+
+	Protocols   map[string]int64 `json:"protocols"`
+	Connections int64            `json:"connections_opened"`
+	// Reused counts requests sent on a pooled keep-alive connection.
+	Reused int64 `json:"connections_reused"`
+
+	// ClientGC is the load generator's own garbage collection during the
+	// run.
+	ClientGC *clientGCReport `json:"client_gc,omitempty"`
+
+	TotalRequests int64   `json:"total_requests"`
+	Success       int64   `json:"success"`
+	Failed        int64   `json:"failed"`
+	ErrorRatePct  float64 `json:"error_rate_pct"`
+
+	Errors     errorBreakdown `json:"errors"`
+	Retries    int64          `json:"retries"`
+	RetriedOps int64          `json:"retried_ops"`
+
+	Throughput   float64 `json:"throughput_rps"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+
+	CacheHitRatePct *float64 `json:"cache_hit_rate_pct,omitempty"`
+
+	// Bytes count request and response bodies, not headers.
+	BytesSent     int64            `json:"bytes_sent"`
+	BytesReceived int64            `json:"bytes_received"`
+	MBpsOut       float64          `json:"mb_per_sec_out"`
+	MBpsIn        float64          `json:"mb_per_sec_in"`
+	ValueSizes    *valueSizeReport `json:"value_sizes,omitempty"`
+
+	// ProtocolViolations are only checked with -strict and are counted
+	// separately from errors.
+	Strict             bool                `json:"strict,omitempty"`
+	ProtocolViolations []protocolViolation `json:"protocol_violations,omitempty"`
+
+	TargetRate  float64 `json:"target_rate_rps,omitempty"`
+	ThinkTime   string  `json:"think_time,omitempty"`
+	ThinkDist   string  `json:"think_time_dist,omitempty"`
+	OfferedLoad float64 `json:"offered_load_rps,omitempty"`
+
+	// ServiceTime is measured from the actual send; ResponseTime, present
+	// only with a target rate, from the intended send on the schedule.
+	ServiceTime  latencySummary  `json:"service_time"`
+	ResponseTime *latencySummary `json:"response_time,omitempty"`
+	// SampleWarnings name the percentiles of the latency the SLA checks
+	// judge by that rest on too few samples.
+	SampleWarnings []string `json:"sample_warnings,omitempty"`
+	// Series has one point per second, with -live-dashboard.
+	Series []intervalPoint `json:"series,omitempty"`
+	// Backpressure is set with -respect-backpressure.
+	Backpressure *backpressureReport `json:"backpressure,omitempty"`
+	// ServerTiming splits GET latency by stage, with -server-timing.
+	ServerTiming *serverTimingReport `json:"server_timing,omitempty"`
+
+	Coherence   *coherenceReport   `json:"coherence,omitempty"`
+	TTL         *ttlReport         `json:"ttl,omitempty"`
+	DeleteChurn *deleteChurnReport `json:"churn_delete,omitempty"`
+	Churn       *churnReport       `json:"churn,omitempty"`
+	Outage      *outageReport      `json:"outage,omitempty"`
+	Tenants     []tenantReport     `json:"tenants,omitempty"`
+	Pools       []poolReport       `json:"pools,omitempty"`
+
+	// AutoTune is the -auto-tune search; the rest of the report is its
+	// confirmation run.
+	AutoTune *autoTuneReport `json:"auto_tune,omitempty"`
+
+	// Joiners lists the load generators of a -coordinator run.
+	Joiners []joinerReport `json:"joiners,omitempty"`
+
+	Baseline *baselineComparison `json:"baseline,omitempty"`
+
+	Violations []string `json:"violations,omitempty"`
+}
+
+func (r *Report) setStart(start time.Time, clock *clockSync) {
+	r.Start = start.Round(0)
+	r.StartServer = clock.serverTime(start)
+	r.ClockSync = clock.report()
+}
+
+func (r *Report) Print() {
+	fmt.Println("\n===================================")
+	fmt.Println("       LOAD TEST RESULTS")
+	fmt.Println("===================================")
+	if r.RunID != "" {
+		fmt.Printf("Run ID:              %s\n", r.RunID)
+	}
+	if len(r.Labels) > 0 {
+		fmt.Printf("Labels:              %s\n", labelFlag(r.Labels))
+	}
+	fmt.Printf("Workload:            %s\n", r.Workload)
+	fmt.Printf("Active Clients:      %d\n", r.Clients)
+	fmt.Printf("Duration:            %s\n", time.Duration(r.DurationSec*float64(time.Second)).Round(time.Millisecond))
+	if r.Interrupted {
+		fmt.Println("Interrupted:         yes")
+	}
+	fmt.Printf("Transport:           %s\n", r.Transport)
+	if r.Seed != 0 {
+		fmt.Printf("Seed:                %d\n", r.Seed)
+	}
+	if c := r.ClockSync; c != nil {
+		fmt.Printf("Server clock:        %+.3f ms ± %.3f ms (min RTT %.3f ms over %d samples)\n", c.OffsetMs, c.UncertaintyMs, c.MinRTTMs, c.Samples)
+	}
+	fmt.Printf("Client version:      %s\n", &r.Client)
+	if r.Server != nil {
+		fmt.Printf("Server version:      %s (%s)\n", r.Server.Version, strings.Join(r.Server.Features, ", "))
+		if r.Server.Build != nil {
+			fmt.Printf("Server build:        %s\n", r.Server.Build)
+		}
+	}
+	protos := make([]string, 0, len(r.Protocols))
+	for p := range r.Protocols {
+		protos = append(protos, p)
+	}
+	sort.Strings(protos)
+	for _, p := range protos {
+		fmt.Printf("Protocol:            %s (%d responses)\n", p, r.Protocols[p])
+	}
+	fmt.Printf("Connections opened:  %d\n", r.Connections)
+	if n := r.Connections + r.Reused; n > 0 {
+		fmt.Printf("Connection reuse:    %.1f%% of requests (%d reused)\n", float64(r.Reused)/float64(n)*100, r.Reused)
+	}
+	if r.ClientGC != nil {
+		fmt.Printf("Client GC:           %s\n", r.ClientGC)
+	}
+	if r.Keyspace > 0 {
+		fmt.Printf("Keyspace:            %d keys\n", r.Keyspace)
+	}
+	if r.Keys != nil {
+		fmt.Printf("Key template:        %s\n", r.Keys)
+	}
+	fmt.Println("-----------------------------------")
+	fmt.Printf("Total Requests:      %d\n", r.TotalRequests)
+	fmt.Printf("Success:             %d\n", r.Success)
+	fmt.Printf("Failed:              %d\n", r.Failed)
+	fmt.Printf("Error Rate:          %.2f%%\n", r.ErrorRatePct)
+	if r.Failed > 0 {
+		fmt.Printf("  Timeouts:          %d\n", r.Errors.Timeout)
+		fmt.Printf("  Connection:        %d\n", r.Errors.Connection)
+		fmt.Printf("  HTTP 4xx/5xx:      %d\n", r.Errors.HTTP)
+		if r.Errors.Quota > 0 {
+			fmt.Printf("  Quota (507):       %d\n", r.Errors.Quota)
+		}
+		if r.Errors.Request > 0 {
+			fmt.Printf("  Request build:     %d\n", r.Errors.Request)
+		}
+	}
+	if r.Retries > 0 {
+		fmt.Printf("Retries:             %d (over %d operations)\n", r.Retries, r.RetriedOps)
+	}
+	fmt.Println("-----------------------------------")
+	fmt.Printf("THROUGHPUT:          %.2f reqs/sec\n", r.Throughput)
+	if r.TargetRate > 0 {
+		fmt.Printf("TARGET RATE:         %.2f reqs/sec\n", r.TargetRate)
+	}
+	if r.ThinkTime != "" {
+		fmt.Printf("THINK TIME:          %s (%s)\n", r.ThinkTime, r.ThinkDist)
+		fmt.Printf("OFFERED LOAD:        %.2f reqs/sec\n", r.OfferedLoad)
+	}
+	fmt.Printf("AVG RESPONSE TIME:   %.2f ms\n", r.AvgLatencyMs)
+	if r.ResponseTime != nil {
+		fmt.Println("Service time (actual send -> completion):")
+		printLatency(r.ServiceTime)
+		fmt.Println("Response time (intended send -> completion, CO-corrected):")
+		printLatency(*r.ResponseTime)
+	} else {
+		printLatency(r.ServiceTime)
+	}
+	for _, w := range r.SampleWarnings {
+		fmt.Printf("WARNING: %s\n", w)
+	}
+	if r.CacheHitRatePct != nil {
+		fmt.Printf("CACHE HIT RATE:      %.2f%%\n", *r.CacheHitRatePct)
+	}
+	fmt.Printf("BANDWIDTH:           %.2f MB/s out, %.2f MB/s in\n", r.MBpsOut, r.MBpsIn)
+	if v := r.ValueSizes; v != nil {
+		fmt.Printf("Value sizes (GET):   mean %.0f B, p50/p90/p99 <= %d / %d / %d B, max %d B\n",
+			v.MeanBytes, v.P50Bytes, v.P90Bytes, v.P99Bytes, v.MaxBytes)
+	}
+	if r.Backpressure != nil {
+		r.Backpressure.print()
+	}
+	if r.ServerTiming != nil {
+		r.ServerTiming.print()
+	}
+	if c := r.Churn; c != nil {
+		fmt.Println("-----------------------------------")
+		fmt.Printf("CHURN (%d hot keys, %s, every %s):\n", c.HotKeys, c.KeyDist, c.Interval)
+		fmt.Printf("Churn events:        %d\n", c.Events)
+		fmt.Printf("Recovered >= %.0f%%:   %d\n", c.RecoverHitRate, c.Recovered)
+		if c.Recovered > 0 {
+			fmt.Printf("Time to recover:     avg %.0f ms, max %.0f ms\n", c.AvgRecoveryMs, c.MaxRecoveryMs)
+		}
+	}
+	if o := r.Outage; o != nil {
+		fmt.Println("-----------------------------------")
+		fmt.Printf("OUTAGES:             %d\n", len(o.Outages))
+		for i, w := range o.Outages {
+			end := "end of run"
+			if w.End != nil {
+				end = w.End.UTC().Format("15:04:05.000")
+			}
+			fmt.Printf("  #%d %s -> %s UTC (at +%.1fs): down %.0f ms, %d failed requests\n",
+				i+1, w.Start.UTC().Format("15:04:05.000"), end, w.StartOffsetMs/1000, w.DowntimeMs, w.FailedRequests)
+			switch {
+			case w.RecoveryMs != nil:
+				fmt.Printf("     back to 95%% of %.0f req/s %.0f ms after the outage\n", w.PreOutageRps, *w.RecoveryMs)
+			case w.End != nil:
+				fmt.Printf("     never back to 95%% of %.0f req/s\n", w.PreOutageRps)
+			}
+		}
+		if o.WorkersAffected > 0 {
+			fmt.Printf("Per-client downtime: avg %.0f ms, max %.0f ms (%d clients affected)\n",
+				o.WorkerDowntimeAvgMs, o.WorkerDowntimeMaxMs, o.WorkersAffected)
+		}
+		if o.Backup != "" {
+			fmt.Printf("Failover:            %d to %s, %d back, %d requests on the backup\n",
+				o.Failovers, o.Backup, o.Failbacks, o.BackupRequests)
+		}
+	}
+	for _, t := range r.Tenants {
+		fmt.Println("-----------------------------------")
+		fmt.Printf("TENANT %s (%s*, %d clients, %d keys, %.0f%% reads):\n", t.Name, t.Prefix, t.Clients, t.Keys, t.ReadPct)
+		fmt.Printf("Requests:            %d (%d failed)\n", t.Requests, t.Failed)
+		fmt.Printf("Throughput:          %.2f reqs/sec\n", t.Throughput)
+		if t.CacheHitRatePct != nil {
+			fmt.Printf("Cache hit rate:      %.2f%%\n", *t.CacheHitRatePct)
+		}
+		printLatency(t.ServiceTime)
+	}
+	for _, p := range r.Pools {
+		fmt.Println("-----------------------------------")
+		fmt.Printf("POOL %s (%d clients, %s keys", p.Name, p.Clients, p.KeyPolicy)
+		if p.ReadLagMs > 0 {
+			fmt.Printf(", %s behind", time.Duration(p.ReadLagMs*float64(time.Millisecond)))
+		}
+		if p.TargetRps > 0 {
+			fmt.Printf(", target %.0f reqs/sec", p.TargetRps)
+		}
+		fmt.Println("):")
+		fmt.Printf("Requests:            %d (%d failed)\n", p.Requests, p.Failed)
+		fmt.Printf("Throughput:          %.2f reqs/sec\n", p.Throughput)
+		if p.CacheHitRatePct != nil {
+			fmt.Printf("Cache hit rate:      %.2f%%\n", *p.CacheHitRatePct)
+		}
+		fmt.Printf("Connections opened:  %d (%d requests reused one)\n", p.Connections, p.Reused)
+		printLatency(p.ServiceTime)
+	}
+	if c := r.Coherence; c != nil {
+		fmt.Println("-----------------------------------")
+		fmt.Println("COHERENCE (write A -> visible on B):")
+		fmt.Printf("Writes:              %d\n", c.Writes)
+		fmt.Printf("Converged:           %d (avg %.1f reads)\n", c.Converged, c.AvgReads)
+		fmt.Printf("Never converged:     %d\n", c.NeverConverged)
+		printLatency(c.Convergence)
+		for _, k := range c.UnconvergedKeys {
+			fmt.Printf("  stale: %s\n", k)
+		}
+	}
+	if t := r.TTL; t != nil {
+		fmt.Println("-----------------------------------")
+		fmt.Println("TTL CORRECTNESS:")
+		fmt.Printf("Keys written:        %d\n", t.Writes)
+		fmt.Printf("Checks before/after: %d / %d\n", t.ChecksBefore, t.ChecksAfter)
+		fmt.Printf("Premature expiries:  %d\n", t.Premature)
+		fmt.Printf("Late expiries:       %d (tolerance %s)\n", t.Late, t.Tolerance)
+		if t.ClockOffsetMs != nil {
+			fmt.Printf("Server clock offset: %+.0f ms (from Date headers)\n", *t.ClockOffsetMs)
+		}
+		if t.ClockStepped {
+			fmt.Println("Clock stepped:       the Date headers disagree with the clock sync before the run")
+		}
+		for _, e := range t.Examples {
+			fmt.Printf("  violation: %s\n", e)
+		}
+	}
+	if d := r.DeleteChurn; d != nil {
+		fmt.Println("-----------------------------------")
+		fmt.Println("DELETE CORRECTNESS:")
+		fmt.Printf("Keys created:        %d\n", d.Keys)
+		fmt.Printf("Deletes:             %d confirmed, %d unconfirmed\n", d.Deletes, d.Unconfirmed)
+		fmt.Printf("Premature losses:    %d of %d reads before the delete (%.3f%%)\n", d.Premature, d.ReadsBefore, d.PrematurePct)
+		fmt.Printf("Resurrections:       %d of %d reads after the delete (%.3f%%)\n", d.Resurrected, d.ReadsAfter, d.ResurrectionPct)
+		if d.Premature > 0 {
+			for _, b := range d.BeforeDelete {
+				fmt.Printf("  %-17s  %d lost of %d (%.3f%%)\n", b.Window+" after PUT:", b.Violations, b.Reads, b.RatePct)
+			}
+		}
+		for _, b := range d.AfterDelete {
+			fmt.Printf("  %-17s  %d resurrected of %d (%.3f%%)\n", b.Window+" after:", b.Violations, b.Reads, b.RatePct)
+		}
+		for _, e := range d.Examples {
+			fmt.Printf("  violation: %s\n", e)
+		}
+	}
+	if r.AutoTune != nil {
+		r.AutoTune.print()
+	}
+	if len(r.Joiners) > 0 {
+		fmt.Println("-----------------------------------")
+		fmt.Printf("JOINERS:             %d\n", len(r.Joiners))
+		for _, j := range r.Joiners {
+			status := "ok"
+			if j.Error != "" {
+				status = "FAILED: " + j.Error + " (not in the totals above)"
+			}
+			fmt.Printf("  #%d %s: %d clients, %d requests, %s\n", j.ID, j.Host, j.Clients, j.Requests, status)
+		}
+	}
+	if r.Strict {
+		fmt.Println("-----------------------------------")
+		fmt.Printf("PROTOCOL VIOLATIONS: %d\n", r.protocolViolationCount())
+		for _, v := range r.ProtocolViolations {
+			fmt.Printf("  %s: %d\n", v.Check, v.Count)
+			for _, e := range v.Examples {
+				fmt.Printf("    e.g. %s\n", e)
+			}
+		}
+	}
+	if r.Baseline != nil {
+		r.Baseline.print()
+	}
+	if len(r.Violations) > 0 {
+		fmt.Println("-----------------------------------")
+		fmt.Println("SLA VIOLATIONS:")
+		for _, v := range r.Violations {
+			fmt.Printf("  - %s\n", v)
+		}
+	}
+	fmt.Println("===================================")
+}
+
+func (r *Report) protocolViolationCount() int64 {
+	var n int64
+	for _, v := range r.ProtocolViolations {
+		n += v.Count
+	}
+	return n
+}
+
+func printLatency(s latencySummary) {
+	fmt.Printf("P50 / P90:           %.2f %s / %.2f %s ms\n", s.P50Ms, s.P50CI, s.P90Ms, s.P90CI)
+	fmt.Printf("P99 / P99.9:         %.2f %s / %.2f %s ms\n", s.P99Ms, s.P99CI, s.P999Ms, s.P999CI)
+	fmt.Printf("MAX:                 %.2f ms\n", s.MaxMs)
+}
+
+func (r *Report) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+)
+
+// maxReusedRequests bounds the requests a worker keeps for reuse; keys
+// beyond it get a fresh request each time.
+const maxReusedRequests = 1024
+
+// requester sends a worker's operations without allocating in the steady
+// state. A request may be sent again once its response body is closed, so
+// one is kept per method and URL. Their shared context is cancelled by a
+// timer re-armed for each attempt instead of one context per request; only
+// a timeout, which cancels it for good, costs a new context and requests.
+type requester struct {
+	client  *http.Client
+	timeout time.Duration
+	header  http.Header
+	// timing asks the server for its timing of each GET.
+	timing bool
+	base   context.Context
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+	reqs   map[requestKey]*reusedRequest
+}
+
+type requestKey struct {
+	method, url string
+}
+
+type reusedRequest struct {
+	req   *http.Request
+	body  *reusedBody
+	value string
+}
+
+// reusedBody is a request body that can be rewound for the next attempt.
+// Closing it is a no-op; the request owns it.
+type reusedBody struct {
+	strings.Reader
+}
+
+func (b *reusedBody) Close() error { return nil }
+
+func newRequester(client *http.Client, cfg *workerConfig) *requester {
+	rq := &requester{client: client, timeout: cfg.opTimeout, header: make(http.Header), timing: cfg.serverTiming, base: context.Background()}
+	if cfg.runID != "" {
+		rq.header.Set("X-Run-ID", cfg.runID)
+	}
+	// Attach the connection trace once rather than per request.
+	if t, ok := client.Transport.(*trackingTransport); ok {
+		rq.base = httptrace.WithClientTrace(rq.base, t.trace)
+	}
+	rq.renew()
+	return rq
+}
+
+// renew replaces a context that timed out, and the requests built on it.
+func (rq *requester) renew() {
+	rq.ctx, rq.cancel = context.WithCancelCause(rq.base)
+	cancel := rq.cancel
+	rq.timer = time.AfterFunc(time.Hour, func() { cancel(context.DeadlineExceeded) })
+	rq.timer.Stop()
+	rq.reqs = make(map[requestKey]*reusedRequest)
+}
+
+func (rq *requester) request(op operation) (*http.Request, error) {
+	key := requestKey{op.method, op.url}
+	r, ok := rq.reqs[key]
+	if !ok {
+		r = &reusedRequest{}
+		var err error
+		if op.body != "" {
+			r.body = &reusedBody{}
+			if r.req, err = http.NewRequestWithContext(rq.ctx, op.method, op.url, r.body); err == nil {
+				// Lets the transport resend the body on a stale connection.
+				r.req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(r.value)), nil }
+			}
+		} else {
+			r.req, err = http.NewRequestWithContext(rq.ctx, op.method, op.url, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range rq.header {
+			r.req.Header[k] = v
+		}
+		if rq.timing && op.method == "GET" {
+			r.req.Header.Set("X-Timing", "true")
+		}
+		// The URL has the host; a Host of its own makes Do copy the URL.
+		r.req.Host = ""
+		if len(rq.reqs) < maxReusedRequests {
+			rq.reqs[key] = r
+		}
+	}
+	if r.body != nil {
+		r.value = op.body
+		r.body.Reset(op.body)
+		r.req.Body = r.body
+		r.req.ContentLength = int64(len(op.body))
+	}
+	return r.req, nil
+}
+
+// Do sends req straight to the transport. The server never redirects and
+// the workers keep no cookies, so the client only adds copies of the URL
+// and the headers kept for redirects.
+func (rq *requester) Do(req *http.Request) (*http.Response, error) {
+	if rq.client.Transport == nil {
+		return rq.client.Do(req)
+	}
+	return rq.client.Transport.RoundTrip(req)
+}
+
+// attempt is operation.attempt on the worker's reused requests.
+func (rq *requester) attempt(op operation, strict bool) outcome {
+	req, err := rq.request(op)
+	if err != nil {
+		return outcome{class: errRequest}
+	}
+	rq.timer.Reset(rq.timeout)
+	out := op.send(rq, req, strict)
+	if !rq.timer.Stop() {
+		rq.renew()
+	}
+	return out
+}
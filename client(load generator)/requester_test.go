@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubTransport answers every request with the same response, rewound,
+// so the only allocations left are the load generator's own.
+type stubTransport struct {
+	resp *http.Response
+	body *stubBody
+	text string
+}
+
+type stubBody struct {
+	strings.Reader
+}
+
+func (b *stubBody) Close() error { return nil }
+
+func newStubTransport(body string) *stubTransport {
+	t := &stubTransport{body: &stubBody{}, text: body}
+	t.resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-Cache": {"HIT"}},
+		Body:       t.body,
+	}
+	return t
+}
+
+func (t *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+	}
+	t.body.Reset(t.text)
+	t.resp.Request = req
+	return t.resp, nil
+}
+
+func stubWorker(workload string) (*workerConfig, *requester, *workerKeys) {
+	cfg := &workerConfig{
+		workload:      workload,
+		readTargets:   []string{"http://stub"},
+		writeTargets:  []string{"http://stub"},
+		pathPrefix:    "/kv/",
+		keysPerClient: 100,
+		allClients:    1,
+		opTimeout:     time.Second,
+		seed:          1,
+	}
+	rq := newRequester(&http.Client{Transport: newStubTransport("data-key-1")}, cfg)
+	return cfg, rq, &workerKeys{rng: cfg.rng(0)}
+}
+
+// issue is one turn of runClient's loop for the plain workloads: pick the
+// operation, send it with retries, and record its latency.
+func issue(cfg *workerConfig, rq *requester, keys *workerKeys, h *histogram) {
+	start := time.Now()
+	op := nextOperation(cfg, keys)
+	out := op.execute(rq, cfg, nil)
+	if out.class == errNone {
+		h.record(time.Since(start))
+	}
+}
+
+func BenchmarkIssueLoop(b *testing.B) {
+	for _, workload := range []string{"get-popular", "get-all", "put-all"} {
+		b.Run("workload="+workload, func(b *testing.B) {
+			cfg, rq, keys := stubWorker(workload)
+			h := newHistogram()
+			b.ReportAllocs()
+			for range b.N {
+				issue(cfg, rq, keys, h)
+			}
+		})
+	}
+}
+
+func TestGetPopularLoopAllocs(t *testing.T) {
+	cfg, rq, keys := stubWorker("get-popular")
+	h := newHistogram()
+	// Warm up, so each popular key's URL and request exist.
+	for range 100 {
+		issue(cfg, rq, keys, h)
+	}
+	if n := testing.AllocsPerRun(1000, func() { issue(cfg, rq, keys, h) }); n > 0 {
+		t.Errorf("get-popular allocates %.1f times per operation in the steady state", n)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// newRunID returns a random (version 4) UUID.
+func newRunID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// labelFlag collects -label key=value flags. Its String form, a comma
+// separated list, is accepted by Set too so the labels reach the joiners
+// of a distributed run.
+type labelFlag map[string]string
+
+func (l labelFlag) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + l[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l labelFlag) Set(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("want key=value, got %q", pair)
+		}
+		l[k] = v
+	}
+	return nil
+}
+
+// runIDTransport adds X-Run-ID to every request so the server can tell
+// the runs apart in its logs.
+type runIDTransport struct {
+	base  http.RoundTripper
+	runID string
+}
+
+func (t *runIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	// Workers set the header themselves, sparing the clone; the canonical
+	// spelling spares Get an allocation.
+	if req.Header.Get("X-Run-Id") != t.runID {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Run-ID", t.runID)
+	}
+	return base.RoundTrip(req)
+}
+
+type runMarker struct {
+	RunID  string            `json:"run_id"`
+	Event  string            `json:"event"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// sendRunMarkers tells every target that the run starts or stops. Servers
+// without the run-markers feature are skipped; failures are only logged.
+func sendRunMarkers(cfg *workerConfig, event string) {
+	if !cfg.server.has("run-markers") {
+		return
+	}
+	body, _ := json.Marshal(runMarker{RunID: cfg.runID, Event: event, Labels: cfg.labels})
+	client := &http.Client{Timeout: 5 * time.Second, Transport: cfg.transport}
+	var sent []string
+	for _, target := range slices.Concat(cfg.targets, cfg.readTargets, cfg.writeTargets) {
+		if slices.Contains(sent, target) {
+			continue
+		}
+		sent = append(sent, target)
+		req, err := http.NewRequest("POST", target+"/admin/run-marker", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Cannot send run %s marker to %s: %v", event, target, err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if cfg.adminToken != "" {
+			req.Header.Set("Authorization", "Bearer "+cfg.adminToken)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Cannot send run %s marker to %s: %v", event, target, err)
+			continue
+		}
+		drainClose(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("Run %s marker rejected by %s: HTTP %d", event, target, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serverTiming is what a server asked with X-Timing: true reports about a
+// GET, from its headers or, for streamed values, its trailers.
+type serverTiming struct {
+	ok               bool
+	cache, db, total time.Duration
+}
+
+// parseServerTiming reads the timing of resp, whose body must have been
+// read to the end for its trailers to be there.
+func parseServerTiming(resp *http.Response) serverTiming {
+	h := resp.Header
+	if h.Get("X-Timing-Total-us") == "" {
+		h = resp.Trailer
+	}
+	var t serverTiming
+	var errs [3]error
+	t.cache, errs[0] = parseMicros(h.Get("X-Timing-Cache-us"))
+	t.db, errs[1] = parseMicros(h.Get("X-Timing-DB-us"))
+	t.total, errs[2] = parseMicros(h.Get("X-Timing-Total-us"))
+	t.ok = errs[0] == nil && errs[1] == nil && errs[2] == nil
+	return t
+}
+
+func parseMicros(s string) (time.Duration, error) {
+	us, err := strconv.ParseInt(s, 10, 64)
+	return time.Duration(us) * time.Microsecond, err
+}
+
+// timingStats aggregates the server timing of GETs answered without a
+// retry, whose client latency is that of the one timed request.
+type timingStats struct {
+	cache, db, total *histogram
+	// overhead is the client latency minus the server total: the network
+	// and the client's own time.
+	overhead *histogram
+	// inconsistent counts responses whose stages add up to more than
+	// their total, or whose total exceeds the client latency. The server
+	// rounds each down to a microsecond, so 2µs of slack is allowed.
+	inconsistent int64
+	examples     []string
+}
+
+const timingSlack = 2 * time.Microsecond
+
+func newTimingStats() timingStats {
+	return timingStats{cache: newHistogram(), db: newHistogram(), total: newHistogram(), overhead: newHistogram()}
+}
+
+func (s *timingStats) record(t serverTiming, client time.Duration) {
+	s.cache.record(t.cache)
+	s.db.record(t.db)
+	s.total.record(t.total)
+	s.overhead.record(max(client-t.total, 0))
+	if t.cache+t.db > t.total+timingSlack || t.total > client+timingSlack {
+		s.inconsistent++
+		if len(s.examples) < 5 {
+			s.examples = append(s.examples, fmt.Sprintf("cache %s + db %s, total %s, client %s", t.cache, t.db, t.total, client.Round(time.Microsecond)))
+		}
+	}
+}
+
+func (s *timingStats) merge(o *timingStats) {
+	s.cache.merge(o.cache)
+	s.db.merge(o.db)
+	s.total.merge(o.total)
+	s.overhead.merge(o.overhead)
+	s.inconsistent += o.inconsistent
+	for _, e := range o.examples {
+		if len(s.examples) < 5 {
+			s.examples = append(s.examples, e)
+		}
+	}
+}
+
+type serverTimingReport struct {
+	Samples int64          `json:"samples"`
+	Cache   latencySummary `json:"cache"`
+	DB      latencySummary `json:"db"`
+	Total   latencySummary `json:"server_total"`
+	// Overhead is the client-observed latency minus the server total.
+	Overhead     latencySummary `json:"network_client_overhead"`
+	Inconsistent int64          `json:"inconsistent,omitempty"`
+	Examples     []string       `json:"inconsistent_examples,omitempty"`
+}
+
+func (s *timingStats) report() *serverTimingReport {
+	return &serverTimingReport{
+		Samples:      s.total.count(),
+		Cache:        s.cache.summary(),
+		DB:           s.db.summary(),
+		Total:        s.total.summary(),
+		Overhead:     s.overhead.summary(),
+		Inconsistent: s.inconsistent,
+		Examples:     s.examples,
+	}
+}
+
+func (t *serverTimingReport) print() {
+	fmt.Println("-----------------------------------")
+	fmt.Printf("SERVER TIMING (%d GETs):\n", t.Samples)
+	for _, stage := range []struct {
+		name string
+		s    latencySummary
+	}{
+		{"Cache", t.Cache},
+		{"DB", t.DB},
+		{"Server total", t.Total},
+		{"Network + client", t.Overhead},
+	} {
+		fmt.Printf("  %-18s p50 %.3f, p99 %.3f, max %.3f ms\n", stage.name+":", stage.s.P50Ms, stage.s.P99Ms, stage.s.MaxMs)
+	}
+	if t.Inconsistent > 0 {
+		fmt.Printf("Inconsistent:        %d (stages over the total, or the total over the client latency)\n", t.Inconsistent)
+		for _, e := range t.Examples {
+			fmt.Printf("  e.g. %s\n", e)
+		}
+	}
+}
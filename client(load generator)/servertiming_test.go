@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timingStub answers GETs with fixed stage timings, in trailers for
+// /kv/big, and records whether each request asked for them.
+func timingStub(asked map[string]bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked[r.Method] = r.Header.Get("X-Timing") == "true"
+		h := w.Header()
+		if r.URL.Path == "/kv/big" {
+			h.Set("Trailer", "X-Timing-Cache-us, X-Timing-DB-us, X-Timing-Total-us")
+			w.Write([]byte(strings.Repeat("v", 64<<10)))
+		}
+		h.Set("X-Timing-Cache-us", "3")
+		h.Set("X-Timing-DB-us", "400")
+		h.Set("X-Timing-Total-us", "450")
+		w.Write([]byte("v"))
+	}))
+}
+
+func TestServerTimingParsed(t *testing.T) {
+	asked := make(map[string]bool)
+	ts := timingStub(asked)
+	defer ts.Close()
+	rq := newRequester(&http.Client{}, &workerConfig{opTimeout: 5 * time.Second, serverTiming: true})
+
+	want := serverTiming{ok: true, cache: 3 * time.Microsecond, db: 400 * time.Microsecond, total: 450 * time.Microsecond}
+	for _, path := range []string{"/kv/k", "/kv/big"} {
+		if out := rq.attempt(operation{method: "GET", url: ts.URL + path}, false); out.timing != want {
+			t.Errorf("GET %s: timing %+v, want %+v", path, out.timing, want)
+		}
+	}
+	if !asked["GET"] {
+		t.Error("GET sent without X-Timing")
+	}
+	rq.attempt(operation{method: "PUT", url: ts.URL + "/kv/k", body: "v"}, false)
+	if asked["PUT"] {
+		t.Error("PUT sent with X-Timing")
+	}
+
+	// Off by default, and a response without the headers is not counted.
+	rq = newRequester(&http.Client{}, &workerConfig{opTimeout: 5 * time.Second})
+	rq.attempt(operation{method: "GET", url: ts.URL + "/kv/k"}, false)
+	if asked["GET"] {
+		t.Error("GET sent with X-Timing without -server-timing")
+	}
+	if got := parseServerTiming(&http.Response{Header: http.Header{}}); got.ok {
+		t.Errorf("timing of a response without it = %+v, want not ok", got)
+	}
+}
+
+func TestTimingStatsConsistency(t *testing.T) {
+	s := newTimingStats()
+	us := time.Microsecond
+	s.record(serverTiming{ok: true, cache: 10 * us, db: 80 * us, total: 100 * us}, 300*us)
+	// Rounding each stage down to a microsecond is within the slack.
+	s.record(serverTiming{ok: true, cache: 51 * us, db: 50 * us, total: 100 * us}, 101*us)
+	if s.inconsistent != 0 {
+		t.Fatalf("%d consistent timings flagged: %v", s.inconsistent, s.examples)
+	}
+	s.record(serverTiming{ok: true, cache: 60 * us, db: 60 * us, total: 100 * us}, 300*us)
+	s.record(serverTiming{ok: true, cache: 10 * us, db: 10 * us, total: 500 * us}, 300*us)
+	if s.inconsistent != 2 || len(s.examples) != 2 {
+		t.Errorf("%d inconsistent, %v; want the two over their total or the client latency", s.inconsistent, s.examples)
+	}
+
+	o := newTimingStats()
+	o.merge(&s)
+	r := o.report()
+	if r.Samples != 4 || r.Inconsistent != 2 {
+		t.Errorf("merged report %+v", r)
+	}
+	// Overhead is the client latency minus the server total, never negative.
+	if r.Overhead.MaxMs < 0.19 || r.Overhead.MaxMs > 0.21 {
+		t.Errorf("max overhead %.3fms, want 0.2ms", r.Overhead.MaxMs)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import "math/bits"
+
+// sizeHistogram counts byte sizes in power-of-two buckets: bucket i holds
+// sizes in [2^(i-1), 2^i), bucket 0 holds empty values.
+type sizeHistogram struct {
+	counts [65]int64
+	n      int64
+	sum    int64
+	max    int64
+}
+
+type sizeBucket struct {
+	UpToBytes int64 `json:"up_to_bytes"`
+	Count     int64 `json:"count"`
+}
+
+type valueSizeReport struct {
+	Count     int64        `json:"count"`
+	MeanBytes float64      `json:"mean_bytes"`
+	P50Bytes  int64        `json:"p50_bytes"`
+	P90Bytes  int64        `json:"p90_bytes"`
+	P99Bytes  int64        `json:"p99_bytes"`
+	MaxBytes  int64        `json:"max_bytes"`
+	Buckets   []sizeBucket `json:"buckets"`
+}
+
+func (h *sizeHistogram) record(size int64) {
+	h.counts[bits.Len64(uint64(size))]++
+	h.n++
+	h.sum += size
+	h.max = max(h.max, size)
+}
+
+func (h *sizeHistogram) merge(o *sizeHistogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.n += o.n
+	h.sum += o.sum
+	h.max = max(h.max, o.max)
+}
+
+// bucketLimit is the largest size bucket i can hold.
+func bucketLimit(i int) int64 {
+	if i == 0 {
+		return 0
+	}
+	if i >= 64 {
+		return 1<<63 - 1
+	}
+	return 1<<i - 1
+}
+
+// percentile returns the upper limit of the bucket holding the nearest-rank
+// value, clamped to the observed maximum.
+func (h *sizeHistogram) percentile(p float64) int64 {
+	rank := max(int64(float64(h.n)*p/100+0.5), 1)
+	var seen int64
+	for i, c := range h.counts {
+		if seen += c; seen >= rank {
+			return min(bucketLimit(i), h.max)
+		}
+	}
+	return h.max
+}
+
+func (h *sizeHistogram) report() *valueSizeReport {
+	if h.n == 0 {
+		return nil
+	}
+	r := &valueSizeReport{
+		Count:     h.n,
+		MeanBytes: float64(h.sum) / float64(h.n),
+		P50Bytes:  h.percentile(50),
+		P90Bytes:  h.percentile(90),
+		P99Bytes:  h.percentile(99),
+		MaxBytes:  h.max,
+	}
+	for i, c := range h.counts {
+		if c > 0 {
+			r.Buckets = append(r.Buckets, sizeBucket{UpToBytes: bucketLimit(i), Count: c})
+		}
+	}
+	return r
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// Exit codes are bit flags so a run violating several thresholds reports all
+// of them; 1 and 2 stay reserved for log.Fatal and flag parse errors, and
+// the bits stay below 128, which shells use for deaths by signal. So
+// exitCorrectness covers -strict protocol violations as well as the ttl
+// and churn-delete workloads' violations, exitInterrupted also covers a
+// distributed run that lost a joiner, and a -fail-on-regression failure
+// sets the bit of the metric that regressed.
+const (
+	exitErrorRate   = 1 << 2
+	exitP99         = 1 << 3
+	exitThroughput  = 1 << 4
+	exitInterrupted = 1 << 5
+	exitCorrectness = 1 << 6
+)
+
+type slaThresholds struct {
+	maxErrorRate  *float64
+	maxP99        *time.Duration
+	minThroughput *float64
+}
+
+func slaFromFlags(maxErrorRate *float64, maxP99 *time.Duration, minThroughput *float64) slaThresholds {
+	var t slaThresholds
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "max-error-rate":
+			t.maxErrorRate = maxErrorRate
+		case "max-p99":
+			t.maxP99 = maxP99
+		case "min-throughput":
+			t.minThroughput = minThroughput
+		}
+	})
+	return t
+}
+
+func (t slaThresholds) check(r *Report) (violations []string, code int) {
+	if t.maxErrorRate != nil && r.ErrorRatePct > *t.maxErrorRate {
+		violations = append(violations, fmt.Sprintf("error rate %.2f%% exceeds max %.2f%%", r.ErrorRatePct, *t.maxErrorRate))
+		code |= exitErrorRate
+	}
+	if t.maxP99 != nil {
+		p99 := time.Duration(r.latency().P99Ms * float64(time.Millisecond))
+		if p99 > *t.maxP99 {
+			violations = append(violations, fmt.Sprintf("p99 %s exceeds max %s", p99.Round(time.Microsecond), *t.maxP99))
+			code |= exitP99
+		}
+	}
+	if t.minThroughput != nil && r.Throughput < *t.minThroughput {
+		violations = append(violations, fmt.Sprintf("throughput %.2f reqs/sec below min %.2f", r.Throughput, *t.minThroughput))
+		code |= exitThroughput
+	}
+	if n := r.protocolViolationCount(); r.Strict && n > 0 {
+		violations = append(violations, fmt.Sprintf("%d protocol violations with -strict", n))
+		code |= exitCorrectness
+	}
+	if t := r.TTL; t != nil && t.Premature+t.Late > 0 {
+		violations = append(violations, fmt.Sprintf("%d premature and %d late TTL expirations", t.Premature, t.Late))
+		code |= exitCorrectness
+	}
+	if d := r.DeleteChurn; d != nil && d.Premature+d.Resurrected > 0 {
+		violations = append(violations, fmt.Sprintf("%d premature losses and %d resurrections of deleted keys", d.Premature, d.Resurrected))
+		code |= exitCorrectness
+	}
+	if a := r.AutoTune; a != nil {
+		switch {
+		case a.SustainableRate == 0 && !a.Interrupted:
+			violations = append(violations, fmt.Sprintf("auto-tune: p%g exceeds %.3f ms even at %.0f reqs/sec", a.Percentile, a.TargetMs, a.Windows[0].Rate))
+			code |= exitP99
+		case a.Confirmation != nil && !a.Confirmation.Pass:
+			violations = append(violations, fmt.Sprintf("auto-tune: confirmation at %.0f reqs/sec failed: %s", a.SustainableRate, a.Confirmation.Reason))
+			code |= exitP99
+		}
+	}
+	for _, j := range r.Joiners {
+		if j.Error != "" {
+			violations = append(violations, fmt.Sprintf("joiner %d (%s) failed: %s", j.ID, j.Host, j.Error))
+			code |= exitInterrupted
+		}
+	}
+	if r.Interrupted {
+		code |= exitInterrupted
+	}
+	return violations, code
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tenant is one class of clients in the tenants workload: share of the
+// clients, percentage of reads, and a keyspace of keys tenant<name>-<n>.
+type tenant struct {
+	name    string
+	share   float64
+	readPct float64
+	keys    int
+}
+
+func (t tenant) prefix() string {
+	return "tenant" + t.name + "-"
+}
+
+func (t tenant) key(n int) string {
+	return t.prefix() + strconv.Itoa(n)
+}
+
+// parseTenants parses "A:40%:read=95:keys=1000;B:60%:read=10:keys=1000000".
+// Shares are relative weights; read defaults to 50 and keys to 1000.
+func parseTenants(spec string) ([]tenant, error) {
+	var tenants []tenant
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ":")
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("tenant %q: want NAME:SHARE%%[:read=PCT][:keys=N]", part)
+		}
+		t := tenant{name: fields[0], readPct: 50, keys: 1000}
+		if seen[t.name] {
+			return nil, fmt.Errorf("tenant %q listed twice", t.name)
+		}
+		seen[t.name] = true
+
+		share, err := strconv.ParseFloat(strings.TrimSuffix(fields[1], "%"), 64)
+		if err != nil || share <= 0 {
+			return nil, fmt.Errorf("tenant %s: invalid share %q", t.name, fields[1])
+		}
+		t.share = share
+		for _, opt := range fields[2:] {
+			name, value, _ := strings.Cut(opt, "=")
+			switch name {
+			case "read":
+				t.readPct, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+				if err != nil || t.readPct < 0 || t.readPct > 100 {
+					return nil, fmt.Errorf("tenant %s: read must be a percentage, got %q", t.name, value)
+				}
+			case "keys":
+				t.keys, err = strconv.Atoi(value)
+				if err != nil || t.keys <= 0 {
+					return nil, fmt.Errorf("tenant %s: keys must be a positive integer, got %q", t.name, value)
+				}
+			default:
+				return nil, fmt.Errorf("tenant %s: unknown option %q", t.name, opt)
+			}
+		}
+		tenants = append(tenants, t)
+	}
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("-tenants lists no tenants")
+	}
+	return tenants, nil
+}
+
+// assignTenants gives each tenant a number of clients proportional to its
+// share (largest remainder, at least one each) and returns the tenant index
+// of every client.
+func assignTenants(tenants []tenant, clients int) ([]int, error) {
+	if clients < len(tenants) {
+		return nil, fmt.Errorf("%d tenants need at least as many -clients", len(tenants))
+	}
+	var total float64
+	for _, t := range tenants {
+		total += t.share
+	}
+	counts := make([]int, len(tenants))
+	remainders := make([]float64, len(tenants))
+	assigned := 0
+	for i, t := range tenants {
+		exact := t.share / total * float64(clients)
+		counts[i] = max(int(math.Floor(exact)), 1)
+		remainders[i] = exact - math.Floor(exact)
+		assigned += counts[i]
+	}
+	order := make([]int, len(tenants))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]] > remainders[order[b]] })
+	for i := 0; assigned < clients; i = (i + 1) % len(order) {
+		counts[order[i]]++
+		assigned++
+	}
+	for i := len(order) - 1; assigned > clients; i = (i - 1 + len(order)) % len(order) {
+		if counts[order[i]] > 1 {
+			counts[order[i]]--
+			assigned--
+		}
+	}
+
+	var byClient []int
+	for i, n := range counts {
+		for j := 0; j < n; j++ {
+			byClient = append(byClient, i)
+		}
+	}
+	return byClient, nil
+}
+
+func tenantKeys(tenants []tenant) []string {
+	var keys []string
+	for _, t := range tenants {
+		for n := 0; n < t.keys; n++ {
+			keys = append(keys, t.key(n))
+		}
+	}
+	return keys
+}
+
+type tenantReport struct {
+	Name            string         `json:"name"`
+	Prefix          string         `json:"prefix"`
+	Clients         int            `json:"clients"`
+	Keys            int            `json:"keys"`
+	ReadPct         float64        `json:"read_pct"`
+	Requests        int64          `json:"requests"`
+	Failed          int64          `json:"failed"`
+	Throughput      float64        `json:"throughput_rps"`
+	CacheHitRatePct *float64       `json:"cache_hit_rate_pct,omitempty"`
+	ServiceTime     latencySummary `json:"service_time"`
+}
+
+func tenantReports(tenants []tenant, byClient []int, workers []*aggregator, testDuration time.Duration) []tenantReport {
+	reports := make([]tenantReport, len(tenants))
+	merged := make([]*aggregator, len(tenants))
+	for i, t := range tenants {
+		reports[i] = tenantReport{Name: t.name, Prefix: t.prefix(), Keys: t.keys, ReadPct: t.readPct}
+		merged[i] = newAggregator(false, false, time.Time{})
+	}
+	for c, w := range workers {
+		reports[byClient[c]].Clients++
+		merged[byClient[c]].merge(w)
+	}
+	for i, a := range merged {
+		r := &reports[i]
+		r.Requests = a.requests
+		r.Failed = a.errors
+		r.Throughput = float64(a.succeeded()) / testDuration.Seconds()
+		r.ServiceTime = a.service.summary()
+		if rate, ok := a.cache.rate(); ok {
+			r.CacheHitRatePct = &rate
+		}
+	}
+	return reports
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	thinkFixed       = "fixed"
+	thinkUniform     = "uniform"
+	thinkExponential = "exponential"
+)
+
+func validateThinkDist(dist string) error {
+	switch dist {
+	case thinkFixed, thinkUniform, thinkExponential:
+		return nil
+	}
+	return fmt.Errorf("unknown think time distribution %q (want fixed, uniform, or exponential)", dist)
+}
+
+// nextThinkTime draws a think time whose mean is the configured value for
+// every distribution, so offered load is comparable across them.
+func (cfg *workerConfig) nextThinkTime(rng *rand.Rand) time.Duration {
+	if cfg.thinkTime <= 0 {
+		return 0
+	}
+	switch cfg.thinkDist {
+	case thinkUniform:
+		return time.Duration(rng.Int63n(2 * int64(cfg.thinkTime)))
+	case thinkExponential:
+		return time.Duration(rng.ExpFloat64() * float64(cfg.thinkTime))
+	default:
+		return cfg.thinkTime
+	}
+}
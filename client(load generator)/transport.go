@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+// unixTransport sends every request over the Unix socket at path whatever
+// the URL's host, so targets stay nominal (e.g. http://localhost).
+func unixTransport(path string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	var d net.Dialer
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, "unix", path)
+	}
+	return t
+}
+
+// h2cTransport speaks cleartext HTTP/2 with prior knowledge, multiplexing
+// all requests to a host over one connection.
+func h2cTransport(unixSocket string) *http2.Transport {
+	var d net.Dialer
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			if unixSocket != "" {
+				return d.DialContext(ctx, "unix", unixSocket)
+			}
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// trackingTransport counts the connections a worker opens, the requests
+// sent on a reused connection, and the protocol of each response.
+type trackingTransport struct {
+	base   http.RoundTripper
+	trace  *httptrace.ClientTrace
+	conns  atomic.Int64
+	reused atomic.Int64
+
+	mu     sync.Mutex
+	protos map[string]int64
+}
+
+func newTrackingTransport(base http.RoundTripper) *trackingTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &trackingTransport{base: base, protos: make(map[string]int64)}
+	t.trace = &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.reused.Add(1)
+			} else {
+				t.conns.Add(1)
+			}
+		},
+	}
+	return t
+}
+
+func (t *trackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if httptrace.ContextClientTrace(req.Context()) != t.trace {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), t.trace))
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		t.mu.Lock()
+		t.protos[resp.Proto]++
+		t.mu.Unlock()
+	}
+	return resp, err
+}
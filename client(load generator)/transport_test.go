@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConnectionReuse guards against the workers closing response bodies
+// unread, which makes every request open a new connection.
+func TestConnectionReuse(t *testing.T) {
+	body := strings.Repeat("v", 10<<10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			http.Error(w, body, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	// http.Error ends the body with a newline.
+	for path, size := range map[string]int64{"/kv/k": int64(len(body)), "/kv/missing": int64(len(body)) + 1} {
+		t.Run(path, func(t *testing.T) {
+			tt := newTrackingTransport(&http.Transport{})
+			rq := newRequester(&http.Client{Transport: tt}, &workerConfig{opTimeout: 5 * time.Second})
+			op := operation{method: "GET", url: ts.URL + path}
+			const n = 500
+			for range n {
+				if out := rq.attempt(op, false); out.bodySize != size {
+					t.Fatalf("GET %s: status %d, %d body bytes", path, out.status, out.bodySize)
+				}
+			}
+			conns, reused := tt.conns.Load(), tt.reused.Load()
+			if ratio := float64(reused) / float64(conns+reused); conns > 1 || ratio < 0.99 {
+				t.Errorf("%d requests opened %d connections and reused %d (%.1f%%)", n, conns, reused, ratio*100)
+			}
+		})
+	}
+}
+
+func TestDrainCloseReusesConnection(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("v", 10<<10)))
+	}))
+	defer ts.Close()
+	tt := newTrackingTransport(&http.Transport{})
+	client := &http.Client{Transport: tt}
+	for range 100 {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		drainClose(resp.Body)
+	}
+	if conns := tt.conns.Load(); conns != 1 {
+		t.Errorf("100 drained responses opened %d connections", conns)
+	}
+}
+
+// TestUnixTransport checks that the nominal URL's host is ignored and
+// every request goes over the socket.
+func TestUnixTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" "+r.URL.Path)
+	}))
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	c := &http.Client{Transport: unixTransport(path)}
+	resp, err := c.Get("http://localhost:8080/kv/k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "localhost:8080 /kv/k" {
+		t.Errorf("served %q, want the nominal host and path", body)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxReportedTTLViolations = 20
+	// ttlMaxPending caps the keys a worker has written but not yet checked
+	// after expiry; at the cap it waits for the next check instead of writing.
+	ttlMaxPending = 256
+)
+
+type ttlCheckKind int
+
+const (
+	ttlWrite ttlCheckKind = iota
+	ttlBefore
+	ttlAfter
+)
+
+// ttlSample is the outcome of one step of the ttl workload: a write, or a
+// read before or after the key's expected expiry. lo and hi bound the
+// server clock offset (server minus client) from the response's Date.
+type ttlSample struct {
+	kind      ttlCheckKind
+	violation string
+	lo, hi    time.Duration
+	hasDate   bool
+}
+
+type ttlReport struct {
+	Writes        int64    `json:"writes"`
+	ChecksBefore  int64    `json:"checks_before_expiry"`
+	ChecksAfter   int64    `json:"checks_after_expiry"`
+	Premature     int64    `json:"premature_expirations"`
+	Late          int64    `json:"late_expirations"`
+	Tolerance     string   `json:"tolerance,omitempty"`
+	ClockOffsetMs *float64 `json:"server_clock_offset_ms,omitempty"`
+	// ClockStepped is set when the offset measured by the clock sync
+	// before the run falls outside the bounds the Date headers gave
+	// during it: a clock was stepped, and expiries timed on the server
+	// may be off by the step.
+	ClockStepped bool     `json:"clock_stepped,omitempty"`
+	Examples     []string `json:"violation_examples,omitempty"`
+
+	lo, hi time.Duration
+}
+
+// ttlKey is a key written with a TTL. Its expiry, as applied by the
+// server at some point while the PUT was in flight, lies between
+// sent+ttl and acked+ttl on the client's clock.
+type ttlKey struct {
+	key         string
+	ttl         time.Duration
+	sent, acked time.Time
+	due         time.Time
+	kind        ttlCheckKind
+}
+
+type ttlQueue []*ttlKey
+
+func (q ttlQueue) Len() int           { return len(q) }
+func (q ttlQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q ttlQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *ttlQueue) Push(x any)        { *q = append(*q, x.(*ttlKey)) }
+func (q *ttlQueue) Pop() any {
+	old := *q
+	k := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return k
+}
+
+// ttlWorker writes keys with a random TTL from its own never-reused key
+// range, then reads each one once at a random point before its expiry and
+// once just after expiry plus the tolerance. Because both the expiry and
+// the reads are timed on the client's clock relative to the write, the
+// offset between client and server clocks cancels out; the tolerance
+// covers request jitter and drift between the server's and the
+// database's clocks.
+type ttlWorker struct {
+	id      int
+	seq     int
+	base    string
+	pending ttlQueue
+	rng     *rand.Rand
+}
+
+func newTTLWorker(id int, cfg *workerConfig) *ttlWorker {
+	return &ttlWorker{id: id, base: cfg.writeTargetFor(id) + cfg.pathPrefix, rng: cfg.rng(cfg.idBase + id)}
+}
+
+func (t *ttlWorker) step(client *http.Client, cfg *workerConfig, stopChan <-chan struct{}) Result {
+	if len(t.pending) >= ttlMaxPending {
+		select {
+		case <-stopChan:
+			return Result{}
+		case <-time.After(time.Until(t.pending[0].due)):
+		}
+	}
+	if len(t.pending) > 0 && !time.Now().Before(t.pending[0].due) {
+		return t.check(client, cfg, heap.Pop(&t.pending).(*ttlKey))
+	}
+	return t.write(client, cfg)
+}
+
+func (t *ttlWorker) write(client *http.Client, cfg *workerConfig) Result {
+	k := &ttlKey{key: fmt.Sprintf("ttl-%d-%d", t.id, t.seq)}
+	t.seq++
+	k.ttl = cfg.ttlMin
+	if cfg.ttlMax > cfg.ttlMin {
+		k.ttl += time.Duration(t.rng.Int63n(int64(cfg.ttlMax - cfg.ttlMin)))
+	}
+	k.ttl = k.ttl.Round(time.Millisecond)
+	body := "ttl-" + k.key
+	res, status, date, sent, acked := ttlRequest(client, "PUT", t.base+k.key+"?ttl="+k.ttl.String(), body, cfg.opTimeout)
+	res.ttl = &ttlSample{kind: ttlWrite}
+	res.ttl.setDate(date, sent, acked)
+	if res.isError {
+		return res
+	}
+	if status >= 300 {
+		res.isError, res.errClass = true, httpErrorClass(status)
+		return res
+	}
+	k.sent, k.acked = sent, acked
+	if before := k.ttl - cfg.ttlTolerance; before > 0 {
+		k.kind = ttlBefore
+		k.due = sent.Add(time.Duration(t.rng.Int63n(int64(before))))
+	} else {
+		k.kind = ttlAfter
+		k.due = acked.Add(k.ttl + cfg.ttlTolerance)
+	}
+	heap.Push(&t.pending, k)
+	return res
+}
+
+func (t *ttlWorker) check(client *http.Client, cfg *workerConfig, k *ttlKey) Result {
+	res, status, date, sent, done := ttlRequest(client, "GET", t.base+k.key, "", cfg.opTimeout)
+	s := &ttlSample{kind: k.kind}
+	s.setDate(date, sent, done)
+	res.ttl = s
+	if res.isError {
+		return res
+	}
+	switch {
+	case status != http.StatusOK && status != http.StatusNotFound:
+		res.isError, res.errClass = true, errHTTP
+	case k.kind == ttlBefore && status == http.StatusNotFound && done.Before(k.sent.Add(k.ttl-cfg.ttlTolerance)):
+		s.violation = fmt.Sprintf("%s (ttl %s) gone %s after the PUT was sent%s", k.key, k.ttl, done.Sub(k.sent).Round(time.Millisecond), atServerTime(cfg.clock, sent))
+	case k.kind == ttlAfter && status == http.StatusOK && sent.After(k.acked.Add(k.ttl+cfg.ttlTolerance)):
+		s.violation = fmt.Sprintf("%s (ttl %s) still readable %s after the PUT was acknowledged%s", k.key, k.ttl, sent.Sub(k.acked).Round(time.Millisecond), atServerTime(cfg.clock, sent))
+	}
+	if k.kind == ttlBefore {
+		k.kind = ttlAfter
+		k.due = k.acked.Add(k.ttl + cfg.ttlTolerance)
+		heap.Push(&t.pending, k)
+	}
+	return res
+}
+
+// atServerTime says when a violating read was sent on the server's clock,
+// to find it in the server's logs.
+func atServerTime(clock *clockSync, sent time.Time) string {
+	if st := clock.serverTime(sent); st != nil {
+		return fmt.Sprintf(" (read sent at %s server time)", st.UTC().Format("15:04:05.000"))
+	}
+	return ""
+}
+
+// checkClock compares the clock sync's offset with the Date header bounds.
+func (r *ttlReport) checkClock(clock *clockSync) {
+	if clock == nil || r.ClockOffsetMs == nil {
+		return
+	}
+	r.ClockStepped = clock.offset+clock.uncertainty < r.lo || clock.offset-clock.uncertainty > r.hi
+}
+
+// ttlRequest sends one request without retries: a retried read could
+// straddle the expiry. A 404 is a valid answer here, not an error.
+func ttlRequest(client *http.Client, method, url, body string, timeout time.Duration) (res Result, status int, date string, sent, done time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return Result{isError: true, errClass: errRequest}, 0, "", sent, done
+	}
+	sent = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		done = time.Now()
+		res = Result{responseTime: done.Sub(sent), correctedTime: done.Sub(sent), isError: true, errClass: errConnection}
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			res.errClass = errTimeout
+		}
+		return res, 0, "", sent, done
+	}
+	n, _ := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	done = time.Now()
+	res = Result{
+		responseTime:  done.Sub(sent),
+		correctedTime: done.Sub(sent),
+		cache:         parseCacheOutcome(resp.Header.Get("X-Cache")),
+		bytesSent:     int64(len(body)),
+		bytesReceived: n,
+	}
+	return res, resp.StatusCode, resp.Header.Get("Date"), sent, done
+}
+
+// setDate bounds the server clock offset from a Date header, which is
+// truncated to the second: the server's clock read somewhere in
+// [date, date+1s) while the client's read somewhere in [sent, done].
+func (s *ttlSample) setDate(date string, sent, done time.Time) {
+	d, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+	s.lo, s.hi, s.hasDate = d.Sub(done), d.Add(time.Second).Sub(sent), true
+}
+
+type ttlStats struct {
+	writes, before, after int64
+	premature, late       int64
+	examples              []string
+
+	// lo and hi intersect every sample's offset bounds; many samples
+	// landing at different points within the second narrow it well below
+	// the Date header's one-second resolution.
+	lo, hi  time.Duration
+	hasDate bool
+}
+
+func (ts *ttlStats) add(s *ttlSample) {
+	switch s.kind {
+	case ttlWrite:
+		ts.writes++
+	case ttlBefore:
+		ts.before++
+	case ttlAfter:
+		ts.after++
+	}
+	if s.violation != "" {
+		if s.kind == ttlBefore {
+			ts.premature++
+		} else {
+			ts.late++
+		}
+		if len(ts.examples) < maxReportedTTLViolations {
+			ts.examples = append(ts.examples, s.violation)
+		}
+	}
+	if s.hasDate {
+		ts.bound(s.lo, s.hi)
+	}
+}
+
+func (ts *ttlStats) bound(lo, hi time.Duration) {
+	if !ts.hasDate {
+		ts.lo, ts.hi, ts.hasDate = lo, hi, true
+		return
+	}
+	ts.lo, ts.hi = max(ts.lo, lo), min(ts.hi, hi)
+}
+
+func (ts *ttlStats) merge(o *ttlStats) {
+	ts.writes += o.writes
+	ts.before += o.before
+	ts.after += o.after
+	ts.premature += o.premature
+	ts.late += o.late
+	for _, e := range o.examples {
+		if len(ts.examples) < maxReportedTTLViolations {
+			ts.examples = append(ts.examples, e)
+		}
+	}
+	if o.hasDate {
+		ts.bound(o.lo, o.hi)
+	}
+}
+
+func (ts *ttlStats) report() *ttlReport {
+	r := &ttlReport{
+		Writes:       ts.writes,
+		ChecksBefore: ts.before,
+		ChecksAfter:  ts.after,
+		Premature:    ts.premature,
+		Late:         ts.late,
+		Examples:     ts.examples,
+	}
+	// Crossed bounds mean a clock stepped during the run; no estimate then.
+	if ts.hasDate && ts.lo <= ts.hi {
+		ms := float64(ts.lo+ts.hi) / 2 / float64(time.Millisecond)
+		r.ClockOffsetMs = &ms
+		r.lo, r.hi = ts.lo, ts.hi
+	}
+	sort.Strings(r.Examples)
+	return r
+}
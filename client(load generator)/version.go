@@ -0,0 +1,55 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.buildVersion=1.9.0 -X main.buildCommit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without them, the commit and its time come from the VCS stamp go build
+// embeds, if any.
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+	buildTime    = ""
+)
+
+// buildInfo describes a binary: the load generator's own, or the server's
+// as its /version reports it.
+type buildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Time    string `json:"time"`
+	Go      string `json:"go"`
+}
+
+func (b *buildInfo) String() string {
+	return b.Version + " (commit " + b.Commit + ", " + b.Time + ", " + b.Go + ")"
+}
+
+var currentBuild = sync.OnceValue(func() buildInfo {
+	b := buildInfo{Version: buildVersion, Commit: buildCommit, Time: buildTime, Go: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value[:min(len(s.Value), 12)]
+			case s.Key == "vcs.time" && b.Time == "":
+				b.Time = s.Value
+			case s.Key == "vcs.modified" && s.Value == "true" && buildCommit == "":
+				b.Commit += "-dirty"
+			}
+		}
+	}
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.Time == "" {
+		b.Time = "unknown"
+	}
+	return b
+})
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var workloads = []string{"get-popular", "put-all", "get-all", "mixed", "churn", "tenants", "coherence", "ttl", "churn-delete"}
+
+func parseTargets(spec string) ([]string, error) {
+	var targets []string
+	for _, t := range strings.Split(spec, ",") {
+		t = strings.TrimSuffix(strings.TrimSpace(t), "/")
+		if t == "" {
+			continue
+		}
+		if !strings.HasPrefix(t, "http://") && !strings.HasPrefix(t, "https://") {
+			return nil, fmt.Errorf("target %q must start with http:// or https://", t)
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("at least one target is required")
+	}
+	return targets, nil
+}
+
+// readTargetFor and writeTargetFor spread workers over the configured
+// targets round-robin; both lists are -target unless overridden.
+func (cfg *workerConfig) readTargetFor(id int) string {
+	return cfg.readTargets[id%len(cfg.readTargets)]
+}
+
+func (cfg *workerConfig) writeTargetFor(id int) string {
+	return cfg.writeTargets[id%len(cfg.writeTargets)]
+}
+
+// normalizePathPrefix turns "cache" or "/cache" into "/cache/".
+func normalizePathPrefix(p string) string {
+	return "/" + strings.Trim(p, "/") + "/"
+}
+
+// rng returns worker id's source of random choices. With -seed it is
+// seeded from it, so the worker repeats its sequence of requests.
+func (cfg *workerConfig) rng(id int) *rand.Rand {
+	seed := cfg.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed + int64(id)))
+}
+
+// maxWorkerURLs bounds the URLs a worker keeps as strings for reuse.
+const maxWorkerURLs = 1024
+
+// workerKeys walks worker id's own range key-{id}-{0..keysPerClient-1},
+// or its slice of the -key-template IDs.
+type workerKeys struct {
+	id     int
+	seq    int
+	churn  *churnKeys
+	tenant int
+	rng    *rand.Rand
+	// reads is set on the first read with -key-template.
+	reads *idPicker
+
+	// URLs are formatted into buf and looked up in urls, so a URL seen
+	// before costs no allocation.
+	readBase, writeBase string
+	buf                 []byte
+	urls                map[string]string
+}
+
+// url returns base followed by key-{owner}-{n}.
+func (k *workerKeys) url(base string, owner, n int) string {
+	k.buf = append(append(k.buf[:0], base...), "key-"...)
+	k.buf = strconv.AppendInt(k.buf, int64(owner), 10)
+	k.buf = strconv.AppendInt(append(k.buf, '-'), int64(n), 10)
+	return k.intern()
+}
+
+// idURL returns base followed by the key of id through t.
+func (k *workerKeys) idURL(base string, t *keyTemplate, id int64) string {
+	k.buf = t.appendKey(append(k.buf[:0], base...), id)
+	return k.intern()
+}
+
+func (k *workerKeys) keyURL(base, key string) string {
+	k.buf = append(append(k.buf[:0], base...), key...)
+	return k.intern()
+}
+
+func (k *workerKeys) intern() string {
+	if s, ok := k.urls[string(k.buf)]; ok {
+		return s
+	}
+	s := string(k.buf)
+	if k.urls == nil {
+		k.urls = make(map[string]string)
+	}
+	if len(k.urls) < maxWorkerURLs {
+		k.urls[s] = s
+	}
+	return s
+}
+
+func (k *workerKeys) nextWrite(cfg *workerConfig) string {
+	if t := cfg.keyTemplate; t != nil {
+		first, count := t.slice(k.id, cfg.allClients)
+		url := k.idURL(k.writeBase, t, first+int64(k.seq)%count)
+		k.seq++
+		return url
+	}
+	url := k.url(k.writeBase, k.id, k.seq%cfg.keysPerClient)
+	k.seq++
+	return url
+}
+
+// nextRead picks a key from the worker's own range, or from any worker's
+// range with -read-others. With -key-template, -key-dist picks the ID.
+func (k *workerKeys) nextRead(cfg *workerConfig) string {
+	if t := cfg.keyTemplate; t != nil {
+		first, count := t.slice(k.id, cfg.allClients)
+		if cfg.readOthers {
+			first, count = t.lo, t.size()
+		}
+		if k.reads == nil {
+			k.reads = newIDPicker(k.rng, cfg.keyDist, count)
+		}
+		return k.idURL(k.readBase, t, first+k.reads.next(k.rng))
+	}
+	owner := k.id
+	if cfg.readOthers {
+		owner = k.rng.Intn(cfg.allClients)
+	}
+	return k.url(k.readBase, owner, k.rng.Intn(cfg.keysPerClient))
+}
+
+func nextOperation(cfg *workerConfig, keys *workerKeys) operation {
+	if keys.readBase == "" {
+		keys.readBase = cfg.readTargetFor(keys.id) + cfg.pathPrefix
+		keys.writeBase = cfg.writeTargetFor(keys.id) + cfg.pathPrefix
+	}
+	base, writeBase := keys.readBase, keys.writeBase
+
+	switch cfg.workload {
+	case "get-popular":
+		key := popularKeys[keys.rng.Intn(len(popularKeys))]
+		return operation{method: "GET", url: keys.keyURL(base, key)}
+
+	case "put-all":
+		return operation{method: "PUT", url: keys.nextWrite(cfg), body: "some-data-payload"}
+
+	case "get-all":
+		return operation{method: "GET", url: keys.nextRead(cfg)}
+
+	case "tenants":
+		t := cfg.tenants[keys.tenant]
+		key := t.key(keys.rng.Intn(t.keys))
+		if keys.rng.Float64()*100 < t.readPct {
+			return operation{method: "GET", url: base + key}
+		}
+		return operation{method: "PUT", url: writeBase + key, body: primeValue(key)}
+
+	case "churn":
+		return operation{method: "GET", url: base + keys.churn.next(cfg)}
+
+	case "mixed":
+		if cfg.pools != nil {
+			return cfg.pools.next(cfg, keys)
+		}
+		if keys.rng.Float32() < 0.5 {
+			key := popularKeys[keys.rng.Intn(len(popularKeys))]
+			return operation{method: "GET", url: keys.keyURL(base, key)}
+		}
+		url := keys.nextWrite(cfg)
+		return operation{method: "PUT", url: url, body: "data-mixed-" + strings.TrimPrefix(url, writeBase)}
+	}
+
+	log.Fatalf("Unknown workload type: %s", cfg.workload)
+	return operation{}
+}